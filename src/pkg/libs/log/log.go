@@ -12,6 +12,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"pkg/libs/atomic2"
 	"pkg/libs/errors"
 	"pkg/libs/trace"
 )
@@ -175,28 +176,28 @@ func (l *Logger) Panic(v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprint(v...)
 	l.output(1, nil, t, s)
-	os.Exit(1)
+	exit(nil, s)
 }
 
 func (l *Logger) Panicf(format string, v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprintf(format, v...)
 	l.output(1, nil, t, s)
-	os.Exit(1)
+	exit(nil, s)
 }
 
 func (l *Logger) PanicError(err error, v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprint(v...)
 	l.output(1, err, t, s)
-	os.Exit(1)
+	exit(err, s)
 }
 
 func (l *Logger) PanicErrorf(err error, format string, v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprintf(format, v...)
 	l.output(1, err, t, s)
-	os.Exit(1)
+	exit(err, s)
 }
 
 func (l *Logger) Error(v ...interface{}) {
@@ -385,12 +386,61 @@ func (l *Logger) output(traceskip int, err error, t LogType, s string) error {
 		fmt.Fprint(&b, "[stack]: \n", stack.StringWithIndent(1))
 	}
 
+	if t == TYPE_PANIC {
+		if hook, _ := panicHook.Load().(func(string)); hook != nil {
+			hook(b.String())
+		}
+	}
+
 	s = b.String()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	return l.log.Output(traceskip+2, s)
 }
 
+var panicHook atomic.Value
+
+// SetPanicHook sets the function called with the message on panic, before the process exits.
+func SetPanicHook(hook func(msg string)) {
+	panicHook.Store(hook)
+}
+
+// Fatal is raised by the Panic functions instead of exiting the process once SetPanicRecoverable(true).
+type Fatal struct {
+	Msg string
+	Err error
+}
+
+func (f *Fatal) Error() string {
+	if f.Err == nil {
+		return f.Msg
+	}
+	return fmt.Sprintf("%s: %v", f.Msg, f.Err)
+}
+
+var panicRecoverable atomic2.Bool
+
+/*
+ * SetPanicRecoverable makes the Panic functions raise *Fatal by panic instead of exiting the
+ * process, so that the routine recovering it can quit alone. The routine which doesn't recover
+ * it still takes down the process.
+ */
+func SetPanicRecoverable(recoverable bool) {
+	panicRecoverable.Set(recoverable)
+}
+
+// whether the Panic functions raise *Fatal, see SetPanicRecoverable
+func PanicRecoverable() bool {
+	return panicRecoverable.Get()
+}
+
+func exit(err error, s string) {
+	if panicRecoverable.Get() {
+		panic(&Fatal{Msg: s, Err: err})
+	}
+	os.Exit(1)
+}
+
 func Flags() int {
 	return StdLog.log.Flags()
 }
@@ -419,28 +469,28 @@ func Panic(v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprint(v...)
 	StdLog.output(1, nil, t, s)
-	os.Exit(1)
+	exit(nil, s)
 }
 
 func Panicf(format string, v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprintf(format, v...)
 	StdLog.output(1, nil, t, s)
-	os.Exit(1)
+	exit(nil, s)
 }
 
 func PanicError(err error, v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprint(v...)
 	StdLog.output(1, err, t, s)
-	os.Exit(1)
+	exit(err, s)
 }
 
 func PanicErrorf(err error, format string, v ...interface{}) {
 	t := TYPE_PANIC
 	s := fmt.Sprintf(format, v...)
 	StdLog.output(1, err, t, s)
-	os.Exit(1)
+	exit(err, s)
 }
 
 func Error(v ...interface{}) {
@@ -5,10 +5,12 @@ package rdb
 
 import (
 	"bytes"
+	"encoding/binary"
 
 	"pkg/libs/cupcake/rdb"
 	"pkg/libs/cupcake/rdb/nopdecoder"
 	"pkg/libs/errors"
+	"pkg/rdb/digest"
 )
 
 func DecodeDump(p []byte) (interface{}, error) {
@@ -19,6 +21,24 @@ func DecodeDump(p []byte) (interface{}, error) {
 	return d.obj, d.err
 }
 
+// DecodeStringDump returns the string and the rdb version in the DUMP payload of the string. Unlike
+// DecodeDump, the payload of any rdb version is accepted.
+func DecodeStringDump(p []byte) ([]byte, uint16, error) {
+	if len(p) < 10 || p[0] != RdbTypeString {
+		return nil, 0, errors.Errorf("invalid string dump")
+	}
+	c := digest.New()
+	c.Write(p[:len(p)-8])
+	if c.Sum64() != binary.LittleEndian.Uint64(p[len(p)-8:]) {
+		return nil, 0, errors.Errorf("invalid string dump checksum")
+	}
+	s, err := NewRdbReader(bytes.NewReader(p[1 : len(p)-10])).ReadString()
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	return s, binary.LittleEndian.Uint16(p[len(p)-10:]), nil
+}
+
 type decoder struct {
 	nopdecoder.NopDecoder
 	obj interface{}
@@ -5,10 +5,12 @@ package rdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 
 	"github.com/cupcake/rdb"
 	"pkg/libs/errors"
+	"pkg/rdb/digest"
 )
 
 type objectEncoder interface {
@@ -121,6 +123,20 @@ func EncodeDump(obj interface{}) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// EncodeStringDump returns the DUMP payload of the string in the given rdb version.
+func EncodeStringDump(s []byte, version uint16) ([]byte, error) {
+	var b bytes.Buffer
+	c := digest.New()
+	w := io.MultiWriter(&b, c)
+	w.Write([]byte{RdbTypeString})
+	if err := String(s).encodeValue(rdb.NewEncoder(w)); err != nil {
+		return nil, err
+	}
+	binary.Write(w, binary.LittleEndian, version)
+	binary.Write(w, binary.LittleEndian, c.Sum64())
+	return b.Bytes(), nil
+}
+
 type Encoder struct {
 	enc *rdb.Encoder
 	db  int64
@@ -5,6 +5,7 @@ package rdb
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"math/rand"
@@ -45,6 +46,35 @@ func TestEncodeString(t *testing.T) {
 	docheck(b.String())
 }
 
+func TestStringDump(t *testing.T) {
+	docheck := func(text string, version uint16) {
+		p, err := EncodeStringDump([]byte(text), version)
+		assert.MustNoError(err)
+		s, v, err := DecodeStringDump(p)
+		assert.MustNoError(err)
+		assert.Must(string(s) == text && v == version)
+		if version == 6 {
+			o, err := DecodeDump(p)
+			assert.MustNoError(err)
+			checkString(t, o, text)
+		}
+	}
+	docheck("hello world!!", 6)
+	docheck("hello world!!", 10)
+	docheck("4294967296", 9)
+	docheck("", 10)
+
+	p, err := hex.DecodeString("00c0010600b0958f3624542d6f")
+	assert.MustNoError(err)
+	s, v, err := DecodeStringDump(p)
+	assert.MustNoError(err)
+	assert.Must(string(s) == "1" && v == 6)
+
+	p[1] = 0xc1
+	_, _, err = DecodeStringDump(p)
+	assert.Must(err != nil)
+}
+
 func toList(list ...string) List {
 	o := List{}
 	for _, e := range list {
@@ -20,6 +20,7 @@ type Loader struct {
 	crc       hash.Hash64
 	db        uint32
 	lastEntry *BinEntry
+	version   int64
 }
 
 func NewLoader(r io.Reader) *Loader {
@@ -41,10 +42,17 @@ func (l *Loader) Header() error {
 		return errors.Trace(err)
 	} else if version <= 0 || version > FromVersion {
 		return errors.Errorf("verify version, invalid RDB version number %d, %d", version, FromVersion)
+	} else {
+		l.version = version
 	}
 	return nil
 }
 
+// rdb version parsed from the header
+func (l *Loader) Version() int64 {
+	return l.version
+}
+
 func (l *Loader) Footer() error {
 	crc1 := l.crc.Sum64()
 	if crc2, err := l.readUint64(); err != nil {
@@ -62,6 +70,7 @@ type BinEntry struct {
 	Value           []byte
 	ExpireAt        uint64
 	RealMemberCount uint32
+	TotMemberCount  uint32 // members of the whole value if it's split
 	NeedReadLen     byte
 	IdleTime        uint32
 	Freq            uint8
@@ -213,6 +222,7 @@ func (l *Loader) NextBinEntry() (*BinEntry, error) {
 			} else {
 				// RealMemberCount > 0 means this is big entry which also is a split key.
 				entry.RealMemberCount = l.lastReadCount
+				entry.TotMemberCount = l.totMemberCount
 			}
 			l.lastEntry = entry
 			return entry, nil
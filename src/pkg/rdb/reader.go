@@ -54,6 +54,25 @@ const (
 	rdbModuleOpcodeString = 5
 )
 
+// return the redis type name of the rdb value type, empty if it isn't a key type.
+func TypeName(t byte) string {
+	switch t {
+	case RdbTypeString:
+		return "string"
+	case RdbTypeList, RdbTypeListZiplist, RdbTypeQuicklist:
+		return "list"
+	case RdbTypeSet, RdbTypeSetIntset:
+		return "set"
+	case RdbTypeZSet, RdbTypeZSet2, RdbTypeZSetZiplist:
+		return "zset"
+	case RdbTypeHash, RdbTypeHashZipmap, RdbTypeHashZiplist:
+		return "hash"
+	case RDBTypeStreamListPacks:
+		return "stream"
+	}
+	return ""
+}
+
 const (
 	rdb6bitLen  = 0
 	rdb14bitLen = 1
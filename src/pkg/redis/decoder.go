@@ -32,6 +32,10 @@ func Decode(r *bufio.Reader) (Resp, error) {
 	return d.decodeResp(0)
 }
 
+func (d *Decoder) Decode() (Resp, error) {
+	return d.decodeResp(0)
+}
+
 func MustDecodeOpt(d *Decoder) Resp {
 	resp, err := d.decodeResp(0)
 	if err != nil {
@@ -1,10 +1,26 @@
 package base
 
+import "sync/atomic"
+
 var(
-	Status = "null"
+	status atomic.Value // the phase of the process, see SetStatus
 	RDBPipeSize = 1024
 )
 
+// SetStatus sets the phase of the process, e.g., "full" and "incr", which is set by the routines
+// of the syncers and read by the metric and the heartbeat.
+func SetStatus(s string) {
+	status.Store(s)
+}
+
+// GetStatus returns the phase of the process, "null" before it's set.
+func GetStatus() string {
+	if s, ok := status.Load().(string); ok {
+		return s
+	}
+	return "null"
+}
+
 type Runner interface{
 	Main()
 
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// aliyunCluster is the proxy of the cluster of aliyun, whose nodes are scanned by ISCAN with the
+// index of the node. The OPINFO of the oplog in its replication stream is dropped.
+type aliyunCluster struct {
+	cloudBase
+}
+
+func (aliyunCluster) VendorCommand(name string) bool {
+	return strings.EqualFold(name, "opinfo")
+}
+
+func (aliyunCluster) ScanNodes(c redigo.Conn) ([]string, error) {
+	info, err := redigo.Bytes(c.Do("info", "Cluster"))
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.ParseInt(ParseInfo(info)["nodecount"], 10, 0)
+	if err != nil {
+		return nil, err
+	} else if count <= 0 {
+		return nil, fmt.Errorf("source node count[%v] illegal", count)
+	}
+	nodes := make([]string, count)
+	for i := range nodes {
+		nodes[i] = strconv.Itoa(i)
+	}
+	return nodes, nil
+}
+
+func (aliyunCluster) Scan(c redigo.Conn, node string, cursor int64, count int64) (interface{}, error) {
+	return c.Do("iscan", node, cursor, "count", count)
+}
@@ -0,0 +1,474 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg/libs/atomic2"
+	"pkg/libs/io/pipe"
+	"pkg/libs/log"
+	"pkg/rdb"
+	"pkg/redis"
+)
+
+/*
+ * AofWriter appends the commands in RESP format into the file. Once the file size exceeds
+ * maxSize, it's renamed to "${name}.${index}" and a new file is opened, the index starts
+ * from 1. maxSize = 0 means never rotate.
+ */
+type AofWriter struct {
+	name    string
+	maxSize int64
+
+	f     *os.File
+	bw    *bufio.Writer
+	size  int64
+	index int
+}
+
+func NewAofWriter(name string, maxSize int64) *AofWriter {
+	w := &AofWriter{
+		name:    name,
+		maxSize: maxSize,
+	}
+	w.open()
+	return w
+}
+
+func (w *AofWriter) open() {
+	f, err := os.OpenFile(w.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.PanicErrorf(err, "open aof file[%v] failed", w.name)
+	}
+	s, err := f.Stat()
+	if err != nil {
+		log.PanicErrorf(err, "stat aof file[%v] failed", w.name)
+	}
+	w.f = f
+	w.bw = bufio.NewWriterSize(f, WriterBufferSize)
+	w.size = s.Size()
+}
+
+func (w *AofWriter) rotate() {
+	w.Close()
+	for {
+		w.index++
+		rotated := fmt.Sprintf("%s.%d", w.name, w.index)
+		if _, err := os.Stat(rotated); err == nil {
+			// left by the last run
+			continue
+		}
+		if err := os.Rename(w.name, rotated); err != nil {
+			log.PanicErrorf(err, "rotate aof file[%v] to [%v] failed", w.name, rotated)
+		}
+		log.Infof("rotate aof file[%v] to [%v]", w.name, rotated)
+		break
+	}
+	w.open()
+}
+
+// append one command
+func (w *AofWriter) Write(cmd string, args [][]byte) {
+	if w.maxSize > 0 && w.size >= w.maxSize {
+		w.rotate()
+	}
+
+	resp := redis.NewArray()
+	resp.AppendBulkBytes([]byte(cmd))
+	for _, arg := range args {
+		resp.AppendBulkBytes(arg)
+	}
+	data, err := redis.EncodeToBytes(resp)
+	if err != nil {
+		log.PanicErrorf(err, "encode command[%v] into aof failed", cmd)
+	}
+	if _, err := w.bw.Write(data); err != nil {
+		log.PanicErrorf(err, "write aof file[%v] failed", w.name)
+	}
+	w.size += int64(len(data))
+}
+
+func (w *AofWriter) Flush() {
+	if err := w.bw.Flush(); err != nil {
+		log.PanicErrorf(err, "flush aof file[%v] failed", w.name)
+	}
+}
+
+func (w *AofWriter) Close() {
+	w.Flush()
+	w.f.Close()
+}
+
+const (
+	aofTailInterval    = 100 * time.Millisecond // wait for more at the end of the aof
+	aofManifestSuffix  = ".manifest"
+	aofManifestBase    = "b"
+	aofManifestHistory = "h"
+	aofManifestIncr    = "i"
+)
+
+// one file in the manifest of the multi-part aof
+type AofManifestFile struct {
+	Name string // path joined with the dir of the manifest
+	Seq  int64
+	Type string
+}
+
+// IsAofManifest returns whether the aof is the manifest of the multi-part aof of redis 7.
+func IsAofManifest(name string) bool {
+	return strings.HasSuffix(name, aofManifestSuffix)
+}
+
+/*
+ * ReadAofManifest parses the lines like "file appendonly.aof.1.base.rdb seq 1 type b", the base
+ * file is returned separately, and the incr files, including the history ones which aren't
+ * deleted yet, are sorted by seq.
+ */
+func ReadAofManifest(name string) (base *AofManifestFile, incr []AofManifestFile, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := filepath.Dir(name)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, nil, fmt.Errorf("invalid line[%v] in aof manifest[%v]", line, name)
+		}
+		var f AofManifestFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.Name = fields[i+1]
+				if unquoted, err := strconv.Unquote(f.Name); err == nil {
+					f.Name = unquoted
+				}
+				f.Name = filepath.Join(dir, f.Name)
+			case "seq":
+				if f.Seq, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+					return nil, nil, fmt.Errorf("invalid seq in line[%v] of aof manifest[%v]", line, name)
+				}
+			case "type":
+				f.Type = fields[i+1]
+			}
+		}
+		switch f.Type {
+		case aofManifestBase:
+			base = &f
+		case aofManifestHistory, aofManifestIncr:
+			incr = append(incr, f)
+		default:
+			return nil, nil, fmt.Errorf("invalid type in line[%v] of aof manifest[%v]", line, name)
+		}
+	}
+	sort.Slice(incr, func(i, j int) bool {
+		return incr[i].Seq < incr[j].Seq
+	})
+	return base, incr, nil
+}
+
+/*
+ * AofTailer reads the aof file of redis and waits for more at the end like "tail -f", Read only
+ * returns io.EOF after Close, or at the end of the last file if it doesn't follow. The name is
+ * either the single appendonly.aof, or the manifest of the multi-part aof of redis 7 whose incr
+ * files are read one by one in seq: the current file is complete once the next one is in the
+ * manifest, so the rewrite is followed. The single file is replaced by the rewrite with another
+ * one starting with the whole dataset, it can't be followed and Read fails then.
+ */
+type AofTailer struct {
+	name     string // the single aof or the manifest
+	manifest bool
+
+	f      *os.File
+	seq    int64  // the seq of the incr file being read
+	next   string // the file after f, it's opened once f is read to the end again
+	follow bool   // wait for more at the end, the type replay reads the files once
+	closed atomic2.Bool
+}
+
+// NewAofTailer starts from the base if base is set, otherwise the first incr file of the manifest.
+func NewAofTailer(name string, base, follow bool) (*AofTailer, error) {
+	t := &AofTailer{name: name, manifest: IsAofManifest(name), follow: follow}
+	start := name
+	if t.manifest {
+		b, incr, err := ReadAofManifest(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range incr {
+			if f.Type == aofManifestIncr {
+				start, t.seq = f.Name, f.Seq
+				break
+			}
+		}
+		if t.seq == 0 {
+			return nil, fmt.Errorf("no incr file in aof manifest[%v]", name)
+		}
+		if base {
+			if b == nil {
+				return nil, fmt.Errorf("no base file in aof manifest[%v]", name)
+			}
+			// the first incr file follows the base
+			start, t.next = b.Name, start
+			t.seq--
+		}
+	}
+	f, err := os.Open(start)
+	if err != nil {
+		return nil, err
+	}
+	t.f = f
+	return t, nil
+}
+
+func (t *AofTailer) Read(p []byte) (int, error) {
+	for {
+		if t.closed.Get() {
+			t.f.Close()
+			return 0, io.EOF
+		}
+		n, err := t.f.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+
+		if t.next != "" {
+			f, err := os.Open(t.next)
+			if err != nil {
+				return 0, err
+			}
+			log.Infof("tail aof file[%v] after [%v]", t.next, t.f.Name())
+			t.f.Close()
+			t.f, t.next = f, ""
+			t.seq++
+			continue
+		}
+		if t.manifest {
+			if t.next, err = t.nextIncrFile(); err != nil {
+				return 0, err
+			} else if t.next != "" {
+				// the data may be appended before the next file is written into the manifest
+				continue
+			}
+		} else if t.follow {
+			if err := t.checkRewritten(); err != nil {
+				return 0, err
+			}
+		}
+		if !t.follow {
+			// the last file is read to the end
+			return 0, io.EOF
+		}
+		time.Sleep(aofTailInterval)
+	}
+}
+
+// the incr file with seq + 1 in the manifest, it's missing if the file after it is there already
+func (t *AofTailer) nextIncrFile() (string, error) {
+	_, incr, err := ReadAofManifest(t.name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range incr {
+		if f.Seq == t.seq+1 {
+			return f.Name, nil
+		} else if f.Seq > t.seq+1 {
+			return "", fmt.Errorf("incr file with seq[%v] is missing in aof manifest[%v], it's deleted "+
+				"by the rewrite before being read", t.seq+1, t.name)
+		}
+	}
+	return "", nil
+}
+
+func (t *AofTailer) checkRewritten() error {
+	cur, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	pos, err := t.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if s, err := os.Stat(t.name); err != nil || !os.SameFile(s, cur) || s.Size() < pos {
+		return fmt.Errorf("aof file[%v] is rewritten which can't be followed, use the multi-part aof of "+
+			"redis 7 or disable auto-aof-rewrite-percentage on the source", t.name)
+	}
+	return nil
+}
+
+// Close makes Read return io.EOF, it can be called in another routine.
+func (t *AofTailer) Close() error {
+	t.closed.Set(true)
+	return nil
+}
+
+/*
+ * CopyCommands decodes the commands and writes them into w until Read fails, the annotations
+ * between the commands, e.g., "#TS:" written by aof-timestamp-enabled, are dropped.
+ */
+func (t *AofTailer) CopyCommands(w io.Writer) error {
+	br := bufio.NewReaderSize(t, ReaderBufferSize)
+	bw := bufio.NewWriterSize(w, WriterBufferSize)
+	for {
+		if br.Buffered() == 0 {
+			// flush before blocking on the file
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+		b, err := br.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == '#' {
+			if _, err := br.ReadBytes('\n'); err != nil {
+				return err
+			}
+			continue
+		}
+		resp, err := redis.Decode(br)
+		if err != nil {
+			return err
+		}
+		if err := redis.Encode(bw, resp, false); err != nil {
+			return err
+		}
+	}
+}
+
+// the source stream opened by OpenAofSource
+type aofSource struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (s *aofSource) Close() error {
+	for _, c := range s.closers {
+		c.Close()
+	}
+	return nil
+}
+
+/*
+ * OpenAofSource returns the rdb followed by the commands tailed from the aof, which is read the
+ * same way as the stream of SYNC. The stream ends at the end of the aof if follow isn't set. If
+ * rdbFile is empty, the rdb is the base of the manifest or the preamble of the single aof, and
+ * it's empty if the base or the single aof has only the commands. The size of the rdb is 0 if
+ * it's unknown.
+ */
+func OpenAofSource(rdbFile, aofFile string, follow bool) (io.ReadCloser, int64, error) {
+	s := new(aofSource)
+	var size int64
+	var rdbReader io.Reader
+	base := false
+	if rdbFile != "" {
+		f, err := os.Open(rdbFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		rdbReader, size = f, fi.Size()
+		s.closers = append(s.closers, f)
+	} else if IsAofManifest(aofFile) {
+		b, _, err := ReadAofManifest(aofFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		if b == nil {
+			return nil, 0, fmt.Errorf("no base file in aof manifest[%v]", aofFile)
+		}
+		if isRdb, err := hasRdbHeader(b.Name); err != nil {
+			return nil, 0, err
+		} else if isRdb {
+			f, err := os.Open(b.Name)
+			if err != nil {
+				return nil, 0, err
+			}
+			fi, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+			rdbReader, size = f, fi.Size()
+			s.closers = append(s.closers, f)
+		} else {
+			// the commands of the base are read before the incr files
+			base = true
+		}
+	}
+	if !IsAofManifest(aofFile) {
+		if isRdb, err := hasRdbHeader(aofFile); err != nil {
+			s.Close()
+			return nil, 0, err
+		} else if isRdb && rdbFile != "" {
+			s.Close()
+			return nil, 0, fmt.Errorf("aof file[%v] starts with the rdb preamble, source.rdb_file "+
+				"should be empty", aofFile)
+		} else if isRdb {
+			// the preamble is read from the aof itself
+			rdbReader = bytes.NewReader(nil)
+		}
+	}
+	if rdbReader == nil {
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		if err := enc.EncodeHeader(); err != nil {
+			return nil, 0, err
+		}
+		if err := enc.EncodeFooter(); err != nil {
+			return nil, 0, err
+		}
+		rdbReader = &b
+	}
+
+	t, err := NewAofTailer(aofFile, base, follow)
+	if err != nil {
+		s.Close()
+		return nil, 0, err
+	}
+	s.closers = append(s.closers, t)
+	if !t.manifest {
+		// the single aof is written by redis before 7.0 without the annotations
+		s.Reader = io.MultiReader(rdbReader, t)
+		return s, size, nil
+	}
+	piper, pipew := pipe.NewSize(ReaderBufferSize)
+	go func() {
+		pipew.CloseWithError(t.CopyCommands(pipew))
+	}()
+	s.closers = append(s.closers, piper)
+	s.Reader = io.MultiReader(rdbReader, piper)
+	return s, size, nil
+}
+
+func hasRdbHeader(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(f, head); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(head) == "REDIS", nil
+}
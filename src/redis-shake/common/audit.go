@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+)
+
+// reasons of the dropped keys
+const (
+	DropReasonDB      = "db"
+	DropReasonKey     = "key" // filter.key.whitelist and filter.key.blacklist
+	DropReasonSlot    = "slot"
+	DropReasonType    = "type"
+	DropReasonSize    = "size"    // filter.max_value_bytes
+	DropReasonCommand = "command" // e.g., filter.lua
+	DropReasonLimit   = "limit"   // limit_key_count
+	DropReasonMigrate = "migrate" // deleted by MIGRATE on the source cluster, see source.slot_migration
+	DropReasonCollide = "collide" // restored by another shard, see target.merge_collision
+	DropReasonProxy   = "proxy"   // not supported by the proxy target, see ProxyCommand
+)
+
+/*
+ * DropAudit records the keys dropped by the filters for audit. Each key is written as one line
+ * into the file, or into the log if the file isn't given. At most rate lines are written in one
+ * second, the keys over it are only counted, and the number is written once the next second
+ * comes. rate = 0 means no limit. The counts of each reason are kept regardless of the rate.
+ */
+type DropAudit struct {
+	name string // prefix of each line
+	rate int
+
+	mu         sync.Mutex
+	f          *os.File
+	second     int64
+	lines      int
+	suppressed int64
+	counts     map[string]int64
+
+	now func() time.Time // replaced in test
+}
+
+func NewDropAudit(name, file string, rate int) *DropAudit {
+	a := &DropAudit{
+		name:   name,
+		rate:   rate,
+		counts: make(map[string]int64),
+		now:    time.Now,
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.PanicErrorf(err, "open filter.log_dropped.file[%v] failed", file)
+		}
+		a.f = f
+	}
+	return a
+}
+
+// Record the key dropped, cmd is empty for the rdb entry.
+func (a *DropAudit) Record(reason string, db int, cmd string, key []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.counts[reason]++
+	if second := a.now().Unix(); second != a.second {
+		if a.suppressed != 0 {
+			a.write(fmt.Sprintf("%s %d dropped keys aren't logged in the last second", a.name, a.suppressed))
+		}
+		a.second, a.lines, a.suppressed = second, 0, 0
+	}
+	if a.rate > 0 && a.lines >= a.rate {
+		a.suppressed++
+		return
+	}
+	a.lines++
+
+	if cmd != "" {
+		a.write(fmt.Sprintf("%s drop reason[%s] db[%d] command[%s] key[%s]", a.name, reason, db, cmd, key))
+	} else {
+		a.write(fmt.Sprintf("%s drop reason[%s] db[%d] key[%s]", a.name, reason, db, key))
+	}
+}
+
+func (a *DropAudit) write(line string) {
+	if a.f == nil {
+		log.Info(line)
+		return
+	}
+	if _, err := fmt.Fprintf(a.f, "%s %s\n", a.now().Format("2006/01/02 15:04:05"), line); err != nil {
+		log.Warnf("write filter.log_dropped.file[%v] failed[%v]", a.f.Name(), err)
+	}
+}
+
+// Counts returns the number of the keys dropped by each reason.
+func (a *DropAudit) Counts() map[string]int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := make(map[string]int64, len(a.counts))
+	for k, v := range a.counts {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Summary returns the counts as "reason=count" sorted by the reason.
+func (a *DropAudit) Summary() string {
+	return formatCounts(a.Counts())
+}
+
+// the counts as "name=count" sorted by the name
+func formatCounts(counts map[string]int64) string {
+	names := make([]string, 0, len(counts))
+	for k := range counts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	items := make([]string, 0, len(names))
+	for _, k := range names {
+		items = append(items, fmt.Sprintf("%s=%d", k, counts[k]))
+	}
+	return strings.Join(items, " ")
+}
+
+func (a *DropAudit) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+}
@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	AuthProviderFile        = "file"
+	AuthProviderCommand     = "command"
+	AuthProviderElastiCache = "elasticache"
+
+	// separates the user and the password given by ACLPassword, it never shows up in a password
+	aclSeparator = "\x00"
+)
+
+var (
+	// nil means the static password in the configuration is used
+	SourceAuthProvider AuthTokenProvider
+	TargetAuthProvider AuthTokenProvider
+)
+
+// AuthTokenProvider returns the password used by AUTH. It's called every time the connection is
+// (re)opened, so short-lived tokens like the cloud IAM auth token can be refreshed.
+type AuthTokenProvider interface {
+	Token() (string, error)
+}
+
+// read the token from a file which is rotated by other agent.
+type fileTokenProvider struct {
+	path string
+}
+
+func (p *fileTokenProvider) Token() (string, error) {
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// run the command and use the stdout as token.
+type commandTokenProvider struct {
+	args []string
+}
+
+func (p *commandTokenProvider) Token() (string, error) {
+	out, err := exec.Command(p.args[0], p.args[1:]...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// NewAuthTokenProvider parses the provider option, the format is "file:${path}",
+// "command:${command line}", "elasticache:${region}:${cache name}:${user id}[:serverless]", or the
+// secret referenced, e.g., "vault://${path}#${field}", see secretRef. nil is returned if the option
+// is empty.
+func NewAuthTokenProvider(option string) (AuthTokenProvider, error) {
+	if option == "" {
+		return nil, nil
+	}
+	if IsSecretRef(option) {
+		return newSecretTokenProvider(option)
+	}
+
+	idx := strings.Index(option, ":")
+	if idx == -1 {
+		return nil, fmt.Errorf("invalid auth provider[%v], should be 'file:path', 'command:cmd' or "+
+			"'elasticache:region:cache name:user id'", option)
+	}
+	tp, value := option[:idx], strings.TrimSpace(option[idx+1:])
+	if value == "" {
+		return nil, fmt.Errorf("auth provider[%v] is empty", option)
+	}
+
+	switch tp {
+	case AuthProviderFile:
+		return &fileTokenProvider{path: value}, nil
+	case AuthProviderCommand:
+		return &commandTokenProvider{args: strings.Fields(value)}, nil
+	case AuthProviderElastiCache:
+		return newElastiCacheTokenProvider(value)
+	default:
+		return nil, fmt.Errorf("unknown auth provider type[%v]", tp)
+	}
+}
+
+// ExpiringTokenProvider is the provider whose token expires, the long-lived connection
+// authenticated by it is authenticated again by the new token every ReauthInterval.
+type ExpiringTokenProvider interface {
+	AuthTokenProvider
+	ReauthInterval() time.Duration
+}
+
+// ReauthInterval returns how often the connection authenticated by the provider is authenticated
+// again, 0 if the token doesn't expire.
+func ReauthInterval(provider AuthTokenProvider) time.Duration {
+	if p, ok := provider.(ExpiringTokenProvider); ok {
+		return p.ReauthInterval()
+	}
+	return 0
+}
+
+// FetchAuthToken returns the latest token of the provider. The given password is returned if the
+// provider is nil or fails, so the old token could still be tried.
+func FetchAuthToken(provider AuthTokenProvider, password string) string {
+	if provider == nil || IsSecretRef(password) {
+		// the secret of the job is fetched by AuthArgs
+		return password
+	}
+	token, err := provider.Token()
+	if err != nil {
+		log.Warnf("fetch auth token failed[%v], use the previous one", err)
+		return password
+	}
+	return token
+}
+
+// ACLPassword returns the password authenticated as the user of redis 6 ACL, i.e., "AUTH user password".
+func ACLPassword(user, password string) string {
+	return user + aclSeparator + password
+}
+
+// AuthArgs returns the arguments of AUTH for the password, the user is the first if it's given by ACLPassword.
+// The password referencing the secret is replaced by the secret, see SecretPassword.
+func AuthArgs(password string) []interface{} {
+	if secret, err := SecretPassword(password); err != nil {
+		log.Warnf("fetch the secret of the password failed[%v]", err)
+	} else {
+		password = secret
+	}
+	if i := strings.Index(password, aclSeparator); i != -1 {
+		return []interface{}{password[:i], password[i+len(aclSeparator):]}
+	}
+	return []interface{}{password}
+}
+
+// SourceAuthToken returns the password of the source, empty if source.no_auth is set so that AUTH
+// isn't sent at all.
+func SourceAuthToken(password string) string {
+	if conf.Options.SourceNoAuth {
+		return ""
+	}
+	return FetchAuthToken(SourceAuthProvider, password)
+}
+
+/*
+ * reauthConn sends AUTH with the new token of the provider once the interval passes since the last
+ * one, before the command sent when no reply is pending, so the connection should be used by one
+ * routine. The one sending and receiving in different routines authenticates again by itself, see
+ * targetLane.
+ */
+type reauthConn struct {
+	redigo.Conn
+	authType string
+	provider AuthTokenProvider
+	password string
+	interval time.Duration
+	authed   time.Time
+	pending  int // sent but not received
+	now      func() time.Time
+}
+
+// ReauthRedisConn wraps c authenticated by the token of the provider, c is returned if the token
+// doesn't expire. The connections of the cluster are authenticated once opened.
+func ReauthRedisConn(c redigo.Conn, authType string, provider AuthTokenProvider, password string) redigo.Conn {
+	interval := ReauthInterval(provider)
+	if _, ok := c.(*ClusterConn); ok || c == nil || interval == 0 {
+		return c
+	}
+	return &reauthConn{Conn: c, authType: authType, provider: provider, password: password, interval: interval,
+		authed: time.Now(), now: time.Now}
+}
+
+// ReauthSourceConn is ReauthRedisConn of the source, c is returned if source.no_auth is set.
+func ReauthSourceConn(c redigo.Conn, authType, password string) redigo.Conn {
+	if conf.Options.SourceNoAuth {
+		return c
+	}
+	return ReauthRedisConn(c, authType, SourceAuthProvider, password)
+}
+
+// ReauthTargetConn is ReauthRedisConn of the target.
+func ReauthTargetConn(c redigo.Conn, authType, password string) redigo.Conn {
+	return ReauthRedisConn(c, authType, TargetAuthProvider, password)
+}
+
+func (c *reauthConn) reauth() {
+	if c.pending != 0 || c.now().Sub(c.authed) < c.interval {
+		return
+	}
+	c.authed = c.now()
+	if _, err := c.Conn.Do(c.authType, AuthArgs(FetchAuthToken(c.provider, c.password))...); err != nil {
+		log.Warnf("%s again by the new token failed[%v]", c.authType, err)
+	}
+}
+
+func (c *reauthConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.reauth()
+	}
+	// the pending replies are received by Do
+	c.pending = 0
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *reauthConn) Send(cmd string, args ...interface{}) error {
+	c.reauth()
+	c.pending++
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *reauthConn) Receive() (interface{}, error) {
+	if c.pending > 0 {
+		c.pending--
+	}
+	return c.Conn.Receive()
+}
+
+/*
+ * AuthHint explains the error replied by the source or target which requires a password, e.g.,
+ * NOAUTH or DENIED in protected mode, the role is "source" or "target". It's empty for the other
+ * errors, otherwise it starts with ", " to be appended to the error.
+ */
+func AuthHint(role, reply string) string {
+	reply = strings.TrimPrefix(strings.TrimSpace(reply), "-")
+	switch {
+	case strings.HasPrefix(reply, "NOAUTH"):
+		if role == "source" && conf.Options.SourceNoAuth {
+			return ", the source requires a password but source.no_auth is set"
+		}
+		return fmt.Sprintf(", the %s requires a password, please set %s.password_raw", role, role)
+	case strings.HasPrefix(reply, "DENIED") && strings.Contains(reply, "protected mode"):
+		return fmt.Sprintf(", the %s is running in protected mode, please set requirepass on it and "+
+			"%s.password_raw, or disable its protected-mode", role, role)
+	}
+	return ""
+}
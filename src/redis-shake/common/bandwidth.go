@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+/*
+ * ByteLimiter is the token bucket of the bytes per second, shared by the connections of one
+ * direction of the dbSyncer, see transfer.max_mbps. The bytes taken beyond the tokens are borrowed
+ * and the caller sleeps till they're refilled, so a large write isn't blocked forever. The tokens
+ * saved while idle are at most 100ms of the rate, so the burst after idle is small.
+ */
+type ByteLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time // replaced in the test
+	sleep func(time.Duration)
+}
+
+// NewByteLimiter returns the limiter of the bytes per second, nil if it's 0 which means no limit.
+func NewByteLimiter(bytesPerSecond int64) *ByteLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(bytesPerSecond) / 10
+	if burst < 4096 {
+		burst = 4096
+	}
+	return &ByteLimiter{
+		rate:  float64(bytesPerSecond),
+		burst: burst,
+		last:  time.Now(),
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// MbpsToBytes converts the megabits per second into the bytes per second.
+func MbpsToBytes(mbps uint) int64 {
+	return int64(mbps) * 1000 * 1000 / 8
+}
+
+// Wait takes n bytes, and blocks till the bytes borrowed are refilled.
+func (l *ByteLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// LimitReadConn limits the bytes read from the connection by the limiter, c is returned if it's nil.
+func LimitReadConn(c net.Conn, l *ByteLimiter) net.Conn {
+	if l == nil {
+		return c
+	}
+	return &limitReadConn{Conn: c, limiter: l}
+}
+
+type limitReadConn struct {
+	net.Conn
+	limiter *ByteLimiter
+}
+
+// the bytes read are taken after reading, so the source is slowed down by the socket buffer full
+func (c *limitReadConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limiter.Wait(n)
+	return n, err
+}
+
+// LimitRedisConn limits the bytes of the commands sent by the limiter, c is returned if it's nil.
+func LimitRedisConn(c redigo.Conn, l *ByteLimiter) redigo.Conn {
+	if l == nil {
+		return c
+	}
+	return &limitRedisConn{Conn: c, limiter: l}
+}
+
+type limitRedisConn struct {
+	redigo.Conn
+	limiter *ByteLimiter
+}
+
+func (c *limitRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "" {
+		c.limiter.Wait(commandSize(cmd, args))
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *limitRedisConn) Send(cmd string, args ...interface{}) error {
+	c.limiter.Wait(commandSize(cmd, args))
+	return c.Conn.Send(cmd, args...)
+}
+
+// about the bytes of the command encoded in RESP, the headers of the arguments are counted roughly
+func commandSize(cmd string, args []interface{}) int {
+	n := len(cmd) + 16
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case []byte:
+			n += len(v)
+		case string:
+			n += len(v)
+		default:
+			n += 20 // the number
+		}
+		n += 16
+	}
+	return n
+}
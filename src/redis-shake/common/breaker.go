@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed = "closed"
+	BreakerOpen   = "open"
+
+	// the breaker won't trip until the window has enough replies
+	breakerMinRequests = 20
+)
+
+/*
+ * CircuitBreaker trips once the rate of the failed replies in the rolling window exceeds the
+ * threshold(percent). The window is split into buckets of one second. The caller stops sending
+ * once it's open and closes it after the recovery. The trips are counted until a whole window
+ * passes without tripping.
+ */
+type CircuitBreaker struct {
+	threshold int // percent
+	window    int // seconds
+
+	mu       sync.Mutex
+	buckets  []breakerBucket
+	open     bool
+	trips    int
+	lastTrip time.Time
+
+	now func() time.Time // replaced in test
+}
+
+type breakerBucket struct {
+	second           int64
+	success, failure int64
+}
+
+func NewCircuitBreaker(threshold, window int) *CircuitBreaker {
+	if window <= 0 {
+		window = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		buckets:   make([]breakerBucket, window),
+		now:       time.Now,
+	}
+}
+
+// Record the result of one reply, return true if the breaker trips by this reply.
+func (cb *CircuitBreaker) Record(success bool) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	second := now.Unix()
+	b := &cb.buckets[second%int64(cb.window)]
+	if b.second != second {
+		*b = breakerBucket{second: second}
+	}
+	if success {
+		b.success++
+	} else {
+		b.failure++
+	}
+
+	if cb.trips > 0 && now.Sub(cb.lastTrip) > time.Duration(cb.window)*time.Second {
+		// recovered
+		cb.trips = 0
+	}
+	if cb.open {
+		return false
+	}
+
+	var total, failure int64
+	for _, b := range cb.buckets {
+		if second-b.second < int64(cb.window) {
+			total += b.success + b.failure
+			failure += b.failure
+		}
+	}
+	if total < breakerMinRequests || failure*100 <= total*int64(cb.threshold) {
+		return false
+	}
+
+	cb.open = true
+	cb.trips++
+	cb.lastTrip = now
+	return true
+}
+
+func (cb *CircuitBreaker) IsOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.open
+}
+
+// close the breaker after the recovery, the replies recorded before are dropped.
+func (cb *CircuitBreaker) Close() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.open = false
+	for i := range cb.buckets {
+		cb.buckets[i] = breakerBucket{}
+	}
+}
+
+// number of the trips in a row
+func (cb *CircuitBreaker) Trips() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.trips
+}
+
+func (cb *CircuitBreaker) State() string {
+	if cb.IsOpen() {
+		return BreakerOpen
+	}
+	return BreakerClosed
+}
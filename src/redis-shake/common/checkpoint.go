@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// Checkpoint is the replication position of the source persisted by sync.checkpoint_file and sync.checkpoint_key.
+type Checkpoint struct {
+	Source string `json:"source"` // address of the source
+	RunId  string `json:"runid"`
+	Offset int64  `json:"offset"` // the commands before it are all replied by the target
+	Time   string `json:"time"`
+}
+
+// the checkpoint file of the db syncer
+func CheckpointFileName(file string, id int) string {
+	return fmt.Sprintf("%s.%d", file, id)
+}
+
+// WriteCheckpoint writes into a temporary file and renames it so that the file is never half written.
+func WriteCheckpoint(file string, cp *Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// ReadCheckpoint returns nil if the file doesn't exist.
+func ReadCheckpoint(file string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cp := new(Checkpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file[%v]: %v", file, err)
+	}
+	if err := cp.validate(); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file[%v]: %v", file, err)
+	}
+	return cp, nil
+}
+
+func (cp *Checkpoint) validate() error {
+	if cp.RunId == "" || cp.Offset < 0 {
+		return fmt.Errorf("runid[%v] offset[%v]", cp.RunId, cp.Offset)
+	}
+	return nil
+}
+
+// RemoveCheckpoint removes the file, it's fine if the file doesn't exist.
+func RemoveCheckpoint(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// the checkpoint key of the db syncer on the target
+func CheckpointKeyName(prefix string, id int) string {
+	return fmt.Sprintf("%s:%d", prefix, id)
+}
+
+// HMSetArgs returns the args of HMSET which writes the checkpoint into the hash key.
+func (cp *Checkpoint) HMSetArgs(key string) []interface{} {
+	return []interface{}{key, "source", cp.Source, "runid", cp.RunId, "offset", cp.Offset, "time", cp.Time}
+}
+
+// ReadTargetCheckpoint reads the hash key written by HMSetArgs, nil is returned if the key doesn't exist.
+func ReadTargetCheckpoint(c redigo.Conn, key string) (*Checkpoint, error) {
+	m, err := redigo.StringMap(c.Do("hgetall", key))
+	if err != nil {
+		return nil, fmt.Errorf("hgetall checkpoint key[%v] failed: %v", key, err)
+	}
+	if len(m) == 0 {
+		return nil, nil
+	}
+	cp := &Checkpoint{Source: m["source"], RunId: m["runid"], Time: m["time"]}
+	if cp.Offset, err = strconv.ParseInt(m["offset"], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint key[%v]: offset[%v]", key, m["offset"])
+	}
+	if err := cp.validate(); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint key[%v]: %v", key, err)
+	}
+	return cp, nil
+}
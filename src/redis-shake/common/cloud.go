@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+var (
+	// the adapters of source.rdb.special_cloud and scan.special_cloud, the default behaviors of
+	// the community redis if not given
+	SourceRdbCloud CloudAdapter = cloudBase{}
+	ScanCloud      CloudAdapter = cloudBase{}
+
+	// the adapters of the vendors by the name, a new vendor is added here with its own file
+	cloudAdapters = map[string]CloudAdapter{
+		AliyunCluster:  aliyunCluster{},
+		TencentCluster: tencentCluster{},
+		UCloudCluster:  ucloudCluster{},
+		HuaweiCluster:  huaweiCluster{},
+	}
+)
+
+/*
+ * CloudAdapter covers the quirks of the redis offered by the cloud vendor, so the callers don't
+ * switch on the vendor. The adapter embeds cloudBase and overrides the quirks of the vendor only.
+ */
+type CloudAdapter interface {
+	// the verbs of sync and psync. no vendor renames them so far, the ones renamed on the
+	// source are given by command.rename instead, see RenameCommand
+	SyncCommand() string
+	PSyncCommand() string
+
+	// whether the command in the stream of the source is the vendor's own, which is dropped
+	// since the target doesn't know it
+	VendorCommand(name string) bool
+
+	// the key of the entry in the rdb of the source
+	RdbKey(key []byte) []byte
+
+	// the nodes behind the proxy which are scanned one by one, nil means the proxy is scanned as
+	// a single node by the normal scan
+	ScanNodes(c redigo.Conn) ([]string, error)
+	// scan the node from the cursor, the reply is [cursor, keys] as SCAN
+	Scan(c redigo.Conn, node string, cursor int64, count int64) (interface{}, error)
+
+	// the dbs of the source, nil means the dbs in "info keyspace"
+	Dbs() []int32
+}
+
+// GetCloudAdapter returns the adapter of the vendor, empty name means the community redis.
+func GetCloudAdapter(name string) (CloudAdapter, error) {
+	if name == "" {
+		return cloudBase{}, nil
+	}
+	if adapter, ok := cloudAdapters[name]; ok {
+		return adapter, nil
+	}
+
+	names := make([]string, 0, len(cloudAdapters))
+	for k := range cloudAdapters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("special cloud type[%s] is not supported, should be in {%v}", name,
+		strings.Join(names, ", "))
+}
+
+// the behaviors of the community redis
+type cloudBase struct{}
+
+func (cloudBase) SyncCommand() string {
+	return "sync"
+}
+
+func (cloudBase) PSyncCommand() string {
+	return "psync"
+}
+
+func (cloudBase) VendorCommand(name string) bool {
+	return false
+}
+
+func (cloudBase) RdbKey(key []byte) []byte {
+	return key
+}
+
+func (cloudBase) ScanNodes(c redigo.Conn) ([]string, error) {
+	return nil, nil
+}
+
+func (cloudBase) Scan(c redigo.Conn, node string, cursor int64, count int64) (interface{}, error) {
+	return c.Do("scan", cursor, "count", count)
+}
+
+func (cloudBase) Dbs() []int32 {
+	return nil
+}
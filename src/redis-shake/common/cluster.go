@@ -1,108 +1,605 @@
 package utils
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	redigoCluster "github.com/vinllen/redis-go-cluster"
-	redigo "github.com/garyburd/redigo/redis"
 	"pkg/libs/log"
-)
+	"redis-shake/configure"
+	"redis-shake/filter"
 
-var (
-	RecvChanSize = 4096
+	redigo "github.com/garyburd/redigo/redis"
 )
 
-/* implement redigo.Conn(https://github.com/garyburd/redigo)
- * Embed redis-go-cluster(https://github.com/chasex/redis-go-cluster)
- * The reason I create this struct is that redis-go-cluster isn't fulfill redigo.Conn
- * interface. So I implement "Err", "Send", "Flush" and "Receive" interfaces.
+/*
+ * ClusterConn implements redigo.Conn on the redis cluster: the slots are fetched by CLUSTER SLOTS
+ * from the nodes given, and each command is sent to the master owning the slot of its first key on
+ * the pipelined connection to that master, the replies are received in the order sent. MOVED
+ * updates the owner of the slot and ASK is followed with ASKING, the command is retried on the node
+ * given in the reply, so the resharding of the cluster is transparent. The command without keys
+ * goes to the node of the last command, and the transaction goes to the node of its first key.
+ * The same as redigo, Send and Flush can be called in one goroutine while Receive in another.
+ * The slots are fetched again every target.cluster_refresh_sec and once a master can't be
+ * connected, so the nodes added, removed or failed over are followed without the redirections.
  */
 type ClusterConn struct {
-	client   *redigoCluster.Cluster
-	recvChan chan reply
-	batcher  *redigoCluster.Batch
+	seeds        []string
+	authType     string
+	passwd       string
+	tlsConfig    *tls.Config
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu        sync.Mutex
+	slots     [ClusterSlots]string   // master of each slot
+	nodes     map[string]redigo.Conn // pipelined connection to each master
+	sent      []*clusterCommand      // commands sent but not received in order
+	unflushed map[string]struct{}    // nodes with the commands not flushed
+	last      string                 // node of the last command
+	multi     *clusterCommand        // multi isn't sent until the node of the transaction is known
+	txNode    string                 // node of the transaction in progress
+
+	refreshInterval time.Duration // 0 means the slots aren't fetched again periodically
+	refreshed       time.Time
+	refreshing      bool
+
+	directMu sync.Mutex
+	direct   map[string]redigo.Conn // connections not pipelined, used by Do and the redirection
 }
 
-type reply struct {
-	answer interface{}
-	err    error
+type clusterCommand struct {
+	cmd  string
+	args []interface{}
+	node string
+	slot int  // -1 if the command has no key
+	inTx bool // the reply is QUEUED or of exec, the redirection isn't followed
 }
 
-func NewClusterConn(clusterClient *redigoCluster.Cluster, recvChanSize int) redigo.Conn {
-	if recvChanSize == 0 {
-		recvChanSize = RecvChanSize
-	}
+// NewClusterConn fetches the slots from the first node of seeds which replies.
+func NewClusterConn(seeds []string, authType, passwd string, readTimeout, writeTimeout time.Duration,
+	tlsConfig *tls.Config) (*ClusterConn, error) {
+	c := &ClusterConn{
+		seeds:        seeds,
+		authType:     authType,
+		passwd:       passwd,
+		tlsConfig:    tlsConfig,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		nodes:        make(map[string]redigo.Conn),
+		unflushed:    make(map[string]struct{}),
+		direct:       make(map[string]redigo.Conn),
 
-	return &ClusterConn{
-		client:   clusterClient,
-		recvChan: make(chan reply, recvChanSize),
+		refreshInterval: time.Duration(conf.Options.TargetClusterRefresh) * time.Second,
+		refreshed:       time.Now(),
 	}
+	var err error
+	for _, seed := range seeds {
+		if err = c.fetchSlots(seed); err == nil {
+			return c, nil
+		}
+		log.Warnf("fetch the slots from node[%v] failed: %v", seed, err)
+	}
+	return nil, fmt.Errorf("fetch the slots from %v failed: %v", seeds, err)
 }
 
-func (cc *ClusterConn) Close() error {
-	cc.client.Close()
+/*
+ * fetch the slots again from the masters known or else the seeds, the connections to the nodes
+ * not serving any slot are closed once no reply is waited from them. The slots are kept on error.
+ */
+func (c *ClusterConn) refresh() error {
+	c.mu.Lock()
+	old := c.slots
+	c.mu.Unlock()
+	candidates := make([]string, 0, len(c.seeds))
+	known := make(map[string]struct{})
+	for _, node := range append(old[:], c.seeds...) {
+		if _, ok := known[node]; !ok && node != "" {
+			known[node] = struct{}{}
+			candidates = append(candidates, node)
+		}
+	}
+
+	var err error
+	for _, node := range candidates {
+		if err = c.fetchSlots(node); err == nil {
+			break
+		}
+		log.Warnf("fetch the slots from node[%v] failed: %v", node, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshed = time.Now()
+	c.refreshing = false
+	if err != nil {
+		return fmt.Errorf("fetch the slots from %v failed: %v", candidates, err)
+	}
+
+	moved := 0
+	masters := make(map[string]struct{})
+	for slot, node := range c.slots {
+		if node != old[slot] {
+			moved++
+		}
+		masters[node] = struct{}{}
+	}
+	if moved > 0 {
+		log.Infof("%d slots of the cluster are moved, %d masters now", moved, len(masters))
+	}
+	waiting := make(map[string]struct{})
+	for _, cc := range c.sent {
+		waiting[cc.node] = struct{}{}
+	}
+	for node, conn := range c.nodes {
+		_, master := masters[node]
+		_, wait := waiting[node]
+		_, unflushed := c.unflushed[node]
+		if !master && !wait && !unflushed && node != c.txNode {
+			log.Infof("node[%v] doesn't serve any slot of the cluster, close the connection", node)
+			conn.Close()
+			delete(c.nodes, node)
+			if c.last == node {
+				c.last = ""
+			}
+		}
+	}
+	c.directMu.Lock()
+	for node, conn := range c.direct {
+		if _, master := masters[node]; !master {
+			conn.Close()
+			delete(c.direct, node)
+		}
+	}
+	c.directMu.Unlock()
 	return nil
 }
 
-func (cc *ClusterConn) Err() error {
+// start refreshing the slots in the background once refreshInterval passes, c.mu is held
+func (c *ClusterConn) refreshIfDue() {
+	if c.refreshInterval <= 0 || c.refreshing || time.Since(c.refreshed) < c.refreshInterval {
+		return
+	}
+	c.refreshing = true
+	go func() {
+		if err := c.refresh(); err != nil {
+			log.Warnf("refresh the slots of the cluster failed: %v", err)
+		}
+	}()
+}
+
+// the cluster connection is of the target only, the token is fetched again for the node opened later
+func (c *ClusterConn) open(addr string) (redigo.Conn, error) {
+	nc := OpenNetConnSoft(addr, c.authType, FetchAuthToken(TargetAuthProvider, c.passwd), c.tlsConfig)
+	if nc == nil {
+		return nil, fmt.Errorf("connect to node[%v] failed", addr)
+	}
+	return newRedisConn(nc, c.readTimeout, c.writeTimeout), nil
+}
+
+func (c *ClusterConn) fetchSlots(addr string) error {
+	conn, err := c.open(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slots, err := ClusterSlotOwners(conn, addr)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.slots = slots
+	c.mu.Unlock()
 	return nil
 }
 
-func (cc *ClusterConn) Do(commandName string, args ...interface{}) (reply interface{}, err error) {
-	return cc.client.Do(commandName, args...)
+/*
+ * MapAddress returns the address connected for the node address announced by the cluster, e.g., the
+ * internal ip unreachable here, by cluster.address_map. The address is returned as is if not mapped.
+ * It's applied to CLUSTER NODES, CLUSTER SLOTS and the redirections of both the source and the target.
+ */
+func MapAddress(addr string) string {
+	if len(conf.Options.AddressMap) == 0 {
+		return addr
+	}
+	if to, ok := conf.Options.AddressMap[addr]; ok {
+		return to
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if to, ok := conf.Options.AddressMap[host]; ok {
+		return net.JoinHostPort(to, port)
+	}
+	return addr
 }
 
-// just add into batcher
-func (cc *ClusterConn) Send(commandName string, args ...interface{}) error {
-	if cc.batcher == nil {
-		cc.batcher = cc.client.NewBatch()
+// ClusterSlotOwners returns the master of each slot by CLUSTER SLOTS on the node addr, the slot not
+// served is empty. The reply is [start, end, [ip, port, id], replicas...] of each slot range.
+func ClusterSlotOwners(conn redigo.Conn, addr string) ([ClusterSlots]string, error) {
+	var slots [ClusterSlots]string
+	ranges, err := redigo.Values(conn.Do("cluster", "slots"))
+	if err != nil {
+		return slots, err
 	}
-	return cc.batcher.Put(commandName, args...)
+
+	for _, r := range ranges {
+		fields, err := redigo.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return slots, fmt.Errorf("invalid slot range[%v]: %v", r, err)
+		}
+		start, err1 := redigo.Int(fields[0], nil)
+		end, err2 := redigo.Int(fields[1], nil)
+		master, err3 := redigo.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(master) < 2 || start < 0 || end >= ClusterSlots {
+			return slots, fmt.Errorf("invalid slot range[%v]", r)
+		}
+		ip, _ := redigo.String(master[0], nil)
+		port, err := redigo.Int(master[1], nil)
+		if err != nil {
+			return slots, fmt.Errorf("invalid port of slot range[%v]: %v", r, err)
+		}
+		if ip == "" {
+			// the node doesn't know its own ip
+			ip, _, _ = net.SplitHostPort(addr)
+		}
+		owner := MapAddress(net.JoinHostPort(ip, strconv.Itoa(port)))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = owner
+		}
+	}
+	return slots, nil
 }
 
-// send batcher and put the return into recvChan
-func (cc *ClusterConn) Flush() error {
-	if cc.batcher == nil {
-		log.Info("batcher is empty, no need to flush")
-		return nil
+// ClusterSlotsServed returns the slots served by the node addr in cluster slots of the conn, the
+// slots of its master are returned if it's a replica.
+func ClusterSlotsServed(conn redigo.Conn, addr string) ([ClusterSlots]bool, error) {
+	var served [ClusterSlots]bool
+	owners, err := ClusterSlotOwners(conn, addr)
+	if err != nil {
+		return served, err
+	}
+	replicas, err := ClusterSlotReplicas(conn, addr)
+	if err != nil {
+		return served, err
 	}
 
-	ret, err := cc.client.RunBatch(cc.batcher)
-	defer func() {
-		cc.batcher = nil // reset batcher
-	}()
+	master := addr
+	for m, list := range replicas {
+		for _, replica := range list {
+			if replica == addr {
+				master = m
+			}
+		}
+	}
+	for slot, owner := range owners {
+		served[slot] = owner == master
+	}
+	return served, nil
+}
+
+// ClusterSlotReplicas returns the replicas of each master in cluster slots of the conn.
+func ClusterSlotReplicas(conn redigo.Conn, addr string) (map[string][]string, error) {
+	ranges, err := redigo.Values(conn.Do("cluster", "slots"))
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := make(map[string][]string)
+	for _, r := range ranges {
+		fields, err := redigo.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("invalid slot range[%v]: %v", r, err)
+		}
+		var nodes []string
+		for _, field := range fields[2:] {
+			node, err := redigo.Values(field, nil)
+			if err != nil || len(node) < 2 {
+				return nil, fmt.Errorf("invalid node[%v] of slot range[%v]", field, r)
+			}
+			ip, _ := redigo.String(node[0], nil)
+			port, err := redigo.Int(node[1], nil)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port of slot range[%v]: %v", r, err)
+			}
+			if ip == "" {
+				ip, _, _ = net.SplitHostPort(addr)
+			}
+			nodes = append(nodes, MapAddress(net.JoinHostPort(ip, strconv.Itoa(port))))
+		}
+		// the master serving several ranges is listed once
+		if _, ok := replicas[nodes[0]]; !ok {
+			replicas[nodes[0]] = nodes[1:]
+		}
+	}
+	return replicas, nil
+}
+
+// the node and the slot of the command, the command without keys goes to the last node
+func (c *ClusterConn) route(cmd string, args []interface{}) (string, int, error) {
+	argv := make([][]byte, len(args))
+	for i, arg := range args {
+		argv[i] = argBytes(arg)
+	}
+	if indexes, ok := filter.CommandKeyIndexes(strings.ToLower(cmd), argv); ok && len(indexes) > 0 {
+		slot := int(KeyToSlot(string(argv[indexes[0]])))
+		if c.slots[slot] == "" {
+			return "", slot, fmt.Errorf("slot[%v] isn't served by any node", slot)
+		}
+		return c.slots[slot], slot, nil
+	}
+	if c.last != "" {
+		return c.last, -1, nil
+	}
+	for _, node := range c.slots {
+		if node != "" {
+			return node, -1, nil
+		}
+	}
+	return "", -1, fmt.Errorf("no slot is served by any node")
+}
 
+func argBytes(arg interface{}) []byte {
+	switch v := arg.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+// the pipelined connection to the node, opened once it's used
+func (c *ClusterConn) nodeConn(node string) (redigo.Conn, error) {
+	if conn, ok := c.nodes[node]; ok {
+		return conn, nil
+	}
+	conn, err := c.open(node)
 	if err != nil {
-		cc.recvChan <- reply{
-			answer: nil,
-			err:    err,
+		return nil, &nodeConnError{err}
+	}
+	c.nodes[node] = conn
+	return conn, nil
+}
+
+// queue the command of the node, the connection is returned to send it out of the lock
+func (c *ClusterConn) queue(cc *clusterCommand, node string) (redigo.Conn, error) {
+	conn, err := c.nodeConn(node)
+	if err != nil {
+		return nil, err
+	}
+	cc.node = node
+	c.last = node
+	c.unflushed[node] = struct{}{}
+	return conn, nil
+}
+
+func (c *ClusterConn) Send(commandName string, args ...interface{}) error {
+	c.mu.Lock()
+	inTx := c.multi != nil || c.txNode != "" || strings.EqualFold(commandName, "multi")
+	c.mu.Unlock()
+	err := c.send(commandName, args)
+	if _, ok := err.(*nodeConnError); ok && !inTx {
+		// the master may be failed over or removed
+		if rerr := c.refresh(); rerr != nil {
+			return fmt.Errorf("%v, %v", err, rerr)
 		}
+		err = c.send(commandName, args)
+	}
+	return err
+}
+
+// the node can't be connected
+type nodeConnError struct {
+	err error
+}
+
+func (e *nodeConnError) Error() string {
+	return e.err.Error()
+}
 
+func (c *ClusterConn) send(commandName string, args []interface{}) error {
+	cc := &clusterCommand{cmd: commandName, args: args, slot: -1}
+	c.mu.Lock()
+	c.refreshIfDue()
+	if strings.EqualFold(commandName, "multi") {
+		cc.inTx = true
+		c.multi = cc
+		c.sent = append(c.sent, cc)
+		c.mu.Unlock()
+		return nil
+	}
+
+	var multi redigo.Conn
+	var err error
+	if c.multi != nil || c.txNode != "" {
+		cc.inTx = true
+		if c.multi != nil {
+			var node string
+			if node, _, err = c.route(commandName, args); err == nil {
+				if multi, err = c.queue(c.multi, node); err == nil {
+					c.txNode = node
+					c.multi = nil
+				}
+			}
+		}
+		if err == nil {
+			cc.node = c.txNode
+		}
+		if strings.EqualFold(commandName, "exec") || strings.EqualFold(commandName, "discard") {
+			c.txNode = ""
+		}
+	} else {
+		cc.node, cc.slot, err = c.route(commandName, args)
+	}
+	var conn redigo.Conn
+	if err == nil {
+		conn, err = c.queue(cc, cc.node)
+	}
+	if err != nil {
+		c.mu.Unlock()
 		return err
 	}
+	c.sent = append(c.sent, cc)
+	c.mu.Unlock()
+
+	if multi != nil {
+		if err := multi.Send("multi"); err != nil {
+			return err
+		}
+	}
+	return conn.Send(commandName, args...)
+}
+
+func (c *ClusterConn) Flush() error {
+	c.mu.Lock()
+	var multi redigo.Conn
+	if c.multi != nil {
+		// the transaction is flushed before any command in it, it goes to the last node
+		node, _, err := c.route("multi", nil)
+		if err == nil {
+			multi, err = c.queue(c.multi, node)
+		}
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.txNode = node
+		c.multi = nil
+	}
+	conns := make([]redigo.Conn, 0, len(c.unflushed))
+	for node := range c.unflushed {
+		conns = append(conns, c.nodes[node])
+		delete(c.unflushed, node)
+	}
+	c.mu.Unlock()
+
+	if multi != nil {
+		if err := multi.Send("multi"); err != nil {
+			return err
+		}
+	}
+	for _, conn := range conns {
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ClusterConn) Receive() (interface{}, error) {
+	c.mu.Lock()
+	if len(c.sent) == 0 {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("no command is waiting for the reply")
+	}
+	cc := c.sent[0]
+	c.sent[0] = nil
+	c.sent = c.sent[1:]
+	conn := c.nodes[cc.node]
+	c.mu.Unlock()
+
+	reply, err := conn.Receive()
+	if cc.inTx {
+		return reply, err
+	}
+	if kind, addr, ok := ParseRedirect(err); ok {
+		return c.redirect(cc, kind, addr)
+	}
+	return reply, err
+}
+
+func (c *ClusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	cc := &clusterCommand{cmd: commandName, args: args}
+	c.mu.Lock()
+	node, slot, err := c.route(commandName, args)
+	if err == nil {
+		cc.node, cc.slot = node, slot
+		c.last = node
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(node, false, cc)
+	if kind, addr, ok := ParseRedirect(err); ok {
+		return c.redirect(cc, kind, addr)
+	}
+	return reply, err
+}
 
-	// for redis-go-cluster driver, "Receive" function returns all the replies once flushed.
-	// However, this action is different with redigo driver that "Receive" only returns 1
-	// reply each time.
+// retry the command on the node given by MOVED or ASK
+func (c *ClusterConn) redirect(cc *clusterCommand, kind, addr string) (reply interface{}, err error) {
+	for depth := 0; depth < redirectMaxDepth; depth++ {
+		log.Debugf("follow redirection[%v] of command[%v] to node[%v]", kind, cc.cmd, addr)
+		if kind == RedirectMoved && cc.slot >= 0 {
+			c.mu.Lock()
+			c.slots[cc.slot] = addr
+			c.mu.Unlock()
+			log.Infof("slot[%v] of the cluster is moved to node[%v]", cc.slot, addr)
+		}
 
-	retLength := len(ret)
-	availableSize := cap(cc.recvChan) - len(cc.recvChan)
-	if availableSize < retLength {
-		log.Warnf("available channel size[%v] less than current returned batch size[%v]", availableSize, retLength)
+		reply, err = c.do(addr, kind == RedirectAsk, cc)
+		var ok bool
+		if kind, addr, ok = ParseRedirect(err); !ok {
+			return reply, err
+		}
 	}
-	log.Debugf("cluster flush batch with size[%v], return replies size[%v]", cc.batcher.GetBatchSize(), retLength)
+	log.Warnf("command[%v] is redirected more than %d times, last error[%v]", cc.cmd, redirectMaxDepth, err)
+	return reply, err
+}
 
-	for _, ele := range ret {
-		cc.recvChan <- reply{
-			answer: ele,
-			err:    err,
+// run the command on the connection not pipelined, ASKING is sent ahead if asking is true
+func (c *ClusterConn) do(node string, asking bool, cc *clusterCommand) (interface{}, error) {
+	c.directMu.Lock()
+	defer c.directMu.Unlock()
+	conn, ok := c.direct[node]
+	if !ok {
+		var err error
+		if conn, err = c.open(node); err != nil {
+			return nil, err
 		}
+		c.direct[node] = conn
 	}
 
-	return err
+	if asking {
+		if _, err := conn.Do("asking"); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.Do(cc.cmd, cc.args...)
+	if conn.Err() != nil {
+		// broken, reopened next time
+		conn.Close()
+		delete(c.direct, node)
+	}
+	return reply, err
+}
+
+func (c *ClusterConn) Err() error {
+	return nil
 }
 
-// read recvChan
-func (cc *ClusterConn) Receive() (reply interface{}, err error) {
-	ret := <- cc.recvChan
-	return ret.answer, ret.err
-}
\ No newline at end of file
+func (c *ClusterConn) Close() error {
+	c.mu.Lock()
+	for node, conn := range c.nodes {
+		conn.Close()
+		delete(c.nodes, node)
+	}
+	c.mu.Unlock()
+	c.directMu.Lock()
+	for node, conn := range c.direct {
+		conn.Close()
+		delete(c.direct, node)
+	}
+	c.directMu.Unlock()
+	return nil
+}
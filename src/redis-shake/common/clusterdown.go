@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"strings"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	stallBackoffMin = 10 * time.Millisecond
+	stallBackoffMax = time.Second
+)
+
+// the error replies of the target which is failing over or loading, the command succeeds later
+var stallErrorPrefixes = []string{"CLUSTERDOWN", "LOADING", "TRYAGAIN"}
+
+// IsStallError returns true if err is CLUSTERDOWN, LOADING or TRYAGAIN replied by the target.
+func IsStallError(err error) bool {
+	e, ok := err.(redigo.Error)
+	if !ok {
+		return false
+	}
+	for _, prefix := range stallErrorPrefixes {
+		if strings.HasPrefix(string(e), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsReadOnlyError returns true if err is READONLY replied by the master demoted after failover.
+func IsReadOnlyError(err error) bool {
+	e, ok := err.(redigo.Error)
+	return ok && strings.HasPrefix(string(e), "READONLY")
+}
+
+/*
+ * RetryStalled runs do again while it fails by CLUSTERDOWN, LOADING or TRYAGAIN, e.g., the master
+ * of the target cluster is failing over, until maxStall of target.clusterdown_max_stall_ms passes
+ * after the first failure. The backoff starts from 10ms and doubles up to 1 second. err is the
+ * first failure, it's returned as it is if it isn't a stall or maxStall is 0, the last failure is
+ * returned once the stall lasts too long.
+ */
+func RetryStalled(maxStall time.Duration, err error, cmd string, do func() (interface{}, error)) (interface{},
+	error) {
+	if maxStall == 0 || !IsStallError(err) {
+		return nil, err
+	}
+	start := time.Now()
+	backoff := stallBackoffMin
+	var reply interface{}
+	for retries := 1; IsStallError(err); retries++ {
+		if time.Since(start) >= maxStall {
+			log.Warnf("command[%v] is stalled by the target more than %v, last error[%v]", cmd, maxStall, err)
+			return reply, err
+		}
+		log.Debugf("command[%v] is stalled by the target[%v], retry after %v", cmd, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > stallBackoffMax {
+			backoff = stallBackoffMax
+		}
+		if reply, err = do(); !IsStallError(err) {
+			log.Infof("command[%v] is retried %d times in %v after the target stalled", cmd, retries,
+				time.Since(start))
+		}
+	}
+	return reply, err
+}
+
+// RefreshSlots fetches the slots of the cluster again if c is the cluster connection, the
+// failover of the master is followed before retrying the command stalled.
+func RefreshSlots(c redigo.Conn) {
+	if cc, ok := c.(*ClusterConn); ok {
+		if err := cc.refresh(); err != nil {
+			log.Warnf("refresh the slots of the cluster failed: %v", err)
+		}
+	}
+}
+
+// DoRetryStalled runs the command on c, and retries it by RetryStalled.
+func DoRetryStalled(c redigo.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Do(cmd, args...)
+	if !IsStallError(err) {
+		return reply, err
+	}
+	maxStall := time.Duration(conf.Options.TargetMaxStall) * time.Millisecond
+	return RetryStalled(maxStall, err, cmd, func() (interface{}, error) {
+		RefreshSlots(c)
+		return c.Do(cmd, args...)
+	})
+}
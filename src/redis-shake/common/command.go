@@ -131,7 +131,7 @@ func ParseClusterNode(content []byte) []*ClusterNodeInfo {
 		}
 		ret = append(ret, &ClusterNodeInfo{
 			Id:          string(items[0]),
-			Address:     string(address[0]),
+			Address:     MapAddress(string(address[0])),
 			Flags:       role,
 			Master:      string(items[3]),
 			PingSent:    string(items[4]),
@@ -144,6 +144,35 @@ func ParseClusterNode(content []byte) []*ClusterNodeInfo {
 	return ret
 }
 
+/*
+ * ParseMigratingSlots returns the slots migrating out of and importing into the node itself in the
+ * reply of cluster nodes, they're given as "[slot->-id]" and "[slot-<-id]" after the slot ranges
+ * of the line with the flag myself.
+ */
+func ParseMigratingSlots(content []byte) (migrating, importing []int) {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		items := strings.Fields(string(line))
+		if len(items) < 3 || !strings.Contains(items[2], "myself") {
+			continue
+		}
+		for _, item := range items[3:] {
+			if !strings.HasPrefix(item, "[") {
+				continue
+			}
+			if i := strings.Index(item, "->-"); i > 0 {
+				if slot, err := strconv.Atoi(item[1:i]); err == nil {
+					migrating = append(migrating, slot)
+				}
+			} else if i := strings.Index(item, "-<-"); i > 0 {
+				if slot, err := strconv.Atoi(item[1:i]); err == nil {
+					importing = append(importing, slot)
+				}
+			}
+		}
+	}
+	return migrating, importing
+}
+
 // needMaster: true(master), false(slave)
 func ClusterNodeChoose(input []*ClusterNodeInfo, role string) []*ClusterNodeInfo {
 	ret := make([]*ClusterNodeInfo, 0, len(input))
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"path"
 	"strings"
 	"reflect"
+	"sync"
 	"unsafe"
 	"encoding/binary"
 
 	"pkg/libs/bytesize"
 	"redis-shake/configure"
+	"redis-shake/filter"
 
 	logRotate "gopkg.in/natefinch/lumberjack.v2"
 	"github.com/cupcake/rdb/crc64"
@@ -23,6 +26,9 @@ const (
 	ReaderBufferSize = bytesize.MB * 32
 	WriterBufferSize = bytesize.MB * 8
 
+	RdbSizeUnknown       = -1 // rdb size in diskless mode
+	RdbEOFMarkSize       = 40
+
 	LogLevelNone  = "none"
 	LogLevelError = "error"
 	LogLevelWarn  = "warn"
@@ -33,6 +39,7 @@ const (
 	TencentCluster = "tencent_cluster"
 	AliyunCluster  = "aliyun_cluster"
 	UCloudCluster  = "ucloud_cluster"
+	HuaweiCluster  = "huawei_cluster"
 	CodisCluster   = "codis_cluster"
 
 	CoidsErrMsg = "ERR backend server 'server' not found"
@@ -44,6 +51,8 @@ var (
 	StartTime        string
 	TargetRoundRobin int
 	RDBVersion       uint = 9 // 9 for 5.0
+
+	targetRoundRobinMu sync.Mutex // the targets are picked by the routines of the syncers
 )
 
 const (
@@ -93,7 +102,8 @@ func ParseInfo(content []byte) map[string]string {
 }
 
 func GetTotalLink() int {
-	if conf.Options.Type == conf.TypeSync || conf.Options.Type == conf.TypeRump || conf.Options.Type == conf.TypeDump {
+	if conf.Options.Type == conf.TypeSync || conf.Options.Type == conf.TypeRump || conf.Options.Type == conf.TypeDump ||
+		conf.Options.Type == conf.TypeReplay {
 		return len(conf.Options.SourceAddressList)
 	} else if conf.Options.Type == conf.TypeDecode || conf.Options.Type == conf.TypeRestore {
 		return len(conf.Options.SourceRdbInput)
@@ -102,12 +112,37 @@ func GetTotalLink() int {
 }
 
 func PickTargetRoundRobin(n int) int {
+	targetRoundRobinMu.Lock()
+	defer targetRoundRobinMu.Unlock()
 	defer func() {
 		TargetRoundRobin = (TargetRoundRobin + 1) % n
 	}()
 	return TargetRoundRobin
 }
 
+// PickTargetWeighted picks the target round-robin, the one given weight n in target.address is
+// picked n times in a round.
+func PickTargetWeighted(targets []string, options map[string]conf.AddressOptions) int {
+	weight := func(target string) int {
+		if w := options[target].Weight; w > 0 {
+			return w
+		}
+		return 1
+	}
+	total := 0
+	for _, target := range targets {
+		total += weight(target)
+	}
+	n := PickTargetRoundRobin(total)
+	for i, target := range targets {
+		if n < weight(target) {
+			return i
+		}
+		n -= weight(target)
+	}
+	return len(targets) - 1
+}
+
 func String2Bytes(s string) []byte {
 	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
 	bh := reflect.SliceHeader{
@@ -212,4 +247,205 @@ func CompareVersion(a, b string, level int) int {
 	}
 
 	return 0
-}
\ No newline at end of file
+}
+
+/*
+ * parse the db map like "0:5,1:6" or "0:5;1:6" which means source db0 -> target db5,
+ * source db1 -> target db6.
+ */
+func ParseDBMap(input string) (map[int]int, error) {
+	ret := make(map[int]int)
+	list := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+	for _, ele := range list {
+		pair := strings.Split(strings.TrimSpace(ele), ":")
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid db pair[%v]", ele)
+		}
+		source, err := strconv.Atoi(pair[0])
+		if err != nil || source < 0 {
+			return nil, fmt.Errorf("invalid source db[%v]", pair[0])
+		}
+		target, err := strconv.Atoi(pair[1])
+		if err != nil || target < 0 {
+			return nil, fmt.Errorf("invalid target db[%v]", pair[1])
+		}
+		if _, ok := ret[source]; ok {
+			return nil, fmt.Errorf("source db[%v] is duplicated", source)
+		}
+		ret[source] = target
+	}
+	return ret, nil
+}
+
+// ShardMapSplitter splits the source address and the target address of the pair in shard.map
+const ShardMapSplitter = "->"
+
+// ParseShardMap parses shard.map, e.g., "10.1.1.1:6379->10.2.1.1:6379;10.1.1.2:6379->10.2.1.2:6379".
+func ParseShardMap(input string) (map[string]string, error) {
+	ret := make(map[string]string)
+	list := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+	for _, ele := range list {
+		pair := strings.Split(strings.TrimSpace(ele), ShardMapSplitter)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid shard pair[%v]", ele)
+		}
+		source, target := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		if source == "" || target == "" {
+			return nil, fmt.Errorf("invalid shard pair[%v]", ele)
+		}
+		if _, ok := ret[source]; ok {
+			return nil, fmt.Errorf("source shard[%v] is duplicated", source)
+		}
+		ret[source] = target
+	}
+	return ret, nil
+}
+
+/*
+ * ParseAddressMap parses cluster.address_map, e.g., "10.0.0.1:6379->1.2.3.4:16379;10.0.0.2->1.2.3.5".
+ * The pair of ip maps the ip of all the ports, it's given with or without the port on both sides.
+ */
+func ParseAddressMap(input string) (map[string]string, error) {
+	ret := make(map[string]string)
+	list := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+	for _, ele := range list {
+		pair := strings.Split(strings.TrimSpace(ele), ShardMapSplitter)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid address pair[%v]", ele)
+		}
+		from, to := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid address pair[%v]", ele)
+		}
+		_, _, err1 := net.SplitHostPort(from)
+		_, _, err2 := net.SplitHostPort(to)
+		if (err1 == nil) != (err2 == nil) {
+			return nil, fmt.Errorf("the port of address pair[%v] should be given on both sides or neither", ele)
+		}
+		if _, ok := ret[from]; ok {
+			return nil, fmt.Errorf("address[%v] is duplicated", from)
+		}
+		ret[from] = to
+	}
+	return ret, nil
+}
+
+/*
+ * ParseCommandRename parses command.rename, e.g., "config->xconfig;psync->xpsync". The commands are
+ * case-insensitive, the names renamed to are kept as they are.
+ */
+func ParseCommandRename(input string) (map[string]string, error) {
+	ret := make(map[string]string)
+	list := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+	for _, ele := range list {
+		pair := strings.Split(strings.TrimSpace(ele), ShardMapSplitter)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid command pair[%v]", ele)
+		}
+		from, to := strings.ToLower(strings.TrimSpace(pair[0])), strings.TrimSpace(pair[1])
+		if from == "" || to == "" || strings.ContainsAny(to, " \t") {
+			return nil, fmt.Errorf("invalid command pair[%v]", ele)
+		}
+		if _, ok := ret[from]; ok {
+			return nil, fmt.Errorf("command[%v] is duplicated", from)
+		}
+		ret[from] = to
+	}
+	return ret, nil
+}
+
+// HostPatterns are the CIDRs or the globs of the hosts, e.g., "10.0.0.0/8" or "*.internal".
+type HostPatterns []string
+
+func ParseHostPatterns(patterns []string) (HostPatterns, error) {
+	for _, pattern := range patterns {
+		if _, _, err := net.ParseCIDR(pattern); err == nil {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad host pattern[%v]: %v", pattern, err)
+		}
+	}
+	return HostPatterns(patterns), nil
+}
+
+// whether the host of the address matches any pattern, empty patterns match all
+func (p HostPatterns) Match(address string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	for _, pattern := range p {
+		if _, ipnet, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+		} else if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * ParseReshardPlan parses reshard.plan into the master each slot is moved into, e.g.,
+ * "0-1000->10.1.1.4:6379;5461->10.1.1.5:6379". Both ends of the slot range are included.
+ */
+func ParseReshardPlan(input string) (map[int]string, error) {
+	ret := make(map[int]string)
+	list := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+	for _, ele := range list {
+		pair := strings.Split(strings.TrimSpace(ele), ShardMapSplitter)
+		if len(pair) != 2 || strings.TrimSpace(pair[1]) == "" {
+			return nil, fmt.Errorf("invalid slot move[%v]", ele)
+		}
+		low, high, err := filter.ParseSlotRange(pair[0])
+		if err != nil || low < 0 || low > high || high >= ClusterSlots {
+			return nil, fmt.Errorf("invalid slot range[%v] of slot move[%v]", pair[0], ele)
+		}
+		for slot := low; slot <= high; slot++ {
+			if _, ok := ret[slot]; ok {
+				return nil, fmt.Errorf("slot[%v] is moved more than once", slot)
+			}
+			ret[slot] = strings.TrimSpace(pair[1])
+		}
+	}
+	return ret, nil
+}
+
+/*
+ * return the db in the target that the given source db should be written into, based
+ * on target.db and target.db_map. false means the db should be dropped.
+ */
+func MapTargetDB(db int) (int, bool) {
+	return MapJobTargetDB(&conf.Options, db)
+}
+
+// the same as MapTargetDB with target.db and target.db_map of the job in sync.jobs
+func MapJobTargetDB(opts *conf.Configuration, db int) (int, bool) {
+	if opts.TargetDB != -1 {
+		return opts.TargetDB, true
+	}
+
+	if len(opts.TargetDBMap) != 0 {
+		if target, ok := opts.TargetDBMap[db]; ok {
+			return target, true
+		}
+		return db, opts.TargetDBMapPolicy != conf.DBMapPolicyDrop
+	}
+	return db, true
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"redis-shake/configure"
+)
+
+// check the compress type is supported, empty means no compression.
+func CheckCompressType(tp string) error {
+	switch tp {
+	case "", conf.CompressGzip:
+		return nil
+	default:
+		return fmt.Errorf("unknown compress type[%v], should be %v", tp, conf.CompressGzip)
+	}
+}
+
+// the compressed data is flushed after every write so the reader on the other side of the
+// stream won't wait for the data buffered in the compressor.
+type flushCompressWriter struct {
+	w *gzip.Writer
+}
+
+func (f *flushCompressWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.w.Flush()
+}
+
+func (f *flushCompressWriter) Close() error {
+	return f.w.Close()
+}
+
+// NewCompressWriter wraps w with the given compress type, w is returned if tp is empty.
+func NewCompressWriter(w io.Writer, tp string) io.WriteCloser {
+	switch tp {
+	case conf.CompressGzip:
+		return &flushCompressWriter{w: gzip.NewWriter(w)}
+	default:
+		return &nopWriteCloser{w}
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// the decompressor is created on the first read because it reads the header at creation which
+// blocks until the writer sends something.
+type lazyDecompressReader struct {
+	r  io.Reader
+	dr io.Reader
+}
+
+func (l *lazyDecompressReader) Read(p []byte) (int, error) {
+	if l.dr == nil {
+		dr, err := gzip.NewReader(l.r)
+		if err != nil {
+			return 0, err
+		}
+		l.dr = dr
+	}
+	return l.dr.Read(p)
+}
+
+// NewDecompressReader wraps r with the given compress type, r is returned if tp is empty.
+func NewDecompressReader(r io.Reader, tp string) io.Reader {
+	switch tp {
+	case conf.CompressGzip:
+		return &lazyDecompressReader{r: r}
+	default:
+		return r
+	}
+}
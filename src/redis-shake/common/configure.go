@@ -1,9 +1,13 @@
 package utils
 
 import (
-	"strings"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"pkg/libs/log"
 	"redis-shake/configure"
 )
 
@@ -11,23 +15,28 @@ const (
 	AddressSplitter       = "@"
 	AddressHeaderSplitter = ":"
 	AddressClusterSplitter = ";"
+	AddressOptionsSplitter = "?"
 )
 
 // parse source address and target address
 func ParseAddress(tp string) error {
 	// check source
-	if tp == conf.TypeDump || tp == conf.TypeSync || tp == conf.TypeRump {
+	if tp == conf.TypeSync && conf.Options.SourceAofFile != "" {
+		// the files are read instead of the source redis
+		conf.Options.SourceAddressList = []string{conf.Options.SourceAofFile}
+	} else if tp == conf.TypeDump || tp == conf.TypeSync || tp == conf.TypeRump || tp == conf.TypeReshard {
 		if err := parseAddress(tp, conf.Options.SourceAddress, conf.Options.SourceType, true); err != nil {
 			return err
 		}
 
 		if len(conf.Options.SourceAddressList) == 0 {
-			return fmt.Errorf("source address shouldn't be empty when type in {dump, sync, rump}")
+			return fmt.Errorf("source address shouldn't be empty when type in {dump, sync, rump, reshard}")
 		}
 	}
 
-	// check target
-	if tp == conf.TypeRestore || tp == conf.TypeSync || tp == conf.TypeRump {
+	// check target, the slots are moved within the source cluster in reshard if it isn't given
+	if tp == conf.TypeRestore || tp == conf.TypeSync || tp == conf.TypeRump ||
+		tp == conf.TypeReshard && conf.Options.TargetAddress != "" {
 		if err := parseAddress(tp, conf.Options.TargetAddress, conf.Options.TargetType, false); err != nil {
 			return err
 		}
@@ -53,43 +62,30 @@ func parseAddress(tp, address, redisType string, isSource bool) error {
 		/*if addressLen != 1 {
 			return fmt.Errorf("redis type[%v] address[%v] length[%v] != 1", redisType, address, addressLen)
 		}*/
-		setAddressList(isSource, address)
+		if err := setAddressList(isSource, address); err != nil {
+			return err
+		}
 	case conf.RedisTypeSentinel:
-		arr := strings.Split(address, AddressSplitter)
-		if len(arr) != 2 {
-			return fmt.Errorf("redis type[%v] address[%v] must begin with or has '%v': e.g., \"master@ip1:port1;ip2:port2\", " +
-				"\"@ip1:port1,ip2:port2\"",
-				conf.RedisTypeSentinel, address, AddressSplitter)
+		if strings.Contains(address, AddressOptionsSplitter) {
+			return fmt.Errorf("the options of address[%v] aren't supported when type is 'sentinel'", address)
 		}
-
-		var masterName string
-		var fromMaster bool
-		if strings.Contains(arr[0], AddressHeaderSplitter) {
-			arrHeader := strings.Split(arr[0], AddressHeaderSplitter)
-			if isSource {
-				masterName = arrHeader[0]
-				fromMaster = arrHeader[1] == conf.StandAloneRoleMaster
-			} else {
-				masterName = arrHeader[0]
-				fromMaster = true
-			}
-		} else {
-			masterName = arr[0]
-			fromMaster = true
+		masterName, fromMaster, clusterList, err := parseSentinelAddress(address, isSource)
+		if err != nil {
+			return err
 		}
 
-		clusterList := strings.Split(arr[1], AddressClusterSplitter)
-
 		if isSource {
 			// get real source
-			if source, err := GetReadableRedisAddressThroughSentinel(clusterList, masterName, fromMaster); err != nil {
+			if source, err := GetReadableRedisAddressThroughSentinel(clusterList, masterName, fromMaster,
+				conf.Options.SourceSentinelPassword); err != nil {
 				return err
 			} else {
 				conf.Options.SourceAddressList = []string{source}
 			}
 		} else {
 			// get real target
-			if target, err := GetWritableRedisAddressThroughSentinel(clusterList, masterName); err != nil {
+			if target, err := GetWritableRedisAddressThroughSentinel(clusterList, masterName,
+				conf.Options.TargetSentinelPassword); err != nil {
 				return err
 			} else {
 				conf.Options.TargetAddressList = []string{target}
@@ -117,7 +113,7 @@ func parseAddress(tp, address, redisType string, isSource bool) error {
 			// get auth type and password
 			var auth, password string
 			if isSource {
-				auth, password = conf.Options.SourceAuthType, conf.Options.SourcePasswordRaw
+				auth, password = conf.Options.SourceAuthType, SourceAuthToken(conf.Options.SourcePasswordRaw)
 			} else {
 				auth, password = conf.Options.TargetAuthType, conf.Options.TargetPasswordRaw
 			}
@@ -127,8 +123,11 @@ func parseAddress(tp, address, redisType string, isSource bool) error {
 				role = conf.StandAloneRoleAll
 			}
 			// create client to fetch
-			tls := isSource && conf.Options.SourceTLSEnable || !isSource && conf.Options.TargetTLSEnable
-			client := OpenRedisConn(clusterList, auth, password, false, tls)
+			tlsConfig := TargetTLS(conf.Options.TargetTLSEnable)
+			if isSource {
+				tlsConfig = SourceTLS(conf.Options.SourceTLSEnable)
+			}
+			client := OpenRedisConn(clusterList, auth, password, false, tlsConfig)
 			if addressList, err := GetAllClusterNode(client, role, "address"); err != nil {
 				return err
 			} else {
@@ -138,8 +137,23 @@ func parseAddress(tp, address, redisType string, isSource bool) error {
 					conf.Options.TargetAddressList = addressList
 				}
 			}
-		} else {
-			setAddressList(isSource, address)
+		} else if seeds := splitCluster(address); isSource && len(seeds) == 1 {
+			// the seed of the cluster, all the masters are synced
+			if strings.Contains(seeds[0], AddressOptionsSplitter) {
+				return fmt.Errorf("the options of the seed[%v] of the cluster aren't supported", seeds[0])
+			}
+			masters, err := discoverClusterMasters(seeds[0])
+			if err != nil {
+				return err
+			}
+			conf.Options.SourceAddressList = masters
+		} else if err := setAddressList(isSource, address); err != nil {
+			return err
+		}
+		if isSource && conf.Options.SourceClusterReadFrom == conf.ClusterReadFromReplica {
+			if err := pickClusterReplicas(); err != nil {
+				return err
+			}
 		}
 	case conf.RedisTypeProxy:
 		if isSource && addressLen != 1 {
@@ -149,7 +163,9 @@ func parseAddress(tp, address, redisType string, isSource bool) error {
 			return fmt.Errorf("source.type == proxy should only happens when mode is 'rump'")
 		}
 
-		setAddressList(isSource, address)
+		if err := setAddressList(isSource, address); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("unknown type[%v]", redisType)
 	}
@@ -157,14 +173,256 @@ func parseAddress(tp, address, redisType string, isSource bool) error {
 	return nil
 }
 
+/*
+ * the masters of the source cluster found by CLUSTER NODES on the seed, each of them is synced by
+ * one db syncer. Every slot given by CLUSTER SLOTS should be served by one of them, otherwise the
+ * cluster is failing over or resharding and some keys would be missed. The master serving no slot
+ * is dropped. It's checked again on each start, so the shards added or removed are followed.
+ */
+func discoverClusterMasters(seed string) ([]string, error) {
+	client := OpenRedisConn([]string{seed}, conf.Options.SourceAuthType,
+		SourceAuthToken(conf.Options.SourcePasswordRaw), false, SourceTLS(conf.Options.SourceTLSEnable))
+	defer client.Close()
+	nodes, err := GetAllClusterNode(client, conf.StandAloneRoleMaster, "address")
+	if err != nil {
+		return nil, fmt.Errorf("get the nodes of the source cluster from seed[%v] failed: %v", seed, err)
+	}
+	owners, err := ClusterSlotOwners(client, seed)
+	if err != nil {
+		return nil, fmt.Errorf("get the slots of the source cluster from seed[%v] failed: %v", seed, err)
+	}
+
+	isMaster := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		isMaster[node] = true
+	}
+	serving := make(map[string]bool, len(nodes))
+	for slot, owner := range owners {
+		if owner == "" {
+			return nil, fmt.Errorf("slot[%v] of the source cluster isn't served by any master", slot)
+		} else if !isMaster[owner] {
+			return nil, fmt.Errorf("slot[%v] of the source cluster is served by [%v] which isn't a master in "+
+				"cluster nodes, the cluster may be failing over", slot, owner)
+		}
+		serving[owner] = true
+	}
+
+	masters := make([]string, 0, len(serving))
+	for _, node := range nodes {
+		if serving[node] {
+			masters = append(masters, node)
+		} else {
+			log.Infof("master[%v] of the source cluster serves no slot, skip it", node)
+		}
+	}
+	log.Infof("discover %d masters%v of the source cluster from seed[%v]", len(masters), masters, seed)
+	return masters, nil
+}
+
+/*
+ * replace each master in the source address list with its replica in cluster slots, the master
+ * without the replica is kept. The master of each replica is kept in conf.Options.SourceReplicaOf
+ * for the fallback, and the options given in the address of the master are used for the replica.
+ */
+func pickClusterReplicas() error {
+	masters := conf.Options.SourceAddressList
+	var replicas map[string][]string
+	var err error
+	for _, master := range masters {
+		client := OpenRedisConnSoft([]string{master}, conf.Options.SourceAuthType,
+			SourceAuthToken(AddressPassword(conf.Options.SourceAddressOptions, master, conf.Options.SourcePasswordRaw)),
+			time.Second, time.Second, false,
+			SourceTLS(AddressTLS(conf.Options.SourceAddressOptions, master, conf.Options.SourceTLSEnable)))
+		if client == nil {
+			err = fmt.Errorf("connect source[%v] failed", master)
+			continue
+		}
+		replicas, err = ClusterSlotReplicas(client, master)
+		client.Close()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("get the replicas of the source cluster failed: %v", err)
+	}
+
+	list := make([]string, 0, len(masters))
+	conf.Options.SourceReplicaOf = make(map[string]string, len(masters))
+	for _, master := range masters {
+		if len(replicas[master]) == 0 {
+			log.Warnf("master[%v] of the source cluster has no replica, sync it instead", master)
+			list = append(list, master)
+			continue
+		}
+		replica := replicas[master][0]
+		log.Infof("sync replica[%v] instead of master[%v] of the source cluster", replica, master)
+		list = append(list, replica)
+		conf.Options.SourceReplicaOf[replica] = master
+		if opts, ok := conf.Options.SourceAddressOptions[master]; ok {
+			conf.Options.SourceAddressOptions[replica] = opts
+		}
+	}
+	conf.Options.SourceAddressList = list
+	return nil
+}
+
 func splitCluster(input string) []string {
 	return strings.Split(input, AddressClusterSplitter)
 }
 
-func setAddressList(isSource bool, address string) {
+func setAddressList(isSource bool, address string) error {
+	var list []string
+	var options map[string]conf.AddressOptions
+	for _, item := range strings.Split(address, AddressClusterSplitter) {
+		addr, opts, err := parseAddressOptions(item, isSource)
+		if err != nil {
+			return err
+		}
+		if opts != nil {
+			if options == nil {
+				options = make(map[string]conf.AddressOptions)
+			}
+			options[addr] = *opts
+		}
+		list = append(list, addr)
+	}
+
 	if isSource {
-		conf.Options.SourceAddressList = strings.Split(address, AddressClusterSplitter)
+		conf.Options.SourceAddressList = list
+		conf.Options.SourceAddressOptions = options
 	} else {
-		conf.Options.TargetAddressList = strings.Split(address, AddressClusterSplitter)
+		conf.Options.TargetAddressList = list
+		conf.Options.TargetAddressOptions = options
+	}
+	return nil
+}
+
+// AddressPassword returns the password given in the address list for the address, or def if not given.
+func AddressPassword(options map[string]conf.AddressOptions, address, def string) string {
+	if password := options[address].Password; password != nil {
+		return *password
+	}
+	return def
+}
+
+// AddressTLS returns the tls given in the address list for the address, or def if not given.
+func AddressTLS(options map[string]conf.AddressOptions, address string, def bool) bool {
+	if tls := options[address].TLS; tls != nil {
+		return *tls
+	}
+	return def
+}
+
+// the address and the options after "?" of it, e.g., "127.0.0.1:6379?password=x&tls=true&weight=2",
+// the options are nil if not given. weight is only for the target, parallel, sender_count and qps
+// are only for the source.
+func parseAddressOptions(item string, isSource bool) (string, *conf.AddressOptions, error) {
+	i := strings.Index(item, AddressOptionsSplitter)
+	if i < 0 {
+		return item, nil, nil
+	}
+	addr := item[:i]
+	values, err := url.ParseQuery(item[i+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("parse the options of address[%v] failed: %v", addr, err)
+	}
+
+	opts := new(conf.AddressOptions)
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "password":
+			opts.Password = &value
+		case "tls":
+			tls, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("parse tls[%v] of address[%v] failed: %v", value, addr, err)
+			}
+			opts.TLS = &tls
+		case "weight":
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight <= 0 {
+				return "", nil, fmt.Errorf("weight[%v] of address[%v] should be a positive integer", value, addr)
+			}
+			if isSource {
+				return "", nil, fmt.Errorf("weight of address[%v] is only supported in target.address", addr)
+			}
+			opts.Weight = weight
+		case "parallel", "sender_count", "qps":
+			// the same bounds as parallel, sender.count and qps
+			max := map[string]int{"parallel": 1024, "sender_count": 99999, "qps": 99999999}[key]
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > max {
+				return "", nil, fmt.Errorf("%v[%v] of address[%v] should in (0, %v]", key, value, addr, max)
+			}
+			if !isSource {
+				return "", nil, fmt.Errorf("%v of address[%v] is only supported in source.address", key, addr)
+			}
+			switch key {
+			case "parallel":
+				opts.Parallel = n
+			case "sender_count":
+				opts.SenderCount = uint(n)
+			default:
+				opts.Qps = n
+			}
+		default:
+			return "", nil, fmt.Errorf("unknown option[%v] of address[%v], should be in {password, tls, weight, "+
+				"parallel, sender_count, qps}", key, addr)
+		}
+	}
+	return addr, opts, nil
+}
+
+// the master name, whether to read from the master and the sentinels in the sentinel address
+func parseSentinelAddress(address string, isSource bool) (string, bool, []string, error) {
+	arr := strings.Split(address, AddressSplitter)
+	if len(arr) != 2 {
+		return "", false, nil, fmt.Errorf("redis type[%v] address[%v] must begin with or has '%v': e.g., \"master@ip1:port1;ip2:port2\", "+
+			"\"@ip1:port1,ip2:port2\"",
+			conf.RedisTypeSentinel, address, AddressSplitter)
+	}
+
+	var masterName string
+	var fromMaster bool
+	if strings.Contains(arr[0], AddressHeaderSplitter) {
+		arrHeader := strings.Split(arr[0], AddressHeaderSplitter)
+		if isSource {
+			masterName = arrHeader[0]
+			fromMaster = arrHeader[1] == conf.StandAloneRoleMaster
+		} else {
+			masterName = arrHeader[0]
+			fromMaster = true
+		}
+	} else {
+		masterName = arr[0]
+		fromMaster = true
+	}
+	return masterName, fromMaster, strings.Split(arr[1], AddressClusterSplitter), nil
+}
+
+/*
+ * ResolveSentinelSource gets the source address through the sentinel in source.address again, e.g.,
+ * after the master fails over. fromMaster is false if the source is read from a slave, which is
+ * picked randomly each time.
+ */
+func ResolveSentinelSource(options *conf.Configuration) (address string, fromMaster bool, err error) {
+	masterName, fromMaster, sentinels, err := parseSentinelAddress(options.SourceAddress, true)
+	if err != nil {
+		return "", false, err
+	}
+	address, err = GetReadableRedisAddressThroughSentinel(sentinels, masterName, fromMaster,
+		options.SourceSentinelPassword)
+	return address, fromMaster, err
+}
+
+// ResolveSentinelTarget gets the master through the sentinel in target.address again, e.g., after
+// the target fails over.
+func ResolveSentinelTarget(options *conf.Configuration) (string, error) {
+	masterName, _, sentinels, err := parseSentinelAddress(options.TargetAddress, false)
+	if err != nil {
+		return "", err
 	}
+	return GetWritableRedisAddressThroughSentinel(sentinels, masterName, options.TargetSentinelPassword)
 }
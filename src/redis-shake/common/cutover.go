@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const CutoverEventDone = "cutover_done" // all the syncers are drained, the clients can be repointed
+
+// the position of one syncer once it's drained
+type CutoverSyncer struct {
+	Syncer int    `json:"syncer"`
+	Source string `json:"source"`
+	RunId  string `json:"runid"`
+	Offset int64  `json:"offset"` // the commands before it are all replied by the target
+}
+
+type CutoverEvent struct {
+	Event   string          `json:"event"`
+	Id      string          `json:"id"`
+	Syncers []CutoverSyncer `json:"syncers"`
+	Ts      int64           `json:"ts"`
+}
+
+// SendCutoverWebhook POSTs the event to the url and waits for the response, unlike NotifyFullSyncEvent
+// the process quits right after it.
+func SendCutoverWebhook(url string, event *CutoverEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
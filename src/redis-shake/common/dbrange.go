@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// IsDBOutOfRangeError tells whether the error is replied to SELECT of the db which doesn't exist.
+func IsDBOutOfRangeError(err error) bool {
+	if err == nil {
+		return false
+	}
+	s := err.Error()
+	return strings.Contains(s, "DB index is out of range") || strings.Contains(s, "invalid DB index")
+}
+
+/*
+ * TargetDBChecker applies target.db_out_of_range to the db which can't be selected on the
+ * target, e.g., the source has more dbs than "databases" of the target. Each db is checked once
+ * by SELECT on a connection of its own, so the connections writing data aren't affected.
+ */
+type TargetDBChecker struct {
+	policy string // target.db_out_of_range
+	proxy  bool   // the target is the proxy
+	open   func() redigo.Conn
+
+	mu      sync.Mutex
+	c       redigo.Conn
+	inRange map[int]bool
+}
+
+func NewTargetDBChecker(options *conf.Configuration, open func() redigo.Conn) *TargetDBChecker {
+	return &TargetDBChecker{
+		policy:  options.TargetDBOutOfRange,
+		proxy:   options.TargetType == conf.RedisTypeProxy,
+		open:    open,
+		inRange: make(map[int]bool),
+	}
+}
+
+// Map returns the db to write into, false means the data of the db is dropped.
+func (dc *TargetDBChecker) Map(db int) (int, bool) {
+	policy := dc.policy
+	if db != 0 && dc.proxy {
+		// the proxy has db 0 only and SELECT isn't sent
+		if policy == "" || policy == conf.DBOutOfRangeError {
+			log.Panicf("target db[%d] isn't supported by the proxy target, see target.db_out_of_range", db)
+		}
+		if policy == conf.DBOutOfRangeSkip {
+			return db, false
+		}
+		return 0, true
+	}
+	if db == 0 || policy == "" || policy == conf.DBOutOfRangeError {
+		// SELECT fails later if it's out of range
+		return db, true
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	inRange, ok := dc.inRange[db]
+	if !ok {
+		if dc.c == nil {
+			dc.c = dc.open()
+		}
+		_, err := dc.c.Do("select", db)
+		if err != nil && !IsDBOutOfRangeError(err) {
+			log.PanicErrorf(err, "select target db[%d] failed", db)
+		}
+		inRange = err == nil
+		dc.inRange[db] = inRange
+		if !inRange {
+			log.Warnf("target db[%d] is out of range, %s the data of it by target.db_out_of_range", db, policy)
+		}
+	}
+
+	if inRange {
+		return db, true
+	} else if policy == conf.DBOutOfRangeSkip {
+		return db, false
+	}
+	return 0, true
+}
+
+func (dc *TargetDBChecker) Close() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.c != nil {
+		dc.c.Close()
+		dc.c = nil
+	}
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+)
+
+const (
+	FullSyncEventSyncerDone = "syncer_done" // one syncer finished the rdb phase
+	FullSyncEventAllDone    = "all_done"    // all syncers finished the rdb phase
+
+	fullSyncEventChanSize = 1024
+)
+
+type FullSyncEvent struct {
+	Event     string `json:"event"`
+	Id        string `json:"id"`
+	Syncer    int    `json:"syncer"` // -1 in the all_done event
+	Source    string `json:"source"`
+	Entry     int64  `json:"entry"`
+	Ignore    int64  `json:"ignore"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Ts        int64  `json:"ts"`
+}
+
+var (
+	fullSyncEventChan chan *FullSyncEvent
+	fullSyncEventOnce sync.Once
+)
+
+// NotifyFullSyncEvent queues the event to fullsync.done_webhook and fullsync.done_marker. Events are
+// sent in order in the background, so the caller is never blocked.
+func NotifyFullSyncEvent(event *FullSyncEvent) {
+	if conf.Options.FullSyncDoneWebhook == "" && conf.Options.FullSyncDoneMarker == "" {
+		return
+	}
+
+	fullSyncEventOnce.Do(func() {
+		fullSyncEventChan = make(chan *FullSyncEvent, fullSyncEventChanSize)
+		go func() {
+			for event := range fullSyncEventChan {
+				sendFullSyncEvent(event)
+			}
+		}()
+	})
+
+	event.Id = conf.Options.Id
+	event.Ts = time.Now().UnixNano() / int64(time.Millisecond)
+	select {
+	case fullSyncEventChan <- event:
+	default:
+		log.Warnf("Event:FullSyncEventDropped\tId:%s\tEvent:%s\tSyncer:%d", event.Id, event.Event, event.Syncer)
+	}
+}
+
+func sendFullSyncEvent(event *FullSyncEvent) {
+	data, _ := json.Marshal(event)
+
+	if conf.Options.FullSyncDoneMarker != "" {
+		// one json per line
+		f, err := os.OpenFile(conf.Options.FullSyncDoneMarker, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Warnf("Event:WriteFullSyncMarkerFail\tId:%s\tFile:%s\tError:%s", event.Id,
+				conf.Options.FullSyncDoneMarker, err.Error())
+		} else {
+			if _, err := f.Write(append(data, '\n')); err != nil {
+				log.Warnf("Event:WriteFullSyncMarkerFail\tId:%s\tFile:%s\tError:%s", event.Id,
+					conf.Options.FullSyncDoneMarker, err.Error())
+			}
+			f.Close()
+		}
+	}
+
+	if conf.Options.FullSyncDoneWebhook != "" {
+		client := http.Client{
+			Timeout: 10 * time.Second,
+		}
+		resp, err := client.Post(conf.Options.FullSyncDoneWebhook, "application/json", bytes.NewBuffer(data))
+		if err != nil {
+			log.Warnf("Event:SendFullSyncWebhookFail\tId:%s\tURL:%s\tError:%s", event.Id,
+				conf.Options.FullSyncDoneWebhook, err.Error())
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Warnf("Event:SendFullSyncWebhookFail\tId:%s\tURL:%s\tStatus:%s", event.Id,
+				conf.Options.FullSyncDoneWebhook, resp.Status)
+			return
+		}
+	}
+	log.Infof("Event:SendFullSyncEventDone\tId:%s\tEvent:%s\tSyncer:%d", event.Id, event.Event, event.Syncer)
+}
@@ -0,0 +1,12 @@
+package utils
+
+// huaweiCluster is the proxy of the cluster of huawei cloud DCS, which is scanned as a single
+// node. It has 1 logical db only, SELECT of another db fails on it, so db 0 is scanned without
+// looking into "info keyspace".
+type huaweiCluster struct {
+	cloudBase
+}
+
+func (huaweiCluster) Dbs() []int32 {
+	return []int32{0}
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	elastiCacheService      = "elasticache"
+	elastiCacheTokenExpires = 900 // seconds, the max allowed by elasticache
+	awsDateFormat           = "20060102T150405Z"
+
+	// the long-lived connection is authenticated again before the token expires
+	elastiCacheReauthInterval = 10 * time.Minute
+)
+
+// the instance metadata service serving the credentials of the role, replaced in the test
+var awsMetadataEndpoint = "http://169.254.169.254"
+
+/*
+ * elastiCacheTokenProvider generates the IAM auth token of ElastiCache, which is the request of
+ * "connect" presigned by SigV4 and valid for 15 minutes. It's cheap to generate, so a new one is
+ * generated every time the connection is opened, the reconnection after the token expires is
+ * authenticated as well, and the connection kept open is authenticated again by a new one every
+ * 10 minutes, see ReauthInterval. The credentials are read from the environment variables AWS_ACCESS_KEY_ID,
+ * AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or fetched from the instance metadata service by
+ * the role attached to the host.
+ */
+type elastiCacheTokenProvider struct {
+	region     string
+	cacheName  string
+	user       string
+	serverless bool
+
+	creds awsCredentialCache
+	now   func() time.Time
+}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// parse "${region}:${cache name}:${user id}[:serverless]"
+func newElastiCacheTokenProvider(value string) (*elastiCacheTokenProvider, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != 3 && !(len(fields) == 4 && fields[3] == "serverless") {
+		return nil, fmt.Errorf("invalid elasticache auth provider[%v], should be "+
+			"'region:cache name:user id[:serverless]'", value)
+	}
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("invalid elasticache auth provider[%v], empty field", value)
+		}
+	}
+	return &elastiCacheTokenProvider{
+		region:     fields[0],
+		cacheName:  strings.ToLower(fields[1]),
+		user:       fields[2],
+		serverless: len(fields) == 4,
+		now:        time.Now,
+	}, nil
+}
+
+func (p *elastiCacheTokenProvider) Token() (string, error) {
+	creds, err := p.creds.get(p.now())
+	if err != nil {
+		return "", fmt.Errorf("fetch aws credentials failed: %v", err)
+	}
+
+	now := p.now().UTC()
+	date := now.Format(awsDateFormat)
+	scope := strings.Join([]string{date[:8], p.region, elastiCacheService, "aws4_request"}, "/")
+	query := url.Values{
+		"Action":              {"connect"},
+		"User":                {p.user},
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {creds.AccessKeyId + "/" + scope},
+		"X-Amz-Date":          {date},
+		"X-Amz-Expires":       {fmt.Sprint(elastiCacheTokenExpires)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if p.serverless {
+		query.Set("ResourceType", "ServerlessCache")
+	}
+	if creds.Token != "" {
+		query.Set("X-Amz-Security-Token", creds.Token)
+	}
+	canonicalQuery := awsCanonicalQuery(query)
+
+	emptyHash := sha256.Sum256(nil)
+	canonicalRequest := strings.Join([]string{"GET", "/", canonicalQuery, "host:" + p.cacheName + "\n", "host",
+		hex.EncodeToString(emptyHash[:])}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope,
+		hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := awsSigningKey(creds.SecretAccessKey, date[:8], p.region, elastiCacheService)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	token := p.cacheName + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature
+	return ACLPassword(p.user, token), nil
+}
+
+func (p *elastiCacheTokenProvider) ReauthInterval() time.Duration {
+	return elastiCacheReauthInterval
+}
+
+// the credentials of the role fetched from the metadata service, shared by the requests signed
+type awsCredentialCache struct {
+	mu    sync.Mutex
+	creds *awsCredentials
+}
+
+// the credentials in the environment variables, or of the role of the instance
+func (cc *awsCredentialCache) get(now time.Time) (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyId: id, SecretAccessKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	// refreshed 5 minutes before the expiration, so the token signed is valid in its 15 minutes
+	if cc.creds != nil && now.Add(5*time.Minute).Before(cc.creds.Expiration) {
+		return cc.creds, nil
+	}
+	creds, err := fetchInstanceCredentials()
+	if err != nil {
+		return nil, err
+	}
+	cc.creds = creds
+	return creds, nil
+}
+
+// fetch the credentials of the role by IMDSv2
+func fetchInstanceCredentials() (*awsCredentials, error) {
+	client := &http.Client{Timeout: 3 * time.Second}
+	do := func(method, path, token string) (string, error) {
+		req, err := http.NewRequest(method, awsMetadataEndpoint+path, nil)
+		if err != nil {
+			return "", err
+		}
+		if token == "" {
+			req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+		} else {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		} else if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%v %v replied %v", method, path, resp.Status)
+		}
+		return strings.TrimSpace(string(body)), nil
+	}
+
+	token, err := do("PUT", "/latest/api/token", "")
+	if err != nil {
+		return nil, err
+	}
+	roles, err := do("GET", "/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.SplitN(roles, "\n", 2)[0]
+	if role == "" {
+		return nil, fmt.Errorf("no role is attached to the instance")
+	}
+	content, err := do("GET", "/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return nil, err
+	}
+	creds := new(awsCredentials)
+	if err := json.Unmarshal([]byte(content), creds); err != nil {
+		return nil, fmt.Errorf("parse the credentials of role[%v] failed: %v", role, err)
+	}
+	return creds, nil
+}
+
+// the key of SigV4 derived from the secret for the day, the region and the service
+func awsSigningKey(secret, day, region, service string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, v := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// the query sorted by the key, and escaped by rfc3986 as SigV4 requires
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escape all but the unreserved characters of rfc3986, unlike url.QueryEscape "~" is kept
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '.' || ch == '_' || ch == '~' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
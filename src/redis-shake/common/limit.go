@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"sync"
+
+	"pkg/libs/atomic2"
+	"pkg/libs/log"
+	"pkg/rdb"
+	"redis-shake/configure"
+)
+
+// RestoreLimiter counts the entries restored in the rdb phase against limit.key_count and
+// limit.byte_count. One limiter is shared by all the syncers and their workers, so the limits
+// are on the total. Once a syncer begins another full sync, the entries of its last one aren't
+// counted any more, see Begin. A nil limiter has no limit.
+type RestoreLimiter struct {
+	id        string
+	keyCount  uint64
+	byteCount uint64
+
+	mu     sync.Mutex
+	shares map[int]*RestoreShare // by the id of the syncer
+
+	keys, bytes atomic2.Int64
+	hit         atomic2.Bool
+}
+
+// RestoreShare is the part of the counts of one full sync of a syncer.
+type RestoreShare struct {
+	l           *RestoreLimiter
+	keys, bytes atomic2.Int64
+}
+
+// NewRestoreLimiter returns nil if neither limit.key_count nor limit.byte_count is set.
+func NewRestoreLimiter(options *conf.Configuration) *RestoreLimiter {
+	if options.LimitKeyCount == 0 && options.LimitByteCount == 0 {
+		return nil
+	}
+	return &RestoreLimiter{
+		id:        options.Id,
+		keyCount:  options.LimitKeyCount,
+		byteCount: options.LimitByteCount,
+		shares:    make(map[int]*RestoreShare),
+	}
+}
+
+// Begin is called by the syncer before the rdb is restored, the share of its last full sync is
+// taken away from the counts.
+func (l *RestoreLimiter) Begin(owner int) *RestoreShare {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.shares[owner]; ok {
+		keys := l.keys.Add(-last.keys.Get())
+		bytes := l.bytes.Add(-last.bytes.Get())
+		if l.within(keys, bytes) {
+			l.hit.Set(false)
+		}
+	}
+	share := &RestoreShare{l: l}
+	l.shares[owner] = share
+	return share
+}
+
+func (l *RestoreLimiter) within(keys, bytes int64) bool {
+	return (l.keyCount == 0 || keys <= int64(l.keyCount)) && (l.byteCount == 0 || bytes <= int64(l.byteCount))
+}
+
+// Reached returns true if restoring the entry exceeds limit.key_count or limit.byte_count, the
+// entry should be dropped then. Once reached, all the following entries are dropped. Aux fields
+// aren't counted, nor are the entries dropped.
+func (s *RestoreShare) Reached(e *rdb.BinEntry) bool {
+	if s == nil || e.Type == rdb.RdbFlagAUX {
+		return false
+	}
+
+	l, size := s.l, int64(len(e.Key)+len(e.Value))
+	if l.hit.Get() {
+		return true
+	}
+	if l.within(l.keys.Incr(), l.bytes.Add(size)) {
+		s.keys.Incr()
+		s.bytes.Add(size)
+		return false
+	}
+	l.keys.Add(-1)
+	l.bytes.Add(-size)
+
+	if l.hit.CompareAndSwap(false, true) {
+		log.Warnf("Event:RestoreLimitHit\tId:%s\tlimit.key_count = %d\tlimit.byte_count = %d, the following "+
+			"entries are dropped", l.id, l.keyCount, l.byteCount)
+	}
+	return true
+}
+
+// whether limit.key_count or limit.byte_count is hit
+func (l *RestoreLimiter) Hit() bool {
+	return l != nil && l.hit.Get()
+}
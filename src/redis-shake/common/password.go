@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"redis-shake/configure"
+)
+
+/*
+ * The password of password_encoding is "${encoding}:${data}" so the plaintext isn't kept in the
+ * configuration file. "base64:${data}" is only obfuscated, "aes-gcm:${data}" is the base64 of the
+ * nonce followed by the ciphertext sealed by AES-GCM with the key of password.key or
+ * password.key_file, which is the base64 of 16, 24 or 32 bytes. The encoded one is generated by
+ * "redis-shake -encode_password ${encoding}" with the password read from the stdin.
+ */
+
+// LoadPasswordKey returns the key of AES-GCM given by the base64 or the file of it, nil if neither
+// is given.
+func LoadPasswordKey(key, keyFile string) ([]byte, error) {
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("only one of password.key and password.key_file should be given")
+	}
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(content))
+		if key == "" {
+			return nil, fmt.Errorf("key file[%v] is empty", keyFile)
+		}
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	ret, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("the key should be base64: %v", err)
+	}
+	if n := len(ret); n != 16 && n != 24 && n != 32 {
+		return nil, fmt.Errorf("the key should be 16, 24 or 32 bytes, but is %v bytes", n)
+	}
+	return ret, nil
+}
+
+// DecodePassword decodes the password of password_encoding, the key is used by aes-gcm only.
+func DecodePassword(encoded string, key []byte) (string, error) {
+	i := strings.Index(encoded, ":")
+	if i == -1 {
+		return "", fmt.Errorf("should be '${encoding}:${data}'")
+	}
+	encoding, data := encoded[:i], encoded[i+1:]
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("the data should be base64: %v", err)
+	}
+
+	switch encoding {
+	case conf.PasswordEncodingBase64:
+		return string(raw), nil
+	case conf.PasswordEncodingAESGCM:
+		gcm, err := newPasswordGCM(key)
+		if err != nil {
+			return "", err
+		}
+		if len(raw) < gcm.NonceSize() {
+			return "", fmt.Errorf("the data is too short")
+		}
+		plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+		if err != nil {
+			return "", fmt.Errorf("decrypt failed, the key may be wrong: %v", err)
+		}
+		return string(plain), nil
+	}
+	return "", fmt.Errorf("unknown encoding[%v], should be in {%v, %v}", encoding,
+		conf.PasswordEncodingBase64, conf.PasswordEncodingAESGCM)
+}
+
+// EncodePassword encodes the password into the value of password_encoding.
+func EncodePassword(encoding, password string, key []byte) (string, error) {
+	var raw []byte
+	switch encoding {
+	case conf.PasswordEncodingBase64:
+		raw = []byte(password)
+	case conf.PasswordEncodingAESGCM:
+		gcm, err := newPasswordGCM(key)
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		raw = gcm.Seal(nonce, nonce, []byte(password), nil)
+	default:
+		return "", fmt.Errorf("unknown encoding[%v], should be in {%v, %v}", encoding,
+			conf.PasswordEncodingBase64, conf.PasswordEncodingAESGCM)
+	}
+	return encoding + ":" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func newPasswordGCM(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, fmt.Errorf("password.key or password.key_file should be given for %v",
+			conf.PasswordEncodingAESGCM)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
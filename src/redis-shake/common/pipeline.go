@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"pkg/libs/log"
+	"pkg/rdb"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+/*
+ * RestorePipeline sends up to count RESTORE in one batch on the connection and reads the
+ * replies after that, which saves the round trips on the link with high latency. SELECT is
+ * sent in the batch in order too. The entry failed in the batch is restored again alone by
+ * RestoreRdbEntry, so the busy key, IDLETIME/FREQ and the bad data format are handled the same
+ * way as before, and the others in the batch aren't affected. The special entries, e.g., the
+ * big key, flush the batch and are restored alone.
+ */
+type RestorePipeline struct {
+	c      redigo.Conn
+	count  int
+	bigKey uint64 // see BigKeyThreshold
+
+	batch    []pipelineItem
+	restores int    // RESTORE in the batch
+	db       uint32 // the db selected once the batch is done
+
+	Restored int64 // entries restored in batches
+	Retried  int64 // entries failed in the batch and restored again alone
+}
+
+type pipelineItem struct {
+	e     *rdb.BinEntry // nil for SELECT
+	db    uint32
+	ttlms uint64
+}
+
+func NewRestorePipeline(c redigo.Conn, count int, bigKey uint64) *RestorePipeline {
+	return &RestorePipeline{
+		c:      c,
+		count:  count,
+		bigKey: bigKey,
+		batch:  make([]pipelineItem, 0, count),
+	}
+}
+
+func (p *RestorePipeline) Select(db uint32) {
+	if err := p.c.Send("select", db); err != nil {
+		log.PanicError(err, "send select command error")
+	}
+	p.batch = append(p.batch, pipelineItem{db: db})
+	p.db = db
+}
+
+func (p *RestorePipeline) Restore(e *rdb.BinEntry) {
+	ttlms := prepareRdbEntry(e)
+	if isSpecialRdbEntry(e, p.bigKey) {
+		p.Flush()
+		restoreSpecialRdbEntry(p.c, e, ttlms, p.bigKey)
+		return
+	}
+
+	params, _ := restoreParams(e, ttlms)
+	log.Debugf("pipeline restore key[%s] with params[%v]", e.Key, params)
+	if err := p.c.Send("restore", params...); err != nil {
+		log.PanicError(err, "send restore command error")
+	}
+	p.batch = append(p.batch, pipelineItem{e: e, db: p.db, ttlms: ttlms})
+	if p.restores++; p.restores >= p.count {
+		p.Flush()
+	}
+}
+
+// send the batch and check the replies one by one
+func (p *RestorePipeline) Flush() {
+	if len(p.batch) == 0 {
+		return
+	}
+	if err := p.c.Flush(); err != nil {
+		log.PanicError(err, "flush restore pipeline error")
+	}
+
+	var failed []pipelineItem
+	for _, item := range p.batch {
+		s, err := redigo.String(p.c.Receive())
+		if item.e == nil {
+			if err != nil {
+				log.PanicError(err, "select command error")
+			} else if s != "OK" {
+				log.Panicf("select command response = '%s', should be 'OK'", s)
+			}
+			continue
+		}
+		if err != nil {
+			log.Debugf("pipeline restore key[%s] failed[%v], restore it again alone", item.e.Key, err)
+			failed = append(failed, item)
+		} else if s != "OK" {
+			log.Panicf("restore command response = '%s', should be 'OK'", s)
+		} else {
+			p.Restored++
+		}
+	}
+	p.batch = p.batch[:0]
+	p.restores = 0
+
+	// the failed entry may be in another db than the current one
+	db := p.db
+	for _, item := range failed {
+		if item.db != db {
+			db = item.db
+			SelectDB(p.c, db)
+		}
+		restoreRdbValue(p.c, item.e, item.ttlms)
+		p.Retried++
+	}
+	if db != p.db {
+		SelectDB(p.c, p.db)
+	}
+}
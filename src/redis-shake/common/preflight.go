@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"pkg/rdb"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const preflightTimeout = 5 * time.Second
+
+/*
+ * PreflightCheck connects to the address, authenticates and runs INFO, the error says which
+ * endpoint and which check failed instead of panicking deep in the sync. If write is set, the
+ * replica is rejected and a temporary key is written and deleted to confirm the endpoint is
+ * writable. The key can't be routed in the cluster, so only the role is checked there.
+ */
+func PreflightCheck(role, address, authType, passwd string, tlsConfig *tls.Config, write, isCluster bool) error {
+	c, err := preflightConn(role, address, authType, passwd, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	info, err := redigo.Bytes(c.Do("info"))
+	if err != nil {
+		return fmt.Errorf("%s[%v] info failed: %v%s", role, address, err, AuthHint(role, err.Error()))
+	}
+	if !write {
+		return nil
+	}
+
+	if ParseRedisInfo(info)["role"] == "slave" {
+		return fmt.Errorf("%s[%v] is a replica which isn't writable", role, address)
+	}
+	if isCluster {
+		return nil
+	}
+
+	key := fmt.Sprintf("redis-shake-preflight-%d", os.Getpid())
+	if _, err := c.Do("set", key, "1", "px", preflightTimeout.Nanoseconds()/int64(time.Millisecond)); err != nil {
+		if strings.HasPrefix(err.Error(), "READONLY") {
+			return fmt.Errorf("%s[%v] is read-only: %v", role, address, err)
+		}
+		return fmt.Errorf("%s[%v] write failed: %v", role, address, err)
+	}
+	if _, err := c.Do("del", key); err != nil {
+		return fmt.Errorf("%s[%v] del failed: %v", role, address, err)
+	}
+	return nil
+}
+
+// connect to the address and authenticate, the error says which endpoint and which step failed
+func preflightConn(role, address, authType, passwd string, tlsConfig *tls.Config) (redigo.Conn, error) {
+	d := &net.Dialer{Timeout: preflightTimeout}
+	nc, err := dialConn(d, address, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s[%v] connect failed: %v", role, address, err)
+	}
+	c := newRedisConn(nc, preflightTimeout, preflightTimeout)
+
+	if passwd != "" {
+		if _, err := c.Do(authType, AuthArgs(passwd)...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s[%v] %s failed: %v", role, address, authType, err)
+		}
+	}
+	return c, nil
+}
+
+/*
+ * CheckSlotCoverage checks all the 16384 slots are served in cluster slots of the node of the
+ * cluster, otherwise the keys of the slots not served are rejected with CLUSTERDOWN after the
+ * sync starts.
+ */
+func CheckSlotCoverage(role, address, authType, passwd string, tlsConfig *tls.Config) error {
+	c, err := preflightConn(role, address, authType, passwd, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	slots, err := ClusterSlotOwners(c, address)
+	if err != nil {
+		return fmt.Errorf("%s[%v] cluster slots failed: %v", role, address, err)
+	}
+	if missing := uncoveredSlots(slots); missing != "" {
+		return fmt.Errorf("%s[%v] cluster doesn't serve slots[%v], assign them to the masters first", role,
+			address, missing)
+	}
+	return nil
+}
+
+// the slots served by nobody as the ranges, e.g., "0-99,5461", empty if all are served
+func uncoveredSlots(slots [ClusterSlots]string) string {
+	var ranges []string
+	for start := 0; start < ClusterSlots; start++ {
+		if slots[start] != "" {
+			continue
+		}
+		end := start
+		for end+1 < ClusterSlots && slots[end+1] == "" {
+			end++
+		}
+		if start == end {
+			ranges = append(ranges, strconv.Itoa(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+		}
+		start = end
+	}
+	return strings.Join(ranges, ",")
+}
+
+/*
+ * CheckRdbCompatible checks the rdb of the source version can be decoded, the newer rdb, e.g.,
+ * the listpack encodings of redis 7.0, fails the full sync at once. Then the target version is
+ * checked by CheckRdbVersion, rewrite is true if the keys should be written by commands.
+ */
+func CheckRdbCompatible(sourceVersion, targetVersion, policy string) (bool, error) {
+	version := RedisRdbVersion(sourceVersion)
+	if version == 0 {
+		// unknown
+		return false, nil
+	}
+	if version > rdb.FromVersion {
+		return false, fmt.Errorf("source redis version[%v] writes rdb version %v whose encodings can't be "+
+			"decoded, only rdb version <= %v is supported", sourceVersion, version, rdb.FromVersion)
+	}
+	return CheckRdbVersion(version, targetVersion, policy)
+}
+
+// RdbFileVersion returns the rdb version in the header of the rdb file.
+func RdbFileVersion(file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	l := rdb.NewLoader(f)
+	if err := l.Header(); err != nil {
+		return 0, fmt.Errorf("rdb file[%v] %v", file, err)
+	}
+	return l.Version(), nil
+}
+
+/*
+ * SourceModules returns the modules loaded by the source in "info modules", the keys of the
+ * module types can't be decoded. The source older than 4.0 has no modules.
+ */
+func SourceModules(address, authType, passwd string, tlsConfig *tls.Config) ([]string, error) {
+	c, err := preflightConn("source", address, authType, passwd, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	info, err := redigo.String(c.Do("info", "modules"))
+	if err != nil {
+		return nil, fmt.Errorf("source[%v] info modules failed: %v", address, err)
+	}
+	var modules []string
+	for _, line := range strings.Split(info, "\n") {
+		// module:name=ReJSON,ver=20008,api=1,filters=0,usedby=[],using=[],options=[]
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "module:") {
+			continue
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(line, "module:"), ",") {
+			if strings.HasPrefix(field, "name=") {
+				modules = append(modules, strings.TrimPrefix(field, "name="))
+			}
+		}
+	}
+	return modules, nil
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+)
+
+/*
+ * the commands which the proxy target, e.g., codis and twemproxy, rejects or can't route to the
+ * right backend, they're dropped when target.type = proxy. The proxy has db 0 only, so SELECT is
+ * never sent, see TargetDBChecker. MULTI and EXEC are dropped while the commands in between are
+ * still sent one by one, so the transaction of the source isn't atomic on the target.
+ */
+var proxyUnsupportedCommands = map[string]struct{}{
+	"select":   {},
+	"multi":    {},
+	"exec":     {},
+	"discard":  {},
+	"watch":    {},
+	"unwatch":  {},
+	"flushall": {},
+	"flushdb":  {},
+	"swapdb":   {},
+	"move":     {},
+	"rename":   {},
+	"renamenx": {},
+	"bitop":    {},
+	"migrate":  {},
+	"publish":  {},
+	"spublish": {},
+	"script":   {},
+	"function": {},
+}
+
+// the commands which are sent as another one supported by the proxy target. msetnx whose keys may
+// be routed to different backends is sent as mset, it's only propagated once all the keys are set
+// on the source, see SplitCommandBySlot.
+var proxyTranslatedCommands = map[string]string{
+	"unlink":         "del",
+	"restore-asking": "restore",
+	"msetnx":         "mset",
+}
+
+// ProxyCommand returns the command sent to the proxy target instead, false if it's dropped.
+func ProxyCommand(cmd string) (string, bool) {
+	lower := strings.ToLower(cmd)
+	if _, ok := proxyUnsupportedCommands[lower]; ok {
+		return cmd, false
+	}
+	if translated, ok := proxyTranslatedCommands[lower]; ok {
+		return translated, true
+	}
+	return cmd, true
+}
+
+// CommandCounts counts the commands by the name, e.g., the ones dropped for the proxy target. The
+// zero value is ready to use.
+type CommandCounts struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// Incr the count of the command, true if it's the first one.
+func (c *CommandCounts) Incr(cmd string) bool {
+	cmd = strings.ToLower(cmd)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[cmd]++
+	return c.counts[cmd] == 1
+}
+
+// Counts returns the count of each command.
+func (c *CommandCounts) Counts() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Summary returns the counts as "command=count" sorted by the command.
+func (c *CommandCounts) Summary() string {
+	return formatCounts(c.Counts())
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"redis-shake/configure"
+)
+
+// nil means no PROXY protocol header is sent
+var ProxyProtocol *ProxyHeader
+
+// the signature of the PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyHeader writes the header of the PROXY protocol right after the connection is opened, so the
+// load balancer enforcing it, e.g., HAProxy with accept-proxy, accepts the connection.
+type ProxyHeader struct {
+	version string
+	hosts   HostPatterns // the hosts the header is sent to
+}
+
+// NewProxyHeader parses the version "v1" or "v2" and the patterns of the hosts.
+func NewProxyHeader(version string, hosts []string) (*ProxyHeader, error) {
+	if version != conf.ProxyProtocolV1 && version != conf.ProxyProtocolV2 {
+		return nil, fmt.Errorf("should be in {%v, %v}", conf.ProxyProtocolV1, conf.ProxyProtocolV2)
+	}
+	patterns, err := ParseHostPatterns(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyHeader{version: version, hosts: patterns}, nil
+}
+
+// whether the header is sent to the address
+func (p *ProxyHeader) Match(address string) bool {
+	return p.hosts.Match(address)
+}
+
+/*
+ * write the header of the connection from src to dst, which are the local and the remote address
+ * of the tcp connection. nil means unknown, e.g., the connection through the ssh tunnel or the socks5
+ * proxy, then "PROXY UNKNOWN" of v1 or the LOCAL command of v2 is sent, and the load balancer
+ * uses the address of the connection itself.
+ */
+func (p *ProxyHeader) Write(c net.Conn, src, dst net.Addr, timeout time.Duration) error {
+	var header []byte
+	if p.version == conf.ProxyProtocolV1 {
+		header = proxyHeaderV1(src, dst)
+	} else {
+		header = proxyHeaderV2(src, dst)
+	}
+	if timeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(timeout))
+		defer c.SetWriteDeadline(time.Time{})
+	}
+	if _, err := c.Write(header); err != nil {
+		return fmt.Errorf("write the header of proxy protocol %v failed: %v", p.version, err)
+	}
+	return nil
+}
+
+// the tcp addresses of the same family, ok is false if they're unknown
+func proxyAddrs(src, dst net.Addr) (srcAddr, dstAddr *net.TCPAddr, ipv4 bool, ok bool) {
+	srcAddr, ok1 := src.(*net.TCPAddr)
+	dstAddr, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || srcAddr == nil || dstAddr == nil {
+		return nil, nil, false, false
+	}
+	ipv4 = srcAddr.IP.To4() != nil
+	if ipv4 != (dstAddr.IP.To4() != nil) {
+		return nil, nil, false, false
+	}
+	return srcAddr, dstAddr, ipv4, true
+}
+
+// "PROXY TCP4 ${src ip} ${dst ip} ${src port} ${dst port}\r\n"
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcAddr, dstAddr, ipv4, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if ipv4 {
+		family = "TCP4"
+	}
+	return []byte("PROXY " + family + " " + srcAddr.IP.String() + " " + dstAddr.IP.String() + " " +
+		strconv.Itoa(srcAddr.Port) + " " + strconv.Itoa(dstAddr.Port) + "\r\n")
+}
+
+// the signature, the version and the command, the family, the length and the addresses
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	srcAddr, dstAddr, ipv4, ok := proxyAddrs(src, dst)
+	if !ok {
+		// LOCAL with AF_UNSPEC
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+
+	var addrs []byte
+	if ipv4 {
+		header = append(header, 0x21, 0x11) // PROXY, TCP over IPv4
+		addrs = append(addrs, srcAddr.IP.To4()...)
+		addrs = append(addrs, dstAddr.IP.To4()...)
+	} else {
+		header = append(header, 0x21, 0x21) // PROXY, TCP over IPv6
+		addrs = append(addrs, srcAddr.IP.To16()...)
+		addrs = append(addrs, dstAddr.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+	addrs = append(addrs, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrs)))
+	header = append(header, length...)
+	return append(header, addrs...)
+}
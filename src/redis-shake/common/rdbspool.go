@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"pkg/rdb/digest"
+)
+
+const (
+	rdbHeaderSize   = 9 // "REDIS" and 4 digits of the version
+	rdbChecksumSize = 8
+
+	rdbChecksumVersion = 5 // the checksum is appended since rdb version 5
+)
+
+/*
+ * RdbSpool keeps the rdb received in a temporary file, so that the checksum at the end can be
+ * validated before anything is restored. The checksum zero means it's disabled on the source by
+ * rdbchecksum no, and it isn't validated then.
+ */
+type RdbSpool struct {
+	f      *os.File
+	crc    hash.Hash64
+	header []byte
+	tail   []byte // the last 8 bytes, which is the checksum if it's the end
+	size   int64
+}
+
+func NewRdbSpool() (*RdbSpool, error) {
+	f, err := ioutil.TempFile("", "redis-shake-rdb-")
+	if err != nil {
+		return nil, fmt.Errorf("create the temporary file of the rdb failed[%v]", err)
+	}
+	return &RdbSpool{f: f, crc: digest.New()}, nil
+}
+
+func (s *RdbSpool) Write(p []byte) (int, error) {
+	if _, err := s.f.Write(p); err != nil {
+		return 0, err
+	}
+	s.size += int64(len(p))
+	if len(s.header) < rdbHeaderSize {
+		n := rdbHeaderSize - len(s.header)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.header = append(s.header, p[:n]...)
+	}
+
+	// all the bytes except the tail are covered by the checksum
+	s.tail = append(s.tail, p...)
+	if n := len(s.tail) - rdbChecksumSize; n > 0 {
+		s.crc.Write(s.tail[:n])
+		s.tail = append(s.tail[:0], s.tail[n:]...)
+	}
+	return len(p), nil
+}
+
+// Verify validates the size if it's known, i.e., not RdbSizeUnknown, and the checksum.
+func (s *RdbSpool) Verify(size int64) error {
+	if size != RdbSizeUnknown && s.size != size {
+		return fmt.Errorf("RDB size mismatch, expect %d, got %d", size, s.size)
+	}
+	if s.size < rdbHeaderSize+1 || !bytes.Equal(s.header[:5], []byte("REDIS")) {
+		return fmt.Errorf("RDB is invalid, size = %d, header = %q", s.size, s.header)
+	}
+	version, err := strconv.Atoi(string(s.header[5:]))
+	if err != nil {
+		return fmt.Errorf("RDB is invalid, header = %q", s.header)
+	}
+	if version < rdbChecksumVersion {
+		return nil
+	}
+	if s.size < rdbHeaderSize+1+rdbChecksumSize {
+		return fmt.Errorf("RDB is truncated, size = %d", s.size)
+	}
+
+	expect := binary.LittleEndian.Uint64(s.tail)
+	if expect == 0 {
+		return nil
+	}
+	if got := s.crc.Sum64(); got != expect {
+		return fmt.Errorf("RDB checksum mismatch, expect %016x, got %016x", expect, got)
+	}
+	return nil
+}
+
+// WriteTo copies the rdb kept into w.
+func (s *RdbSpool) WriteTo(w io.Writer) (int64, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.f)
+}
+
+// Close removes the temporary file.
+func (s *RdbSpool) Close() error {
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
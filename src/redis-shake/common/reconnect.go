@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * ReconnectDetector detects the reconnect loop in which the source is reconnected again and again
+ * without the offset advancing. Reconnect reports the loop once more than limit reconnects happen
+ * within the window and the offset stays the same since the first of them. limit = 0 means the
+ * reconnects are only counted.
+ */
+type ReconnectDetector struct {
+	limit  int
+	window time.Duration
+
+	mu           sync.Mutex
+	count        int64
+	offset       int64
+	stalled      []time.Time // reconnects since the offset last advanced
+	lastProgress time.Time
+
+	now func() time.Time // replaced in test
+}
+
+func NewReconnectDetector(limit int, window time.Duration) *ReconnectDetector {
+	return &ReconnectDetector{
+		limit:        limit,
+		window:       window,
+		lastProgress: time.Now(),
+		now:          time.Now,
+	}
+}
+
+// Reconnect records one reconnect at the offset, true is returned if it's in a reconnect loop.
+func (d *ReconnectDetector) Reconnect(offset int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.count++
+	if offset != d.offset {
+		// the offset of the new master may be smaller after failover, it's progress too
+		d.offset, d.lastProgress = offset, now
+		d.stalled = d.stalled[:0]
+		return false
+	}
+
+	d.stalled = append(d.stalled, now)
+	for len(d.stalled) > 0 && now.Sub(d.stalled[0]) > d.window {
+		d.stalled = d.stalled[1:]
+	}
+	return d.limit > 0 && len(d.stalled) > d.limit
+}
+
+// Stalled returns the number of the reconnects in the window since the offset last advanced.
+func (d *ReconnectDetector) Stalled() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.stalled)
+}
+
+func (d *ReconnectDetector) Count() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// LastProgress returns the time the offset is last seen advancing.
+func (d *ReconnectDetector) LastProgress() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastProgress
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"pkg/libs/log"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	RedirectMoved = "MOVED"
+	RedirectAsk   = "ASK"
+
+	// a command redirected more than this is taken as failed
+	redirectMaxDepth = 5
+)
+
+// ParseRedirect parses the "MOVED 3999 127.0.0.1:6381" or "ASK 3999 127.0.0.1:6381" error
+// reply into the kind and the address of the node mapped by cluster.address_map. ok is false if err
+// isn't a redirection.
+func ParseRedirect(err error) (kind, addr string, ok bool) {
+	e, isReply := err.(redigo.Error)
+	if !isReply {
+		return "", "", false
+	}
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || fields[0] != RedirectMoved && fields[0] != RedirectAsk {
+		return "", "", false
+	}
+	return fields[0], MapAddress(fields[2]), true
+}
+
+/*
+ * Redirector follows the MOVED and ASK replied by the target, e.g., the proxy exposing the
+ * redirection of the cluster behind it. The command is retried on the node given in the reply,
+ * ASKING is sent before the retry of ASK. The connections to the nodes are cached and only used
+ * by the caller goroutine.
+ */
+type Redirector struct {
+	authType     string
+	passwd       string
+	tlsConfig    *tls.Config
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	conns map[string]redigo.Conn
+}
+
+func NewRedirector(authType, passwd string, readTimeout, writeTimeout time.Duration,
+	tlsConfig *tls.Config) *Redirector {
+	return &Redirector{
+		authType:     authType,
+		passwd:       passwd,
+		tlsConfig:    tlsConfig,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+		conns:        make(map[string]redigo.Conn),
+	}
+}
+
+func (r *Redirector) conn(addr string) redigo.Conn {
+	if c, ok := r.conns[addr]; ok && c.Err() == nil {
+		return c
+	}
+	c := OpenRedisConnWithTimeout([]string{addr}, r.authType, FetchAuthToken(TargetAuthProvider, r.passwd),
+		r.readTimeout, r.writeTimeout, false, r.tlsConfig)
+	r.conns[addr] = c
+	return c
+}
+
+// Redirect retries the command if err is MOVED or ASK and returns the reply of the retry.
+// handled is false if err isn't a redirection, the reply and err should be used as they are.
+func (r *Redirector) Redirect(err error, cmd string, args [][]byte) (reply interface{}, retErr error, handled bool) {
+	data := make([]interface{}, len(args))
+	for i := range args {
+		data[i] = args[i]
+	}
+
+	retErr = err
+	for depth := 0; depth < redirectMaxDepth; depth++ {
+		kind, addr, ok := ParseRedirect(retErr)
+		if !ok {
+			return reply, retErr, depth > 0
+		}
+		log.Debugf("follow redirection[%v] of command[%v] to node[%v]", retErr, cmd, addr)
+
+		c := r.conn(addr)
+		if kind == RedirectAsk {
+			if _, err := c.Do("asking"); err != nil {
+				return nil, err, true
+			}
+		}
+		reply, retErr = c.Do(cmd, data...)
+	}
+
+	if _, _, ok := ParseRedirect(retErr); ok {
+		log.Warnf("command[%v] is redirected more than %d times, last error[%v]", cmd, redirectMaxDepth, retErr)
+	}
+	return reply, retErr, true
+}
+
+func (r *Redirector) Close() {
+	for addr, c := range r.conns {
+		c.Close()
+		delete(r.conns, addr)
+	}
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// RenameCommand returns the name the command is renamed to by command.rename, e.g., "config" is
+// sent as "xconfig" to the server with "rename-command CONFIG xconfig".
+func RenameCommand(name string) string {
+	if len(conf.Options.CommandRename) == 0 || name == "" {
+		return name
+	}
+	if to, ok := conf.Options.CommandRename[strings.ToLower(name)]; ok {
+		return to
+	}
+	return name
+}
+
+// the redigo connection on nc, whose commands are renamed by command.rename
+func newRedisConn(nc net.Conn, readTimeout, writeTimeout time.Duration) redigo.Conn {
+	return wrapRenameConn(redigo.NewConn(nc, readTimeout, writeTimeout))
+}
+
+func wrapRenameConn(c redigo.Conn) redigo.Conn {
+	if len(conf.Options.CommandRename) == 0 {
+		return c
+	}
+	return renameConn{Conn: c}
+}
+
+type renameConn struct {
+	redigo.Conn
+}
+
+func (c renameConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.Conn.Do(RenameCommand(cmd), args...)
+}
+
+func (c renameConn) Send(cmd string, args ...interface{}) error {
+	return c.Conn.Send(RenameCommand(cmd), args...)
+}
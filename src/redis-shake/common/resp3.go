@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/libs/atomic2"
+	"pkg/libs/log"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+/* implement redigo.Conn(https://github.com/garyburd/redigo) for the target speaking RESP3.
+ * redigo only understands RESP2, so the replies are decoded here and converted into the
+ * types redigo returns. The out-of-band push frames(">") are skipped in Receive, so they
+ * won't be taken as the reply of any command. The attribute frames("|") are dropped and the
+ * following reply is returned.
+ */
+type Resp3Conn struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	bw           *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	push atomic2.Int64 // number of push frames skipped
+
+	mu  sync.Mutex
+	err error
+}
+
+// the connection whose input is read through the reader, which may have buffered some already
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.br.Read(p)
+}
+
+// push frame which isn't a reply of any command
+type resp3Push []interface{}
+
+func NewResp3Conn(c net.Conn, readTimeout, writeTimeout time.Duration) *Resp3Conn {
+	return &Resp3Conn{
+		conn:         c,
+		br:           bufio.NewReaderSize(c, ReaderBufferSize),
+		bw:           bufio.NewWriterSize(c, WriterBufferSize),
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// open the connection, auth and then switch to RESP3 by "hello 3"
+func OpenResp3ConnWithTimeout(target, auth_type, passwd string, readTimeout, writeTimeout time.Duration,
+	tlsConfig *tls.Config) redigo.Conn {
+	c, err := NegotiateResp3(target, OpenNetConn(target, auth_type, passwd, tlsConfig), readTimeout, writeTimeout)
+	if err != nil {
+		log.Panicf("switch to RESP3 with 'hello 3' on target[%v] failed[%v]", target, err)
+	}
+	return c
+}
+
+// same as OpenResp3ConnWithTimeout, but return nil instead of panic
+func OpenResp3ConnSoft(target, auth_type, passwd string, readTimeout, writeTimeout time.Duration,
+	tlsConfig *tls.Config) redigo.Conn {
+	nc := OpenNetConnSoft(target, auth_type, passwd, tlsConfig)
+	if nc == nil {
+		return nil
+	}
+	c, err := NegotiateResp3(target, nc, readTimeout, writeTimeout)
+	if err != nil {
+		nc.Close()
+		return nil
+	}
+	return c
+}
+
+/*
+ * NegotiateResp3 sends "hello 3" on the connection authenticated already. The server older
+ * than 6.0 rejects HELLO as an unknown command and the server not speaking RESP3 replies
+ * NOPROTO, the connection stays in RESP2 then and the redigo connection is returned.
+ */
+func NegotiateResp3(target string, nc net.Conn, readTimeout, writeTimeout time.Duration) (redigo.Conn, error) {
+	c := NewResp3Conn(nc, readTimeout, writeTimeout)
+	reply, err := c.Do("hello", "3")
+	if err != nil {
+		if e, ok := err.(redigo.Error); ok && (strings.HasPrefix(string(e), "NOPROTO") ||
+			strings.Contains(strings.ToLower(string(e)), "unknown command")) {
+			log.Warnf("target[%v] doesn't support RESP3[%v], fall back to RESP2", target, err)
+			return newRedisConn(&bufferedConn{Conn: nc, br: c.br}, readTimeout, writeTimeout), nil
+		}
+		return nil, err
+	}
+
+	// the reply is the map of the server properties
+	fields, _ := reply.([]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		// the keys are bulk strings in redis, simple strings in some proxies
+		if key, _ := redigo.String(fields[i], nil); key == "proto" {
+			if proto, _ := fields[i+1].(int64); proto != 3 {
+				return nil, fmt.Errorf("protocol[%v] is replied instead of 3", fields[i+1])
+			}
+		}
+	}
+	return wrapRenameConn(c), nil
+}
+
+func (rc *Resp3Conn) Close() error {
+	rc.fatal(io.ErrClosedPipe)
+	return rc.conn.Close()
+}
+
+func (rc *Resp3Conn) Err() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.err
+}
+
+// number of push frames skipped so far
+func (rc *Resp3Conn) PushCount() int64 {
+	return rc.push.Get()
+}
+
+func (rc *Resp3Conn) fatal(err error) error {
+	rc.mu.Lock()
+	if rc.err == nil {
+		rc.err = err
+	}
+	rc.mu.Unlock()
+	return err
+}
+
+func (rc *Resp3Conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName != "" {
+		if err := rc.Send(commandName, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	if commandName == "" {
+		return nil, nil
+	}
+	return rc.Receive()
+}
+
+func (rc *Resp3Conn) Send(commandName string, args ...interface{}) error {
+	if err := rc.Err(); err != nil {
+		return err
+	}
+
+	rc.bw.WriteString("*" + strconv.Itoa(len(args)+1) + "\r\n")
+	rc.writeBulk([]byte(commandName))
+	for _, arg := range args {
+		if a, ok := arg.(redigo.Argument); ok {
+			arg = a.RedisArg()
+		}
+		switch v := arg.(type) {
+		case []byte:
+			rc.writeBulk(v)
+		case string:
+			rc.writeBulk([]byte(v))
+		case int:
+			rc.writeBulk(strconv.AppendInt(nil, int64(v), 10))
+		case int64:
+			rc.writeBulk(strconv.AppendInt(nil, v, 10))
+		case float64:
+			rc.writeBulk(strconv.AppendFloat(nil, v, 'g', -1, 64))
+		case bool:
+			if v {
+				rc.writeBulk([]byte("1"))
+			} else {
+				rc.writeBulk([]byte("0"))
+			}
+		case nil:
+			rc.writeBulk(nil)
+		default:
+			var b bytes.Buffer
+			fmt.Fprint(&b, v)
+			rc.writeBulk(b.Bytes())
+		}
+	}
+	return nil
+}
+
+func (rc *Resp3Conn) writeBulk(p []byte) {
+	rc.bw.WriteString("$" + strconv.Itoa(len(p)) + "\r\n")
+	rc.bw.Write(p)
+	rc.bw.WriteString("\r\n")
+}
+
+func (rc *Resp3Conn) Flush() error {
+	if rc.writeTimeout != 0 {
+		rc.conn.SetWriteDeadline(time.Now().Add(rc.writeTimeout))
+	}
+	if err := rc.bw.Flush(); err != nil {
+		return rc.fatal(err)
+	}
+	return nil
+}
+
+// receive the reply of the next command, push frames are skipped.
+func (rc *Resp3Conn) Receive() (interface{}, error) {
+	for {
+		if rc.readTimeout != 0 {
+			rc.conn.SetReadDeadline(time.Now().Add(rc.readTimeout))
+		}
+		reply, err := rc.readReply()
+		if err != nil {
+			return nil, rc.fatal(err)
+		}
+
+		switch v := reply.(type) {
+		case resp3Push:
+			rc.push.Incr()
+			log.Debugf("skip RESP3 push frame[%v]", v)
+			continue
+		case redigo.Error:
+			return nil, v
+		}
+		return reply, nil
+	}
+}
+
+func (rc *Resp3Conn) readLine() ([]byte, error) {
+	line, err := rc.br.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("bad RESP3 line[%q]", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func (rc *Resp3Conn) readBulk(size int64) ([]byte, error) {
+	p := make([]byte, size+2)
+	if _, err := io.ReadFull(rc.br, p); err != nil {
+		return nil, err
+	}
+	if p[size] != '\r' || p[size+1] != '\n' {
+		return nil, fmt.Errorf("bad RESP3 bulk string end")
+	}
+	return p[:size], nil
+}
+
+func (rc *Resp3Conn) readArray(n int64) ([]interface{}, error) {
+	ret := make([]interface{}, n)
+	for i := range ret {
+		v, err := rc.readReply()
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+// decode one frame and convert it to the type redigo returns:
+// simple string -> string, error -> redigo.Error, integer/boolean -> int64,
+// bulk/double/big number/verbatim -> []byte, array/set/map -> []interface{}, null -> nil.
+func (rc *Resp3Conn) readReply() (interface{}, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	tp, body := line[0], line[1:]
+
+	switch tp {
+	case '+':
+		return string(body), nil
+	case '-':
+		return redigo.Error(body), nil
+	case ':':
+		return strconv.ParseInt(string(body), 10, 64)
+	case ',', '(':
+		return append([]byte{}, body...), nil
+	case '#':
+		if len(body) == 1 && body[0] == 't' {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case '_':
+		return nil, nil
+	case '$', '=', '!':
+		n, err := strconv.ParseInt(string(body), 10, 64)
+		if err != nil || n < 0 {
+			// $-1 is the RESP2 null
+			return nil, err
+		}
+		p, err := rc.readBulk(n)
+		if err != nil {
+			return nil, err
+		}
+		if tp == '!' {
+			return redigo.Error(p), nil
+		} else if tp == '=' && len(p) >= 4 {
+			// skip the format, e.g., "txt:"
+			return p[4:], nil
+		}
+		return p, nil
+	case '*', '~', '%', '>', '|':
+		n, err := strconv.ParseInt(string(body), 10, 64)
+		if err != nil || n < 0 {
+			// *-1 is the RESP2 null
+			return nil, err
+		}
+		if tp == '%' || tp == '|' {
+			n *= 2
+		}
+		ret, err := rc.readArray(n)
+		if err != nil {
+			return nil, err
+		}
+		switch tp {
+		case '>':
+			return resp3Push(ret), nil
+		case '|':
+			// attribute describes the following reply, drop it
+			return rc.readReply()
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP3 type[%q]", tp)
+	}
+}
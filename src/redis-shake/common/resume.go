@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+
+	"pkg/libs/log"
+	"pkg/rdb"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	resumeScanCount    = 1000 // COUNT of each SCAN on the target
+	resumeCheckBatch   = 128  // keys checked in one pipeline
+	resumeTTLTolerance = 1000 // ttl difference in milliseconds regarded as the same
+)
+
+// TargetKeys is the keys found on the target in each db, see fullsync.resumable.
+type TargetKeys map[int]map[string]struct{}
+
+func (tk TargetKeys) add(db int, key string) {
+	m, ok := tk[db]
+	if !ok {
+		m = make(map[string]struct{})
+		tk[db] = m
+	}
+	m[key] = struct{}{}
+}
+
+// take the key out since each key comes once in the rdb
+func (tk TargetKeys) take(db int, key []byte) bool {
+	m, ok := tk[db]
+	if !ok {
+		return false
+	}
+	if _, ok := m[string(key)]; !ok {
+		return false
+	}
+	delete(m, string(key))
+	return true
+}
+
+// Len returns the number of the keys in all the dbs.
+func (tk TargetKeys) Len() int {
+	n := 0
+	for _, m := range tk {
+		n += len(m)
+	}
+	return n
+}
+
+// ScanTargetKeys adds the keys of all the dbs on the node by SCAN, c shouldn't be the cluster connection.
+func ScanTargetKeys(c redigo.Conn, tk TargetKeys) error {
+	info, err := redigo.Bytes(c.Do("info", "keyspace"))
+	if err != nil {
+		return fmt.Errorf("info keyspace failed: %v", err)
+	}
+	dbs, err := ParseKeyspace(info)
+	if err != nil {
+		return err
+	}
+
+	for db := range dbs {
+		if _, err := c.Do("select", db); err != nil {
+			return fmt.Errorf("select db[%v] failed: %v", db, err)
+		}
+		cursor := "0"
+		for {
+			reply, err := redigo.Values(c.Do("scan", cursor, "count", resumeScanCount))
+			if err != nil || len(reply) != 2 {
+				return fmt.Errorf("scan db[%v] with cursor[%v] failed: %v", db, cursor, err)
+			}
+			if cursor, err = redigo.String(reply[0], nil); err != nil {
+				return fmt.Errorf("parse the cursor of scan failed: %v", err)
+			}
+			keys, err := redigo.ByteSlices(reply[1], nil)
+			if err != nil {
+				return fmt.Errorf("parse the keys of scan failed: %v", err)
+			}
+			for _, key := range keys {
+				tk.add(int(db), string(key))
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * SkipRestoredRdbEntry drops the entries restored by the full sync interrupted before, skipped is
+ * called for each entry dropped. The entry whose key is in keys is checked by DUMP and PTTL on the
+ * target in pipeline, it's dropped only if the value is the same and the ttl differs less than a
+ * second, otherwise it's restored again. The key split in loading is always restored. The key and
+ * the ttl are compared after being transformed the same way as restoring, e.g., target.ttl_mode,
+ * and the db is mapped by target.db and target.db_map in opts. guard is deferred in the routine if
+ * it isn't nil.
+ */
+func SkipRestoredRdbEntry(input chan *rdb.BinEntry, keys TargetKeys, opts *conf.Configuration,
+	open func() redigo.Conn, size int, guard func(), skipped func(e *rdb.BinEntry)) chan *rdb.BinEntry {
+	output := make(chan *rdb.BinEntry, size)
+	go func() {
+		defer close(output)
+		if guard != nil {
+			defer guard()
+		}
+		c := open()
+		defer c.Close()
+		isCluster := conf.Options.TargetType == conf.RedisTypeCluster
+		lastdb := -1
+
+		type candidate struct {
+			e    *rdb.BinEntry
+			db   int
+			key  []byte // key on the target
+			ttl  uint64 // ttl in milliseconds on the target, 0 means no expiration
+			sel  bool   // select is sent ahead
+			dump []byte
+			pttl int64
+		}
+		batch := make([]*candidate, 0, resumeCheckBatch)
+		check := func() {
+			if len(batch) == 0 {
+				return
+			}
+			for _, cd := range batch {
+				if cd.sel = cd.db != lastdb && !isCluster; cd.sel {
+					if err := c.Send("select", cd.db); err != nil {
+						log.PanicErrorf(err, "send select db[%v] to target failed", cd.db)
+					}
+				}
+				lastdb = cd.db
+				if err := c.Send("dump", cd.key); err != nil {
+					log.PanicErrorf(err, "send dump key[%s] to target failed", cd.key)
+				}
+				if err := c.Send("pttl", cd.key); err != nil {
+					log.PanicErrorf(err, "send pttl key[%s] to target failed", cd.key)
+				}
+			}
+			if err := c.Flush(); err != nil {
+				log.PanicErrorf(err, "flush the resume check failed")
+			}
+			for _, cd := range batch {
+				if cd.sel {
+					if _, err := c.Receive(); err != nil {
+						log.PanicErrorf(err, "select db[%v] on target failed", cd.db)
+					}
+				}
+				reply, err := c.Receive()
+				if err != nil {
+					log.PanicErrorf(err, "dump key[%s] from target failed", cd.key)
+				}
+				if reply != nil {
+					cd.dump, _ = redigo.Bytes(reply, nil)
+				}
+				if cd.pttl, err = redigo.Int64(c.Receive()); err != nil {
+					log.PanicErrorf(err, "pttl key[%s] from target failed", cd.key)
+				}
+			}
+
+			for _, cd := range batch {
+				if cd.dump != nil && bytes.Equal(dumpBody(cd.dump), dumpBody(cd.e.Value)) &&
+					sameTTL(cd.ttl, cd.pttl) {
+					skipped(cd.e)
+				} else {
+					output <- cd.e
+				}
+			}
+			batch = batch[:0]
+		}
+
+		for e := range input {
+			db, pass := MapJobTargetDB(opts, int(e.DB))
+			if e.Type == rdb.RdbFlagAUX || e.NeedReadLen != 1 || e.RealMemberCount != 0 || !pass {
+				output <- e
+				continue
+			}
+
+			// the key and ttl on the target without changing the entry
+			target := *e
+			ttl := prepareRdbEntry(&target)
+			if isCluster {
+				db = 0
+			}
+			if !keys.take(db, target.Key) {
+				output <- e
+				continue
+			}
+
+			batch = append(batch, &candidate{e: e, db: db, key: target.Key, ttl: ttl})
+			if len(batch) >= resumeCheckBatch || len(input) == 0 {
+				check()
+			}
+		}
+		check()
+	}()
+	return output
+}
+
+// the ttl restored is ttl, pttl is got from the target
+func sameTTL(ttl uint64, pttl int64) bool {
+	if ttl == 0 {
+		return pttl == -1
+	}
+	if pttl < 0 {
+		return false
+	}
+	diff := int64(ttl) - pttl
+	return diff <= resumeTTLTolerance && diff >= -resumeTTLTolerance
+}
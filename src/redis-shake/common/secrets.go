@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+)
+
+const (
+	SecretVault          = "vault"
+	SecretSecretsManager = "awssm"
+
+	secretsManagerService = "secretsmanager"
+)
+
+var (
+	// the endpoint of AWS Secrets Manager in the region, replaced in the test
+	awsSecretsManagerEndpoint = func(region string) string {
+		return "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	// the credentials shared by the requests to AWS Secrets Manager
+	secretsManagerCreds awsCredentialCache
+)
+
+/*
+ * The secret is referenced as "${store}://${path}[#${field}]" in the options of the passwords and
+ * the tls files, so it's pulled from the secret store at runtime instead of being kept in the
+ * configuration file:
+ *   1. "vault://${path}#${field}" reads the field of the secret of HashiCorp Vault at the path,
+ *      e.g., "vault://secret/data/redis#password" of the kv v2 engine. The address, the token and
+ *      the namespace are given by VAULT_ADDR, VAULT_TOKEN (or ~/.vault-token) and VAULT_NAMESPACE.
+ *   2. "awssm://${secret id}[#${field}]" reads the SecretString of AWS Secrets Manager, the field
+ *      is the key of it in json. The region is the one of the arn, or AWS_REGION. The request is
+ *      signed by the credentials the same as the elasticache auth provider.
+ */
+type secretRef struct {
+	store string
+	path  string
+	field string
+}
+
+// IsSecretRef returns whether the value references a secret of the secret store.
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretVault+"://") || strings.HasPrefix(value, SecretSecretsManager+"://")
+}
+
+func parseSecretRef(value string) (*secretRef, error) {
+	i := strings.Index(value, "://")
+	if i == -1 {
+		return nil, fmt.Errorf("invalid secret[%v], should be '${store}://${path}[#${field}]'", value)
+	}
+	ref := &secretRef{store: value[:i], path: value[i+3:]}
+	if j := strings.LastIndex(ref.path, "#"); j != -1 {
+		ref.path, ref.field = ref.path[:j], ref.path[j+1:]
+	}
+	if ref.store != SecretVault && ref.store != SecretSecretsManager {
+		return nil, fmt.Errorf("unknown secret store[%v], should be in {%v, %v}", ref.store, SecretVault,
+			SecretSecretsManager)
+	} else if ref.path == "" {
+		return nil, fmt.Errorf("the path of secret[%v] is empty", value)
+	} else if ref.store == SecretVault && ref.field == "" {
+		return nil, fmt.Errorf("the field of vault secret[%v] should be given", value)
+	}
+	return ref, nil
+}
+
+// FetchSecret fetches the secret referenced once.
+func FetchSecret(value string) (string, error) {
+	ref, err := parseSecretRef(value)
+	if err != nil {
+		return "", err
+	}
+	return ref.fetch()
+}
+
+func (ref *secretRef) fetch() (string, error) {
+	if ref.store == SecretVault {
+		return fetchVaultSecret(ref.path, ref.field)
+	}
+	return fetchSecretsManagerSecret(ref.path, ref.field, time.Now())
+}
+
+/*
+ * secretTokenProvider is the auth provider of the password referenced, the secret is cached for
+ * secrets.refresh_sec seconds so the rotated one is used by the connection (re)opened after it,
+ * and the store isn't asked on every connection.
+ */
+type secretTokenProvider struct {
+	ref     *secretRef
+	refresh time.Duration
+
+	mu      sync.Mutex
+	value   string
+	fetched time.Time
+	now     func() time.Time
+}
+
+func newSecretTokenProvider(value string) (*secretTokenProvider, error) {
+	ref, err := parseSecretRef(value)
+	if err != nil {
+		return nil, err
+	}
+	return &secretTokenProvider{
+		ref:     ref,
+		refresh: time.Duration(conf.Options.SecretsRefreshSec) * time.Second,
+		now:     time.Now,
+	}, nil
+}
+
+func (p *secretTokenProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.fetched.IsZero() && p.now().Sub(p.fetched) < p.refresh {
+		return p.value, nil
+	}
+	value, err := p.ref.fetch()
+	if err != nil {
+		return "", err
+	}
+	p.value, p.fetched = value, p.now()
+	return value, nil
+}
+
+// the providers of the passwords which reference the secrets, by the reference
+var secretPasswords sync.Map
+
+/*
+ * SecretPassword returns the secret if the password references one, the password is returned as
+ * it is otherwise. The jobs of sync.jobs keep the reference as the password, since the auth
+ * providers are shared by all the jobs, and each reference has its own provider so that the
+ * rotated secret is used once secrets.refresh_sec passes. The secret fetched last time is returned
+ * if the store fails.
+ */
+func SecretPassword(password string) (string, error) {
+	if !IsSecretRef(password) {
+		return password, nil
+	}
+	p, ok := secretPasswords.Load(password)
+	if !ok {
+		provider, err := newSecretTokenProvider(password)
+		if err != nil {
+			return "", err
+		}
+		p, _ = secretPasswords.LoadOrStore(password, provider)
+	}
+	provider := p.(*secretTokenProvider)
+	value, err := provider.Token()
+	if err != nil {
+		provider.mu.Lock()
+		defer provider.mu.Unlock()
+		if provider.value != "" {
+			log.Warnf("fetch secret[%v] failed[%v], use the previous one", password, err)
+			return provider.value, nil
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+// read the field of the secret by the http api of vault, both the kv v1 and v2 engines are supported
+func fetchVaultSecret(path, field string) (string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR isn't set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			content, _ := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(content))
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("neither VAULT_TOKEN nor ~/.vault-token is given")
+	}
+
+	req, err := http.NewRequest("GET", addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("read vault secret[%v] failed: %v", path, err)
+	}
+
+	var reply struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return "", fmt.Errorf("parse vault secret[%v] failed: %v", path, err)
+	}
+	data := reply.Data
+	// the kv v2 engine wraps the secret with the metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return secretField(data, path, field)
+}
+
+// GetSecretValue of AWS Secrets Manager, signed by SigV4
+func fetchSecretsManagerSecret(id, field string, now time.Time) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	// arn:aws:secretsmanager:${region}:${account}:secret:${name}
+	if fields := strings.Split(id, ":"); len(fields) > 3 && fields[0] == "arn" {
+		region = fields[3]
+	}
+	if region == "" {
+		return "", fmt.Errorf("the region of secret[%v] is unknown, set AWS_REGION or use the arn", id)
+	}
+	creds, err := secretsManagerCreds.get(now)
+	if err != nil {
+		return "", fmt.Errorf("fetch aws credentials failed: %v", err)
+	}
+
+	payload, _ := json.Marshal(map[string]string{"SecretId": id})
+	endpoint := awsSecretsManagerEndpoint(region)
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, u.Host, payload, creds, region, secretsManagerService, now)
+
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("get secret[%v] of aws secrets manager failed: %v", id, err)
+	}
+	var reply struct {
+		SecretString *string
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return "", fmt.Errorf("parse secret[%v] failed: %v", id, err)
+	} else if reply.SecretString == nil {
+		return "", fmt.Errorf("secret[%v] has no SecretString", id)
+	}
+	if field == "" {
+		return *reply.SecretString, nil
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(*reply.SecretString), &data); err != nil {
+		return "", fmt.Errorf("the SecretString of secret[%v] isn't a json object: %v", id, err)
+	}
+	return secretField(data, id, field)
+}
+
+// sign the request of the json api by the Authorization header of SigV4
+func signAWSRequest(req *http.Request, host string, payload []byte, creds *awsCredentials, region, service string,
+	now time.Time) {
+	date := now.UTC().Format(awsDateFormat)
+	req.Header.Set("X-Amz-Date", date)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{req.Method, "/", "", canonicalHeaders, signedHeaders,
+		hex.EncodeToString(payloadHash[:])}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{date[:8], region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", date, scope, hex.EncodeToString(requestHash[:])}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(creds.SecretAccessKey, date[:8], region, service),
+		stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func doSecretRequest(req *http.Request) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("replied %v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// the field of the secret should be a string
+func secretField(data map[string]interface{}, path, field string) (string, error) {
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("field[%v] isn't found in secret[%v]", field, path)
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field[%v] of secret[%v] isn't a string", field, path)
+	}
+	return str, nil
+}
@@ -1,19 +1,214 @@
 package utils
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"redis-shake/configure"
+	"redis-shake/filter"
+)
+
+const (
+	ClusterSlots   = 16384
+	SlotRangeSize  = 1024 // slots of each range in the progress of the restored keys
+	SlotRangeCount = ClusterSlots / SlotRangeSize
+)
+
+// the rules of target.hash_tag_rules, see ParseHashTagRules
+var hashTagRules []*regexp.Regexp
+
+// the name of the i-th slot range, e.g., "0-1023"
+func SlotRangeName(i int) string {
+	return fmt.Sprintf("%d-%d", i*SlotRangeSize, (i+1)*SlotRangeSize-1)
+}
+
+// HashTag returns the hash tag of the key the same way as redis, empty means the whole key is hashed.
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return ""
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return ""
+	}
+	return key[start+1 : start+1+end]
+}
+
 func KeyToSlot(key string) uint16 {
-	hashtag := ""
-	for i, s := range key {
-		if s == '{' {
-			for k := i; k < len(key); k++ {
-				if key[k] == '}' {
-					hashtag = key[i+1 : k]
-					break
-				}
+	if hashtag := HashTag(key); len(hashtag) > 0 {
+		return crc16(hashtag) & 0x3fff
+	}
+	return crc16(key) & 0x3fff
+}
+
+/*
+ * InjectHashTag wraps the key as "{tag}key" by target.hash_tag_inject so that all the keys of the
+ * source are in the same slot of the target. The key whose hash tag is already the tag is kept,
+ * the key with another hash tag is still wrapped since only the first one takes effect.
+ * The portion of the key is wrapped instead if target.hash_tag_rules is given, see wrapHashTag.
+ */
+func InjectHashTag(key []byte) []byte {
+	if len(hashTagRules) != 0 {
+		return wrapHashTag(key)
+	}
+	tag := conf.Options.TargetHashTagInject
+	if tag == "" || HashTag(string(key)) == tag {
+		return key
+	}
+	ret := make([]byte, 0, len(tag)+2+len(key))
+	ret = append(ret, '{')
+	ret = append(ret, tag...)
+	ret = append(ret, '}')
+	return append(ret, key...)
+}
+
+// InjectCommandHashTag injects the hash tag into the keys of the command, false is returned if
+// the key positions of the command are unknown and the args are returned as they are.
+func InjectCommandHashTag(cmd string, args [][]byte) ([][]byte, bool) {
+	if conf.Options.TargetHashTagInject == "" && len(hashTagRules) == 0 {
+		return args, true
+	}
+	indexes, ok := filter.CommandKeyIndexes(strings.ToLower(cmd), args)
+	if !ok {
+		return args, false
+	}
+	ret := make([][]byte, len(args))
+	copy(ret, args)
+	for _, i := range indexes {
+		ret[i] = InjectHashTag(args[i])
+	}
+	return ret, true
+}
+
+// ParseHashTagRules compiles the regular expressions of target.hash_tag_rules, each of them should
+// have one capturing group for the portion of the key wrapped as the hash tag.
+func ParseHashTagRules(rules []string) error {
+	compiled := make([]*regexp.Regexp, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return fmt.Errorf("invalid rule[%v]: %v", rule, err)
+		}
+		if re.NumSubexp() != 1 {
+			return fmt.Errorf("rule[%v] should have exactly one capturing group", rule)
+		}
+		compiled = append(compiled, re)
+	}
+	hashTagRules = compiled
+	return nil
+}
+
+/*
+ * wrap the portion captured by the first rule matched as "{portion}", e.g., "user:1000:profile"
+ * becomes "user:{1000}:profile" by "^user:([^:]+):", so that the keys of the same user are in the
+ * same slot. The key with a hash tag already or matching no rule is kept, so does the empty portion.
+ */
+func wrapHashTag(key []byte) []byte {
+	if HashTag(string(key)) != "" {
+		return key
+	}
+	for _, re := range hashTagRules {
+		loc := re.FindSubmatchIndex(key)
+		if loc == nil {
+			continue
+		}
+		start, end := loc[2], loc[3]
+		if start < 0 || end <= start {
+			return key
+		}
+		ret := make([]byte, 0, len(key)+2)
+		ret = append(ret, key[:start]...)
+		ret = append(ret, '{')
+		ret = append(ret, key[start:end]...)
+		ret = append(ret, '}')
+		return append(ret, key[end:]...)
+	}
+	return key
+}
+
+/*
+ * FilterCommandSlot keeps the keys of the command in the slots of filter.slot, true is returned if
+ * the command is dropped. The keys of the commands split by SplitCommandBySlot are filtered apart,
+ * and the other commands are judged by the slot of the first key. The commands without keys pass.
+ */
+func FilterCommandSlot(f filter.Filter, cmd string, args [][]byte) ([][]byte, bool) {
+	if !f.HasSlotFilter() {
+		return args, false
+	}
+	indexes, ok := filter.CommandKeyIndexes(strings.ToLower(cmd), args)
+	if !ok || len(indexes) == 0 {
+		return args, false
+	}
+	_, parts, _ := SplitCommandBySlot(cmd, args)
+	if len(parts) == 1 {
+		return args, f.FilterSlot(int(KeyToSlot(string(args[indexes[0]]))))
+	}
+
+	var kept [][]byte
+	dropped := false
+	for _, part := range parts {
+		if f.FilterSlot(int(KeyToSlot(string(part[0])))) {
+			dropped = true
+		} else {
+			kept = append(kept, part...)
+		}
+	}
+	if !dropped {
+		return args, false
+	}
+	return kept, len(kept) == 0
+}
+
+/*
+ * SplitCommandBySlot splits the multi-key command into the commands of each slot in the order of
+ * the first key, since the cluster target replies CROSSSLOT to the command whose keys are in
+ * different slots. Only the commands whose keys are independent are split: del, unlink, touch and
+ * mset. msetnx becomes mset since it's only propagated once all the keys are set on the source.
+ * false is returned if the keys cross slots but the command can't be split, e.g., sunionstore.
+ */
+func SplitCommandBySlot(cmd string, args [][]byte) (string, [][][]byte, bool) {
+	step := 0
+	switch strings.ToLower(cmd) {
+	case "del", "unlink", "touch":
+		step = 1
+	case "mset", "msetnx":
+		step = 2
+	}
+
+	if step == 0 {
+		indexes, ok := filter.CommandKeyIndexes(strings.ToLower(cmd), args)
+		if !ok || len(indexes) < 2 {
+			return cmd, [][][]byte{args}, true
+		}
+		first := KeyToSlot(string(args[indexes[0]]))
+		for _, i := range indexes[1:] {
+			if KeyToSlot(string(args[i])) != first {
+				return cmd, [][][]byte{args}, false
 			}
 		}
+		return cmd, [][][]byte{args}, true
 	}
-	if len(hashtag) > 0 {
-		return crc16(hashtag) & 0x3fff
+
+	var order []uint16
+	parts := make(map[uint16][][]byte)
+	for i := 0; i+step <= len(args); i += step {
+		slot := KeyToSlot(string(args[i]))
+		if _, ok := parts[slot]; !ok {
+			order = append(order, slot)
+		}
+		parts[slot] = append(parts[slot], args[i:i+step]...)
 	}
-	return crc16(key) & 0x3fff
+	if len(order) <= 1 {
+		return cmd, [][][]byte{args}, true
+	}
+	ret := make([][][]byte, len(order))
+	for i, slot := range order {
+		ret[i] = parts[slot]
+	}
+	if step == 2 {
+		cmd = "mset"
+	}
+	return cmd, ret, true
 }
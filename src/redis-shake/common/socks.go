@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nil means all the addresses are dialed directly
+var Socks5Proxy *Socks5
+
+// the reply codes of the socks5 request, rfc1928
+var socks5Replies = map[byte]string{
+	1: "general socks server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "ttl expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Socks5 dials the address by CONNECT of the socks5 proxy, with the username/password
+// authentication of rfc1929 if the user is given.
+type Socks5 struct {
+	address  string
+	user     string
+	password string
+	hosts    HostPatterns // the hosts dialed through the proxy
+}
+
+// NewSocks5Proxy parses the proxy "[user[:password]@]host:port" and the patterns of the hosts.
+func NewSocks5Proxy(proxy string, hosts []string) (*Socks5, error) {
+	s := new(Socks5)
+	if i := strings.LastIndex(proxy, "@"); i != -1 {
+		auth := proxy[:i]
+		proxy = proxy[i+1:]
+		if j := strings.Index(auth, ":"); j != -1 {
+			s.user, s.password = auth[:j], auth[j+1:]
+		} else {
+			s.user = auth
+		}
+		if s.user == "" || len(s.user) > 255 || len(s.password) > 255 {
+			return nil, fmt.Errorf("the user and the password should be 1 to 255 bytes")
+		}
+	}
+	if _, _, err := net.SplitHostPort(proxy); err != nil {
+		return nil, err
+	}
+	s.address = proxy
+
+	var err error
+	if s.hosts, err = ParseHostPatterns(hosts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// whether the address is dialed through the proxy
+func (s *Socks5) Match(address string) bool {
+	return s.hosts.Match(address)
+}
+
+// connect to the proxy by the dialer and ask it to connect to the address, the host name is
+// resolved by the proxy
+func (s *Socks5) Dial(d *net.Dialer, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port[%v]", portStr)
+	}
+
+	c, err := d.Dial("tcp", s.address)
+	if err != nil {
+		return nil, fmt.Errorf("connect to socks5 proxy[%v] failed: %v", s.address, err)
+	}
+	if d.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	if err := s.handshake(c, host, uint16(port)); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("socks5 proxy[%v] connect to [%v] failed: %v", s.address, address, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (s *Socks5) handshake(c net.Conn, host string, port uint16) error {
+	// the methods: no authentication, or username/password
+	method := byte(0)
+	if s.user != "" {
+		method = 2
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("unknown version[%v]", reply[0])
+	} else if reply[1] != method {
+		return fmt.Errorf("authentication method[%v] isn't accepted", method)
+	}
+
+	if method == 2 {
+		req := []byte{1, byte(len(s.user))}
+		req = append(req, s.user...)
+		req = append(req, byte(len(s.password)))
+		req = append(req, s.password...)
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+	}
+
+	// CONNECT
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host[%v] is too long", host)
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if msg, ok := socks5Replies[head[1]]; ok {
+			return fmt.Errorf("%v", msg)
+		}
+		return fmt.Errorf("unknown reply[%v]", head[1])
+	}
+	// skip the address bound
+	var size int
+	switch head[3] {
+	case 1:
+		size = net.IPv4len
+	case 4:
+		size = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(c, head[:1]); err != nil {
+			return err
+		}
+		size = int(head[0])
+	default:
+		return fmt.Errorf("unknown address type[%v]", head[3])
+	}
+	if _, err := io.ReadFull(c, make([]byte, size+2)); err != nil {
+		return err
+	}
+	return nil
+}
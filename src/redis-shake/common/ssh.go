@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// nil means all the addresses are dialed directly
+	SSHTunnel *Tunnel
+
+	// the ssh client run for each connection, replaced in the test
+	sshCommand = "ssh"
+)
+
+/*
+ * Tunnel dials the address through the bastion by "ssh -W address", each connection runs its own
+ * ssh client and talks with it by stdin and stdout. So there is no forward shared by all the
+ * connections to break, the connection dropped is reopened as the direct one. The host key is
+ * checked by known_hosts, and ~/.ssh/config of the user is applied as well.
+ */
+type Tunnel struct {
+	user       string
+	host       string
+	port       string
+	keyFile    string
+	passphrase string       // the passphrase of the key, empty if no passphrase
+	hosts      HostPatterns // the hosts dialed through the tunnel
+}
+
+// NewSSHTunnel parses the bastion "[user@]host[:port]" and the patterns of the hosts, each pattern is
+// the CIDR or the glob of the host, e.g., "10.0.0.0/8" or "*.cache.amazonaws.com".
+func NewSSHTunnel(bastion, keyFile, passphrase string, hosts []string) (*Tunnel, error) {
+	t := &Tunnel{keyFile: keyFile, passphrase: passphrase}
+	if i := strings.LastIndex(bastion, "@"); i != -1 {
+		t.user, bastion = bastion[:i], bastion[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(bastion); err == nil {
+		t.host, t.port = host, port
+	} else {
+		t.host = bastion
+	}
+	if t.host == "" {
+		return nil, fmt.Errorf("bastion host is empty")
+	}
+	var err error
+	if t.hosts, err = ParseHostPatterns(hosts); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+/*
+ * ssh reads the passphrase from the program given by SSH_ASKPASS only, so the script replying it
+ * is written for each ssh client and removed once the client exits. The passphrase is passed in
+ * the environment of the client, not in the script or the environment of redis-shake.
+ */
+func writeAskpass() (string, error) {
+	f, err := ioutil.TempFile("", "redis-shake-askpass")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString("#!/bin/sh\nprintf '%s\\n' \"$REDIS_SHAKE_SSH_PASSPHRASE\"\n"); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Chmod(0700); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// whether the address is dialed through the tunnel
+func (t *Tunnel) Match(address string) bool {
+	return t.hosts.Match(address)
+}
+
+func (t *Tunnel) args(address string, timeout, keepAlive time.Duration) []string {
+	args := []string{"-W", address, "-o", "ExitOnForwardFailure=yes"}
+	if t.passphrase == "" {
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	if timeout > 0 {
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", (timeout+time.Second-1)/time.Second))
+	}
+	if keepAlive > 0 {
+		args = append(args, "-o", fmt.Sprintf("ServerAliveInterval=%d", (keepAlive+time.Second-1)/time.Second))
+	}
+	if t.user != "" {
+		args = append(args, "-l", t.user)
+	}
+	if t.port != "" {
+		args = append(args, "-p", t.port)
+	}
+	if t.keyFile != "" {
+		args = append(args, "-i", t.keyFile)
+	}
+	return append(args, t.host)
+}
+
+// start the ssh client forwarding the stdin and stdout to the address
+func (t *Tunnel) Dial(address string, timeout, keepAlive time.Duration) (net.Conn, error) {
+	cmd := exec.Command(sshCommand, t.args(address, timeout, keepAlive)...)
+	var askpass string
+	if t.passphrase != "" {
+		var err error
+		if askpass, err = writeAskpass(); err != nil {
+			return nil, fmt.Errorf("write the askpass script failed: %v", err)
+		}
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS="+askpass, "SSH_ASKPASS_REQUIRE=force",
+			"REDIS_SHAKE_SSH_PASSPHRASE="+t.passphrase)
+	}
+	removeAskpass := func() {
+		if askpass != "" {
+			os.Remove(askpass)
+		}
+	}
+	// os.Pipe instead of cmd.StdinPipe, so the deadlines of the connection work
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		removeAskpass()
+		return nil, err
+	}
+	r, stdout, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		w.Close()
+		removeAskpass()
+		return nil, err
+	}
+	c := &tunnelConn{cmd: cmd, r: r, w: w, address: address, askpass: askpass, exited: make(chan struct{})}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, &c.stderr
+	err = cmd.Start()
+	stdin.Close()
+	stdout.Close()
+	if err != nil {
+		r.Close()
+		w.Close()
+		removeAskpass()
+		return nil, fmt.Errorf("start ssh failed: %v", err)
+	}
+	go func() {
+		cmd.Wait()
+		removeAskpass()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+type tunnelConn struct {
+	cmd     *exec.Cmd
+	r       *os.File // stdout of ssh
+	w       *os.File // stdin of ssh
+	address string
+	askpass string // the askpass script, removed once ssh exits
+	stderr  lockedBuffer
+	exited  chan struct{}
+	once    sync.Once
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf.Len() > 4096 {
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(b.buf.String())
+}
+
+// the error says why ssh exited once stdout is closed
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && n == 0 {
+		select {
+		case <-c.exited:
+			if msg := c.stderr.String(); msg != "" {
+				return 0, fmt.Errorf("ssh tunnel to [%v] exited: %v", c.address, msg)
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() {
+		c.w.Close()
+		c.r.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		if c.askpass != "" {
+			os.Remove(c.askpass)
+		}
+	})
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return tunnelAddr("ssh")
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return tunnelAddr(c.address)
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.r.SetReadDeadline(t)
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "ssh"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// tencentCluster is the proxy of the cluster of tencent cloud, which has 1 logical db only and
+// whose masters are scanned by SCAN with the id of the node appended.
+type tencentCluster struct {
+	cloudBase
+}
+
+func (tencentCluster) ScanNodes(c redigo.Conn) ([]string, error) {
+	return GetAllClusterNode(c, conf.StandAloneRoleMaster, "id")
+}
+
+func (tencentCluster) Scan(c redigo.Conn, node string, cursor int64, count int64) (interface{}, error) {
+	return c.Do("scan", cursor, "count", count, node)
+}
+
+func (tencentCluster) Dbs() []int32 {
+	return []int32{0}
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+)
+
+// the tls configurations of the connections to the source and the target whose tls is enabled,
+// the server certificate is verified by the system roots by default.
+var (
+	SourceTLSConfig = &tls.Config{}
+	TargetTLSConfig = &tls.Config{}
+)
+
+// SourceTLS returns the tls configuration of the source if enable is set, nil means no tls.
+func SourceTLS(enable bool) *tls.Config {
+	if !enable {
+		return nil
+	}
+	return SourceTLSConfig
+}
+
+// TargetTLS returns the tls configuration of the target if enable is set, nil means no tls.
+func TargetTLS(enable bool) *tls.Config {
+	if !enable {
+		return nil
+	}
+	return TargetTLSConfig
+}
+
+// TLSOptions is the tls_* options of the source or the target.
+type TLSOptions struct {
+	CaFile     string
+	CertFile   string
+	KeyFile    string
+	SkipVerify bool
+}
+
+/*
+ * NewTLSConfig returns the configuration of the tls options of the source or the target, each side
+ * has its own one so that the CA, the client certificate and skip_verify of one side never apply
+ * to the other. The CA file is added into the system roots. Each file can be a secret referenced,
+ * e.g., "vault://secret/data/redis#tls_key", the files are fetched again by the handshake once
+ * secrets.refresh_sec passes then, so the rotated certificates are used by the new connections.
+ */
+func NewTLSConfig(side TLSOptions) (*tls.Config, error) {
+	if (side.CertFile == "") != (side.KeyFile == "") {
+		return nil, fmt.Errorf("cert file and key file should be given together")
+	}
+	files := &tlsFiles{
+		side:    side,
+		refresh: time.Duration(conf.Options.SecretsRefreshSec) * time.Second,
+		now:     time.Now,
+	}
+	roots, cert, err := files.get()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{InsecureSkipVerify: side.SkipVerify, RootCAs: roots}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	if !side.hasSecret() {
+		return config, nil
+	}
+
+	if cert != nil {
+		config.Certificates = nil
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, cert, err := files.get()
+			return cert, err
+		}
+	}
+	if roots != nil && !side.SkipVerify {
+		// the server certificate is verified by the latest CA instead of RootCAs
+		config.InsecureSkipVerify, config.RootCAs = true, nil
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			roots, _, err := files.get()
+			if err != nil {
+				return err
+			}
+			return verifyServerCertificate(cs, roots)
+		}
+	}
+	return config, nil
+}
+
+// whether any of the files is a secret referenced
+func (side TLSOptions) hasSecret() bool {
+	return IsSecretRef(side.CaFile) || IsSecretRef(side.CertFile) || IsSecretRef(side.KeyFile)
+}
+
+// the tls files of one side cached for secrets.refresh_sec
+type tlsFiles struct {
+	side    TLSOptions
+	refresh time.Duration
+
+	mu      sync.Mutex
+	roots   *x509.CertPool   // nil if the CA file isn't given
+	cert    *tls.Certificate // nil if the cert file isn't given
+	fetched time.Time
+	now     func() time.Time
+}
+
+// the files loaded last time if they are loaded in secrets.refresh_sec, or if the reload fails
+func (f *tlsFiles) get() (*x509.CertPool, *tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.fetched.IsZero() && f.now().Sub(f.fetched) < f.refresh {
+		return f.roots, f.cert, nil
+	}
+	roots, cert, err := loadTLSFiles(f.side)
+	if err != nil {
+		if f.fetched.IsZero() {
+			return nil, nil, err
+		}
+		// tried again once secrets.refresh_sec passes
+		log.Warnf("reload tls files failed[%v], use the previous ones", err)
+		f.fetched = f.now()
+		return f.roots, f.cert, nil
+	}
+	f.roots, f.cert, f.fetched = roots, cert, f.now()
+	return roots, cert, nil
+}
+
+func loadTLSFiles(side TLSOptions) (*x509.CertPool, *tls.Certificate, error) {
+	var roots *x509.CertPool
+	if side.CaFile != "" {
+		if pool, err := x509.SystemCertPool(); err == nil {
+			roots = pool
+		} else {
+			roots = x509.NewCertPool()
+		}
+		pem, err := readTLSFile(side.CaFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificate is found in [%v]", side.CaFile)
+		}
+	}
+	if side.CertFile == "" {
+		return roots, nil, nil
+	}
+	certPEM, err := readTLSFile(side.CertFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := readTLSFile(side.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roots, &cert, nil
+}
+
+// the same verification as the one of crypto/tls by RootCAs
+func verifyServerCertificate(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no certificate is sent by the server")
+	}
+	opts := x509.VerifyOptions{Roots: roots, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// the content of the file, or of the secret referenced
+func readTLSFile(path string) ([]byte, error) {
+	if IsSecretRef(path) {
+		content, err := FetchSecret(path)
+		return []byte(content), err
+	}
+	return ioutil.ReadFile(path)
+}
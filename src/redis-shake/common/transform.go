@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"pkg/libs/log"
+	"pkg/rdb"
+	"redis-shake/configure"
+)
+
+/*
+ * Transformer passes the values to the worker process started by transform.command and takes
+ * the new values from it. The worker keeps running until Close, and talks in lines:
+ *   request:  "<base64 key> <base64 value>\n"
+ *   response: "+<base64 new value>\n", or "-<reason>\n" if it fails on the key
+ * The requests are sent one by one, so the worker handles one line and replies before reading the
+ * next one. Each worker of restore and rump starts its own Transformer, so the round trips of the
+ * workers don't wait for each other.
+ */
+type Transformer struct {
+	command string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	skipped [256]bool // the types logged as not transformed, see TransformDump
+}
+
+func NewTransformer(command string) (*Transformer, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("transform.command is empty")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start transform.command[%v] failed[%v]", command, err)
+	}
+	return &Transformer{
+		command: command,
+		cmd:     cmd,
+		stdin:   stdin,
+		stdout:  bufio.NewReaderSize(stdout, ReaderBufferSize),
+	}, nil
+}
+
+/*
+ * Transform returns the new value of the key. The reason is returned instead if the worker fails
+ * on the key, and the error is returned if the worker is broken.
+ */
+func (t *Transformer) Transform(key, value []byte) ([]byte, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	line := base64.StdEncoding.EncodeToString(key) + " " + base64.StdEncoding.EncodeToString(value) + "\n"
+	if _, err := io.WriteString(t.stdin, line); err != nil {
+		return nil, "", fmt.Errorf("write to transform.command[%v] failed[%v]", t.command, err)
+	}
+	reply, err := t.stdout.ReadString('\n')
+	if err != nil {
+		return nil, "", fmt.Errorf("read from transform.command[%v] failed[%v]", t.command, err)
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+
+	switch {
+	case strings.HasPrefix(reply, "+"):
+		v, err := base64.StdEncoding.DecodeString(reply[1:])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid reply of transform.command[%v]: %v", t.command, err)
+		}
+		return v, "", nil
+	case strings.HasPrefix(reply, "-"):
+		if reply == "-" {
+			return nil, "failed", nil
+		}
+		return nil, reply[1:], nil
+	}
+	return nil, "", fmt.Errorf("invalid reply of transform.command[%v]: %q", t.command, reply)
+}
+
+/*
+ * TransformDump transforms the value in the payload of DUMP/RESTORE in the same rdb version. Only
+ * the string is passed to the worker, the payload of the other types is returned as it is.
+ */
+func (t *Transformer) TransformDump(key, payload []byte) ([]byte, string, error) {
+	if len(payload) == 0 {
+		return payload, "", nil
+	} else if typ := payload[0]; typ != rdb.RdbTypeString {
+		t.mu.Lock()
+		if !t.skipped[typ] {
+			t.skipped[typ] = true
+			log.Infof("transform.command takes the string only, the keys of rdb type[%v] are written as they are, "+
+				"e.g., key[%s]", typ, key)
+		}
+		t.mu.Unlock()
+		return payload, "", nil
+	}
+	s, version, err := rdb.DecodeStringDump(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode the value of key[%s] failed[%v]", key, err)
+	}
+
+	v, reason, err := t.Transform(key, s)
+	if err != nil || reason != "" {
+		return nil, reason, err
+	}
+	if payload, err = rdb.EncodeStringDump(v, version); err != nil {
+		return nil, "", fmt.Errorf("encode the value of key[%s] failed[%v]", key, err)
+	}
+	return payload, "", nil
+}
+
+/*
+ * Apply transforms the payload and handles the key the worker fails on by transform.on_error,
+ * false is returned if the key should be skipped. It panics if the worker is broken.
+ */
+func (t *Transformer) Apply(key, payload []byte) ([]byte, bool) {
+	v, reason, err := t.TransformDump(key, payload)
+	if err != nil {
+		log.PanicErrorf(err, "transform key[%s] failed", key)
+	}
+	if reason == "" {
+		return v, true
+	}
+
+	switch conf.Options.TransformOnError {
+	case conf.TransformOnErrorSkip:
+		log.Warnf("transform key[%s] failed[%v], skip it", key, reason)
+		return nil, false
+	case conf.TransformOnErrorKeep:
+		log.Warnf("transform key[%s] failed[%v], keep the original value", key, reason)
+		return payload, true
+	default:
+		log.Panicf("transform key[%s] failed[%v]", key, reason)
+	}
+	return nil, false
+}
+
+// Close stops the worker by closing its stdin.
+func (t *Transformer) Close() error {
+	t.stdin.Close()
+	return t.cmd.Wait()
+}
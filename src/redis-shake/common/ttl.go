@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-shake/configure"
+)
+
+// AdjustTTL applies target.ttl_mode to the ttl in milliseconds, 0 means no expiration.
+func AdjustTTL(ttlms uint64) uint64 {
+	d := uint64(conf.Options.TargetDefaultTTLSec) * 1000
+	switch conf.Options.TargetTTLMode {
+	case conf.TTLModeOverride:
+		return d
+	case conf.TTLModeMin:
+		if ttlms == 0 || ttlms > d {
+			return d
+		}
+	case conf.TTLModeMax:
+		if ttlms != 0 && ttlms < d {
+			return d
+		}
+	}
+	return ttlms
+}
+
+/*
+ * AdjustExpireCommand applies target.ttl_mode to the ttl given in expire, pexpire, expireat,
+ * pexpireat, setex and psetex, the args are returned as they are for the other commands. The
+ * ttl <= 0 which deletes the key is kept.
+ */
+func AdjustExpireCommand(cmd string, args [][]byte) [][]byte {
+	if conf.Options.TargetTTLMode == "" || conf.Options.TargetTTLMode == conf.TTLModeSource || len(args) < 2 {
+		return args
+	}
+
+	var unit int64 // milliseconds of the unit
+	var absolute bool
+	switch strings.ToLower(cmd) {
+	case "expire", "setex":
+		unit = 1000
+	case "pexpire", "psetex":
+		unit = 1
+	case "expireat":
+		unit, absolute = 1000, true
+	case "pexpireat":
+		unit, absolute = 1, true
+	default:
+		return args
+	}
+
+	v, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		// let the target reply the error
+		return args
+	}
+	ttlms := v * unit
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if absolute {
+		ttlms -= now
+	}
+	if ttlms <= 0 {
+		return args
+	}
+
+	ttlms = int64(AdjustTTL(uint64(ttlms)))
+	if absolute {
+		ttlms += now
+	}
+	ret := make([][]byte, len(args))
+	copy(ret, args)
+	ret[1] = []byte(strconv.FormatInt((ttlms+unit-1)/unit, 10))
+	return ret
+}
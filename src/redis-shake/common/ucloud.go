@@ -0,0 +1,17 @@
+package utils
+
+// length of the slot prefix, e.g., "046110.key"
+const ucloudSlotPrefixLen = 7
+
+// ucloudCluster is the cluster of ucloud, whose rdb has the slot prefix added into every key.
+type ucloudCluster struct {
+	cloudBase
+}
+
+// 046110.key -> key
+func (ucloudCluster) RdbKey(key []byte) []byte {
+	if len(key) < ucloudSlotPrefixLen {
+		return key
+	}
+	return key[ucloudSlotPrefixLen:]
+}
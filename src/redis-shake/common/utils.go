@@ -6,6 +6,7 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"fmt"
@@ -27,49 +28,154 @@ import (
 
 	"github.com/FZambia/go-sentinel"
 	redigo "github.com/garyburd/redigo/redis"
-	redigoCluster "github.com/vinllen/redis-go-cluster"
 )
 
-func OpenRedisConn(target []string, auth_type, passwd string, isCluster bool, tlsEnable bool) redigo.Conn {
-	return OpenRedisConnWithTimeout(target, auth_type, passwd, 0, 0, isCluster, tlsEnable)
+func OpenRedisConn(target []string, auth_type, passwd string, isCluster bool, tlsConfig *tls.Config) redigo.Conn {
+	return OpenRedisConnWithTimeout(target, auth_type, passwd, 0, 0, isCluster, tlsConfig)
 }
 
 func OpenRedisConnWithTimeout(target []string, auth_type, passwd string, readTimeout, writeTimeout time.Duration,
-	isCluster bool, tlsEnable bool) redigo.Conn {
+	isCluster bool, tlsConfig *tls.Config) redigo.Conn {
 	if isCluster {
-		// the alive time isn't the tcp keep_alive parameter
-		cluster, err := redigoCluster.NewCluster(
-			&redigoCluster.Options{
-				StartNodes:   target,
-				ConnTimeout:  5 * time.Second,
-				ReadTimeout:  readTimeout,
-				WriteTimeout: writeTimeout,
-				KeepAlive:    32,               // number of available connections
-				AliveTime:    10 * time.Second, // hard code to set alive time in single connection, not the tcp keep alive
-				Password:     passwd,
-			})
+		c, err := NewClusterConn(target, auth_type, passwd, readTimeout, writeTimeout, tlsConfig)
 		if err != nil {
 			log.Panicf("create cluster connection error[%v]", err)
 			return nil
 		}
-		return NewClusterConn(cluster, RecvChanSize)
+		return c
 	} else {
 		// tls only support single connection currently
-		return redigo.NewConn(OpenNetConn(target[0], auth_type, passwd, tlsEnable), readTimeout, writeTimeout)
+		return newRedisConn(OpenNetConn(target[0], auth_type, passwd, tlsConfig), readTimeout, writeTimeout)
 	}
 }
 
-func OpenNetConn(target, auth_type, passwd string, tlsEnable bool) net.Conn {
-	d := &net.Dialer{
-		KeepAlive: time.Duration(conf.Options.KeepAlive) * time.Second,
+// the same as OpenRedisConnWithTimeout, but nil is returned if the target can't be connected
+func OpenRedisConnSoft(target []string, auth_type, passwd string, readTimeout, writeTimeout time.Duration,
+	isCluster bool, tlsConfig *tls.Config) redigo.Conn {
+	if isCluster {
+		c, err := NewClusterConn(target, auth_type, passwd, readTimeout, writeTimeout, tlsConfig)
+		if err != nil {
+			log.Warnf("create cluster connection error[%v]", err)
+			return nil
+		}
+		return c
+	}
+	c := OpenNetConnSoft(target[0], auth_type, passwd, tlsConfig)
+	if c == nil {
+		return nil
 	}
+	return newRedisConn(c, readTimeout, writeTimeout)
+}
+
+// dial the address directly or through the ssh tunnel or the socks5 proxy, then send the header of
+// the PROXY protocol if proxy_protocol.version is given, and handshake if tlsConfig isn't nil
+func dialConn(d *net.Dialer, address string, tlsConfig *tls.Config) (net.Conn, error) {
 	var c net.Conn
 	var err error
-	if tlsEnable {
-		c, err = tls.DialWithDialer(d, "tcp", target, &tls.Config{InsecureSkipVerify: false})
-	} else {
-		c, err = d.Dial("tcp", target)
+	direct := false
+	switch {
+	case SSHTunnel != nil && SSHTunnel.Match(address):
+		c, err = SSHTunnel.Dial(address, d.Timeout, d.KeepAlive)
+	case Socks5Proxy != nil && Socks5Proxy.Match(address):
+		c, err = Socks5Proxy.Dial(d, address)
+	default:
+		c, err = dialDirect(d, address)
+		direct = true
+	}
+	if err == nil && ProxyProtocol != nil && ProxyProtocol.Match(address) {
+		// the addresses of the tunneled connection aren't the ones to the load balancer
+		var src, dst net.Addr
+		if direct {
+			src, dst = c.LocalAddr(), c.RemoteAddr()
+		}
+		if err = ProxyProtocol.Write(c, src, dst, d.Timeout); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if err != nil || tlsConfig == nil {
+		return c, err
+	}
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tc := tls.Client(c, config)
+	if d.Timeout > 0 {
+		tc.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+/*
+ * the host is resolved again on each dial instead of using the ips resolved before, since the
+ * endpoint of the cloud may switch its ip on failover. The ips of dial_prefer_family are dialed
+ * first, then the others in the order resolved, each with the whole dial_timeout_ms.
+ */
+func dialDirect(d *net.Dialer, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.Dial("tcp", address)
+	}
+
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	} else if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address of host[%v] is resolved", host)
+	}
+
+	var lastErr error
+	for _, ip := range preferFamily(addrs, conf.Options.DialPreferFamily) {
+		c, err := d.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		log.Warnf("dial [%v] resolved from [%v] failed: %v", ip, address, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// resolve the host, replaced in the test
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// the ips of the family first, the others keep the order resolved
+func preferFamily(addrs []net.IPAddr, family string) []net.IP {
+	preferred := make([]net.IP, 0, len(addrs))
+	var others []net.IP
+	for _, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		if family == "" || (family == conf.AddressFamilyIPv4) == isIPv4 {
+			preferred = append(preferred, addr.IP)
+		} else {
+			others = append(others, addr.IP)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// the dialer of dial_timeout_ms and keep_alive
+func newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   time.Duration(conf.Options.DialTimeoutMs) * time.Millisecond,
+		KeepAlive: time.Duration(conf.Options.KeepAlive) * time.Second,
 	}
+}
+
+func OpenNetConn(target, auth_type, passwd string, tlsConfig *tls.Config) net.Conn {
+	c, err := dialConn(newDialer(), target, tlsConfig)
 	if err != nil {
 		log.PanicErrorf(err, "cannot connect to '%s'", target)
 	}
@@ -80,14 +186,8 @@ func OpenNetConn(target, auth_type, passwd string, tlsEnable bool) net.Conn {
 	return c
 }
 
-func OpenNetConnSoft(target, auth_type, passwd string, tlsEnable bool) net.Conn {
-	var c net.Conn
-	var err error
-	if tlsEnable {
-		c, err = tls.Dial("tcp", target, &tls.Config{InsecureSkipVerify: false})
-	} else {
-		c, err = net.Dial("tcp", target)
-	}
+func OpenNetConnSoft(target, auth_type, passwd string, tlsConfig *tls.Config) net.Conn {
+	c, err := dialConn(newDialer(), target, tlsConfig)
 	if err != nil {
 		return nil
 	}
@@ -95,6 +195,34 @@ func OpenNetConnSoft(target, auth_type, passwd string, tlsEnable bool) net.Conn
 	return c
 }
 
+// the connection whose deadline is pushed back before each read and write, 0 means no deadline
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func WithTimeout(c net.Conn, readTimeout, writeTimeout time.Duration) net.Conn {
+	if readTimeout == 0 && writeTimeout == 0 {
+		return c
+	}
+	return &timeoutConn{Conn: c, readTimeout: readTimeout, writeTimeout: writeTimeout}
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.readTimeout != 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.writeTimeout != 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
 func OpenReadFile(name string) (*os.File, int64) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -124,7 +252,7 @@ func OpenReadWriteFile(name string) *os.File {
 }
 
 func SendPSyncListeningPort(c net.Conn, port int) {
-	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand("replconf", "listening-port", port)))
+	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand(RenameCommand("replconf"), "listening-port", port)))
 	if err != nil {
 		log.PanicError(errors.Trace(err), "write replconf listening-port failed")
 	}
@@ -134,7 +262,7 @@ func SendPSyncListeningPort(c net.Conn, port int) {
 		log.PanicError(errors.Trace(err), "read auth response failed")
 	}
 	if strings.ToUpper(ret) != "+OK\r\n" {
-		log.Panicf("repl listening-port failed[%v]", RemoveRESPEnd(ret))
+		log.Panicf("repl listening-port failed[%v]%s", RemoveRESPEnd(ret), AuthHint("source", ret))
 	}
 }
 
@@ -144,7 +272,7 @@ func AuthPassword(c net.Conn, auth_type, passwd string) {
 		return
 	}
 
-	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand(auth_type, passwd)))
+	_, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand(auth_type, AuthArgs(passwd)...)))
 	if err != nil {
 		log.PanicError(errors.Trace(err), "write auth command failed")
 	}
@@ -158,19 +286,45 @@ func AuthPassword(c net.Conn, auth_type, passwd string) {
 	}
 }
 
-func OpenSyncConn(target string, auth_type, passwd string, tlsEnable bool) (net.Conn, <-chan int64) {
-	c := OpenNetConn(target, auth_type, passwd, tlsEnable)
-	if _, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand("sync"))); err != nil {
+func OpenSyncConn(target string, auth_type, passwd string, tlsConfig *tls.Config) (net.Conn, <-chan RdbSize) {
+	c := OpenNetConn(target, auth_type, passwd, tlsConfig)
+	if _, err := c.Write(redis.MustEncodeToBytes(redis.NewCommand(RenameCommand(SourceRdbCloud.SyncCommand())))); err != nil {
 		log.PanicError(errors.Trace(err), "write sync command failed")
 	}
 	return c, waitRdbDump(c)
 }
 
+/*
+ * the rdb size in the sync response. In diskless mode, the response is "$EOF:<40 bytes mark>\r\n",
+ * the Size is RdbSizeUnknown and the rdb ends with the EOFMark.
+ */
+type RdbSize struct {
+	Size    int64
+	EOFMark []byte
+	Fatal   *log.Fatal // raised in the routine reading the size, see log.SetPanicRecoverable
+}
+
+// CheckFatal raises the fatal error of the routine reading the size again in the routine waiting for it.
+func (s RdbSize) CheckFatal() {
+	if s.Fatal != nil {
+		panic(s.Fatal)
+	}
+}
+
 // pipeline mode which means we don't wait all dump finish and run the next step
-func waitRdbDump(r io.Reader) <-chan int64 {
-	size := make(chan int64)
+func waitRdbDump(r io.Reader) <-chan RdbSize {
+	size := make(chan RdbSize)
 	// read rdb size
 	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				f, ok := r.(*log.Fatal)
+				if !ok {
+					panic(r)
+				}
+				size <- RdbSize{Fatal: f}
+			}
+		}()
 		var rsp string
 		for {
 			b := []byte{0}
@@ -178,7 +332,7 @@ func waitRdbDump(r io.Reader) <-chan int64 {
 				log.PanicErrorf(err, "read sync response = '%s'", rsp)
 			}
 			if len(rsp) == 0 && b[0] == '\n' {
-				size <- 0
+				size <- RdbSize{}
 				continue
 			}
 			rsp += string(b)
@@ -187,19 +341,71 @@ func waitRdbDump(r io.Reader) <-chan int64 {
 			}
 		}
 		if rsp[0] != '$' {
-			log.Panicf("invalid sync response, rsp = '%s'", rsp)
+			log.Panicf("invalid sync response, rsp = '%s'%s", rsp, AuthHint("source", rsp))
+		}
+		if strings.HasPrefix(rsp, "$EOF:") {
+			mark := rsp[5 : len(rsp)-2]
+			if len(mark) != RdbEOFMarkSize {
+				log.Panicf("invalid sync response = '%s', eof mark length = %d", rsp, len(mark))
+			}
+			size <- RdbSize{Size: RdbSizeUnknown, EOFMark: []byte(mark)}
+			return
 		}
 		n, err := strconv.Atoi(rsp[1 : len(rsp)-2])
 		if err != nil || n <= 0 {
 			log.PanicErrorf(err, "invalid sync response = '%s', n = %d", rsp, n)
 		}
-		size <- int64(n)
+		size <- RdbSize{Size: int64(n)}
 	}()
 	return size
 }
 
-func SendPSyncFullsync(br *bufio.Reader, bw *bufio.Writer) (string, int64, <-chan int64) {
-	cmd := redis.NewCommand("psync", "?", -1)
+/*
+ * copy the rdb which ends with the given eof mark in diskless mode. The mark is stripped, and
+ * the data following the mark in the same read isn't written into w but returned, since it's
+ * the increment rather than the rdb. If nread isn't nil, it's increased by the copied rdb size.
+ * return the rdb size and the data following the mark.
+ */
+func CopyRdbUntilEOFMark(r io.Reader, w io.Writer, mark []byte, nread *atomic2.Int64) (int64, []byte) {
+	write := func(p []byte) {
+		if _, err := w.Write(p); err != nil {
+			log.PanicError(err, "write error")
+		}
+	}
+
+	var rdbSize int64
+	p := make([]byte, 8192)
+	buf := make([]byte, 0, len(p)+len(mark))
+	for {
+		n, err := r.Read(p)
+		buf = append(buf, p[:n]...)
+		if idx := bytes.Index(buf, mark); idx >= 0 {
+			write(buf[:idx])
+			rdbSize += int64(idx)
+			if nread != nil {
+				nread.Add(int64(idx))
+			}
+			return rdbSize, buf[idx+len(mark):]
+		}
+		if err != nil {
+			log.PanicError(err, "read error")
+		}
+
+		// keep the tail which may be the prefix of the mark
+		if keep := len(mark) - 1; len(buf) > keep {
+			step := len(buf) - keep
+			write(buf[:step])
+			rdbSize += int64(step)
+			if nread != nil {
+				nread.Add(int64(step))
+			}
+			buf = append(buf[:0], buf[step:]...)
+		}
+	}
+}
+
+func SendPSyncFullsync(br *bufio.Reader, bw *bufio.Writer) (string, int64, <-chan RdbSize) {
+	cmd := redis.NewCommand(RenameCommand(SourceRdbCloud.PSyncCommand()), "?", -1)
 	if err := redis.Encode(bw, cmd, true); err != nil {
 		log.PanicError(err, "write psync command failed, fullsync")
 	}
@@ -214,10 +420,20 @@ func SendPSyncFullsync(br *bufio.Reader, bw *bufio.Writer) (string, int64, <-cha
 	if err != nil {
 		log.PanicError(err, "invalid psync response, fullsync")
 	}
-	xx := strings.Split(string(x), " ")
-	if len(xx) < 3 || strings.ToLower(xx[0]) != "fullresync" {
+	runid, offset, wait, ok := ParsePSyncFullsync(br, string(x))
+	if !ok {
 		log.Panicf("invalid psync response = '%s', should be fullsync", x)
 	}
+	return runid, offset, wait
+}
+
+// parse the "fullresync <runid> <offset>" reply of psync and start waiting the rdb from br,
+// false is returned if it isn't a fullresync reply.
+func ParsePSyncFullsync(br *bufio.Reader, reply string) (string, int64, <-chan RdbSize, bool) {
+	xx := strings.Split(reply, " ")
+	if len(xx) < 3 || strings.ToLower(xx[0]) != "fullresync" {
+		return "", 0, nil, false
+	}
 	v, err := strconv.ParseInt(xx[2], 10, 64)
 	if err != nil {
 		log.PanicError(err, "parse psync offset failed")
@@ -226,11 +442,27 @@ func SendPSyncFullsync(br *bufio.Reader, bw *bufio.Writer) (string, int64, <-cha
 	// log.PurePrintf("%s\n", NewLogItem("FullSyncStart", "INFO", LogDetail{}))
 	log.Infof("Event:FullSyncStart\tId:%s\t", conf.Options.Id)
 	runid, offset := xx[1], v
-	return runid, offset, waitRdbDump(br)
+	return runid, offset, waitRdbDump(br), true
 }
 
 func SendPSyncContinue(br *bufio.Reader, bw *bufio.Writer, runid string, offset int64) {
-	cmd := redis.NewCommand("psync", runid, offset+1)
+	if ok, x := TryPSyncContinue(br, bw, runid, offset); !ok {
+		if strings.HasPrefix(strings.ToLower(x), "fullresync") {
+
+			// log.PurePrintf("%s\n", NewLogItem("ExpectContinueButFullSync", "ERROR", NewErrorLogDetail(string(x), "")))
+			log.Errorf("Event:ExpectContinueButFullSync\tId:%s\tReply:%s", conf.Options.Id, x)
+		}
+		log.Panicf("invalid psync response = '%s', should be continue", x)
+	}
+
+	// log.PurePrintf("%s\n", NewLogItem("IncSyncStart", "INFO", LogDetail{}))
+	log.Infof("Event:IncSyncStart\tId:%s\t", conf.Options.Id)
+}
+
+// send psync with the given runid and offset, return whether the master replies "continue" and the reply.
+// The master supporting psync2 may reply "continue <runid>" with its new runid(replid) after failover.
+func TryPSyncContinue(br *bufio.Reader, bw *bufio.Writer, runid string, offset int64) (bool, string) {
+	cmd := redis.NewCommand(RenameCommand(SourceRdbCloud.PSyncCommand()), runid, offset+1)
 	if err := redis.Encode(bw, cmd, true); err != nil {
 		log.PanicError(err, "write psync command failed, continue")
 	}
@@ -239,28 +471,26 @@ func SendPSyncContinue(br *bufio.Reader, bw *bufio.Writer, runid string, offset
 		log.PanicError(err, "invalid psync response, continue")
 	}
 	if e, ok := r.(*redis.Error); ok {
-		log.Panicf("invalid psync response, continue, %s", e.Value)
+		return false, string(e.Value)
 	}
 	x, err := redis.AsString(r, nil)
 	if err != nil {
 		log.PanicError(err, "invalid psync response, continue")
 	}
 	xx := strings.Split(string(x), " ")
-	if len(xx) != 1 || strings.ToLower(xx[0]) != "continue" {
-		if strings.ToLower(xx[0]) == "fullresync" {
+	return len(xx) <= 2 && strings.ToLower(xx[0]) == "continue", string(x)
+}
 
-			// log.PurePrintf("%s\n", NewLogItem("ExpectContinueButFullSync", "ERROR", NewErrorLogDetail(string(x), "")))
-			log.Errorf("Event:ExpectContinueButFullSync\tId:%s\tReply:%s", conf.Options.Id, x)
-		}
-		log.Panicf("invalid psync response = '%s', should be continue", x)
+// the runid in the "continue <runid>" reply of psync, empty if the runid isn't changed.
+func PSyncContinueRunId(reply string) string {
+	if xx := strings.Split(reply, " "); len(xx) == 2 {
+		return xx[1]
 	}
-
-	// log.PurePrintf("%s\n", NewLogItem("IncSyncStart", "INFO", LogDetail{}))
-	log.Infof("Event:IncSyncStart\tId:%s\t", conf.Options.Id)
+	return ""
 }
 
 func SendPSyncAck(bw *bufio.Writer, offset int64) error {
-	cmd := redis.NewCommand("replconf", "ack", offset)
+	cmd := redis.NewCommand(RenameCommand("replconf"), "ack", offset)
 	return redis.Encode(bw, cmd, true)
 }
 
@@ -274,7 +504,9 @@ func paclusterSlotsHB(c redigo.Conn) {
 
 func SelectDB(c redigo.Conn, db uint32) {
 	s, err := redigo.String(c.Do("select", db))
-	if err != nil {
+	if IsDBOutOfRangeError(err) {
+		log.PanicErrorf(err, "select target db[%d] failed, it's out of range, see target.db_out_of_range", db)
+	} else if err != nil {
 		log.PanicError(err, "select command error")
 	}
 	if s != "OK" {
@@ -331,10 +563,27 @@ func set(c redigo.Conn, key []byte, value []byte) {
 	}
 }
 
+// the string larger than target.restore_max_bytes is written by SET and APPEND of the chunks
+func setInChunks(c redigo.Conn, key []byte, value []byte) {
+	limit := int(conf.Options.TargetRestoreMaxBytes)
+	if limit == 0 || len(value) <= limit {
+		set(c, key, value)
+		return
+	}
+	log.Info("restore big string key ", string(key), " in ", (len(value)+limit-1)/limit, " chunks")
+	set(c, key, value[:limit])
+	for i := limit; i < len(value); i += limit {
+		end := i + limit
+		if end > len(value) {
+			end = len(value)
+		}
+		if _, err := c.Do("append", key, value[i:end]); err != nil {
+			log.PanicError(err, "append command error")
+		}
+	}
+}
+
 func flushAndCheckReply(c redigo.Conn, count int) {
-	// for redis-go-cluster driver, "Receive" function returns all the replies once flushed.
-	// However, this action is different with redigo driver that "Receive" only returns 1
-	// reply each time.
 	c.Flush()
 	for j := 0; j < count; j++ {
 		_, err := c.Receive()
@@ -576,7 +825,7 @@ func restoreBigRdbEntry(c redigo.Conn, e *rdb.BinEntry) error {
 		if err != nil {
 			log.PanicError(err, "read rdb ")
 		}
-		set(c, e.Key, value)
+		setInChunks(c, e.Key, value)
 	case rdb.RdbTypeList:
 		if n, err := r.ReadLength(); err != nil {
 			log.PanicError(err, "read rdb ")
@@ -722,20 +971,28 @@ func restoreBigRdbEntry(c redigo.Conn, e *rdb.BinEntry) error {
 	return err
 }
 
-func RestoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
-	/*
-	 * for ucloud, special judge.
-	 * 046110.key -> key
-	 */
-	if conf.Options.SourceRdbSpecialCloud == UCloudCluster {
-		e.Key = e.Key[7:]
+// set once the target rejects IDLETIME/FREQ in restore
+var idleFreqRejected atomic2.Bool
+
+// the value larger than bigKey is written by commands, see BigKeyThreshold
+func RestoreRdbEntry(c redigo.Conn, e *rdb.BinEntry, bigKey uint64) {
+	ttlms := prepareRdbEntry(e)
+	if !restoreSpecialRdbEntry(c, e, ttlms, bigKey) {
+		restoreRdbValue(c, e, ttlms)
 	}
+}
+
+// rewrite the key for the target and return the ttl in milliseconds adjusted by target.ttl_mode,
+// 0 means no expiration
+func prepareRdbEntry(e *rdb.BinEntry) uint64 {
+	e.Key = SourceRdbCloud.RdbKey(e.Key)
 
 	var ttlms uint64
 	if conf.Options.ReplaceHashTag {
 		e.Key = bytes.Replace(e.Key, []byte("{"), []byte(""), 1)
 		e.Key = bytes.Replace(e.Key, []byte("}"), []byte(""), 1)
 	}
+	e.Key = InjectHashTag(e.Key)
 	if e.ExpireAt != 0 {
 		now := uint64(time.Now().Add(conf.Options.ShiftTime).UnixNano())
 		now /= uint64(time.Millisecond)
@@ -745,6 +1002,30 @@ func RestoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 			ttlms = e.ExpireAt - now
 		}
 	}
+	return AdjustTTL(ttlms)
+}
+
+/*
+ * BigKeyThreshold returns the size of the value above which the key is written by the commands of
+ * its type instead of one RESTORE. It's target.restore_max_bytes if that's smaller than
+ * big_key_threshold, e.g., the proxy of the cluster rejecting the request larger than it.
+ */
+func BigKeyThreshold(options *conf.Configuration) uint64 {
+	if limit := options.TargetRestoreMaxBytes; limit > 0 && limit < options.BigKeyThreshold {
+		return limit
+	}
+	return options.BigKeyThreshold
+}
+
+// the entries that can't be restored by one RESTORE
+func isSpecialRdbEntry(e *rdb.BinEntry, bigKey uint64) bool {
+	return e.Type == rdb.RdbTypeQuicklist || e.Type == rdb.RdbFlagAUX && string(e.Key) == "lua" ||
+		e.Type != rdb.RDBTypeStreamListPacks &&
+			(uint64(len(e.Value)) > bigKey || e.RealMemberCount != 0)
+}
+
+// restore the quicklist, the lua script and the big key, return false if e isn't one of them
+func restoreSpecialRdbEntry(c redigo.Conn, e *rdb.BinEntry, ttlms, bigKey uint64) bool {
 	if e.Type == rdb.RdbTypeQuicklist {
 		exist, err := redigo.Bool(c.Do("exists", e.Key))
 		if err != nil {
@@ -764,13 +1045,13 @@ func RestoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 			}
 		}
 		restoreQuicklistEntry(c, e)
-		if e.ExpireAt != 0 {
+		if ttlms != 0 {
 			r, err := redigo.Int64(c.Do("pexpire", e.Key, ttlms))
 			if err != nil && r != 1 {
 				log.Panicf("expire ", string(e.Key), err)
 			}
 		}
-		return
+		return true
 	}
 
 	// load lua script
@@ -781,12 +1062,12 @@ func RestoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 				log.Panicf(err.Error())
 			}
 		}
-		return
+		return true
 	}
 
 	// TODO, need to judge big key
 	if e.Type != rdb.RDBTypeStreamListPacks &&
-		(uint64(len(e.Value)) > conf.Options.BigKeyThreshold || e.RealMemberCount != 0) {
+		(uint64(len(e.Value)) > bigKey || e.RealMemberCount != 0) {
 		log.Debugf("restore big key[%s] with length[%v] and member count[%v]", e.Key, len(e.Value), e.RealMemberCount)
 		//use command
 		if conf.Options.Rewrite && e.NeedReadLen == 1 {
@@ -803,30 +1084,44 @@ func RestoreRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
 			log.Panic(err)
 		}
 
-		if e.ExpireAt != 0 {
+		if ttlms != 0 {
 			r, err := redigo.Int64(c.Do("pexpire", e.Key, ttlms))
 			if err != nil && r != 1 {
 				log.Panicf("expire ", string(e.Key), err)
 			}
 		}
-		return
+		return true
 	}
+	return false
+}
 
-	params := []interface{}{e.Key, ttlms, e.Value}
-	if e.IdleTime != 0 {
-		params = append(params, "IDLETIME")
-		params = append(params, e.IdleTime)
-	}
-	if e.Freq != 0 {
-		params = append(params, "FREQ")
-		params = append(params, e.Freq)
+// the arguments of RESTORE, idleFreq is true if IDLETIME or FREQ is given
+func restoreParams(e *rdb.BinEntry, ttlms uint64) (params []interface{}, idleFreq bool) {
+	params = []interface{}{e.Key, ttlms, e.Value}
+	if conf.Options.TargetPreserveIdleFreq && !idleFreqRejected.Get() {
+		if e.IdleTime != 0 {
+			params = append(params, "IDLETIME")
+			params = append(params, e.IdleTime)
+			idleFreq = true
+		}
+		if e.Freq != 0 {
+			params = append(params, "FREQ")
+			params = append(params, e.Freq)
+			idleFreq = true
+		}
 	}
+	return params, idleFreq
+}
+
+// restore the value by RESTORE
+func restoreRdbValue(c redigo.Conn, e *rdb.BinEntry, ttlms uint64) {
+	params, idleFreq := restoreParams(e, ttlms)
 
 	log.Debugf("restore key[%s] with params[%v]", e.Key, params)
 	// fmt.Printf("key: %v, value: %v params: %v\n", string(e.Key), e.Value, params)
 	// s, err := redigo.String(c.Do("restore", params...))
 RESTORE:
-	s, err := redigoCluster.String(c.Do("restore", params...))
+	s, err := redigo.String(DoRetryStalled(c, "restore", params...))
 	if err != nil {
 		/*The reply value of busykey in 2.8 kernel is "target key name is busy",
 		  but in 4.0 kernel is "BUSYKEY Target key name already exists"*/
@@ -840,7 +1135,7 @@ RESTORE:
 				if conf.Options.TargetReplace {
 					params = append(params, "REPLACE")
 				} else {
-					_, err = redigo.String(c.Do("del", e.Key))
+					_, err = c.Do("del", e.Key)
 					if err != nil {
 						log.Panicf("delete key[%v] failed[%v]", string(e.Key), err)
 					}
@@ -851,6 +1146,14 @@ RESTORE:
 			} else {
 				log.Panicf("target key name is busy:", string(e.Key))
 			}
+		} else if idleFreq && strings.Contains(err.Error(), "syntax error") {
+			// IDLETIME and FREQ are supported since 5.0
+			if idleFreqRejected.CompareAndSwap(false, true) {
+				log.Warnf("target doesn't support IDLETIME/FREQ in restore[%v], restore without them", err)
+			}
+			params = params[:3]
+			idleFreq = false
+			goto RESTORE
 		} else if strings.Contains(err.Error(), "Bad data format") {
 			// from big version to small version may has this error. we need to split the data struct
 			log.Warnf("return error[%v], ignore it and try to split the value", err)
@@ -889,13 +1192,21 @@ func FlushWriter(w *bufio.Writer) {
 	}
 }
 
-func NewRDBLoader(reader *bufio.Reader, rbytes *atomic2.Int64, size int) chan *rdb.BinEntry {
+/*
+ * The header is parsed before returning, so the caller checks whether its target can load the
+ * returned rdb version, see CheckTargetRdbVersion. guard is deferred in the routine if it isn't
+ * nil, e.g., to recover the fatal error.
+ */
+func NewRDBLoader(reader *bufio.Reader, rbytes *atomic2.Int64, size int, guard func()) (chan *rdb.BinEntry, int64) {
+	l := rdb.NewLoader(stats.NewCountReader(reader, rbytes))
+	if err := l.Header(); err != nil {
+		log.PanicError(err, "parse rdb header error")
+	}
 	pipe := make(chan *rdb.BinEntry, size)
 	go func() {
 		defer close(pipe)
-		l := rdb.NewLoader(stats.NewCountReader(reader, rbytes))
-		if err := l.Header(); err != nil {
-			log.PanicError(err, "parse rdb header error")
+		if guard != nil {
+			defer guard()
 		}
 		for {
 			if entry, err := l.NextBinEntry(); err != nil {
@@ -914,11 +1225,176 @@ func NewRDBLoader(reader *bufio.Reader, rbytes *atomic2.Int64, size int) chan *r
 			}
 		}
 	}()
-	return pipe
+	return pipe, l.Version()
+}
+
+/*
+ * CheckTargetRdbVersion checks whether each of the targets can load the rdb version by the
+ * redis_version in its INFO, target.version is used if INFO fails, e.g., the proxy rejecting it.
+ * Return rewrite = true if the entries should be rebuilt by commands, then the caller writes them
+ * by the big key threshold 1.
+ */
+func CheckTargetRdbVersion(rdbVersion int64, targets []string, authType, auth string, tlsConfig *tls.Config,
+	options *conf.Configuration) (bool, error) {
+	var rewrite bool
+	for _, address := range targets {
+		version, err := GetRedisVersion(address, authType, auth, tlsConfig)
+		if err != nil {
+			log.Warnf("get the version of target[%v] failed, use target.version[%v]: %v", address,
+				options.TargetVersion, err)
+			version = options.TargetVersion
+		}
+		ok, err := CheckRdbVersion(rdbVersion, version, options.TargetVersionMismatch)
+		if err != nil {
+			return false, fmt.Errorf("target[%v]: %v", address, err)
+		} else if ok {
+			log.Warnf("target[%v] of version[%v] can't load rdb version[%v], the keys are written by commands",
+				address, version, rdbVersion)
+			rewrite = true
+		}
+	}
+	return rewrite, nil
 }
 
-func GetRedisVersion(target, authType, auth string, tlsEnable bool) (string, error) {
-	c := OpenRedisConn([]string{target}, authType, auth, false, tlsEnable)
+/*
+ * check whether the target redis with given version can load the rdb payload. Return
+ * rewrite = true if the entries should be rebuilt by commands instead of RESTORE.
+ */
+func CheckRdbVersion(rdbVersion int64, targetVersion, policy string) (bool, error) {
+	maxVersion := RedisRdbVersion(targetVersion)
+	if maxVersion == 0 || rdbVersion <= maxVersion {
+		// unknown target version or compatible
+		return false, nil
+	}
+
+	switch policy {
+	case conf.VersionMismatchRewrite:
+		return true, nil
+	default:
+		return false, fmt.Errorf("target redis version[%v] only supports rdb version <= %v, but the source rdb "+
+			"version is %v. set target.version_mismatch = rewrite to write by commands",
+			targetVersion, maxVersion, rdbVersion)
+	}
+}
+
+// return the max rdb version the given redis version can load, 0 means unknown
+func RedisRdbVersion(version string) int64 {
+	if !strings.Contains(version, ".") {
+		version += ".0"
+	}
+
+	list := []struct {
+		version    string
+		rdbVersion int64
+	}{
+		{"7.4", 12},
+		{"7.2", 11},
+		{"7.0", 10},
+		{"5.0", 9},
+		{"4.0", 8},
+		{"3.2", 7},
+		{"2.6", 6},
+	}
+	for _, ele := range list {
+		switch CompareVersion(version, ele.version, 2) {
+		case 0, 2:
+			return ele.rdbVersion
+		case 3:
+			return 0
+		}
+	}
+	return 5
+}
+
+/*
+ * buffer the rdb entries and output them grouped by db so that fewer SELECT is needed when
+ * the dbs are interleaved. The order of entries in the same db is kept. The buffer is
+ * flushed once the size of buffered keys and values reaches the limit.
+ */
+func GroupRdbEntryByDB(input chan *rdb.BinEntry, limit uint64, size int) chan *rdb.BinEntry {
+	output := make(chan *rdb.BinEntry, size)
+	go func() {
+		defer close(output)
+		groups := make(map[uint32][]*rdb.BinEntry)
+		order := make([]uint32, 0) // db in the order of first seen
+		var cached uint64
+		var lastdb uint32
+
+		flush := func() {
+			// continue with the last db
+			if list, ok := groups[lastdb]; ok {
+				for _, e := range list {
+					output <- e
+				}
+				delete(groups, lastdb)
+			}
+			for _, db := range order {
+				if list, ok := groups[db]; ok {
+					for _, e := range list {
+						output <- e
+					}
+					lastdb = db
+					delete(groups, db)
+				}
+			}
+			order = order[:0]
+			cached = 0
+		}
+
+		for e := range input {
+			if _, ok := groups[e.DB]; !ok {
+				order = append(order, e.DB)
+			}
+			groups[e.DB] = append(groups[e.DB], e)
+			cached += uint64(len(e.Key) + len(e.Value))
+			if cached >= limit {
+				flush()
+			}
+		}
+		flush()
+	}()
+	return output
+}
+
+/*
+ * skip the rdb entries whose value is larger than max, dropped is called for each key skipped.
+ * The value split into parts in loading is judged by the size estimated from the first part,
+ * and the rest parts of the key skipped are skipped too.
+ */
+func FilterRdbEntryBySize(input chan *rdb.BinEntry, max uint64, size int, dropped func(e *rdb.BinEntry, size uint64)) chan *rdb.BinEntry {
+	output := make(chan *rdb.BinEntry, size)
+	go func() {
+		defer close(output)
+		var dropping []byte // the split key being skipped
+		for e := range input {
+			if e.NeedReadLen != 1 {
+				// the rest parts of the split key
+				if dropping == nil || !bytes.Equal(dropping, e.Key) {
+					output <- e
+				}
+				continue
+			}
+			dropping = nil
+
+			n := uint64(len(e.Value))
+			if e.RealMemberCount != 0 && e.TotMemberCount > e.RealMemberCount {
+				n = n * uint64(e.TotMemberCount) / uint64(e.RealMemberCount)
+			}
+			if e.Type == rdb.RdbFlagAUX || n <= max {
+				output <- e
+				continue
+			}
+			dropped(e, n)
+			if e.RealMemberCount != 0 {
+				dropping = e.Key
+			}
+		}
+	}()
+	return output
+}
+
+func GetRedisVersion(target, authType, auth string, tlsConfig *tls.Config) (string, error) {
+	c := OpenRedisConn([]string{target}, authType, auth, false, tlsConfig)
 	defer c.Close()
 
 	infoStr, err := redigo.Bytes(c.Do("info", "server"))
@@ -940,8 +1416,8 @@ func GetRedisVersion(target, authType, auth string, tlsEnable bool) (string, err
 	}
 }
 
-func GetRDBChecksum(target, authType, auth string, tlsEnable bool) (string, error) {
-	c := OpenRedisConn([]string{target}, authType, auth, false, tlsEnable)
+func GetRDBChecksum(target, authType, auth string, tlsConfig *tls.Config) (string, error) {
+	c := OpenRedisConn([]string{target}, authType, auth, false, tlsConfig)
 	defer c.Close()
 
 	content, err := c.Do("config", "get", "rdbchecksum")
@@ -965,7 +1441,8 @@ func CheckHandleNetError(err error) bool {
 	return false
 }
 
-func GetFakeSlaveOffset(c redigo.Conn) (string, error) {
+// fetch the offset of the slave which reports the listening port from INFO replication
+func GetFakeSlaveOffset(c redigo.Conn, port int) (string, error) {
 	infoStr, err := redigo.Bytes(c.Do("info", "Replication"))
 	if err != nil {
 		return "", err
@@ -973,15 +1450,23 @@ func GetFakeSlaveOffset(c redigo.Conn) (string, error) {
 
 	kv := ParseRedisInfo(infoStr)
 
+	portItem := fmt.Sprintf("port=%d", port)
 	for k, v := range kv {
-		if strings.Contains(k, "slave") && strings.Contains(v, fmt.Sprintf("port=%d", conf.Options.HttpProfile)) {
-			list := strings.Split(v, ",")
-			for _, item := range list {
-				if strings.HasPrefix(item, "offset=") {
-					return strings.Split(item, "=")[1], nil
-				}
+		if !strings.Contains(k, "slave") {
+			continue
+		}
+		var offset string
+		var match bool
+		for _, item := range strings.Split(v, ",") {
+			if item == portItem {
+				match = true
+			} else if strings.HasPrefix(item, "offset=") {
+				offset = strings.Split(item, "=")[1]
 			}
 		}
+		if match && offset != "" {
+			return offset, nil
+		}
 	}
 	return "", fmt.Errorf("OffsetNotFoundInInfo")
 }
@@ -1016,12 +1501,15 @@ func GetLocalIp(preferdInterfaces []string) (ip string, interfaceName string, er
 // GetReadableRedisAddressThroughSentinel gets readable redis address
 // First, the function will pick one from available slaves randomly.
 // If there is no available slave, it will pick master.
-func GetReadableRedisAddressThroughSentinel(sentinelAddrs []string, sentinelMasterName string, fromMaster bool) (string, error) {
+// The password is sent to the sentinels by AUTH if given.
+func GetReadableRedisAddressThroughSentinel(sentinelAddrs []string, sentinelMasterName string, fromMaster bool,
+	password string) (string, error) {
 	sentinelGroup := sentinel.Sentinel{
 		Addrs:      sentinelAddrs,
 		MasterName: sentinelMasterName,
-		Dial:       defaultDialFunction,
+		Dial:       sentinelDialFunction(password),
 	}
+	defer sentinelGroup.Close()
 	if fromMaster == false {
 		if slaves, err := sentinelGroup.Slaves(); err == nil {
 			if addr, err := getAvailableSlaveAddress(slaves); err == nil {
@@ -1053,21 +1541,34 @@ func getAvailableSlaveAddress(slaves []*sentinel.Slave) (string, error) {
 }
 
 // getWritableRedisAddressThroughSentinel gets writable redis address
-// The function will return redis master address.
-func GetWritableRedisAddressThroughSentinel(sentinelAddrs []string, sentinelMasterName string) (string, error) {
+// The function will return redis master address, the password is sent to the sentinels by AUTH if given.
+func GetWritableRedisAddressThroughSentinel(sentinelAddrs []string, sentinelMasterName string,
+	password string) (string, error) {
 	sentinelGroup := sentinel.Sentinel{
 		Addrs:      sentinelAddrs,
 		MasterName: sentinelMasterName,
-		Dial:       defaultDialFunction,
+		Dial:       sentinelDialFunction(password),
 	}
+	defer sentinelGroup.Close()
 	return sentinelGroup.MasterAddr()
 }
 
-var defaultDialFunction = func(addr string) (redigo.Conn, error) {
-	timeout := 500 * time.Millisecond
-	c, err := redigo.DialTimeout("tcp", addr, timeout, timeout, timeout)
-	if err != nil {
-		return nil, err
+// the sentinel requiring the password of its own, which differs from the one of the master, is
+// authenticated on connecting
+func sentinelDialFunction(password string) func(addr string) (redigo.Conn, error) {
+	return func(addr string) (redigo.Conn, error) {
+		timeout := 500 * time.Millisecond
+		c, err := dialConn(&net.Dialer{Timeout: timeout}, addr, nil)
+		if err != nil {
+			return nil, err
+		}
+		conn := redigo.NewConn(c, timeout, timeout)
+		if password != "" {
+			if _, err := conn.Do("auth", password); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("auth sentinel[%v] failed: %v", addr, err)
+			}
+		}
+		return conn, nil
 	}
-	return c, nil
 }
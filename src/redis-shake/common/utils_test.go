@@ -4,9 +4,40 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"pkg/libs/atomic2"
+	"pkg/libs/io/pipe"
+	"pkg/rdb"
+	"pkg/redis"
+	"redis-shake/configure"
+	"redis-shake/filter"
+
+	redigo "github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -100,4 +131,4395 @@ func TestCompareVersion(t *testing.T) {
 		assert.Equal(t, 0, CompareVersion("1.4.x", "1.4", 0), "should be equal")
 		assert.Equal(t, 2, CompareVersion("2.4", "1.1", 2), "should be equal")
 	}
-}
\ No newline at end of file
+}
+
+func TestCheckRdbVersion(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestCheckRdbVersion case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, int64(9), RedisRdbVersion("5.0.7"), "should be equal")
+		assert.Equal(t, int64(9), RedisRdbVersion("6"), "should be equal")
+		assert.Equal(t, int64(10), RedisRdbVersion("7.0.15"), "should be equal")
+		assert.Equal(t, int64(11), RedisRdbVersion("7.2.4"), "should be equal")
+		assert.Equal(t, int64(12), RedisRdbVersion("7.4"), "should be equal")
+		assert.Equal(t, int64(8), RedisRdbVersion("4.0.14"), "should be equal")
+		assert.Equal(t, int64(7), RedisRdbVersion("3.2.12"), "should be equal")
+		assert.Equal(t, int64(6), RedisRdbVersion("3.0"), "should be equal")
+		assert.Equal(t, int64(5), RedisRdbVersion("2.4"), "should be equal")
+		assert.Equal(t, int64(0), RedisRdbVersion("x.y"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckRdbVersion case %d.\n", nr)
+		nr++
+
+		// compatible
+		rewrite, err := CheckRdbVersion(8, "5.0.7", conf.VersionMismatchAbort)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, false, rewrite, "should be equal")
+
+		// unknown target version
+		rewrite, err = CheckRdbVersion(9, "unknown", conf.VersionMismatchAbort)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, false, rewrite, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckRdbVersion case %d.\n", nr)
+		nr++
+
+		// mismatch
+		rewrite, err := CheckRdbVersion(9, "4.0.14", conf.VersionMismatchAbort)
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Equal(t, false, rewrite, "should be equal")
+
+		rewrite, err = CheckRdbVersion(9, "4.0.14", conf.VersionMismatchRewrite)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, rewrite, "should be equal")
+	}
+}
+
+func TestDBMap(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestDBMap case %d.\n", nr)
+		nr++
+
+		mp, err := ParseDBMap("0:5,1:6")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[int]int{0: 5, 1: 6}, mp, "should be equal")
+
+		mp, err = ParseDBMap("0:5;1:6; 2:0")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[int]int{0: 5, 1: 6, 2: 0}, mp, "should be equal")
+
+		_, err = ParseDBMap("0:5,0:6")
+		assert.NotEqual(t, nil, err, "should be equal")
+		_, err = ParseDBMap("0-5")
+		assert.NotEqual(t, nil, err, "should be equal")
+		_, err = ParseDBMap("a:5")
+		assert.NotEqual(t, nil, err, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDBMap case %d.\n", nr)
+		nr++
+
+		// db0 -> db5, db1 -> db6, others pass
+		conf.Options.TargetDB = -1
+		conf.Options.TargetDBMap = map[int]int{0: 5, 1: 6}
+		conf.Options.TargetDBMapPolicy = conf.DBMapPolicyPass
+		db, pass := MapTargetDB(0)
+		assert.Equal(t, 5, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+		db, pass = MapTargetDB(1)
+		assert.Equal(t, 6, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+		db, pass = MapTargetDB(2)
+		assert.Equal(t, 2, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDBMap case %d.\n", nr)
+		nr++
+
+		// others dropped
+		conf.Options.TargetDBMapPolicy = conf.DBMapPolicyDrop
+		db, pass := MapTargetDB(1)
+		assert.Equal(t, 6, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+		_, pass = MapTargetDB(2)
+		assert.Equal(t, false, pass, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDBMap case %d.\n", nr)
+		nr++
+
+		// target.db
+		conf.Options.TargetDB = 3
+		conf.Options.TargetDBMap = nil
+		db, pass := MapTargetDB(1)
+		assert.Equal(t, 3, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+
+		conf.Options.TargetDB = -1
+		db, pass = MapTargetDB(1)
+		assert.Equal(t, 1, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+	}
+}
+
+func TestDisklessRdb(t *testing.T) {
+	mark := strings.Repeat("0123456789", 4)
+	rdb := "REDIS0009" + strings.Repeat("x", 20000) + "0123" // ends with the prefix of the mark
+	incr := "*1\r\n$4\r\nping\r\n"
+	input := "\n\n$EOF:" + mark + "\r\n" + rdb + mark + incr
+
+	var nr int
+	{
+		fmt.Printf("TestDisklessRdb case %d.\n", nr)
+		nr++
+
+		r := strings.NewReader(input)
+		wait := waitRdbDump(r)
+		assert.Equal(t, RdbSize{}, <-wait, "should be equal")
+		assert.Equal(t, RdbSize{}, <-wait, "should be equal")
+		size := <-wait
+		assert.Equal(t, int64(RdbSizeUnknown), size.Size, "should be equal")
+		assert.Equal(t, []byte(mark), size.EOFMark, "should be equal")
+
+		var w bytes.Buffer
+		rdbSize, rest := CopyRdbUntilEOFMark(r, &w, size.EOFMark, nil)
+		assert.Equal(t, int64(len(rdb)), rdbSize, "should be equal")
+		// the increment is returned instead of being written
+		assert.Equal(t, incr, string(rest), "should be equal")
+		assert.Equal(t, rdb, w.String(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDisklessRdb case %d.\n", nr)
+		nr++
+
+		// read one byte every time
+		var w bytes.Buffer
+		var nread atomic2.Int64
+		r := iotest.OneByteReader(strings.NewReader(rdb + mark + incr))
+		rdbSize, rest := CopyRdbUntilEOFMark(r, &w, []byte(mark), &nread)
+		assert.Equal(t, int64(len(rdb)), rdbSize, "should be equal")
+		assert.Equal(t, int64(len(rdb)), nread.Get(), "should be equal")
+		assert.Equal(t, 0, len(rest), "should be equal")
+		assert.Equal(t, rdb, w.String(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDisklessRdb case %d.\n", nr)
+		nr++
+
+		// fixed size
+		r := strings.NewReader("$1024\r\n")
+		assert.Equal(t, RdbSize{Size: 1024}, <-waitRdbDump(r), "should be equal")
+	}
+}
+
+func TestGroupRdbEntryByDB(t *testing.T) {
+	// the number of SELECT needed by one writer
+	countSelect := func(output chan *rdb.BinEntry) (int, map[uint32][]string) {
+		var count int
+		var lastdb uint32
+		keys := make(map[uint32][]string)
+		for e := range output {
+			if e.DB != lastdb {
+				count++
+				lastdb = e.DB
+			}
+			keys[e.DB] = append(keys[e.DB], string(e.Key))
+		}
+		return count, keys
+	}
+	// alternating db: 0, 1, 0, 1 ...
+	alternate := func(n int) chan *rdb.BinEntry {
+		input := make(chan *rdb.BinEntry, n)
+		for i := 0; i < n; i++ {
+			input <- &rdb.BinEntry{DB: uint32(i % 2), Key: []byte(fmt.Sprintf("k%02d", i)), Value: []byte("v")}
+		}
+		close(input)
+		return input
+	}
+	expectKeys := map[uint32][]string{
+		0: {"k00", "k02", "k04", "k06", "k08", "k10", "k12", "k14", "k16", "k18"},
+		1: {"k01", "k03", "k05", "k07", "k09", "k11", "k13", "k15", "k17", "k19"},
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestGroupRdbEntryByDB case %d.\n", nr)
+		nr++
+
+		// without group
+		count, keys := countSelect(alternate(20))
+		assert.Equal(t, 19, count, "should be equal")
+		assert.Equal(t, expectKeys, keys, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestGroupRdbEntryByDB case %d.\n", nr)
+		nr++
+
+		// buffer all entries
+		count, keys := countSelect(GroupRdbEntryByDB(alternate(20), 1024, 10))
+		assert.Equal(t, 1, count, "should be equal")
+		assert.Equal(t, expectKeys, keys, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestGroupRdbEntryByDB case %d.\n", nr)
+		nr++
+
+		// buffer 4 entries(4 bytes each): [0 0 1 1] [1 1 0 0] [0 0 1 1] ...
+		count, keys := countSelect(GroupRdbEntryByDB(alternate(20), 16, 10))
+		assert.Equal(t, 5, count, "should be equal")
+		assert.Equal(t, expectKeys, keys, "should be equal")
+	}
+}
+
+// token changes on every call
+type rotatingTokenProvider struct {
+	n int
+}
+
+func (p *rotatingTokenProvider) Token() (string, error) {
+	p.n++
+	return fmt.Sprintf("token-%d", p.n), nil
+}
+
+// the token expiring, the connection is authenticated again every 10 minutes
+type expiringTokenProvider struct {
+	rotatingTokenProvider
+}
+
+func (p *expiringTokenProvider) ReauthInterval() time.Duration {
+	return 10 * time.Minute
+}
+
+// fake server which records the password of every AUTH, "user password" for the user of ACL
+func startFakeAuthServer(t *testing.T, passwords chan string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				resp, err := redis.Decode(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				_, args, err := redis.ParseArgs(resp)
+				if err != nil || len(args) == 0 || len(args) > 2 {
+					return
+				}
+				passwords <- string(bytes.Join(args, []byte(" ")))
+				conn.Write([]byte("+OK\r\n"))
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestAuthTokenProvider(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// reconnect uses the fresh token
+		passwords := make(chan string, 4)
+		l := startFakeAuthServer(t, passwords)
+		defer l.Close()
+
+		provider := new(rotatingTokenProvider)
+		for i := 1; i <= 2; i++ {
+			c := OpenNetConnSoft(l.Addr().String(), "auth", FetchAuthToken(provider, "static"), nil)
+			assert.NotEqual(t, nil, c, "should be equal")
+			assert.Equal(t, fmt.Sprintf("token-%d", i), <-passwords, "should be equal")
+			c.Close()
+		}
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// nil provider or failed provider returns the given password
+		assert.Equal(t, "static", FetchAuthToken(nil, "static"), "should be equal")
+		provider, err := NewAuthTokenProvider("file:/not/exist/token")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "static", FetchAuthToken(provider, "static"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// file provider reads the rotated file
+		f, err := ioutil.TempFile("", "token")
+		assert.Equal(t, nil, err, "should be equal")
+		f.Close()
+		defer os.Remove(f.Name())
+
+		provider, err := NewAuthTokenProvider("file:" + f.Name())
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, ioutil.WriteFile(f.Name(), []byte("aaa\n"), 0644), "should be equal")
+		assert.Equal(t, "aaa", FetchAuthToken(provider, ""), "should be equal")
+		assert.Equal(t, nil, ioutil.WriteFile(f.Name(), []byte("bbb\n"), 0644), "should be equal")
+		assert.Equal(t, "bbb", FetchAuthToken(provider, ""), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		provider, err := NewAuthTokenProvider("command:echo abc")
+		assert.Equal(t, nil, err, "should be equal")
+		token, err := provider.Token()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "abc", token, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		provider, err := NewAuthTokenProvider("")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, provider, "should be equal")
+
+		_, err = NewAuthTokenProvider("file")
+		assert.NotEqual(t, nil, err, "should be equal")
+		_, err = NewAuthTokenProvider("unknown:abc")
+		assert.NotEqual(t, nil, err, "should be equal")
+		_, err = NewAuthTokenProvider("elasticache:us-east-1:cache")
+		assert.NotEqual(t, nil, err, "should be equal")
+		_, err = NewAuthTokenProvider("elasticache:us-east-1::user")
+		assert.NotEqual(t, nil, err, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// the example of deriving the signing key in the document of SigV4
+		assert.Equal(t, "c4afb1cc5771d871763a393e44b703571b55cc28424d1a5e86da6ed3c154a4b9",
+			fmt.Sprintf("%x", awsSigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20150830", "us-east-1", "iam")),
+			"should be equal")
+		assert.Equal(t, "a=1%202&b=%2A~&c=x%2Fy", awsCanonicalQuery(map[string][]string{
+			"c": {"x/y"}, "a": {"1 2"}, "b": {"*~"}}), "should be equal")
+		// only the unreserved characters of rfc3986 are kept
+		assert.Equal(t, "-._~az09%20%2B%2F%3D%25%C3%A9", awsEscape("-._~az09 +/=%é"), "should be equal")
+
+		// post-vanilla of the test suite of SigV4
+		req, err := http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+		assert.Equal(t, nil, err, "should be equal")
+		signAWSRequest(req, "example.amazonaws.com", nil, &awsCredentials{AccessKeyId: "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, "us-east-1", "service",
+			time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+		assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"), "should be equal")
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+			req.Header.Get("Authorization"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// the token of elasticache is signed by the credentials in the environment
+		os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		os.Setenv("AWS_SESSION_TOKEN", "session/token")
+		defer func() {
+			os.Unsetenv("AWS_ACCESS_KEY_ID")
+			os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+			os.Unsetenv("AWS_SESSION_TOKEN")
+		}()
+		provider, err := NewAuthTokenProvider("elasticache:us-east-1:My-Cache:shake:serverless")
+		assert.Equal(t, nil, err, "should be equal")
+		provider.(*elastiCacheTokenProvider).now = func() time.Time {
+			return time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+		}
+		token, err := provider.Token()
+		assert.Equal(t, nil, err, "should be equal")
+		args := AuthArgs(token)
+		assert.Equal(t, 2, len(args), "should be equal")
+		assert.Equal(t, "shake", args[0], "should be equal")
+		signed := "my-cache/?Action=connect&ResourceType=ServerlessCache&User=shake&X-Amz-Algorithm=AWS4-HMAC-SHA256" +
+			"&X-Amz-Credential=AKIDEXAMPLE%2F20240506%2Fus-east-1%2Felasticache%2Faws4_request" +
+			"&X-Amz-Date=20240506T070809Z&X-Amz-Expires=900&X-Amz-Security-Token=session%2Ftoken" +
+			"&X-Amz-SignedHeaders=host&X-Amz-Signature="
+		password := args[1].(string)
+		assert.Equal(t, signed, password[:len(signed)], "should be equal")
+		assert.Equal(t, 64, len(password)-len(signed), "should be equal")
+
+		// the user and the token are sent by AUTH
+		passwords := make(chan string, 1)
+		l := startFakeAuthServer(t, passwords)
+		defer l.Close()
+		c := OpenNetConnSoft(l.Addr().String(), "auth", token, nil)
+		assert.NotEqual(t, nil, c, "should be not equal")
+		assert.Equal(t, "shake "+password, <-passwords, "should be equal")
+		c.Close()
+		assert.Equal(t, []interface{}{"abc"}, AuthArgs("abc"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// the credentials of the role are fetched from the metadata service by IMDSv2, and cached
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		os.Unsetenv("AWS_SESSION_TOKEN")
+		var fetched int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+				w.Write([]byte("imds-token"))
+			case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+				w.WriteHeader(http.StatusUnauthorized)
+			case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+				w.Write([]byte("shake-role\n"))
+			case r.URL.Path == "/latest/meta-data/iam/security-credentials/shake-role":
+				fetched++
+				fmt.Fprintf(w, `{"AccessKeyId":"ASIAROLE","SecretAccessKey":"s","Token":"t","Expiration":"%s"}`,
+					time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+		oldEndpoint := awsMetadataEndpoint
+		awsMetadataEndpoint = server.URL
+		defer func() {
+			awsMetadataEndpoint = oldEndpoint
+		}()
+
+		provider, err := NewAuthTokenProvider("elasticache:eu-west-1:cache:shake")
+		assert.Equal(t, nil, err, "should be equal")
+		for i := 0; i < 2; i++ {
+			token, err := provider.Token()
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, true, strings.Contains(token, "X-Amz-Credential=ASIAROLE%2F"), "should be equal")
+			assert.Equal(t, true, strings.Contains(token, "X-Amz-Security-Token=t&"), "should be equal")
+		}
+		assert.Equal(t, 1, fetched, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthTokenProvider case %d.\n", nr)
+		nr++
+
+		// the connection kept open is authenticated again by the new token once the interval passes,
+		// but not in the middle of the pipeline
+		commands := make(chan string, 16)
+		l := startFakeRestoreTarget(t, commands, true)
+		defer l.Close()
+		nc, err := redigo.Dial("tcp", l.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer nc.Close()
+
+		assert.Equal(t, 10*time.Minute, ReauthInterval(&elastiCacheTokenProvider{}), "should be equal")
+		assert.Equal(t, time.Duration(0), ReauthInterval(new(rotatingTokenProvider)), "should be equal")
+		assert.Equal(t, nc, ReauthRedisConn(nc, "auth", new(rotatingTokenProvider), ""), "should be equal")
+
+		c := ReauthRedisConn(nc, "auth", new(expiringTokenProvider), "static").(*reauthConn)
+		now := time.Now()
+		c.now = func() time.Time {
+			return now
+		}
+		_, err = c.Do("ping")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "ping", <-commands, "should be equal")
+
+		now = now.Add(11 * time.Minute)
+		assert.Equal(t, nil, c.Send("set", "a", "1"), "should be equal")
+		now = now.Add(11 * time.Minute)
+		assert.Equal(t, nil, c.Send("set", "b", "2"), "should be equal")
+		_, err = c.Do("")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "auth token-1", <-commands, "should be equal")
+		assert.Equal(t, "set a 1", <-commands, "should be equal")
+		assert.Equal(t, "set b 2", <-commands, "should be equal")
+
+		_, err = c.Do("ping")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "auth token-2", <-commands, "should be equal")
+		assert.Equal(t, "ping", <-commands, "should be equal")
+	}
+}
+
+// unset the environment variables, the previous values are restored by the function returned
+func clearEnv(keys ...string) func() {
+	old := make(map[string]string)
+	for _, k := range keys {
+		if v, ok := os.LookupEnv(k); ok {
+			old[k] = v
+		}
+		os.Unsetenv(k)
+	}
+	return func() {
+		for _, k := range keys {
+			if v, ok := old[k]; ok {
+				os.Setenv(k, v)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	// test the secrets referenced of vault and aws secrets manager
+	old := conf.Options
+	oldEndpoint := awsSecretsManagerEndpoint
+	restoreEnv := clearEnv("VAULT_ADDR", "VAULT_TOKEN", "VAULT_NAMESPACE", "AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_REGION", "AWS_DEFAULT_REGION")
+	defer func() {
+		conf.Options = old
+		awsSecretsManagerEndpoint = oldEndpoint
+		restoreEnv()
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestSecrets case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, true, IsSecretRef("vault://secret/data/redis#password"), "should be equal")
+		assert.Equal(t, true, IsSecretRef("awssm://prod/redis"), "should be equal")
+		assert.Equal(t, false, IsSecretRef("123456"), "should be equal")
+		assert.Equal(t, false, IsSecretRef("file:/tmp/token"), "should be equal")
+
+		ref, err := parseSecretRef("awssm://arn:aws:secretsmanager:us-east-1:1:secret:redis#a#b")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, secretRef{SecretSecretsManager, "arn:aws:secretsmanager:us-east-1:1:secret:redis#a", "b"}, *ref,
+			"should be equal")
+		// the field of vault is required
+		_, err = parseSecretRef("vault://secret/data/redis")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = parseSecretRef("awssm://#password")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = parseSecretRef("kms://key")
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestSecrets case %d.\n", nr)
+		nr++
+
+		// the kv v2 and v1 engines of vault
+		var reads int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reads++
+			switch {
+			case r.Header.Get("X-Vault-Token") != "root":
+				w.WriteHeader(http.StatusForbidden)
+			case r.URL.Path == "/v1/secret/data/redis":
+				w.Write([]byte(`{"data":{"data":{"password":"v2pass","port":6379},"metadata":{"version":3}}}`))
+			case r.URL.Path == "/v1/kv/redis":
+				w.Write([]byte(`{"data":{"password":"v1pass"}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		_, err := FetchSecret("vault://secret/data/redis#password")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		os.Setenv("VAULT_ADDR", server.URL+"/")
+		os.Setenv("VAULT_TOKEN", "root")
+
+		value, err := FetchSecret("vault://secret/data/redis#password")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "v2pass", value, "should be equal")
+		value, err = FetchSecret("vault:///kv/redis#password")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "v1pass", value, "should be equal")
+		content, err := readTLSFile("vault://kv/redis#password")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []byte("v1pass"), content, "should be equal")
+		// not a string, not found
+		_, err = FetchSecret("vault://secret/data/redis#port")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = FetchSecret("vault://secret/data/redis#user")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = FetchSecret("vault://secret/data/other#password")
+		assert.NotEqual(t, nil, err, "should be not equal")
+
+		// the auth provider caches the secret for secrets.refresh_sec
+		conf.Options.SecretsRefreshSec = 60
+		provider, err := NewAuthTokenProvider("vault://secret/data/redis#password")
+		assert.Equal(t, nil, err, "should be equal")
+		now := time.Unix(1000, 0)
+		provider.(*secretTokenProvider).now = func() time.Time { return now }
+		reads = 0
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, "v2pass", FetchAuthToken(provider, ""), "should be equal")
+		}
+		assert.Equal(t, 1, reads, "should be equal")
+		now = now.Add(time.Minute)
+		assert.Equal(t, "v2pass", FetchAuthToken(provider, ""), "should be equal")
+		assert.Equal(t, 2, reads, "should be equal")
+
+		// the password of the job keeps the reference, which is fetched by AUTH
+		ref := "vault://secret/data/redis#password"
+		defer secretPasswords.Delete(ref)
+		conf.Options.SecretsRefreshSec = 0
+		assert.Equal(t, ref, FetchAuthToken(provider, ref), "should be equal")
+		assert.Equal(t, []interface{}{"v2pass"}, AuthArgs(ref), "should be equal")
+		value, err = SecretPassword("123456")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "123456", value, "should be equal")
+		reads = 0
+		value, err = SecretPassword(ref)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "v2pass", value, "should be equal")
+		assert.Equal(t, 1, reads, "should be equal")
+		// the previous one is used if vault fails
+		os.Setenv("VAULT_TOKEN", "expired")
+		value, err = SecretPassword(ref)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "v2pass", value, "should be equal")
+		assert.Equal(t, 2, reads, "should be equal")
+		_, err = SecretPassword("vault://secret/data/other#password")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		os.Setenv("VAULT_TOKEN", "root")
+	}
+
+	{
+		fmt.Printf("TestSecrets case %d.\n", nr)
+		nr++
+
+		// GetSecretValue of aws secrets manager signed by the credentials
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			auth := r.Header.Get("Authorization")
+			switch {
+			case r.Method != "POST" || r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue":
+				w.WriteHeader(http.StatusBadRequest)
+			case !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+				!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request, SignedHeaders="+
+					"content-type;host;x-amz-date;x-amz-target, Signature="):
+				w.WriteHeader(http.StatusForbidden)
+			case string(body) == `{"SecretId":"prod/redis"}`:
+				w.Write([]byte(`{"Name":"prod/redis","SecretString":"{\"password\":\"smpass\"}"}`))
+			case string(body) == `{"SecretId":"plain"}`:
+				w.Write([]byte(`{"Name":"plain","SecretString":"raw"}`))
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"ResourceNotFoundException"}`))
+			}
+		}))
+		defer server.Close()
+		awsSecretsManagerEndpoint = func(region string) string {
+			assert.Equal(t, "eu-west-1", region, "should be equal")
+			return server.URL
+		}
+		os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+		// the region is unknown
+		_, err := FetchSecret("awssm://prod/redis#password")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		os.Setenv("AWS_REGION", "eu-west-1")
+
+		value, err := FetchSecret("awssm://prod/redis#password")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "smpass", value, "should be equal")
+		value, err = FetchSecret("awssm://plain")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "raw", value, "should be equal")
+		// not a json object, or not found
+		_, err = FetchSecret("awssm://plain#password")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = FetchSecret("awssm://other")
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+}
+
+func TestNotifyFullSyncEvent(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestNotifyFullSyncEvent case %d.\n", nr)
+		nr++
+
+		bodyChan := make(chan []byte, 4)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodyChan <- body
+		}))
+		defer server.Close()
+
+		f, err := ioutil.TempFile("", "marker")
+		assert.Equal(t, nil, err, "should be equal")
+		f.Close()
+		os.Remove(f.Name())
+		defer os.Remove(f.Name())
+
+		conf.Options.Id = "test-id"
+		conf.Options.FullSyncDoneWebhook = server.URL
+		conf.Options.FullSyncDoneMarker = f.Name()
+		NotifyFullSyncEvent(&FullSyncEvent{
+			Event:     FullSyncEventSyncerDone,
+			Syncer:    0,
+			Source:    "127.0.0.1:6379",
+			Entry:     100,
+			Ignore:    2,
+			ElapsedMs: 30,
+		})
+		NotifyFullSyncEvent(&FullSyncEvent{
+			Event:  FullSyncEventAllDone,
+			Syncer: -1,
+			Entry:  100,
+			Ignore: 2,
+		})
+
+		var event FullSyncEvent
+		assert.Equal(t, nil, json.Unmarshal(<-bodyChan, &event), "should be equal")
+		assert.Equal(t, FullSyncEventSyncerDone, event.Event, "should be equal")
+		assert.Equal(t, "test-id", event.Id, "should be equal")
+		assert.Equal(t, 0, event.Syncer, "should be equal")
+		assert.Equal(t, "127.0.0.1:6379", event.Source, "should be equal")
+		assert.Equal(t, int64(100), event.Entry, "should be equal")
+		assert.Equal(t, int64(2), event.Ignore, "should be equal")
+		assert.Equal(t, int64(30), event.ElapsedMs, "should be equal")
+		assert.NotEqual(t, int64(0), event.Ts, "should be equal")
+
+		assert.Equal(t, nil, json.Unmarshal(<-bodyChan, &event), "should be equal")
+		assert.Equal(t, FullSyncEventAllDone, event.Event, "should be equal")
+		assert.Equal(t, -1, event.Syncer, "should be equal")
+
+		// the marker is written before the webhook
+		content, err := ioutil.ReadFile(f.Name())
+		assert.Equal(t, nil, err, "should be equal")
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		assert.Equal(t, 2, len(lines), "should be equal")
+		assert.Equal(t, nil, json.Unmarshal([]byte(lines[1]), &event), "should be equal")
+		assert.Equal(t, FullSyncEventAllDone, event.Event, "should be equal")
+
+		conf.Options.FullSyncDoneWebhook = ""
+		conf.Options.FullSyncDoneMarker = ""
+	}
+}
+
+// count the bytes written
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return c.w.Write(p)
+}
+
+func TestCompressSockFile(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestCompressSockFile case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, nil, CheckCompressType(""), "should be equal")
+		assert.Equal(t, nil, CheckCompressType(conf.CompressGzip), "should be equal")
+		assert.NotEqual(t, nil, CheckCompressType("lz4"), "should be equal")
+		assert.NotEqual(t, nil, CheckCompressType("zip"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCompressSockFile case %d.\n", nr)
+		nr++
+
+		f, err := ioutil.TempFile("", "sock")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		data := bytes.Repeat([]byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"), 10000)
+		r, w := pipe.NewFilePipe(1024*1024, f)
+		cnt := &countWriter{w: w}
+		go func() {
+			defer w.Close()
+			cw := NewCompressWriter(cnt, conf.CompressGzip)
+			defer cw.Close()
+			src := bytes.NewReader(data)
+			p := make([]byte, 4096)
+			for rest := len(data); rest != 0; {
+				rest -= Iocopy(src, cw, p, rest)
+			}
+		}()
+
+		// the pipe returns a traced EOF once closed, so read the exact length
+		output := make([]byte, len(data))
+		_, err = io.ReadFull(NewDecompressReader(r, conf.CompressGzip), output)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, data, output, "should be equal")
+		assert.Equal(t, true, cnt.n < len(data)/10, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCompressSockFile case %d.\n", nr)
+		nr++
+
+		// no compression
+		var b bytes.Buffer
+		cw := NewCompressWriter(&b, "")
+		cw.Write([]byte("abc"))
+		assert.Equal(t, nil, cw.Close(), "should be equal")
+		output, err := ioutil.ReadAll(NewDecompressReader(&b, ""))
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "abc", string(output), "should be equal")
+	}
+}
+
+func TestResp3Conn(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestResp3Conn case %d.\n", nr)
+		nr++
+
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go io.Copy(ioutil.Discard, server)
+		go server.Write([]byte("+OK\r\n" +
+			">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$1\r\nx\r\n" +
+			"+OK\r\n" +
+			">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nkey\r\n" +
+			">2\r\n$10\r\ninvalidate\r\n_\r\n" +
+			":5\r\n" +
+			"|1\r\n+ttl\r\n:3600\r\n$1\r\nv\r\n" +
+			"-ERR wrong\r\n" +
+			"%1\r\n+proto\r\n:3\r\n" +
+			",1.5\r\n(3492890328409238509324850943850943825024385\r\n#t\r\n_\r\n=7\r\ntxt:abc\r\n"))
+
+		c := NewResp3Conn(client, time.Second, time.Second)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, nil, c.Send("set", "a", 1), "should be equal")
+		}
+		assert.Equal(t, nil, c.Flush(), "should be equal")
+
+		reply, err := c.Receive()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		reply, err = c.Receive()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		assert.Equal(t, int64(1), c.PushCount(), "should be equal")
+
+		reply, err = c.Receive()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(5), reply, "should be equal")
+		assert.Equal(t, int64(3), c.PushCount(), "should be equal")
+
+		// attribute is dropped
+		reply, err = c.Receive()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []byte("v"), reply, "should be equal")
+
+		_, err = c.Receive()
+		assert.Equal(t, redigo.Error("ERR wrong"), err, "should be equal")
+
+		reply, err = c.Receive()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []interface{}{"proto", int64(3)}, reply, "should be equal")
+
+		expect := []interface{}{[]byte("1.5"), []byte("3492890328409238509324850943850943825024385"),
+			int64(1), nil, []byte("abc")}
+		for _, e := range expect {
+			reply, err = c.Receive()
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, e, reply, "should be equal")
+		}
+		assert.Equal(t, nil, c.Err(), "should be equal")
+	}
+
+	negotiate := func(replies string) (redigo.Conn, error) {
+		client, server := net.Pipe()
+		go io.Copy(ioutil.Discard, server)
+		go server.Write([]byte(replies))
+		return NegotiateResp3("target", client, time.Second, time.Second)
+	}
+
+	{
+		fmt.Printf("TestResp3Conn case %d.\n", nr)
+		nr++
+
+		// switched to RESP3
+		c, err := negotiate("%2\r\n$6\r\nserver\r\n$5\r\nredis\r\n$5\r\nproto\r\n:3\r\n>2\r\n+invalidate\r\n_\r\n" +
+			"+OK\r\n")
+		assert.Equal(t, nil, err, "should be equal")
+		_, ok := c.(*Resp3Conn)
+		assert.Equal(t, true, ok, "should be equal")
+		reply, err := c.Do("set", "a", 1)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		c.Close()
+	}
+
+	{
+		fmt.Printf("TestResp3Conn case %d.\n", nr)
+		nr++
+
+		// the server rejecting hello or RESP3 stays in RESP2
+		for _, rejected := range []string{
+			"-ERR unknown command 'hello', with args beginning with: '3'\r\n",
+			"-NOPROTO unsupported protocol version\r\n",
+		} {
+			c, err := negotiate(rejected + "+OK\r\n")
+			assert.Equal(t, nil, err, "should be equal")
+			_, ok := c.(*Resp3Conn)
+			assert.Equal(t, false, ok, "should be equal")
+			reply, err := c.Do("set", "a", 1)
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, "OK", reply, "should be equal")
+			c.Close()
+		}
+	}
+
+	{
+		fmt.Printf("TestResp3Conn case %d.\n", nr)
+		nr++
+
+		_, err := negotiate("%1\r\n$5\r\nproto\r\n:2\r\n")
+		assert.Equal(t, "protocol[2] is replied instead of 3", fmt.Sprint(err), "should be equal")
+		// the simple string key
+		_, err = negotiate("%1\r\n+proto\r\n:2\r\n")
+		assert.Equal(t, "protocol[2] is replied instead of 3", fmt.Sprint(err), "should be equal")
+		_, err = negotiate("-WRONGPASS invalid username-password pair\r\n")
+		assert.Equal(t, redigo.Error("WRONGPASS invalid username-password pair"), err, "should be equal")
+	}
+}
+
+func readAofFile(t *testing.T, name string) []string {
+	content, err := ioutil.ReadFile(name)
+	assert.Equal(t, nil, err, "should be equal")
+	br := bufio.NewReader(bytes.NewReader(content))
+	ret := make([]string, 0)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		}
+		resp, err := redis.Decode(br)
+		assert.Equal(t, nil, err, "should be equal")
+		cmd, args, err := redis.ParseArgs(resp)
+		assert.Equal(t, nil, err, "should be equal")
+		for _, arg := range args {
+			cmd += " " + string(arg)
+		}
+		ret = append(ret, cmd)
+	}
+	return ret
+}
+
+func TestAofWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	var nr int
+	{
+		fmt.Printf("TestAofWriter case %d.\n", nr)
+		nr++
+
+		name := dir + "/incr.0"
+		w := NewAofWriter(name, 0)
+		w.Write("SELECT", [][]byte{[]byte("1")})
+		w.Write("set", [][]byte{[]byte("a"), []byte("1")})
+		w.Write("del", [][]byte{[]byte("a")})
+		w.Close()
+
+		content, err := ioutil.ReadFile(name)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"+
+			"*2\r\n$3\r\ndel\r\n$1\r\na\r\n", string(content), "should be equal")
+		assert.Equal(t, []string{"select 1", "set a 1", "del a"}, readAofFile(t, name), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAofWriter case %d.\n", nr)
+		nr++
+
+		// rotate once the size exceeds 30 bytes, each command is 27 bytes
+		name := dir + "/incr.1"
+		w := NewAofWriter(name, 30)
+		for i := 0; i < 5; i++ {
+			w.Write("set", [][]byte{[]byte(fmt.Sprintf("%d", i)), []byte("v")})
+		}
+		w.Close()
+
+		assert.Equal(t, []string{"set 0 v", "set 1 v"}, readAofFile(t, name+".1"), "should be equal")
+		assert.Equal(t, []string{"set 2 v", "set 3 v"}, readAofFile(t, name+".2"), "should be equal")
+		assert.Equal(t, []string{"set 4 v"}, readAofFile(t, name), "should be equal")
+	}
+}
+
+// read one command from the source opened by OpenAofSource
+func readAofCommand(t *testing.T, br *bufio.Reader) string {
+	resp, err := redis.Decode(br)
+	assert.Equal(t, nil, err, "should be equal")
+	cmd, args, err := redis.ParseArgs(resp)
+	assert.Equal(t, nil, err, "should be equal")
+	for _, arg := range args {
+		cmd += " " + string(arg)
+	}
+	return cmd
+}
+
+func TestOpenAofSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("a"), 0, rdb.String("v")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	var empty bytes.Buffer
+	enc = rdb.NewEncoder(&empty)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	del := "*2\r\n$3\r\ndel\r\n$1\r\na\r\n"
+	appendFile := func(name, data string) {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		assert.Equal(t, nil, err, "should be equal")
+		_, err = f.WriteString(data)
+		assert.Equal(t, nil, err, "should be equal")
+		f.Close()
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestOpenAofSource case %d.\n", nr)
+		nr++
+
+		// the base rdb of the manifest, then the incr files are followed across the rewrite
+		sub := dir + "/manifest"
+		assert.Equal(t, nil, os.Mkdir(sub, 0755), "should be equal")
+		manifest := sub + "/appendonly.aof.manifest"
+		assert.Equal(t, nil, ioutil.WriteFile(sub+"/appendonly.aof.1.base.rdb", b.Bytes(), 0644), "should be equal")
+		appendFile(sub+"/appendonly.aof.1.incr.aof", "#TS:1628217470\r\n"+set)
+		appendFile(manifest, "file appendonly.aof.1.base.rdb seq 1 type b\n"+
+			"file appendonly.aof.1.incr.aof seq 1 type i\n")
+
+		input, size, err := OpenAofSource("", manifest, true)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(b.Len()), size, "should be equal")
+		br := bufio.NewReader(input)
+		p := make([]byte, b.Len())
+		_, err = io.ReadFull(br, p)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, b.Bytes(), p, "should be equal")
+		assert.Equal(t, "set a 1", readAofCommand(t, br), "should be equal")
+
+		appendFile(sub+"/appendonly.aof.1.incr.aof", "#TS:1628217471\r\n"+del)
+		assert.Equal(t, "del a", readAofCommand(t, br), "should be equal")
+
+		// rewritten, the rest of the old incr file is still read before the new one
+		appendFile(sub+"/appendonly.aof.1.incr.aof", set)
+		appendFile(sub+"/appendonly.aof.2.incr.aof", del)
+		assert.Equal(t, nil, ioutil.WriteFile(manifest+".tmp", []byte(
+			"file appendonly.aof.2.base.rdb seq 2 type b\n"+
+				"file appendonly.aof.1.base.rdb seq 1 type h\n"+
+				"file appendonly.aof.1.incr.aof seq 1 type h\n"+
+				"file appendonly.aof.2.incr.aof seq 2 type i\n"), 0644), "should be equal")
+		assert.Equal(t, nil, os.Rename(manifest+".tmp", manifest), "should be equal")
+		assert.Equal(t, "set a 1", readAofCommand(t, br), "should be equal")
+		assert.Equal(t, "del a", readAofCommand(t, br), "should be equal")
+
+		input.Close()
+		_, err = redis.Decode(br)
+		assert.NotEqual(t, nil, err, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestOpenAofSource case %d.\n", nr)
+		nr++
+
+		// the single aof with only the commands follows an empty rdb, the rewrite fails
+		name := dir + "/appendonly.aof"
+		appendFile(name, set)
+		input, size, err := OpenAofSource("", name, true)
+		assert.Equal(t, nil, err, "should be equal")
+		defer input.Close()
+		assert.Equal(t, int64(0), size, "should be equal")
+		br := bufio.NewReader(input)
+		p := make([]byte, empty.Len())
+		_, err = io.ReadFull(br, p)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, empty.Bytes(), p, "should be equal")
+		assert.Equal(t, "set a 1", readAofCommand(t, br), "should be equal")
+
+		appendFile(name+".tmp", b.String()+del)
+		assert.Equal(t, nil, os.Rename(name+".tmp", name), "should be equal")
+		_, err = redis.Decode(br)
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Equal(t, true, strings.Contains(err.Error(), "is rewritten"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestOpenAofSource case %d.\n", nr)
+		nr++
+
+		// the preamble is rejected if the rdb file is given
+		name := dir + "/preamble.aof"
+		appendFile(name, b.String()+set)
+		_, _, err := OpenAofSource(dir+"/manifest/appendonly.aof.1.base.rdb", name, true)
+		assert.NotEqual(t, nil, err, "should be equal")
+
+		// the incr file deleted by the rewrite before being read
+		sub := dir + "/missing"
+		assert.Equal(t, nil, os.Mkdir(sub, 0755), "should be equal")
+		manifest := sub + "/appendonly.aof.manifest"
+		appendFile(sub+"/appendonly.aof.1.incr.aof", set)
+		appendFile(manifest, "file appendonly.aof.1.incr.aof seq 1 type i\n")
+		input, _, err := OpenAofSource(dir+"/manifest/appendonly.aof.1.base.rdb", manifest, true)
+		assert.Equal(t, nil, err, "should be equal")
+		defer input.Close()
+		br := bufio.NewReader(input)
+		p := make([]byte, b.Len())
+		_, err = io.ReadFull(br, p)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "set a 1", readAofCommand(t, br), "should be equal")
+
+		assert.Equal(t, nil, ioutil.WriteFile(manifest, []byte("file appendonly.aof.3.incr.aof seq 3 type i\n"),
+			0644), "should be equal")
+		_, err = redis.Decode(br)
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Equal(t, true, strings.Contains(err.Error(), "is missing"), "should be equal")
+	}
+}
+
+// fake node which records the commands, "get" is always moved to the node itself
+func startFakeRedirectNode(t *testing.T, commands chan string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					commands <- strings.Join(strs, " ")
+					if cmd == "get" {
+						conn.Write([]byte("-MOVED 0 " + l.Addr().String() + "\r\n"))
+					} else {
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestRedirector(t *testing.T) {
+	commands := make(chan string, 16)
+	l := startFakeRedirectNode(t, commands)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	var nr int
+	{
+		fmt.Printf("TestRedirector case %d.\n", nr)
+		nr++
+
+		kind, node, ok := ParseRedirect(redigo.Error("MOVED 3999 127.0.0.1:6381"))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, RedirectMoved, kind, "should be equal")
+		assert.Equal(t, "127.0.0.1:6381", node, "should be equal")
+
+		kind, node, ok = ParseRedirect(redigo.Error("ASK 3999 127.0.0.1:6381"))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, RedirectAsk, kind, "should be equal")
+		assert.Equal(t, "127.0.0.1:6381", node, "should be equal")
+
+		_, _, ok = ParseRedirect(redigo.Error("ERR unknown command"))
+		assert.Equal(t, false, ok, "should be equal")
+		_, _, ok = ParseRedirect(io.EOF)
+		assert.Equal(t, false, ok, "should be equal")
+	}
+
+	r := NewRedirector("auth", "", time.Second, time.Second, nil)
+	defer r.Close()
+	args := [][]byte{[]byte("a"), []byte("1")}
+
+	{
+		fmt.Printf("TestRedirector case %d.\n", nr)
+		nr++
+
+		// MOVED, retry on the node
+		reply, err, handled := r.Redirect(redigo.Error("MOVED 15495 "+addr), "set", args)
+		assert.Equal(t, true, handled, "should be equal")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		assert.Equal(t, "set a 1", <-commands, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRedirector case %d.\n", nr)
+		nr++
+
+		// ASK, ASKING before the retry
+		reply, err, handled := r.Redirect(redigo.Error("ASK 15495 "+addr), "set", args)
+		assert.Equal(t, true, handled, "should be equal")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		assert.Equal(t, "asking", <-commands, "should be equal")
+		assert.Equal(t, "set a 1", <-commands, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRedirector case %d.\n", nr)
+		nr++
+
+		// not a redirection
+		origin := redigo.Error("ERR wrong type")
+		_, err, handled := r.Redirect(origin, "set", args)
+		assert.Equal(t, false, handled, "should be equal")
+		assert.Equal(t, origin, err, "should be equal")
+		assert.Equal(t, 0, len(commands), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRedirector case %d.\n", nr)
+		nr++
+
+		// redirected again and again
+		_, err, handled := r.Redirect(redigo.Error("MOVED 15495 "+addr), "get", [][]byte{[]byte("a")})
+		assert.Equal(t, true, handled, "should be equal")
+		_, _, ok := ParseRedirect(err)
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, redirectMaxDepth, len(commands), "should be equal")
+	}
+}
+
+// fake target which records the restore commands, IDLETIME and FREQ are rejected if !support
+func startFakeRestoreTarget(t *testing.T, commands chan string, support bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					commands <- strings.Join(strs, " ")
+					if !support && len(args) > 3 {
+						conn.Write([]byte("-ERR syntax error\r\n"))
+					} else {
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestRestoreIdleFreq(t *testing.T) {
+	conf.Options.BigKeyThreshold = 50 * MB
+	defer func() {
+		conf.Options.TargetPreserveIdleFreq = false
+		idleFreqRejected.Set(false)
+	}()
+
+	restore := func(l net.Listener, e *rdb.BinEntry) {
+		c, err := redigo.Dial("tcp", l.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+		RestoreRdbEntry(c, e, BigKeyThreshold(&conf.Options))
+	}
+
+	commands := make(chan string, 16)
+	l := startFakeRestoreTarget(t, commands, true)
+	defer l.Close()
+
+	var nr int
+	{
+		fmt.Printf("TestRestoreIdleFreq case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetPreserveIdleFreq = true
+		restore(l, &rdb.BinEntry{Key: []byte("a"), Value: []byte("v"), IdleTime: 100})
+		assert.Equal(t, "restore a 0 v IDLETIME 100", <-commands, "should be equal")
+
+		restore(l, &rdb.BinEntry{Key: []byte("b"), Value: []byte("v"), Freq: 8})
+		assert.Equal(t, "restore b 0 v FREQ 8", <-commands, "should be equal")
+
+		// nothing to preserve
+		restore(l, &rdb.BinEntry{Key: []byte("c"), Value: []byte("v")})
+		assert.Equal(t, "restore c 0 v", <-commands, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRestoreIdleFreq case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetPreserveIdleFreq = false
+		restore(l, &rdb.BinEntry{Key: []byte("a"), Value: []byte("v"), IdleTime: 100, Freq: 8})
+		assert.Equal(t, "restore a 0 v", <-commands, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRestoreIdleFreq case %d.\n", nr)
+		nr++
+
+		// the old target rejects them, retry without them and don't send them any more
+		old := startFakeRestoreTarget(t, commands, false)
+		defer old.Close()
+
+		conf.Options.TargetPreserveIdleFreq = true
+		restore(old, &rdb.BinEntry{Key: []byte("a"), Value: []byte("v"), IdleTime: 100})
+		assert.Equal(t, "restore a 0 v IDLETIME 100", <-commands, "should be equal")
+		assert.Equal(t, "restore a 0 v", <-commands, "should be equal")
+
+		restore(old, &rdb.BinEntry{Key: []byte("b"), Value: []byte("v"), Freq: 8})
+		assert.Equal(t, "restore b 0 v", <-commands, "should be equal")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var nr int
+	now := time.Unix(1000, 0)
+	cb := NewCircuitBreaker(50, 10)
+	cb.now = func() time.Time { return now }
+
+	{
+		fmt.Printf("TestCircuitBreaker case %d.\n", nr)
+		nr++
+
+		// too few replies to trip
+		for i := 0; i < breakerMinRequests-1; i++ {
+			assert.Equal(t, false, cb.Record(false), "should be equal")
+		}
+		assert.Equal(t, BreakerClosed, cb.State(), "should be equal")
+
+		// half of the replies fail, not exceeding the threshold
+		cb.Close()
+		for i := 0; i < 20; i++ {
+			assert.Equal(t, false, cb.Record(i%2 == 0), "should be equal")
+		}
+		assert.Equal(t, BreakerClosed, cb.State(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCircuitBreaker case %d.\n", nr)
+		nr++
+
+		// the failures exceed the threshold
+		tripped := 0
+		for i := 0; i < 10; i++ {
+			if cb.Record(false) {
+				tripped++
+			}
+		}
+		assert.Equal(t, 1, tripped, "should be equal")
+		assert.Equal(t, BreakerOpen, cb.State(), "should be equal")
+		assert.Equal(t, 1, cb.Trips(), "should be equal")
+
+		cb.Close()
+		assert.Equal(t, BreakerClosed, cb.State(), "should be equal")
+		assert.Equal(t, 1, cb.Trips(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCircuitBreaker case %d.\n", nr)
+		nr++
+
+		// the failures out of the window are dropped
+		for i := 0; i < 30; i++ {
+			cb.Record(false)
+		}
+		assert.Equal(t, 2, cb.Trips(), "should be equal")
+		cb.Close()
+		now = now.Add(5 * time.Second)
+		for i := 0; i < 15; i++ {
+			cb.Record(false)
+		}
+		now = now.Add(11 * time.Second)
+		for i := 0; i < 15; i++ {
+			assert.Equal(t, false, cb.Record(true), "should be equal")
+		}
+		assert.Equal(t, BreakerClosed, cb.State(), "should be equal")
+		// a whole window passes without tripping
+		assert.Equal(t, 0, cb.Trips(), "should be equal")
+	}
+}
+
+// fake target which replies the commands received together at once and records each batch,
+// RESTORE of "busy" fails unless REPLACE is given
+func startFakePipelineTarget(t *testing.T, batches chan []string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			commands := make(chan []string, 64)
+			go func(conn net.Conn) {
+				defer close(commands)
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					commands <- strs
+				}
+			}(conn)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for cmd := range commands {
+					batch := [][]string{cmd}
+				COLLECT:
+					for {
+						select {
+						case cmd, ok := <-commands:
+							if !ok {
+								break COLLECT
+							}
+							batch = append(batch, cmd)
+						case <-time.After(50 * time.Millisecond):
+							break COLLECT
+						}
+					}
+
+					var record []string
+					var b bytes.Buffer
+					for _, cmd := range batch {
+						record = append(record, strings.Join(cmd, " "))
+						if cmd[0] == "restore" && cmd[1] == "busy" && cmd[len(cmd)-1] != "REPLACE" {
+							b.WriteString("-BUSYKEY Target key name already exists\r\n")
+						} else {
+							b.WriteString("+OK\r\n")
+						}
+					}
+					batches <- record
+					if _, err := conn.Write(b.Bytes()); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestRestorePipeline(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.BigKeyThreshold = 50 * MB
+	conf.Options.Rewrite = true
+	conf.Options.TargetReplace = true
+
+	batches := make(chan []string, 16)
+	l := startFakePipelineTarget(t, batches)
+	defer l.Close()
+
+	var nr int
+	{
+		fmt.Printf("TestRestorePipeline case %d.\n", nr)
+		nr++
+
+		c, err := redigo.Dial("tcp", l.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+
+		p := NewRestorePipeline(c, 3, BigKeyThreshold(&conf.Options))
+		p.Select(1)
+		p.Restore(&rdb.BinEntry{Key: []byte("a"), Value: []byte("v")})
+		p.Restore(&rdb.BinEntry{Key: []byte("busy"), Value: []byte("v")})
+		p.Select(2)
+		// the batch is sent once 3 entries are buffered
+		p.Restore(&rdb.BinEntry{Key: []byte("b"), Value: []byte("v")})
+		assert.Equal(t, []string{"select 1", "restore a 0 v", "restore busy 0 v", "select 2", "restore b 0 v"},
+			<-batches, "should be equal")
+
+		// the failed one is restored again alone in its own db, then back to the current db
+		assert.Equal(t, []string{"select 1"}, <-batches, "should be equal")
+		assert.Equal(t, []string{"restore busy 0 v"}, <-batches, "should be equal")
+		assert.Equal(t, []string{"restore busy 0 v REPLACE"}, <-batches, "should be equal")
+		assert.Equal(t, []string{"select 2"}, <-batches, "should be equal")
+		assert.Equal(t, int64(2), p.Restored, "should be equal")
+		assert.Equal(t, int64(1), p.Retried, "should be equal")
+
+		p.Restore(&rdb.BinEntry{Key: []byte("c"), Value: []byte("v")})
+		p.Flush()
+		assert.Equal(t, []string{"restore c 0 v"}, <-batches, "should be equal")
+		assert.Equal(t, int64(3), p.Restored, "should be equal")
+
+		// nothing to send
+		p.Flush()
+		select {
+		case batch := <-batches:
+			t.Errorf("unexpected batch %v", batch)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestRestoreMaxBytes(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.BigKeyThreshold = 50 * MB
+
+	batches := make(chan []string, 16)
+	l := startFakePipelineTarget(t, batches)
+	defer l.Close()
+
+	var nr int
+	{
+		fmt.Printf("TestRestoreMaxBytes case %d.\n", nr)
+		nr++
+
+		// the smaller one of big_key_threshold and target.restore_max_bytes
+		assert.Equal(t, uint64(50*MB), BigKeyThreshold(&conf.Options), "should be equal")
+		conf.Options.TargetRestoreMaxBytes = 100 * MB
+		assert.Equal(t, uint64(50*MB), BigKeyThreshold(&conf.Options), "should be equal")
+		conf.Options.TargetRestoreMaxBytes = 4
+		assert.Equal(t, uint64(4), BigKeyThreshold(&conf.Options), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRestoreMaxBytes case %d.\n", nr)
+		nr++
+
+		// the string larger than the limit is written in chunks instead of one RESTORE
+		c, err := redigo.Dial("tcp", l.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+
+		RestoreRdbEntry(c, &rdb.BinEntry{Key: []byte("k"), Type: rdb.RdbTypeString,
+			Value: []byte("\x00\x0a0123456789")}, BigKeyThreshold(&conf.Options))
+		assert.Equal(t, []string{"set k 0123"}, <-batches, "should be equal")
+		assert.Equal(t, []string{"append k 4567"}, <-batches, "should be equal")
+		assert.Equal(t, []string{"append k 89"}, <-batches, "should be equal")
+	}
+}
+
+func TestAdjustTTL(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.TargetDefaultTTLSec = 60
+	conf.Options.BigKeyThreshold = 50 * MB
+
+	strs := func(args [][]byte) []string {
+		ret := make([]string, len(args))
+		for i := range args {
+			ret[i] = string(args[i])
+		}
+		return ret
+	}
+	bytesArgs := func(args ...string) [][]byte {
+		ret := make([][]byte, len(args))
+		for i := range args {
+			ret[i] = []byte(args[i])
+		}
+		return ret
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestAdjustTTL case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetTTLMode = conf.TTLModeSource
+		assert.Equal(t, uint64(0), AdjustTTL(0), "should be equal")
+		assert.Equal(t, uint64(1000), AdjustTTL(1000), "should be equal")
+		assert.Equal(t, []string{"k", "10"}, strs(AdjustExpireCommand("expire", bytesArgs("k", "10"))),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestAdjustTTL case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetTTLMode = conf.TTLModeOverride
+		assert.Equal(t, uint64(60000), AdjustTTL(0), "should be equal")
+		assert.Equal(t, uint64(60000), AdjustTTL(1000), "should be equal")
+		assert.Equal(t, uint64(60000), AdjustTTL(1000000), "should be equal")
+
+		assert.Equal(t, []string{"k", "60"}, strs(AdjustExpireCommand("expire", bytesArgs("k", "10"))),
+			"should be equal")
+		assert.Equal(t, []string{"k", "60000"}, strs(AdjustExpireCommand("PEXPIRE", bytesArgs("k", "10"))),
+			"should be equal")
+		assert.Equal(t, []string{"k", "60", "v"}, strs(AdjustExpireCommand("setex", bytesArgs("k", "10", "v"))),
+			"should be equal")
+		at := time.Now().Unix() + 10
+		ret := AdjustExpireCommand("expireat", bytesArgs("k", fmt.Sprint(at), "NX"))
+		v, err := strconv.ParseInt(string(ret[1]), 10, 64)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, v >= at+49 && v <= at+51, "should be equal")
+		assert.Equal(t, "NX", string(ret[2]), "should be equal")
+
+		// deleting the key and the other commands are kept
+		assert.Equal(t, []string{"k", "-1"}, strs(AdjustExpireCommand("expire", bytesArgs("k", "-1"))),
+			"should be equal")
+		assert.Equal(t, []string{"k", "10"}, strs(AdjustExpireCommand("set", bytesArgs("k", "10"))),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestAdjustTTL case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetTTLMode = conf.TTLModeMin
+		assert.Equal(t, uint64(60000), AdjustTTL(0), "should be equal")
+		assert.Equal(t, uint64(1000), AdjustTTL(1000), "should be equal")
+		assert.Equal(t, uint64(60000), AdjustTTL(1000000), "should be equal")
+		assert.Equal(t, []string{"k", "60"}, strs(AdjustExpireCommand("expire", bytesArgs("k", "100"))),
+			"should be equal")
+		assert.Equal(t, []string{"k", "10"}, strs(AdjustExpireCommand("expire", bytesArgs("k", "10"))),
+			"should be equal")
+
+		conf.Options.TargetTTLMode = conf.TTLModeMax
+		assert.Equal(t, uint64(0), AdjustTTL(0), "should be equal")
+		assert.Equal(t, uint64(60000), AdjustTTL(1000), "should be equal")
+		assert.Equal(t, uint64(1000000), AdjustTTL(1000000), "should be equal")
+		assert.Equal(t, []string{"k", "60000"}, strs(AdjustExpireCommand("psetex", bytesArgs("k", "10", "v")))[:2],
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestAdjustTTL case %d.\n", nr)
+		nr++
+
+		// the restored key without ttl gets the default one
+		commands := make(chan string, 16)
+		l := startFakeRestoreTarget(t, commands, true)
+		defer l.Close()
+		c, err := redigo.Dial("tcp", l.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+
+		conf.Options.TargetTTLMode = conf.TTLModeOverride
+		RestoreRdbEntry(c, &rdb.BinEntry{Key: []byte("a"), Value: []byte("v")}, BigKeyThreshold(&conf.Options))
+		assert.Equal(t, "restore a 60000 v", <-commands, "should be equal")
+
+		conf.Options.TargetTTLMode = conf.TTLModeMax
+		RestoreRdbEntry(c, &rdb.BinEntry{Key: []byte("b"), Value: []byte("v")}, BigKeyThreshold(&conf.Options))
+		assert.Equal(t, "restore b 0 v", <-commands, "should be equal")
+	}
+}
+
+func TestFilterRdbEntryBySize(t *testing.T) {
+	// test FilterRdbEntryBySize
+
+	var nr int
+	{
+		fmt.Printf("TestFilterRdbEntryBySize case %d.\n", nr)
+		nr++
+
+		part := func(key string, size int, real, tot uint32, first bool) *rdb.BinEntry {
+			e := &rdb.BinEntry{Key: []byte(key), Value: make([]byte, size), RealMemberCount: real,
+				TotMemberCount: tot}
+			if first {
+				e.NeedReadLen = 1
+			}
+			return e
+		}
+		input := make(chan *rdb.BinEntry, 16)
+		input <- part("small", 10, 0, 0, true)
+		input <- part("large", 200, 0, 0, true)
+		input <- &rdb.BinEntry{Type: rdb.RdbFlagAUX, Key: []byte("lua"), Value: make([]byte, 200), NeedReadLen: 1}
+		// split into 3 parts of 60 bytes, about 180 bytes in total
+		input <- part("split-large", 60, 10, 30, true)
+		input <- part("split-large", 60, 10, 0, false)
+		input <- part("split-large", 60, 10, 0, false)
+		// split into 2 parts of 40 bytes
+		input <- part("split-small", 40, 10, 20, true)
+		input <- part("split-small", 40, 10, 0, false)
+		input <- part("tail", 100, 0, 0, true)
+		close(input)
+
+		var dropped []string
+		var keys []string
+		for e := range FilterRdbEntryBySize(input, 100, 4, func(e *rdb.BinEntry, size uint64) {
+			dropped = append(dropped, fmt.Sprintf("%s:%d", e.Key, size))
+		}) {
+			keys = append(keys, string(e.Key))
+		}
+		assert.Equal(t, []string{"large:200", "split-large:180"}, dropped, "should be equal")
+		assert.Equal(t, []string{"small", "lua", "split-small", "split-small", "tail"}, keys, "should be equal")
+	}
+}
+
+func TestDropAudit(t *testing.T) {
+	// test DropAudit
+
+	var nr int
+	{
+		fmt.Printf("TestDropAudit case %d.\n", nr)
+		nr++
+
+		f, err := ioutil.TempFile("", "drop_audit")
+		assert.Equal(t, nil, err, "should be equal")
+		f.Close()
+		defer os.Remove(f.Name())
+
+		now := time.Unix(1000, 0)
+		a := NewDropAudit("test", f.Name(), 2)
+		a.now = func() time.Time { return now }
+		for i := 0; i < 5; i++ {
+			a.Record(DropReasonKey, 0, "", []byte(fmt.Sprintf("k%d", i)))
+		}
+		now = now.Add(time.Second)
+		a.Record(DropReasonDB, 1, "set", []byte("k5"))
+		a.Close()
+
+		data, err := ioutil.ReadFile(f.Name())
+		assert.Equal(t, nil, err, "should be equal")
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			lines = append(lines, strings.SplitN(line, " ", 3)[2])
+		}
+		assert.Equal(t, []string{
+			"test drop reason[key] db[0] key[k0]",
+			"test drop reason[key] db[0] key[k1]",
+			"test 3 dropped keys aren't logged in the last second",
+			"test drop reason[db] db[1] command[set] key[k5]",
+		}, lines, "should be equal")
+		assert.Equal(t, map[string]int64{"key": 5, "db": 1}, a.Counts(), "should be equal")
+		assert.Equal(t, "db=1 key=5", a.Summary(), "should be equal")
+	}
+}
+
+// fake redis which replies the given reply to the command, and OK to the others
+func startFakePreflightServer(t *testing.T, replies map[string]string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, _, _ := redis.ParseArgs(resp)
+					reply, ok := replies[cmd]
+					if !ok {
+						reply = "+OK\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestPreflightCheck(t *testing.T) {
+	// test PreflightCheck
+
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	master := bulk("# Replication\r\nrole:master\r\nconnected_slaves:0\r\n")
+	slave := bulk("# Replication\r\nrole:slave\r\nmaster_host:127.0.0.1\r\n")
+
+	var nr int
+	{
+		fmt.Printf("TestPreflightCheck case %d.\n", nr)
+		nr++
+
+		// all pass
+		l := startFakePreflightServer(t, map[string]string{"info": master, "del": ":1\r\n"})
+		defer l.Close()
+		assert.Equal(t, nil, PreflightCheck("target", l.Addr().String(), "auth", "pwd", nil, true, false),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestPreflightCheck case %d.\n", nr)
+		nr++
+
+		// auth failure
+		l := startFakePreflightServer(t, map[string]string{"auth": "-ERR invalid password\r\n", "info": master})
+		defer l.Close()
+		err := PreflightCheck("source", l.Addr().String(), "auth", "wrong", nil, false, false)
+		assert.Equal(t, fmt.Sprintf("source[%v] auth failed: ERR invalid password", l.Addr()), fmt.Sprint(err),
+			"should be equal")
+
+		// no password, no auth
+		assert.Equal(t, nil, PreflightCheck("source", l.Addr().String(), "auth", "", nil, false, false),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestPreflightCheck case %d.\n", nr)
+		nr++
+
+		// the replica
+		l := startFakePreflightServer(t, map[string]string{"info": slave})
+		defer l.Close()
+		err := PreflightCheck("target", l.Addr().String(), "auth", "", nil, true, true)
+		assert.Equal(t, fmt.Sprintf("target[%v] is a replica which isn't writable", l.Addr()), fmt.Sprint(err),
+			"should be equal")
+
+		// the source can be a replica
+		assert.Equal(t, nil, PreflightCheck("source", l.Addr().String(), "auth", "", nil, false, false),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestPreflightCheck case %d.\n", nr)
+		nr++
+
+		// the read-only target, e.g., the proxy of the replica
+		l := startFakePreflightServer(t, map[string]string{"info": bulk("# Server\r\n"),
+			"set": "-READONLY You can't write against a read only replica.\r\n"})
+		defer l.Close()
+		err := PreflightCheck("target", l.Addr().String(), "auth", "", nil, true, false)
+		assert.Equal(t, fmt.Sprintf("target[%v] is read-only: READONLY You can't write against a read only replica.",
+			l.Addr()), fmt.Sprint(err), "should be equal")
+
+		// nothing is written if write isn't needed
+		assert.Equal(t, nil, PreflightCheck("target", l.Addr().String(), "auth", "", nil, false, false),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestPreflightCheck case %d.\n", nr)
+		nr++
+
+		// connect failure
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err, "should be equal")
+		address := l.Addr().String()
+		l.Close()
+		err = PreflightCheck("target", address, "auth", "", nil, true, false)
+		assert.Equal(t, true, strings.HasPrefix(fmt.Sprint(err), fmt.Sprintf("target[%v] connect failed: ", address)),
+			"should be equal")
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	// test CheckSlotCoverage, CheckRdbCompatible, RdbFileVersion and SourceModules
+
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	slots := func(ranges ...[2]int) string {
+		s := fmt.Sprintf("*%d\r\n", len(ranges))
+		for _, r := range ranges {
+			s += fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n$9\r\n127.0.0.1\r\n:6379\r\n$2\r\nid\r\n", r[0], r[1])
+		}
+		return s
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestCheckCompatibility case %d.\n", nr)
+		nr++
+
+		// all the slots are served
+		l := startFakePreflightServer(t, map[string]string{"cluster": slots([2]int{0, 8191}, [2]int{8192, 16383})})
+		defer l.Close()
+		assert.Equal(t, nil, CheckSlotCoverage("target", l.Addr().String(), "auth", "", nil), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckCompatibility case %d.\n", nr)
+		nr++
+
+		// the slots not served are given as ranges
+		l := startFakePreflightServer(t, map[string]string{"cluster": slots([2]int{100, 5460}, [2]int{5462, 16382})})
+		defer l.Close()
+		err := CheckSlotCoverage("target", l.Addr().String(), "auth", "", nil)
+		assert.Equal(t, fmt.Sprintf("target[%v] cluster doesn't serve slots[0-99,5461,16383], assign them to the "+
+			"masters first", l.Addr()), fmt.Sprint(err), "should be equal")
+
+		// not a cluster
+		l2 := startFakePreflightServer(t, map[string]string{"cluster": "-ERR This instance has cluster support disabled\r\n"})
+		defer l2.Close()
+		err = CheckSlotCoverage("target", l2.Addr().String(), "auth", "", nil)
+		assert.Equal(t, fmt.Sprintf("target[%v] cluster slots failed: ERR This instance has cluster support disabled",
+			l2.Addr()), fmt.Sprint(err), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckCompatibility case %d.\n", nr)
+		nr++
+
+		// the rdb of redis 7.0 can't be decoded
+		_, err := CheckRdbCompatible("7.0.15", "7.0.15", conf.VersionMismatchRewrite)
+		assert.Equal(t, "source redis version[7.0.15] writes rdb version 10 whose encodings can't be decoded, "+
+			"only rdb version <= 9 is supported", fmt.Sprint(err), "should be equal")
+
+		// the target version is checked then
+		rewrite, err := CheckRdbCompatible("6.2.6", "7.0.15", conf.VersionMismatchAbort)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, false, rewrite, "should be equal")
+		rewrite, err = CheckRdbCompatible("5.0.7", "4.0.14", conf.VersionMismatchRewrite)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, rewrite, "should be equal")
+		_, err = CheckRdbCompatible("5.0.7", "4.0.14", conf.VersionMismatchAbort)
+		assert.NotEqual(t, nil, err, "should be not equal")
+
+		// unknown source version
+		rewrite, err = CheckRdbCompatible("", "4.0.14", conf.VersionMismatchAbort)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, false, rewrite, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckCompatibility case %d.\n", nr)
+		nr++
+
+		dir, err := ioutil.TempDir("", "rdb")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.RemoveAll(dir)
+
+		assert.Equal(t, nil, ioutil.WriteFile(dir+"/8.rdb", []byte("REDIS0008\xff"), 0644), "should be equal")
+		version, err := RdbFileVersion(dir + "/8.rdb")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(8), version, "should be equal")
+
+		// written by redis 7.0
+		assert.Equal(t, nil, ioutil.WriteFile(dir+"/10.rdb", []byte("REDIS0010\xff"), 0644), "should be equal")
+		_, err = RdbFileVersion(dir + "/10.rdb")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		assert.Equal(t, true, strings.HasPrefix(fmt.Sprint(err), "rdb file["+dir+"/10.rdb] "), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckCompatibility case %d.\n", nr)
+		nr++
+
+		l := startFakePreflightServer(t, map[string]string{"info": bulk("# Modules\r\n" +
+			"module:name=ReJSON,ver=20008,api=1,filters=0,usedby=[],using=[],options=[]\r\n" +
+			"module:name=bf,ver=20205,api=1,filters=0,usedby=[],using=[],options=[]\r\n")})
+		defer l.Close()
+		modules, err := SourceModules(l.Addr().String(), "auth", "", nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []string{"ReJSON", "bf"}, modules, "should be equal")
+
+		// no module
+		l2 := startFakePreflightServer(t, map[string]string{"info": bulk("# Modules\r\n")})
+		defer l2.Close()
+		modules, err = SourceModules(l2.Addr().String(), "auth", "", nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 0, len(modules), "should be equal")
+	}
+}
+
+func TestAuthHint(t *testing.T) {
+	// test AuthHint and SourceAuthToken
+
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestAuthHint case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, ", the source requires a password, please set source.password_raw",
+			AuthHint("source", "-NOAUTH Authentication required.\r\n"), "should be equal")
+		assert.Equal(t, ", the target requires a password, please set target.password_raw",
+			AuthHint("target", "NOAUTH Authentication required."), "should be equal")
+		assert.Equal(t, ", the source is running in protected mode, please set requirepass on it and "+
+			"source.password_raw, or disable its protected-mode", AuthHint("source",
+			"-DENIED Redis is running in protected mode because protected mode is enabled\r\n"), "should be equal")
+		assert.Equal(t, "", AuthHint("source", "-ERR unknown command\r\n"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthHint case %d.\n", nr)
+		nr++
+
+		// the source requires a password but none is given
+		l := startFakePreflightServer(t, map[string]string{"info": "-NOAUTH Authentication required.\r\n"})
+		defer l.Close()
+		err := PreflightCheck("source", l.Addr().String(), "auth", SourceAuthToken(""), nil, false, false)
+		assert.Equal(t, fmt.Sprintf("source[%v] info failed: NOAUTH Authentication required., the source "+
+			"requires a password, please set source.password_raw", l.Addr()), fmt.Sprint(err), "should be equal")
+
+		// the password is given but source.no_auth is set
+		conf.Options.SourceNoAuth = true
+		err = PreflightCheck("source", l.Addr().String(), "auth", SourceAuthToken("pwd"), nil, false, false)
+		assert.Equal(t, fmt.Sprintf("source[%v] info failed: NOAUTH Authentication required., the source "+
+			"requires a password but source.no_auth is set", l.Addr()), fmt.Sprint(err), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAuthHint case %d.\n", nr)
+		nr++
+
+		// source.no_auth, AUTH isn't sent to the proxy which rejects it
+		l := startFakePreflightServer(t, map[string]string{"auth": "-ERR unknown command 'auth'\r\n",
+			"info": "$0\r\n\r\n"})
+		defer l.Close()
+		conf.Options.SourceNoAuth = true
+		assert.Equal(t, "", SourceAuthToken("pwd"), "should be equal")
+		assert.Equal(t, nil, PreflightCheck("source", l.Addr().String(), "auth", SourceAuthToken("pwd"), nil,
+			false, false), "should be equal")
+
+		conf.Options.SourceNoAuth = false
+		assert.Equal(t, "pwd", SourceAuthToken("pwd"), "should be equal")
+		assert.NotEqual(t, nil, PreflightCheck("source", l.Addr().String(), "auth", SourceAuthToken("pwd"), nil,
+			false, false), "should be equal")
+	}
+}
+
+func TestGetFakeSlaveOffset(t *testing.T) {
+	// test GetFakeSlaveOffset
+
+	info := "# Replication\r\nrole:master\r\nconnected_slaves:3\r\n" +
+		"slave0:ip=10.0.0.1,port=93201,state=online,offset=100,lag=0\r\n" +
+		"slave1:ip=10.0.0.1,port=9321,state=online,offset=200,lag=0\r\n" +
+		"slave2:ip=10.0.0.1,port=9320,state=online,offset=300,lag=1\r\n"
+	l := startFakePreflightServer(t, map[string]string{"info": fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)})
+	defer l.Close()
+	c, err := redigo.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err, "should be equal")
+	defer c.Close()
+
+	var nr int
+	{
+		fmt.Printf("TestGetFakeSlaveOffset case %d.\n", nr)
+		nr++
+
+		offset, err := GetFakeSlaveOffset(c, 9320)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "300", offset, "should be equal")
+
+		offset, err = GetFakeSlaveOffset(c, 9321)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "200", offset, "should be equal")
+
+		_, err = GetFakeSlaveOffset(c, 9322)
+		assert.NotEqual(t, nil, err, "should be equal")
+	}
+}
+
+func TestReconnectDetector(t *testing.T) {
+	var nr int
+	now := time.Unix(1000, 0)
+	newDetector := func(limit int) *ReconnectDetector {
+		d := NewReconnectDetector(limit, 60*time.Second)
+		d.now = func() time.Time { return now }
+		return d
+	}
+
+	{
+		fmt.Printf("TestReconnectDetector case %d.\n", nr)
+		nr++
+
+		// the offset doesn't advance
+		d := newDetector(3)
+		assert.Equal(t, false, d.Reconnect(100), "should be equal")
+		progress := d.LastProgress()
+		for i := 0; i < 4; i++ {
+			now = now.Add(time.Second)
+			assert.Equal(t, i == 3, d.Reconnect(100), "should be equal")
+		}
+		assert.Equal(t, int64(5), d.Count(), "should be equal")
+		assert.Equal(t, 4, d.Stalled(), "should be equal")
+		assert.Equal(t, progress, d.LastProgress(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReconnectDetector case %d.\n", nr)
+		nr++
+
+		// the offset advances between the reconnects
+		d := newDetector(3)
+		for i := 0; i < 10; i++ {
+			now = now.Add(time.Second)
+			assert.Equal(t, false, d.Reconnect(int64(100+i)), "should be equal")
+		}
+		assert.Equal(t, int64(10), d.Count(), "should be equal")
+		assert.Equal(t, 0, d.Stalled(), "should be equal")
+		assert.Equal(t, now, d.LastProgress(), "should be equal")
+
+		// the new master after failover starts from a smaller offset
+		assert.Equal(t, false, d.Reconnect(10), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReconnectDetector case %d.\n", nr)
+		nr++
+
+		// the reconnects out of the window are forgotten
+		d := newDetector(3)
+		for i := 0; i < 10; i++ {
+			now = now.Add(30 * time.Second)
+			assert.Equal(t, false, d.Reconnect(0), "should be equal")
+		}
+		assert.Equal(t, 3, d.Stalled(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReconnectDetector case %d.\n", nr)
+		nr++
+
+		// no limit
+		d := newDetector(0)
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, false, d.Reconnect(0), "should be equal")
+		}
+		assert.Equal(t, int64(100), d.Count(), "should be equal")
+	}
+}
+
+func TestRdbSpool(t *testing.T) {
+	// test RdbSpool
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String(fmt.Sprintf("value%d", i))), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	data := b.Bytes()
+
+	spool := func(p []byte, chunk int) *RdbSpool {
+		s, err := NewRdbSpool()
+		assert.Equal(t, nil, err, "should be equal")
+		for len(p) > 0 {
+			n := chunk
+			if n > len(p) {
+				n = len(p)
+			}
+			_, err := s.Write(p[:n])
+			assert.Equal(t, nil, err, "should be equal")
+			p = p[n:]
+		}
+		return s
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestRdbSpool case %d.\n", nr)
+		nr++
+
+		// written in different sizes
+		for _, chunk := range []int{1, 7, 8, 9, 8192} {
+			s := spool(data, chunk)
+			assert.Equal(t, nil, s.Verify(int64(len(data))), "should be equal")
+			assert.Equal(t, nil, s.Verify(RdbSizeUnknown), "should be equal")
+			var out bytes.Buffer
+			_, err := s.WriteTo(&out)
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, data, out.Bytes(), "should be equal")
+			name := s.f.Name()
+			assert.Equal(t, nil, s.Close(), "should be equal")
+			_, err = os.Stat(name)
+			assert.Equal(t, true, os.IsNotExist(err), "should be equal")
+		}
+	}
+
+	{
+		fmt.Printf("TestRdbSpool case %d.\n", nr)
+		nr++
+
+		// corrupted
+		corrupted := append([]byte{}, data...)
+		corrupted[len(corrupted)/2] ^= 0xff
+		s := spool(corrupted, 100)
+		defer s.Close()
+		err := s.Verify(int64(len(corrupted)))
+		assert.Equal(t, true, strings.HasPrefix(fmt.Sprint(err), "RDB checksum mismatch"), "should be equal")
+
+		// the checksum is disabled on the source
+		for i := len(corrupted) - 8; i < len(corrupted); i++ {
+			corrupted[i] = 0
+		}
+		s = spool(corrupted, 100)
+		defer s.Close()
+		assert.Equal(t, nil, s.Verify(int64(len(corrupted))), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRdbSpool case %d.\n", nr)
+		nr++
+
+		// truncated
+		s := spool(data[:len(data)-20], 100)
+		defer s.Close()
+		assert.Equal(t, fmt.Sprintf("RDB size mismatch, expect %d, got %d", len(data), len(data)-20),
+			fmt.Sprint(s.Verify(int64(len(data)))), "should be equal")
+		assert.Equal(t, true, strings.HasPrefix(fmt.Sprint(s.Verify(RdbSizeUnknown)), "RDB checksum mismatch"),
+			"should be equal")
+
+		// not rdb
+		s = spool([]byte("-ERR unknown\r\n"), 100)
+		defer s.Close()
+		assert.Equal(t, true, strings.HasPrefix(fmt.Sprint(s.Verify(RdbSizeUnknown)), "RDB is invalid"),
+			"should be equal")
+	}
+}
+
+func TestInjectHashTag(t *testing.T) {
+	// test InjectHashTag and InjectCommandHashTag
+
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestInjectHashTag case %d.\n", nr)
+		nr++
+
+		// the same as redis, only the first non-empty hash tag takes effect
+		assert.Equal(t, "a", HashTag("{a}{b}c"), "should be equal")
+		assert.Equal(t, "", HashTag("{}a{b}"), "should be equal")
+		assert.Equal(t, "b", HashTag("{b}}"), "should be equal")
+		assert.Equal(t, "", HashTag("{a"), "should be equal")
+		assert.Equal(t, KeyToSlot("a"), KeyToSlot("{a}{b}c"), "should be equal")
+		assert.Equal(t, crc16("{}a{b}")&0x3fff, KeyToSlot("{}a{b}"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestInjectHashTag case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetHashTagInject = ""
+		assert.Equal(t, []byte("key"), InjectHashTag([]byte("key")), "should be equal")
+		args := [][]byte{[]byte("a"), []byte("1")}
+		ret, ok := InjectCommandHashTag("set", args)
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, args, ret, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestInjectHashTag case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetHashTagInject = "t1"
+		assert.Equal(t, []byte("{t1}key"), InjectHashTag([]byte("key")), "should be equal")
+		// not wrapped twice
+		assert.Equal(t, []byte("{t1}key"), InjectHashTag([]byte("{t1}key")), "should be equal")
+		assert.Equal(t, []byte("user:{t1}"), InjectHashTag([]byte("user:{t1}")), "should be equal")
+		// the other hash tag is overridden by the injected one
+		assert.Equal(t, []byte("{t1}{user}key"), InjectHashTag([]byte("{user}key")), "should be equal")
+		assert.Equal(t, KeyToSlot("t1"), KeyToSlot(string(InjectHashTag([]byte("{user}key")))), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestInjectHashTag case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetHashTagInject = "t1"
+		cases := []struct {
+			cmd    string
+			args   []string
+			expect []string
+		}{
+			{"SET", []string{"a", "1"}, []string{"{t1}a", "1"}},
+			{"mset", []string{"a", "1", "{t1}b", "2", "c", "3"}, []string{"{t1}a", "1", "{t1}b", "2", "{t1}c", "3"}},
+			{"del", []string{"a", "b", "{x}c"}, []string{"{t1}a", "{t1}b", "{t1}{x}c"}},
+			{"rename", []string{"a", "b"}, []string{"{t1}a", "{t1}b"}},
+			{"zadd", []string{"z", "1", "m"}, []string{"{t1}z", "1", "m"}},
+			{"bitop", []string{"and", "d", "a", "b"}, []string{"and", "{t1}d", "{t1}a", "{t1}b"}},
+		}
+		for _, c := range cases {
+			args := bytesArgs(c.args...)
+			ret, ok := InjectCommandHashTag(c.cmd, args)
+			assert.Equal(t, true, ok, c.cmd)
+			assert.Equal(t, bytesArgs(c.expect...), ret, c.cmd)
+			// the source args aren't changed
+			assert.Equal(t, bytesArgs(c.args...), args, c.cmd)
+
+			// all the keys are in one slot
+			keys, _ := filter.CommandKeys(strings.ToLower(c.cmd), ret)
+			for _, key := range keys {
+				assert.Equal(t, KeyToSlot("t1"), KeyToSlot(string(key)), c.cmd)
+			}
+		}
+
+		// the keys of eval are unknown
+		args := bytesArgs("return 1", "1", "a")
+		ret, ok := InjectCommandHashTag("eval", args)
+		assert.Equal(t, false, ok, "should be equal")
+		assert.Equal(t, args, ret, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestInjectHashTag case %d.\n", nr)
+		nr++
+
+		// the rdb entry
+		conf.Options.TargetHashTagInject = "t1"
+		conf.Options.ReplaceHashTag = false
+		conf.Options.SourceRdbSpecialCloud = ""
+		e := &rdb.BinEntry{Key: []byte("key")}
+		prepareRdbEntry(e)
+		assert.Equal(t, []byte("{t1}key"), e.Key, "should be equal")
+		prepareRdbEntry(e)
+		assert.Equal(t, []byte("{t1}key"), e.Key, "should be equal")
+	}
+}
+
+func TestCloudAdapter(t *testing.T) {
+	// test GetCloudAdapter and the adapters of the vendors
+
+	var nr int
+	{
+		fmt.Printf("TestCloudAdapter case %d.\n", nr)
+		nr++
+
+		// the community redis
+		adapter, err := GetCloudAdapter("")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "sync", adapter.SyncCommand(), "should be equal")
+		assert.Equal(t, "psync", adapter.PSyncCommand(), "should be equal")
+		assert.Equal(t, false, adapter.VendorCommand("set"), "should be equal")
+		assert.Equal(t, false, adapter.VendorCommand("opinfo"), "should be equal")
+		assert.Equal(t, []byte("046110.key"), adapter.RdbKey([]byte("046110.key")), "should be equal")
+		nodes, err := adapter.ScanNodes(nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 0, len(nodes), "should be equal")
+		assert.Equal(t, 0, len(adapter.Dbs()), "should be equal")
+
+		_, err = GetCloudAdapter("unknown_cluster")
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestCloudAdapter case %d.\n", nr)
+		nr++
+
+		// the slot prefix in the rdb of ucloud is stripped
+		adapter, err := GetCloudAdapter(UCloudCluster)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []byte("key"), adapter.RdbKey([]byte("046110.key")), "should be equal")
+		assert.Equal(t, []byte("key"), adapter.RdbKey([]byte("key")), "should be equal")
+		assert.Equal(t, "psync", adapter.PSyncCommand(), "should be equal")
+
+		oldCloud, oldInject := SourceRdbCloud, conf.Options.TargetHashTagInject
+		defer func() {
+			SourceRdbCloud, conf.Options.TargetHashTagInject = oldCloud, oldInject
+		}()
+		SourceRdbCloud = adapter
+		conf.Options.TargetHashTagInject = ""
+		e := &rdb.BinEntry{Key: []byte("046110.key")}
+		prepareRdbEntry(e)
+		assert.Equal(t, []byte("key"), e.Key, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCloudAdapter case %d.\n", nr)
+		nr++
+
+		// the clusters having 1 logical db only
+		for _, name := range []string{TencentCluster, HuaweiCluster} {
+			adapter, err := GetCloudAdapter(name)
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, []int32{0}, adapter.Dbs(), "should be equal")
+		}
+		adapter, err := GetCloudAdapter(AliyunCluster)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 0, len(adapter.Dbs()), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCloudAdapter case %d.\n", nr)
+		nr++
+
+		// the opinfo in the stream of aliyun is dropped
+		adapter, err := GetCloudAdapter(AliyunCluster)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, adapter.VendorCommand("opinfo"), "should be equal")
+		assert.Equal(t, true, adapter.VendorCommand("OPINFO"), "should be equal")
+		assert.Equal(t, false, adapter.VendorCommand("set"), "should be equal")
+		assert.Equal(t, "sync", adapter.SyncCommand(), "should be equal")
+		assert.Equal(t, "psync", adapter.PSyncCommand(), "should be equal")
+
+		for _, name := range []string{TencentCluster, UCloudCluster, HuaweiCluster} {
+			adapter, err := GetCloudAdapter(name)
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, false, adapter.VendorCommand("opinfo"), "should be equal")
+		}
+	}
+}
+
+func bytesArgs(args ...string) [][]byte {
+	ret := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		ret = append(ret, []byte(arg))
+	}
+	return ret
+}
+
+func TestSameTTL(t *testing.T) {
+	// test sameTTL of fullsync.resumable
+
+	assert.Equal(t, true, sameTTL(0, -1), "should be equal")
+	assert.Equal(t, false, sameTTL(0, 1000), "should be equal")
+	assert.Equal(t, false, sameTTL(5000, -1), "should be equal")
+	assert.Equal(t, false, sameTTL(5000, -2), "should be equal")
+	assert.Equal(t, true, sameTTL(5000, 4500), "should be equal")
+	assert.Equal(t, true, sameTTL(5000, 6000), "should be equal")
+	assert.Equal(t, false, sameTTL(5000, 3000), "should be equal")
+}
+
+func TestCheckpoint(t *testing.T) {
+	// test WriteCheckpoint, ReadCheckpoint and RemoveCheckpoint
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+	file := CheckpointFileName(dir+"/checkpoint", 3)
+	assert.Equal(t, dir+"/checkpoint.3", file, "should be equal")
+
+	var nr int
+	{
+		fmt.Printf("TestCheckpoint case %d.\n", nr)
+		nr++
+
+		// no checkpoint
+		cp, err := ReadCheckpoint(file)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, (*Checkpoint)(nil), cp, "should be equal")
+		assert.Equal(t, nil, RemoveCheckpoint(file), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckpoint case %d.\n", nr)
+		nr++
+
+		cp := &Checkpoint{Source: "127.0.0.1:6379", RunId: "0123456789", Offset: 100, Time: "now"}
+		assert.Equal(t, nil, WriteCheckpoint(file, cp), "should be equal")
+		cp.Offset = 200
+		assert.Equal(t, nil, WriteCheckpoint(file, cp), "should be equal")
+		ret, err := ReadCheckpoint(file)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, cp, ret, "should be equal")
+		_, err = os.Stat(file + ".tmp")
+		assert.Equal(t, true, os.IsNotExist(err), "should be equal")
+
+		assert.Equal(t, nil, RemoveCheckpoint(file), "should be equal")
+		ret, err = ReadCheckpoint(file)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, (*Checkpoint)(nil), ret, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckpoint case %d.\n", nr)
+		nr++
+
+		// broken file
+		assert.Equal(t, nil, ioutil.WriteFile(file, []byte("{\"runid\":"), 0644), "should be equal")
+		_, err := ReadCheckpoint(file)
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Equal(t, nil, ioutil.WriteFile(file, []byte("{\"offset\":1}"), 0644), "should be equal")
+		_, err = ReadCheckpoint(file)
+		assert.NotEqual(t, nil, err, "should be equal")
+	}
+}
+
+// fake node of the cluster, the key in redirect is replied with the error unless asking is sent ahead
+type fakeClusterNode struct {
+	net.Listener
+	mu       sync.Mutex
+	slots    string            // reply of cluster slots
+	nodes    string            // reply of cluster nodes
+	redirect map[string]string // key -> MOVED or ASK
+	commands []string
+}
+
+func startFakeClusterNode(t *testing.T) *fakeClusterNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	n := &fakeClusterNode{Listener: l, redirect: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				asking, queued := false, -1
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					n.mu.Lock()
+					n.commands = append(n.commands, strings.Join(strs, " "))
+					slots, nodes := n.slots, n.nodes
+					var redirect string
+					if len(args) > 0 && !asking {
+						redirect = n.redirect[string(args[0])]
+					}
+					n.mu.Unlock()
+
+					switch {
+					case cmd == "cluster" && strings.EqualFold(string(args[0]), "nodes"):
+						conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)))
+					case cmd == "cluster":
+						conn.Write([]byte(slots))
+					case cmd == "asking":
+						asking = true
+						conn.Write([]byte("+OK\r\n"))
+						continue
+					case cmd == "multi":
+						queued = 0
+						conn.Write([]byte("+OK\r\n"))
+					case cmd == "exec":
+						conn.Write([]byte(fmt.Sprintf("*%d\r\n%s", queued, strings.Repeat("+OK\r\n", queued))))
+						queued = -1
+					case redirect != "":
+						conn.Write([]byte("-" + redirect + "\r\n"))
+					case queued >= 0:
+						queued++
+						conn.Write([]byte("+QUEUED\r\n"))
+					default:
+						conn.Write([]byte("+OK\r\n"))
+					}
+					asking = false
+				}
+			}(conn)
+		}
+	}()
+	return n
+}
+
+// the commands received since the last call
+func (n *fakeClusterNode) take() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	commands := n.commands
+	n.commands = nil
+	return commands
+}
+
+func TestClusterConn(t *testing.T) {
+	nodeA := startFakeClusterNode(t)
+	defer nodeA.Close()
+	nodeB := startFakeClusterNode(t)
+	defer nodeB.Close()
+	node := func(n *fakeClusterNode) string {
+		_, port, _ := net.SplitHostPort(n.Addr().String())
+		return fmt.Sprintf("*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", port)
+	}
+	// 0-8191 on A, 8192-16383 on B
+	slots := "*2\r\n*3\r\n:0\r\n:8191\r\n" + node(nodeA) + "*3\r\n:8192\r\n:16383\r\n" + node(nodeB)
+	nodeA.slots, nodeB.slots = slots, slots
+	keyIn := func(low, high int, skip ...string) string {
+	NEXT:
+		for i := 0; ; i++ {
+			key := fmt.Sprintf("key%d", i)
+			for _, s := range skip {
+				if key == s {
+					continue NEXT
+				}
+			}
+			if slot := int(KeyToSlot(key)); slot >= low && slot <= high {
+				return key
+			}
+		}
+	}
+	keyA, keyB := keyIn(0, 8191), keyIn(8192, ClusterSlots-1)
+
+	c, err := NewClusterConn([]string{"127.0.0.1:1", nodeA.Addr().String()}, "auth", "", time.Second, time.Second, nil)
+	assert.Equal(t, nil, err, "should be equal")
+	defer c.Close()
+	nodeA.take()
+	receive := func(n int) []interface{} {
+		var replies []interface{}
+		for i := 0; i < n; i++ {
+			reply, err := c.Receive()
+			assert.Equal(t, nil, err, "should be equal")
+			replies = append(replies, reply)
+		}
+		return replies
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestClusterConn case %d.\n", nr)
+		nr++
+
+		// each command goes to the master of its slot, the one without keys goes to the last node
+		assert.Equal(t, nil, c.Send("set", []byte(keyA), "1"), "should be equal")
+		assert.Equal(t, nil, c.Send("set", []byte(keyB), "2"), "should be equal")
+		assert.Equal(t, nil, c.Send("ping"), "should be equal")
+		assert.Equal(t, nil, c.Send("restore", keyA, 0, "value"), "should be equal")
+		assert.Equal(t, nil, c.Flush(), "should be equal")
+		assert.Equal(t, []interface{}{"OK", "OK", "OK", "OK"}, receive(4), "should be equal")
+		assert.Equal(t, []string{"set " + keyA + " 1", "restore " + keyA + " 0 value"}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{"set " + keyB + " 2", "ping"}, nodeB.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestClusterConn case %d.\n", nr)
+		nr++
+
+		// MOVED is followed and the slot is served by the new node later
+		moved := keyIn(0, 8191, keyA)
+		nodeA.mu.Lock()
+		nodeA.redirect[moved] = fmt.Sprintf("MOVED %d %s", KeyToSlot(moved), nodeB.Addr().String())
+		nodeA.mu.Unlock()
+		assert.Equal(t, nil, c.Send("set", moved, "1"), "should be equal")
+		assert.Equal(t, nil, c.Send("set", keyA, "1"), "should be equal")
+		assert.Equal(t, nil, c.Flush(), "should be equal")
+		assert.Equal(t, []interface{}{"OK", "OK"}, receive(2), "should be equal")
+		assert.Equal(t, []string{"set " + moved + " 1", "set " + keyA + " 1"}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{"set " + moved + " 1"}, nodeB.take(), "should be equal")
+
+		reply, err := c.Do("set", moved, "2")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		assert.Equal(t, 0, len(nodeA.take()), "should be equal")
+		assert.Equal(t, []string{"set " + moved + " 2"}, nodeB.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestClusterConn case %d.\n", nr)
+		nr++
+
+		// ASK is followed with asking, but the slot isn't changed
+		ask := keyIn(0, 8191, keyA, keyIn(0, 8191, keyA))
+		nodeA.mu.Lock()
+		nodeA.redirect[ask] = fmt.Sprintf("ASK %d %s", KeyToSlot(ask), nodeB.Addr().String())
+		nodeA.mu.Unlock()
+		reply, err := c.Do("set", ask, "1")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		assert.Equal(t, []string{"set " + ask + " 1"}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{"asking", "set " + ask + " 1"}, nodeB.take(), "should be equal")
+
+		assert.Equal(t, nil, c.Send("set", ask, "2"), "should be equal")
+		assert.Equal(t, nil, c.Flush(), "should be equal")
+		assert.Equal(t, []interface{}{"OK"}, receive(1), "should be equal")
+		assert.Equal(t, []string{"set " + ask + " 2"}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{"asking", "set " + ask + " 2"}, nodeB.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestClusterConn case %d.\n", nr)
+		nr++
+
+		// the transaction goes to the node of its first key
+		assert.Equal(t, nil, c.Send("multi"), "should be equal")
+		assert.Equal(t, nil, c.Send("set", keyB, "1"), "should be equal")
+		assert.Equal(t, nil, c.Send("del", keyB), "should be equal")
+		assert.Equal(t, nil, c.Send("exec"), "should be equal")
+		assert.Equal(t, nil, c.Flush(), "should be equal")
+		replies := receive(4)
+		assert.Equal(t, []interface{}{"OK", "QUEUED", "QUEUED"}, replies[:3], "should be equal")
+		assert.Equal(t, 2, len(replies[3].([]interface{})), "should be equal")
+		assert.Equal(t, 0, len(nodeA.take()), "should be equal")
+		assert.Equal(t, []string{"multi", "set " + keyB + " 1", "del " + keyB, "exec"}, nodeB.take(),
+			"should be equal")
+	}
+}
+
+func TestDiscoverClusterMasters(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	seed := startFakeClusterNode(t)
+	defer seed.Close()
+	addr := seed.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	slotRange := func(start, end int, port string) string {
+		return fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", start, end, port)
+	}
+	nodes := "a 127.0.0.1:" + port + "@1 myself,master - 0 0 1 connected 0-8191\n" +
+		"b 127.0.0.1:7002@17002 master - 0 0 2 connected 8192-16383\n" +
+		"c 127.0.0.1:7003@17003 slave b 0 0 2 connected\n" +
+		"d 127.0.0.1:7004@17004 master - 0 0 3 connected\n"
+
+	var nr int
+	{
+		fmt.Printf("TestDiscoverClusterMasters case %d.\n", nr)
+		nr++
+
+		// the masters serving the slots are found from the seed
+		seed.mu.Lock()
+		seed.nodes = nodes
+		seed.slots = "*2\r\n" + slotRange(0, 8191, port) + slotRange(8192, 16383, "7002")
+		seed.mu.Unlock()
+		masters, err := discoverClusterMasters(addr)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []string{addr, "127.0.0.1:7002"}, masters, "should be equal")
+
+		conf.Options.SourceType = conf.RedisTypeCluster
+		conf.Options.SourceAddress = addr
+		conf.Options.SourceAofFile = ""
+		conf.Options.TargetType = conf.RedisTypeStandalone
+		conf.Options.TargetAddress = "127.0.0.1:6379"
+		assert.Equal(t, nil, ParseAddress(conf.TypeSync), "should be equal")
+		assert.Equal(t, []string{addr, "127.0.0.1:7002"}, conf.Options.SourceAddressList, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDiscoverClusterMasters case %d.\n", nr)
+		nr++
+
+		// the slot served by the slave, e.g., failing over
+		seed.mu.Lock()
+		seed.slots = "*2\r\n" + slotRange(0, 8191, port) + slotRange(8192, 16383, "7003")
+		seed.mu.Unlock()
+		_, err := discoverClusterMasters(addr)
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Contains(t, err.Error(), "isn't a master", "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDiscoverClusterMasters case %d.\n", nr)
+		nr++
+
+		// the slot not served
+		seed.mu.Lock()
+		seed.slots = "*2\r\n" + slotRange(0, 8191, port) + slotRange(8193, 16383, "7002")
+		seed.mu.Unlock()
+		_, err := discoverClusterMasters(addr)
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Contains(t, err.Error(), "slot[8192]", "should be equal")
+	}
+}
+
+func TestPickClusterReplicas(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	seed := startFakeClusterNode(t)
+	defer seed.Close()
+	addr := seed.Addr().String()
+	_, port, _ := net.SplitHostPort(addr)
+	node := func(port string) string {
+		return fmt.Sprintf("*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", port)
+	}
+	seed.mu.Lock()
+	seed.nodes = "a 127.0.0.1:" + port + "@1 myself,master - 0 0 1 connected 0-8191\n" +
+		"b 127.0.0.1:7002@17002 master - 0 0 2 connected 8192-16383\n" +
+		"c 127.0.0.1:7005@17005 slave a 0 0 2 connected\n"
+	seed.slots = "*3\r\n*4\r\n:0\r\n:100\r\n" + node(port) + node("7005") +
+		"*4\r\n:101\r\n:8191\r\n" + node(port) + node("7005") +
+		"*3\r\n:8192\r\n:16383\r\n" + node("7002")
+	seed.mu.Unlock()
+
+	var nr int
+	{
+		fmt.Printf("TestPickClusterReplicas case %d.\n", nr)
+		nr++
+
+		c := OpenRedisConn([]string{addr}, "auth", "", false, nil)
+		replicas, err := ClusterSlotReplicas(c, addr)
+		c.Close()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[string][]string{
+			addr:             {"127.0.0.1:7005"},
+			"127.0.0.1:7002": {},
+		}, replicas, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestPickClusterReplicas case %d.\n", nr)
+		nr++
+
+		// the master without the replica is kept
+		conf.Options.SourceType = conf.RedisTypeCluster
+		conf.Options.SourceAddress = addr
+		conf.Options.SourceAofFile = ""
+		conf.Options.SourceClusterReadFrom = conf.ClusterReadFromReplica
+		conf.Options.SourceAuthType = "auth"
+		conf.Options.TargetType = conf.RedisTypeStandalone
+		conf.Options.TargetAddress = "127.0.0.1:6379"
+		assert.Equal(t, nil, ParseAddress(conf.TypeSync), "should be equal")
+		assert.Equal(t, []string{"127.0.0.1:7005", "127.0.0.1:7002"}, conf.Options.SourceAddressList,
+			"should be equal")
+		assert.Equal(t, map[string]string{"127.0.0.1:7005": addr}, conf.Options.SourceReplicaOf, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestPickClusterReplicas case %d.\n", nr)
+		nr++
+
+		// the options of the master are used for the replica
+		conf.Options.SourceAddress = addr + "?password=x;127.0.0.1:7002"
+		assert.Equal(t, nil, ParseAddress(conf.TypeSync), "should be equal")
+		assert.Equal(t, []string{"127.0.0.1:7005", "127.0.0.1:7002"}, conf.Options.SourceAddressList,
+			"should be equal")
+		assert.Equal(t, "x", AddressPassword(conf.Options.SourceAddressOptions, "127.0.0.1:7005", ""),
+			"should be equal")
+	}
+}
+
+func TestParseMigratingSlots(t *testing.T) {
+	content := []byte("07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460 [93->-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1] [77-<-292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f] [94->-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1]\n")
+
+	var nr int
+	{
+		fmt.Printf("TestParseMigratingSlots case %d.\n", nr)
+		nr++
+
+		migrating, importing := ParseMigratingSlots(content)
+		assert.Equal(t, []int{93, 94}, migrating, "should be equal")
+		assert.Equal(t, []int{77}, importing, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestParseMigratingSlots case %d.\n", nr)
+		nr++
+
+		// the migration of the other nodes isn't counted
+		migrating, importing := ParseMigratingSlots(bytes.Replace(content, []byte("myself,"), nil, 1))
+		assert.Equal(t, 0, len(migrating), "should be equal")
+		assert.Equal(t, 0, len(importing), "should be equal")
+	}
+}
+
+func TestClusterRefresh(t *testing.T) {
+	nodeA := startFakeClusterNode(t)
+	defer nodeA.Close()
+	nodeB := startFakeClusterNode(t)
+	defer nodeB.Close()
+	only := func(n *fakeClusterNode) string {
+		_, port, _ := net.SplitHostPort(n.Addr().String())
+		return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", port)
+	}
+	serve := func(n *fakeClusterNode) {
+		for _, node := range []*fakeClusterNode{nodeA, nodeB} {
+			node.mu.Lock()
+			node.slots = only(n)
+			node.mu.Unlock()
+		}
+	}
+	serve(nodeA)
+
+	c, err := NewClusterConn([]string{nodeA.Addr().String()}, "auth", "", time.Second, time.Second, nil)
+	assert.Equal(t, nil, err, "should be equal")
+	defer c.Close()
+	set := func(key string) {
+		assert.Equal(t, nil, c.Send("set", key, "1"), "should be equal")
+		assert.Equal(t, nil, c.Flush(), "should be equal")
+		reply, err := c.Receive()
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+	}
+	set("a")
+	nodeA.take()
+
+	var nr int
+	{
+		fmt.Printf("TestClusterRefresh case %d.\n", nr)
+		nr++
+
+		// the slots moved are followed and the connection to the node without slots is closed
+		serve(nodeB)
+		assert.Equal(t, nil, c.refresh(), "should be equal")
+		set("a")
+		assert.Equal(t, []string{"cluster slots"}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{"set a 1"}, nodeB.take(), "should be equal")
+		c.mu.Lock()
+		assert.Equal(t, 1, len(c.nodes), "should be equal")
+		c.mu.Unlock()
+	}
+
+	{
+		fmt.Printf("TestClusterRefresh case %d.\n", nr)
+		nr++
+
+		// the slots are fetched again in the background once the interval passes
+		serve(nodeA)
+		c.mu.Lock()
+		c.refreshInterval = time.Second
+		c.refreshed = time.Now().Add(-2 * time.Second)
+		c.mu.Unlock()
+		set("a")
+		for i := 0; i < 50; i++ {
+			c.mu.Lock()
+			refreshed := c.slots[0] == nodeA.Addr().String()
+			c.mu.Unlock()
+			if refreshed {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		set("a")
+		assert.Equal(t, []string{"set a 1"}, nodeA.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestClusterRefresh case %d.\n", nr)
+		nr++
+
+		// the master which can't be connected makes the slots fetched again at once
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err, "should be equal")
+		gone := l.Addr().String()
+		l.Close()
+		c.mu.Lock()
+		c.refreshInterval = 0
+		for i := range c.slots {
+			c.slots[i] = gone
+		}
+		c.mu.Unlock()
+		set("a")
+		assert.Equal(t, []string{"cluster slots", "set a 1"}, nodeA.take(), "should be equal")
+	}
+}
+
+func TestRetryStalled(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	node := startFakeClusterNode(t)
+	defer node.Close()
+	_, port, _ := net.SplitHostPort(node.Addr().String())
+	node.slots = fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", port)
+	stall := func(reply string) {
+		node.mu.Lock()
+		if reply == "" {
+			delete(node.redirect, "a")
+		} else {
+			node.redirect["a"] = reply
+		}
+		node.mu.Unlock()
+	}
+
+	c, err := NewClusterConn([]string{node.Addr().String()}, "auth", "", time.Second, time.Second, nil)
+	assert.Equal(t, nil, err, "should be equal")
+	defer c.Close()
+	node.take()
+
+	var nr int
+	{
+		fmt.Printf("TestRetryStalled case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, true, IsStallError(redigo.Error("CLUSTERDOWN The cluster is down")), "should be equal")
+		assert.Equal(t, true, IsStallError(redigo.Error("LOADING Redis is loading the dataset in memory")),
+			"should be equal")
+		assert.Equal(t, true, IsStallError(redigo.Error("TRYAGAIN Multiple keys request during rehashing of slot")),
+			"should be equal")
+		assert.Equal(t, false, IsStallError(redigo.Error("ERR wrong type")), "should be equal")
+		assert.Equal(t, false, IsStallError(io.EOF), "should be equal")
+		assert.Equal(t, false, IsStallError(nil), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRetryStalled case %d.\n", nr)
+		nr++
+
+		// disabled, the error is returned at once
+		conf.Options.TargetMaxStall = 0
+		stall("CLUSTERDOWN The cluster is down")
+		_, err := DoRetryStalled(c, "set", "a", "1")
+		assert.Equal(t, redigo.Error("CLUSTERDOWN The cluster is down"), err, "should be equal")
+		assert.Equal(t, []string{"set a 1"}, node.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRetryStalled case %d.\n", nr)
+		nr++
+
+		// retried with the slots fetched again until the cluster is up
+		conf.Options.TargetMaxStall = 5000
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			stall("")
+		}()
+		reply, err := DoRetryStalled(c, "set", "a", "1")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "OK", reply, "should be equal")
+		commands := node.take()
+		assert.Equal(t, "set a 1", commands[len(commands)-1], "should be equal")
+		assert.Equal(t, "cluster slots", commands[len(commands)-2], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRetryStalled case %d.\n", nr)
+		nr++
+
+		// the error which isn't a stall isn't retried
+		stall("ERR wrong type")
+		_, err := DoRetryStalled(c, "set", "a", "1")
+		assert.Equal(t, redigo.Error("ERR wrong type"), err, "should be equal")
+		assert.Equal(t, []string{"set a 1"}, node.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRetryStalled case %d.\n", nr)
+		nr++
+
+		// the stall lasts longer than target.clusterdown_max_stall_ms
+		conf.Options.TargetMaxStall = 100
+		stall("LOADING Redis is loading the dataset in memory")
+		start := time.Now()
+		_, err := DoRetryStalled(c, "set", "a", "1")
+		assert.Equal(t, redigo.Error("LOADING Redis is loading the dataset in memory"), err, "should be equal")
+		assert.Equal(t, true, time.Since(start) >= 100*time.Millisecond, "should be equal")
+		assert.Equal(t, true, time.Since(start) < time.Second, "should be equal")
+	}
+}
+
+func TestSplitCommandBySlot(t *testing.T) {
+	join := func(parts [][][]byte) []string {
+		var ret []string
+		for _, part := range parts {
+			ret = append(ret, string(bytes.Join(part, []byte(" "))))
+		}
+		return ret
+	}
+	args := func(strs ...string) [][]byte {
+		ret := make([][]byte, len(strs))
+		for i, s := range strs {
+			ret[i] = []byte(s)
+		}
+		return ret
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestSplitCommandBySlot case %d.\n", nr)
+		nr++
+
+		// the keys are grouped by slot in the order of the first key
+		cmd, parts, ok := SplitCommandBySlot("del", args("a", "b", "{a}x", "{b}y"))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "del", cmd, "should be equal")
+		assert.Equal(t, []string{"a {a}x", "b {b}y"}, join(parts), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSplitCommandBySlot case %d.\n", nr)
+		nr++
+
+		// msetnx is split into mset with the pairs
+		cmd, parts, ok := SplitCommandBySlot("msetnx", args("a", "1", "b", "2", "{a}x", "3"))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "mset", cmd, "should be equal")
+		assert.Equal(t, []string{"a 1 {a}x 3", "b 2"}, join(parts), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSplitCommandBySlot case %d.\n", nr)
+		nr++
+
+		// the keys in the same slot aren't split
+		cmd, parts, ok := SplitCommandBySlot("msetnx", args("{a}1", "1", "{a}2", "2"))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "msetnx", cmd, "should be equal")
+		assert.Equal(t, []string{"{a}1 1 {a}2 2"}, join(parts), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSplitCommandBySlot case %d.\n", nr)
+		nr++
+
+		// the command depending on the other keys can't be split
+		_, parts, ok := SplitCommandBySlot("sunionstore", args("a", "b", "c"))
+		assert.Equal(t, false, ok, "should be equal")
+		assert.Equal(t, 1, len(parts), "should be equal")
+		_, _, ok = SplitCommandBySlot("sunionstore", args("{a}1", "{a}2"))
+		assert.Equal(t, true, ok, "should be equal")
+		_, _, ok = SplitCommandBySlot("set", args("a", "b"))
+		assert.Equal(t, true, ok, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSplitCommandBySlot case %d.\n", nr)
+		nr++
+
+		// the keys of the redis 7 commands, including the ones counted by numkeys
+		_, _, ok := SplitCommandBySlot("copy", args("a", "b", "replace"))
+		assert.Equal(t, false, ok, "should be equal")
+		_, _, ok = SplitCommandBySlot("copy", args("{a}1", "{a}2", "replace"))
+		assert.Equal(t, true, ok, "should be equal")
+		_, _, ok = SplitCommandBySlot("lmpop", args("2", "{a}1", "b", "left"))
+		assert.Equal(t, false, ok, "should be equal")
+		_, _, ok = SplitCommandBySlot("zunionstore", args("{a}d", "2", "{a}1", "{a}2", "weights", "1", "2"))
+		assert.Equal(t, true, ok, "should be equal")
+	}
+}
+
+func TestHashTagRules(t *testing.T) {
+	defer ParseHashTagRules(nil)
+
+	var nr int
+	{
+		fmt.Printf("TestHashTagRules case %d.\n", nr)
+		nr++
+
+		// the rule should compile and have one capturing group
+		assert.NotEqual(t, nil, ParseHashTagRules([]string{"^user:("}), "should be not equal")
+		assert.NotEqual(t, nil, ParseHashTagRules([]string{"^user:"}), "should be not equal")
+		assert.NotEqual(t, nil, ParseHashTagRules([]string{"^(a)(b)"}), "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestHashTagRules case %d.\n", nr)
+		nr++
+
+		// the portion captured by the first rule matched is wrapped
+		assert.Equal(t, nil, ParseHashTagRules([]string{"^user:([^:]+):", "^order-([0-9]+)", "^(x*)y"}), "should be equal")
+		assert.Equal(t, "user:{1000}:profile", string(InjectHashTag([]byte("user:1000:profile"))), "should be equal")
+		assert.Equal(t, KeyToSlot("user:{1000}:profile"), KeyToSlot(string(InjectHashTag([]byte("user:1000:orders")))),
+			"should be equal")
+		assert.Equal(t, "order-{42}-items", string(InjectHashTag([]byte("order-42-items"))), "should be equal")
+		assert.Equal(t, "session:1", string(InjectHashTag([]byte("session:1"))), "should be equal")
+		assert.Equal(t, "user:{a}:1", string(InjectHashTag([]byte("user:{a}:1"))), "should be equal")
+		assert.Equal(t, "y", string(InjectHashTag([]byte("y"))), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestHashTagRules case %d.\n", nr)
+		nr++
+
+		// the keys of the command are wrapped by the rules
+		assert.Equal(t, nil, ParseHashTagRules([]string{"^user:([^:]+):"}), "should be equal")
+		ret, ok := InjectCommandHashTag("mset", [][]byte{[]byte("user:1:a"), []byte("1"), []byte("user:1:b"), []byte("2")})
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "user:{1}:a 1 user:{1}:b 2", string(bytes.Join(ret, []byte(" "))), "should be equal")
+	}
+}
+
+func TestFilterCommandSlot(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	args := func(strs ...string) [][]byte {
+		ret := make([][]byte, len(strs))
+		for i, s := range strs {
+			ret[i] = []byte(s)
+		}
+		return ret
+	}
+	// "b" is in slot 3300 and "a" is in slot 15495
+	conf.Options.FilterSlot = []string{"0-5460"}
+	f := filter.New(&conf.Options)
+
+	var nr int
+	{
+		fmt.Printf("TestFilterCommandSlot case %d.\n", nr)
+		nr++
+
+		ret, reject := FilterCommandSlot(f, "set", args("a", "1"))
+		assert.Equal(t, true, reject, "should be equal")
+		ret, reject = FilterCommandSlot(f, "set", args("b", "1"))
+		assert.Equal(t, false, reject, "should be equal")
+		assert.Equal(t, args("b", "1"), ret, "should be equal")
+		_, reject = FilterCommandSlot(f, "ping", nil)
+		assert.Equal(t, false, reject, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterCommandSlot case %d.\n", nr)
+		nr++
+
+		// the multi-key commands keep the keys in the slots given
+		ret, reject := FilterCommandSlot(f, "mset", args("a", "1", "b", "2", "{b}x", "3"))
+		assert.Equal(t, false, reject, "should be equal")
+		assert.Equal(t, args("b", "2", "{b}x", "3"), ret, "should be equal")
+		_, reject = FilterCommandSlot(f, "del", args("a", "{a}x"))
+		assert.Equal(t, true, reject, "should be equal")
+		_, reject = FilterCommandSlot(f, "sunionstore", args("b", "a"))
+		assert.Equal(t, false, reject, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterCommandSlot case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterSlot = nil
+		ret, reject := FilterCommandSlot(f, "set", args("a", "1"))
+		assert.Equal(t, false, reject, "should be equal")
+		assert.Equal(t, args("a", "1"), ret, "should be equal")
+	}
+}
+
+func TestAddressOptions(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+		TargetRoundRobin = 0
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestAddressOptions case %d.\n", nr)
+		nr++
+
+		err := setAddressList(false, "10.1.1.1:6379?password=x&tls=true&weight=2;10.1.1.2:6379")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []string{"10.1.1.1:6379", "10.1.1.2:6379"}, conf.Options.TargetAddressList, "should be equal")
+		assert.Equal(t, 1, len(conf.Options.TargetAddressOptions), "should be equal")
+		assert.Equal(t, 2, conf.Options.TargetAddressOptions["10.1.1.1:6379"].Weight, "should be equal")
+
+		options := conf.Options.TargetAddressOptions
+		assert.Equal(t, "x", AddressPassword(options, "10.1.1.1:6379", "def"), "should be equal")
+		assert.Equal(t, "def", AddressPassword(options, "10.1.1.2:6379", "def"), "should be equal")
+		assert.Equal(t, true, AddressTLS(options, "10.1.1.1:6379", false), "should be equal")
+		assert.Equal(t, false, AddressTLS(options, "10.1.1.2:6379", false), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAddressOptions case %d.\n", nr)
+		nr++
+
+		// the empty password overrides the default one
+		err := setAddressList(true, "10.1.1.1:6379?password=;10.1.1.2:6379?tls=false")
+		assert.Equal(t, nil, err, "should be equal")
+		options := conf.Options.SourceAddressOptions
+		assert.Equal(t, "", AddressPassword(options, "10.1.1.1:6379", "def"), "should be equal")
+		assert.Equal(t, false, AddressTLS(options, "10.1.1.2:6379", true), "should be equal")
+		assert.Equal(t, true, AddressTLS(options, "10.1.1.1:6379", true), "should be equal")
+
+		err = setAddressList(true, "10.1.1.1:6379")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 0, len(conf.Options.SourceAddressOptions), "should be equal")
+
+		// the parallelism and the rate of each source
+		err = setAddressList(true, "10.1.1.1:6379?parallel=8&sender_count=256&qps=1000;10.1.1.2:6379")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, conf.AddressOptions{Parallel: 8, SenderCount: 256, Qps: 1000},
+			conf.Options.SourceAddressOptions["10.1.1.1:6379"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAddressOptions case %d.\n", nr)
+		nr++
+
+		for _, address := range []string{
+			"10.1.1.1:6379?weight=2",     // weight of the source
+			"10.1.1.1:6379?tls=maybe",    // bad tls
+			"10.1.1.1:6379?db=1",         // unknown option
+			"10.1.1.1:6379?password=%zz", // bad escape
+			"10.1.1.1:6379?parallel=0",   // not positive
+			"10.1.1.1:6379?parallel=1025",
+			"10.1.1.1:6379?qps=x",
+		} {
+			assert.NotEqual(t, nil, setAddressList(true, address), "should be not equal")
+		}
+		assert.NotEqual(t, nil, setAddressList(false, "10.1.1.1:6379?qps=100"), "should be not equal")
+		assert.NotEqual(t, nil, setAddressList(false, "10.1.1.1:6379?weight=0"), "should be not equal")
+		assert.NotEqual(t, nil, setAddressList(false, "10.1.1.1:6379?weight=x"), "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestAddressOptions case %d.\n", nr)
+		nr++
+
+		targets := []string{"a", "b", "c"}
+		options := map[string]conf.AddressOptions{"b": {Weight: 3}}
+		TargetRoundRobin = 0
+		var picked []int
+		for i := 0; i < 10; i++ {
+			picked = append(picked, PickTargetWeighted(targets, options))
+		}
+		assert.Equal(t, []int{0, 1, 1, 1, 2, 0, 1, 1, 1, 2}, picked, "should be equal")
+
+		TargetRoundRobin = 0
+		picked = picked[:0]
+		for i := 0; i < 4; i++ {
+			picked = append(picked, PickTargetWeighted(targets, nil))
+		}
+		assert.Equal(t, []int{0, 1, 2, 0}, picked, "should be equal")
+	}
+}
+
+func TestParseShardMap(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestParseShardMap case %d.\n", nr)
+		nr++
+
+		mp, err := ParseShardMap("10.1.1.1:6379->10.2.1.1:6379;10.1.1.2:6379 -> 10.2.1.2:6379")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[string]string{
+			"10.1.1.1:6379": "10.2.1.1:6379",
+			"10.1.1.2:6379": "10.2.1.2:6379",
+		}, mp, "should be equal")
+
+		// several sources can be merged into one target
+		mp, err = ParseShardMap("a:1->c:1,b:1->c:1")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[string]string{"a:1": "c:1", "b:1": "c:1"}, mp, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestParseShardMap case %d.\n", nr)
+		nr++
+
+		for _, input := range []string{"a:1->c:1;a:1->d:1", "a:1:c:1", "a:1->", "->c:1", "a:1->b:1->c:1"} {
+			_, err := ParseShardMap(input)
+			assert.NotEqual(t, nil, err, "should be not equal")
+		}
+	}
+}
+
+func TestCommandRename(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestCommandRename case %d.\n", nr)
+		nr++
+
+		mp, err := ParseCommandRename("CONFIG->xconfig; psync -> PSYNC_abc")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[string]string{"config": "xconfig", "psync": "PSYNC_abc"}, mp, "should be equal")
+
+		for _, input := range []string{"config->a;Config->b", "config->", "->a", "config", "a->b->c", "a->b c"} {
+			_, err := ParseCommandRename(input)
+			assert.NotEqual(t, nil, err, "should be not equal")
+		}
+
+		conf.Options.CommandRename = mp
+		assert.Equal(t, "xconfig", RenameCommand("Config"), "should be equal")
+		assert.Equal(t, "set", RenameCommand("set"), "should be equal")
+		assert.Equal(t, "", RenameCommand(""), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCommandRename case %d.\n", nr)
+		nr++
+
+		// the commands sent by the connection opened are renamed
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err, "should be equal")
+		defer l.Close()
+		commands := make(chan string, 10)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			for {
+				resp, err := redis.Decode(br)
+				if err != nil {
+					return
+				}
+				cmd, _, _ := redis.ParseArgs(resp)
+				commands <- cmd
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}()
+
+		conf.Options.CommandRename = map[string]string{"config": "xconfig", "replconf": "xreplconf"}
+		c := OpenRedisConnSoft([]string{l.Addr().String()}, "auth", "", time.Second, time.Second, false, nil)
+		assert.NotEqual(t, nil, c, "should be not equal")
+		defer c.Close()
+		_, err = c.Do("config", "get", "maxmemory")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, c.Send("set", "a", "1"), "should be equal")
+		_, err = c.Do("")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "xconfig", <-commands, "should be equal")
+		assert.Equal(t, "set", <-commands, "should be equal")
+
+		// the raw command of the replication
+		var b bytes.Buffer
+		bw := bufio.NewWriter(&b)
+		assert.Equal(t, nil, SendPSyncAck(bw, 100), "should be equal")
+		bw.Flush()
+		assert.Equal(t, "*3\r\n$9\r\nxreplconf\r\n$3\r\nack\r\n$3\r\n100\r\n", b.String(), "should be equal")
+	}
+}
+
+func TestAddressMap(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestAddressMap case %d.\n", nr)
+		nr++
+
+		mp, err := ParseAddressMap("10.0.0.1:6379->1.2.3.4:16379; 10.0.0.2 -> 1.2.3.5")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, map[string]string{"10.0.0.1:6379": "1.2.3.4:16379", "10.0.0.2": "1.2.3.5"}, mp,
+			"should be equal")
+
+		for _, input := range []string{"a:1->b:1;a:1->c:1", "a:1->b", "a->b:1", "a:1->", "a->b->c"} {
+			_, err := ParseAddressMap(input)
+			assert.NotEqual(t, nil, err, "should be not equal")
+		}
+	}
+
+	{
+		fmt.Printf("TestAddressMap case %d.\n", nr)
+		nr++
+
+		// the address is mapped first, then the ip
+		conf.Options.AddressMap = map[string]string{"10.0.0.1:6379": "1.2.3.4:16379", "10.0.0.1": "1.2.3.4",
+			"10.0.0.2": "1.2.3.5"}
+		assert.Equal(t, "1.2.3.4:16379", MapAddress("10.0.0.1:6379"), "should be equal")
+		assert.Equal(t, "1.2.3.4:6380", MapAddress("10.0.0.1:6380"), "should be equal")
+		assert.Equal(t, "1.2.3.5:6379", MapAddress("10.0.0.2:6379"), "should be equal")
+		assert.Equal(t, "10.0.0.3:6379", MapAddress("10.0.0.3:6379"), "should be equal")
+
+		kind, addr, ok := ParseRedirect(redigo.Error("MOVED 3999 10.0.0.2:6381"))
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, RedirectMoved, kind, "should be equal")
+		assert.Equal(t, "1.2.3.5:6381", addr, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestAddressMap case %d.\n", nr)
+		nr++
+
+		// the masters of the cluster announcing the internal ips are discovered by the mapped addresses
+		seed := startFakeClusterNode(t)
+		defer seed.Close()
+		addr := seed.Addr().String()
+		slotRange := func(start, end int, ip string, port int) string {
+			return fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n$%d\r\n%s\r\n:%d\r\n$2\r\nid\r\n", start, end,
+				len(ip), ip, port)
+		}
+		seed.mu.Lock()
+		seed.nodes = "a 10.0.0.1:6379@16379 myself,master - 0 0 1 connected 0-8191\n" +
+			"b 10.0.0.2:7002@17002 master - 0 0 2 connected 8192-16383\n"
+		seed.slots = "*2\r\n" + slotRange(0, 8191, "10.0.0.1", 6379) + slotRange(8192, 16383, "10.0.0.2", 7002)
+		seed.mu.Unlock()
+		conf.Options.AddressMap = map[string]string{"10.0.0.1:6379": addr, "10.0.0.2": "127.0.0.1"}
+		masters, err := discoverClusterMasters(addr)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []string{addr, "127.0.0.1:7002"}, masters, "should be equal")
+	}
+}
+
+func TestProxyCommand(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestProxyCommand case %d.\n", nr)
+		nr++
+
+		for cmd, expected := range map[string]string{"set": "set", "UNLINK": "del", "restore-asking": "restore",
+			"msetnx": "mset", "MSETNX": "mset"} {
+			translated, ok := ProxyCommand(cmd)
+			assert.Equal(t, true, ok, "should be equal")
+			assert.Equal(t, expected, translated, "should be equal")
+		}
+		for _, cmd := range []string{"select", "MULTI", "exec", "flushall", "rename", "publish"} {
+			_, ok := ProxyCommand(cmd)
+			assert.Equal(t, false, ok, "should be equal")
+		}
+	}
+
+	{
+		fmt.Printf("TestProxyCommand case %d.\n", nr)
+		nr++
+
+		var counts CommandCounts
+		assert.Equal(t, "", counts.Summary(), "should be equal")
+		assert.Equal(t, true, counts.Incr("MULTI"), "should be equal")
+		assert.Equal(t, false, counts.Incr("multi"), "should be equal")
+		assert.Equal(t, true, counts.Incr("exec"), "should be equal")
+		assert.Equal(t, map[string]int64{"multi": 2, "exec": 1}, counts.Counts(), "should be equal")
+		assert.Equal(t, "exec=1 multi=2", counts.Summary(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestProxyCommand case %d.\n", nr)
+		nr++
+
+		// the proxy target has db 0 only, it's never selected
+		conf.Options.TargetType = conf.RedisTypeProxy
+		open := func() redigo.Conn {
+			t.Fatal("the proxy target shouldn't be connected")
+			return nil
+		}
+		conf.Options.TargetDBOutOfRange = conf.DBOutOfRangeSkip
+		dc := NewTargetDBChecker(&conf.Options, open)
+		_, pass := dc.Map(1)
+		assert.Equal(t, false, pass, "should be equal")
+		db, pass := dc.Map(0)
+		assert.Equal(t, true, pass, "should be equal")
+		assert.Equal(t, 0, db, "should be equal")
+
+		conf.Options.TargetDBOutOfRange = conf.DBOutOfRangeRemap
+		dc = NewTargetDBChecker(&conf.Options, open)
+		db, pass = dc.Map(2)
+		assert.Equal(t, true, pass, "should be equal")
+		assert.Equal(t, 0, db, "should be equal")
+	}
+}
+
+// write the self-signed certificate of 127.0.0.1 and its key into the dir
+func writeSelfSignedCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err, "should be equal")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err, "should be equal")
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, nil, err, "should be equal")
+
+	certFile, keyFile := dir+"/"+name+".crt", dir+"/"+name+".key"
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.Equal(t, nil, err, "should be equal")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	assert.Equal(t, nil, err, "should be equal")
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	oldSource, oldTarget := SourceTLSConfig, TargetTLSConfig
+	defer func() {
+		SourceTLSConfig, TargetTLSConfig = oldSource, oldTarget
+	}()
+
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+	serverCert, serverKey := writeSelfSignedCert(t, dir, "server")
+	clientCert, clientKey := writeSelfSignedCert(t, dir, "client")
+
+	// the server asks for the client certificate issued by the client ca
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	assert.Equal(t, nil, err, "should be equal")
+	clientCA, err := NewTLSConfig(TLSOptions{CaFile: clientCert})
+	assert.Equal(t, nil, err, "should be equal")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCA.RootCAs,
+	})
+	assert.Equal(t, nil, err, "should be equal")
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// handshake, then close
+			go func(c net.Conn) {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}(c)
+		}
+	}()
+	addr := l.Addr().String()
+
+	var nr int
+	{
+		fmt.Printf("TestTLSConfig case %d.\n", nr)
+		nr++
+
+		_, err := NewTLSConfig(TLSOptions{CaFile: dir + "/none.crt"})
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = NewTLSConfig(TLSOptions{CaFile: serverKey})
+		assert.Equal(t, fmt.Sprintf("no certificate is found in [%v]", serverKey), fmt.Sprint(err),
+			"should be equal")
+		_, err = NewTLSConfig(TLSOptions{CertFile: clientCert})
+		assert.Equal(t, "cert file and key file should be given together", fmt.Sprint(err), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestTLSConfig case %d.\n", nr)
+		nr++
+
+		// the self-signed server certificate isn't in the system roots
+		TargetTLSConfig, err = NewTLSConfig(TLSOptions{CertFile: clientCert, KeyFile: clientKey})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, OpenNetConnSoft(addr, "auth", "", TargetTLS(true)), "should be equal")
+		assert.Equal(t, (*tls.Config)(nil), TargetTLS(false), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestTLSConfig case %d.\n", nr)
+		nr++
+
+		// the ca and the client certificate of the target
+		TargetTLSConfig, err = NewTLSConfig(TLSOptions{CaFile: serverCert, CertFile: clientCert, KeyFile: clientKey})
+		assert.Equal(t, nil, err, "should be equal")
+		c := OpenNetConnSoft(addr, "auth", "", TargetTLS(true))
+		assert.NotEqual(t, nil, c, "should be not equal")
+		c.Close()
+
+		// the ca of the target isn't trusted by the source
+		SourceTLSConfig, err = NewTLSConfig(TLSOptions{CertFile: clientCert, KeyFile: clientKey})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, OpenNetConnSoft(addr, "auth", "", SourceTLS(true)), "should be equal")
+
+		// nor the client certificate of the target is sent to the source
+		SourceTLSConfig, err = NewTLSConfig(TLSOptions{CaFile: serverCert})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 0, len(SourceTLS(true).Certificates), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestTLSConfig case %d.\n", nr)
+		nr++
+
+		// the server certificate isn't verified, but the client certificate is still required
+		SourceTLSConfig, err = NewTLSConfig(TLSOptions{SkipVerify: true, CertFile: clientCert, KeyFile: clientKey})
+		assert.Equal(t, nil, err, "should be equal")
+		c := OpenNetConnSoft(addr, "auth", "", SourceTLS(true))
+		assert.NotEqual(t, nil, c, "should be not equal")
+		c.Close()
+
+		// skip_verify of the source doesn't apply to the target
+		TargetTLSConfig, err = NewTLSConfig(TLSOptions{CertFile: clientCert, KeyFile: clientKey})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, nil, OpenNetConnSoft(addr, "auth", "", TargetTLS(true)), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestTLSConfig case %d.\n", nr)
+		nr++
+
+		// the files referenced in vault are fetched again once secrets.refresh_sec passes
+		oldOptions := conf.Options
+		restoreEnv := clearEnv("VAULT_ADDR", "VAULT_TOKEN", "VAULT_NAMESPACE")
+		defer func() {
+			conf.Options = oldOptions
+			restoreEnv()
+		}()
+		read := func(file string) string {
+			content, err := ioutil.ReadFile(file)
+			assert.Equal(t, nil, err, "should be equal")
+			return string(content)
+		}
+		newServerCert, newServerKey := writeSelfSignedCert(t, dir, "server2")
+		newClientCert, newClientKey := writeSelfSignedCert(t, dir, "client2")
+
+		var mu sync.Mutex
+		secret := map[string]string{"ca": read(serverCert), "cert": read(clientCert), "key": read(clientKey)}
+		vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			body, _ := json.Marshal(map[string]interface{}{"data": secret})
+			w.Write(body)
+		}))
+		defer vault.Close()
+		os.Setenv("VAULT_ADDR", vault.URL)
+		os.Setenv("VAULT_TOKEN", "root")
+
+		// the server whose certificate is rotated, the name of the client certificate is recorded
+		serverPair := pair
+		newPair, err := tls.LoadX509KeyPair(newServerCert, newServerKey)
+		assert.Equal(t, nil, err, "should be equal")
+		clients := make(chan string, 10)
+		rl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return &serverPair, nil
+			},
+			ClientAuth: tls.RequireAnyClientCert,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				cert, err := x509.ParseCertificate(rawCerts[0])
+				if err == nil {
+					clients <- cert.Subject.CommonName
+				}
+				return err
+			},
+		})
+		assert.Equal(t, nil, err, "should be equal")
+		defer rl.Close()
+		go func() {
+			for {
+				c, err := rl.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					c.(*tls.Conn).Handshake()
+					c.Close()
+				}(c)
+			}
+		}()
+		connect := func(config *tls.Config) string {
+			c := OpenNetConnSoft(rl.Addr().String(), "auth", "", config)
+			if c == nil {
+				return ""
+			}
+			defer c.Close()
+			select {
+			case name := <-clients:
+				return name
+			case <-time.After(3 * time.Second):
+				return "timeout"
+			}
+		}
+
+		side := TLSOptions{CaFile: "vault://kv/tls#ca", CertFile: "vault://kv/tls#cert", KeyFile: "vault://kv/tls#key"}
+		conf.Options.SecretsRefreshSec = 60
+		cached, err := NewTLSConfig(side)
+		assert.Equal(t, nil, err, "should be equal")
+		conf.Options.SecretsRefreshSec = 0
+		refreshed, err := NewTLSConfig(side)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "client", connect(cached), "should be equal")
+		assert.Equal(t, "client", connect(refreshed), "should be equal")
+
+		// rotated
+		mu.Lock()
+		serverPair = newPair
+		secret = map[string]string{"ca": read(newServerCert), "cert": read(newClientCert), "key": read(newClientKey)}
+		mu.Unlock()
+		assert.Equal(t, "client2", connect(refreshed), "should be equal")
+		// the old ca doesn't verify the new server certificate
+		assert.Equal(t, "", connect(cached), "should be equal")
+
+		// the previous files are used if the store fails
+		vault.Close()
+		assert.Equal(t, "client2", connect(refreshed), "should be equal")
+	}
+}
+
+func TestSSHTunnel(t *testing.T) {
+	oldTunnel, oldCommand := SSHTunnel, sshCommand
+	defer func() {
+		SSHTunnel, sshCommand = oldTunnel, oldCommand
+	}()
+
+	dir, err := ioutil.TempDir("", "ssh")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+	// fake ssh client which records the arguments and the passphrase, and then echoes the input
+	sshCommand = dir + "/ssh"
+	err = ioutil.WriteFile(sshCommand, []byte("#!/bin/sh\necho \"$@\" > "+dir+"/args\n"+
+		"if [ -n \"$SSH_ASKPASS\" ]; then \"$SSH_ASKPASS\" > "+dir+"/passphrase; fi\n"+
+		"if [ \"$2\" = \"10.0.0.9:6379\" ]; then echo 'channel 0: open failed' >&2; exit 255; fi\n"+
+		"exec cat\n"), 0700)
+	assert.Equal(t, nil, err, "should be equal")
+
+	var nr int
+	{
+		fmt.Printf("TestSSHTunnel case %d.\n", nr)
+		nr++
+
+		_, err := NewSSHTunnel("root@", "", "", nil)
+		assert.Equal(t, "bastion host is empty", fmt.Sprint(err), "should be equal")
+		_, err = NewSSHTunnel("bastion", "", "", []string{"[a-"})
+		assert.NotEqual(t, nil, err, "should be not equal")
+
+		tunnel, err := NewSSHTunnel("bastion", "", "", []string{"10.0.0.0/8", "*.internal"})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, tunnel.Match("10.1.2.3:6379"), "should be equal")
+		assert.Equal(t, true, tunnel.Match("redis.internal:6379"), "should be equal")
+		assert.Equal(t, false, tunnel.Match("11.1.2.3:6379"), "should be equal")
+		assert.Equal(t, false, tunnel.Match("127.0.0.1:6379"), "should be equal")
+
+		tunnel, err = NewSSHTunnel("bastion", "", "", nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, tunnel.Match("127.0.0.1:6379"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSSHTunnel case %d.\n", nr)
+		nr++
+
+		// the connection talks with the address through the ssh client
+		SSHTunnel, err = NewSSHTunnel("root@bastion:2222", "/key", "secret", []string{"10.0.0.0/8"})
+		assert.Equal(t, nil, err, "should be equal")
+		c, err := dialConn(&net.Dialer{Timeout: 3 * time.Second, KeepAlive: 10 * time.Second}, "10.0.0.1:6379",
+			nil)
+		assert.Equal(t, nil, err, "should be equal")
+		// cat replies the command itself
+		reply, err := redigo.NewConn(c, time.Second, time.Second).Do("ping")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []interface{}{[]byte("ping")}, reply, "should be equal")
+		assert.Equal(t, "10.0.0.1:6379", c.RemoteAddr().String(), "should be equal")
+		// the passphrase is given to the ssh client only, and the askpass script is removed by the close
+		assert.Equal(t, "", os.Getenv("REDIS_SHAKE_SSH_PASSPHRASE"), "should be equal")
+		askpass := c.(*tunnelConn).askpass
+		_, err = os.Stat(askpass)
+		assert.Equal(t, nil, err, "should be equal")
+		c.Close()
+		_, err = os.Stat(askpass)
+		assert.Equal(t, true, os.IsNotExist(err), "should be equal")
+
+		args, err := ioutil.ReadFile(dir + "/args")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "-W 10.0.0.1:6379 -o ExitOnForwardFailure=yes -o ConnectTimeout=3 "+
+			"-o ServerAliveInterval=10 -l root -p 2222 -i /key bastion\n", string(args), "should be equal")
+		passphrase, err := ioutil.ReadFile(dir + "/passphrase")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "secret\n", string(passphrase), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSSHTunnel case %d.\n", nr)
+		nr++
+
+		// the error of ssh is returned by the read
+		c, err := dialConn(&net.Dialer{}, "10.0.0.9:6379", nil)
+		assert.Equal(t, nil, err, "should be equal")
+		askpass := c.(*tunnelConn).askpass
+		_, err = c.Read(make([]byte, 1))
+		assert.Equal(t, "ssh tunnel to [10.0.0.9:6379] exited: channel 0: open failed", fmt.Sprint(err),
+			"should be equal")
+		// removed once ssh exits
+		_, err = os.Stat(askpass)
+		assert.Equal(t, true, os.IsNotExist(err), "should be equal")
+		c.Close()
+
+		// the address not matched is dialed directly
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err, "should be equal")
+		defer l.Close()
+		c, err = dialConn(&net.Dialer{}, l.Addr().String(), nil)
+		assert.Equal(t, nil, err, "should be equal")
+		_, ok := c.(*net.TCPConn)
+		assert.Equal(t, true, ok, "should be equal")
+		c.Close()
+	}
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	old := Socks5Proxy
+	defer func() {
+		Socks5Proxy = old
+	}()
+
+	// fake socks5 proxy accepting user "u" with password "p", the connection echoes after CONNECT
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	defer l.Close()
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				head := make([]byte, 3)
+				io.ReadFull(br, head)
+				c.Write([]byte{5, head[2]})
+				if head[2] == 2 {
+					br.ReadByte() // version
+					ulen, _ := br.ReadByte()
+					user := make([]byte, ulen)
+					io.ReadFull(br, user)
+					plen, _ := br.ReadByte()
+					password := make([]byte, plen)
+					io.ReadFull(br, password)
+					if string(user) != "u" || string(password) != "p" {
+						c.Write([]byte{1, 1})
+						return
+					}
+					c.Write([]byte{1, 0})
+				}
+				req := make([]byte, 5)
+				io.ReadFull(br, req)
+				var host string
+				switch req[3] {
+				case 1:
+					ip := make([]byte, 3)
+					io.ReadFull(br, ip)
+					host = net.IP(append(req[4:5], ip...)).String()
+				case 3:
+					name := make([]byte, req[4])
+					io.ReadFull(br, name)
+					host = string(name)
+				}
+				port := make([]byte, 2)
+				io.ReadFull(br, port)
+				address := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+				requests <- address
+				if port[1] == 1 {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				c.Write([]byte{5, 0, 0, 3, 5, 'p', 'r', 'o', 'x', 'y', 0, 1})
+				io.Copy(c, br)
+			}(c)
+		}
+	}()
+	proxy := l.Addr().String()
+
+	var nr int
+	{
+		fmt.Printf("TestSocks5Proxy case %d.\n", nr)
+		nr++
+
+		_, err := NewSocks5Proxy("u:p@localhost", nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = NewSocks5Proxy(":p@localhost:1080", nil)
+		assert.Equal(t, "the user and the password should be 1 to 255 bytes", fmt.Sprint(err), "should be equal")
+		s, err := NewSocks5Proxy("localhost:1080", []string{"10.0.0.0/8"})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, s.Match("10.0.0.1:6379"), "should be equal")
+		assert.Equal(t, false, s.Match("127.0.0.1:6379"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSocks5Proxy case %d.\n", nr)
+		nr++
+
+		// the host name is resolved by the proxy
+		Socks5Proxy, err = NewSocks5Proxy("u:p@"+proxy, []string{"*.internal", "10.0.0.0/8"})
+		assert.Equal(t, nil, err, "should be equal")
+		for _, address := range []string{"redis.internal:6379", "10.0.0.1:6380"} {
+			c, err := dialConn(&net.Dialer{Timeout: time.Second}, address, nil)
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, address, <-requests, "should be equal")
+			reply, err := redigo.NewConn(c, time.Second, time.Second).Do("ping")
+			assert.Equal(t, nil, err, "should be equal")
+			assert.Equal(t, []interface{}{[]byte("ping")}, reply, "should be equal")
+			c.Close()
+		}
+	}
+
+	{
+		fmt.Printf("TestSocks5Proxy case %d.\n", nr)
+		nr++
+
+		_, err := dialConn(&net.Dialer{Timeout: time.Second}, "redis.internal:1", nil)
+		assert.Equal(t, fmt.Sprintf("socks5 proxy[%v] connect to [redis.internal:1] failed: connection refused",
+			proxy), fmt.Sprint(err), "should be equal")
+		<-requests
+
+		Socks5Proxy, err = NewSocks5Proxy("u:x@"+proxy, nil)
+		assert.Equal(t, nil, err, "should be equal")
+		_, err = dialConn(&net.Dialer{Timeout: time.Second}, "redis.internal:6379", nil)
+		assert.Equal(t, fmt.Sprintf("socks5 proxy[%v] connect to [redis.internal:6379] failed: authentication failed",
+			proxy), fmt.Sprint(err), "should be equal")
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestWithTimeout case %d.\n", nr)
+		nr++
+
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		assert.Equal(t, client, WithTimeout(client, 0, 0), "should be equal")
+
+		// the deadline is pushed back by each read
+		c := WithTimeout(client, 100*time.Millisecond, 0)
+		go func() {
+			for i := 0; i < 3; i++ {
+				time.Sleep(60 * time.Millisecond)
+				server.Write([]byte("a"))
+			}
+		}()
+		p := make([]byte, 1)
+		for i := 0; i < 3; i++ {
+			_, err := c.Read(p)
+			assert.Equal(t, nil, err, "should be equal")
+		}
+		_, err := c.Read(p)
+		e, ok := err.(net.Error)
+		assert.Equal(t, true, ok && e.Timeout(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestWithTimeout case %d.\n", nr)
+		nr++
+
+		conf.Options.DialTimeoutMs = 1500
+		conf.Options.KeepAlive = 30
+		d := newDialer()
+		assert.Equal(t, 1500*time.Millisecond, d.Timeout, "should be equal")
+		assert.Equal(t, 30*time.Second, d.KeepAlive, "should be equal")
+	}
+}
+
+func TestDialDirect(t *testing.T) {
+	old := conf.Options
+	oldLookup := lookupIPAddr
+	defer func() {
+		conf.Options = old
+		lookupIPAddr = oldLookup
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestDialDirect case %d.\n", nr)
+		nr++
+
+		addrs := []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fe80::1")},
+			{IP: net.ParseIP("10.0.0.2")}}
+		assert.Equal(t, []net.IP{addrs[0].IP, addrs[1].IP, addrs[2].IP, addrs[3].IP}, preferFamily(addrs, ""),
+			"should be equal")
+		assert.Equal(t, []net.IP{addrs[1].IP, addrs[3].IP, addrs[0].IP, addrs[2].IP},
+			preferFamily(addrs, conf.AddressFamilyIPv4), "should be equal")
+		assert.Equal(t, []net.IP{addrs[0].IP, addrs[2].IP, addrs[1].IP, addrs[3].IP},
+			preferFamily(addrs, conf.AddressFamilyIPv6), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDialDirect case %d.\n", nr)
+		nr++
+
+		// the host is resolved on each dial, and the ip refused is skipped
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err, "should be equal")
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+
+		var lookups int
+		resolved := []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}}
+		lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			lookups++
+			assert.Equal(t, "redis.example", host, "should be equal")
+			return resolved, nil
+		}
+		conf.Options.DialTimeoutMs = 1000
+		c, err := dialDirect(newDialer(), "redis.example:"+port)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, l.Addr().String(), c.RemoteAddr().String(), "should be equal")
+		c.Close()
+
+		// the ip switched on failover
+		resolved = []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}}
+		_, err = dialDirect(newDialer(), "redis.example:"+port)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		assert.Equal(t, 2, lookups, "should be equal")
+
+		// the ip isn't resolved
+		_, err = dialDirect(newDialer(), l.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 2, lookups, "should be equal")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	defer func() {
+		ProxyProtocol = nil
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestProxyHeader case %d.\n", nr)
+		nr++
+
+		_, err := NewProxyHeader("v3", nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = NewProxyHeader(conf.ProxyProtocolV1, []string{"["})
+		assert.NotEqual(t, nil, err, "should be not equal")
+		p, err := NewProxyHeader(conf.ProxyProtocolV2, []string{"10.0.0.0/8"})
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, p.Match("10.1.1.1:6379"), "should be equal")
+		assert.Equal(t, false, p.Match("192.168.1.1:6379"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestProxyHeader case %d.\n", nr)
+		nr++
+
+		src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+		dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6379}
+		src6 := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 50000}
+		dst6 := &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 6379}
+		assert.Equal(t, "PROXY TCP4 10.0.0.1 10.0.0.2 50000 6379\r\n", string(proxyHeaderV1(src, dst)), "should be equal")
+		assert.Equal(t, "PROXY TCP6 fe80::1 fe80::2 50000 6379\r\n", string(proxyHeaderV1(src6, dst6)),
+			"should be equal")
+		// unknown or mixed families
+		assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeaderV1(nil, nil)), "should be equal")
+		assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeaderV1(src, dst6)), "should be equal")
+
+		header := proxyHeaderV2(src, dst)
+		assert.Equal(t, proxyV2Signature, header[:12], "should be equal")
+		assert.Equal(t, []byte{0x21, 0x11, 0, 12, 10, 0, 0, 1, 10, 0, 0, 2, 0xc3, 0x50, 0x18, 0xeb}, header[12:],
+			"should be equal")
+		header = proxyHeaderV2(src6, dst6)
+		assert.Equal(t, []byte{0x21, 0x21, 0, 36}, header[12:16], "should be equal")
+		assert.Equal(t, 16+36, len(header), "should be equal")
+		assert.Equal(t, []byte{0x20, 0x00, 0, 0}, proxyHeaderV2(nil, nil)[12:], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestProxyHeader case %d.\n", nr)
+		nr++
+
+		// the header is the first bytes of the connection
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err, "should be equal")
+		defer l.Close()
+		received := make(chan string, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			received <- line
+		}()
+
+		ProxyProtocol, _ = NewProxyHeader(conf.ProxyProtocolV1, nil)
+		c, err := dialConn(&net.Dialer{Timeout: time.Second}, l.Addr().String(), nil)
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+		local := c.LocalAddr().(*net.TCPAddr)
+		assert.Equal(t, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", local.Port,
+			l.Addr().(*net.TCPAddr).Port), <-received, "should be equal")
+	}
+}
+
+func TestPassword(t *testing.T) {
+	// test LoadPasswordKey, EncodePassword and DecodePassword
+
+	key := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // 32 bytes
+
+	var nr int
+	{
+		fmt.Printf("TestPassword case %d.\n", nr)
+		nr++
+
+		ret, err := LoadPasswordKey("", "")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []byte(nil), ret, "should be equal")
+		ret, err = LoadPasswordKey(key, "")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), ret, "should be equal")
+
+		// not base64, or the size isn't of AES
+		_, err = LoadPasswordKey("!!", "")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = LoadPasswordKey("YWJj", "")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = LoadPasswordKey(key, "/tmp/key")
+		assert.NotEqual(t, nil, err, "should be not equal")
+
+		// the key file with the line break
+		f, err := ioutil.TempFile("", "password-key")
+		assert.Equal(t, nil, err, "should be equal")
+		defer os.Remove(f.Name())
+		f.WriteString(key + "\n")
+		f.Close()
+		ret, err = LoadPasswordKey("", f.Name())
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []byte("0123456789abcdef0123456789abcdef"), ret, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestPassword case %d.\n", nr)
+		nr++
+
+		encoded, err := EncodePassword(conf.PasswordEncodingBase64, "p@ss", nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "base64:cEBzcw==", encoded, "should be equal")
+		password, err := DecodePassword(encoded, nil)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "p@ss", password, "should be equal")
+
+		_, err = DecodePassword("cEBzcw==", nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = DecodePassword("rot13:cEBzcw==", nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = EncodePassword("rot13", "p@ss", nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestPassword case %d.\n", nr)
+		nr++
+
+		k, _ := LoadPasswordKey(key, "")
+		encoded, err := EncodePassword(conf.PasswordEncodingAESGCM, "p@ss", k)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, true, strings.HasPrefix(encoded, "aes-gcm:"), "should be equal")
+		// the nonce is random
+		another, _ := EncodePassword(conf.PasswordEncodingAESGCM, "p@ss", k)
+		assert.NotEqual(t, encoded, another, "should be not equal")
+
+		password, err := DecodePassword(encoded, k)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "p@ss", password, "should be equal")
+
+		// no key, the wrong key, or the data is broken
+		_, err = DecodePassword(encoded, nil)
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = DecodePassword(encoded, []byte("0123456789abcdef"))
+		assert.NotEqual(t, nil, err, "should be not equal")
+		_, err = DecodePassword("aes-gcm:YWJj", k)
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+}
+
+func TestByteLimiter(t *testing.T) {
+	// test ByteLimiter, LimitReadConn and LimitRedisConn
+
+	var nr int
+	{
+		fmt.Printf("TestByteLimiter case %d.\n", nr)
+		nr++
+
+		assert.Equal(t, (*ByteLimiter)(nil), NewByteLimiter(0), "should be equal")
+		assert.Equal(t, int64(1250000), MbpsToBytes(10), "should be equal")
+		var l *ByteLimiter
+		l.Wait(100) // no limit
+	}
+
+	{
+		fmt.Printf("TestByteLimiter case %d.\n", nr)
+		nr++
+
+		// the bytes beyond the burst are borrowed and slept for
+		now := time.Unix(1000, 0)
+		var slept []time.Duration
+		l := NewByteLimiter(100000)
+		l.now = func() time.Time { return now }
+		l.sleep = func(d time.Duration) { slept = append(slept, d) }
+		l.last = now
+
+		l.Wait(10000)
+		assert.Equal(t, []time.Duration{100 * time.Millisecond}, slept, "should be equal")
+		// the next caller waits for the one borrowed before as well
+		l.Wait(5000)
+		assert.Equal(t, 150*time.Millisecond, slept[1], "should be equal")
+
+		// refilled after 1 second, but saved at most 100ms of the rate
+		now = now.Add(time.Second)
+		slept = nil
+		l.Wait(10000)
+		assert.Equal(t, 0, len(slept), "should be equal")
+		l.Wait(10000)
+		assert.Equal(t, []time.Duration{100 * time.Millisecond}, slept, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestByteLimiter case %d.\n", nr)
+		nr++
+
+		// the bytes read and the commands sent are taken
+		var taken int
+		l := NewByteLimiter(1 << 30)
+		l.sleep = func(d time.Duration) {}
+		l.now = func() time.Time { return l.last }
+		l.tokens = l.burst
+
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go server.Write([]byte("+OK\r\n"))
+		c := LimitReadConn(client, l)
+		p := make([]byte, 16)
+		n, err := c.Read(p)
+		assert.Equal(t, nil, err, "should be equal")
+		taken = int(l.burst - l.tokens)
+		assert.Equal(t, n, taken, "should be equal")
+
+		go func() {
+			br := bufio.NewReader(server)
+			for {
+				if _, err := redis.Decode(br); err != nil {
+					return
+				}
+				server.Write([]byte("+OK\r\n"))
+			}
+		}()
+		rc := LimitRedisConn(redigo.NewConn(client, time.Second, time.Second), l)
+		_, err = rc.Do("set", "key", []byte("value"))
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, commandSize("set", []interface{}{"key", []byte("value")}), int(l.burst-l.tokens)-taken,
+			"should be equal")
+		assert.Equal(t, 3+16+3+16+5+16, commandSize("set", []interface{}{"key", []byte("value")}), "should be equal")
+	}
+}
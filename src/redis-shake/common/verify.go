@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+
+	"pkg/libs/log"
+	"pkg/rdb"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	VerifyMatch = iota
+	VerifyMismatch
+	VerifyMissing
+	VerifySkip // the key split by the loader which can't be compared by parts, only hash is compared
+
+	// the fields of the split hash compared by each HMGET
+	verifyHashBatch = 100
+
+	// rdb version(2 bytes) and crc(8 bytes) at the end of the DUMP payload
+	dumpFooterSize = 10
+)
+
+// drop the footer so the target with another rdb version still matches
+func dumpBody(p []byte) []byte {
+	if len(p) < dumpFooterSize {
+		return p
+	}
+	return p[:len(p)-dumpFooterSize]
+}
+
+/*
+ * VerifyRdbEntry compares the entry with the DUMP of the same key on the target without
+ * writing anything. The value larger than big_key_threshold is compared by the sha1 of the
+ * payload, and the value of the entry is released before the DUMP so that only one of the
+ * payloads is held at a time. The hash split by the loader is compared by parts, see
+ * verifySplitHash.
+ */
+func VerifyRdbEntry(c redigo.Conn, e *rdb.BinEntry) int {
+	if e.RealMemberCount != 0 {
+		if e.Type != rdb.RdbTypeHash {
+			return VerifySkip
+		}
+		return verifySplitHash(c, e)
+	}
+
+	var digest [sha1.Size]byte
+	big := uint64(len(e.Value)) > conf.Options.BigKeyThreshold
+	if big {
+		digest = sha1.Sum(dumpBody(e.Value))
+		e.Value = nil
+	}
+
+	reply, err := c.Do("dump", e.Key)
+	if err != nil {
+		log.PanicErrorf(err, "dump key[%s] from target failed", e.Key)
+	}
+	if reply == nil {
+		return VerifyMissing
+	}
+	payload, err := redigo.Bytes(reply, nil)
+	if err != nil {
+		log.PanicErrorf(err, "parse the dump of key[%s] failed", e.Key)
+	}
+
+	if big {
+		if sha1.Sum(dumpBody(payload)) == digest {
+			return VerifyMatch
+		}
+	} else if bytes.Equal(dumpBody(payload), dumpBody(e.Value)) {
+		return VerifyMatch
+	}
+	return VerifyMismatch
+}
+
+// compare the fields in the part of the split hash by HMGET, the first part also compares the
+// length by HLEN. The result is of the part only, the caller merges the results of all the parts.
+func verifySplitHash(c redigo.Conn, e *rdb.BinEntry) int {
+	typ, err := redigo.String(c.Do("type", e.Key))
+	if err != nil {
+		log.PanicErrorf(err, "get the type of key[%s] from target failed", e.Key)
+	}
+	switch typ {
+	case "none":
+		return VerifyMissing
+	case "hash":
+	default:
+		return VerifyMismatch
+	}
+
+	r := rdb.NewRdbReader(bytes.NewReader(e.Value))
+	if _, err := r.ReadByte(); err != nil {
+		log.PanicErrorf(err, "read the type of key[%s] failed", e.Key)
+	}
+	if e.NeedReadLen == 1 {
+		if _, err := r.ReadLength(); err != nil {
+			log.PanicErrorf(err, "read the length of key[%s] failed", e.Key)
+		}
+		n, err := redigo.Int64(c.Do("hlen", e.Key))
+		if err != nil {
+			log.PanicErrorf(err, "get the length of key[%s] from target failed", e.Key)
+		}
+		if n != int64(e.TotMemberCount) {
+			return VerifyMismatch
+		}
+	}
+
+	ret := VerifyMatch
+	args := []interface{}{e.Key}
+	var values [][]byte
+	for i := 0; i < int(e.RealMemberCount); i++ {
+		field, err := r.ReadString()
+		if err != nil {
+			log.PanicErrorf(err, "read the field of key[%s] failed", e.Key)
+		}
+		value, err := r.ReadString()
+		if err != nil {
+			log.PanicErrorf(err, "read the value of key[%s] failed", e.Key)
+		}
+		args = append(args, field)
+		values = append(values, value)
+		if len(values) < verifyHashBatch && i != int(e.RealMemberCount)-1 {
+			continue
+		}
+
+		replies, err := redigo.ByteSlices(c.Do("hmget", args...))
+		if err != nil {
+			log.PanicErrorf(err, "hmget key[%s] from target failed", e.Key)
+		}
+		for j := range values {
+			if j >= len(replies) || !bytes.Equal(replies[j], values[j]) {
+				ret = VerifyMismatch
+			}
+		}
+		args, values = args[:1], values[:0]
+	}
+	return ret
+}
@@ -15,19 +15,85 @@ type Configuration struct {
 	SourcePasswordRaw      string   `config:"source.password_raw"`
 	SourcePasswordEncoding string   `config:"source.password_encoding"`
 	SourceAuthType         string   `config:"source.auth_type"`
+	SourceAuthProvider     string   `config:"source.auth_provider"`
+	SourceSentinelPassword string   `config:"source.sentinel_password"`
+	SourceNoAuth           bool     `config:"source.no_auth"`
 	SourceTLSEnable        bool     `config:"source.tls_enable"`
+	SourceTLSCaFile        string   `config:"source.tls_ca_file"`
+	SourceTLSCertFile      string   `config:"source.tls_cert_file"`
+	SourceTLSKeyFile       string   `config:"source.tls_key_file"`
+	SourceTLSSkipVerify    bool     `config:"source.tls_skip_verify"`
 	SourceRdbInput         []string `config:"source.rdb.input"`
 	SourceRdbParallel      int      `config:"source.rdb.parallel"`
 	SourceRdbSpecialCloud  string   `config:"source.rdb.special_cloud"`
+	SourceRdbChecksum      bool     `config:"source.rdb_checksum"`
+	SourceRdbFile          string   `config:"source.rdb_file"`
+	SourceAofFile          string   `config:"source.aof_file"`
+	SourceFakeSlaveOffset  bool     `config:"source.fake_slave_offset"`
+	SourceOffsetInterval   uint     `config:"source.fake_slave_offset_interval"`
+	SourceMaxInflightBytes int64    `config:"source.max_inflight_bytes"`
+	SourceReplicaPort      int      `config:"source.replica_listening_port"`
+	SourceReconnectLimit   uint     `config:"source.reconnect_limit"`
+	SourceReconnectWindow  uint     `config:"source.reconnect_window"`
+	SourceSlotMigration    string   `config:"source.slot_migration"`
+	SourceClusterReadFrom  string   `config:"source.cluster_read_from"`
+	SourceReplicaMaxLag    uint     `config:"source.replica_max_lag_sec"`
+	SourceTimeoutMs        uint     `config:"source.timeout_ms"`
 	TargetAddress          string   `config:"target.address"`
 	TargetPasswordRaw      string   `config:"target.password_raw"`
 	TargetPasswordEncoding string   `config:"target.password_encoding"`
+	PasswordKey            string   `config:"password.key"`
+	PasswordKeyFile        string   `config:"password.key_file"`
+	SecretsRefreshSec      uint     `config:"secrets.refresh_sec"`
 	TargetDBString         string   `config:"target.db"`
+	TargetDBMapString      string   `config:"target.db_map"`
+	TargetDBMapPolicy      string   `config:"target.db_map_policy"`
+	TargetDBOutOfRange     string   `config:"target.db_out_of_range"`
 	TargetAuthType         string   `config:"target.auth_type"`
+	TargetAuthProvider     string   `config:"target.auth_provider"`
+	TargetSentinelPassword string   `config:"target.sentinel_password"`
 	TargetType             string   `config:"target.type"`
 	TargetTLSEnable        bool     `config:"target.tls_enable"`
+	TargetTLSCaFile        string   `config:"target.tls_ca_file"`
+	TargetTLSCertFile      string   `config:"target.tls_cert_file"`
+	TargetTLSKeyFile       string   `config:"target.tls_key_file"`
+	TargetTLSSkipVerify    bool     `config:"target.tls_skip_verify"`
+	TargetResp3            bool     `config:"target.resp3"`
+	TargetFollowRedirects  bool     `config:"target.follow_redirects"`
 	TargetRdbOutput        string   `config:"target.rdb.output"`
 	TargetVersion          string   `config:"target.version"`
+	TargetVersionMismatch  string   `config:"target.version_mismatch"`
+	TargetPreserveIdleFreq bool     `config:"target.preserve_idle_freq"`
+	TargetTTLMode          string   `config:"target.ttl_mode"`
+	TargetDefaultTTLSec    int      `config:"target.default_ttl_sec"`
+	TargetHashTagInject    string   `config:"target.hash_tag_inject"`
+	TargetHashTagRules     []string `config:"target.hash_tag_rules"`
+	TargetMergeCollision   string   `config:"target.merge_collision"`
+	ShardMapString         string   `config:"shard.map"`
+	AddressMapString       string   `config:"cluster.address_map"`
+	CommandRenameString    string   `config:"command.rename"`
+	SSHTunnelAddress       string   `config:"ssh_tunnel.address"`
+	SSHTunnelKeyFile       string   `config:"ssh_tunnel.key_file"`
+	SSHTunnelPassphrase    string   `config:"ssh_tunnel.key_passphrase"`
+	SSHTunnelHosts         []string `config:"ssh_tunnel.hosts"`
+	Socks5ProxyAddress     string   `config:"socks5_proxy.address"`
+	Socks5ProxyHosts       []string `config:"socks5_proxy.hosts"`
+	ProxyProtocolVersion   string   `config:"proxy_protocol.version"`
+	ProxyProtocolHosts     []string `config:"proxy_protocol.hosts"`
+	TargetWaitReplicas     int      `config:"target.wait_replicas"`
+	TargetWaitTimeoutMs    int      `config:"target.wait_timeout_ms"`
+	TargetWaitPolicy       string   `config:"target.wait_policy"`
+	TargetWaitIntervalMs   int      `config:"target.wait_interval_ms"`
+	TargetWaitIntervalCmds uint     `config:"target.wait_interval_commands"`
+	TargetErrorRate        int      `config:"target.error_rate_threshold"`
+	TargetErrorWindow      int      `config:"target.error_rate_window"`
+	TargetErrorMaxTrips    int      `config:"target.error_rate_max_trips"`
+	TargetReconnectRetries uint     `config:"target.reconnect_retries"`
+	TargetReconnectBackoff uint     `config:"target.reconnect_backoff_ms"`
+	TargetClusterRefresh   uint     `config:"target.cluster_refresh_sec"`
+	TargetMaxStall         uint     `config:"target.clusterdown_max_stall_ms"`
+	TargetRestoreMaxBytes  uint64   `config:"target.restore_max_bytes"`
+	TargetTimeoutMs        uint     `config:"target.timeout_ms"`
 	FakeTime               string   `config:"fake_time"`
 	Rewrite                bool     `config:"rewrite"`
 	FilterDBWhitelist      []string `config:"filter.db.whitelist"`
@@ -35,20 +101,75 @@ type Configuration struct {
 	FilterKeyWhitelist     []string `config:"filter.key.whitelist"`
 	FilterKeyBlacklist     []string `config:"filter.key.blacklist"`
 	FilterSlot             []string `config:"filter.slot"`
+	FilterTypeWhitelist    []string `config:"filter.type_whitelist"`
+	FilterTypeBlacklist    []string `config:"filter.type_blacklist"`
 	FilterLua              bool     `config:"filter.lua"`
+	FilterCommandWhitelist []string `config:"filter.command.whitelist"`
+	FilterCommandBlacklist []string `config:"filter.command.blacklist"`
+	FilterDangerousCommand bool     `config:"filter.dangerous_command"`
+	FilterDangerousAllow   []string `config:"filter.dangerous_command.allow"`
+	FilterMaxValueBytes    uint64   `config:"filter.max_value_bytes"`
+	FilterLogDropped       bool     `config:"filter.log_dropped"`
+	FilterLogDroppedFile   string   `config:"filter.log_dropped.file"`
+	FilterLogDroppedRate   uint     `config:"filter.log_dropped.rate"`
 	BigKeyThreshold        uint64   `config:"big_key_threshold"`
+	RestoreDBGroupBuffer   uint64   `config:"restore.db_group_buffer"`
+	RestorePipelineCount   uint     `config:"restore.pipeline_count"`
+	RestoreFileOrder       string   `config:"restore.file_order"`
+	TransformCommand       string   `config:"transform.command"`
+	TransformOnError       string   `config:"transform.on_error"`
+	LimitKeyCount          uint64   `config:"limit.key_count"`
+	LimitByteCount         uint64   `config:"limit.byte_count"`
+	LimitStopAfterFull     bool     `config:"limit.stop_after_full"`
 	Psync                  bool     `config:"psync"`
+	SyncLoopTag            string   `config:"sync.loop_tag"`
+	SyncMode               string   `config:"sync.mode"`
+	SyncSkipFull           bool     `config:"sync.skip_full"`
+	SyncSkipFullRunId      string   `config:"sync.skip_full.run_id"`
+	SyncSkipFullOffset     int64    `config:"sync.skip_full.offset"`
+	SyncSkipFullFallback   string   `config:"sync.skip_full.fallback"`
+	SyncIncrOnly           bool     `config:"sync.incr_only"`
+	SyncFullOnly           bool     `config:"sync.full_only"`
+	SyncCheckpointFile     string   `config:"sync.checkpoint_file"`
+	SyncCheckpointInterval uint     `config:"sync.checkpoint_interval"`
+	SyncCheckpointKey      string   `config:"sync.checkpoint_key"`
+	SyncRestartRetries     uint     `config:"sync.restart_retries"`
+	SyncRestartBackoff     uint     `config:"sync.restart_backoff_ms"`
+	SyncJobs               []string `config:"sync.jobs"`
+	JobName                string   `config:"job.name"`
+	IncrAofOutput          string   `config:"incr.aof_output"`
+	IncrAofMaxMB           uint64   `config:"incr.aof_max_mb"`
+	FullSyncDoneWebhook    string   `config:"fullsync.done_webhook"`
+	FullSyncDoneMarker     string   `config:"fullsync.done_marker"`
+	FullSyncResumable      bool     `config:"fullsync.resumable"`
 	Metric                 bool     `config:"metric"`
 	MetricPrintLog         bool     `config:"metric.print_log"`
+	MetricDelaySample      string   `config:"metric.delay_sample"`
 	SenderSize             uint64   `config:"sender.size"`
 	SenderCount            uint     `config:"sender.count"`
 	SenderDelayChannelSize uint     `config:"sender.delay_channel_size"`
+	SenderTargetParallel   uint     `config:"sender.target_parallel"`
+	SenderTransaction      bool     `config:"sender.transaction"`
+	SenderMaxBytes         uint64   `config:"sender.max_bytes"`
+	SenderSpillFile        string   `config:"sender.spill_file"`
+	SenderSpillMaxMB       uint     `config:"sender.spill_max_mb"`
+	SenderSpillMaxAge      uint     `config:"sender.spill_max_age_sec"`
 	KeepAlive              uint     `config:"keep_alive"`
+	DialTimeoutMs          uint     `config:"dial_timeout_ms"`
+	DialPreferFamily       string   `config:"dial_prefer_family"`
+	TransferMaxMbps        uint     `config:"transfer.max_mbps"`
 	PidPath                string   `config:"pid_path"`
 	ScanKeyNumber          uint32   `config:"scan.key_number"`
 	ScanSpecialCloud       string   `config:"scan.special_cloud"`
 	ScanKeyFile            string   `config:"scan.key_file"`
+	ReshardPlanString      string   `config:"reshard.plan"`
+	ReshardBatch           uint     `config:"reshard.batch"`
 	Qps                    int      `config:"qps"`
+	ShutdownDrainTimeoutMs int      `config:"shutdown.drain_timeout_ms"`
+	CutoverEnable          bool     `config:"cutover.enable"`
+	CutoverLagThreshold    int64    `config:"cutover.lag_threshold"`
+	CutoverStableSeconds   uint     `config:"cutover.stable_seconds"`
+	CutoverWebhook         string   `config:"cutover.webhook"`
 
 	/*---------------------------------------------------------*/
 	// inner variables
@@ -61,20 +182,47 @@ type Configuration struct {
 	ExtraInfo                 bool     `config:"extra"`
 	SockFileName              string   `config:"sock.file_name"`
 	SockFileSize              uint     `config:"sock.file_size"`
+	SockCompress              string   `config:"sock.compress"`
 	FilterKey                 []string `config:"filter.key"` // compatible with older versions
 	FilterDB                  string   `config:"filter.db"`  // compatible with older versions
 
 	/*---------------------------------------------------------*/
 	// generated variables
-	SourceAddressList []string      // source address list
-	TargetAddressList []string      // target address list
-	SourceVersion     string        // source version
-	HeartbeatIp       string        // heartbeat ip
-	ShiftTime         time.Duration // shift
-	TargetReplace     bool          // to_replace
-	TargetDB          int           // int type
-	Version           string        // version
-	Type              string        // input mode -type=xxx
+	SourceAddressList []string         // source address list
+	TargetAddressList []string         // target address list
+
+	SourceAddressOptions map[string]AddressOptions // options given in source.address, see AddressOptions
+	TargetAddressOptions map[string]AddressOptions // options given in target.address
+	ShardMap             map[string]string         // source address -> target address, see shard.map
+	AddressMap           map[string]string         // address announced -> address connected, see cluster.address_map
+	CommandRename        map[string]string         // command -> name renamed to, see command.rename
+	SourceReplicaOf      map[string]string         // replica synced -> master of the shard, see source.cluster_read_from
+	ReshardPlan          map[int]string            // slot -> master moved into, see reshard.plan
+
+	SourceVersion     string           // source version
+	HeartbeatIp       string           // heartbeat ip
+	ShiftTime         time.Duration    // shift
+	TargetReplace     bool             // to_replace
+	TargetDB          int              // int type
+	TargetDBMap       map[int]int      // source db -> target db
+	DelaySampleRatio  int              // 1:N sampling of metric.delay_sample, 0 means adaptive, -1 means off
+	Jobs              []*Configuration // the options of each job in sync.jobs
+	Version           string           // version
+	Type              string           // input mode -type=xxx
+}
+
+// the options given after "?" of the address in the address list, which override the ones of all
+// the addresses, e.g., "127.0.0.1:6379?password=x&tls=true&weight=2". nil means not given.
+type AddressOptions struct {
+	Password *string
+	TLS      *bool
+	Weight   int // the target is picked weight times in a round, 0 means 1
+
+	// the source only, they override parallel and sender.count for the db syncer of the source,
+	// 0 means not given. Qps limits the keys restored and the commands sent per second, 0 means no limit.
+	Parallel    int
+	SenderCount uint
+	Qps         int
 }
 
 var Options Configuration
@@ -94,4 +242,64 @@ const (
 	TypeDump    = "dump"
 	TypeSync    = "sync"
 	TypeRump    = "rump"
+	TypeReplay  = "replay"  // sync from source.aof_file once without following it
+	TypeReshard = "reshard" // move the slots of the source cluster by reshard.plan
+
+	VersionMismatchAbort   = "abort"
+	VersionMismatchRewrite = "rewrite"
+
+	DBMapPolicyPass = "pass"
+	DBMapPolicyDrop = "drop"
+
+	RestoreFileOrderParallel   = "parallel"
+	RestoreFileOrderSequential = "sequential" // in the order of source.rdb.input
+
+	TransformOnErrorAbort = "abort"
+	TransformOnErrorSkip  = "skip"
+	TransformOnErrorKeep  = "keep" // the original value
+
+	DBOutOfRangeError = "error"
+	DBOutOfRangeSkip  = "skip"
+	DBOutOfRangeRemap = "remap" // into db 0
+
+	WaitPolicyWarn  = "warn"
+	WaitPolicyPause = "pause"
+
+	SkipFullFallbackAbort    = "abort"
+	SkipFullFallbackFullsync = "fullsync"
+
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+
+	PasswordEncodingBase64 = "base64"
+	PasswordEncodingAESGCM = "aes-gcm"
+
+	CompressGzip = "gzip"
+
+	DelaySampleAdaptive = "adaptive"
+	DelaySampleAll      = "all"
+	DelaySampleOff      = "off"
+
+	SyncModeSync   = "sync"
+	SyncModeVerify = "verify"
+
+	TTLModeSource   = "source"
+	TTLModeOverride = "override"
+	TTLModeMin      = "min"
+	TTLModeMax      = "max"
+
+	SlotMigrationReconcile = "reconcile"
+	SlotMigrationAbort     = "abort" // the syncer fails once the slots migrate in the full sync
+	SlotMigrationIgnore    = "ignore"
+
+	ClusterReadFromMaster  = "master"
+	ClusterReadFromReplica = "replica" // the replica of each shard is synced, see source.cluster_read_from
+
+	MergeCollisionOverwrite = "overwrite"
+	MergeCollisionSkip      = "skip"
+	MergeCollisionRename    = "rename" // restored as "${key}.shard${id}"
+	MergeCollisionAbort     = "abort"
 )
@@ -0,0 +1,115 @@
+package conf
+
+/*
+ * The defaults of the options, shared by the configuration loader and the embedded Syncer so they
+ * don't drift apart. Preset is called before the configuration file is loaded, it sets the options
+ * whose zero value is valid but isn't the default, e.g., source.fake_slave_offset = false, so the
+ * value given in the file is kept even if it's zero. FillDefaults is called after loading, it sets
+ * the options left zero, which means not given.
+ */
+
+func Preset(c *Configuration) {
+	c.Id = "redis-shake"
+	c.LogLevel = "info"
+	c.SourceType = RedisTypeStandalone
+	c.SourceAuthType = "auth"
+	c.SourceFakeSlaveOffset = true
+	c.TargetType = RedisTypeStandalone
+	c.TargetAuthType = "auth"
+	c.TargetClusterRefresh = 10
+	c.TargetPreserveIdleFreq = true
+	c.TargetTimeoutMs = 600000
+	c.SecretsRefreshSec = 300
+	c.Psync = true
+}
+
+func FillDefaults(c *Configuration) {
+	if c.Parallel == 0 {
+		c.Parallel = 64
+	}
+	if c.BigKeyThreshold == 0 {
+		c.BigKeyThreshold = 50 * 1024 * 1024
+	}
+
+	if c.SourceOffsetInterval == 0 {
+		c.SourceOffsetInterval = 10
+	}
+	if c.SourceReconnectWindow == 0 {
+		c.SourceReconnectWindow = 300
+	}
+	if c.SourceSlotMigration == "" {
+		c.SourceSlotMigration = SlotMigrationReconcile
+	}
+	if c.SourceClusterReadFrom == "" {
+		c.SourceClusterReadFrom = ClusterReadFromMaster
+	}
+	if c.SourceReplicaMaxLag == 0 {
+		c.SourceReplicaMaxLag = 30
+	}
+
+	if c.TargetDBString == "" {
+		c.TargetDB = -1
+	}
+	if c.TargetDBMapPolicy == "" {
+		c.TargetDBMapPolicy = DBMapPolicyPass
+	}
+	if c.TargetDBOutOfRange == "" {
+		c.TargetDBOutOfRange = DBOutOfRangeError
+	}
+	if c.TargetVersionMismatch == "" {
+		c.TargetVersionMismatch = VersionMismatchAbort
+	}
+	if c.TargetTTLMode == "" {
+		c.TargetTTLMode = TTLModeSource
+	}
+	if c.TargetWaitTimeoutMs == 0 {
+		c.TargetWaitTimeoutMs = 1000
+	}
+	if c.TargetWaitIntervalMs == 0 {
+		c.TargetWaitIntervalMs = 1000
+	}
+	if c.TargetWaitPolicy == "" {
+		c.TargetWaitPolicy = WaitPolicyWarn
+	}
+	if c.TargetErrorWindow <= 0 {
+		c.TargetErrorWindow = 10
+	}
+	if c.TargetErrorMaxTrips <= 0 {
+		c.TargetErrorMaxTrips = 3
+	}
+	if c.TargetReconnectBackoff == 0 {
+		c.TargetReconnectBackoff = 100
+	}
+
+	if c.SyncMode == "" {
+		c.SyncMode = SyncModeSync
+	}
+	if c.SyncSkipFullFallback == "" {
+		c.SyncSkipFullFallback = SkipFullFallbackAbort
+	}
+	if c.SyncCheckpointInterval == 0 {
+		c.SyncCheckpointInterval = 1
+	}
+	if c.SyncRestartBackoff == 0 {
+		c.SyncRestartBackoff = 1000
+	}
+
+	if c.SenderSize == 0 {
+		c.SenderSize = 65535
+	}
+	if c.SenderCount == 0 {
+		c.SenderCount = 1024
+	}
+	if c.SenderDelayChannelSize == 0 {
+		c.SenderDelayChannelSize = 32
+	}
+	if c.SenderTargetParallel == 0 {
+		c.SenderTargetParallel = 1
+	}
+	if c.MetricDelaySample == "" {
+		c.MetricDelaySample = DelaySampleAdaptive
+	}
+	if c.Qps == 0 {
+		c.Qps = 500000
+	}
+}
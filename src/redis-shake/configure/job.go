@@ -0,0 +1,35 @@
+package conf
+
+/*
+ * The options can be given in the job file of sync.jobs, they're loaded on top of the main file
+ * for each job, so that the jobs in one process sync different source and target with their own
+ * filters and target db. The others are shared by all the jobs since they're read from Options.
+ */
+var jobOptions = map[string]struct{}{
+	"job.name":                 {},
+	"source.address":           {},
+	"source.password_raw":      {},
+	"source.password_encoding": {},
+	"target.address":           {},
+	"target.password_raw":      {},
+	"target.password_encoding": {},
+	"shard.map":                {},
+	"target.db":                {},
+	"target.db_map":            {},
+	"target.db_map_policy":     {},
+	"filter.db":                {},
+	"filter.db.whitelist":      {},
+	"filter.db.blacklist":      {},
+	"filter.key":               {},
+	"filter.key.whitelist":     {},
+	"filter.key.blacklist":     {},
+	"filter.slot":              {},
+	"filter.type_whitelist":    {},
+	"filter.type_blacklist":    {},
+}
+
+// IsJobOption returns whether the option tag can be given in the job file of sync.jobs.
+func IsJobOption(tag string) bool {
+	_, ok := jobOptions[tag]
+	return ok
+}
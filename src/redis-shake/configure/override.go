@@ -0,0 +1,149 @@
+package conf
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+ * The options tagged by `config` in Configuration can be overridden by the environment
+ * variables and the flags, the precedence is: flags > environment variables > file > defaults.
+ * The environment variable of the option is the tag in upper case with "." and "-" replaced by
+ * "_" and prefixed by "REDISSHAKE_", e.g., REDISSHAKE_SOURCE_ADDRESS for source.address, and
+ * the flag is the tag itself, e.g., -source.address or --source.address. The list is separated
+ * by ";" the same as the file.
+ */
+const (
+	EnvPrefix       = "REDISSHAKE_"
+	optionSeparator = ";"
+)
+
+// the name of the environment variable of the option tag
+func EnvName(tag string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(tag))
+}
+
+// LoadEnv sets the options given by the environment variables in "key=value" format.
+func LoadEnv(opt *Configuration, environ []string) error {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if pair := strings.SplitN(kv, "=", 2); len(pair) == 2 && strings.HasPrefix(pair[0], EnvPrefix) {
+			env[pair[0]] = pair[1]
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	return walkOptions(opt, func(tag string, field reflect.Value) error {
+		if value, ok := env[EnvName(tag)]; ok {
+			if err := setOption(field, value); err != nil {
+				return fmt.Errorf("environment variable %s: %v", EnvName(tag), err)
+			}
+		}
+		return nil
+	})
+}
+
+// the flag of one option, the value is kept until the file is loaded
+type optionFlag struct {
+	isBool bool
+	value  string
+	set    bool
+}
+
+func (f *optionFlag) String() string {
+	return f.value
+}
+
+func (f *optionFlag) Set(value string) error {
+	f.value, f.set = value, true
+	return nil
+}
+
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+/*
+ * RegisterFlags defines a flag in fs for each option, and returns the function which sets the
+ * options given by the flags. It's called after the file and the environment variables are
+ * loaded so that the flags take precedence.
+ */
+func RegisterFlags(fs *flag.FlagSet) func(opt *Configuration) error {
+	flags := make(map[string]*optionFlag)
+	walkOptions(&Configuration{}, func(tag string, field reflect.Value) error {
+		f := &optionFlag{isBool: field.Kind() == reflect.Bool}
+		fs.Var(f, tag, fmt.Sprintf("override %s in the configuration file", tag))
+		flags[tag] = f
+		return nil
+	})
+
+	return func(opt *Configuration) error {
+		return walkOptions(opt, func(tag string, field reflect.Value) error {
+			if f := flags[tag]; f.set {
+				if err := setOption(field, f.value); err != nil {
+					return fmt.Errorf("flag -%s: %v", tag, err)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// call fn for each field tagged by `config`
+func walkOptions(opt *Configuration, fn func(tag string, field reflect.Value) error) error {
+	v := reflect.ValueOf(opt).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("config")
+		if tag == "" {
+			continue
+		}
+		if err := fn(tag, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set the value the same way as the file loader
+func setOption(field reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("boolean wrong format %v", value)
+		}
+		field.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("integer wrong format %v", value)
+		}
+		field.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("unsigned integer wrong format %v", value)
+		}
+		field.SetUint(v)
+	case reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, optionSeparator) {
+			if s := strings.TrimSpace(item); len(s) != 0 {
+				items = append(items, s)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// +build linux darwin windows
+// +build integration
+
+package conf
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/gugemichael/nimo4go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverride(t *testing.T) {
+	// test LoadEnv and RegisterFlags
+
+	f, err := ioutil.TempFile("", "override")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("source.address = 10.0.0.1:6379\nparallel = 1\nfilter.lua = false\nfilter.key.blacklist = a;b\n")
+	assert.Equal(t, nil, err, "should be equal")
+	f.Close()
+
+	load := func() *Configuration {
+		file, err := os.Open(f.Name())
+		assert.Equal(t, nil, err, "should be equal")
+		defer file.Close()
+		opt := new(Configuration)
+		assert.Equal(t, nil, nimo.NewConfigLoader(file).Load(opt), "should be equal")
+		return opt
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestOverride case %d.\n", nr)
+		nr++
+
+		// the environment variable names are unique
+		names := make(map[string]string)
+		walkOptions(new(Configuration), func(tag string, _ reflect.Value) error {
+			name := EnvName(tag)
+			_, ok := names[name]
+			assert.Equal(t, false, ok, name)
+			names[name] = tag
+			return nil
+		})
+		assert.Equal(t, "source.address", names["REDISSHAKE_SOURCE_ADDRESS"], "should be equal")
+		assert.Equal(t, "filter.db.whitelist", names["REDISSHAKE_FILTER_DB_WHITELIST"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestOverride case %d.\n", nr)
+		nr++
+
+		// env overrides the file
+		opt := load()
+		assert.Equal(t, nil, LoadEnv(opt, []string{
+			"REDISSHAKE_SOURCE_ADDRESS=10.0.0.2:6379",
+			"REDISSHAKE_FILTER_LUA=true",
+			"REDISSHAKE_FILTER_KEY_BLACKLIST=c; d",
+			"HOME=/root",
+		}), "should be equal")
+		assert.Equal(t, "10.0.0.2:6379", opt.SourceAddress, "should be equal")
+		assert.Equal(t, 1, opt.Parallel, "should be equal")
+		assert.Equal(t, true, opt.FilterLua, "should be equal")
+		assert.Equal(t, []string{"c", "d"}, opt.FilterKeyBlacklist, "should be equal")
+
+		err := LoadEnv(opt, []string{"REDISSHAKE_PARALLEL=x"})
+		assert.Equal(t, "environment variable REDISSHAKE_PARALLEL: integer wrong format x", fmt.Sprint(err),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestOverride case %d.\n", nr)
+		nr++
+
+		// flag overrides env and the file
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		conf := fs.String("conf", "", "configuration path")
+		apply := RegisterFlags(fs)
+		assert.Equal(t, nil, fs.Parse([]string{"-conf", "shake.conf", "--source.address=10.0.0.3:6379",
+			"-parallel", "5", "-filter.lua"}), "should be equal")
+		assert.Equal(t, "shake.conf", *conf, "should be equal")
+
+		opt := load()
+		assert.Equal(t, nil, LoadEnv(opt, []string{"REDISSHAKE_SOURCE_ADDRESS=10.0.0.2:6379",
+			"REDISSHAKE_PARALLEL=3"}), "should be equal")
+		assert.Equal(t, nil, apply(opt), "should be equal")
+		assert.Equal(t, "10.0.0.3:6379", opt.SourceAddress, "should be equal")
+		assert.Equal(t, 5, opt.Parallel, "should be equal")
+		assert.Equal(t, true, opt.FilterLua, "should be equal")
+		// not given by the flags
+		assert.Equal(t, []string{"a", "b"}, opt.FilterKeyBlacklist, "should be equal")
+	}
+}
+
+func TestJobOption(t *testing.T) {
+	// test IsJobOption
+
+	var nr int
+	{
+		fmt.Printf("TestJobOption case %d.\n", nr)
+		nr++
+
+		// each job option is tagged in Configuration
+		tags := make(map[string]struct{})
+		walkOptions(&Configuration{}, func(tag string, field reflect.Value) error {
+			tags[tag] = struct{}{}
+			return nil
+		})
+		for tag := range jobOptions {
+			_, ok := tags[tag]
+			assert.Equal(t, true, ok, tag)
+		}
+		assert.Equal(t, true, IsJobOption("filter.key.whitelist"), "should be equal")
+		assert.Equal(t, false, IsJobOption("source.type"), "should be equal")
+		assert.Equal(t, false, IsJobOption("sync.jobs"), "should be equal")
+	}
+}
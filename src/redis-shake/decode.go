@@ -9,22 +9,25 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"time"
 
 	"pkg/libs/atomic2"
 	"pkg/libs/log"
 	"pkg/rdb"
+	"redis-shake/base"
 	"redis-shake/common"
 	"redis-shake/configure"
-	"redis-shake/base"
+	"redis-shake/filter"
 )
 
 type CmdDecode struct {
-	rbytes, wbytes, nentry atomic2.Int64
+	rbytes, wbytes, nentry, ignore atomic2.Int64
 }
 
 type cmdDecodeStat struct {
-	rbytes, wbytes, nentry int64
+	rbytes, wbytes, nentry, ignore int64
 }
 
 func (cmd *CmdDecode) Stat() *cmdDecodeStat {
@@ -32,6 +35,7 @@ func (cmd *CmdDecode) Stat() *cmdDecodeStat {
 		rbytes: cmd.rbytes.Get(),
 		wbytes: cmd.wbytes.Get(),
 		nentry: cmd.nentry.Get(),
+		ignore: cmd.ignore.Get(),
 	}
 }
 
@@ -44,7 +48,11 @@ func (cmd *CmdDecode) Main() {
 
 	for i, input := range conf.Options.SourceRdbInput {
 		// decode one by one. By now, we don't support decoding concurrence.
-		output := fmt.Sprintf("%s.%d", conf.Options.TargetRdbOutput, i)
+		// print to stdout if no output given.
+		var output string
+		if conf.Options.TargetRdbOutput != "" {
+			output = fmt.Sprintf("%s.%d", conf.Options.TargetRdbOutput, i)
+		}
 		cmd.decode(input, output)
 	}
 
@@ -55,13 +63,21 @@ func (cmd *CmdDecode) decode(input, output string) {
 	readin, nsize := utils.OpenReadFile(input)
 	defer readin.Close()
 
-	saveto := utils.OpenWriteFile(output)
-	defer saveto.Close()
+	var saveto io.Writer = os.Stdout
+	if output != "" {
+		file := utils.OpenWriteFile(output)
+		defer file.Close()
+		saveto = file
+	}
 
 	reader := bufio.NewReaderSize(readin, utils.ReaderBufferSize)
 	writer := bufio.NewWriterSize(saveto, utils.WriterBufferSize)
 
-	ipipe := utils.NewRDBLoader(reader, &cmd.rbytes, base.RDBPipeSize)
+	cmd.decodeRDB(reader, writer, nsize)
+}
+
+func (cmd *CmdDecode) decodeRDB(reader *bufio.Reader, writer *bufio.Writer, nsize int64) {
+	ipipe, _ := utils.NewRDBLoader(reader, &cmd.rbytes, base.RDBPipeSize, nil)
 	opipe := make(chan string, cap(ipipe))
 
 	go func() {
@@ -88,8 +104,12 @@ func (cmd *CmdDecode) decode(input, output string) {
 			if _, err := writer.WriteString(s); err != nil {
 				log.PanicError(err, "write string failed")
 			}
-			utils.FlushWriter(writer)
+			// only flush when no more line is waiting
+			if len(opipe) == 0 {
+				utils.FlushWriter(writer)
+			}
 		}
+		utils.FlushWriter(writer)
 	}()
 
 	for done := false; !done; {
@@ -108,6 +128,9 @@ func (cmd *CmdDecode) decode(input, output string) {
 		}
 		fmt.Fprintf(&b, "  write=%-12d", stat.wbytes)
 		fmt.Fprintf(&b, "  entry=%-12d", stat.nentry)
+		if stat.ignore != 0 {
+			fmt.Fprintf(&b, "  ignore=%-12d", stat.ignore)
+		}
 		log.Info(b.String())
 	}
 }
@@ -135,25 +158,63 @@ func (cmd *CmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- strin
 		}
 		return string(b)
 	}
+	// each element is written as one json line so that the big key won't be buffered entirely
+	output := func(o interface{}) {
+		opipe <- fmt.Sprintf("%s\n", toJson(o))
+	}
 	for e := range ipipe {
-		var b bytes.Buffer
+		if filter.FilterDB(int(e.DB)) {
+			cmd.ignore.Incr()
+			continue
+		}
+
 		if e.Type == rdb.RdbFlagAUX {
 			o := &struct {
+				Type    string `json:"type"`
+				Key     string `json:"key"`
+				Value64 string `json:"value64"`
+			}{
+				"aux", string(e.Key), string(e.Value),
+			}
+			output(o)
+			cmd.nentry.Incr()
+			continue
+		}
+
+		if filter.FilterKey(string(e.Key)) {
+			cmd.ignore.Incr()
+			continue
+		}
+
+		ttl := calcDecodeTTL(e.ExpireAt)
+		if e.Type == rdb.RDBTypeStreamListPacks {
+			// stream isn't supported in DecodeDump, so print the raw dump payload
+			o := &struct {
+				DB       uint32 `json:"db"`
 				Type     string `json:"type"`
+				ExpireAt uint64 `json:"expireat"`
+				TTL      int64  `json:"ttl"`
 				Key      string `json:"key"`
+				Key64    string `json:"key64"`
 				Value64  string `json:"value64"`
 			}{
-				"aux", string(e.Key), string(e.Value),
+				e.DB, "stream", e.ExpireAt, ttl, toText(e.Key), toBase64(e.Key),
+				toBase64(e.Value),
 			}
-			fmt.Fprintf(&b, "%s\n", toJson(o))
+			output(o)
 			cmd.nentry.Incr()
-			opipe <- b.String()
 			continue
 		}
 
-		o, err := rdb.DecodeDump(e.Value)
-		if err != nil {
-			log.PanicError(err, "decode failed")
+		var o interface{}
+		if e.Type == rdb.RdbTypeHash && (e.RealMemberCount != 0 || e.NeedReadLen == 0) {
+			// big hash is split into several entries by loader, DecodeDump can't parse the partial value
+			o = decodeSplitHash(e)
+		} else {
+			var err error
+			if o, err = rdb.DecodeDump(e.Value); err != nil {
+				log.PanicError(err, "decode failed")
+			}
 		}
 		switch obj := o.(type) {
 		default:
@@ -163,29 +224,31 @@ func (cmd *CmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- strin
 				DB       uint32 `json:"db"`
 				Type     string `json:"type"`
 				ExpireAt uint64 `json:"expireat"`
+				TTL      int64  `json:"ttl"`
 				Key      string `json:"key"`
 				Key64    string `json:"key64"`
 				Value64  string `json:"value64"`
 			}{
-				e.DB, "string", e.ExpireAt, toText(e.Key), toBase64(e.Key),
+				e.DB, "string", e.ExpireAt, ttl, toText(e.Key), toBase64(e.Key),
 				toBase64(obj),
 			}
-			fmt.Fprintf(&b, "%s\n", toJson(o))
+			output(o)
 		case rdb.List:
 			for i, ele := range obj {
 				o := &struct {
 					DB       uint32 `json:"db"`
 					Type     string `json:"type"`
 					ExpireAt uint64 `json:"expireat"`
+					TTL      int64  `json:"ttl"`
 					Key      string `json:"key"`
 					Key64    string `json:"key64"`
 					Index    int    `json:"index"`
 					Value64  string `json:"value64"`
 				}{
-					e.DB, "list", e.ExpireAt, toText(e.Key), toBase64(e.Key),
+					e.DB, "list", e.ExpireAt, ttl, toText(e.Key), toBase64(e.Key),
 					i, toBase64(ele),
 				}
-				fmt.Fprintf(&b, "%s\n", toJson(o))
+				output(o)
 			}
 		case rdb.Hash:
 			for _, ele := range obj {
@@ -193,16 +256,17 @@ func (cmd *CmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- strin
 					DB       uint32 `json:"db"`
 					Type     string `json:"type"`
 					ExpireAt uint64 `json:"expireat"`
+					TTL      int64  `json:"ttl"`
 					Key      string `json:"key"`
 					Key64    string `json:"key64"`
 					Field    string `json:"field"`
 					Field64  string `json:"field64"`
 					Value64  string `json:"value64"`
 				}{
-					e.DB, "hash", e.ExpireAt, toText(e.Key), toBase64(e.Key),
+					e.DB, "hash", e.ExpireAt, ttl, toText(e.Key), toBase64(e.Key),
 					toText(ele.Field), toBase64(ele.Field), toBase64(ele.Value),
 				}
-				fmt.Fprintf(&b, "%s\n", toJson(o))
+				output(o)
 			}
 		case rdb.Set:
 			for _, mem := range obj {
@@ -210,15 +274,16 @@ func (cmd *CmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- strin
 					DB       uint32 `json:"db"`
 					Type     string `json:"type"`
 					ExpireAt uint64 `json:"expireat"`
+					TTL      int64  `json:"ttl"`
 					Key      string `json:"key"`
 					Key64    string `json:"key64"`
 					Member   string `json:"member"`
 					Member64 string `json:"member64"`
 				}{
-					e.DB, "set", e.ExpireAt, toText(e.Key), toBase64(e.Key),
+					e.DB, "set", e.ExpireAt, ttl, toText(e.Key), toBase64(e.Key),
 					toText(mem), toBase64(mem),
 				}
-				fmt.Fprintf(&b, "%s\n", toJson(o))
+				output(o)
 			}
 		case rdb.ZSet:
 			for _, ele := range obj {
@@ -226,19 +291,64 @@ func (cmd *CmdDecode) decoderMain(ipipe <-chan *rdb.BinEntry, opipe chan<- strin
 					DB       uint32  `json:"db"`
 					Type     string  `json:"type"`
 					ExpireAt uint64  `json:"expireat"`
+					TTL      int64   `json:"ttl"`
 					Key      string  `json:"key"`
 					Key64    string  `json:"key64"`
 					Member   string  `json:"member"`
 					Member64 string  `json:"member64"`
 					Score    float64 `json:"score"`
 				}{
-					e.DB, "zset", e.ExpireAt, toText(e.Key), toBase64(e.Key),
+					e.DB, "zset", e.ExpireAt, ttl, toText(e.Key), toBase64(e.Key),
 					toText(ele.Member), toBase64(ele.Member), ele.Score,
 				}
-				fmt.Fprintf(&b, "%s\n", toJson(o))
+				output(o)
 			}
 		}
 		cmd.nentry.Incr()
-		opipe <- b.String()
 	}
 }
+
+// calcDecodeTTL returns the remaining ttl in milliseconds, -1 means no expiration.
+func calcDecodeTTL(expireAt uint64) int64 {
+	if expireAt == 0 {
+		return -1
+	}
+	now := uint64(time.Now().Add(conf.Options.ShiftTime).UnixNano()) / uint64(time.Millisecond)
+	if now >= expireAt {
+		return 0
+	}
+	return int64(expireAt - now)
+}
+
+// decodeSplitHash parses the partial hash entry which is split by rdb loader.
+func decodeSplitHash(e *rdb.BinEntry) rdb.Hash {
+	r := rdb.NewRdbReader(bytes.NewReader(e.Value))
+	if _, err := r.ReadByte(); err != nil {
+		log.PanicError(err, "read rdb type failed")
+	}
+
+	n := e.RealMemberCount
+	if e.NeedReadLen == 1 {
+		rlen, err := r.ReadLength()
+		if err != nil {
+			log.PanicError(err, "read rdb length failed")
+		}
+		if n == 0 {
+			n = rlen
+		}
+	}
+
+	hash := make(rdb.Hash, 0, n)
+	for i := 0; i < int(n); i++ {
+		field, err := r.ReadString()
+		if err != nil {
+			log.PanicError(err, "read rdb hash field failed")
+		}
+		value, err := r.ReadString()
+		if err != nil {
+			log.PanicError(err, "read rdb hash value failed")
+		}
+		hash = append(hash, &rdb.HashElement{Field: field, Value: value})
+	}
+	return hash
+}
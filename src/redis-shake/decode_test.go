@@ -0,0 +1,106 @@
+// +build linux darwin windows
+// +build integration
+
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"pkg/rdb"
+	"redis-shake/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func buildDecodeRDB(t *testing.T) []byte {
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("str"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("list"), 0,
+		rdb.List{[]byte("a"), []byte("b")}), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(1, []byte("hash"), 0,
+		rdb.Hash{&rdb.HashElement{Field: []byte("f"), Value: []byte("v")}}), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(1, []byte("zset"), 0,
+		rdb.ZSet{&rdb.ZSetElement{Member: []byte("m"), Score: 1.5}}), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	return b.Bytes()
+}
+
+func runDecode(t *testing.T, input []byte) []map[string]interface{} {
+	var output bytes.Buffer
+	cmd := new(CmdDecode)
+	writer := bufio.NewWriter(&output)
+	cmd.decodeRDB(bufio.NewReader(bytes.NewReader(input)), writer, int64(len(input)))
+
+	ret := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		mp := make(map[string]interface{})
+		assert.Equal(t, nil, json.Unmarshal([]byte(line), &mp), "should be equal")
+		ret = append(ret, mp)
+	}
+	return ret
+}
+
+func TestDecodeRDB(t *testing.T) {
+	conf.Options.Parallel = 4
+	input := buildDecodeRDB(t)
+
+	var nr int
+	{
+		fmt.Printf("TestDecodeRDB case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterDBWhitelist = []string{}
+		conf.Options.FilterKeyWhitelist = []string{}
+		lines := runDecode(t, input)
+		assert.Equal(t, 5, len(lines), "should be equal") // list has 2 elements
+
+		types := make(map[string]string)
+		for _, line := range lines {
+			types[line["key"].(string)] = line["type"].(string)
+			assert.Equal(t, float64(-1), line["ttl"], "should be equal")
+		}
+		assert.Equal(t, "string", types["str"], "should be equal")
+		assert.Equal(t, "list", types["list"], "should be equal")
+		assert.Equal(t, "hash", types["hash"], "should be equal")
+		assert.Equal(t, "zset", types["zset"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDecodeRDB case %d.\n", nr)
+		nr++
+
+		// filter db
+		conf.Options.FilterDBWhitelist = []string{"1"}
+		conf.Options.FilterKeyWhitelist = []string{}
+		lines := runDecode(t, input)
+		assert.Equal(t, 2, len(lines), "should be equal")
+		for _, line := range lines {
+			assert.Equal(t, float64(1), line["db"], "should be equal")
+		}
+	}
+
+	{
+		fmt.Printf("TestDecodeRDB case %d.\n", nr)
+		nr++
+
+		// filter key
+		conf.Options.FilterDBWhitelist = []string{}
+		conf.Options.FilterKeyWhitelist = []string{"li"}
+		lines := runDecode(t, input)
+		assert.Equal(t, 2, len(lines), "should be equal")
+		for _, line := range lines {
+			assert.Equal(t, "list", line["key"], "should be equal")
+		}
+		conf.Options.FilterKeyWhitelist = []string{}
+	}
+}
@@ -5,6 +5,7 @@ package run
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
@@ -119,44 +120,54 @@ func (dd *dbDumper) dump() (*bufio.Reader, *bufio.Writer, int64) {
 	defer dumpto.Close()
 
 	// send command and get the returned channel
-	master, nsize := dd.sendCmd(dd.source, conf.Options.SourceAuthType, dd.sourcePassword, conf.Options.SourceTLSEnable)
+	master, size := dd.sendCmd(dd.source, conf.Options.SourceAuthType, dd.sourcePassword,
+		utils.SourceTLS(conf.Options.SourceTLSEnable))
 	defer master.Close()
 
-	log.Infof("routine[%v] source db[%v] dump rdb file-size[%d]\n", dd.id, dd.source, nsize)
+	log.Infof("routine[%v] source db[%v] dump rdb file-size[%d]\n", dd.id, dd.source, size.Size)
 
 	reader := bufio.NewReaderSize(master, utils.ReaderBufferSize)
 	writer := bufio.NewWriterSize(dumpto, utils.WriterBufferSize)
 
-	dd.dumpRDBFile(reader, writer, nsize)
+	nsize := dd.dumpRDBFile(reader, writer, size)
 
 	return reader, writer, nsize
 }
 
-func (dd *dbDumper) sendCmd(master, auth_type, passwd string, tlsEnable bool) (net.Conn, int64) {
-	c, wait := utils.OpenSyncConn(master, auth_type, passwd, tlsEnable)
-	var nsize int64
+func (dd *dbDumper) sendCmd(master, auth_type, passwd string, tlsConfig *tls.Config) (net.Conn, utils.RdbSize) {
+	c, wait := utils.OpenSyncConn(master, auth_type, utils.SourceAuthToken(passwd), tlsConfig)
+	var size utils.RdbSize
 
 	// wait rdb dump finish
-	for nsize == 0 {
+	for size.Size == 0 {
 		select {
-		case nsize = <-wait:
-			if nsize == 0 {
+		case size = <-wait:
+			if size.Size == 0 {
 				log.Infof("routine[%v] + waiting source rdb", dd.id)
 			}
 		case <-time.After(time.Second):
 			log.Infof("routine[%v] - waiting source rdb", dd.id)
 		}
 	}
-	return c, nsize
+	return c, size
 }
 
-func (dd *dbDumper) dumpRDBFile(reader *bufio.Reader, writer *bufio.Writer, nsize int64) {
+// return the rdb size
+func (dd *dbDumper) dumpRDBFile(reader *bufio.Reader, writer *bufio.Writer, size utils.RdbSize) int64 {
 	var nread atomic2.Int64
 	wait := make(chan struct{})
+	nsize := size.Size
 
 	// read from reader and write into writer int stream way
 	go func() {
 		defer close(wait)
+		if size.EOFMark != nil {
+			// diskless, read until the eof mark, the increment following it isn't dumped
+			nsize, _ = utils.CopyRdbUntilEOFMark(reader, writer, size.EOFMark, &nread)
+			utils.FlushWriter(writer)
+			return
+		}
+
 		p := make([]byte, utils.WriterBufferSize)
 		for nsize != nread.Get() {
 			nstep := int(nsize - nread.Get())
@@ -174,8 +185,13 @@ func (dd *dbDumper) dumpRDBFile(reader *bufio.Reader, writer *bufio.Writer, nsiz
 		case <-time.After(time.Second):
 		}
 		n := nread.Get()
+		if size.EOFMark != nil {
+			log.Infof("routine[%v] total = unknown - %12s\n", dd.id, utils.GetMetric(n))
+			continue
+		}
 		p := 100 * n / nsize
 		log.Infof("routine[%v] total = %s - %12s [%3d%%]\n", dd.id, utils.GetMetric(nsize), utils.GetMetric(n), p)
 	}
 	log.Infof("routine[%v] dump: rdb done", dd.id)
+	return nsize
 }
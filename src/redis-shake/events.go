@@ -0,0 +1,91 @@
+package run
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+)
+
+type EventType string
+
+const (
+	EventSourceConnected EventType = "SourceConnected" // the source replies the full sync to psync
+	EventFullSyncStarted EventType = "FullSyncStarted"
+	EventFullSyncDone    EventType = "FullSyncDone"
+	EventIncrSyncStarted EventType = "IncrSyncStarted"
+	EventSourceReconnect EventType = "SourceReconnect" // the broken source connection is reopened
+	EventSourceFailover  EventType = "SourceFailover"  // the source runid is changed after reconnecting
+	EventFatalError      EventType = "FatalError"      // the process exits right after it
+	EventPaused          EventType = "Paused"          // the increment isn't sent to the target, see Pause
+	EventResumed         EventType = "Resumed"
+	EventStopped         EventType = "Stopped"
+	EventSyncerFailed    EventType = "SyncerFailed"   // the syncer quits on the fatal error, see sync.restart_retries
+	EventCommandBlocked  EventType = "CommandBlocked" // the command is dropped by filter.dangerous_command
+	EventSlotMigrating   EventType = "SlotMigrating"  // the slots of the source cluster are migrating
+
+	// events not consumed in time are dropped once the channel is full
+	eventChanSize = 64
+)
+
+// the event of the Syncer, see Syncer.Events
+type Event struct {
+	Type    EventType
+	Syncer  int // id of the syncer
+	Time    time.Time
+	Message string
+}
+
+// emit the event without blocking, the event is dropped if nobody takes it
+func (ds *dbSyncer) emit(typ EventType, format string, v ...interface{}) {
+	if ds.events == nil {
+		return
+	}
+	ev := Event{
+		Type:    typ,
+		Syncer:  ds.id,
+		Time:    time.Now(),
+		Message: fmt.Sprintf(format, v...),
+	}
+	select {
+	case ds.events <- ev:
+	default:
+		ds.eventsDropped.Incr()
+	}
+}
+
+/*
+ * log.Panic* exits the process, so FatalError is emitted from the panic hook to all the
+ * syncers started. It's only seen if the consumer takes it before the exit.
+ */
+var fatalSyncers = struct {
+	sync.Mutex
+	hook sync.Once
+	m    map[*dbSyncer]struct{}
+}{m: make(map[*dbSyncer]struct{})}
+
+func registerFatalEvent(ds *dbSyncer) {
+	fatalSyncers.hook.Do(func() {
+		log.SetPanicHook(func(msg string) {
+			if log.PanicRecoverable() {
+				// only the syncer failed quits, see recoverFatal
+				return
+			}
+			fatalSyncers.Lock()
+			defer fatalSyncers.Unlock()
+			for ds := range fatalSyncers.m {
+				ds.emit(EventFatalError, "%s", msg)
+			}
+		})
+	})
+	fatalSyncers.Lock()
+	fatalSyncers.m[ds] = struct{}{}
+	fatalSyncers.Unlock()
+}
+
+func unregisterFatalEvent(ds *dbSyncer) {
+	fatalSyncers.Lock()
+	delete(fatalSyncers.m, ds)
+	fatalSyncers.Unlock()
+}
@@ -0,0 +1,234 @@
+package run
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/common"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const clusterWatchInterval = time.Second // see watchClusterMaster
+
+/*
+ * the first slot served by the master of the shard of the source cluster, the shard is followed by
+ * the slot once the master fails over, see resolveClusterMaster. It's -1 if source.type isn't
+ * cluster or the source serves no slot, e.g., it's a slave not picked by source.cluster_read_from,
+ * then the failover isn't followed.
+ */
+func (ds *dbSyncer) shardSlot(master string) int {
+	if ds.opts().SourceType != conf.RedisTypeCluster {
+		return -1
+	}
+	owners, err := ds.clusterSlotOwners(nil, master)
+	if err != nil {
+		log.Warnf("dbSyncer[%v] fetch cluster slots of source[%v] failed, the failover of the shard isn't "+
+			"followed: %v", ds.id, master, err)
+		return -1
+	}
+	for slot, owner := range owners {
+		if owner == ds.shardMaster(master) {
+			return slot
+		}
+	}
+	log.Warnf("dbSyncer[%v] source[%v] serves no slot in cluster slots, the failover of the shard isn't followed",
+		ds.id, master)
+	return -1
+}
+
+/*
+ * the connections to the nodes of the source kept open across the polls of watchClusterMaster, the
+ * nil one opens the connection each time and closes it once it's used.
+ */
+type nodeConns map[string]redigo.Conn
+
+// the connection to the node, it's opened by open if it isn't kept, nil if it can't be connected
+func (nc nodeConns) get(node string, open func() redigo.Conn) redigo.Conn {
+	if c := nc[node]; c != nil {
+		return c
+	}
+	c := open()
+	if c != nil && nc != nil {
+		nc[node] = c
+	}
+	return c
+}
+
+// release the connection got, it's closed and opened again next time if err is the failure of it
+func (nc nodeConns) put(node string, c redigo.Conn, err error) {
+	if nc != nil && err == nil {
+		return
+	}
+	c.Close()
+	delete(nc, node)
+}
+
+func (nc nodeConns) close() {
+	for node, c := range nc {
+		c.Close()
+		delete(nc, node)
+	}
+}
+
+// the owner of each slot in cluster slots of the node of the source cluster
+func (ds *dbSyncer) clusterSlotOwners(conns nodeConns, node string) ([utils.ClusterSlots]string, error) {
+	conn := conns.get(node, func() redigo.Conn {
+		options := ds.jobOptions().SourceAddressOptions
+		return utils.OpenRedisConnSoft([]string{node}, ds.opts().SourceAuthType,
+			utils.SourceAuthToken(utils.AddressPassword(options, node, ds.sourcePassword)), time.Second,
+			time.Second, false, utils.SourceTLS(utils.AddressTLS(options, node, ds.sourceTLSEnable())))
+	})
+	if conn == nil {
+		return [utils.ClusterSlots]string{}, fmt.Errorf("connect node[%v] failed", node)
+	}
+	owners, err := utils.ClusterSlotOwners(conn, node)
+	conns.put(node, conn, err)
+	return owners, err
+}
+
+/*
+ * the master serving the slot of the shard now, "" if nobody knows, e.g., the slot is failing over.
+ * The other nodes in source.address are asked before the master since the master may be cut off
+ * from the cluster without knowing it's replaced.
+ */
+func (ds *dbSyncer) slotOwner(conns nodeConns, master string, slot int) string {
+	nodes := make([]string, 0, len(ds.jobOptions().SourceAddressList)+1)
+	for _, node := range ds.jobOptions().SourceAddressList {
+		if node != master {
+			nodes = append(nodes, node)
+		}
+	}
+	nodes = append(nodes, master)
+
+	for _, node := range nodes {
+		owners, err := ds.clusterSlotOwners(conns, node)
+		if err != nil {
+			log.Debugf("dbSyncer[%v] fetch cluster slots of node[%v] failed: %v", ds.id, node, err)
+			continue
+		}
+		if owner := owners[slot]; owner != "" {
+			return owner
+		}
+	}
+	return ""
+}
+
+// the master of the shard got again if the shard is followed, master is kept if nobody knows
+func (ds *dbSyncer) resolveClusterMaster(master string, slot int) string {
+	if slot < 0 {
+		return master
+	}
+	owner := ds.slotOwner(nil, master, slot)
+	if owner == "" {
+		log.Warnf("dbSyncer[%v] Event:ClusterResolveFail\tId:%s\tslot[%v] is served by nobody", ds.id,
+			ds.opts().Id, slot)
+		return master
+	}
+	if owner != master {
+		log.Warnf("dbSyncer[%v] Event:SourceMasterSwitch\tId:%s\t%s -> %s", ds.id, ds.opts().Id, master, owner)
+		ds.master.Store(owner)
+	}
+	return owner
+}
+
+/*
+ * poll the owner of the slot of the shard every second while reading from the master, the
+ * connection is closed once the slave is promoted so that the increment continues from it, the
+ * same as watchSentinel. The connections to the nodes polled are kept till it stops. The returned
+ * channel stops it.
+ */
+func (ds *dbSyncer) watchClusterMaster(c net.Conn, master string, slot int) chan struct{} {
+	stop := make(chan struct{})
+	if slot < 0 {
+		return stop
+	}
+	ds.spawn(func() {
+		conns := make(nodeConns)
+		defer conns.close()
+		ticker := time.NewTicker(clusterWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if owner := ds.slotOwner(conns, master, slot); owner != "" && owner != ds.shardMaster(master) {
+				log.Warnf("dbSyncer[%v] Event:SourceMasterSwitch\tId:%s\t%s -> %s, reconnect", ds.id,
+					ds.opts().Id, master, owner)
+				c.Close()
+				return
+			}
+			if master != ds.shardMaster(master) {
+				if err := ds.checkReplica(conns, master); err != nil {
+					// the master is resolved as the owner of the slot on reconnecting
+					log.Warnf("dbSyncer[%v] Event:ReplicaFallback\tId:%s\treplica[%v] %v, reconnect to the "+
+						"master", ds.id, ds.opts().Id, master, err)
+					c.Close()
+					return
+				}
+			}
+		}
+	})
+	return stop
+}
+
+// the master of the shard which the node synced is in, it's the node itself unless it's the replica
+// picked by source.cluster_read_from
+func (ds *dbSyncer) shardMaster(node string) string {
+	if master, ok := ds.jobOptions().SourceReplicaOf[node]; ok && node == ds.source {
+		return master
+	}
+	return node
+}
+
+/*
+ * nil if the replica can be synced, it's connected to the master and the master is heard within
+ * source.replica_max_lag_sec. The master pings the replica every repl-ping-replica-period which is
+ * 10 seconds by default, so the lag should be longer than it.
+ */
+func (ds *dbSyncer) checkReplica(conns nodeConns, replica string) error {
+	conn := conns.get(replica, func() redigo.Conn {
+		return utils.OpenRedisConnSoft([]string{replica}, ds.opts().SourceAuthType,
+			utils.SourceAuthToken(ds.sourcePassword), time.Second, time.Second, false, ds.sourceTLS())
+	})
+	if conn == nil {
+		return fmt.Errorf("can't be connected")
+	}
+	content, err := redigo.Bytes(conn.Do("info", "replication"))
+	conns.put(replica, conn, err)
+	if err != nil {
+		return fmt.Errorf("info replication failed: %v", err)
+	}
+	info := utils.ParseRedisInfo(content)
+	if role := info["role"]; role != "slave" {
+		return fmt.Errorf("is %v now", role)
+	} else if status := info["master_link_status"]; status != "up" {
+		return fmt.Errorf("master_link_status is %v", status)
+	}
+	last, err := strconv.Atoi(info["master_last_io_seconds_ago"])
+	if err != nil {
+		return fmt.Errorf("invalid master_last_io_seconds_ago[%v]", info["master_last_io_seconds_ago"])
+	} else if last > int(ds.opts().SourceReplicaMaxLag) {
+		return fmt.Errorf("lags %d seconds behind the master, more than source.replica_max_lag_sec", last)
+	}
+	return nil
+}
+
+// sync the master instead if the replica picked by source.cluster_read_from can't be synced now
+func (ds *dbSyncer) checkReplicaSource() {
+	master := ds.shardMaster(ds.source)
+	if master == ds.source {
+		return
+	}
+	if err := ds.checkReplica(nil, ds.source); err != nil {
+		log.Warnf("dbSyncer[%v] Event:ReplicaFallback\tId:%s\treplica[%v] %v, sync the master[%v] instead",
+			ds.id, ds.opts().Id, ds.source, err, master)
+		ds.master.Store(master)
+	}
+}
@@ -4,31 +4,102 @@ import (
 	"strings"
 	"redis-shake/configure"
 	"strconv"
+
+	"pkg/rdb"
 )
 
 // return true means not pass
 func FilterCommands(cmd string) bool {
-	if strings.EqualFold(cmd, "opinfo") {
-		return true
-	}
+	return New(&conf.Options).FilterCommands(cmd)
+}
 
-	if conf.Options.FilterLua && (strings.EqualFold(cmd, "eval") || strings.EqualFold(cmd, "script") ||
+// return true means not pass
+func (f Filter) FilterCommands(cmd string) bool {
+	if f.opts.FilterLua && (strings.EqualFold(cmd, "eval") || strings.EqualFold(cmd, "script") ||
 			strings.EqualFold(cmd, "evalsha")) {
 		return true
 	}
 
+	if len(f.opts.FilterCommandBlacklist) != 0 {
+		return hasCommand(cmd, f.opts.FilterCommandBlacklist)
+	} else if len(f.opts.FilterCommandWhitelist) != 0 {
+		// the transaction is kept even if multi and exec aren't given
+		if strings.EqualFold(cmd, "multi") || strings.EqualFold(cmd, "exec") || strings.EqualFold(cmd, "discard") {
+			return false
+		}
+		return !hasCommand(cmd, f.opts.FilterCommandWhitelist)
+	}
+
+	return false
+}
+
+func hasCommand(cmd string, list []string) bool {
+	for _, ele := range list {
+		if strings.EqualFold(cmd, ele) {
+			return true
+		}
+	}
+	return false
+}
+
+// the commands which wipe or swap the whole db, see filter.dangerous_command
+var DangerousCommands = []string{"flushall", "flushdb", "swapdb"}
+
+// return true means not pass, the command is one of DangerousCommands not given in
+// filter.dangerous_command.allow
+func FilterDangerousCommand(cmd string) bool {
+	return New(&conf.Options).FilterDangerousCommand(cmd)
+}
+
+// the same as the package function FilterDangerousCommand
+func (f Filter) FilterDangerousCommand(cmd string) bool {
+	if !f.opts.FilterDangerousCommand {
+		return false
+	}
+	for _, dangerous := range DangerousCommands {
+		if !strings.EqualFold(cmd, dangerous) {
+			continue
+		}
+		for _, allow := range f.opts.FilterDangerousAllow {
+			if strings.EqualFold(cmd, allow) {
+				return false
+			}
+		}
+		return true
+	}
 	return false
 }
 
+/*
+ * Filter checks with the filters in opts, which are given by the syncer or the job file of
+ * sync.jobs. The package functions check with conf.Options.
+ */
+type Filter struct {
+	opts *conf.Configuration
+}
+
+func New(opts *conf.Configuration) Filter {
+	return Filter{opts: opts}
+}
+
 // return true means not pass
 func FilterKey(key string) bool {
-	if len(conf.Options.FilterKeyBlacklist) != 0 {
-		if hasAtLeastOnePrefix(key, conf.Options.FilterKeyBlacklist) {
+	return New(&conf.Options).FilterKey(key)
+}
+
+// return true means not pass
+func (f Filter) FilterKey(key string) bool {
+	if f.opts.SyncCheckpointKey != "" && strings.HasPrefix(key, f.opts.SyncCheckpointKey) {
+		// the checkpoint written by redis-shake, e.g., synced back in the two-way sync
+		return true
+	}
+	if len(f.opts.FilterKeyBlacklist) != 0 {
+		if hasAtLeastOnePrefix(key, f.opts.FilterKeyBlacklist) {
 			return true
 		}
 		return false
-	} else if len(conf.Options.FilterKeyWhitelist) != 0 {
-		if hasAtLeastOnePrefix(key, conf.Options.FilterKeyWhitelist) {
+	} else if len(f.opts.FilterKeyWhitelist) != 0 {
+		if hasAtLeastOnePrefix(key, f.opts.FilterKeyWhitelist) {
 			return false
 		}
 		return true
@@ -38,30 +109,62 @@ func FilterKey(key string) bool {
 
 // return true means not pass
 func FilterSlot(slot int) bool {
-	if len(conf.Options.FilterSlot) == 0 {
+	return New(&conf.Options).FilterSlot(slot)
+}
+
+// return true means not pass
+func (f Filter) FilterSlot(slot int) bool {
+	if len(f.opts.FilterSlot) == 0 {
 		return false
 	}
 
 	// the slot in FilterSlot need to be passed
-	for _, ele := range conf.Options.FilterSlot {
-		slotInt, _ := strconv.Atoi(ele)
-		if slot == slotInt {
+	for _, ele := range f.opts.FilterSlot {
+		low, high, _ := ParseSlotRange(ele)
+		if slot >= low && slot <= high {
 			return false
 		}
 	}
 	return true
 }
 
+// whether filter.slot is given
+func (f Filter) HasSlotFilter() bool {
+	return len(f.opts.FilterSlot) != 0
+}
+
+// ParseSlotRange parses the slot "5" or the slot range "0-5460" of filter.slot, both ends included.
+func ParseSlotRange(s string) (int, int, error) {
+	lowStr, highStr := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lowStr, highStr = s[:i], s[i+1:]
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(lowStr))
+	if err != nil {
+		return 0, -1, err
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highStr))
+	if err != nil {
+		return 0, -1, err
+	}
+	return low, high, nil
+}
+
 // return true means not pass
 func FilterDB(db int) bool {
+	return New(&conf.Options).FilterDB(db)
+}
+
+// return true means not pass
+func (f Filter) FilterDB(db int) bool {
 	dbString := strconv.FormatInt(int64(db), 10)
-	if len(conf.Options.FilterDBBlacklist) != 0 {
-		if matchOne(dbString, conf.Options.FilterDBBlacklist) {
+	if len(f.opts.FilterDBBlacklist) != 0 {
+		if matchOne(dbString, f.opts.FilterDBBlacklist) {
 			return true
 		}
 		return false
-	} else if len(conf.Options.FilterDBWhitelist) != 0 {
-		if matchOne(dbString, conf.Options.FilterDBWhitelist) {
+	} else if len(f.opts.FilterDBWhitelist) != 0 {
+		if matchOne(dbString, f.opts.FilterDBWhitelist) {
 			return false
 		}
 		return true
@@ -69,6 +172,89 @@ func FilterDB(db int) bool {
 	return false
 }
 
+// return true means not pass. the input is the type of rdb entry.
+func FilterType(tp byte) bool {
+	return New(&conf.Options).FilterType(tp)
+}
+
+// return true means not pass. the input is the type of rdb entry.
+func (f Filter) FilterType(tp byte) bool {
+	name := rdb.TypeName(tp)
+	if name == "" {
+		// aux or module fields, always pass
+		return false
+	}
+
+	if len(f.opts.FilterTypeBlacklist) != 0 {
+		if matchOne(name, f.opts.FilterTypeBlacklist) {
+			return true
+		}
+		return false
+	} else if len(f.opts.FilterTypeWhitelist) != 0 {
+		if matchOne(name, f.opts.FilterTypeWhitelist) {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+/*
+ * skip the commands written by redis-shake itself. They're sent as "multi, publish ${loop_tag}
+ * ${id}, ${command}, exec", so the transaction beginning with the loop tag is dropped as a whole.
+ * The multi is held until the command behind it tells whether the transaction is tagged, and the
+ * loop tag out of the transaction, e.g., the command in it isn't propagated, is dropped alone.
+ */
+type LoopFilter struct {
+	tag    string // sync.loop_tag, "" means disabled
+	multi  bool   // the multi is held
+	tagged bool   // in the transaction of the loop tag
+}
+
+func NewLoopFilter(tag string) *LoopFilter {
+	return &LoopFilter{tag: tag}
+}
+
+/*
+ * skip is true if the command shouldn't pass, the multi held is skipped as well. multi is true if
+ * the multi held should pass ahead of the command.
+ */
+func (lf *LoopFilter) Filter(scmd string, argv [][]byte) (skip bool, multi bool) {
+	if lf.tag == "" {
+		return false, false
+	}
+
+	if lf.tagged {
+		if strings.EqualFold(scmd, "exec") || strings.EqualFold(scmd, "discard") {
+			lf.tagged = false
+		}
+		return true, false
+	}
+	if lf.multi {
+		lf.multi = false
+		if lf.isLoopTag(scmd, argv) {
+			lf.tagged = true
+			return true, false
+		}
+		return false, true
+	}
+	if strings.EqualFold(scmd, "multi") {
+		lf.multi = true
+		return true, false
+	}
+	return lf.isLoopTag(scmd, argv), false
+}
+
+// whether the multi is held by Filter
+func (lf *LoopFilter) Holding() bool {
+	return lf.multi
+}
+
+// judge whether the command is the loop tag: "publish ${loop_tag} ${id}"
+func (lf *LoopFilter) isLoopTag(scmd string, argv [][]byte) bool {
+	return strings.EqualFold(scmd, "publish") && len(argv) == 2 && string(argv[0]) == lf.tag
+}
+
 /*
  * judge whether the input command with key should be filter,
  * @return:
@@ -76,21 +262,80 @@ func FilterDB(db int) bool {
  *     bool: true means pass
  */
 func HandleFilterKeyWithCommand(scmd string, commandArgv [][]byte) ([][]byte, bool) {
-	if len(conf.Options.FilterKeyWhitelist) == 0 && len(conf.Options.FilterKeyBlacklist) == 0 {
+	return New(&conf.Options).HandleFilterKeyWithCommand(scmd, commandArgv)
+}
+
+// the same as the package function HandleFilterKeyWithCommand
+func (f Filter) HandleFilterKeyWithCommand(scmd string, commandArgv [][]byte) ([][]byte, bool) {
+	if len(f.opts.FilterKeyWhitelist) == 0 && len(f.opts.FilterKeyBlacklist) == 0 {
 		// pass if no filter given
 		return commandArgv, false
 	}
 
 	cmdNode, ok := RedisCommands[scmd]
-	if !ok || len(commandArgv) == 0 {
-		// pass when command not found or length of argv == 0
+	if !ok || len(commandArgv) == 0 || channelCommands[scmd] {
+		// pass when command not found or length of argv == 0, the shard channel isn't a key
 		return commandArgv, false
 	}
 
-	newArgs, pass := getMatchKeys(cmdNode, commandArgv)
+	if cmdNode.getkey_proc != nil || cmdNode.lastkey > 1 {
+		// the keys depend on each other, e.g., the source and the destination of copy, or are
+		// counted by numkeys, so the command can't be cut and is dropped if any key is filtered
+		indexes, _ := CommandKeyIndexes(scmd, commandArgv)
+		for _, i := range indexes {
+			if f.FilterKey(string(commandArgv[i])) {
+				return commandArgv, true
+			}
+		}
+		return commandArgv, false
+	}
+
+	newArgs, pass := f.getMatchKeys(cmdNode, commandArgv)
 	return newArgs, !pass
 }
 
+// CommandKeys returns the keys of the command, false is returned if the command isn't in RedisCommands.
+func CommandKeys(scmd string, args [][]byte) ([][]byte, bool) {
+	indexes, ok := CommandKeyIndexes(scmd, args)
+	if !ok {
+		return nil, false
+	}
+
+	var keys [][]byte
+	for _, i := range indexes {
+		keys = append(keys, args[i])
+	}
+	return keys, true
+}
+
+// CommandKeyIndexes returns the indexes of the keys in the args of the command, false is
+// returned if the command isn't in RedisCommands.
+func CommandKeyIndexes(scmd string, args [][]byte) ([]int, bool) {
+	cmdNode, ok := RedisCommands[scmd]
+	if !ok {
+		return nil, false
+	}
+	if cmdNode.getkey_proc != nil {
+		return cmdNode.getkey_proc(args), true
+	}
+	n := len(args)
+
+	// the position counts from 1 and the negative one counts from the end
+	lastkey := cmdNode.lastkey - 1
+	if cmdNode.lastkey <= 0 {
+		lastkey = n + cmdNode.lastkey
+		if cmdNode.lastkey == 0 {
+			lastkey--
+		}
+	}
+
+	var indexes []int
+	for i := cmdNode.firstkey - 1; i <= lastkey && i < n; i += cmdNode.keystep {
+		indexes = append(indexes, i)
+	}
+	return indexes, true
+}
+
 // hasAtLeastOnePrefix checks whether the key begins with at least one of prefixes.
 func hasAtLeastOnePrefix(key string, prefixes []string) bool {
 	for _, prefix := range prefixes {
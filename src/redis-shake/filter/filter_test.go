@@ -7,6 +7,7 @@ import (
 	"testing"
 	"fmt"
 
+	"pkg/rdb"
 	"redis-shake/configure"
 
 	"github.com/stretchr/testify/assert"
@@ -21,7 +22,8 @@ func TestFilterCommands(t *testing.T) {
 		nr++
 
 		assert.Equal(t, false, FilterCommands("unknown-cmd"), "should be equal")
-		assert.Equal(t, true, FilterCommands("opinfo"), "should be equal")
+		// the opinfo of aliyun is dropped by the adapter of aliyun_cluster instead
+		assert.Equal(t, false, FilterCommands("opinfo"), "should be equal")
 		assert.Equal(t, false, FilterCommands("eval"), "should be equal")
 		conf.Options.FilterLua = true
 		assert.Equal(t, false, FilterCommands("unknown-cmd"), "should be equal")
@@ -32,6 +34,73 @@ func TestFilterCommands(t *testing.T) {
 	}
 }
 
+func TestFilterCommandList(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestFilterCommandList case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterCommandBlacklist = []string{"publish", "EVAL"}
+		assert.Equal(t, true, FilterCommands("PUBLISH"), "should be equal")
+		assert.Equal(t, true, FilterCommands("eval"), "should be equal")
+		assert.Equal(t, false, FilterCommands("set"), "should be equal")
+		assert.Equal(t, false, FilterCommands("multi"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterCommandList case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterCommandBlacklist = nil
+		conf.Options.FilterCommandWhitelist = []string{"set", "del"}
+		assert.Equal(t, false, FilterCommands("SET"), "should be equal")
+		assert.Equal(t, false, FilterCommands("del"), "should be equal")
+		assert.Equal(t, true, FilterCommands("publish"), "should be equal")
+		assert.Equal(t, true, FilterCommands("hset"), "should be equal")
+		assert.Equal(t, false, FilterCommands("multi"), "should be equal")
+		assert.Equal(t, false, FilterCommands("exec"), "should be equal")
+		assert.Equal(t, true, FilterCommands("opinfo"), "should be equal")
+	}
+}
+
+func TestFilterDangerousCommand(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestFilterDangerousCommand case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterDangerousCommand = false
+		assert.Equal(t, false, FilterDangerousCommand("flushall"), "should be equal")
+
+		conf.Options.FilterDangerousCommand = true
+		assert.Equal(t, true, FilterDangerousCommand("flushall"), "should be equal")
+		assert.Equal(t, true, FilterDangerousCommand("FLUSHDB"), "should be equal")
+		assert.Equal(t, true, FilterDangerousCommand("swapdb"), "should be equal")
+		assert.Equal(t, false, FilterDangerousCommand("set"), "should be equal")
+		assert.Equal(t, false, FilterDangerousCommand("del"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterDangerousCommand case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterDangerousCommand = true
+		conf.Options.FilterDangerousAllow = []string{"SWAPDB"}
+		assert.Equal(t, true, FilterDangerousCommand("flushall"), "should be equal")
+		assert.Equal(t, false, FilterDangerousCommand("swapdb"), "should be equal")
+	}
+}
+
 func TestFilterKey(t *testing.T) {
 	// test FilterKey
 
@@ -74,6 +143,20 @@ func TestFilterKey(t *testing.T) {
 		assert.Equal(t, false, FilterKey("a"), "should be equal")
 		assert.Equal(t, false, FilterKey("ab"), "should be equal")
 	}
+
+	{
+		fmt.Printf("TestFilterKey case %d.\n", nr)
+		nr++
+
+		// the checkpoint key is never synced even in the whitelist
+		conf.Options.FilterKeyBlacklist = []string{}
+		conf.Options.FilterKeyWhitelist = []string{"redis-shake"}
+		conf.Options.SyncCheckpointKey = "redis-shake-checkpoint"
+		assert.Equal(t, true, FilterKey("redis-shake-checkpoint:0"), "should be equal")
+		assert.Equal(t, false, FilterKey("redis-shake-key"), "should be equal")
+		conf.Options.SyncCheckpointKey = ""
+		assert.Equal(t, false, FilterKey("redis-shake-checkpoint:0"), "should be equal")
+	}
 }
 
 func TestFilterSlot(t *testing.T) {
@@ -98,6 +181,26 @@ func TestFilterSlot(t *testing.T) {
 		assert.Equal(t, true, FilterSlot(0), "should be equal")
 		assert.Equal(t, false, FilterSlot(5), "should be equal")
 	}
+
+	{
+		fmt.Printf("TestFilterSlot case %d.\n", nr)
+		nr++
+
+		// both ends of the range are included
+		conf.Options.FilterSlot = []string{"0-5460", "10923"}
+		assert.Equal(t, false, FilterSlot(0), "should be equal")
+		assert.Equal(t, false, FilterSlot(5460), "should be equal")
+		assert.Equal(t, true, FilterSlot(5461), "should be equal")
+		assert.Equal(t, false, FilterSlot(10923), "should be equal")
+		assert.Equal(t, true, FilterSlot(16383), "should be equal")
+
+		low, high, err := ParseSlotRange("100-200")
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, []int{100, 200}, []int{low, high}, "should be equal")
+		_, _, err = ParseSlotRange("100-")
+		assert.NotEqual(t, nil, err, "should be not equal")
+		conf.Options.FilterSlot = []string{}
+	}
 }
 
 func TestFilterDB(t *testing.T) {
@@ -139,6 +242,138 @@ func TestFilterDB(t *testing.T) {
 	}
 }
 
+func TestFilterType(t *testing.T) {
+	// test FilterType
+
+	// mixed rdb entry types, the last one is aux field
+	input := []byte{rdb.RdbTypeString, rdb.RdbTypeQuicklist, rdb.RdbTypeSetIntset, rdb.RdbTypeZSetZiplist,
+		rdb.RdbTypeHashZiplist, rdb.RDBTypeStreamListPacks, rdb.RdbTypeHash, rdb.RdbFlagAUX}
+	filterAll := func() []bool {
+		ret := make([]bool, len(input))
+		for i, tp := range input {
+			ret[i] = FilterType(tp)
+		}
+		return ret
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestFilterType case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterTypeWhitelist = []string{}
+		conf.Options.FilterTypeBlacklist = []string{}
+		assert.Equal(t, []bool{false, false, false, false, false, false, false, false}, filterAll(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterType case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterTypeWhitelist = []string{"string", "hash"}
+		conf.Options.FilterTypeBlacklist = []string{}
+		assert.Equal(t, []bool{false, true, true, true, false, true, false, false}, filterAll(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterType case %d.\n", nr)
+		nr++
+
+		conf.Options.FilterTypeWhitelist = []string{}
+		conf.Options.FilterTypeBlacklist = []string{"stream", "list"}
+		assert.Equal(t, []bool{false, true, false, false, false, true, false, false}, filterAll(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterType case %d.\n", nr)
+		nr++
+
+		// blacklist first when both given
+		conf.Options.FilterTypeWhitelist = []string{"string"}
+		conf.Options.FilterTypeBlacklist = []string{"zset"}
+		assert.Equal(t, []bool{false, false, false, true, false, false, false, false}, filterAll(), "should be equal")
+
+		conf.Options.FilterTypeWhitelist = []string{}
+		conf.Options.FilterTypeBlacklist = []string{}
+	}
+}
+
+func TestLoopFilter(t *testing.T) {
+	// test LoopFilter
+
+	type result struct {
+		skip  bool
+		multi bool
+	}
+	filter := func(lf *LoopFilter, cmd string, args ...string) result {
+		skip, multi := lf.Filter(cmd, convertToByte(args...))
+		return result{skip, multi}
+	}
+	pass, skip, release := result{false, false}, result{true, false}, result{false, true}
+
+	var nr int
+	{
+		fmt.Printf("TestLoopFilter case %d.\n", nr)
+		nr++
+
+		// disable
+		lf := NewLoopFilter("")
+		assert.Equal(t, pass, filter(lf, "publish", "shake-loop", "id"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "multi"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "set", "a", "1"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestLoopFilter case %d.\n", nr)
+		nr++
+
+		// the transaction of the loop tag is skipped, others pass
+		lf := NewLoopFilter("shake-loop")
+		assert.Equal(t, pass, filter(lf, "set", "a", "1"), "should be equal")
+		assert.Equal(t, skip, filter(lf, "multi"), "should be equal")
+		assert.Equal(t, true, lf.Holding(), "should be equal")
+		assert.Equal(t, skip, filter(lf, "publish", "shake-loop", "id"), "should be equal")
+		assert.Equal(t, false, lf.Holding(), "should be equal")
+		assert.Equal(t, skip, filter(lf, "set", "b", "2"), "should be equal")
+		assert.Equal(t, skip, filter(lf, "exec"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "set", "c", "3"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "publish", "other-channel", "msg"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "set", "d", "4"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestLoopFilter case %d.\n", nr)
+		nr++
+
+		// the command in the transaction isn't propagated, the loop tag alone is skipped and the
+		// command behind it passes
+		lf := NewLoopFilter("shake-loop")
+		assert.Equal(t, skip, filter(lf, "PUBLISH", "shake-loop", "id"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "select", "1"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "lpush", "list", "x"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "lpush", "list", "y"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestLoopFilter case %d.\n", nr)
+		nr++
+
+		// the transaction of the source passes with the multi held
+		lf := NewLoopFilter("shake-loop")
+		assert.Equal(t, skip, filter(lf, "MULTI"), "should be equal")
+		assert.Equal(t, release, filter(lf, "set", "a", "1"), "should be equal")
+		assert.Equal(t, false, lf.Holding(), "should be equal")
+		assert.Equal(t, pass, filter(lf, "set", "b", "2"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "exec"), "should be equal")
+
+		// the tagged transaction is discarded
+		assert.Equal(t, skip, filter(lf, "multi"), "should be equal")
+		assert.Equal(t, skip, filter(lf, "publish", "shake-loop", "id"), "should be equal")
+		assert.Equal(t, skip, filter(lf, "discard"), "should be equal")
+		assert.Equal(t, pass, filter(lf, "set", "c", "3"), "should be equal")
+	}
+}
+
 func TestHandleFilterKeyWithCommand(t *testing.T) {
 	// test HandleFilterKeyWithCommand
 
@@ -279,6 +514,55 @@ func TestHandleFilterKeyWithCommand(t *testing.T) {
 		assert.Equal(t, false, filter, "should be equal")
 		assert.Equal(t, expectArgs, ret, "should be equal")
 	}
+
+	// the keys which can't be cut
+	{
+		fmt.Printf("TestHandleFilterKeyWithCommand case %d.\n", nr)
+		nr++
+
+		for _, c := range []struct {
+			cmd  string
+			args [][]byte
+		}{
+			{"copy", convertToByte("xyz", "abc", "replace")},
+			{"lmove", convertToByte("xyz", "abc", "left", "right")},
+			{"rename", convertToByte("xyz", "abc")},
+			{"lmpop", convertToByte("2", "xyz", "abc", "left")},
+			{"zinterstore", convertToByte("abc", "2", "xyz", "ab")},
+		} {
+			conf.Options.FilterKeyBlacklist = []string{"zzz"}
+			conf.Options.FilterKeyWhitelist = []string{}
+			ret, filter = HandleFilterKeyWithCommand(c.cmd, c.args)
+			assert.Equal(t, false, filter, c.cmd)
+			assert.Equal(t, c.args, ret, c.cmd)
+
+			// one of the keys is filtered, the whole command is dropped
+			conf.Options.FilterKeyBlacklist = []string{"x"}
+			ret, filter = HandleFilterKeyWithCommand(c.cmd, c.args)
+			assert.Equal(t, true, filter, c.cmd)
+
+			conf.Options.FilterKeyBlacklist = []string{}
+			conf.Options.FilterKeyWhitelist = []string{"x", "ab"}
+			ret, filter = HandleFilterKeyWithCommand(c.cmd, c.args)
+			assert.Equal(t, false, filter, c.cmd)
+			assert.Equal(t, c.args, ret, c.cmd)
+		}
+	}
+
+	// the shard channel isn't filtered as the key
+	{
+		fmt.Printf("TestHandleFilterKeyWithCommand case %d.\n", nr)
+		nr++
+
+		cmd = "spublish"
+		args = convertToByte("xyz", "msg")
+		conf.Options.FilterKeyBlacklist = []string{"x"}
+		conf.Options.FilterKeyWhitelist = []string{}
+		ret, filter = HandleFilterKeyWithCommand(cmd, args)
+		assert.Equal(t, false, filter, "should be equal")
+		assert.Equal(t, args, ret, "should be equal")
+		conf.Options.FilterKeyBlacklist = []string{}
+	}
 }
 
 func TestHasAtLeastOnePrefix(t *testing.T) {
@@ -313,10 +597,161 @@ func TestHasAtLeastOnePrefix(t *testing.T) {
 	}
 }
 
+func TestCommandKeys(t *testing.T) {
+	cases := []struct {
+		cmd        string
+		args       [][]byte
+		expectKeys [][]byte
+		expectOk   bool
+	}{
+		{
+			"set",
+			convertToByte("a", "1"),
+			convertToByte("a"),
+			true,
+		},
+		{
+			// all the args are keys
+			"del",
+			convertToByte("a", "b", "c"),
+			convertToByte("a", "b", "c"),
+			true,
+		},
+		{
+			// key value pairs
+			"mset",
+			convertToByte("a", "1", "b", "2"),
+			convertToByte("a", "b"),
+			true,
+		},
+		{
+			// the last arg isn't key
+			"brpop",
+			convertToByte("a", "b", "0"),
+			convertToByte("a", "b"),
+			true,
+		},
+		{
+			"rpoplpush",
+			convertToByte("a", "b"),
+			convertToByte("a", "b"),
+			true,
+		},
+		{
+			"copy",
+			convertToByte("a", "b", "db", "1", "replace"),
+			convertToByte("a", "b"),
+			true,
+		},
+		{
+			"getdel",
+			convertToByte("a"),
+			convertToByte("a"),
+			true,
+		},
+		{
+			// the keys counted by numkeys
+			"lmpop",
+			convertToByte("2", "a", "b", "left", "count", "2"),
+			convertToByte("a", "b"),
+			true,
+		},
+		{
+			"blmpop",
+			convertToByte("0", "1", "a", "right"),
+			convertToByte("a"),
+			true,
+		},
+		{
+			"sintercard",
+			convertToByte("2", "a", "b", "limit", "1"),
+			convertToByte("a", "b"),
+			true,
+		},
+		{
+			// numkeys exceeds the args
+			"zmpop",
+			convertToByte("3", "a", "min"),
+			nil,
+			true,
+		},
+		{
+			// the destination and the keys counted by numkeys
+			"zunionstore",
+			convertToByte("d", "2", "a", "b", "weights", "1", "2"),
+			convertToByte("d", "a", "b"),
+			true,
+		},
+		{
+			"object",
+			convertToByte("freq", "a"),
+			convertToByte("a"),
+			true,
+		},
+		{
+			"xgroup",
+			convertToByte("create", "a", "g", "$"),
+			convertToByte("a"),
+			true,
+		},
+		{
+			// the shard channel
+			"spublish",
+			convertToByte("ch", "msg"),
+			convertToByte("ch"),
+			true,
+		},
+		{
+			// unknown command
+			"flushall",
+			nil,
+			nil,
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		keys, ok := CommandKeys(c.cmd, c.args)
+		assert.Equal(t, c.expectOk, ok, c.cmd)
+		assert.Equal(t, c.expectKeys, keys, c.cmd)
+	}
+}
+
 func convertToByte(args... string) [][]byte {
 	ret := make([][]byte, 0)
 	for _, arg := range args {
 		ret = append(ret, []byte(arg))
 	}
 	return ret
-}
\ No newline at end of file
+}
+func TestJobFilter(t *testing.T) {
+	// test Filter of the job
+
+	var nr int
+	{
+		fmt.Printf("TestJobFilter case %d.\n", nr)
+		nr++
+
+		// the filters of the job don't change the package functions
+		conf.Options.FilterKeyWhitelist = []string{}
+		conf.Options.FilterKeyBlacklist = []string{}
+		conf.Options.FilterDBWhitelist = []string{}
+		conf.Options.FilterDBBlacklist = []string{}
+		job := conf.Options
+		job.FilterKeyWhitelist = []string{"a"}
+		job.FilterDBBlacklist = []string{"1"}
+		f := New(&job)
+		assert.Equal(t, false, f.FilterKey("abc"), "should be equal")
+		assert.Equal(t, true, f.FilterKey("xyz"), "should be equal")
+		assert.Equal(t, false, FilterKey("xyz"), "should be equal")
+		assert.Equal(t, true, f.FilterDB(1), "should be equal")
+		assert.Equal(t, false, FilterDB(1), "should be equal")
+
+		newArgs, reject := f.HandleFilterKeyWithCommand("mset", [][]byte{[]byte("abc"), []byte("1"),
+			[]byte("xyz"), []byte("2")})
+		assert.Equal(t, false, reject, "should be equal")
+		assert.Equal(t, [][]byte{[]byte("abc"), []byte("1")}, newArgs, "should be equal")
+		_, reject = HandleFilterKeyWithCommand("mset", [][]byte{[]byte("xyz"), []byte("2")})
+		assert.Equal(t, false, reject, "should be equal")
+	}
+}
@@ -1,7 +1,12 @@
 // redis command struct.
 package filter
 
-type getkeys_proc func(args []string) []int
+import (
+	"strconv"
+)
+
+// return the indexes of the keys in the args, nil if the args are malformed
+type getkeys_proc func(args [][]byte) []int
 type redisCommand struct {
 	getkey_proc                getkeys_proc
 	firstkey, lastkey, keystep int
@@ -47,8 +52,10 @@ var RedisCommands = map[string]redisCommand{
 	"zremrangebyscore": {nil, 1, 1, 1},
 	"zremrangebyrank":  {nil, 1, 1, 1},
 	"zremrangebylex":   {nil, 1, 1, 1},
-	//"zunionstore", {zunionInterGetKeys, 0, 0, 0},
-	//"zinterstore", {zunionInterGetKeys, 0, 0, 0},
+	"zunionstore":      {storeNumKeysGetKeys, 0, 0, 0},
+	"zinterstore":      {storeNumKeysGetKeys, 0, 0, 0},
+	"zdiffstore":       {storeNumKeysGetKeys, 0, 0, 0},
+
 	"hset":         {nil, 1, 1, 1},
 	"hsetnx":       {nil, 1, 1, 1},
 	"hmset":        {nil, 1, 1, 1},
@@ -80,9 +87,87 @@ var RedisCommands = map[string]redisCommand{
 	//"georadiusbymember", {georadiusGetKeys, 1, 1, 1},
 	"pfadd":   {nil, 1, 1, 1},
 	"pfmerge": {nil, 1, -1, 1},
+
+	// redis 5.0 and later
+	"touch":      {nil, 1, -1, 1},
+	"zpopmin":    {nil, 1, 1, 1},
+	"zpopmax":    {nil, 1, 1, 1},
+	"bzpopmin":   {nil, 1, -2, 1},
+	"bzpopmax":   {nil, 1, -2, 1},
+	"xadd":       {nil, 1, 1, 1},
+	"xdel":       {nil, 1, 1, 1},
+	"xtrim":      {nil, 1, 1, 1},
+	"xack":       {nil, 1, 1, 1},
+	"xclaim":     {nil, 1, 1, 1},
+	"xautoclaim": {nil, 1, 1, 1},
+	"xsetid":     {nil, 1, 1, 1},
+	"xgroup":     {subcommandGetKeys, 0, 0, 0},
+	"object":     {subcommandGetKeys, 0, 0, 0},
+
+	// redis 6.2 and 7.0
+	"copy":           {nil, 1, 2, 1},
+	"getdel":         {nil, 1, 1, 1},
+	"getex":          {nil, 1, 1, 1},
+	"lmove":          {nil, 1, 2, 1},
+	"blmove":         {nil, 1, 2, 1},
+	"zrangestore":    {nil, 1, 2, 1},
+	"geosearchstore": {nil, 1, 2, 1},
+	"lmpop":          {numKeysGetKeys(0), 0, 0, 0},
+	"zmpop":          {numKeysGetKeys(0), 0, 0, 0},
+	"sintercard":     {numKeysGetKeys(0), 0, 0, 0},
+	"blmpop":         {numKeysGetKeys(1), 0, 0, 0},
+	"bzmpop":         {numKeysGetKeys(1), 0, 0, 0},
+
+	// the shard channels of the sharded pub/sub are hashed to the slots as the keys, so they're
+	// routed to the node of the slot, but they aren't filtered by filter.key, see channelCommands
+	"spublish":     {nil, 1, 1, 1},
+	"ssubscribe":   {nil, 1, -1, 1},
+	"sunsubscribe": {nil, 1, -1, 1},
+}
+
+// the commands whose "keys" are the shard channels
+var channelCommands = map[string]bool{
+	"spublish":     true,
+	"ssubscribe":   true,
+	"sunsubscribe": true,
+}
+
+// the keys follow the numkeys at the position, e.g., "lmpop numkeys key [key ...] LEFT|RIGHT"
+func numKeysGetKeys(pos int) getkeys_proc {
+	return func(args [][]byte) []int {
+		if len(args) <= pos {
+			return nil
+		}
+		num, err := strconv.Atoi(string(args[pos]))
+		if err != nil || num < 0 || pos+1+num > len(args) {
+			return nil
+		}
+		indexes := make([]int, 0, num)
+		for i := pos + 1; i <= pos+num; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+}
+
+// "zunionstore destination numkeys key [key ...] [WEIGHTS ...]", the destination is the first key
+func storeNumKeysGetKeys(args [][]byte) []int {
+	indexes := numKeysGetKeys(1)(args)
+	if indexes == nil {
+		return nil
+	}
+	return append([]int{0}, indexes...)
+}
+
+// the key follows the subcommand, e.g., "xgroup create key group id" and "object freq key"
+func subcommandGetKeys(args [][]byte) []int {
+	if len(args) < 2 {
+		return nil
+	}
+	return []int{1}
 }
 
-func getMatchKeys(redis_cmd redisCommand, args [][]byte) (new_args [][]byte, pass bool) {
+func (f Filter) getMatchKeys(redis_cmd redisCommand, args [][]byte) (new_args [][]byte, pass bool) {
 	lastkey := redis_cmd.lastkey - 1
 	keystep := redis_cmd.keystep
 
@@ -94,7 +179,7 @@ func getMatchKeys(redis_cmd redisCommand, args [][]byte) (new_args [][]byte, pas
 	number := 0                     // matching key number
 	for firstkey := redis_cmd.firstkey - 1; firstkey <= lastkey; firstkey += keystep {
 		key := string(args[firstkey])
-		if FilterKey(key) == false {
+		if f.FilterKey(key) == false {
 			// pass
 			array[number] = firstkey
 			number++
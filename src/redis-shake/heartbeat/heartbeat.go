@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"pkg/libs/log"
+	"redis-shake/base"
 	"redis-shake/configure"
 	"redis-shake/common"
 )
@@ -15,15 +16,30 @@ import (
 type HeartbeatController struct {
 	ServerUrl string
 	Interval  int32
+	Collect   func() []SyncerData // fetch the syncer info, may be nil
 }
 
 type HeartbeatData struct {
-	Id       string `json:"id"`
-	Ip       string `json:"ip"`
-	Port     int32  `json:"port"`
-	Ts       int64  `json:"ts"`
-	Version  string `json:"version"`
-	External string `json:"external"`
+	Id       string       `json:"id"`
+	Ip       string       `json:"ip"`
+	Port     int32        `json:"port"`
+	Ts       int64        `json:"ts"`
+	Version  string       `json:"version"`
+	External string       `json:"external"`
+	Status   string       `json:"status"`
+	Syncers  []SyncerData `json:"syncers"`
+}
+
+// status of one source->target link
+type SyncerData struct {
+	Id           int      `json:"id"`
+	Source       string   `json:"source"`
+	Target       []string `json:"target"`
+	SourceOffset int64    `json:"source_offset"` // offset acked by the source
+	TargetOffset int64    `json:"target_offset"` // offset received from the source
+	Lag          int64    `json:"lag"`           // target_offset - source_offset
+	Forward      int64    `json:"forward"`
+	Bypass       int64    `json:"bypass"`
 }
 
 type HeartbeatResponse struct {
@@ -41,7 +57,7 @@ func (c *HeartbeatController) Start() {
 		External: conf.Options.HeartbeatExternal,
 	}
 
-	ticker := time.NewTicker(time.Second * time.Duration(conf.Options.HeartbeatInterval))
+	ticker := time.NewTicker(time.Second * time.Duration(c.Interval))
 	defer ticker.Stop()
 
 	for range ticker.C {
@@ -51,34 +67,38 @@ func (c *HeartbeatController) Start() {
 
 func (c *HeartbeatController) run(data *HeartbeatData) {
 	data.Ts = time.Now().UnixNano() / int64(time.Millisecond)
+	data.Status = base.GetStatus()
+	if c.Collect != nil {
+		data.Syncers = c.Collect()
+	}
 	dataStr, _ := json.MarshalIndent(data, "", "  ")
 
 	client := http.Client{
 		Timeout: 10 * time.Second,
 	}
-	resp, err := client.Post(conf.Options.HeartbeatUrl, "application/json", bytes.NewBuffer(dataStr))
+	resp, err := client.Post(c.ServerUrl, "application/json", bytes.NewBuffer(dataStr))
 	if err != nil {
-		// log.PurePrintf("%s\n", NewLogItem("SendHearbeatFail", "WARN", NewErrorLogDetail(conf.Options.HeartbeatUrl, err.Error())))
-		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tError:%s", conf.Options.Id, conf.Options.HeartbeatUrl, err.Error())
+		// log.PurePrintf("%s\n", NewLogItem("SendHearbeatFail", "WARN", NewErrorLogDetail(c.ServerUrl, err.Error())))
+		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tError:%s", conf.Options.Id, c.ServerUrl, err.Error())
 		return
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		// log.PurePrintf("%s\n", NewLogItem("SendHearbeatFail", "WARN", NewErrorLogDetail(conf.Options.HeartbeatUrl, "ReadBodyFail")))
-		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tReason:ReadBodyFail\tError:%s\t", conf.Options.Id, conf.Options.HeartbeatUrl, err.Error())
+		// log.PurePrintf("%s\n", NewLogItem("SendHearbeatFail", "WARN", NewErrorLogDetail(c.ServerUrl, "ReadBodyFail")))
+		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tReason:ReadBodyFail\tError:%s\t", conf.Options.Id, c.ServerUrl, err.Error())
 		return
 	}
 
 	hbResp := HeartbeatResponse{}
 	if err := json.Unmarshal(body, &hbResp); err != nil {
-		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tReason:InvalidResponseBody\tResponse:%s\tError:%s\t", conf.Options.Id, conf.Options.HeartbeatUrl, body, err.Error())
+		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tReason:InvalidResponseBody\tResponse:%s\tError:%s\t", conf.Options.Id, c.ServerUrl, body, err.Error())
 		return
 	}
 
 	if hbResp.Error != 0 {
-		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tReason:ErrorResponse\tResponse:%s\t", conf.Options.Id, conf.Options.HeartbeatUrl, body)
+		log.Warnf("Event:SendHearbeatFail\tId:%s\tURL:%s\tReason:ErrorResponse\tResponse:%s\t", conf.Options.Id, c.ServerUrl, body)
 		return
 	}
 	log.Infof("Event: SendHearbeatDone\tId:%s\t", conf.Options.Id)
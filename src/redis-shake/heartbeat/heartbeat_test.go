@@ -0,0 +1,76 @@
+// +build linux darwin windows
+// +build integration
+
+package heartbeat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"redis-shake/base"
+	"redis-shake/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatRun(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestHeartbeatRun case %d.\n", nr)
+		nr++
+
+		bodyChan := make(chan []byte, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodyChan <- body
+			w.Write([]byte(`{"error":0,"msg":"","data":""}`))
+		}))
+		defer server.Close()
+
+		conf.Options.Id = "test-id"
+		base.SetStatus("incr")
+		c := &HeartbeatController{
+			ServerUrl: server.URL,
+			Interval:  1,
+			Collect: func() []SyncerData {
+				return []SyncerData{
+					{
+						Id:           0,
+						Source:       "127.0.0.1:6379",
+						Target:       []string{"127.0.0.1:6380"},
+						SourceOffset: 100,
+						TargetOffset: 150,
+						Lag:          50,
+						Forward:      10,
+						Bypass:       2,
+					},
+				}
+			},
+		}
+		c.run(&HeartbeatData{
+			Id:       conf.Options.Id,
+			External: "external-tag",
+		})
+
+		mp := make(map[string]interface{})
+		assert.Equal(t, nil, json.Unmarshal(<-bodyChan, &mp), "should be equal")
+		assert.Equal(t, "test-id", mp["id"], "should be equal")
+		assert.Equal(t, "external-tag", mp["external"], "should be equal")
+		assert.Equal(t, "incr", mp["status"], "should be equal")
+		assert.NotEqual(t, float64(0), mp["ts"], "should be equal")
+
+		syncers := mp["syncers"].([]interface{})
+		assert.Equal(t, 1, len(syncers), "should be equal")
+		syncer := syncers[0].(map[string]interface{})
+		assert.Equal(t, "127.0.0.1:6379", syncer["source"], "should be equal")
+		assert.Equal(t, float64(100), syncer["source_offset"], "should be equal")
+		assert.Equal(t, float64(150), syncer["target_offset"], "should be equal")
+		assert.Equal(t, float64(50), syncer["lag"], "should be equal")
+		assert.Equal(t, float64(10), syncer["forward"], "should be equal")
+		assert.Equal(t, float64(2), syncer["bypass"], "should be equal")
+	}
+}
@@ -0,0 +1,473 @@
+package run
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/libs/atomic2"
+	"redis-shake/common"
+	"redis-shake/configure"
+	"redis-shake/filter"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// one of the sender.target_parallel connections to the target in the increment sync
+type targetLane struct {
+	id int
+	c  redigo.Conn
+
+	sendBuf chan cmdDetail // sending queue
+	budget  *byteBudget    // bytes queued in sendBuf of all the lanes, nil if sender.max_bytes = 0
+	spill   *spillQueue    // commands over sendBuf, nil if sender.spill_file is empty
+
+	/*
+	 * this channel is used to calculate delay between redis-shake and target redis.
+	 * Once oplog sent, the corresponding delayNode push back into this queue. Next time
+	 * receive reply from target redis, the front node poped and then delay calculated.
+	 */
+	delayChannel chan *delayNode
+
+	redirectChannel chan *redirectNode // commands sent but not replied, used in target.follow_redirects and clusterdown_max_stall_ms
+	redirector      *utils.Redirector
+	stallConn       redigo.Conn        // retry the commands stalled by CLUSTERDOWN or LOADING, opened once needed
+	openStall       func() redigo.Conn // nil if target.clusterdown_max_stall_ms = 0
+	maxStall        time.Duration      // target.clusterdown_max_stall_ms
+	stallDB         []byte             // the db of the last select replied, selected on stallConn before retrying
+	stallSelected   []byte             // the db selected on stallConn
+	stalled         atomic2.Bool       // the receiver is retrying the command stalled, the sender holds
+
+	breaker     *utils.CircuitBreaker // nil if target.error_rate_threshold = 0
+	open        func() redigo.Conn    // reopen the connection once the breaker trips
+	reconnected chan redigo.Conn      // pass the reopened connection to the receiver
+	db          []byte                // the last db selected, selected again after reconnecting
+	inTx        bool                  // between multi and exec, the connection isn't reopened here
+	batchTx     bool                  // multi of sender.transaction is sent but exec isn't
+
+	unreplied *sentQueue         // commands sent but not replied, nil if target.reconnect_retries = 0
+	reopen    func() *recordConn // reopen the broken connection, nil if the target can't be connected
+	broken    chan struct{}      // the receiver finds the connection broken, see replayLane
+
+	ackChannel chan *ackNode // the last command of each batch flushed, used in sync.checkpoint_file
+	acked      atomic2.Int64 // source offset of the commands replied, see ackNode
+
+	reauth      *time.Ticker  // authenticate again, nil if the token of target.auth_provider doesn't expire
+	authType    string        // target.auth_type
+	authToken   func() string // the new token
+	authChannel chan int64    // the reply ids of auth, skipped by the receiver
+
+	sendId, recvId atomic2.Int64
+	pending        atomic2.Int64 // commands queued or sent but not replied
+
+	done   chan struct{}   // closed once the sender quits
+	failed <-chan struct{} // closed once the syncer fails, the sender may quit already
+	closed atomic2.Bool    // the connection is closed once the syncer quits
+}
+
+func (ds *dbSyncer) openTargetLane(id int, target []string, auth_type, passwd string, tlsConfig *tls.Config,
+	readTimeout, writeTimeout time.Duration) *targetLane {
+	l := &targetLane{
+		id:           id,
+		sendBuf:      make(chan cmdDetail, ds.senderCount()),
+		delayChannel: make(chan *delayNode, ds.opts().SenderDelayChannelSize),
+		ackChannel:   make(chan *ackNode, ackChannelSize),
+		done:         make(chan struct{}),
+		failed:       ds.failed,
+	}
+	l.open = func() redigo.Conn {
+		var c redigo.Conn
+		if ds.opts().TargetResp3 {
+			c = utils.OpenResp3ConnWithTimeout(target[0], auth_type, passwd, readTimeout, writeTimeout, tlsConfig)
+		} else {
+			c = utils.OpenRedisConnWithTimeout(target, auth_type, passwd, readTimeout, writeTimeout,
+				ds.opts().TargetType == conf.RedisTypeCluster, tlsConfig)
+		}
+		return utils.LimitRedisConn(c, ds.targetLimiter)
+	}
+	if ds.opts().TargetReconnectRetries > 0 {
+		l.unreplied = new(sentQueue)
+		l.broken = make(chan struct{}, 1)
+		l.reconnected = make(chan redigo.Conn)
+		open := l.open
+		l.open = func() redigo.Conn {
+			return &recordConn{Conn: open(), q: l.unreplied}
+		}
+		master := target // the master switched to by the sentinel, used by the sender only
+		l.reopen = func() *recordConn {
+			// the token given by target.auth_provider may be expired already
+			passwd := utils.FetchAuthToken(utils.TargetAuthProvider, passwd)
+			master = ds.resolveSentinelTarget(master)
+			var c redigo.Conn
+			if ds.opts().TargetResp3 {
+				c = utils.OpenResp3ConnSoft(master[0], auth_type, passwd, readTimeout, writeTimeout, tlsConfig)
+			} else {
+				c = utils.OpenRedisConnSoft(master, auth_type, passwd, readTimeout, writeTimeout,
+					ds.opts().TargetType == conf.RedisTypeCluster, tlsConfig)
+			}
+			if c == nil {
+				return nil
+			}
+			return &recordConn{Conn: utils.LimitRedisConn(c, ds.targetLimiter), q: l.unreplied}
+		}
+	}
+	l.c = l.open()
+	if ds.opts().TargetErrorRate > 0 {
+		l.breaker = utils.NewCircuitBreaker(ds.opts().TargetErrorRate, ds.opts().TargetErrorWindow)
+		if l.reconnected == nil {
+			l.reconnected = make(chan redigo.Conn)
+		}
+	}
+	if ds.opts().TargetFollowRedirects || ds.opts().TargetMaxStall > 0 {
+		l.redirectChannel = make(chan *redirectNode, ds.senderCount())
+	}
+	if ds.opts().TargetFollowRedirects {
+		l.redirector = utils.NewRedirector(auth_type, passwd, readTimeout, writeTimeout, tlsConfig)
+	}
+	if interval := utils.ReauthInterval(utils.TargetAuthProvider); interval > 0 &&
+		ds.opts().TargetType != conf.RedisTypeCluster {
+		// the connections of the cluster are authenticated once opened
+		l.reauth = time.NewTicker(interval)
+		l.authType = auth_type
+		l.authToken = func() string {
+			return utils.FetchAuthToken(utils.TargetAuthProvider, passwd)
+		}
+		l.authChannel = make(chan int64, 1)
+	}
+	if ds.opts().TargetMaxStall > 0 {
+		l.maxStall = time.Duration(ds.opts().TargetMaxStall) * time.Millisecond
+		l.openStall = func() redigo.Conn {
+			return utils.OpenRedisConnSoft(target, auth_type, utils.FetchAuthToken(utils.TargetAuthProvider, passwd),
+				readTimeout, writeTimeout, ds.opts().TargetType == conf.RedisTypeCluster, tlsConfig)
+		}
+	}
+	return l
+}
+
+/*
+ * retry the command replied CLUSTERDOWN, LOADING or TRYAGAIN on another connection by
+ * utils.RetryStalled, it's called by the receiver so the following replies wait for it, and the
+ * sender holds the commands not sent yet until it's done. The commands already sent after it on
+ * the lane are applied by the target before the retry, so the writes may be reordered within the
+ * commands in flight. The db replied last on the lane is selected first. The target which can't be
+ * connected, e.g., the master is failing over, is taken as still stalled.
+ */
+func (l *targetLane) retryStalled(err error, cmd string, args [][]byte) (interface{}, error) {
+	l.stalled.Set(true)
+	defer l.stalled.Set(false)
+	data := make([]interface{}, len(args))
+	for i := range args {
+		data[i] = args[i]
+	}
+	return utils.RetryStalled(l.maxStall, err, cmd, func() (interface{}, error) {
+		if l.stallConn != nil && l.stallConn.Err() != nil {
+			l.stallConn.Close()
+			l.stallConn = nil
+		}
+		if l.stallConn == nil {
+			if l.stallConn = l.openStall(); l.stallConn == nil {
+				return nil, err
+			}
+			l.stallSelected = nil
+		} else {
+			utils.RefreshSlots(l.stallConn)
+		}
+		if l.stallDB != nil && !bytes.Equal(l.stallDB, l.stallSelected) {
+			if _, err := l.stallConn.Do("select", l.stallDB); err != nil {
+				return nil, err
+			}
+			l.stallSelected = l.stallDB
+		}
+		return l.stallConn.Do(cmd, data...)
+	})
+}
+
+// one command sent, kept until it's replied
+type sentCommand struct {
+	cmd  string
+	args []interface{}
+}
+
+// the commands sent but not replied in order, used in target.reconnect_retries
+type sentQueue struct {
+	mu   sync.Mutex
+	cmds []sentCommand
+	db   interface{}   // the db of the last select replied, selected first after reconnecting
+	tx   []sentCommand // multi and the commands queued after it till exec, queued again after reconnecting
+}
+
+func (q *sentQueue) push(cmd string, args []interface{}) {
+	q.mu.Lock()
+	q.cmds = append(q.cmds, sentCommand{cmd: cmd, args: args})
+	q.mu.Unlock()
+}
+
+// the front command is replied
+func (q *sentQueue) pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.cmds) == 0 {
+		return
+	}
+	switch front := q.cmds[0]; {
+	case strings.EqualFold(front.cmd, "multi"):
+		q.tx = []sentCommand{front}
+	case strings.EqualFold(front.cmd, "exec"):
+		// select in the transaction takes effect now
+		for _, cmd := range q.tx {
+			if strings.EqualFold(cmd.cmd, "select") && len(cmd.args) == 1 {
+				q.db = cmd.args[0]
+			}
+		}
+		q.tx = nil
+	case strings.EqualFold(front.cmd, "discard"):
+		q.tx = nil
+	case q.tx != nil:
+		// only queued by the target
+		q.tx = append(q.tx, front)
+	case strings.EqualFold(front.cmd, "select") && len(front.args) == 1:
+		q.db = front.args[0]
+	}
+	q.cmds[0] = sentCommand{}
+	q.cmds = q.cmds[1:]
+}
+
+// the commands not replied, the db selected before them and the transaction they're in
+func (q *sentQueue) all() ([]sentCommand, interface{}, []sentCommand) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]sentCommand(nil), q.cmds...), q.db, append([]sentCommand(nil), q.tx...)
+}
+
+// the connection which keeps each command sent in the queue
+type recordConn struct {
+	redigo.Conn
+	q *sentQueue
+}
+
+func (c *recordConn) Send(cmd string, args ...interface{}) error {
+	c.q.push(cmd, args)
+	return c.Conn.Send(cmd, args...)
+}
+
+func (l *targetLane) push(item cmdDetail) {
+	l.pending.Incr()
+	if l.spill != nil {
+		l.spill.push(l, item)
+		return
+	}
+	if l.budget != nil {
+		l.budget.acquire(item.size())
+	}
+	select {
+	case l.sendBuf <- item:
+	case <-l.failed:
+		l.pending.Decr()
+	}
+}
+
+// the next command queued, its bytes are given back to the budget
+func (l *targetLane) pop(item cmdDetail) {
+	if l.budget != nil {
+		l.budget.release(item.size())
+	}
+}
+
+/*
+ * byteBudget bounds the bytes of the commands queued in sendBuf by sender.max_bytes, the decoder
+ * blocks once it's full so that a slow target doesn't make the memory grow without limit. The
+ * command larger than the budget is still queued once the budget is empty.
+ */
+type byteBudget struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int64
+	used    int64
+	aborted bool // acquire doesn't block any more
+}
+
+func newByteBudget(max uint64) *byteBudget {
+	if max == 0 {
+		return nil
+	}
+	b := &byteBudget{max: int64(max)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *byteBudget) acquire(n int64) {
+	b.mu.Lock()
+	for !b.aborted && b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mu.Unlock()
+}
+
+// acquire without blocking, false if the budget is full
+func (b *byteBudget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.aborted && b.used > 0 && b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// the syncer fails, the senders may quit without giving back the bytes
+func (b *byteBudget) abort() {
+	b.mu.Lock()
+	b.aborted = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// the bytes queued now
+func (b *byteBudget) queued() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (l *targetLane) close() {
+	l.closed.Set(true)
+	if l.reauth != nil {
+		l.reauth.Stop()
+	}
+	l.c.Close()
+	if l.spill != nil {
+		l.spill.remove()
+	}
+}
+
+// wait until all the commands queued in the lane are replied, or the syncer fails
+func (l *targetLane) drain() {
+	for l.pending.Get() > 0 {
+		select {
+		case <-l.failed:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+/*
+ * laneDispatcher spreads the commands among the lanes while keeping the order of each key:
+ * 1. the command whose keys are all in the same lane goes to that lane, the lane is picked by
+ *    the slot of the key so that the keys with the same hash tag stay together.
+ * 2. select is sent on all the lanes.
+ * 3. the commands between multi and exec are dispatched as a whole.
+ * 4. the others, e.g., the keys are in different lanes, flushall, eval or the commands unknown,
+ *    are sent on the first lane after all the lanes are drained, and the following commands
+ *    wait for its reply.
+ */
+type laneDispatcher struct {
+	lanes []*targetLane
+	multi []cmdDetail // commands in multi
+	inTx  bool
+}
+
+func newLaneDispatcher(lanes []*targetLane) *laneDispatcher {
+	return &laneDispatcher{lanes: lanes}
+}
+
+func (d *laneDispatcher) Send(item cmdDetail) {
+	if len(d.lanes) == 1 {
+		d.lanes[0].push(item)
+		return
+	}
+
+	switch {
+	case strings.EqualFold(item.Cmd, "select"):
+		// every connection has its own db
+		for _, l := range d.lanes {
+			l.push(item)
+		}
+		return
+	case strings.EqualFold(item.Cmd, "multi"):
+		d.inTx = true
+		d.multi = append(d.multi[:0], item)
+		return
+	case d.inTx:
+		d.multi = append(d.multi, item)
+		if strings.EqualFold(item.Cmd, "exec") || strings.EqualFold(item.Cmd, "discard") {
+			d.inTx = false
+			d.sendBatch(d.multi)
+		}
+		return
+	case strings.EqualFold(item.Cmd, "ping"):
+		// no data is changed
+		d.lanes[0].push(item)
+		return
+	}
+
+	d.sendBatch([]cmdDetail{item})
+}
+
+func (d *laneDispatcher) sendBatch(items []cmdDetail) {
+	lane := -1
+	for _, item := range items {
+		if strings.EqualFold(item.Cmd, "multi") || strings.EqualFold(item.Cmd, "exec") ||
+			strings.EqualFold(item.Cmd, "discard") {
+			continue
+		}
+		keys, ok := filter.CommandKeys(strings.ToLower(item.Cmd), item.Args)
+		if !ok {
+			lane = -2
+			break
+		}
+		for _, key := range keys {
+			if n := d.laneOf(key); lane == -1 {
+				lane = n
+			} else if lane != n {
+				lane = -2
+				break
+			}
+		}
+	}
+
+	if lane >= 0 {
+		for _, item := range items {
+			d.lanes[lane].push(item)
+		}
+		return
+	}
+
+	// keep the order with all the lanes
+	for _, l := range d.lanes {
+		l.drain()
+	}
+	for _, item := range items {
+		d.lanes[0].push(item)
+	}
+	d.lanes[0].drain()
+}
+
+func (d *laneDispatcher) laneOf(key []byte) int {
+	return int(utils.KeyToSlot(string(key))) % len(d.lanes)
+}
+
+// the sender quits once the queue is drained
+func (d *laneDispatcher) Close() {
+	for _, l := range d.lanes {
+		if l.spill != nil {
+			// closed by feedLane once the commands spilled are queued
+			l.spill.close()
+			continue
+		}
+		close(l.sendBuf)
+	}
+}
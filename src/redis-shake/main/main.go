@@ -8,10 +8,12 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"runtime/debug"
@@ -25,6 +27,7 @@ import (
 	"redis-shake/base"
 	"redis-shake/common"
 	"redis-shake/configure"
+	"redis-shake/filter"
 	"redis-shake/metric"
 	"redis-shake/restful"
 
@@ -34,11 +37,12 @@ import (
 
 type Exit struct{ Code int }
 
+// closed once SIGINT or SIGTERM is received, the signal handler exits the process then
+var signaled = make(chan struct{})
+
 const (
-	defaultHttpPort    = 9320
-	defaultSystemPort  = 9310
-	defaultSenderSize  = 65535
-	defaultSenderCount = 1024
+	defaultHttpPort   = 9320
+	defaultSystemPort = 9310
 )
 
 func main() {
@@ -48,8 +52,12 @@ func main() {
 
 	// argument options
 	configuration := flag.String("conf", "", "configuration path")
-	tp := flag.String("type", "", "run type: decode, restore, dump, sync, rump")
+	tp := flag.String("type", "", "run type: decode, restore, dump, sync, rump, replay, reshard")
 	version := flag.Bool("version", false, "show version")
+	check := flag.Bool("check", false, "only check the connectivity and permissions of source and target, then exit")
+	encodePassword := flag.String("encode_password", "", "encode the password read from stdin for password_encoding "+
+		"by the encoding: base64, aes-gcm, then exit")
+	overrideOptions := conf.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *version {
@@ -57,6 +65,22 @@ func main() {
 		return
 	}
 
+	if *encodePassword != "" {
+		// the key is given by -password.key_file or the environment variable REDISSHAKE_PASSWORD_KEY
+		if err := conf.LoadEnv(&conf.Options, os.Environ()); err != nil {
+			crash(fmt.Sprintf("Configure environment variables parse failed. %v", err), -3)
+		}
+		if err := overrideOptions(&conf.Options); err != nil {
+			crash(fmt.Sprintf("Configure flags parse failed. %v", err), -3)
+		}
+		encoded, err := encodePasswordFromStdin(*encodePassword)
+		if err != nil {
+			crash(fmt.Sprintf("Encode password failed. %v", err), -3)
+		}
+		fmt.Println(encoded)
+		return
+	}
+
 	if *configuration == "" || *tp == "" {
 		if !*version {
 			fmt.Println("Please show me the '-conf' and '-type'")
@@ -74,18 +98,37 @@ func main() {
 		crash(fmt.Sprintf("Configure file open failed. %v", err), -1)
 	}
 
+	// default value if not given in the configuration
+	conf.Preset(&conf.Options)
+
 	configure := nimo.NewConfigLoader(file)
 	configure.SetDateFormat(utils.GolangSecurityTime)
 	if err := configure.Load(&conf.Options); err != nil {
 		crash(fmt.Sprintf("Configure file %s parse failed. %v", *configuration, err), -2)
 	}
 
+	// the environment variables and flags override the file
+	if err := conf.LoadEnv(&conf.Options, os.Environ()); err != nil {
+		crash(fmt.Sprintf("Configure environment variables parse failed. %v", err), -3)
+	}
+	if err := overrideOptions(&conf.Options); err != nil {
+		crash(fmt.Sprintf("Configure flags parse failed. %v", err), -3)
+	}
+
 	// verify parameters
-	if err = sanitizeOptions(*tp); err != nil {
+	if *tp == conf.TypeSync && len(conf.Options.SyncJobs) != 0 {
+		err = sanitizeJobs(*check)
+	} else {
+		err = sanitizeOptions(*tp, *check)
+	}
+	if err != nil {
 		crash(fmt.Sprintf("Conf.Options check failed: %s", err.Error()), -4)
 	}
+	if *check {
+		fmt.Println("Preflight check passed")
+		return
+	}
 
-	initSignal()
 	initFreeOS()
 	nimo.Profiling(int(conf.Options.SystemProfile))
 	utils.Welcome()
@@ -104,15 +147,19 @@ func main() {
 		runner = new(run.CmdRestore)
 	case conf.TypeDump:
 		runner = new(run.CmdDump)
-	case conf.TypeSync:
+	case conf.TypeSync, conf.TypeReplay:
 		runner = new(run.CmdSync)
 	case conf.TypeRump:
 		runner = new(run.CmdRump)
+	case conf.TypeReshard:
+		runner = new(run.CmdReshard)
 	}
 
+	initSignal(runner)
+
 	// create metric
 	metric.CreateMetric(runner)
-	go startHttpServer()
+	go startHttpServer(runner)
 
 	// print configuration
 	if opts, err := json.Marshal(conf.Options); err != nil {
@@ -124,15 +171,42 @@ func main() {
 	// run
 	runner.Main()
 
+	select {
+	case <-signaled:
+		// stopped by the signal, wait for the handler to finish the shutdown
+		select {}
+	default:
+	}
 	log.Infof("execute runner[%v] finished!", reflect.TypeOf(runner))
 }
 
-func initSignal() {
+// the runner which waits for the commands sent before exiting, see shutdown.drain_timeout_ms
+type drainer interface {
+	Drain(timeout time.Duration) int64
+}
+
+func initSignal(runner base.Runner) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigs
 		log.Info("receive signal: ", sig)
+		close(signaled)
+		go func() {
+			sig := <-sigs
+			log.Warnf("receive signal %v again, force exit", sig)
+			os.Exit(1)
+		}()
+
+		if d, ok := runner.(drainer); ok {
+			timeout := time.Duration(conf.Options.ShutdownDrainTimeoutMs) * time.Millisecond
+			if unconfirmed := d.Drain(timeout); unconfirmed != 0 {
+				log.Warnf("Event:DrainTimeout\tId:%s\tforce exit with %d commands unconfirmed after %v",
+					conf.Options.Id, unconfirmed, timeout)
+			} else {
+				log.Infof("Event:DrainDone\tId:%s\tall the commands sent are confirmed", conf.Options.Id)
+			}
+		}
 
 		if utils.LogRotater != nil {
 			utils.LogRotater.Rotate()
@@ -151,7 +225,13 @@ func initFreeOS() {
 	}()
 }
 
-func startHttpServer() {
+// the runner whose increment can be paused by /pause and resumed by /resume
+type pauser interface {
+	Pause() interface{}
+	Resume() interface{}
+}
+
+func startHttpServer(runner base.Runner) {
 	if conf.Options.HttpProfile == -1 {
 		return
 	}
@@ -160,6 +240,14 @@ func startHttpServer() {
 	utils.HttpApi.RegisterAPI("/conf", nimo.HttpGet, func([]byte) interface{} {
 		return &conf.Options
 	})
+	if p, ok := runner.(pauser); ok {
+		utils.HttpApi.RegisterAPI("/pause", nimo.HttpPost, func([]byte) interface{} {
+			return p.Pause()
+		})
+		utils.HttpApi.RegisterAPI("/resume", nimo.HttpPost, func([]byte) interface{} {
+			return p.Resume()
+		})
+	}
 	restful.RestAPI()
 
 	if err := utils.HttpApi.Listen(); err != nil {
@@ -168,11 +256,24 @@ func startHttpServer() {
 }
 
 // sanitize options
-func sanitizeOptions(tp string) error {
+func sanitizeOptions(tp string, check bool) error {
 	var err error
-	if tp != conf.TypeDecode && tp != conf.TypeRestore && tp != conf.TypeDump && tp != conf.TypeSync && tp != conf.TypeRump {
+	if tp != conf.TypeDecode && tp != conf.TypeRestore && tp != conf.TypeDump && tp != conf.TypeSync && tp != conf.TypeRump &&
+		tp != conf.TypeReplay && tp != conf.TypeReshard {
 		return fmt.Errorf("unknown type[%v]", tp)
 	}
+	if tp == conf.TypeReplay {
+		if conf.Options.SourceAofFile == "" {
+			return fmt.Errorf("source.aof_file should be given in type[%v]", tp)
+		} else if len(conf.Options.SyncJobs) != 0 || conf.Options.SyncFullOnly {
+			return fmt.Errorf("sync.jobs and sync.full_only aren't supported in type[%v]", tp)
+		} else if conf.Options.SyncRestartRetries != 0 {
+			return fmt.Errorf("sync.restart_retries isn't supported in type[%v]", tp)
+		}
+		// the same as sync from the files, but it quits at the end of the aof
+		tp = conf.TypeSync
+	}
+	conf.FillDefaults(&conf.Options)
 
 	if conf.Options.Id == "" {
 		return fmt.Errorf("id shoudn't be empty")
@@ -186,9 +287,7 @@ func sanitizeOptions(tp string) error {
 		runtime.GOMAXPROCS(conf.Options.NCpu)
 	}
 
-	if conf.Options.Parallel == 0 { // not set
-		conf.Options.Parallel = 64 // default is 64
-	} else if conf.Options.Parallel > 1024 {
+	if conf.Options.Parallel > 1024 {
 		return fmt.Errorf("parallel[%v] should in (0, 1024]", conf.Options.Parallel)
 	} else {
 		conf.Options.Parallel = int(math.Max(float64(conf.Options.Parallel), float64(conf.Options.NCpu)))
@@ -197,29 +296,246 @@ func sanitizeOptions(tp string) error {
 	// 500 M
 	if conf.Options.BigKeyThreshold > 500 * utils.MB {
 		return fmt.Errorf("BigKeyThreshold[%v] should <= 500 MB", conf.Options.BigKeyThreshold)
-	} else if conf.Options.BigKeyThreshold == 0 {
-		conf.Options.BigKeyThreshold = 50 * utils.MB
+	}
+	if conf.Options.TargetRestoreMaxBytes > 0 && conf.Options.TargetType != conf.RedisTypeCluster &&
+		conf.Options.TargetType != conf.RedisTypeProxy {
+		return fmt.Errorf("target.restore_max_bytes is only supported when target.type is %v or %v",
+			conf.RedisTypeCluster, conf.RedisTypeProxy)
 	}
 
+	// the key of the passwords encrypted
+	passwordKey, err := utils.LoadPasswordKey(conf.Options.PasswordKey, conf.Options.PasswordKeyFile)
+	if err != nil {
+		return fmt.Errorf("load the password key failed[%v]", err)
+	}
 	// source password
 	if conf.Options.SourcePasswordRaw != "" && conf.Options.SourcePasswordEncoding != "" {
 		return fmt.Errorf("only one of source password_raw or password_encoding should be given")
 	} else if conf.Options.SourcePasswordEncoding != "" {
-		sourcePassword := "" // todo, inner version
-		conf.Options.SourcePasswordRaw = string(sourcePassword)
+		if conf.Options.SourcePasswordRaw, err = utils.DecodePassword(conf.Options.SourcePasswordEncoding,
+			passwordKey); err != nil {
+			return fmt.Errorf("decode source.password_encoding failed[%v]", err)
+		}
 	}
 	// target password
 	if conf.Options.TargetPasswordRaw != "" && conf.Options.TargetPasswordEncoding != "" {
 		return fmt.Errorf("only one of target password_raw or password_encoding should be given")
 	} else if conf.Options.TargetPasswordEncoding != "" {
-		targetPassword := "" // todo, inner version
-		conf.Options.TargetPasswordRaw = string(targetPassword)
+		if conf.Options.TargetPasswordRaw, err = utils.DecodePassword(conf.Options.TargetPasswordEncoding,
+			passwordKey); err != nil {
+			return fmt.Errorf("decode target.password_encoding failed[%v]", err)
+		}
+	}
+	// the password referencing the secret is fetched by the auth provider so that it's refreshed,
+	// but the jobs of sync.jobs share the providers, so the job keeps the reference which has its
+	// own provider, see utils.SecretPassword
+	for _, side := range []struct {
+		name               string
+		password, provider *string
+	}{
+		{"source", &conf.Options.SourcePasswordRaw, &conf.Options.SourceAuthProvider},
+		{"target", &conf.Options.TargetPasswordRaw, &conf.Options.TargetAuthProvider},
+	} {
+		if !utils.IsSecretRef(*side.password) {
+			continue
+		}
+		if len(conf.Options.SyncJobs) != 0 {
+			if _, err = utils.SecretPassword(*side.password); err != nil {
+				return fmt.Errorf("fetch %s.password_raw failed[%v]", side.name, err)
+			}
+		} else if *side.provider != "" {
+			return fmt.Errorf("only one of %s password_raw referencing the secret or auth_provider should be given",
+				side.name)
+		} else {
+			*side.provider = *side.password
+		}
+	}
+	// auth token provider, the first token is used as the password in all modes
+	if provider, err := utils.NewAuthTokenProvider(conf.Options.SourceAuthProvider); err != nil {
+		return fmt.Errorf("parse source.auth_provider failed[%v]", err)
+	} else if provider != nil {
+		token, err := provider.Token()
+		if err != nil {
+			return fmt.Errorf("fetch source auth token failed[%v]", err)
+		}
+		conf.Options.SourcePasswordRaw = token
+		utils.SourceAuthProvider = provider
+	}
+	if provider, err := utils.NewAuthTokenProvider(conf.Options.TargetAuthProvider); err != nil {
+		return fmt.Errorf("parse target.auth_provider failed[%v]", err)
+	} else if provider != nil {
+		token, err := provider.Token()
+		if err != nil {
+			return fmt.Errorf("fetch target auth token failed[%v]", err)
+		}
+		conf.Options.TargetPasswordRaw = token
+		utils.TargetAuthProvider = provider
+	}
+	// tls configuration of the source and the target apart
+	if config, err := utils.NewTLSConfig(utils.TLSOptions{
+		CaFile:     conf.Options.SourceTLSCaFile,
+		CertFile:   conf.Options.SourceTLSCertFile,
+		KeyFile:    conf.Options.SourceTLSKeyFile,
+		SkipVerify: conf.Options.SourceTLSSkipVerify,
+	}); err != nil {
+		return fmt.Errorf("load tls files of the source failed[%v]", err)
+	} else {
+		utils.SourceTLSConfig = config
+	}
+	if config, err := utils.NewTLSConfig(utils.TLSOptions{
+		CaFile:     conf.Options.TargetTLSCaFile,
+		CertFile:   conf.Options.TargetTLSCertFile,
+		KeyFile:    conf.Options.TargetTLSKeyFile,
+		SkipVerify: conf.Options.TargetTLSSkipVerify,
+	}); err != nil {
+		return fmt.Errorf("load tls files of the target failed[%v]", err)
+	} else {
+		utils.TargetTLSConfig = config
+	}
+
+	// the source redis is replaced by the files
+	fileSource := tp == conf.TypeSync && conf.Options.SourceAofFile != ""
+	if tp == conf.TypeSync && conf.Options.SourceRdbFile != "" && !fileSource {
+		return fmt.Errorf("source.rdb_file needs source.aof_file")
+	} else if fileSource {
+		if err := checkFileSource(); err != nil {
+			return err
+		}
+	}
+
+	if conf.Options.SourceClusterReadFrom != conf.ClusterReadFromMaster &&
+		conf.Options.SourceClusterReadFrom != conf.ClusterReadFromReplica {
+		return fmt.Errorf("source.cluster_read_from[%v] should be in {%v, %v}", conf.Options.SourceClusterReadFrom,
+			conf.ClusterReadFromMaster, conf.ClusterReadFromReplica)
+	} else if conf.Options.SourceClusterReadFrom == conf.ClusterReadFromReplica &&
+		(tp != conf.TypeSync || conf.Options.SourceType != conf.RedisTypeCluster) {
+		return fmt.Errorf("source.cluster_read_from = %v is only supported in %v when source.type = %v",
+			conf.ClusterReadFromReplica, conf.TypeSync, conf.RedisTypeCluster)
+	}
+
+	if tp == conf.TypeReshard {
+		if conf.Options.SourceType != conf.RedisTypeCluster {
+			return fmt.Errorf("source.type should be %v in %v", conf.RedisTypeCluster, tp)
+		} else if conf.Options.TargetAddress != "" && conf.Options.TargetType != conf.RedisTypeCluster {
+			return fmt.Errorf("target.type should be %v in %v if target.address is given", conf.RedisTypeCluster, tp)
+		}
+		var err error
+		if conf.Options.ReshardPlan, err = utils.ParseReshardPlan(conf.Options.ReshardPlanString); err != nil {
+			return fmt.Errorf("parse reshard.plan[%v] failed[%v]", conf.Options.ReshardPlanString, err)
+		} else if len(conf.Options.ReshardPlan) == 0 {
+			return fmt.Errorf("reshard.plan should be given in %v", tp)
+		}
+		if conf.Options.ReshardBatch == 0 {
+			conf.Options.ReshardBatch = 100
+		}
+	} else if conf.Options.ReshardPlanString != "" {
+		return fmt.Errorf("reshard.plan is only supported in %v", conf.TypeReshard)
+	}
+
+	// the addresses discovered in ParseAddress are mapped already
+	if conf.Options.AddressMapString != "" {
+		var err error
+		if conf.Options.AddressMap, err = utils.ParseAddressMap(conf.Options.AddressMapString); err != nil {
+			return fmt.Errorf("parse cluster.address_map[%v] failed[%v]", conf.Options.AddressMapString, err)
+		}
+	}
+	if conf.Options.DialPreferFamily != "" && conf.Options.DialPreferFamily != conf.AddressFamilyIPv4 &&
+		conf.Options.DialPreferFamily != conf.AddressFamilyIPv6 {
+		return fmt.Errorf("dial_prefer_family[%v] should be in {%v, %v}", conf.Options.DialPreferFamily,
+			conf.AddressFamilyIPv4, conf.AddressFamilyIPv6)
+	}
+	if conf.Options.CommandRenameString != "" {
+		var err error
+		if conf.Options.CommandRename, err = utils.ParseCommandRename(conf.Options.CommandRenameString); err != nil {
+			return fmt.Errorf("parse command.rename[%v] failed[%v]", conf.Options.CommandRenameString, err)
+		}
+	}
+	if conf.Options.SSHTunnelAddress != "" {
+		tunnel, err := utils.NewSSHTunnel(conf.Options.SSHTunnelAddress, conf.Options.SSHTunnelKeyFile,
+			conf.Options.SSHTunnelPassphrase, conf.Options.SSHTunnelHosts)
+		if err != nil {
+			return fmt.Errorf("parse ssh_tunnel.address[%v] failed[%v]", conf.Options.SSHTunnelAddress, err)
+		}
+		utils.SSHTunnel = tunnel
+	} else if conf.Options.SSHTunnelKeyFile != "" || conf.Options.SSHTunnelPassphrase != "" ||
+		len(conf.Options.SSHTunnelHosts) != 0 {
+		return fmt.Errorf("ssh_tunnel.address should be given with the other ssh_tunnel options")
+	}
+	if conf.Options.Socks5ProxyAddress != "" {
+		proxy, err := utils.NewSocks5Proxy(conf.Options.Socks5ProxyAddress, conf.Options.Socks5ProxyHosts)
+		if err != nil {
+			return fmt.Errorf("parse socks5_proxy.address[%v] failed[%v]", conf.Options.Socks5ProxyAddress, err)
+		}
+		utils.Socks5Proxy = proxy
+	} else if len(conf.Options.Socks5ProxyHosts) != 0 {
+		return fmt.Errorf("socks5_proxy.address should be given with socks5_proxy.hosts")
+	}
+	if conf.Options.ProxyProtocolVersion != "" {
+		header, err := utils.NewProxyHeader(conf.Options.ProxyProtocolVersion, conf.Options.ProxyProtocolHosts)
+		if err != nil {
+			return fmt.Errorf("parse proxy_protocol.version[%v] failed[%v]", conf.Options.ProxyProtocolVersion, err)
+		}
+		utils.ProxyProtocol = header
+	} else if len(conf.Options.ProxyProtocolHosts) != 0 {
+		return fmt.Errorf("proxy_protocol.version should be given with proxy_protocol.hosts")
 	}
 
 	// parse source and target address and type
 	if err := utils.ParseAddress(tp); err != nil {
 		return fmt.Errorf("mode[%v] parse address failed[%v]", tp, err)
 	}
+	if conf.Options.SourceAddressOptions != nil || conf.Options.TargetAddressOptions != nil {
+		// the options of each address are read by the db syncers
+		if tp != conf.TypeSync {
+			return fmt.Errorf("the options in source.address and target.address are only supported in %v",
+				conf.TypeSync)
+		}
+		if conf.Options.TargetType == conf.RedisTypeCluster && conf.Options.TargetAddressOptions != nil {
+			return fmt.Errorf("the options in target.address aren't supported when target.type = %v",
+				conf.RedisTypeCluster)
+		}
+	}
+	if conf.Options.ShardMapString != "" {
+		if tp != conf.TypeSync {
+			return fmt.Errorf("shard.map is only supported in %v", conf.TypeSync)
+		}
+		if conf.Options.TargetType == conf.RedisTypeCluster {
+			return fmt.Errorf("shard.map isn't supported when target.type = %v", conf.RedisTypeCluster)
+		}
+		var err error
+		if conf.Options.ShardMap, err = utils.ParseShardMap(conf.Options.ShardMapString); err != nil {
+			return fmt.Errorf("parse shard.map[%v] failed[%v]", conf.Options.ShardMapString, err)
+		}
+		sources := make(map[string]bool, len(conf.Options.SourceAddressList))
+		for _, source := range conf.Options.SourceAddressList {
+			sources[source] = true
+			if master, ok := conf.Options.SourceReplicaOf[source]; ok {
+				// the replica synced instead
+				sources[master] = true
+			}
+		}
+		targets := make(map[string]bool, len(conf.Options.TargetAddressList))
+		for _, target := range conf.Options.TargetAddressList {
+			targets[target] = true
+		}
+		for source, target := range conf.Options.ShardMap {
+			if !sources[source] {
+				return fmt.Errorf("source[%v] in shard.map isn't in the source address list%v", source,
+					conf.Options.SourceAddressList)
+			}
+			if !targets[target] {
+				return fmt.Errorf("target[%v] in shard.map isn't in the target address list%v", target,
+					conf.Options.TargetAddressList)
+			}
+		}
+	}
+
+	// fail fast before the sync goes on
+	if tp == conf.TypeSync || check {
+		if err := preflight(tp, fileSource); err != nil {
+			return fmt.Errorf("preflight check failed: %v", err)
+		}
+	}
 
 	if tp == conf.TypeRestore || tp == conf.TypeDecode {
 		if len(conf.Options.SourceRdbInput) == 0 {
@@ -246,8 +562,28 @@ func sanitizeOptions(tp string) error {
 		}
 	}
 
-	if conf.Options.SourceRdbSpecialCloud != "" && conf.Options.SourceRdbSpecialCloud != utils.UCloudCluster {
-		return fmt.Errorf("rdb special cloud type[%s] is not supported", conf.Options.SourceRdbSpecialCloud)
+	if conf.Options.RestoreFileOrder == "" {
+		conf.Options.RestoreFileOrder = conf.RestoreFileOrderParallel
+	} else if conf.Options.RestoreFileOrder != conf.RestoreFileOrderParallel &&
+		conf.Options.RestoreFileOrder != conf.RestoreFileOrderSequential {
+		return fmt.Errorf("restore.file_order[%v] should be in {%v, %v}", conf.Options.RestoreFileOrder,
+			conf.RestoreFileOrderParallel, conf.RestoreFileOrderSequential)
+	}
+
+	if conf.Options.TransformOnError == "" {
+		conf.Options.TransformOnError = conf.TransformOnErrorAbort
+	} else if conf.Options.TransformOnError != conf.TransformOnErrorAbort &&
+		conf.Options.TransformOnError != conf.TransformOnErrorSkip &&
+		conf.Options.TransformOnError != conf.TransformOnErrorKeep {
+		return fmt.Errorf("transform.on_error[%v] should be in {%v, %v, %v}", conf.Options.TransformOnError,
+			conf.TransformOnErrorAbort, conf.TransformOnErrorSkip, conf.TransformOnErrorKeep)
+	}
+	if conf.Options.TransformCommand != "" && tp != conf.TypeRestore && tp != conf.TypeRump {
+		return fmt.Errorf("transform.command is only supported in %v and %v", conf.TypeRestore, conf.TypeRump)
+	}
+
+	if utils.SourceRdbCloud, err = utils.GetCloudAdapter(conf.Options.SourceRdbSpecialCloud); err != nil {
+		return fmt.Errorf("rdb %v", err)
 	}
 
 	if conf.Options.LogFile != "" {
@@ -336,22 +672,79 @@ func sanitizeOptions(tp string) error {
 		return fmt.Errorf("only one of 'filter.key.whitelist' and 'filter.key.blacklist' can be given")
 	}
 
+	if len(conf.Options.FilterTypeWhitelist) != 0 && len(conf.Options.FilterTypeBlacklist) != 0 {
+		return fmt.Errorf("only one of 'filter.type_whitelist' and 'filter.type_blacklist' can be given")
+	}
+	for _, list := range [][]string{conf.Options.FilterTypeWhitelist, conf.Options.FilterTypeBlacklist} {
+		for _, tp := range list {
+			switch tp {
+			case "string", "list", "set", "zset", "hash", "stream":
+			default:
+				return fmt.Errorf("unknown type[%v] in filter.type_whitelist or filter.type_blacklist", tp)
+			}
+		}
+	}
+
+	if len(conf.Options.FilterCommandWhitelist) != 0 && len(conf.Options.FilterCommandBlacklist) != 0 {
+		return fmt.Errorf("only one of 'filter.command.whitelist' and 'filter.command.blacklist' can be given")
+	}
+
+	for _, allow := range conf.Options.FilterDangerousAllow {
+		known := false
+		for _, cmd := range filter.DangerousCommands {
+			known = known || strings.EqualFold(allow, cmd)
+		}
+		if !known {
+			return fmt.Errorf("filter.dangerous_command.allow[%v] should be one of %v", allow,
+				filter.DangerousCommands)
+		}
+	}
+
 	if len(conf.Options.FilterSlot) > 0 {
 		for i, val := range conf.Options.FilterSlot {
-			if _, err := strconv.Atoi(val); err != nil {
+			low, high, err := filter.ParseSlotRange(val)
+			if err != nil {
 				return fmt.Errorf("parse FilterSlot with index[%v] failed[%v]", i, err)
 			}
+			if low < 0 || low > high || high >= utils.ClusterSlots {
+				return fmt.Errorf("FilterSlot[%v] with index[%v] should be in [0, %v]", val, i,
+					utils.ClusterSlots-1)
+			}
 		}
 	}
 
-	if conf.Options.TargetDBString == "" {
-		conf.Options.TargetDB = -1
-	} else if v, err := strconv.Atoi(conf.Options.TargetDBString); err != nil {
-		return fmt.Errorf("parse target.db[%v] failed[%v]", conf.Options.TargetDBString, err)
-	} else if v < 0 {
-		conf.Options.TargetDB = -1
-	} else {
-		conf.Options.TargetDB = v
+	// -1 by default if not given
+	if conf.Options.TargetDBString != "" {
+		if v, err := strconv.Atoi(conf.Options.TargetDBString); err != nil {
+			return fmt.Errorf("parse target.db[%v] failed[%v]", conf.Options.TargetDBString, err)
+		} else if v < 0 {
+			conf.Options.TargetDB = -1
+		} else {
+			conf.Options.TargetDB = v
+		}
+	}
+
+	if conf.Options.TargetDBMapString != "" {
+		if conf.Options.TargetDB != -1 {
+			return fmt.Errorf("only one of 'target.db' and 'target.db_map' can be given")
+		}
+		if conf.Options.TargetDBMap, err = utils.ParseDBMap(conf.Options.TargetDBMapString); err != nil {
+			return fmt.Errorf("parse target.db_map[%v] failed[%v]", conf.Options.TargetDBMapString, err)
+		}
+		if conf.Options.TargetType == conf.RedisTypeCluster {
+			return fmt.Errorf("target.db_map isn't supported when target type is cluster")
+		}
+	}
+	if conf.Options.TargetDBMapPolicy != conf.DBMapPolicyPass &&
+		conf.Options.TargetDBMapPolicy != conf.DBMapPolicyDrop {
+		return fmt.Errorf("target.db_map_policy[%v] should be in {%v, %v}", conf.Options.TargetDBMapPolicy,
+			conf.DBMapPolicyPass, conf.DBMapPolicyDrop)
+	}
+	if conf.Options.TargetDBOutOfRange != conf.DBOutOfRangeError &&
+		conf.Options.TargetDBOutOfRange != conf.DBOutOfRangeSkip &&
+		conf.Options.TargetDBOutOfRange != conf.DBOutOfRangeRemap {
+		return fmt.Errorf("target.db_out_of_range[%v] should be in {%v, %v, %v}", conf.Options.TargetDBOutOfRange,
+			conf.DBOutOfRangeError, conf.DBOutOfRangeSkip, conf.DBOutOfRangeRemap)
 	}
 
 	// if the target is "cluster", only allow pass db 0
@@ -386,31 +779,157 @@ func sanitizeOptions(tp string) error {
 
 	if conf.Options.SenderSize < 0 || conf.Options.SenderSize >= 1073741824 {
 		return fmt.Errorf("SenderSize[%v] should in [0, 1073741824]", conf.Options.SenderSize)
-	} else if conf.Options.SenderSize == 0 {
-		// set to default when not set
-		conf.Options.SenderSize = defaultSenderSize
 	}
 
 	if conf.Options.SenderCount < 0 || conf.Options.SenderCount >= 100000 {
 		return fmt.Errorf("SenderCount[%v] should in [0, 100000]", conf.Options.SenderCount)
-	} else if conf.Options.SenderCount == 0 {
-		// set to default when not set
-		conf.Options.SenderCount = defaultSenderCount
 	}
-	if conf.Options.TargetType == conf.RedisTypeCluster && int(conf.Options.SenderCount) > utils.RecvChanSize {
-		log.Infof("RecvChanSize is modified from [%v] to [%v]", utils.RecvChanSize, int(conf.Options.SenderCount))
-		utils.RecvChanSize = int(conf.Options.SenderCount)
+
+	if conf.Options.SenderTargetParallel > 1 && conf.Options.TargetWaitReplicas > 0 {
+		// WAIT only confirms the writes on its own connection
+		return fmt.Errorf("target.wait_replicas isn't supported when sender.target_parallel > 1")
+	}
+	if conf.Options.SenderTransaction && conf.Options.TargetType == conf.RedisTypeCluster {
+		// the keys of the batch are in different slots
+		return fmt.Errorf("sender.transaction isn't supported when target.type is cluster")
+	}
+	if conf.Options.SenderTransaction && conf.Options.TargetType == conf.RedisTypeProxy {
+		// MULTI is dropped for the proxy target
+		return fmt.Errorf("sender.transaction isn't supported when target.type is proxy")
+	}
+	if conf.Options.SenderSpillFile != "" && conf.Options.TargetReconnectRetries == 0 {
+		// the syncer exits once the target is broken, nothing is spilled
+		return fmt.Errorf("sender.spill_file needs target.reconnect_retries > 0")
+	}
+
+	if conf.Options.TargetErrorRate < 0 || conf.Options.TargetErrorRate >= 100 {
+		return fmt.Errorf("target.error_rate_threshold[%v] should in [0, 100)", conf.Options.TargetErrorRate)
+	}
+	switch conf.Options.MetricDelaySample {
+	case conf.DelaySampleAdaptive:
+		conf.Options.DelaySampleRatio = 0
+	case conf.DelaySampleAll:
+		conf.Options.DelaySampleRatio = 1
+	case conf.DelaySampleOff:
+		conf.Options.DelaySampleRatio = -1
+	default:
+		ratio, err := strconv.Atoi(conf.Options.MetricDelaySample)
+		if err != nil || ratio <= 0 {
+			return fmt.Errorf("metric.delay_sample[%v] should be in {%v, %v, %v} or a positive number",
+				conf.Options.MetricDelaySample, conf.DelaySampleAdaptive, conf.DelaySampleAll, conf.DelaySampleOff)
+		}
+		conf.Options.DelaySampleRatio = ratio
+	}
+
+	switch conf.Options.TargetTTLMode {
+	case conf.TTLModeSource:
+	case conf.TTLModeOverride, conf.TTLModeMin, conf.TTLModeMax:
+		if conf.Options.TargetDefaultTTLSec <= 0 {
+			return fmt.Errorf("target.default_ttl_sec[%v] should > 0 when target.ttl_mode = %v",
+				conf.Options.TargetDefaultTTLSec, conf.Options.TargetTTLMode)
+		}
+	default:
+		return fmt.Errorf("target.ttl_mode[%v] should be in {%v, %v, %v, %v}", conf.Options.TargetTTLMode,
+			conf.TTLModeSource, conf.TTLModeOverride, conf.TTLModeMin, conf.TTLModeMax)
+	}
+
+	if strings.ContainsAny(conf.Options.TargetHashTagInject, "{}") {
+		return fmt.Errorf("target.hash_tag_inject[%v] shouldn't contain '{' or '}'", conf.Options.TargetHashTagInject)
+	}
+	if len(conf.Options.TargetHashTagRules) != 0 {
+		if conf.Options.TargetHashTagInject != "" {
+			return fmt.Errorf("target.hash_tag_inject and target.hash_tag_rules can't be given at the same time")
+		}
+		if err := utils.ParseHashTagRules(conf.Options.TargetHashTagRules); err != nil {
+			return fmt.Errorf("parse target.hash_tag_rules failed: %v", err)
+		}
+	}
+
+	switch conf.Options.TargetMergeCollision {
+	case "":
+	case conf.MergeCollisionOverwrite, conf.MergeCollisionSkip, conf.MergeCollisionRename, conf.MergeCollisionAbort:
+		if tp != conf.TypeSync {
+			return fmt.Errorf("target.merge_collision is only supported in %v", conf.TypeSync)
+		}
+		if conf.Options.TargetMergeCollision == conf.MergeCollisionOverwrite && !conf.Options.Rewrite {
+			return fmt.Errorf("rewrite should be true when target.merge_collision = %v", conf.MergeCollisionOverwrite)
+		}
+	default:
+		return fmt.Errorf("target.merge_collision[%v] should be in {%v, %v, %v, %v}", conf.Options.TargetMergeCollision,
+			conf.MergeCollisionOverwrite, conf.MergeCollisionSkip, conf.MergeCollisionRename, conf.MergeCollisionAbort)
+	}
+
+	if conf.Options.FullSyncResumable && !conf.Options.Rewrite {
+		return fmt.Errorf("rewrite should be true when fullsync.resumable is enabled")
+	}
+
+	if conf.Options.ShutdownDrainTimeoutMs < 0 {
+		return fmt.Errorf("shutdown.drain_timeout_ms[%v] should >= 0", conf.Options.ShutdownDrainTimeoutMs)
+	}
+
+	if tp == conf.TypeSync && conf.Options.CutoverEnable {
+		if conf.Options.SyncMode == conf.SyncModeVerify || conf.Options.SyncFullOnly {
+			return fmt.Errorf("cutover.enable needs the increment sync")
+		}
+		if conf.Options.CutoverLagThreshold < 0 {
+			return fmt.Errorf("cutover.lag_threshold[%v] should >= 0", conf.Options.CutoverLagThreshold)
+		}
+		if conf.Options.CutoverStableSeconds == 0 {
+			conf.Options.CutoverStableSeconds = 10
+		}
+		if conf.Options.ShutdownDrainTimeoutMs == 0 {
+			// the commands sent aren't waited for, the webhook would be notified too early
+			return fmt.Errorf("shutdown.drain_timeout_ms should > 0 when cutover.enable is true")
+		}
+	}
+
+	if conf.Options.SourceReplicaPort < 0 || conf.Options.SourceReplicaPort > 65535 {
+		return fmt.Errorf("source.replica_listening_port[%v] should in [0, 65535]", conf.Options.SourceReplicaPort)
+	}
+
+	if conf.Options.SourceMaxInflightBytes < 0 {
+		return fmt.Errorf("source.max_inflight_bytes[%v] should >= 0", conf.Options.SourceMaxInflightBytes)
+	}
+
+	if conf.Options.TargetResp3 && conf.Options.TargetType == conf.RedisTypeCluster {
+		return fmt.Errorf("target.resp3 isn't supported when target.type = %v", conf.RedisTypeCluster)
+	}
+
+	if conf.Options.TargetFollowRedirects && conf.Options.TargetType == conf.RedisTypeCluster {
+		// the cluster client follows the redirection itself
+		return fmt.Errorf("target.follow_redirects isn't needed when target.type = %v", conf.RedisTypeCluster)
+	}
+
+	if conf.Options.SyncLoopTag != "" && conf.Options.TargetType == conf.RedisTypeCluster {
+		return fmt.Errorf("sync.loop_tag isn't supported when target.type = %v", conf.RedisTypeCluster)
+	}
+
+	if conf.Options.TargetWaitReplicas < 0 {
+		return fmt.Errorf("target.wait_replicas[%v] should >= 0", conf.Options.TargetWaitReplicas)
+	} else if conf.Options.TargetWaitReplicas > 0 {
+		if conf.Options.TargetType == conf.RedisTypeCluster || conf.Options.TargetType == conf.RedisTypeProxy {
+			return fmt.Errorf("target.wait_replicas isn't supported when target.type = %v", conf.Options.TargetType)
+		}
+		if conf.Options.TargetWaitTimeoutMs < 0 {
+			return fmt.Errorf("target.wait_timeout_ms[%v] should >= 0", conf.Options.TargetWaitTimeoutMs)
+		}
+		if conf.Options.TargetWaitIntervalMs < 0 {
+			return fmt.Errorf("target.wait_interval_ms[%v] should >= 0", conf.Options.TargetWaitIntervalMs)
+		}
+		if conf.Options.TargetWaitPolicy != conf.WaitPolicyWarn &&
+			conf.Options.TargetWaitPolicy != conf.WaitPolicyPause {
+			return fmt.Errorf("target.wait_policy[%v] should be in {%v, %v}", conf.Options.TargetWaitPolicy,
+				conf.WaitPolicyWarn, conf.WaitPolicyPause)
+		}
 	}
 
-	if conf.Options.SenderDelayChannelSize == 0 {
-		conf.Options.SenderDelayChannelSize = 32
+	if err := utils.CheckCompressType(conf.Options.SockCompress); err != nil {
+		return fmt.Errorf("sock.compress invalid: %v", err)
 	}
 
 	// [0, 100 million]
 	if conf.Options.Qps < 0 || conf.Options.Qps >= 100000000 {
 		return fmt.Errorf("qps[%v] should in (0, 100000000]", conf.Options.Qps)
-	} else if conf.Options.Qps == 0 {
-		conf.Options.Qps = 500000
 	}
 
 	if tp == conf.TypeRestore || tp == conf.TypeSync || tp == conf.TypeRump {
@@ -420,7 +939,7 @@ func sanitizeOptions(tp string) error {
 			for _, address := range conf.Options.TargetAddressList {
 				// single connection even if the target is cluster
 				if v, err := utils.GetRedisVersion(address, conf.Options.TargetAuthType,
-					conf.Options.TargetPasswordRaw, conf.Options.TargetTLSEnable); err != nil {
+					conf.Options.TargetPasswordRaw, utils.TargetTLS(conf.Options.TargetTLSEnable)); err != nil {
 					return fmt.Errorf("get target redis version failed[%v]", err)
 				} else if conf.Options.TargetVersion != "" && conf.Options.TargetVersion != v {
 					return fmt.Errorf("target redis version is different: [%v %v]", conf.Options.TargetVersion, v)
@@ -438,6 +957,12 @@ func sanitizeOptions(tp string) error {
 				conf.Options.TargetVersion, conf.Options.SourceVersion)
 		}
 
+		if conf.Options.TargetVersionMismatch != conf.VersionMismatchAbort &&
+			conf.Options.TargetVersionMismatch != conf.VersionMismatchRewrite {
+			return fmt.Errorf("target.version_mismatch[%v] should be in {%v, %v}", conf.Options.TargetVersionMismatch,
+				conf.VersionMismatchAbort, conf.VersionMismatchRewrite)
+		}
+
 		if strings.HasPrefix(conf.Options.TargetVersion, "4.") ||
 			strings.HasPrefix(conf.Options.TargetVersion, "3.") ||
 			strings.HasPrefix(conf.Options.TargetVersion, "5.") {
@@ -448,12 +973,13 @@ func sanitizeOptions(tp string) error {
 	}
 
 	// check version and set big_key_threshold. see #173
-	if tp == conf.TypeSync || tp == conf.TypeRump { // "tp == restore" hasn't been handled
+	if (tp == conf.TypeSync || tp == conf.TypeRump) && !fileSource { // "tp == restore" hasn't been handled
 		// fetch source version
 		for _, address := range conf.Options.SourceAddressList {
 			// single connection even if the target is cluster
 			if v, err := utils.GetRedisVersion(address, conf.Options.SourceAuthType,
-				conf.Options.SourcePasswordRaw, conf.Options.SourceTLSEnable); err != nil {
+				utils.SourceAuthToken(conf.Options.SourcePasswordRaw),
+				utils.SourceTLS(conf.Options.SourceTLSEnable)); err != nil {
 				return fmt.Errorf("get source redis version failed[%v]", err)
 			} else if conf.Options.SourceVersion != "" && conf.Options.SourceVersion != v {
 				return fmt.Errorf("source redis version is different: [%v %v]", conf.Options.SourceVersion, v)
@@ -478,14 +1004,92 @@ func sanitizeOptions(tp string) error {
 		}
 	}
 
+	// fail fast before any data flows
+	if tp == conf.TypeSync || tp == conf.TypeRestore {
+		if err := compatibility(tp, fileSource); err != nil {
+			return fmt.Errorf("compatibility check failed: %v", err)
+		}
+	}
+
+	if tp == conf.TypeSync {
+		if conf.Options.SyncMode != conf.SyncModeSync && conf.Options.SyncMode != conf.SyncModeVerify {
+			return fmt.Errorf("sync.mode[%v] should be in {%v, %v}", conf.Options.SyncMode,
+				conf.SyncModeSync, conf.SyncModeVerify)
+		} else if conf.Options.SyncMode == conf.SyncModeVerify && conf.Options.SyncSkipFull {
+			return fmt.Errorf("sync.skip_full isn't supported when sync.mode = %v", conf.SyncModeVerify)
+		} else if conf.Options.SyncMode == conf.SyncModeVerify && conf.Options.SyncIncrOnly {
+			return fmt.Errorf("sync.incr_only isn't supported when sync.mode = %v", conf.SyncModeVerify)
+		} else if conf.Options.SyncMode == conf.SyncModeVerify && conf.Options.SyncCheckpointFile != "" {
+			return fmt.Errorf("sync.checkpoint_file isn't supported when sync.mode = %v", conf.SyncModeVerify)
+		} else if conf.Options.SyncMode == conf.SyncModeVerify && conf.Options.SyncCheckpointKey != "" {
+			return fmt.Errorf("sync.checkpoint_key isn't supported when sync.mode = %v", conf.SyncModeVerify)
+		}
+	}
+
+	if tp == conf.TypeSync && conf.Options.SyncSkipFull {
+		if !conf.Options.Psync {
+			return fmt.Errorf("sync.skip_full needs psync, but psync is disabled or not supported by the source")
+		}
+		if len(conf.Options.SourceAddressList) != 1 {
+			return fmt.Errorf("sync.skip_full only supports one source address, but given %v",
+				len(conf.Options.SourceAddressList))
+		}
+		if conf.Options.SyncSkipFullRunId == "" {
+			return fmt.Errorf("sync.skip_full.run_id should be given when sync.skip_full is enabled")
+		}
+		if conf.Options.SyncSkipFullOffset < 0 {
+			return fmt.Errorf("sync.skip_full.offset[%v] should >= 0", conf.Options.SyncSkipFullOffset)
+		}
+		if conf.Options.SyncSkipFullFallback != conf.SkipFullFallbackAbort &&
+			conf.Options.SyncSkipFullFallback != conf.SkipFullFallbackFullsync {
+			return fmt.Errorf("sync.skip_full.fallback[%v] should be in {%v, %v}", conf.Options.SyncSkipFullFallback,
+				conf.SkipFullFallbackAbort, conf.SkipFullFallbackFullsync)
+		}
+	}
+
+	if tp == conf.TypeSync {
+		if conf.Options.SourceSlotMigration != conf.SlotMigrationReconcile &&
+			conf.Options.SourceSlotMigration != conf.SlotMigrationAbort &&
+			conf.Options.SourceSlotMigration != conf.SlotMigrationIgnore {
+			return fmt.Errorf("source.slot_migration[%v] should be in {%v, %v, %v}", conf.Options.SourceSlotMigration,
+				conf.SlotMigrationReconcile, conf.SlotMigrationAbort, conf.SlotMigrationIgnore)
+		}
+	}
+
+	if tp == conf.TypeSync && conf.Options.SyncIncrOnly && !conf.Options.Psync {
+		return fmt.Errorf("sync.incr_only needs psync, but psync is disabled or not supported by the source")
+	}
+
+	if tp == conf.TypeSync && conf.Options.SyncFullOnly {
+		// the options skip the rdb or only work in the increment
+		if conf.Options.SyncIncrOnly {
+			return fmt.Errorf("sync.full_only and sync.incr_only can't be both enabled")
+		} else if conf.Options.SyncSkipFull {
+			return fmt.Errorf("sync.full_only and sync.skip_full can't be both enabled")
+		} else if conf.Options.SyncCheckpointFile != "" || conf.Options.SyncCheckpointKey != "" {
+			return fmt.Errorf("sync.checkpoint_file and sync.checkpoint_key aren't supported when sync.full_only is enabled")
+		}
+	}
+
+	if tp == conf.TypeSync && conf.Options.SyncCheckpointFile != "" {
+		if !conf.Options.Psync {
+			return fmt.Errorf("sync.checkpoint_file needs psync, but psync is disabled or not supported by the source")
+		}
+	}
+
+	if tp == conf.TypeSync && conf.Options.SyncCheckpointKey != "" {
+		if !conf.Options.Psync {
+			return fmt.Errorf("sync.checkpoint_key needs psync, but psync is disabled or not supported by the source")
+		}
+	}
+
 	if tp == conf.TypeRump {
 		if conf.Options.ScanKeyNumber == 0 {
 			conf.Options.ScanKeyNumber = 100
 		}
 
-		if conf.Options.ScanSpecialCloud != "" && conf.Options.ScanSpecialCloud != utils.TencentCluster &&
-			conf.Options.ScanSpecialCloud != utils.AliyunCluster {
-			return fmt.Errorf("special cloud type[%s] is not supported", conf.Options.ScanSpecialCloud)
+		if utils.ScanCloud, err = utils.GetCloudAdapter(conf.Options.ScanSpecialCloud); err != nil {
+			return err
 		}
 
 		if conf.Options.ScanSpecialCloud != "" && conf.Options.ScanKeyFile != "" {
@@ -493,21 +1097,16 @@ func sanitizeOptions(tp string) error {
 				conf.Options.ScanSpecialCloud, conf.Options.ScanKeyFile)
 		}
 
-		if int(conf.Options.ScanKeyNumber) > utils.RecvChanSize && conf.Options.TargetType == conf.RedisTypeCluster {
-			log.Infof("RecvChanSize is modified from [%v] to [%v]", utils.RecvChanSize, int(conf.Options.ScanKeyNumber))
-			utils.RecvChanSize = int(conf.Options.ScanKeyNumber)
-		}
-
 		//if len(conf.Options.SourceAddressList) == 1 {
 		//	return fmt.Errorf("source address length should == 1 when type is 'rump'")
 		//}
 	}
 
 	// check rdbchecksum
-	if tp == conf.TypeDump || (tp == conf.TypeSync || tp == conf.TypeRump) && conf.Options.BigKeyThreshold > 1 {
+	if tp == conf.TypeDump || (tp == conf.TypeSync || tp == conf.TypeRump) && conf.Options.BigKeyThreshold > 1 && !fileSource {
 		for _, address := range conf.Options.SourceAddressList {
 			check, err := utils.GetRDBChecksum(address, conf.Options.SourceAuthType,
-				conf.Options.SourcePasswordRaw, conf.Options.SourceTLSEnable)
+				utils.SourceAuthToken(conf.Options.SourcePasswordRaw), utils.SourceTLS(conf.Options.SourceTLSEnable))
 			if err != nil {
 				// ignore
 				log.Warnf("fetch source rdb[%v] checksum failed[%v], ignore", address, err)
@@ -528,6 +1127,217 @@ func sanitizeOptions(tp string) error {
 	return nil
 }
 
+/*
+ * load each job file of sync.jobs on top of the options of the main file and check it the same
+ * way as one sync, the options of the first job are kept in conf.Options and the syncers of all
+ * the jobs are counted in the source address list.
+ */
+func sanitizeJobs(check bool) error {
+	shared := conf.Options
+	if shared.SyncSkipFull || shared.SourceAofFile != "" {
+		return fmt.Errorf("sync.skip_full and source.aof_file aren't supported when sync.jobs is given")
+	}
+
+	jobs := make([]*conf.Configuration, 0, len(shared.SyncJobs))
+	names := make(map[string]struct{}, len(shared.SyncJobs))
+	var sources []string
+	for _, file := range shared.SyncJobs {
+		conf.Options = shared
+		if err := loadJob(file); err != nil {
+			return err
+		}
+		if conf.Options.JobName == "" {
+			conf.Options.JobName = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		name := conf.Options.JobName
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("job.name[%v] of job file[%v] is duplicated", name, file)
+		}
+		names[name] = struct{}{}
+
+		if err := sanitizeOptions(conf.TypeSync, check); err != nil {
+			return fmt.Errorf("job[%v] %v", name, err)
+		}
+		job := conf.Options
+		jobs = append(jobs, &job)
+		sources = append(sources, job.SourceAddressList...)
+	}
+
+	conf.Options = *jobs[0]
+	conf.Options.Jobs = jobs
+	conf.Options.SourceAddressList = sources
+	if shared.SourceRdbParallel <= 0 || shared.SourceRdbParallel > len(sources) {
+		conf.Options.SourceRdbParallel = len(sources)
+	} else {
+		conf.Options.SourceRdbParallel = shared.SourceRdbParallel
+	}
+	return nil
+}
+
+// load the job file into conf.Options, only the job options can be given in it
+func loadJob(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read job file[%v] failed[%v]", file, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if key := strings.TrimSpace(strings.SplitN(line, "=", 2)[0]); !conf.IsJobOption(key) {
+			return fmt.Errorf("option[%v] can't be given in job file[%v], it's shared by all the jobs", key, file)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("open job file[%v] failed[%v]", file, err)
+	}
+	defer f.Close()
+	loader := nimo.NewConfigLoader(f)
+	loader.SetDateFormat(utils.GolangSecurityTime)
+	if err := loader.Load(&conf.Options); err != nil {
+		return fmt.Errorf("job file[%v] parse failed[%v]", file, err)
+	}
+	return nil
+}
+
+// check each source and target can be connected, authenticated and written if needed.
+func preflight(tp string, fileSource bool) error {
+	for _, address := range conf.Options.SourceAddressList {
+		if fileSource {
+			break
+		}
+		if err := utils.PreflightCheck("source", address, conf.Options.SourceAuthType,
+			utils.SourceAuthToken(utils.AddressPassword(conf.Options.SourceAddressOptions, address,
+				conf.Options.SourcePasswordRaw)),
+			utils.SourceTLS(utils.AddressTLS(conf.Options.SourceAddressOptions, address, conf.Options.SourceTLSEnable)),
+			false, false); err != nil {
+			return err
+		}
+	}
+
+	write := (tp == conf.TypeRestore || tp == conf.TypeSync || tp == conf.TypeRump) &&
+		conf.Options.SyncMode != conf.SyncModeVerify
+	for _, address := range conf.Options.TargetAddressList {
+		if err := utils.PreflightCheck("target", address, conf.Options.TargetAuthType,
+			utils.FetchAuthToken(utils.TargetAuthProvider, utils.AddressPassword(conf.Options.TargetAddressOptions,
+				address, conf.Options.TargetPasswordRaw)),
+			utils.TargetTLS(utils.AddressTLS(conf.Options.TargetAddressOptions, address, conf.Options.TargetTLSEnable)),
+			write, conf.Options.TargetType == conf.RedisTypeCluster); err != nil {
+			return err
+		}
+	}
+	if write && conf.Options.TargetType == conf.RedisTypeCluster && len(conf.Options.TargetAddressList) > 0 {
+		// all the nodes have the same view of the slots once the cluster is stable
+		address := conf.Options.TargetAddressList[0]
+		if err := utils.CheckSlotCoverage("target", address, conf.Options.TargetAuthType,
+			utils.FetchAuthToken(utils.TargetAuthProvider, utils.AddressPassword(conf.Options.TargetAddressOptions,
+				address, conf.Options.TargetPasswordRaw)),
+			utils.TargetTLS(utils.AddressTLS(conf.Options.TargetAddressOptions, address,
+				conf.Options.TargetTLSEnable))); err != nil {
+			return err
+		}
+	}
+	log.Infof("preflight check of source%v and target%v passed", conf.Options.SourceAddressList,
+		conf.Options.TargetAddressList)
+	return nil
+}
+
+/*
+ * check the data of the source can be decoded and loaded by the target before any data flows,
+ * instead of failing in the middle of the full sync: the rdb version written by the source or in
+ * the rdb files against the decoder and target.version_mismatch, and the modules loaded by the
+ * source whose keys can't be decoded.
+ */
+func compatibility(tp string, fileSource bool) error {
+	var files []string
+	switch {
+	case tp == conf.TypeRestore:
+		files = conf.Options.SourceRdbInput
+	case fileSource && conf.Options.SourceRdbFile != "":
+		files = []string{conf.Options.SourceRdbFile}
+	}
+	for _, file := range files {
+		version, err := utils.RdbFileVersion(file)
+		if err != nil {
+			return err
+		}
+		if _, err := utils.CheckRdbVersion(version, conf.Options.TargetVersion,
+			conf.Options.TargetVersionMismatch); err != nil {
+			return fmt.Errorf("rdb file[%v]: %v", file, err)
+		}
+	}
+	if tp != conf.TypeSync || fileSource {
+		return nil
+	}
+
+	if rewrite, err := utils.CheckRdbCompatible(conf.Options.SourceVersion, conf.Options.TargetVersion,
+		conf.Options.TargetVersionMismatch); err != nil {
+		return err
+	} else if rewrite {
+		log.Warnf("target version[%v] can't load the rdb of source version[%v], the keys are written by "+
+			"commands", conf.Options.TargetVersion, conf.Options.SourceVersion)
+	}
+	for _, address := range conf.Options.SourceAddressList {
+		modules, err := utils.SourceModules(address, conf.Options.SourceAuthType,
+			utils.SourceAuthToken(utils.AddressPassword(conf.Options.SourceAddressOptions, address,
+				conf.Options.SourcePasswordRaw)),
+			utils.SourceTLS(utils.AddressTLS(conf.Options.SourceAddressOptions, address, conf.Options.SourceTLSEnable)))
+		if err != nil {
+			// e.g., info modules is disabled by the proxy
+			log.Warnf("fetch the modules of source[%v] failed, skip checking them: %v", address, err)
+		} else if len(modules) != 0 {
+			log.Warnf("source[%v] loads modules%v, the full sync fails once a key of the module types comes",
+				address, modules)
+		}
+	}
+	return nil
+}
+
+// check source.rdb_file and source.aof_file, the options needing the source redis are rejected.
+func checkFileSource() error {
+	for _, file := range []string{conf.Options.SourceRdbFile, conf.Options.SourceAofFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("source file[%v] can't be read: %v", file, err)
+		}
+	}
+	if conf.Options.SyncSkipFull || conf.Options.SyncIncrOnly {
+		return fmt.Errorf("sync.skip_full and sync.incr_only aren't supported when source.aof_file is given")
+	} else if conf.Options.SyncCheckpointFile != "" || conf.Options.SyncCheckpointKey != "" {
+		return fmt.Errorf("sync.checkpoint_file and sync.checkpoint_key aren't supported when source.aof_file is given")
+	} else if conf.Options.CutoverEnable {
+		return fmt.Errorf("cutover.enable isn't supported when source.aof_file is given")
+	} else if conf.Options.SourceType != "" && conf.Options.SourceType != conf.RedisTypeStandalone {
+		return fmt.Errorf("source.type[%v] isn't supported when source.aof_file is given", conf.Options.SourceType)
+	}
+	// the increment is read from the aof instead of the replication
+	conf.Options.Psync = false
+	conf.Options.SourceFakeSlaveOffset = false
+	return nil
+}
+
+// encode the password read from the stdin for password_encoding, the line break at the end is trimmed
+func encodePasswordFromStdin(encoding string) (string, error) {
+	key, err := utils.LoadPasswordKey(conf.Options.PasswordKey, conf.Options.PasswordKeyFile)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("empty password")
+	}
+	return utils.EncodePassword(encoding, password, key)
+}
+
 func crash(msg string, errCode int) {
 	fmt.Println(msg)
 	panic(Exit{errCode})
@@ -538,6 +1348,10 @@ func handleExit() {
 		if exit, ok := e.(Exit); ok == true {
 			os.Exit(exit.Code)
 		}
+		// the fatal error out of the syncers when sync.restart_retries is set
+		if _, ok := e.(*log.Fatal); ok {
+			os.Exit(1)
+		}
 		panic(e)
 	}
 }
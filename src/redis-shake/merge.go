@@ -0,0 +1,128 @@
+package run
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pkg/libs/log"
+	"pkg/rdb"
+	"redis-shake/common"
+	"redis-shake/configure"
+	"redis-shake/filter"
+)
+
+/*
+ * keyOwners records the syncer restoring each key in the full sync when the shards of the source
+ * are merged into one target, so that the key restored by two shards is found, see
+ * target.merge_collision. The key is kept as the 64-bit hash of the db and the key to save the
+ * memory, the chance that two keys share the hash can be ignored.
+ */
+type keyOwners struct {
+	mu     sync.Mutex
+	owners map[uint64]int
+}
+
+func newKeyOwners() *keyOwners {
+	return &keyOwners{owners: make(map[uint64]int)}
+}
+
+// the syncer restoring the key first, it's id if nobody restores it before
+func (o *keyOwners) claim(db int, key []byte, id int) int {
+	h := fnv.New64a()
+	h.Write([]byte(strconv.Itoa(db)))
+	h.Write([]byte{0})
+	h.Write(key)
+	sum := h.Sum64()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if owner, ok := o.owners[sum]; ok {
+		return owner
+	}
+	o.owners[sum] = id
+	return id
+}
+
+/*
+ * handle the rdb entry restored by another shard by target.merge_collision, false if it's skipped.
+ * All the parts of the big key are handled the same way since the owner is the same.
+ */
+func (ds *dbSyncer) resolveCollision(db int, e *rdb.BinEntry) bool {
+	if ds.owners == nil || e.Type == rdb.RdbFlagAUX {
+		return true
+	}
+	owner := ds.owners.claim(db, e.Key, ds.id)
+	if owner == ds.id {
+		return true
+	}
+	if e.NeedReadLen == 1 {
+		ds.collisions.Incr()
+	}
+
+	switch ds.opts().TargetMergeCollision {
+	case conf.MergeCollisionSkip:
+		log.Debugf("dbSyncer[%v] skip key[%s] in db[%v] restored by dbSyncer[%v]", ds.id, e.Key, db, owner)
+		ds.ignore.Incr()
+		ds.auditDrop(utils.DropReasonCollide, int(e.DB), "", e.Key)
+		return false
+	case conf.MergeCollisionRename:
+		renamed := append(append([]byte{}, e.Key...), collisionSuffix(ds.id)...)
+		log.Debugf("dbSyncer[%v] rename key[%s] in db[%v] restored by dbSyncer[%v] as [%s]", ds.id, e.Key, db,
+			owner, renamed)
+		e.Key = renamed
+	case conf.MergeCollisionAbort:
+		log.Panicf("dbSyncer[%v] key[%s] in db[%v] is restored by dbSyncer[%v] as well, %d keys collide in "+
+			"dbSyncer[%v] so far, abort by target.merge_collision", ds.id, e.Key, db, owner, ds.collisions.Get(), ds.id)
+	default:
+		log.Debugf("dbSyncer[%v] overwrite key[%s] in db[%v] restored by dbSyncer[%v]", ds.id, e.Key, db, owner)
+	}
+	return true
+}
+
+/*
+ * handle the keys of the command in the increment by target.merge_collision the same as the rdb
+ * entries, false if it's skipped. The key is owned by the syncer writing it first in the full sync
+ * or in the increment, so the writes of the other shards don't overwrite the value kept by skip,
+ * and go to the key renamed by rename. The command is skipped as a whole if any of the keys is
+ * owned by another shard with skip. The command whose keys are unknown is sent as it is.
+ */
+func (ds *dbSyncer) resolveCommandCollision(db int, scmd string, argv [][]byte) ([][]byte, bool) {
+	if ds.owners == nil {
+		return argv, true
+	}
+	indexes, ok := filter.CommandKeyIndexes(strings.ToLower(scmd), argv)
+	if !ok {
+		return argv, true
+	}
+
+	ret, copied := argv, false
+	for _, i := range indexes {
+		owner := ds.owners.claim(db, argv[i], ds.id)
+		if owner == ds.id {
+			continue
+		}
+		switch ds.opts().TargetMergeCollision {
+		case conf.MergeCollisionSkip:
+			log.Debugf("dbSyncer[%v] skip command[%v] of key[%s] in db[%v] written by dbSyncer[%v]", ds.id, scmd,
+				argv[i], db, owner)
+			return argv, false
+		case conf.MergeCollisionRename:
+			if !copied {
+				// the args are audited as they are
+				ret, copied = append([][]byte{}, argv...), true
+			}
+			ret[i] = append(append([]byte{}, argv[i]...), collisionSuffix(ds.id)...)
+		case conf.MergeCollisionAbort:
+			log.Panicf("dbSyncer[%v] key[%s] of command[%v] in db[%v] is written by dbSyncer[%v] as well, abort by "+
+				"target.merge_collision", ds.id, argv[i], scmd, db, owner)
+		}
+	}
+	return ret, true
+}
+
+// the suffix of the key renamed by target.merge_collision = rename
+func collisionSuffix(id int) string {
+	return ".shard" + strconv.Itoa(id)
+}
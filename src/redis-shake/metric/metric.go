@@ -56,8 +56,8 @@ func (p *Percent) Get(returnString bool) interface{} {
 }
 
 func (p *Percent) Update() {
-	p.Dividend = 0
-	p.Divisor = 0
+	atomic.StoreUint64(&p.Dividend, 0)
+	atomic.StoreUint64(&p.Divisor, 0)
 }
 
 type Delta struct {
@@ -65,7 +65,7 @@ type Delta struct {
 }
 
 func (d *Delta) Update() {
-	d.Value = 0
+	atomic.StoreUint64(&d.Value, 0)
 }
 
 type Combine struct {
@@ -91,6 +91,11 @@ type Metric struct {
 	NetworkFlow Combine // +speed
 
 	FullSyncProgress uint64
+	TooLargeCount    uint64 // keys skipped by filter.max_value_bytes
+	ReconnectCount   uint64 // reconnects of the source in the increment sync
+
+	job      string // job.name of the job in sync.jobs
+	printLog bool   // metric.print_log when the metric is added
 }
 
 func CreateMetric(r base.Runner) {
@@ -102,11 +107,17 @@ func AddMetric(id int) {
 		return
 	}
 
-	singleMetric := new(Metric)
+	// read once, the metric is printed by its own routine
+	singleMetric := &Metric{printLog: conf.Options.MetricPrintLog}
 	MetricMap.Store(id, singleMetric)
 	go singleMetric.run()
 }
 
+// SetJob labels the metrics with the job name, it's called before the metrics are added.
+func (m *Metric) SetJob(job string) {
+	m.job = job
+}
+
 func GetMetric(id int) *Metric {
 	metric, _ := MetricMap.Load(id)
 	return metric.(*Metric)
@@ -133,7 +144,7 @@ func (m *Metric) run() {
 		tick := 0
 		for range time.NewTicker(1 * time.Second).C {
 			tick++
-			if tick%updateInterval == 0 && conf.Options.MetricPrintLog {
+			if tick%updateInterval == 0 && m.printLog {
 				stat := NewMetricRest()
 				if opts, err := json.Marshal(stat); err != nil {
 					log.Infof("marshal metric stat error[%v]", err)
@@ -149,7 +160,7 @@ func (m *Metric) run() {
 
 func (m *Metric) AddPullCmdCount(dbSyncerID int, val uint64) {
 	m.PullCmdCount.Set(val)
-	pullCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID)).Add(float64(val))
+	pullCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
 }
 
 func (m *Metric) GetPullCmdCount() interface{} {
@@ -162,7 +173,7 @@ func (m *Metric) GetPullCmdCountTotal() interface{} {
 
 func (m *Metric) AddBypassCmdCount(dbSyncerID int, val uint64) {
 	m.BypassCmdCount.Set(val)
-	bypassCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID)).Add(float64(val))
+	bypassCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
 }
 
 func (m *Metric) GetBypassCmdCount() interface{} {
@@ -175,7 +186,7 @@ func (m *Metric) GetBypassCmdCountTotal() interface{} {
 
 func (m *Metric) AddPushCmdCount(dbSyncerID int, val uint64) {
 	m.PushCmdCount.Set(val)
-	pushCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID)).Add(float64(val))
+	pushCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
 }
 
 func (m *Metric) GetPushCmdCount() interface{} {
@@ -188,7 +199,7 @@ func (m *Metric) GetPushCmdCountTotal() interface{} {
 
 func (m *Metric) AddSuccessCmdCount(dbSyncerID int, val uint64) {
 	m.SuccessCmdCount.Set(val)
-	successCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID)).Add(float64(val))
+	successCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
 }
 
 func (m *Metric) GetSuccessCmdCount() interface{} {
@@ -201,7 +212,7 @@ func (m *Metric) GetSuccessCmdCountTotal() interface{} {
 
 func (m *Metric) AddFailCmdCount(dbSyncerID int, val uint64) {
 	m.FailCmdCount.Set(val)
-	failCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID)).Add(float64(val))
+	failCmdCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
 }
 
 func (m *Metric) GetFailCmdCount() interface{} {
@@ -235,7 +246,7 @@ func (m *Metric) GetAvgDelayFloat64() float64 {
 func (m *Metric) AddNetworkFlow(dbSyncerID int, val uint64) {
 	// atomic.AddUint64(&m.NetworkFlow.Value, val)
 	m.NetworkFlow.Set(val)
-	networkFlowTotalInBytes.WithLabelValues(strconv.Itoa(dbSyncerID)).Add(float64(val))
+	networkFlowTotalInBytes.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
 }
 
 func (m *Metric) GetNetworkFlow() interface{} {
@@ -248,9 +259,27 @@ func (m *Metric) GetNetworkFlowTotal() interface{} {
 
 func (m *Metric) SetFullSyncProgress(dbSyncerID int, val uint64) {
 	m.FullSyncProgress = val
-	fullSyncProcessPercent.WithLabelValues(strconv.Itoa(dbSyncerID)).Set(float64(val))
+	fullSyncProcessPercent.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Set(float64(val))
 }
 
 func (m *Metric) GetFullSyncProgress() interface{} {
 	return m.FullSyncProgress
 }
+
+func (m *Metric) AddTooLargeCount(dbSyncerID int, val uint64) {
+	atomic.AddUint64(&m.TooLargeCount, val)
+	tooLargeCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
+}
+
+func (m *Metric) GetTooLargeCount() interface{} {
+	return atomic.LoadUint64(&m.TooLargeCount)
+}
+
+func (m *Metric) AddReconnectCount(dbSyncerID int, val uint64) {
+	atomic.AddUint64(&m.ReconnectCount, val)
+	reconnectCountTotal.WithLabelValues(strconv.Itoa(dbSyncerID), m.job).Add(float64(val))
+}
+
+func (m *Metric) GetReconnectCount() interface{} {
+	return atomic.LoadUint64(&m.ReconnectCount)
+}
@@ -12,6 +12,7 @@ import (
 const (
 	metricNamespace   = "redisshake"
 	dbSyncerLabelName = "db_syncer"
+	jobLabelName      = "job" // job.name of the job in sync.jobs, empty if sync.jobs isn't given
 )
 
 var (
@@ -21,7 +22,7 @@ var (
 			Name:      "pull_cmd_count_total",
 			Help:      "RedisShake pull redis cmd count in total",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	bypassCmdCountTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -29,7 +30,7 @@ var (
 			Name:      "bypass_cmd_count_total",
 			Help:      "RedisShake bypass redis cmd count in total",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	pushCmdCountTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -37,7 +38,7 @@ var (
 			Name:      "push_cmd_count_total",
 			Help:      "RedisShake push redis cmd count in total",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	successCmdCountTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -45,7 +46,7 @@ var (
 			Name:      "success_cmd_count_total",
 			Help:      "RedisShake push redis cmd count in total",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	failCmdCountTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -53,7 +54,7 @@ var (
 			Name:      "fail_cmd_count_total",
 			Help:      "RedisShake push redis cmd count in total",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	networkFlowTotalInBytes = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -61,7 +62,23 @@ var (
 			Name:      "network_flow_total_in_bytes",
 			Help:      "RedisShake total network flow in total (byte)",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
+	)
+	tooLargeCountTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "too_large_count_total",
+			Help:      "RedisShake keys skipped by filter.max_value_bytes in total",
+		},
+		[]string{dbSyncerLabelName, jobLabelName},
+	)
+	reconnectCountTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricNamespace,
+			Name:      "reconnect_count_total",
+			Help:      "RedisShake reconnects of the source in the increment sync in total",
+		},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	fullSyncProcessPercent = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -69,7 +86,7 @@ var (
 			Name:      "full_sync_process_percent",
 			Help:      "RedisShake full sync process (%)",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 	averageDelayInMs = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -77,7 +94,7 @@ var (
 			Name:      "average_delay_in_ms",
 			Help:      "RedisShake average delay (ms)",
 		},
-		[]string{dbSyncerLabelName},
+		[]string{dbSyncerLabelName, jobLabelName},
 	)
 )
 
@@ -90,6 +107,6 @@ func CalcPrometheusMetrics() {
 			continue
 		}
 		singleMetric := val.(*Metric)
-		averageDelayInMs.WithLabelValues(strconv.Itoa(i)).Set(singleMetric.GetAvgDelayFloat64())
+		averageDelayInMs.WithLabelValues(strconv.Itoa(i), singleMetric.job).Set(singleMetric.GetAvgDelayFloat64())
 	}
 }
@@ -8,6 +8,7 @@ import (
 
 type MetricRest struct {
 	StartTime            interface{}
+	Job                  interface{} // job.name of the job in sync.jobs
 	PullCmdCount         interface{}
 	PullCmdCountTotal    interface{}
 	BypassCmdCount       interface{}
@@ -23,13 +24,17 @@ type MetricRest struct {
 	NetworkSpeed         interface{} // network speed
 	NetworkFlowTotal     interface{} // total network speed
 	FullSyncProgress     interface{}
+	TooLargeCount        interface{} // keys skipped by filter.max_value_bytes
+	ReconnectCount       interface{} // reconnects of the source in the increment sync
 	Status               interface{}
 	SenderBufCount       interface{} // length of sender buffer
+	SenderBufBytes       interface{} // bytes of sender buffer, see sender.max_bytes
 	ProcessingCmdCount   interface{} // length of delay channel
 	TargetDBOffset       interface{} // target redis offset
 	SourceDBOffset       interface{} // source redis offset
 	SourceAddress        interface{}
 	TargetAddress        interface{}
+	SlotRangeRestored    interface{} // keys restored in each slot range when the target is cluster
 	Details              interface{} // other details info
 }
 
@@ -42,7 +47,7 @@ func NewMetricRest() []MetricRest {
 		return []MetricRest{
 			{
 				StartTime: utils.StartTime,
-				Status:    base.Status,
+				Status:    base.GetStatus(),
 			},
 		}
 	}
@@ -58,6 +63,7 @@ func NewMetricRest() []MetricRest {
 		detailMap := detailMapList[i]
 		ret[i] = MetricRest{
 			StartTime:            utils.StartTime,
+			Job:                  singleMetric.job,
 			PullCmdCount:         singleMetric.GetPullCmdCount(),
 			PullCmdCountTotal:    singleMetric.GetPullCmdCountTotal(),
 			BypassCmdCount:       singleMetric.GetBypassCmdCount(),
@@ -73,13 +79,17 @@ func NewMetricRest() []MetricRest {
 			NetworkSpeed:         singleMetric.GetNetworkFlow(),
 			NetworkFlowTotal:     singleMetric.GetNetworkFlowTotal(),
 			FullSyncProgress:     singleMetric.GetFullSyncProgress(),
-			Status:               base.Status,
+			TooLargeCount:        singleMetric.GetTooLargeCount(),
+			ReconnectCount:       singleMetric.GetReconnectCount(),
+			Status:               base.GetStatus(),
 			SenderBufCount:       detailMap["SenderBufCount"],
+			SenderBufBytes:       detailMap["SenderBufBytes"],
 			ProcessingCmdCount:   detailMap["ProcessingCmdCount"],
 			TargetDBOffset:       detailMap["TargetDBOffset"],
 			SourceDBOffset:       detailMap["SourceDBOffset"],
 			SourceAddress:        detailMap["SourceAddress"],
 			TargetAddress:        detailMap["TargetAddress"],
+			SlotRangeRestored:    detailMap["SlotRangeRestored"],
 			Details:              detailMap["Details"],
 		}
 	}
@@ -0,0 +1,177 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/common"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+const (
+	// the keys restored by RESTORE-ASKING are kept so long for the DEL of the source shard
+	migratedKeyTTL             = 10 * time.Minute
+	slotMigrationCheckInterval = time.Second
+)
+
+/*
+ * slotMigrations is shared by the syncers of the shards of the source cluster. MIGRATE of the
+ * resharding is propagated as RESTORE-ASKING in the stream of the importing shard and as DEL in
+ * the stream of the migrating shard, the two streams are synced apart, so the DEL may come after
+ * the key is restored and delete it from the target. The keys restored are recorded here, and the
+ * DEL of the key restored by another shard is dropped, see source.slot_migration.
+ */
+type slotMigrations struct {
+	mu   sync.Mutex
+	keys map[string]migratedKey
+}
+
+type migratedKey struct {
+	shard int // id of the syncer of the importing shard
+	at    time.Time
+}
+
+func newSlotMigrations() *slotMigrations {
+	return &slotMigrations{keys: make(map[string]migratedKey)}
+}
+
+// the key is restored by RESTORE-ASKING in the stream of the shard
+func (m *slotMigrations) restored(shard int, key string) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[key] = migratedKey{shard: shard, at: now}
+	if len(m.keys)%1024 == 0 {
+		for k, v := range m.keys {
+			if now.Sub(v.at) > migratedKeyTTL {
+				delete(m.keys, k)
+			}
+		}
+	}
+}
+
+// the keys of DEL in the stream of the shard without the ones migrated into another shard
+func (m *slotMigrations) settle(shard int, keys [][]byte) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kept [][]byte
+	for i, key := range keys {
+		v, ok := m.keys[string(key)]
+		if ok && v.shard != shard && time.Since(v.at) <= migratedKeyTTL {
+			// deleted by MIGRATE, it's consumed once
+			delete(m.keys, string(key))
+			if kept == nil {
+				kept = append(make([][]byte, 0, len(keys)), keys[:i]...)
+			}
+			continue
+		}
+		if kept != nil {
+			kept = append(kept, key)
+		}
+	}
+	if kept == nil {
+		return keys
+	}
+	return kept
+}
+
+/*
+ * the command of the key migrated between the shards of the source, false if it's dropped.
+ * RESTORE-ASKING becomes RESTORE with REPLACE since the key may be still on the target till the
+ * DEL of the migrating shard comes, and the target may not be the importing node.
+ */
+func (ds *dbSyncer) reconcileMigration(scmd string, argv [][]byte) (string, [][]byte, bool) {
+	if ds.migrations == nil || len(argv) == 0 {
+		return scmd, argv, true
+	}
+	switch scmd {
+	case "restore-asking":
+		ds.migrations.restored(ds.id, string(argv[0]))
+		for i := 3; i < len(argv); i++ {
+			if strings.EqualFold(string(argv[i]), "replace") {
+				return "restore", argv, true
+			}
+		}
+		return "restore", append(argv[:len(argv):len(argv)], []byte("REPLACE")), true
+	case "del", "unlink":
+		kept := ds.migrations.settle(ds.id, argv)
+		if len(kept) != len(argv) {
+			log.Debugf("dbSyncer[%v] drop %d keys of command[%v] migrated into another shard", ds.id,
+				len(argv)-len(kept), scmd)
+			ds.migrationDropped.Add(int64(len(argv) - len(kept)))
+		}
+		return scmd, kept, len(kept) > 0
+	}
+	return scmd, argv, true
+}
+
+// watch the slots migrating on the source node by CLUSTER NODES till the syncer stops
+func (ds *dbSyncer) watchSlotMigration() {
+	if ds.opts().SourceType != conf.RedisTypeCluster || ds.opts().SourceSlotMigration == conf.SlotMigrationIgnore {
+		return
+	}
+	var conn redigo.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	ticker := time.NewTicker(slotMigrationCheckInterval)
+	defer ticker.Stop()
+	last := fmt.Sprint([]int(nil), []int(nil)) // no slot migrating
+	for {
+		select {
+		case <-ds.ctx.Done():
+			return
+		case <-ds.failed:
+			return
+		case <-ticker.C:
+		}
+		if conn == nil {
+			conn = utils.OpenRedisConnSoft([]string{ds.currentSource()}, ds.opts().SourceAuthType,
+				utils.SourceAuthToken(ds.sourcePassword), time.Second, time.Second, false,
+				ds.sourceTLS())
+			if conn == nil {
+				continue
+			}
+		}
+		content, err := redigo.Bytes(conn.Do("cluster", "nodes"))
+		if err != nil {
+			log.Warnf("dbSyncer[%v] fetch cluster nodes of source[%v] failed: %v", ds.id, ds.currentSource(), err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		migrating, importing := utils.ParseMigratingSlots(content)
+		ds.migratingSlots.Set(int64(len(migrating) + len(importing)))
+		now := fmt.Sprint(migrating, importing)
+		if now == last {
+			continue
+		}
+		last = now
+		if len(migrating) == 0 && len(importing) == 0 {
+			log.Infof("dbSyncer[%v] the slots of source[%v] stop migrating", ds.id, ds.currentSource())
+			continue
+		}
+
+		log.Warnf("dbSyncer[%v] Event:SourceSlotMigrating\tId:%s\tMigrating:%v\tImporting:%v", ds.id,
+			ds.opts().Id, migrating, importing)
+		ds.emit(EventSlotMigrating, "migrating = %v, importing = %v", migrating, importing)
+		select {
+		case <-ds.waitFull:
+		default:
+			if ds.opts().SourceSlotMigration == conf.SlotMigrationAbort {
+				log.Panicf("dbSyncer[%v] the slots of source[%v] migrate in the full sync, migrating %v, "+
+					"importing %v", ds.id, ds.currentSource(), migrating, importing)
+			}
+			// the rdb of the shards are taken apart, a key migrated between may be restored twice
+			log.Warnf("dbSyncer[%v] the slots of source[%v] migrate in the full sync", ds.id, ds.currentSource())
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package run
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"pkg/libs/atomic2"
+	"pkg/libs/log"
+	"redis-shake/common"
+	"redis-shake/configure"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// the timeout of MIGRATE, the same as redis-cli
+const reshardMigrateTimeoutMs = 60000
+
+/*
+ * CmdReshard moves the slots of the source cluster into the masters given by reshard.plan online.
+ * Within the source cluster, each slot is moved the same way as redis-cli --cluster reshard:
+ * 1. CLUSTER SETSLOT IMPORTING on the master moved into and MIGRATING on the master serving it.
+ * 2. the keys given by CLUSTER GETKEYSINSLOT are moved by MIGRATE ... REPLACE KEYS from the master
+ *    serving it batch by batch, until the slot is empty.
+ * 3. CLUSTER SETSLOT NODE on the master moved into, the master serving it and then the others.
+ * If target.address is given, the keys are moved into the master of the target cluster which
+ * serves the slot already, and no SETSLOT is sent. The slot served by the master moved into is
+ * skipped, so the reshard killed in the middle can be run again with the same plan.
+ */
+type CmdReshard struct {
+	r *resharder
+}
+
+func (cmd *CmdReshard) GetDetailedInfo() interface{} {
+	if cmd.r == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"TotalSlots": len(conf.Options.ReshardPlan),
+		"MovedSlots": cmd.r.movedSlots.Get(),
+		"MovedKeys":  cmd.r.movedKeys.Get(),
+	}
+}
+
+func (cmd *CmdReshard) Main() {
+	r, err := newResharder()
+	if err != nil {
+		log.Panicf("reshard failed: %v", err)
+	}
+	defer r.close()
+	cmd.r = r
+
+	slots := make([]int, 0, len(conf.Options.ReshardPlan))
+	for slot := range conf.Options.ReshardPlan {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	for _, slot := range slots {
+		node := conf.Options.ReshardPlan[slot]
+		if err := r.moveSlot(slot, node); err != nil {
+			log.Panicf("move slot[%v] into [%v] failed: %v", slot, node, err)
+		}
+	}
+	log.Infof("reshard done, %v slots and %v keys are moved", r.movedSlots.Get(), r.movedKeys.Get())
+}
+
+type resharder struct {
+	between bool // move the keys into the target cluster
+
+	owners       [utils.ClusterSlots]string // master serving each slot of the source cluster
+	ids          map[string]string          // address -> id of the masters of the source cluster
+	targetOwners [utils.ClusterSlots]string // master serving each slot of the target cluster
+
+	conns map[string]redigo.Conn
+
+	movedSlots atomic2.Int64
+	movedKeys  atomic2.Int64
+}
+
+// fetch the slots and the masters of the clusters, each master in reshard.plan is checked first
+func newResharder() (*resharder, error) {
+	r := &resharder{
+		between: len(conf.Options.TargetAddressList) != 0,
+		conns:   make(map[string]redigo.Conn),
+	}
+	seed := conf.Options.SourceAddressList[0]
+	c := r.conn(seed, true)
+	var err error
+	if r.owners, err = utils.ClusterSlotOwners(c, seed); err != nil {
+		return nil, fmt.Errorf("fetch the slots of the source cluster from [%v] failed: %v", seed, err)
+	}
+	content, err := redigo.Bytes(c.Do("cluster", "nodes"))
+	if err != nil {
+		return nil, fmt.Errorf("fetch the nodes of the source cluster from [%v] failed: %v", seed, err)
+	}
+	r.ids = make(map[string]string)
+	for _, node := range utils.ClusterNodeChoose(utils.ParseClusterNode(content), conf.StandAloneRoleMaster) {
+		r.ids[node.Address] = node.Id
+	}
+
+	if r.between {
+		seed := conf.Options.TargetAddressList[0]
+		if r.targetOwners, err = utils.ClusterSlotOwners(r.conn(seed, false), seed); err != nil {
+			return nil, fmt.Errorf("fetch the slots of the target cluster from [%v] failed: %v", seed, err)
+		}
+	}
+	for slot, node := range conf.Options.ReshardPlan {
+		if r.owners[slot] == "" {
+			return nil, fmt.Errorf("slot[%v] isn't served in the source cluster", slot)
+		}
+		if r.between {
+			if r.targetOwners[slot] != node {
+				return nil, fmt.Errorf("slot[%v] is served by [%v] in the target cluster instead of [%v]", slot,
+					r.targetOwners[slot], node)
+			}
+		} else if _, ok := r.ids[node]; !ok {
+			return nil, fmt.Errorf("[%v] isn't a master of the source cluster", node)
+		}
+	}
+	return r, nil
+}
+
+// the password of the node of the source or the target cluster given by the address list
+func (r *resharder) password(addr string, isSource bool) string {
+	if isSource {
+		return utils.SourceAuthToken(utils.AddressPassword(conf.Options.SourceAddressOptions, addr,
+			conf.Options.SourcePasswordRaw))
+	}
+	return utils.FetchAuthToken(utils.TargetAuthProvider, utils.AddressPassword(conf.Options.TargetAddressOptions,
+		addr, conf.Options.TargetPasswordRaw))
+}
+
+// the connection to the node of the source or the target cluster
+func (r *resharder) conn(addr string, isSource bool) redigo.Conn {
+	if c, ok := r.conns[addr]; ok && c.Err() == nil {
+		return c
+	}
+	var c redigo.Conn
+	if isSource {
+		c = utils.OpenRedisConn([]string{addr}, conf.Options.SourceAuthType, r.password(addr, true), false,
+			utils.SourceTLS(utils.AddressTLS(conf.Options.SourceAddressOptions, addr, conf.Options.SourceTLSEnable)))
+	} else {
+		c = utils.OpenRedisConn([]string{addr}, conf.Options.TargetAuthType, r.password(addr, false), false,
+			utils.TargetTLS(utils.AddressTLS(conf.Options.TargetAddressOptions, addr, conf.Options.TargetTLSEnable)))
+	}
+	r.conns[addr] = c
+	return c
+}
+
+func (r *resharder) close() {
+	for addr, c := range r.conns {
+		c.Close()
+		delete(r.conns, addr)
+	}
+}
+
+func (r *resharder) moveSlot(slot int, node string) error {
+	from := r.owners[slot]
+	if r.between {
+		if err := r.moveKeys(slot, r.conn(from, true), node, r.password(node, false)); err != nil {
+			return err
+		}
+		r.movedSlots.Incr()
+		log.Infof("slot[%v] of [%v] is moved into [%v] of the target cluster", slot, from, node)
+		return nil
+	}
+
+	if from == node {
+		log.Infof("slot[%v] is served by [%v] already, skip it", slot, node)
+		return nil
+	}
+	src, dst := r.conn(from, true), r.conn(node, true)
+	if _, err := dst.Do("cluster", "setslot", slot, "importing", r.ids[from]); err != nil {
+		return fmt.Errorf("set slot importing on [%v] failed: %v", node, err)
+	}
+	if _, err := src.Do("cluster", "setslot", slot, "migrating", r.ids[node]); err != nil {
+		return fmt.Errorf("set slot migrating on [%v] failed: %v", from, err)
+	}
+	if err := r.moveKeys(slot, src, node, r.password(node, true)); err != nil {
+		return err
+	}
+
+	// the master moved into first, so the slot is never served by nobody
+	if _, err := dst.Do("cluster", "setslot", slot, "node", r.ids[node]); err != nil {
+		return fmt.Errorf("set slot node on [%v] failed: %v", node, err)
+	}
+	if _, err := src.Do("cluster", "setslot", slot, "node", r.ids[node]); err != nil {
+		return fmt.Errorf("set slot node on [%v] failed: %v", from, err)
+	}
+	for addr := range r.ids {
+		if addr == from || addr == node {
+			continue
+		}
+		// the others learn it by the gossip as well
+		if _, err := r.conn(addr, true).Do("cluster", "setslot", slot, "node", r.ids[node]); err != nil {
+			log.Warnf("set slot[%v] node on [%v] failed: %v", slot, addr, err)
+		}
+	}
+	r.owners[slot] = node
+	r.movedSlots.Incr()
+	log.Infof("slot[%v] is moved from [%v] into [%v]", slot, from, node)
+	return nil
+}
+
+/*
+ * move the keys of the slot by MIGRATE ... REPLACE KEYS from the source into dst, reshard.batch
+ * keys at a time until the slot is empty. MIGRATE is atomic for each key, the key is restored on
+ * dst by RESTORE-ASKING and deleted from the source before any other command is served, so the
+ * key written while the slot is moved isn't lost. The source connects to dst by itself, so dst
+ * should be reachable from the source, and tls is used by the source only if tls-cluster is set.
+ */
+func (r *resharder) moveKeys(slot int, src redigo.Conn, dst, password string) error {
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return fmt.Errorf("invalid address[%v]: %v", dst, err)
+	}
+	for {
+		keys, err := redigo.ByteSlices(src.Do("cluster", "getkeysinslot", slot, conf.Options.ReshardBatch))
+		if err != nil {
+			return fmt.Errorf("get keys in slot failed: %v", err)
+		} else if len(keys) == 0 {
+			return nil
+		}
+
+		args := []interface{}{host, port, "", 0, reshardMigrateTimeoutMs, "replace"}
+		if password != "" {
+			if auth := utils.AuthArgs(password); len(auth) == 2 {
+				args = append(args, "auth2", auth[0], auth[1])
+			} else {
+				args = append(args, "auth", auth[0])
+			}
+		}
+		args = append(args, "keys")
+		for _, key := range keys {
+			args = append(args, key)
+		}
+		// NOKEY means the keys are expired or deleted meanwhile
+		if _, err := redigo.String(src.Do("migrate", args...)); err != nil {
+			return fmt.Errorf("migrate the keys into [%v] failed: %v", dst, err)
+		}
+		r.movedKeys.Add(int64(len(keys)))
+	}
+}
@@ -0,0 +1,329 @@
+// +build linux darwin windows
+// +build integration
+
+package run
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"pkg/redis"
+	"redis-shake/common"
+	"redis-shake/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the fake masters by the address, so the keys are moved by MIGRATE between them
+var reshardNodes sync.Map
+
+// fake master of the cluster which keeps the payload and the ttl of each key, used by rump as well
+type reshardNode struct {
+	net.Listener
+	id       string
+	mu       sync.Mutex
+	keys     map[string][2]string // key -> payload, ttl
+	slots    string               // reply of cluster slots
+	nodes    string               // reply of cluster nodes
+	commands []string             // the commands except dump and pttl
+}
+
+func startReshardNode(t *testing.T, id string) *reshardNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	n := &reshardNode{Listener: l, id: id, keys: make(map[string][2]string)}
+	reshardNodes.Store(l.Addr().String(), n)
+	bulk := func(s string) string {
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+
+					n.mu.Lock()
+					if cmd != "dump" && cmd != "pttl" {
+						n.commands = append(n.commands, strings.Join(strs, " "))
+					}
+					var reply string
+					switch {
+					case cmd == "cluster" && strs[1] == "slots":
+						reply = n.slots
+					case cmd == "cluster" && strs[1] == "nodes":
+						reply = bulk(n.nodes)
+					case cmd == "cluster" && strs[1] == "getkeysinslot":
+						slot, _ := strconv.Atoi(strs[2])
+						count, _ := strconv.Atoi(strs[3])
+						var keys []string
+						for key := range n.keys {
+							if int(utils.KeyToSlot(key)) == slot && len(keys) < count {
+								keys = append(keys, bulk(key))
+							}
+						}
+						reply = fmt.Sprintf("*%d\r\n%s", len(keys), strings.Join(keys, ""))
+					case cmd == "scan":
+						// all the keys at once
+						var keys []string
+						for key := range n.keys {
+							keys = append(keys, bulk(key))
+						}
+						reply = fmt.Sprintf("*2\r\n%s*%d\r\n%s", bulk("0"), len(keys), strings.Join(keys, ""))
+					case cmd == "info":
+						reply = bulk(fmt.Sprintf("# Keyspace\r\ndb0:keys=%d,expires=0,avg_ttl=0\r\n", len(n.keys)))
+					case cmd == "dump":
+						if v, ok := n.keys[strs[1]]; ok {
+							reply = bulk(v[0])
+						} else {
+							reply = "$-1\r\n"
+						}
+					case cmd == "pttl":
+						if v, ok := n.keys[strs[1]]; ok {
+							reply = ":" + v[1] + "\r\n"
+						} else {
+							reply = ":-2\r\n"
+						}
+					case cmd == "restore":
+						n.keys[strs[1]] = [2]string{strs[3], strs[2]}
+						reply = "+OK\r\n"
+					case cmd == "migrate":
+						// migrate host port "" 0 timeout replace [auth ...] keys key...
+						v, _ := reshardNodes.Load(net.JoinHostPort(strs[1], strs[2]))
+						dst := v.(*reshardNode)
+						reply = "+NOKEY\r\n"
+						i := 0
+						for strs[i] != "keys" {
+							i++
+						}
+						for _, key := range strs[i+1:] {
+							v, ok := n.keys[key]
+							if !ok {
+								continue
+							}
+							if v[1] == "-1" {
+								v[1] = "0"
+							}
+							dst.mu.Lock()
+							dst.keys[key] = v
+							dst.commands = append(dst.commands, fmt.Sprintf("restore-asking %s %s %s replace", key,
+								v[1], v[0]))
+							dst.mu.Unlock()
+							delete(n.keys, key)
+							reply = "+OK\r\n"
+						}
+					case cmd == "del":
+						for _, key := range strs[1:] {
+							delete(n.keys, key)
+						}
+						reply = fmt.Sprintf(":%d\r\n", len(strs)-1)
+					default:
+						reply = "+OK\r\n"
+					}
+					n.mu.Unlock()
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return n
+}
+
+func (n *reshardNode) take() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	commands := n.commands
+	n.commands = nil
+	return commands
+}
+
+func (n *reshardNode) snapshot() map[string][2]string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ret := make(map[string][2]string, len(n.keys))
+	for k, v := range n.keys {
+		ret[k] = v
+	}
+	return ret
+}
+
+func TestReshard(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SourceAuthType = "auth"
+	conf.Options.TargetAuthType = "auth"
+	conf.Options.ReshardBatch = 1
+
+	nodeA := startReshardNode(t, "ida")
+	defer nodeA.Close()
+	nodeB := startReshardNode(t, "idb")
+	defer nodeB.Close()
+	line := func(n *reshardNode, flags string) string {
+		return fmt.Sprintf("%s %s@1 %s - 0 0 1 connected\n", n.id, n.Addr(), flags)
+	}
+	slots := func(ranges ...interface{}) string {
+		s := fmt.Sprintf("*%d\r\n", len(ranges)/3)
+		for i := 0; i < len(ranges); i += 3 {
+			_, port, _ := net.SplitHostPort(ranges[i+2].(*reshardNode).Addr().String())
+			s += fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", ranges[i],
+				ranges[i+1], port)
+		}
+		return s
+	}
+	// "a" is in slot 15495, "b" in 3300 and "c" in 7365
+	nodeA.keys = map[string][2]string{"a": {"pa", "0"}, "b": {"pb", "1000"}, "c": {"pc", "-1"}}
+	nodeA.slots = slots(0, 16383, nodeA)
+	nodeA.nodes = line(nodeA, "myself,master") + line(nodeB, "master")
+	conf.Options.SourceAddressList = []string{nodeA.Addr().String()}
+	addrA, addrB := nodeA.Addr().String(), nodeB.Addr().String()
+	_, portB, _ := net.SplitHostPort(addrB)
+
+	var nr int
+	{
+		fmt.Printf("TestReshard case %d.\n", nr)
+		nr++
+
+		// the slots are moved within the cluster with the handshake
+		conf.Options.TargetAddressList = nil
+		conf.Options.ReshardPlan = map[int]string{3300: addrB, 15495: addrB}
+		cmd := new(CmdReshard)
+		cmd.Main()
+		assert.Equal(t, map[string][2]string{"c": {"pc", "-1"}}, nodeA.snapshot(), "should be equal")
+		assert.Equal(t, map[string][2]string{"a": {"pa", "0"}, "b": {"pb", "1000"}}, nodeB.snapshot(),
+			"should be equal")
+		assert.Equal(t, map[string]interface{}{"TotalSlots": 2, "MovedSlots": int64(2), "MovedKeys": int64(2)},
+			cmd.GetDetailedInfo(), "should be equal")
+
+		assert.Equal(t, []string{
+			"cluster slots",
+			"cluster nodes",
+			"cluster setslot 3300 migrating idb",
+			"cluster getkeysinslot 3300 1",
+			"migrate 127.0.0.1 " + portB + "  0 60000 replace keys b",
+			"cluster getkeysinslot 3300 1",
+			"cluster setslot 3300 node idb",
+			"cluster setslot 15495 migrating idb",
+			"cluster getkeysinslot 15495 1",
+			"migrate 127.0.0.1 " + portB + "  0 60000 replace keys a",
+			"cluster getkeysinslot 15495 1",
+			"cluster setslot 15495 node idb",
+		}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{
+			"cluster setslot 3300 importing ida",
+			"restore-asking b 1000 pb replace",
+			"cluster setslot 3300 node idb",
+			"cluster setslot 15495 importing ida",
+			"restore-asking a 0 pa replace",
+			"cluster setslot 15495 node idb",
+		}, nodeB.take(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReshard case %d.\n", nr)
+		nr++
+
+		// the slot served by the master moved into already is skipped
+		nodeA.slots = slots(0, 3300, nodeB, 3301, 16383, nodeA)
+		conf.Options.ReshardPlan = map[int]string{3300: addrB}
+		cmd := new(CmdReshard)
+		cmd.Main()
+		assert.Equal(t, int64(0), cmd.r.movedSlots.Get(), "should be equal")
+		assert.Equal(t, []string{"cluster slots", "cluster nodes"}, nodeA.take(), "should be equal")
+		assert.Equal(t, 0, len(nodeB.take()), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReshard case %d.\n", nr)
+		nr++
+
+		// the master moved into should be a master of the source cluster
+		conf.Options.ReshardPlan = map[int]string{7365: "127.0.0.1:1"}
+		_, err := newResharder()
+		assert.Equal(t, "[127.0.0.1:1] isn't a master of the source cluster", fmt.Sprint(err), "should be equal")
+		nodeA.take()
+	}
+
+	target := startReshardNode(t, "idt")
+	defer target.Close()
+	target.slots = slots(0, 16383, target)
+	conf.Options.TargetAddressList = []string{target.Addr().String()}
+
+	{
+		fmt.Printf("TestReshard case %d.\n", nr)
+		nr++
+
+		// the slot should be served by the master of the target cluster
+		conf.Options.ReshardPlan = map[int]string{7365: addrA}
+		_, err := newResharder()
+		assert.Equal(t, fmt.Sprintf("slot[7365] is served by [%v] in the target cluster instead of [%v]",
+			target.Addr(), addrA), fmt.Sprint(err), "should be equal")
+		nodeA.take()
+		target.take()
+	}
+
+	{
+		fmt.Printf("TestReshard case %d.\n", nr)
+		nr++
+
+		// the keys are moved into the target cluster without the handshake, by the password of the target
+		// given in the address list
+		password := "secret"
+		conf.Options.TargetAddressOptions = map[string]conf.AddressOptions{target.Addr().String(): {Password: &password}}
+		conf.Options.ReshardPlan = map[int]string{7365: target.Addr().String()}
+		_, portT, _ := net.SplitHostPort(target.Addr().String())
+		cmd := new(CmdReshard)
+		cmd.Main()
+		assert.Equal(t, 0, len(nodeA.snapshot()), "should be equal")
+		assert.Equal(t, map[string][2]string{"c": {"pc", "0"}}, target.snapshot(), "should be equal")
+		assert.Equal(t, []string{
+			"cluster slots",
+			"cluster nodes",
+			"cluster getkeysinslot 7365 1",
+			"migrate 127.0.0.1 " + portT + "  0 60000 replace auth secret keys c",
+			"cluster getkeysinslot 7365 1",
+		}, nodeA.take(), "should be equal")
+		assert.Equal(t, []string{"auth secret", "cluster slots", "restore-asking c 0 pc replace"}, target.take(),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestReshard case %d.\n", nr)
+		nr++
+
+		// the user of acl is given by auth2
+		password := utils.ACLPassword("user", "secret")
+		conf.Options.TargetAddressOptions = map[string]conf.AddressOptions{target.Addr().String(): {Password: &password}}
+		nodeA.keys = map[string][2]string{"c": {"pc", "-1"}}
+		_, portT, _ := net.SplitHostPort(target.Addr().String())
+		cmd := new(CmdReshard)
+		cmd.Main()
+		assert.Equal(t, "migrate 127.0.0.1 "+portT+"  0 60000 replace auth2 user secret keys c", nodeA.take()[3],
+			"should be equal")
+		target.take()
+	}
+}
@@ -0,0 +1,197 @@
+package run
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+)
+
+const (
+	restartMaxBackoff = time.Minute      // the backoff of sync.restart_backoff_ms doubles up to it
+	failQuitTimeout   = 10 * time.Second // warn if the routines of the syncer don't quit in time
+)
+
+/*
+ * The fatal error raised by log.Panic* in the routines of the syncer fails the syncer alone once
+ * sync.restart_retries is set, instead of exiting the process. The source stream is closed and
+ * the syncer is stopping, so the other routines reading it or sending the commands quit too, then
+ * CmdSync restarts the syncer with a new one.
+ */
+
+// deferred first in each routine of the syncer
+func (ds *dbSyncer) recoverFatal() {
+	if r := recover(); r != nil {
+		f, ok := r.(*log.Fatal)
+		if !ok {
+			panic(r)
+		}
+		ds.fail(f)
+	}
+}
+
+func (ds *dbSyncer) fail(f *log.Fatal) {
+	ds.failOnce.Do(func() {
+		log.Warnf("dbSyncer[%v] Event:SyncerFailed\tId:%s\tError:%v", ds.id, ds.opts().Id, f)
+		ds.fatal = f
+		if ds.failed != nil {
+			close(ds.failed)
+		}
+		ds.emit(EventSyncerFailed, "%v", f)
+
+		ds.stopping.Set(true)
+		ds.mu.Lock()
+		if ds.input != nil {
+			ds.input.Close()
+		}
+		ds.mu.Unlock()
+		for _, l := range ds.targetLanes() {
+			if l.budget != nil {
+				// the sender which quits doesn't give back the bytes
+				l.budget.abort()
+			}
+			if l.spill != nil {
+				l.spill.abort()
+			}
+		}
+	})
+}
+
+// the routine quits once the syncer fails, so the next phase isn't started
+func (ds *dbSyncer) checkFailed() {
+	select {
+	case <-ds.failed:
+		panic(ds.fatal)
+	default:
+	}
+}
+
+// keep the source stream which is closed once the syncer fails
+func (ds *dbSyncer) setInput(input io.Closer) {
+	ds.mu.Lock()
+	ds.input = input
+	ds.mu.Unlock()
+}
+
+// the fatal error of the syncer, nil if it doesn't fail
+func (ds *dbSyncer) fatalError() error {
+	select {
+	case <-ds.failed:
+		return ds.fatal
+	default:
+		return nil
+	}
+}
+
+// start the routine of the syncer, run waits for it to quit
+func (ds *dbSyncer) spawn(f func()) {
+	ds.routines.Add(1)
+	go func() {
+		defer ds.routines.Done()
+		defer ds.recoverFatal()
+		f()
+	}()
+}
+
+/*
+ * sync until it's stopped or fails. The routines of the syncer read the options and the state of
+ * it, so they're stopped by the ctx and waited for before returning, then the next syncer is free
+ * to start.
+ */
+func (ds *dbSyncer) run() error {
+	ctx, cancel := context.WithCancel(ds.ctx)
+	ds.ctx = ctx
+	done := make(chan struct{})
+	ds.spawn(func() {
+		defer close(done)
+		ds.sync()
+	})
+
+	select {
+	case <-done:
+	case <-ds.failed:
+	}
+	// the source is closed once sync returns, the routines reading it quit without error
+	ds.stopping.Set(true)
+	cancel()
+
+	quit := make(chan struct{})
+	go func() {
+		ds.routines.Wait()
+		close(quit)
+	}()
+	for {
+		select {
+		case <-quit:
+			return ds.fatalError()
+		case <-time.After(failQuitTimeout):
+			log.Warnf("dbSyncer[%v] doesn't quit in %v, waiting for the routines left", ds.id, failQuitTimeout)
+		}
+	}
+}
+
+/*
+ * run the syncer of the node until it's stopped, the syncer failed is replaced by a new one after
+ * the backoff, which doubles from sync.restart_backoff_ms after each failure in a row. The failures
+ * are counted again once the full sync of the syncer is done. The process exits once the syncer
+ * fails more than sync.restart_retries times in a row. full is closed once the full sync of the
+ * node is done for the first time, or the node quits.
+ */
+func (cmd *CmdSync) supervise(nd syncNode, full chan struct{}) {
+	var fullOnce sync.Once
+	defer fullOnce.Do(func() { close(full) })
+	failures := 0
+	for {
+		syncer := NewSyncer(SyncerConfig{
+			Id:             nd.id,
+			Source:         nd.source,
+			SourcePassword: nd.sourcePassword,
+			Target:         nd.target,
+			TargetPassword: nd.targetPassword,
+			Job:            nd.job,
+		})
+		syncer.ds.migrations = nd.migrations
+		syncer.ds.owners = nd.owners
+		syncer.ds.restoreLimiter = nd.limiter
+		cmd.mu.Lock()
+		cmd.dbSyncers[nd.id] = syncer.ds
+		cmd.syncers[nd.id] = syncer
+		cmd.mu.Unlock()
+		go func() {
+			select {
+			case <-syncer.WaitFull():
+				fullOnce.Do(func() { close(full) })
+			case <-syncer.done:
+			}
+		}()
+
+		err := syncer.Start(context.Background())
+		if err == nil || cmd.stopped.Get() {
+			return
+		}
+		select {
+		case <-syncer.WaitFull():
+			failures = 0
+		default:
+		}
+		if failures++; failures > int(conf.Options.SyncRestartRetries) {
+			log.SetPanicRecoverable(false)
+			log.Panicf("dbSyncer[%v] fails %d times in a row, exceeds sync.restart_retries[%v]: %v", nd.id,
+				failures, conf.Options.SyncRestartRetries, err)
+		}
+
+		backoff := time.Duration(conf.Options.SyncRestartBackoff) * time.Millisecond << uint(failures-1)
+		if backoff > restartMaxBackoff || backoff <= 0 {
+			backoff = restartMaxBackoff
+		}
+		log.Warnf("dbSyncer[%v] Event:SyncerRestart\tId:%s\tFailures:%d\trestart after %v", nd.id,
+			conf.Options.Id, failures, backoff)
+		time.Sleep(backoff)
+		if cmd.stopped.Get() {
+			return
+		}
+	}
+}
@@ -6,6 +6,7 @@ package run
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -20,6 +21,8 @@ import (
 	"redis-shake/common"
 	"redis-shake/configure"
 	"redis-shake/filter"
+
+	redigo "github.com/garyburd/redigo/redis"
 )
 
 type CmdRestore struct {
@@ -42,7 +45,7 @@ func (cmd *CmdRestore) Main() {
 		id    int
 		input string
 	}
-	base.Status = "waitRestore"
+	base.SetStatus("waitRestore")
 	total := utils.GetTotalLink()
 	restoreChan := make(chan restoreNode, total)
 
@@ -50,9 +53,21 @@ func (cmd *CmdRestore) Main() {
 		restoreChan <- restoreNode{id: i, input: rdb}
 	}
 
+	parallel := conf.Options.SourceRdbParallel
+	if conf.Options.RestoreFileOrder == conf.RestoreFileOrderSequential {
+		// the next file starts after the previous one is done
+		parallel = 1
+		if !conf.Options.Rewrite {
+			log.Warnf("restore.file_order is %v but rewrite is false, the keys in the later file won't win",
+				conf.RestoreFileOrderSequential)
+		}
+	}
+
+	// the limit is on the keys restored from all the inputs
+	limiter := utils.NewRestoreLimiter(&conf.Options)
 	var wg sync.WaitGroup
 	wg.Add(len(conf.Options.SourceRdbInput))
-	for i := 0; i < conf.Options.SourceRdbParallel; i++ {
+	for i := 0; i < parallel; i++ {
 		go func() {
 			for {
 				node, ok := <-restoreChan
@@ -74,6 +89,7 @@ func (cmd *CmdRestore) Main() {
 					input:          node.input,
 					target:         target,
 					targetPassword: conf.Options.TargetPasswordRaw,
+					restoreLimiter: limiter,
 				}
 				log.Infof("routine[%v] starts restoring data from %v to %v",
 					dr.id, dr.input, dr.target)
@@ -90,7 +106,7 @@ func (cmd *CmdRestore) Main() {
 	log.Infof("restore from '%s' to '%s' done", conf.Options.SourceRdbInput, conf.Options.TargetAddressList)
 	if conf.Options.HttpProfile != -1 {
 		//fake status if set http_port. and wait forever
-		base.Status = "incr"
+		base.SetStatus("incr")
 		log.Infof("Enabled http stats, set status (incr), and wait forever.")
 		select {}
 	}
@@ -104,6 +120,8 @@ type dbRestorer struct {
 	target         []string // len >= 1 when target type is cluster, otherwise len == 1
 	targetPassword string
 
+	restoreLimiter *utils.RestoreLimiter // see limit.key_count, shared by all the inputs
+
 	// metric
 	rbytes, ebytes, nentry, ignore atomic2.Int64
 	forward, nbypass               atomic2.Int64
@@ -124,24 +142,39 @@ func (dr *dbRestorer) Stat() *cmdRestoreStat {
 func (dr *dbRestorer) restore() {
 	readin, nsize := utils.OpenReadFile(dr.input)
 	defer readin.Close()
-	base.Status = "restore"
+	base.SetStatus("restore")
 
 	reader := bufio.NewReaderSize(readin, utils.ReaderBufferSize)
 
 	dr.restoreRDBFile(reader, dr.target, conf.Options.TargetAuthType, conf.Options.TargetPasswordRaw,
-		nsize, conf.Options.TargetTLSEnable)
+		nsize, utils.TargetTLS(conf.Options.TargetTLSEnable))
 
-	base.Status = "extra"
+	base.SetStatus("extra")
 	if conf.Options.ExtraInfo && (nsize == 0 || nsize != dr.rbytes.Get()) {
 		// inner usage
 		dr.restoreCommand(reader, dr.target, conf.Options.TargetAuthType,
-			conf.Options.TargetPasswordRaw, conf.Options.TargetTLSEnable)
+			conf.Options.TargetPasswordRaw, utils.TargetTLS(conf.Options.TargetTLSEnable))
 	}
 }
 
 func (dr *dbRestorer) restoreRDBFile(reader *bufio.Reader, target []string, auth_type, passwd string, nsize int64,
-	tlsEnable bool) {
-	pipe := utils.NewRDBLoader(reader, &dr.rbytes, base.RDBPipeSize)
+	tlsConfig *tls.Config) {
+	restoreShare := dr.restoreLimiter.Begin(dr.id)
+	pipe, version := utils.NewRDBLoader(reader, &dr.rbytes, base.RDBPipeSize, nil)
+	bigKey := utils.BigKeyThreshold(&conf.Options)
+	if rewrite, err := utils.CheckTargetRdbVersion(version, target, auth_type, passwd, tlsConfig,
+		&conf.Options); err != nil {
+		log.PanicErrorf(err, "routine[%v] check rdb version failed", dr.id)
+	} else if rewrite {
+		bigKey = 1
+	}
+	if conf.Options.RestoreDBGroupBuffer > 0 {
+		pipe = utils.GroupRdbEntryByDB(pipe, conf.Options.RestoreDBGroupBuffer, base.RDBPipeSize)
+	}
+	dbChecker := utils.NewTargetDBChecker(&conf.Options, func() redigo.Conn {
+		return utils.OpenRedisConn(target[:1], auth_type, passwd, false, tlsConfig)
+	})
+	defer dbChecker.Close()
 	wait := make(chan struct{})
 	go func() {
 		var wg sync.WaitGroup
@@ -150,37 +183,55 @@ func (dr *dbRestorer) restoreRDBFile(reader *bufio.Reader, target []string, auth
 			go func() {
 				defer wg.Done()
 				c := utils.OpenRedisConn(target, auth_type, passwd, conf.Options.TargetType == conf.RedisTypeCluster,
-					tlsEnable)
+					tlsConfig)
 				defer c.Close()
+				// each worker has its own transform worker, so the keys aren't transformed one by one
+				var transformer *utils.Transformer
+				if conf.Options.TransformCommand != "" {
+					var err error
+					if transformer, err = utils.NewTransformer(conf.Options.TransformCommand); err != nil {
+						log.PanicErrorf(err, "routine[%v] start transform failed", dr.id)
+					}
+					defer transformer.Close()
+				}
 				var lastdb uint32 = 0
 				for e := range pipe {
 					if filter.FilterDB(int(e.DB)) {
 						// filter db
 						dr.ignore.Incr()
+					} else if db, pass := utils.MapTargetDB(int(e.DB)); !pass {
+						// db isn't in the db map
+						dr.ignore.Incr()
+					} else if db, pass = dbChecker.Map(db); !pass {
+						// db is out of range on the target
+						dr.ignore.Incr()
 					} else {
 						dr.nentry.Incr()
 
 						log.Debugf("routine[%v] try restore key[%s] with value length[%v]", dr.id, e.Key, len(e.Value))
 
-						if conf.Options.TargetDB != -1 {
-							if conf.Options.TargetDB != int(lastdb) {
-								lastdb = uint32(conf.Options.TargetDB)
-								utils.SelectDB(c, lastdb)
-							}
-						} else {
-							if e.DB != lastdb {
-								lastdb = e.DB
-								utils.SelectDB(c, lastdb)
-							}
+						if uint32(db) != lastdb {
+							lastdb = uint32(db)
+							utils.SelectDB(c, lastdb)
 						}
 
-						if filter.FilterKey(string(e.Key)) {
+						if filter.FilterKey(string(e.Key)) || filter.FilterType(e.Type) {
+							continue
+						} else if restoreShare.Reached(e) {
+							dr.ignore.Incr()
 							continue
 						}
+						if transformer != nil {
+							var ok bool
+							if e.Value, ok = transformer.Apply(e.Key, e.Value); !ok {
+								dr.ignore.Incr()
+								continue
+							}
+						}
 
 						log.Debugf("routine[%v] start restoring key[%s] with value length[%v]", dr.id, e.Key, len(e.Value))
 
-						utils.RestoreRdbEntry(c, e)
+						utils.RestoreRdbEntry(c, e, bigKey)
 						log.Debugf("routine[%v] restore key[%s] ok", dr.id, e.Key)
 					}
 				}
@@ -213,9 +264,10 @@ func (dr *dbRestorer) restoreRDBFile(reader *bufio.Reader, target []string, auth
 	log.Infof("routine[%v] restore: rdb done", dr.id)
 }
 
-func (dr *dbRestorer) restoreCommand(reader *bufio.Reader, target []string, auth_type, passwd string, tlsEnable bool) {
+func (dr *dbRestorer) restoreCommand(reader *bufio.Reader, target []string, auth_type, passwd string,
+	tlsConfig *tls.Config) {
 	// inner usage. only use on targe
-	c := utils.OpenNetConn(target[0], auth_type, passwd, tlsEnable)
+	c := utils.OpenNetConn(target[0], auth_type, passwd, tlsConfig)
 	defer c.Close()
 
 	writer := bufio.NewWriterSize(c, utils.WriterBufferSize)
@@ -0,0 +1,302 @@
+// +build linux darwin windows
+// +build integration
+
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"pkg/rdb"
+	"pkg/redis"
+	"redis-shake/common"
+	"redis-shake/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fake target which keeps the payload of each key restored, the keys have no ttl
+type kvTarget struct {
+	net.Listener
+	mu       sync.Mutex
+	kv       map[string]string
+	restores int
+}
+
+func startFakeKVTarget(t *testing.T) *kvTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	kt := &kvTarget{Listener: l, kv: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					reply := "+OK\r\n"
+					kt.mu.Lock()
+					switch cmd {
+					case "restore":
+						key := string(args[0])
+						replace := strings.EqualFold(string(args[len(args)-1]), "replace")
+						if _, ok := kt.kv[key]; ok && !replace {
+							reply = "-BUSYKEY Target key name already exists.\r\n"
+						} else {
+							kt.kv[key] = string(args[2])
+							kt.restores++
+						}
+					case "del":
+						delete(kt.kv, string(args[0]))
+						reply = ":1\r\n"
+					case "info":
+						keyspace := "# Keyspace\r\n"
+						if len(kt.kv) != 0 {
+							keyspace += fmt.Sprintf("db0:keys=%d,expires=0,avg_ttl=0\r\n", len(kt.kv))
+						}
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(keyspace), keyspace)
+					case "scan":
+						// all the keys in one round
+						reply = fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(kt.kv))
+						for key := range kt.kv {
+							reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+						}
+					case "dump":
+						reply = "$-1\r\n"
+						if p, ok := kt.kv[string(args[0])]; ok {
+							reply = fmt.Sprintf("$%d\r\n%s\r\n", len(p), p)
+						}
+					case "pttl":
+						reply = ":-2\r\n"
+						if _, ok := kt.kv[string(args[0])]; ok {
+							reply = ":-1\r\n"
+						}
+					}
+					kt.mu.Unlock()
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return kt
+}
+
+func TestRestoreFileOrder(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	dir, err := ioutil.TempDir("", "restore_file_order")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	// the shared key is at the end of the large file0 and in the small file1
+	writeRdb := func(name string, keys int, value string) string {
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+		for i := 0; i < keys; i++ {
+			assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("%s-key%d", name, i)), 0,
+				rdb.String(strings.Repeat("v", 100))), "should be equal")
+		}
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte("shared"), 0, rdb.String(value)), "should be equal")
+		assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+		path := filepath.Join(dir, name)
+		assert.Equal(t, nil, ioutil.WriteFile(path, b.Bytes(), 0644), "should be equal")
+		return path
+	}
+	file0 := writeRdb("file0", 2000, "value-of-file0")
+	file1 := writeRdb("file1", 0, "value-of-file1")
+
+	target := startFakeKVTarget(t)
+	defer target.Close()
+
+	conf.Options.Type = conf.TypeRestore
+	conf.Options.HttpProfile = -1
+	conf.Options.Parallel = 4
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.TargetDB = -1
+	conf.Options.TargetType = conf.RedisTypeStandalone
+	conf.Options.TargetAddressList = []string{target.Addr().String()}
+	conf.Options.Rewrite = true
+	conf.Options.SourceRdbParallel = 2
+
+	var nr int
+	{
+		fmt.Printf("TestRestoreFileOrder case %d.\n", nr)
+		nr++
+
+		// the later file wins
+		conf.Options.RestoreFileOrder = conf.RestoreFileOrderSequential
+		for _, input := range [][]string{{file0, file1}, {file1, file0}} {
+			conf.Options.SourceRdbInput = input
+			new(CmdRestore).Main()
+
+			target.mu.Lock()
+			assert.Equal(t, 2001, len(target.kv), "should be equal")
+			last := strings.TrimPrefix(filepath.Base(input[1]), "file")
+			assert.Equal(t, true, strings.Contains(target.kv["shared"], "value-of-file"+last), "should be equal")
+			target.kv = make(map[string]string)
+			target.mu.Unlock()
+		}
+	}
+
+	{
+		fmt.Printf("TestRestoreFileOrder case %d.\n", nr)
+		nr++
+
+		// all the keys are restored in parallel too
+		conf.Options.RestoreFileOrder = conf.RestoreFileOrderParallel
+		conf.Options.SourceRdbInput = []string{file0, file1}
+		new(CmdRestore).Main()
+
+		target.mu.Lock()
+		assert.Equal(t, 2001, len(target.kv), "should be equal")
+		target.mu.Unlock()
+	}
+}
+
+// the worker of transform.command run by TestTransform, it uppercases the values
+func TestTransformWorker(t *testing.T) {
+	if os.Getenv("GO_TEST_TRANSFORM_WORKER") != "1" {
+		return
+	}
+	if file := os.Getenv("GO_TEST_TRANSFORM_PIDS"); file != "" {
+		// record the worker started
+		f, _ := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		fmt.Fprintln(f, os.Getpid())
+		f.Close()
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		key, _ := base64.StdEncoding.DecodeString(fields[0])
+		value, _ := base64.StdEncoding.DecodeString(fields[1])
+		if string(key) == "bad" {
+			fmt.Println("-not json")
+		} else {
+			fmt.Println("+" + base64.StdEncoding.EncodeToString(bytes.ToUpper(value)))
+		}
+	}
+	os.Exit(0)
+}
+
+func TestTransform(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String(fmt.Sprintf("value%d", i))), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("bad"), 0, rdb.String("bad")), "should be equal")
+	hash := rdb.Hash{&rdb.HashElement{Field: []byte("field"), Value: []byte("value")}}
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("hash"), 0, hash), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	f, err := ioutil.TempFile("", "transform")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.Remove(f.Name())
+	_, err = f.Write(b.Bytes())
+	assert.Equal(t, nil, err, "should be equal")
+	f.Close()
+
+	target := startFakeKVTarget(t)
+	defer target.Close()
+
+	pids, err := ioutil.TempFile("", "transform-pids")
+	assert.Equal(t, nil, err, "should be equal")
+	pids.Close()
+	defer os.Remove(pids.Name())
+	os.Setenv("GO_TEST_TRANSFORM_WORKER", "1")
+	os.Setenv("GO_TEST_TRANSFORM_PIDS", pids.Name())
+	defer os.Unsetenv("GO_TEST_TRANSFORM_WORKER")
+	defer os.Unsetenv("GO_TEST_TRANSFORM_PIDS")
+	conf.Options.Type = conf.TypeRestore
+	conf.Options.HttpProfile = -1
+	conf.Options.Parallel = 4
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.TargetDB = -1
+	conf.Options.TargetType = conf.RedisTypeStandalone
+	conf.Options.TargetAddressList = []string{target.Addr().String()}
+	conf.Options.SourceRdbInput = []string{f.Name()}
+	conf.Options.SourceRdbParallel = 1
+	conf.Options.TransformCommand = os.Args[0] + " -test.run=^TestTransformWorker$"
+
+	value := func(key string) string {
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		payload, ok := target.kv[key]
+		if !ok {
+			return ""
+		}
+		s, _, err := rdb.DecodeStringDump([]byte(payload))
+		assert.Equal(t, nil, err, "should be equal")
+		return string(s)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestTransform case %d.\n", nr)
+		nr++
+
+		// the key failed is skipped
+		conf.Options.TransformOnError = conf.TransformOnErrorSkip
+		new(CmdRestore).Main()
+
+		// each worker of restore has its own transform worker
+		content, err := ioutil.ReadFile(pids.Name())
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, 4, len(strings.Fields(string(content))), "should be equal")
+
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, fmt.Sprintf("VALUE%d", i), value(fmt.Sprintf("key%d", i)), "should be equal")
+		}
+		target.mu.Lock()
+		_, ok := target.kv["bad"]
+		assert.Equal(t, false, ok, "should be equal")
+
+		// the hash isn't passed to the worker
+		obj, err := rdb.DecodeDump([]byte(target.kv["hash"]))
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, hash, obj, "should be equal")
+		target.kv = make(map[string]string)
+		target.mu.Unlock()
+	}
+
+	{
+		fmt.Printf("TestTransform case %d.\n", nr)
+		nr++
+
+		// the original value of the key failed is kept
+		conf.Options.TransformOnError = conf.TransformOnErrorKeep
+		new(CmdRestore).Main()
+
+		assert.Equal(t, "VALUE0", value("key0"), "should be equal")
+		assert.Equal(t, "bad", value("bad"), "should be equal")
+	}
+}
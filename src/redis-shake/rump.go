@@ -2,8 +2,6 @@ package run
 
 import (
 	"fmt"
-	"math"
-	"reflect"
 	"strconv"
 	"sync"
 
@@ -74,8 +72,13 @@ type dbRumper struct {
 	id      int    // id
 	address string // source address
 
-	client       redis.Conn // source client
-	tencentNodes []string   // for tencent cluster only
+	client redis.Conn // source client
+	nodes  []string   // the nodes behind the proxy of the special cloud
+
+	// the slots served by the node of the source cluster, the other keys scanned, e.g., of the
+	// slot importing or given by scan.key_file, are left to the node serving them. nil if
+	// source.type isn't cluster.
+	served *[utils.ClusterSlots]bool
 
 	executors []*dbRumperExecutor
 }
@@ -96,14 +99,22 @@ func (dr *dbRumper) getStats() map[string]interface{} {
 
 func (dr *dbRumper) run() {
 	// single connection
-	dr.client = utils.OpenRedisConn([]string{dr.address}, conf.Options.SourceAuthType,
-		conf.Options.SourcePasswordRaw, false, conf.Options.SourceTLSEnable)
+	dr.client = utils.ReauthSourceConn(utils.OpenRedisConn([]string{dr.address}, conf.Options.SourceAuthType,
+		utils.SourceAuthToken(conf.Options.SourcePasswordRaw), false, utils.SourceTLS(conf.Options.SourceTLSEnable)),
+		conf.Options.SourceAuthType, conf.Options.SourcePasswordRaw)
 
 	// some clouds may have several db under proxy
 	count, err := dr.getNode()
 	if err != nil {
 		log.Panicf("dbRumper[%v] get node failed[%v]", dr.id, err)
 	}
+	if conf.Options.SourceType == conf.RedisTypeCluster {
+		served, err := utils.ClusterSlotsServed(dr.client, dr.address)
+		if err != nil {
+			log.Panicf("dbRumper[%v] get the slots served by source[%v] failed[%v]", dr.id, dr.address, err)
+		}
+		dr.served = &served
+	}
 
 	log.Infof("dbRumper[%v] get node count: %v", dr.id, count)
 
@@ -121,20 +132,29 @@ func (dr *dbRumper) run() {
 			target = []string{conf.Options.TargetAddressList[pick]}
 		}
 
-		var tencentNodeId string
-		if len(dr.tencentNodes) > 0 {
-			tencentNodeId = dr.tencentNodes[i]
+		var node string
+		if len(dr.nodes) > 0 {
+			node = dr.nodes[i]
 		}
 
-		sourceClient := utils.OpenRedisConn([]string{dr.address}, conf.Options.SourceAuthType,
-			conf.Options.SourcePasswordRaw, false, conf.Options.SourceTLSEnable)
+		// scanned by one routine, see ReauthRedisConn
+		sourceClient := utils.ReauthSourceConn(utils.OpenRedisConn([]string{dr.address},
+			conf.Options.SourceAuthType, utils.SourceAuthToken(conf.Options.SourcePasswordRaw), false,
+			utils.SourceTLS(conf.Options.SourceTLSEnable)), conf.Options.SourceAuthType, conf.Options.SourcePasswordRaw)
 		targetClient := utils.OpenRedisConn(target, conf.Options.TargetAuthType,
 			conf.Options.TargetPasswordRaw, conf.Options.TargetType == conf.RedisTypeCluster,
-			conf.Options.TargetTLSEnable)
+			utils.TargetTLS(conf.Options.TargetTLSEnable))
 		targetBigKeyClient := utils.OpenRedisConn(target, conf.Options.TargetAuthType,
 			conf.Options.TargetPasswordRaw, conf.Options.TargetType == conf.RedisTypeCluster,
-			conf.Options.TargetTLSEnable)
-		executor := NewDbRumperExecutor(dr.id, i, sourceClient, targetClient, targetBigKeyClient, tencentNodeId)
+			utils.TargetTLS(conf.Options.TargetTLSEnable))
+		if dr.served != nil {
+			// the replica given by "slave@" replies MOVED without it
+			if _, err := sourceClient.Do("readonly"); err != nil {
+				log.Panicf("dbRumper[%v] send readonly to source[%v] failed[%v]", dr.id, dr.address, err)
+			}
+		}
+		executor := NewDbRumperExecutor(dr.id, i, sourceClient, targetClient, targetBigKeyClient, node)
+		executor.served = dr.served
 		dr.executors[i] = executor
 
 		go func() {
@@ -149,45 +169,28 @@ func (dr *dbRumper) run() {
 }
 
 func (dr *dbRumper) getNode() (int, error) {
-	switch conf.Options.ScanSpecialCloud {
-	case utils.AliyunCluster:
-		info, err := redis.Bytes(dr.client.Do("info", "Cluster"))
-		if err != nil {
-			return -1, err
-		}
-
-		result := utils.ParseInfo(info)
-		if count, err := strconv.ParseInt(result["nodecount"], 10, 0); err != nil {
-			return -1, err
-		} else if count <= 0 {
-			return -1, fmt.Errorf("source node count[%v] illegal", count)
-		} else {
-			return int(count), nil
-		}
-	case utils.TencentCluster:
-		var err error
-		dr.tencentNodes, err = utils.GetAllClusterNode(dr.client, conf.StandAloneRoleMaster, "id")
-		if err != nil {
-			return -1, err
-		}
-
-		return len(dr.tencentNodes), nil
-	default:
+	var err error
+	if dr.nodes, err = utils.ScanCloud.ScanNodes(dr.client); err != nil {
+		return -1, err
+	} else if dr.nodes == nil {
 		return 1, nil
 	}
+	return len(dr.nodes), nil
 }
 
 /*------------------------------------------------------*/
 // one executor(1 db only) link corresponding to one dbRumperExecutor
 type dbRumperExecutor struct {
 	rumperId           int        // father id
-	executorId         int        // current id, also == aliyun cluster node id
+	executorId         int        // current id
 	sourceClient       redis.Conn // source client
 	targetClient       redis.Conn // target client
-	tencentNodeId      string     // tencent cluster node id
+	node               string     // the node behind the proxy of the special cloud
 	targetBigKeyClient redis.Conn // target client only used in big key, this is a bit ugly
 	previousDb         int        // store previous db
 
+	served *[utils.ClusterSlots]bool // see dbRumper.served
+
 	keyChan    chan *KeyNode // keyChan is used to communicated between routine1 and routine2
 	resultChan chan *KeyNode // resultChan is used to communicated between routine2 and routine3
 
@@ -196,27 +199,23 @@ type dbRumperExecutor struct {
 	fetcherWg sync.WaitGroup
 	stat      dbRumperExexutorStats
 
-	dbList    []int32 // db list
-	keyNumber int64   // key in this db number
-	close     bool    // is finish?
+	dbList    []int32      // db list
+	keyNumber int64        // key in this db number
+	close     atomic2.Bool // is finish?
 }
 
 func NewDbRumperExecutor(rumperId, executorId int, sourceClient, targetClient, targetBigKeyClient redis.Conn,
-	tencentNodeId string) *dbRumperExecutor {
+	node string) *dbRumperExecutor {
 	executor := &dbRumperExecutor{
 		rumperId:           rumperId,
 		executorId:         executorId,
 		sourceClient:       sourceClient,
 		targetClient:       targetClient,
-		tencentNodeId:      tencentNodeId,
+		node:               node,
 		targetBigKeyClient: targetBigKeyClient,
 		previousDb:         0,
-		stat: dbRumperExexutorStats{
-			minSize: 1 << 30,
-			maxSize: 0,
-			sumSize: 0,
-		},
 	}
+	executor.stat.minSize = 1 << 30
 
 	return executor
 }
@@ -234,41 +233,49 @@ type dbRumperExexutorStats struct {
 	wBytes    atomic2.Int64 // write bytes
 	wCommands atomic2.Int64 // write commands
 	cCommands atomic2.Int64 // confirmed commands
-	minSize   int64         // min package size
-	maxSize   int64         // max package size
-	sumSize   int64         // total package size
+
+	mu      sync.Mutex // the sizes are updated by the fetchers and read by the stats
+	minSize int64      // min package size
+	maxSize int64      // max package size
+	sumSize int64      // total package size
+}
+
+// record the size of the value dumped
+func (s *dbRumperExexutorStats) addSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size < s.minSize {
+		s.minSize = size
+	}
+	if size > s.maxSize {
+		s.maxSize = size
+	}
+	s.sumSize += size
 }
 
 func (dre *dbRumperExecutor) getStats() map[string]interface{} {
-	kv := make(map[string]interface{})
-	// stats -> map
-	v := reflect.ValueOf(dre.stat)
-	for i := 0; i < v.NumField(); i++ {
-		f := v.Field(i)
-		name := v.Type().Field(i).Name
-		switch f.Kind() {
-		case reflect.Struct:
-			// todo
-			kv[name] = f.Field(0).Int()
-			// kv[name] = f.Interface()
-		case reflect.Int64:
-			if name == "sumSize" {
-				continue
-			}
-			kv[name] = f.Int()
-		}
+	kv := map[string]interface{}{
+		"rBytes":    dre.stat.rBytes.Get(),
+		"rCommands": dre.stat.rCommands.Get(),
+		"wBytes":    dre.stat.wBytes.Get(),
+		"wCommands": dre.stat.wCommands.Get(),
+		"cCommands": dre.stat.cCommands.Get(),
 	}
+	dre.stat.mu.Lock()
+	kv["minSize"] = dre.stat.minSize
+	kv["maxSize"] = dre.stat.maxSize
+	kv["avgSize"] = float64(dre.stat.sumSize) / float64(dre.stat.rCommands.Get())
+	dre.stat.mu.Unlock()
 
 	kv["keyChan"] = len(dre.keyChan)
 	kv["resultChan"] = len(dre.resultChan)
-	kv["avgSize"] = float64(dre.stat.sumSize) / float64(dre.stat.rCommands.Get())
 
 	return kv
 }
 
 func (dre *dbRumperExecutor) exec() {
 	// create scanner
-	dre.scanner = scanner.NewScanner(dre.sourceClient, dre.tencentNodeId, dre.executorId)
+	dre.scanner = scanner.NewScanner(dre.sourceClient, dre.node)
 	if dre.scanner == nil {
 		log.Panicf("dbRumper[%v] executor[%v] create scanner failed", dre.rumperId, dre.executorId)
 		return
@@ -303,14 +310,18 @@ func (dre *dbRumperExecutor) exec() {
 
 	// start metric
 	for range time.NewTicker(1 * time.Second).C {
-		if dre.close {
+		if dre.close.Get() {
 			break
 		}
 
+		var percent int64 = 100
+		if dre.keyNumber > 0 {
+			// the shard of the cluster may be empty
+			percent = 100 * dre.stat.cCommands.Get() / dre.keyNumber
+		}
 		var b bytes.Buffer
 		fmt.Fprintf(&b, "dbRumper[%v] total = %v(keys) - %10v(keys) [%3d%%]  entry=%-12d",
-			dre.rumperId, dre.keyNumber, dre.stat.cCommands.Get(),
-			100 * dre.stat.cCommands.Get() / dre.keyNumber, dre.stat.wCommands.Get())
+			dre.rumperId, dre.keyNumber, dre.stat.cCommands.Get(), percent, dre.stat.wCommands.Get())
 		log.Info(b.String())
 	}
 
@@ -328,6 +339,11 @@ func (dre *dbRumperExecutor) fetcher() {
 			log.Infof("dbRumper[%v] executor[%v] db[%v] filtered", dre.rumperId, dre.executorId, db)
 			continue
 		}
+		if _, pass := utils.MapTargetDB(int(db)); !pass {
+			log.Infof("dbRumper[%v] executor[%v] db[%v] isn't in the db map, dropped", dre.rumperId,
+				dre.executorId, db)
+			continue
+		}
 
 		log.Infof("dbRumper[%v] executor[%v] fetch logical db: %v", dre.rumperId, dre.executorId, db)
 		if err := dre.doFetch(int(db)); err != nil {
@@ -348,6 +364,14 @@ func (dre *dbRumperExecutor) writer() {
 	bucket := utils.StartQoS(conf.Options.Qps)
 	preDb := 0
 	preBigKeyDb := 0
+
+	var transformer *utils.Transformer
+	if conf.Options.TransformCommand != "" {
+		if transformer, err = utils.NewTransformer(conf.Options.TransformCommand); err != nil {
+			log.PanicErrorf(err, "dbRumper[%v] executor[%v] start transform failed", dre.rumperId, dre.executorId)
+		}
+		defer transformer.Close()
+	}
 	for ele := range dre.keyChan {
 		/*if filter.FilterKey(ele.key) {
 			continue
@@ -362,13 +386,18 @@ func (dre *dbRumperExecutor) writer() {
 			log.Debugf("dbRumper[%v] executor[%v] skip key %s for expired", dre.rumperId, dre.executorId, ele.key)
 			continue
 		}
-		if conf.Options.TargetDB != -1 {
-			ele.db = conf.Options.TargetDB
+		ele.db, _ = utils.MapTargetDB(ele.db)
+		if transformer != nil {
+			value, ok := transformer.Apply([]byte(ele.key), []byte(ele.value))
+			if !ok {
+				continue
+			}
+			ele.value = string(value)
 		}
 
 		log.Debugf("dbRumper[%v] executor[%v] restore[%s], length[%v]", dre.rumperId, dre.executorId, ele.key,
 			len(ele.value))
-		if uint64(len(ele.value)) >= conf.Options.BigKeyThreshold {
+		if uint64(len(ele.value)) >= utils.BigKeyThreshold(&conf.Options) {
 			log.Infof("dbRumper[%v] executor[%v] restore big key[%v] with length[%v], pttl[%v], db[%v]",
 				dre.rumperId, dre.executorId, ele.key, len(ele.value), ele.pttl, ele.db)
 			// flush previous cache
@@ -451,13 +480,13 @@ func (dre *dbRumperExecutor) receiver() {
 		dre.stat.cCommands.Incr()
 	}
 
-	dre.close = true
+	dre.close.Set(true)
 }
 
 func (dre *dbRumperExecutor) getSourceDbList() ([]int32, int64, error) {
-	// tencent cluster only has 1 logical db
-	if conf.Options.ScanSpecialCloud == utils.TencentCluster {
-		return []int32{0}, 1, nil
+	// some clouds only have 1 logical db
+	if dbs := utils.ScanCloud.Dbs(); dbs != nil {
+		return dbs, int64(len(dbs)), nil
 	}
 
 	conn := dre.sourceClient
@@ -500,7 +529,8 @@ func (dre *dbRumperExecutor) doFetch(db int) error {
 		}
 
 		var keys []string
-		if len(conf.Options.FilterKeyBlacklist) != 0 || len(conf.Options.FilterKeyWhitelist) != 0 {
+		if len(conf.Options.FilterKeyBlacklist) != 0 || len(conf.Options.FilterKeyWhitelist) != 0 ||
+			dre.served != nil {
 			// filter keys
 			keys = make([]string, 0, len(rawKeys))
 			for _, key := range rawKeys {
@@ -508,6 +538,11 @@ func (dre *dbRumperExecutor) doFetch(db int) error {
 					log.Infof("dbRumper[%v] executor[%v] key[%v] filter", dre.rumperId, dre.executorId, key)
 					continue
 				}
+				if dre.served != nil && !dre.served[utils.KeyToSlot(key)] {
+					log.Debugf("dbRumper[%v] executor[%v] key[%v] isn't served by the source, skip",
+						dre.rumperId, dre.executorId, key)
+					continue
+				}
 				keys = append(keys, key)
 			}
 		} else {
@@ -543,9 +578,7 @@ func (dre *dbRumperExecutor) doFetch(db int) error {
 			for i, k := range keys {
 				length := len(dumps[i])
 				dre.stat.rBytes.Add(int64(length)) // length of value
-				dre.stat.minSize = int64(math.Min(float64(dre.stat.minSize), float64(length)))
-				dre.stat.maxSize = int64(math.Max(float64(dre.stat.maxSize), float64(length)))
-				dre.stat.sumSize += int64(length)
+				dre.stat.addSize(int64(length))
 				dre.keyChan <- &KeyNode{k, dumps[i], pttls[i], db}
 			}
 		}
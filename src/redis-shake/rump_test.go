@@ -0,0 +1,81 @@
+// +build linux darwin windows
+// +build integration
+
+package run
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"redis-shake/common"
+	"redis-shake/configure"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRumpCluster(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SourceType = conf.RedisTypeCluster
+	conf.Options.TargetType = conf.RedisTypeCluster
+	conf.Options.SourceAuthType = "auth"
+	conf.Options.TargetAuthType = "auth"
+	conf.Options.ScanKeyNumber = 100
+	conf.Options.ScanSpecialCloud = ""
+	conf.Options.ScanKeyFile = ""
+	conf.Options.Qps = 1000
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.Rewrite = true
+	conf.Options.FilterKeyWhitelist = nil
+	conf.Options.FilterKeyBlacklist = nil
+	conf.Options.FilterDBWhitelist = nil
+	conf.Options.FilterDBBlacklist = nil
+	conf.Options.TargetDBMap = nil
+	conf.Options.TargetDB = -1
+	conf.Options.TransformCommand = ""
+
+	slots := func(ranges ...interface{}) string {
+		s := fmt.Sprintf("*%d\r\n", len(ranges)/3)
+		for i := 0; i < len(ranges); i += 3 {
+			_, port, _ := net.SplitHostPort(ranges[i+2].(*reshardNode).Addr().String())
+			s += fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$2\r\nid\r\n", ranges[i],
+				ranges[i+1], port)
+		}
+		return s
+	}
+	var nodes []*reshardNode
+	for _, id := range []string{"ida", "idb", "idt1", "idt2"} {
+		n := startReshardNode(t, id)
+		defer n.Close()
+		nodes = append(nodes, n)
+	}
+	sourceA, sourceB, target1, target2 := nodes[0], nodes[1], nodes[2], nodes[3]
+	sourceA.slots = slots(0, 8191, sourceA, 8192, 16383, sourceB)
+	sourceB.slots = sourceA.slots
+	target1.slots = slots(0, 9999, target1, 10000, 16383, target2)
+	target2.slots = target1.slots
+
+	var nr int
+	{
+		fmt.Printf("TestRumpCluster case %d.\n", nr)
+		nr++
+
+		// "b" is in slot 3300, "c" in 7365 and "a" in 15495 which is importing into sourceA
+		sourceA.keys = map[string][2]string{"b": {"pb", "1000"}, "c": {"pc", "-1"}, "a": {"pa-importing", "-1"}}
+		sourceB.keys = map[string][2]string{"a": {"pa", "-1"}}
+		conf.Options.SourceAddressList = []string{sourceA.Addr().String(), sourceB.Addr().String()}
+		conf.Options.TargetAddressList = []string{target1.Addr().String()}
+
+		// each master of the source is scanned and each key is restored on the master serving it
+		cmd := new(CmdRump)
+		cmd.Main()
+		assert.Equal(t, map[string][2]string{"b": {"pb", "1000"}, "c": {"pc", "0"}}, target1.snapshot(),
+			"should be equal")
+		assert.Equal(t, map[string][2]string{"a": {"pa", "0"}}, target2.snapshot(), "should be equal")
+		// the key importing into sourceA is left to sourceB
+		assert.Equal(t, []string{"restore a 0 pa REPLACE"}, target2.take(), "should be equal")
+	}
+}
@@ -20,13 +20,13 @@ type Scanner interface {
 	Close()
 }
 
-func NewScanner(client redis.Conn, tencentNodeId string, aliyunNodeId int) Scanner {
+// node is the one of the nodes behind the proxy of the special cloud
+func NewScanner(client redis.Conn, node string) Scanner {
 	if conf.Options.ScanSpecialCloud != "" {
 		return &SpecialCloudScanner{
-			client:        client,
-			cursor:        0,
-			tencentNodeId: tencentNodeId,
-			aliyunNodeId:  aliyunNodeId,
+			client: client,
+			cursor: 0,
+			node:   node,
 		}
 	} else if conf.Options.ScanKeyFile != "" {
 		if f, err := os.Open(conf.Options.ScanKeyFile); err != nil {
@@ -8,12 +8,11 @@ import (
 	"github.com/garyburd/redigo/redis"
 )
 
+// SpecialCloudScanner scans the node behind the proxy of the cloud by the adapter of scan.special_cloud
 type SpecialCloudScanner struct {
 	client redis.Conn
 	cursor int64
-
-	tencentNodeId string
-	aliyunNodeId int
+	node   string
 }
 
 func (scs *SpecialCloudScanner) ScanKey() ([]string, error) {
@@ -23,14 +22,8 @@ func (scs *SpecialCloudScanner) ScanKey() ([]string, error) {
 		keys   []string
 	)
 
-	switch conf.Options.ScanSpecialCloud {
-	case utils.TencentCluster:
-		values, err = redis.Values(scs.client.Do("SCAN", scs.cursor, "COUNT",
-			conf.Options.ScanKeyNumber, scs.tencentNodeId))
-	case utils.AliyunCluster:
-		values, err = redis.Values(scs.client.Do("ISCAN", scs.aliyunNodeId, scs.cursor, "COUNT",
-			conf.Options.ScanKeyNumber))
-	}
+	values, err = redis.Values(utils.ScanCloud.Scan(scs.client, scs.node, scs.cursor,
+		int64(conf.Options.ScanKeyNumber)))
 	if err != nil && err != redis.ErrNil {
 		return nil, fmt.Errorf("SpecialCloudScanner: scan with cursor[%v] failed[%v]", scs.cursor, err)
 	}
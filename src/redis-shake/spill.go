@@ -0,0 +1,229 @@
+package run
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"pkg/redis"
+	"redis-shake/common"
+	"redis-shake/configure"
+)
+
+/*
+ * spillQueue keeps the commands of the lane in the file of sender.spill_file once sendBuf is full,
+ * e.g., the target is unreachable for a while, so that the source is still read and doesn't drop
+ * the slave for the output buffer. The commands go back into sendBuf in order once it has room,
+ * and the following commands are spilled until the file is drained, then the file is truncated.
+ * Each command is kept as [cmd, args..., offset] in RESP.
+ */
+type spillQueue struct {
+	name     string
+	maxBytes int64         // bytes of the commands spilled, pushing blocks once it's reached
+	maxAge   time.Duration // the syncer fails once the first command spilled is older
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	w       *os.File
+	bw      *bufio.Writer
+	r       *os.File
+	br      *bufio.Reader
+	count   int64     // commands spilled but not queued in sendBuf yet
+	bytes   int64     // bytes of them, see cmdDetail.size
+	since   time.Time // when the first of them is spilled
+	closed  bool      // no more commands are pushed
+	aborted bool      // the syncer fails or the lane is closed
+}
+
+// the file left by the last run is truncated, the commands in it are synced again from the source
+func openSpillQueue(options *conf.Configuration, name string) *spillQueue {
+	w, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		log.PanicErrorf(err, "open spill file[%v] failed", name)
+	}
+	r, err := os.Open(name)
+	if err != nil {
+		w.Close()
+		log.PanicErrorf(err, "open spill file[%v] failed", name)
+	}
+	s := &spillQueue{
+		name:     name,
+		maxBytes: int64(options.SenderSpillMaxMB) * utils.MB,
+		maxAge:   time.Duration(options.SenderSpillMaxAge) * time.Second,
+		w:        w,
+		bw:       bufio.NewWriter(w),
+		r:        r,
+		br:       bufio.NewReader(r),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// queue the command in sendBuf if nothing is spilled and it has room, otherwise spill it
+func (s *spillQueue) push(l *targetLane, item cmdDetail) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted {
+		l.pending.Decr()
+		return
+	}
+
+	n := item.size()
+	if s.count == 0 && (l.budget == nil || l.budget.tryAcquire(n)) {
+		select {
+		case l.sendBuf <- item:
+			return
+		default:
+			if l.budget != nil {
+				l.budget.release(n)
+			}
+		}
+	}
+
+	for !s.aborted && s.count > 0 && s.maxBytes > 0 && s.bytes+n > s.maxBytes {
+		s.cond.Wait()
+	}
+	if s.aborted {
+		l.pending.Decr()
+		return
+	}
+	if s.count == 0 {
+		s.since = time.Now()
+		log.Infof("spill the commands into file[%v] since the queue is full", s.name)
+	} else if s.maxAge > 0 && time.Since(s.since) > s.maxAge {
+		log.Panicf("the commands are spilled into file[%v] for more than %v of sender.spill_max_age_sec",
+			s.name, s.maxAge)
+	}
+
+	resp := redis.NewArray()
+	resp.AppendBulkBytes([]byte(item.Cmd))
+	for _, arg := range item.Args {
+		resp.AppendBulkBytes(arg)
+	}
+	resp.AppendBulkBytes([]byte(strconv.FormatInt(item.Offset, 10)))
+	if err := redis.Encode(s.bw, resp, false); err != nil {
+		log.PanicErrorf(err, "write spill file[%v] failed", s.name)
+	}
+	s.count++
+	s.bytes += n
+	s.cond.Broadcast()
+}
+
+// the first command spilled, false once it's closed and drained or aborted
+func (s *spillQueue) next() (cmdDetail, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.count == 0 && !s.closed && !s.aborted {
+		s.cond.Wait()
+	}
+	if s.count == 0 || s.aborted {
+		return cmdDetail{}, false
+	}
+
+	if s.bw.Buffered() > 0 {
+		if err := s.bw.Flush(); err != nil {
+			log.PanicErrorf(err, "write spill file[%v] failed", s.name)
+		}
+	}
+	resp, err := redis.Decode(s.br)
+	if err != nil {
+		log.PanicErrorf(err, "read spill file[%v] failed", s.name)
+	}
+	values, err := redis.AsArray(resp, nil)
+	if err != nil || len(values) < 2 {
+		log.Panicf("parse spill file[%v] failed: %v", s.name, err)
+	}
+	fields := make([][]byte, len(values))
+	for i, v := range values {
+		if fields[i], err = redis.AsBulkBytes(v, nil); err != nil {
+			log.PanicErrorf(err, "parse spill file[%v] failed", s.name)
+		}
+	}
+	offset, err := strconv.ParseInt(string(fields[len(fields)-1]), 10, 64)
+	if err != nil {
+		log.PanicErrorf(err, "parse the offset in spill file[%v] failed", s.name)
+	}
+	return cmdDetail{Cmd: string(fields[0]), Args: fields[1 : len(fields)-1], Offset: offset}, true
+}
+
+// the command got by next is queued in sendBuf, the file is truncated once it's drained
+func (s *spillQueue) sent(item cmdDetail) {
+	s.mu.Lock()
+	s.count--
+	s.bytes -= item.size()
+	if s.count == 0 && !s.aborted {
+		if err := s.w.Truncate(0); err != nil {
+			log.PanicErrorf(err, "truncate spill file[%v] failed", s.name)
+		}
+		if _, err := s.r.Seek(0, 0); err != nil {
+			log.PanicErrorf(err, "seek spill file[%v] failed", s.name)
+		}
+		s.br.Reset(s.r)
+		log.Infof("the commands spilled into file[%v] are drained in %v", s.name, time.Since(s.since))
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// the commands spilled are still queued in sendBuf, then sendBuf is closed
+func (s *spillQueue) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// pushing and queueing don't block any more, the commands spilled are dropped
+func (s *spillQueue) abort() {
+	s.mu.Lock()
+	s.aborted = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// the bytes spilled now
+func (s *spillQueue) queued() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// abort and remove the file
+func (s *spillQueue) remove() {
+	s.abort()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Close()
+	s.r.Close()
+	os.Remove(s.name)
+}
+
+// move the commands spilled into sendBuf in order, sendBuf is closed once the queue is drained
+func (ds *dbSyncer) feedLane(l *targetLane) {
+	for {
+		item, ok := l.spill.next()
+		if !ok {
+			select {
+			case <-l.failed:
+			default:
+				close(l.sendBuf)
+			}
+			return
+		}
+		if l.budget != nil {
+			l.budget.acquire(item.size())
+		}
+		select {
+		case l.sendBuf <- item:
+		case <-l.failed:
+			return
+		}
+		l.spill.sent(item)
+	}
+}
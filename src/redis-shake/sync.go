@@ -6,19 +6,25 @@ package run
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"pkg/libs/atomic2"
+	"pkg/libs/errors"
 	"pkg/libs/io/pipe"
 	"pkg/libs/log"
+	"pkg/rdb"
 	"pkg/redis"
 	"redis-shake/base"
 	"redis-shake/common"
@@ -26,6 +32,8 @@ import (
 	"redis-shake/heartbeat"
 	"redis-shake/metric"
 	"redis-shake/filter"
+
+	redigo "github.com/garyburd/redigo/redis"
 )
 
 type delayNode struct {
@@ -33,15 +41,69 @@ type delayNode struct {
 	id int64     // id
 }
 
+// command sent to the target, kept to be retried on MOVED/ASK, CLUSTERDOWN or LOADING
+type redirectNode struct {
+	id   int64 // id of the command
+	cmd  string
+	args [][]byte
+}
+
+/*
+ * the last command of the batch flushed, all the commands before it on the lane are replied once
+ * its reply comes. The node is dropped if the channel is full, which only delays the offset.
+ */
+type ackNode struct {
+	id     int64 // id of the command
+	offset int64 // source offset of the command
+}
+
+const (
+	ackChannelSize            = 1024
+	targetReconnectMaxBackoff = 10 * time.Second // see target.reconnect_backoff_ms
+	sentinelWatchInterval     = time.Second      // see watchSentinel
+	cutoverCheckInterval      = time.Second      // see cutover
+)
+
+type waitNode struct {
+	id     int64 // id of the WAIT command
+	offset int64 // source offset of the last command sent before WAIT
+}
+
 type syncerStat struct {
 	rbytes, wbytes, nentry, ignore int64
 
 	forward, nbypass int64
 }
 
+// stats of one full sync, see dbSyncer.LastFullSync
+type fullSyncStat struct {
+	StartTime time.Time
+	Duration  time.Duration
+	Bytes     int64 // bytes of the rdb read
+	Entries   int64
+}
+
+// Throughput returns the average MB/s of the full sync.
+func (s *fullSyncStat) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / utils.MB / s.Duration.Seconds()
+}
+
 type cmdDetail struct {
-	Cmd  string
-	Args [][]byte
+	Cmd    string
+	Args   [][]byte
+	Offset int64 // source offset after this command
+}
+
+// the bytes of the command queued in sendBuf
+func (c *cmdDetail) size() int64 {
+	n := len(c.Cmd)
+	for _, arg := range c.Args {
+		n += len(arg)
+	}
+	return int64(n)
 }
 
 func (c *cmdDetail) String() string {
@@ -54,7 +116,88 @@ func (c *cmdDetail) String() string {
 
 // main struct
 type CmdSync struct {
+	mu        sync.Mutex // the syncers are replaced once restarted, see supervise
 	dbSyncers []*dbSyncer
+	syncers   []*Syncer
+	nodeDone  []chan struct{} // closed once the syncer of the node quits without restarting
+	stopped   atomic2.Bool    // set by Drain, the syncers failed aren't restarted then
+	// the keys restored by all the syncers in the rdb phase, see limit.key_count
+	restoreLimiter *utils.RestoreLimiter
+}
+
+// one source -> target link, the syncer of it is restarted by sync.restart_retries
+type syncNode struct {
+	id             int
+	source         string
+	sourcePassword string
+	target         []string
+	targetPassword string
+	job            *conf.Configuration
+	migrations     *slotMigrations
+	owners         *keyOwners
+	limiter        *utils.RestoreLimiter
+}
+
+// Drain stops all the syncers and waits at most timeout for the replies, the number of the
+// commands not replied is returned, see Syncer.Drain.
+func (cmd *CmdSync) Drain(timeout time.Duration) int64 {
+	cmd.stopped.Set(true)
+	var wg sync.WaitGroup
+	var unconfirmed atomic2.Int64
+	for _, syncer := range cmd.syncers {
+		if syncer == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(syncer *Syncer) {
+			defer wg.Done()
+			unconfirmed.Add(syncer.Drain(timeout))
+		}(syncer)
+	}
+	wg.Wait()
+
+	// the summary of the shutdown, the offsets are of the source
+	for _, ds := range cmd.dbSyncers {
+		if ds == nil {
+			continue
+		}
+		runid, _ := ds.runId.Load().(string)
+		log.Infof("dbSyncer[%v] Event:SyncSummary\tId:%s\tSource:%s\tRunId:%s\tApplyOffset:%d\t"+
+			"ConfirmedOffset:%d\tUnconfirmed:%d\tEntry:%d\tForward:%d", ds.id, conf.Options.Id,
+			ds.currentSource(), runid, ds.applyOffset.Get(), ds.confirmedOffset(), ds.unconfirmed(),
+			ds.nentry.Get(), ds.forward.Get())
+	}
+	return unconfirmed.Get()
+}
+
+// Pause all the syncers, the state of each syncer is returned, see Syncer.Pause.
+func (cmd *CmdSync) Pause() interface{} {
+	return cmd.setPaused(true)
+}
+
+// Resume all the syncers paused.
+func (cmd *CmdSync) Resume() interface{} {
+	return cmd.setPaused(false)
+}
+
+func (cmd *CmdSync) setPaused(paused bool) interface{} {
+	ret := make([]map[string]interface{}, 0, len(cmd.syncers))
+	for _, syncer := range cmd.syncers {
+		if syncer == nil {
+			continue
+		}
+		if paused {
+			syncer.Pause()
+		} else {
+			syncer.Resume()
+		}
+		ret = append(ret, map[string]interface{}{
+			"Id":          syncer.ds.id,
+			"Paused":      syncer.ds.paused.Get(),
+			"ApplyOffset": syncer.ds.applyOffset.Get(),
+		})
+	}
+	return ret
 }
 
 // return send buffer length, delay channel length, target db offset
@@ -69,37 +212,79 @@ func (cmd *CmdSync) GetDetailedInfo() interface{} {
 	return ret
 }
 
+// return heartbeat info of all running syncers
+func (cmd *CmdSync) GetHeartbeatInfo() []heartbeat.SyncerData {
+	ret := make([]heartbeat.SyncerData, 0, len(cmd.dbSyncers))
+	for _, syncer := range cmd.dbSyncers {
+		if syncer == nil {
+			continue
+		}
+		ret = append(ret, syncer.GetHeartbeatInfo())
+	}
+	return ret
+}
+
 func (cmd *CmdSync) Main() {
-	type syncNode struct {
-		id             int
-		source         string
-		sourcePassword string
-		target         []string
-		targetPassword string
+	if conf.Options.SyncRestartRetries > 0 {
+		// the syncer failed is restarted alone, see supervise
+		log.SetPanicRecoverable(true)
 	}
+	startTime := time.Now()
 
 	// source redis number
 	total := utils.GetTotalLink()
 	syncChan := make(chan syncNode, total)
 	cmd.dbSyncers = make([]*dbSyncer, total)
-	for i, source := range conf.Options.SourceAddressList {
-		var target []string
-		if conf.Options.TargetType == conf.RedisTypeCluster {
-			target = conf.Options.TargetAddressList
-		} else {
-			// round-robin pick
-			pick := utils.PickTargetRoundRobin(len(conf.Options.TargetAddressList))
-			target = []string{conf.Options.TargetAddressList[pick]}
+	cmd.syncers = make([]*Syncer, total)
+	cmd.nodeDone = make([]chan struct{}, total)
+	for i := range cmd.nodeDone {
+		cmd.nodeDone[i] = make(chan struct{})
+	}
+	// the syncers of each job in sync.jobs are numbered one after another
+	jobs := conf.Options.Jobs
+	if len(jobs) == 0 {
+		jobs = []*conf.Configuration{&conf.Options}
+	}
+	// the limit is on the keys restored by all the syncers
+	cmd.restoreLimiter = utils.NewRestoreLimiter(&conf.Options)
+	i := 0
+	for _, job := range jobs {
+		var migrations *slotMigrations
+		if conf.Options.SourceType == conf.RedisTypeCluster && conf.Options.SourceSlotMigration == conf.SlotMigrationReconcile {
+			// the keys migrate between the shards of the job
+			migrations = newSlotMigrations()
+		}
+		var owners *keyOwners
+		if conf.Options.TargetMergeCollision != "" && len(job.SourceAddressList) > 1 {
+			// the shards of the job are merged into the target
+			owners = newKeyOwners()
+		}
+		for _, source := range job.SourceAddressList {
+			target := pickTarget(job, source)
+			nd := syncNode{
+				id:             i,
+				source:         source,
+				sourcePassword: utils.AddressPassword(job.SourceAddressOptions, source, job.SourcePasswordRaw),
+				target:         target,
+				targetPassword: utils.AddressPassword(job.TargetAddressOptions, target[0], job.TargetPasswordRaw),
+				job:            job,
+				migrations:     migrations,
+				owners:         owners,
+				limiter:        cmd.restoreLimiter,
+			}
+			syncChan <- nd
+			i++
 		}
+	}
 
-		nd := syncNode{
-			id:             i,
-			source:         source,
-			sourcePassword: conf.Options.SourcePasswordRaw,
-			target:         target,
-			targetPassword: conf.Options.TargetPasswordRaw,
+	// start heartbeat, only one for all syncers
+	if len(conf.Options.HeartbeatUrl) > 0 {
+		heartbeatCtl := heartbeat.HeartbeatController{
+			ServerUrl: conf.Options.HeartbeatUrl,
+			Interval:  int32(conf.Options.HeartbeatInterval),
+			Collect:   cmd.GetHeartbeatInfo,
 		}
-		syncChan <- nd
+		go heartbeatCtl.Start()
 	}
 
 	var wg sync.WaitGroup
@@ -113,16 +298,15 @@ func (cmd *CmdSync) Main() {
 					break
 				}
 
-				ds := NewDbSyncer(nd.id, nd.source, nd.sourcePassword, nd.target, nd.targetPassword,
-					conf.Options.HttpProfile+i)
-				cmd.dbSyncers[nd.id] = ds
-				log.Infof("routine[%v] starts syncing data from %v to %v with http[%v]",
-					ds.id, ds.source, ds.target, ds.httpProfilePort)
 				// run in routine
-				go ds.sync()
+				full := make(chan struct{})
+				go func(nd syncNode) {
+					defer close(cmd.nodeDone[nd.id])
+					cmd.supervise(nd, full)
+				}(nd)
 
 				// wait full sync done
-				<-ds.waitFull
+				<-full
 
 				wg.Done()
 			}
@@ -131,23 +315,239 @@ func (cmd *CmdSync) Main() {
 
 	wg.Wait()
 	close(syncChan)
+	cmd.notifyAllFullSyncDone(startTime)
+
+	if conf.Options.LimitStopAfterFull && cmd.restoreLimitHit() {
+		log.Infof("restore limit is hit, quit after the full sync")
+		return
+	}
+	if conf.Options.SyncMode == conf.SyncModeVerify {
+		log.Infof("verify done, quit after the full sync")
+		return
+	}
+	if conf.Options.SyncFullOnly {
+		cmd.waitSyncers()
+		cmd.reportFullSync()
+		log.Infof("sync.full_only is set, quit after the full sync")
+		return
+	}
+
+	if conf.Options.CutoverEnable {
+		cmd.cutover()
+	}
+
+	if conf.Options.Type == conf.TypeReplay {
+		cmd.waitSyncers()
+		cmd.reportFullSync()
+		for _, ds := range cmd.dbSyncers {
+			log.Infof("dbSyncer[%v] Event:ReplayReport\tId:%s\tSource:%s\tForward:%d\tFilter:%d\tOffset:%d",
+				ds.id, conf.Options.Id, ds.source, ds.forward.Get(), ds.nbypass.Get(), ds.applyOffset.Get())
+		}
+		log.Infof("the aof is replayed, quit")
+		return
+	}
+
+	// the increment syncing runs until all the syncers are stopped, e.g., by Drain on the signal
+	cmd.waitSyncers()
+	log.Infof("all the syncers are stopped")
+}
+
+// wait for the syncers to quit without restarting
+func (cmd *CmdSync) waitSyncers() {
+	for _, done := range cmd.nodeDone {
+		<-done
+	}
+}
+
+// all syncers finish the rdb phase
+func (cmd *CmdSync) notifyAllFullSyncDone(startTime time.Time) {
+	event := &utils.FullSyncEvent{
+		Event:     utils.FullSyncEventAllDone,
+		Syncer:    -1,
+		ElapsedMs: int64(time.Since(startTime) / time.Millisecond),
+	}
+	for _, syncer := range cmd.dbSyncers {
+		if syncer == nil {
+			continue
+		}
+		event.Entry += syncer.nentry.Get()
+		event.Ignore += syncer.ignore.Get()
+	}
+	log.Infof("Event:AllFullSyncDone\tId:%s\tentry = %d\tignore = %d\telapsed = %dms", conf.Options.Id,
+		event.Entry, event.Ignore, event.ElapsedMs)
+	utils.NotifyFullSyncEvent(event)
+}
+
+/*
+ * wait until the lag of all the syncers stays within cutover.lag_threshold for cutover.stable_seconds,
+ * then stop pulling the source, drain the commands sent and notify cutover.webhook. The sync fails if
+ * the syncers don't quit with all the commands replied in shutdown.drain_timeout_ms, so the clients
+ * are never told to repoint too early.
+ */
+func (cmd *CmdSync) cutover() {
+	conns := make([]redigo.Conn, len(cmd.dbSyncers))
+	defer func() {
+		for _, c := range conns {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+
+	stable := time.Duration(conf.Options.CutoverStableSeconds) * time.Second
+	var since time.Time // the lag is within the threshold since
+	ticker := time.NewTicker(cutoverCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var lag int64
+		var err error
+		for i, ds := range cmd.dbSyncers {
+			if conns[i] == nil {
+				conns[i] = utils.OpenRedisConnSoft([]string{ds.currentSource()}, conf.Options.SourceAuthType,
+					utils.SourceAuthToken(ds.sourcePassword), time.Second, time.Second, false,
+					ds.sourceTLS())
+				if conns[i] == nil {
+					err = fmt.Errorf("connect source[%v] failed", ds.currentSource())
+					break
+				}
+			}
+			var n int64
+			if n, err = ds.sourceLag(conns[i]); err != nil {
+				// reconnect next time, the source may be switched by the sentinel
+				conns[i].Close()
+				conns[i] = nil
+				break
+			}
+			if n > lag {
+				lag = n
+			}
+		}
+		if err != nil || lag > conf.Options.CutoverLagThreshold {
+			if err != nil {
+				log.Warnf("Event:CutoverLagFail\tId:%s\tError:%v", conf.Options.Id, err)
+			}
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() {
+			since = time.Now()
+			log.Infof("Event:CutoverLagReached\tId:%s\tlag = %d, wait %v before the cutover", conf.Options.Id,
+				lag, stable)
+		}
+		if time.Since(since) >= stable {
+			break
+		}
+	}
+
+	timeout := time.Duration(conf.Options.ShutdownDrainTimeoutMs) * time.Millisecond
+	log.Infof("Event:CutoverStart\tId:%s\tdrain the syncers in %v", conf.Options.Id, timeout)
+	if unconfirmed := cmd.Drain(timeout); unconfirmed != 0 {
+		log.Panicf("Event:CutoverFail\tId:%s\t%d commands aren't replied by the target in %v", conf.Options.Id,
+			unconfirmed, timeout)
+	}
+	// the commands read but not sent yet aren't counted as unconfirmed, so the syncer should quit
+	for _, syncer := range cmd.syncers {
+		if syncer == nil {
+			continue
+		}
+		select {
+		case <-syncer.done:
+		default:
+			log.Panicf("Event:CutoverFail\tId:%s\tsyncer[%v] isn't stopped in %v", conf.Options.Id,
+				syncer.config.Id, timeout)
+		}
+	}
+
+	event := &utils.CutoverEvent{
+		Event: utils.CutoverEventDone,
+		Id:    conf.Options.Id,
+		Ts:    time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	for _, ds := range cmd.dbSyncers {
+		runid, _ := ds.runId.Load().(string)
+		event.Syncers = append(event.Syncers, utils.CutoverSyncer{
+			Syncer: ds.id,
+			Source: ds.currentSource(),
+			RunId:  runid,
+			Offset: ds.confirmedOffset(),
+		})
+	}
+	if conf.Options.CutoverWebhook != "" {
+		if err := utils.SendCutoverWebhook(conf.Options.CutoverWebhook, event); err != nil {
+			log.PanicErrorf(err, "Event:CutoverFail\tId:%s\tsend cutover.webhook[%v] failed", conf.Options.Id,
+				conf.Options.CutoverWebhook)
+		}
+	}
+	log.Infof("Event:CutoverDone\tId:%s\tit's safe to repoint the clients to the target", conf.Options.Id)
+}
+
+/*
+ * the bytes of the source not replied by the target. Once all the commands queued are replied, the
+ * offset parsed is used since the commands filtered out or not sent, e.g., ping, are never acked.
+ */
+func (ds *dbSyncer) sourceLag(c redigo.Conn) (int64, error) {
+	info, err := redigo.Bytes(c.Do("info", "replication"))
+	if err != nil {
+		return 0, fmt.Errorf("info replication of source[%v] failed: %v", ds.currentSource(), err)
+	}
+	value := utils.ParseRedisInfo(info)["master_repl_offset"]
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid master_repl_offset[%v] of source[%v]", value, ds.currentSource())
+	}
+	confirmed := ds.confirmedOffset()
+	if ds.unconfirmed() == 0 {
+		confirmed = ds.applyOffset.Get()
+	}
+	return offset - confirmed, nil
+}
+
+// whether the restore limit is hit by the syncers
+func (cmd *CmdSync) restoreLimitHit() bool {
+	return cmd.restoreLimiter.Hit()
+}
 
-	// never quit because increment syncing is still running
-	select {}
+// the final report of each syncer in sync.full_only
+func (cmd *CmdSync) reportFullSync() {
+	for _, ds := range cmd.dbSyncers {
+		if ds == nil {
+			continue
+		}
+		var bytes int64
+		var elapsed time.Duration
+		if s := ds.LastFullSync(); s != nil {
+			bytes, elapsed = s.Bytes, s.Duration
+		}
+		log.Infof("dbSyncer[%v] Event:FullSyncReport\tId:%s\tSource:%s\tEntry:%d\tIgnore:%d\tTooLarge:%d\t"+
+			"ResumeSkipped:%d\tBytes:%d\tElapsed:%dms", ds.id, conf.Options.Id, ds.source, ds.nentry.Get(),
+			ds.ignore.Get(), ds.tooLarge.Get(), ds.resumeSkipped.Get(), bytes, int64(elapsed/time.Millisecond))
+	}
 }
 
 /*------------------------------------------------------*/
-// one sync link corresponding to one dbSyncer
-func NewDbSyncer(id int, source, sourcePassword string, target []string, targetPassword string, httpPort int) *dbSyncer {
+// one sync link corresponding to one dbSyncer, nil options means conf.Options
+func NewDbSyncer(id int, source, sourcePassword string, target []string, targetPassword string, httpPort int,
+	options *conf.Configuration) *dbSyncer {
 	ds := &dbSyncer{
 		id:              id,
 		source:          source,
 		sourcePassword:  sourcePassword,
 		target:          target,
 		targetPassword:  targetPassword,
+		options:         options,
 		httpProfilePort: httpPort,
 		waitFull:        make(chan struct{}),
+		ctx:             context.Background(),
+		events:          make(chan Event, eventChanSize),
+		failed:          make(chan struct{}),
 	}
+	if ds.opts().FilterLogDropped {
+		ds.audit = utils.NewDropAudit(fmt.Sprintf("dbSyncer[%v]", id), ds.opts().FilterLogDroppedFile,
+			int(ds.opts().FilterLogDroppedRate))
+	}
+	ds.reconnect = utils.NewReconnectDetector(int(ds.opts().SourceReconnectLimit),
+		time.Duration(ds.opts().SourceReconnectWindow)*time.Second)
+	ds.restoreLimiter = utils.NewRestoreLimiter(ds.opts())
 
 	// add metric
 	metric.AddMetric(id)
@@ -163,33 +563,172 @@ type dbSyncer struct {
 	target         []string // target address
 	targetPassword string   // target password
 
+	// the options of the syncer given by SyncerConfig.Options, nil means conf.Options, see opts.
+	options *conf.Configuration
+	// the options of the job in sync.jobs, only the options given by the job file are read from it.
+	// nil means the options of the syncer, see jobOptions.
+	job *conf.Configuration
+
 	httpProfilePort int // http profile port
 
 	// metric info
 	rbytes, wbytes, nentry, ignore atomic2.Int64
 	forward, nbypass               atomic2.Int64
 	targetOffset                   atomic2.Int64
-	sourceOffset                   int64
-
-	/*
-	 * this channel is used to calculate delay between redis-shake and target redis.
-	 * Once oplog sent, the corresponding delayNode push back into this queue. Next time
-	 * receive reply from target redis, the front node poped and then delay calculated.
-	 */
-	delayChannel chan *delayNode
-
-	sendBuf  chan cmdDetail // sending queue
-	waitFull chan struct{}  // wait full sync done
+	sourceOffset                   atomic2.Int64
+	applyOffset                    atomic2.Int64    // source offset of the commands parsed in increment sync
+	checkpointOffset               atomic2.Int64    // source offset confirmed by WAIT on the target or by draining
+	verified                       [4]atomic2.Int64 // keys of each result in sync.mode = verify, see utils.VerifyMatch
+	pipelineRetried                atomic2.Int64    // entries failed in restore.pipeline_count batches and restored alone
+	inflightThrottled              atomic2.Int64    // times reading source is slowed down by source.max_inflight_bytes
+	tooLarge                       atomic2.Int64    // keys skipped by filter.max_value_bytes
+	resumeSkipped                  atomic2.Int64    // keys skipped by fullsync.resumable since they are on the target
+
+	slotRestored [utils.SlotRangeCount]atomic2.Int64 // keys restored in each slot range, see utils.SlotRangeSize
+
+	// the parts of the split hashes compared in sync.mode = verify, see mergeSplitVerify
+	verifyMu    sync.Mutex
+	verifySplit map[string]*splitVerify
+	lastFullSync atomic.Value                        // *fullSyncStat of the last full sync finished
+	runId        atomic.Value                        // runid of the source to continue from, "" in the full sync again
+	runId2       atomic.Value                        // the runid before the source failed over, see pSyncReconnect
+	runId2Offset atomic2.Int64                       // the offset till which runId2 can continue
+	master       atomic.Value                        // the source switched to through the sentinel, see currentSource
+
+	audit     *utils.DropAudit         // keys dropped by the filters, nil if filter.log_dropped is disabled
+	reconnect *utils.ReconnectDetector // reconnects of the source in the increment, see source.reconnect_limit
+
+	waitChannel chan *waitNode // WAIT commands sent but not replied
+	waitPending atomic2.Int64  // WAIT commands in flight
+	waitPaused  atomic2.Bool   // pause sending because WAIT timeout
+	paused      atomic2.Bool   // pause sending by Syncer.Pause, e.g., /pause of the http api
+	qos         chan struct{}  // tokens of qps given in the address of the source, nil means no limit
+
+	// the bytes read from the source and written to the target, nil means no limit, see transfer.max_mbps
+	sourceLimiter *utils.ByteLimiter
+	targetLimiter *utils.ByteLimiter
+	// the keys restored in the rdb phase, see limit.key_count. shared by all the syncers of sync
+	restoreLimiter *utils.RestoreLimiter
+
+	targetReconnects atomic2.Int64 // the broken target connections reopened, see target.reconnect_retries
+
+	migrations       *slotMigrations // shared by the shards of the source cluster, nil if not reconciled
+	migratingSlots   atomic2.Int64   // slots migrating on the source now, see watchSlotMigration
+	migrationDropped atomic2.Int64   // keys of DEL dropped since they're migrated into another shard
+	splitCommands    atomic2.Int64   // commands split by slot for the cluster target
+
+	owners     *keyOwners    // shared by the shards merged into the target, nil if not detected
+	collisions atomic2.Int64 // keys restored by another shard as well, see target.merge_collision
+
+	proxyDropped utils.CommandCounts // commands dropped since the proxy target doesn't support them
+
+	lanes    atomic.Value  // []*targetLane, connections to the target in the increment sync, see targetLanes
+	waitFull chan struct{} // wait full sync done
+
+	startTime time.Time // sync start time
+
+	ctx      context.Context // stop the sync once done
+	stopping atomic2.Bool    // set once ctx is done and the rdb phase finishes
+	routines sync.WaitGroup  // the routines started by spawn, waited by run
+
+	failed   chan struct{} // closed once the syncer fails, see recoverFatal
+	fatal    *log.Fatal
+	failOnce sync.Once
+	mu       sync.Mutex
+	input    io.Closer // the source stream closed once the syncer fails
+
+	events        chan Event    // see Syncer.Events
+	eventsDropped atomic2.Int64 // events dropped because the channel is full
 }
 
 func (ds *dbSyncer) GetExtraInfo() map[string]interface{} {
-	return map[string]interface{}{
-		"SourceAddress":      ds.source,
+	var senderBufCount, processingCmdCount, breakerTrips int
+	var senderBufBytes, senderSpillBytes int64
+	breakerState := "disabled"
+	for i, l := range ds.targetLanes() {
+		senderBufCount += len(l.sendBuf)
+		senderSpillBytes += l.spill.queued()
+		if i == 0 {
+			// shared by all the lanes
+			senderBufBytes = l.budget.queued()
+		}
+		processingCmdCount += len(l.delayChannel)
+		if l.breaker != nil {
+			if breakerState != utils.BreakerOpen {
+				breakerState = l.breaker.State()
+			}
+			breakerTrips += l.breaker.Trips()
+		}
+	}
+	info := map[string]interface{}{
+		"Job":                ds.jobOptions().JobName,
+		"SourceAddress":      ds.currentSource(),
 		"TargetAddress":      ds.target,
-		"SenderBufCount":     len(ds.sendBuf),
-		"ProcessingCmdCount": len(ds.delayChannel),
+		"SenderBufCount":     senderBufCount,
+		"SenderBufBytes":     senderBufBytes,
+		"SenderSpillBytes":   senderSpillBytes,
+		"MigratingSlots":     ds.migratingSlots.Get(),
+		"MigrationDropped":   ds.migrationDropped.Get(),
+		"SplitCommands":      ds.splitCommands.Get(),
+		"MergeCollisions":    ds.collisions.Get(),
+		"ProxyDropped":       ds.proxyDropped.Counts(),
+		"ProcessingCmdCount": processingCmdCount,
 		"TargetDBOffset":     ds.targetOffset.Get(),
-		"SourceDBOffset":     ds.sourceOffset,
+		"SourceDBOffset":     ds.sourceOffset.Get(),
+		"CheckpointOffset":   ds.checkpointOffset.Get(),
+		"InflightThrottled":  ds.inflightThrottled.Get(),
+		"ResumeSkipped":      ds.resumeSkipped.Get(),
+		"BreakerState":       breakerState,
+		"BreakerTrips":       breakerTrips,
+		"Paused":             ds.paused.Get(),
+		"TargetReconnects":   ds.targetReconnects.Get(),
+	}
+	if ds.reconnect != nil {
+		info["ReconnectCount"] = ds.reconnect.Count()
+		info["LastProgressTime"] = ds.reconnect.LastProgress().Format(utils.GolangSecurityTime)
+	}
+	if s := ds.LastFullSync(); s != nil {
+		info["LastFullSync"] = map[string]interface{}{
+			"StartTime":      s.StartTime.Format(utils.GolangSecurityTime),
+			"DurationSec":    s.Duration.Seconds(),
+			"Bytes":          s.Bytes,
+			"Entries":        s.Entries,
+			"ThroughputMBps": s.Throughput(),
+		}
+	}
+	if ds.opts().TargetType == conf.RedisTypeCluster {
+		slotRestored := make(map[string]int64, len(ds.slotRestored))
+		for i := range ds.slotRestored {
+			slotRestored[utils.SlotRangeName(i)] = ds.slotRestored[i].Get()
+		}
+		info["SlotRangeRestored"] = slotRestored
+	}
+	if ds.opts().SyncMode == conf.SyncModeVerify {
+		info["VerifyMatch"] = ds.verified[utils.VerifyMatch].Get()
+		info["VerifyMismatch"] = ds.verified[utils.VerifyMismatch].Get()
+		info["VerifyMissing"] = ds.verified[utils.VerifyMissing].Get()
+		info["VerifySkip"] = ds.verified[utils.VerifySkip].Get()
+	}
+	return info
+}
+
+// heartbeat info of this syncer
+func (ds *dbSyncer) GetHeartbeatInfo() heartbeat.SyncerData {
+	sourceOffset := ds.sourceOffset.Get()
+	targetOffset := ds.targetOffset.Get()
+	var lag int64
+	if sourceOffset > 0 && targetOffset > sourceOffset {
+		lag = targetOffset - sourceOffset
+	}
+	return heartbeat.SyncerData{
+		Id:           ds.id,
+		Source:       ds.source,
+		Target:       ds.target,
+		SourceOffset: sourceOffset,
+		TargetOffset: targetOffset,
+		Lag:          lag,
+		Forward:      ds.forward.Get(),
+		Bypass:       ds.nbypass.Get(),
 	}
 }
 
@@ -207,66 +746,193 @@ func (ds *dbSyncer) Stat() *syncerStat {
 
 func (ds *dbSyncer) sync() {
 	var sockfile *os.File
-	if len(conf.Options.SockFileName) != 0 {
-		sockfile = utils.OpenReadWriteFile(conf.Options.SockFileName)
+	if len(ds.opts().SockFileName) != 0 {
+		sockfile = utils.OpenReadWriteFile(ds.opts().SockFileName)
 		defer sockfile.Close()
 	}
+	if ds.audit != nil {
+		defer ds.audit.Close()
+	}
 
-	base.Status = "waitfull"
-	var input io.ReadCloser
-	var nsize int64
-	if conf.Options.Psync {
-		input, nsize = ds.sendPSyncCmd(ds.source, conf.Options.SourceAuthType, ds.sourcePassword, conf.Options.SourceTLSEnable)
-	} else {
-		input, nsize = ds.sendSyncCmd(ds.source, conf.Options.SourceAuthType, ds.sourcePassword, conf.Options.SourceTLSEnable)
+	if qps := ds.jobOptions().SourceAddressOptions[ds.source].Qps; qps > 0 && ds.qos == nil {
+		log.Infof("dbSyncer[%v] limit the keys restored and the commands sent to %v per second", ds.id, qps)
+		ds.qos = utils.StartQoS(qps)
 	}
+	if mbps := ds.jobOptions().TransferMaxMbps; mbps > 0 && ds.sourceLimiter == nil {
+		log.Infof("dbSyncer[%v] limit the bytes read from the source and written to the target to %vMbps",
+			ds.id, mbps)
+		ds.sourceLimiter = utils.NewByteLimiter(utils.MbpsToBytes(mbps))
+		ds.targetLimiter = utils.NewByteLimiter(utils.MbpsToBytes(mbps))
+	}
+
+	ds.startTime = time.Now()
+	base.SetStatus("waitfull")
+	input, nsize, full := ds.openSource()
 	defer input.Close()
+	ds.setInput(input)
+
+	source := input
+	ds.spawn(func() {
+		<-ds.ctx.Done()
+		// the rdb phase can't be interrupted
+		select {
+		case <-ds.waitFull:
+		case <-ds.failed:
+			return
+		}
+		log.Infof("dbSyncer[%v] stop syncing", ds.id)
+		ds.stopping.Set(true)
+		// all the routines reading the source quit on the error
+		source.Close()
+	})
+	ds.spawn(ds.watchSlotMigration)
 
 	log.Infof("dbSyncer[%v] rdb file size = %d\n", ds.id, nsize)
 
 	if sockfile != nil {
-		r, w := pipe.NewFilePipe(int(conf.Options.SockFileSize), sockfile)
+		r, w := pipe.NewFilePipe(int(ds.opts().SockFileSize), sockfile)
 		defer r.Close()
-		go func(r io.Reader) {
+		ds.spawn(func() {
 			defer w.Close()
+			// the sock file stores the compressed data if sock.compress is given
+			cw := utils.NewCompressWriter(w, ds.opts().SockCompress)
+			defer cw.Close()
 			p := make([]byte, utils.ReaderBufferSize)
-			for {
-				utils.Iocopy(r, w, p, len(p))
+			if _, err := io.CopyBuffer(cw, source, p); !ds.stopping.Get() {
+				log.PanicErrorf(err, "dbSyncer[%v] copy into sock file failed", ds.id)
 			}
-		}(input)
-		input = r
-	}
-
-	// start heartbeat
-	if len(conf.Options.HeartbeatUrl) > 0 {
-		heartbeatCtl := heartbeat.HeartbeatController{
-			ServerUrl: conf.Options.HeartbeatUrl,
-			Interval:  int32(conf.Options.HeartbeatInterval),
-		}
-		go heartbeatCtl.Start()
+		})
+		input = ioutil.NopCloser(utils.NewDecompressReader(r, ds.opts().SockCompress))
 	}
 
 	reader := bufio.NewReaderSize(input, utils.ReaderBufferSize)
 
 	// sync rdb
-	base.Status = "full"
-	ds.syncRDBFile(reader, ds.target, conf.Options.TargetAuthType, ds.targetPassword, nsize, conf.Options.TargetTLSEnable)
+	if full {
+		base.SetStatus("full")
+		ds.emit(EventFullSyncStarted, "rdb size = %d", nsize)
+		ds.syncRDBFile(reader, ds.target, ds.opts().TargetAuthType, ds.targetPassword, nsize, ds.targetTLS())
+		// the rdb is cut short once the syncer fails
+		ds.checkFailed()
+		ds.emit(EventFullSyncDone, "entry = %d, ignore = %d", ds.nentry.Get(), ds.ignore.Get())
+	} else {
+		log.Infof("dbSyncer[%v] skip full sync", ds.id)
+	}
 
-	// sync increment
-	base.Status = "incr"
 	close(ds.waitFull)
-	ds.syncCommand(reader, ds.target, conf.Options.TargetAuthType, ds.targetPassword, conf.Options.TargetTLSEnable)
+	utils.NotifyFullSyncEvent(&utils.FullSyncEvent{
+		Event:     utils.FullSyncEventSyncerDone,
+		Syncer:    ds.id,
+		Source:    ds.source,
+		Entry:     ds.nentry.Get(),
+		Ignore:    ds.ignore.Get(),
+		ElapsedMs: int64(time.Since(ds.startTime) / time.Millisecond),
+	})
+
+	if ds.opts().LimitStopAfterFull && ds.restoreLimiter.Hit() {
+		log.Infof("dbSyncer[%v] restore limit is hit, skip the increment sync", ds.id)
+		return
+	}
+	if ds.opts().SyncMode == conf.SyncModeVerify {
+		log.Infof("dbSyncer[%v] Event:VerifyDone\tId:%s\tmatch = %d\tmismatch = %d\tmissing = %d\tskip = %d",
+			ds.id, ds.opts().Id, ds.verified[utils.VerifyMatch].Get(), ds.verified[utils.VerifyMismatch].Get(),
+			ds.verified[utils.VerifyMissing].Get(), ds.verified[utils.VerifySkip].Get())
+		return
+	}
+	if ds.opts().SyncFullOnly {
+		log.Infof("dbSyncer[%v] sync.full_only is set, skip the increment sync", ds.id)
+		// the source is closed on return, the routines reading it quit without error
+		ds.stopping.Set(true)
+		return
+	}
+
+	// sync increment
+	base.SetStatus("incr")
+	ds.emit(EventIncrSyncStarted, "offset = %d", ds.targetOffset.Get())
+	ds.syncCommand(reader, ds.target, ds.opts().TargetAuthType, ds.targetPassword, ds.targetTLS())
+}
+
+/*
+ * open the source stream, full is false if the rdb phase is skipped by sync.skip_full or sync.incr_only.
+ * The rdb file and the aof tailed are read instead of the source if source.aof_file is given.
+ */
+func (ds *dbSyncer) openSource() (input io.ReadCloser, nsize int64, full bool) {
+	if ds.opts().SourceAofFile != "" {
+		var err error
+		// the type replay quits at the end of the aof
+		follow := ds.opts().Type != conf.TypeReplay
+		if input, nsize, err = utils.OpenAofSource(ds.opts().SourceRdbFile, ds.opts().SourceAofFile,
+			follow); err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] open rdb file[%v] and aof file[%v] failed", ds.id,
+				ds.opts().SourceRdbFile, ds.opts().SourceAofFile)
+		}
+		return input, nsize, true
+	}
+	ds.checkReplicaSource()
+	if ds.opts().SyncSkipFull {
+		var ok bool
+		if input, ok = ds.sendPSyncContinueCmd(ds.currentSource(), ds.opts().SourceAuthType, ds.sourcePassword,
+			ds.sourceTLS(), ds.opts().SyncSkipFullRunId, ds.opts().SyncSkipFullOffset); ok {
+			return input, 0, false
+		}
+		if ds.opts().SyncSkipFullFallback != conf.SkipFullFallbackFullsync {
+			log.Panicf("dbSyncer[%v] source can't continue from runid[%v] offset[%v], set sync.skip_full.fallback "+
+				"to %v if full sync is acceptable", ds.id, ds.opts().SyncSkipFullRunId,
+				ds.opts().SyncSkipFullOffset, conf.SkipFullFallbackFullsync)
+		}
+		log.Warnf("dbSyncer[%v] source can't continue from runid[%v] offset[%v], fallback to full sync",
+			ds.id, ds.opts().SyncSkipFullRunId, ds.opts().SyncSkipFullOffset)
+	} else if cp := ds.loadCheckpoint(); cp != nil {
+		var ok bool
+		if input, ok = ds.sendPSyncContinueCmd(ds.currentSource(), ds.opts().SourceAuthType, ds.sourcePassword,
+			ds.sourceTLS(), cp.RunId, cp.Offset); ok {
+			return input, 0, false
+		}
+		log.Warnf("dbSyncer[%v] source can't continue from the checkpoint runid[%v] offset[%v], full sync",
+			ds.id, cp.RunId, cp.Offset)
+	}
+
+	if ds.opts().Psync {
+		input, nsize = ds.sendPSyncCmd(ds.currentSource(), ds.opts().SourceAuthType, ds.sourcePassword, ds.sourceTLS())
+		if ds.opts().SyncIncrOnly {
+			return input, 0, false
+		}
+	} else {
+		input, nsize = ds.sendSyncCmd(ds.currentSource(), ds.opts().SourceAuthType, ds.sourcePassword, ds.sourceTLS())
+	}
+	return input, nsize, true
 }
 
-func (ds *dbSyncer) sendSyncCmd(master, auth_type, passwd string, tlsEnable bool) (net.Conn, int64) {
-	c, wait := utils.OpenSyncConn(master, auth_type, passwd, tlsEnable)
+func (ds *dbSyncer) sendSyncCmd(master, auth_type, passwd string, tlsConfig *tls.Config) (io.ReadCloser, int64) {
+	passwd = utils.SourceAuthToken(passwd)
+	c, wait := utils.OpenSyncConn(master, auth_type, passwd, tlsConfig)
+	c = utils.LimitReadConn(c, ds.sourceLimiter)
 	for {
 		select {
-		case nsize := <-wait:
-			if nsize == 0 {
+		case size := <-wait:
+			size.CheckFatal()
+			if size.Size == 0 {
 				log.Infof("dbSyncer[%v] + waiting source rdb", ds.id)
+			} else if size.EOFMark == nil {
+				return c, size.Size
 			} else {
-				return c, nsize
+				// diskless, strip the eof mark so that the increment commands follow the rdb
+				piper, pipew := pipe.NewSize(utils.ReaderBufferSize)
+				ds.spawn(func() {
+					defer c.Close()
+					defer pipew.Close()
+					rdbSize, rest := utils.CopyRdbUntilEOFMark(c, pipew, size.EOFMark, nil)
+					log.Infof("dbSyncer[%v] diskless rdb file size = %d", ds.id, rdbSize)
+					// the increment read together with the end of the rdb
+					if _, err := pipew.Write(rest); err != nil {
+						log.PanicErrorf(err, "dbSyncer[%v] write increment failed", ds.id)
+					}
+					p := make([]byte, 8192)
+					if _, err := io.CopyBuffer(pipew, c, p); !ds.stopping.Get() {
+						log.PanicErrorf(err, "dbSyncer[%v] read from source failed", ds.id)
+					}
+				})
+				return piper, size.Size
 			}
 		case <-time.After(time.Second):
 			log.Infof("dbSyncer[%v] - waiting source rdb", ds.id)
@@ -274,12 +940,26 @@ func (ds *dbSyncer) sendSyncCmd(master, auth_type, passwd string, tlsEnable bool
 	}
 }
 
-func (ds *dbSyncer) sendPSyncCmd(master, auth_type, passwd string, tlsEnable bool) (pipe.Reader, int64) {
-	c := utils.OpenNetConn(master, auth_type, passwd, tlsEnable)
+/*
+ * the listening port reported to the source by REPLCONF, the port plus the id is different for
+ * each syncer so that the fake slave can be told apart in INFO replication of the source.
+ */
+func (ds *dbSyncer) listeningPort() int {
+	port := ds.opts().SourceReplicaPort
+	if port == 0 {
+		port = ds.opts().HttpProfile
+	}
+	return port + ds.id
+}
+
+func (ds *dbSyncer) sendPSyncCmd(master, auth_type, passwd string, tlsConfig *tls.Config) (pipe.Reader, int64) {
+	passwd = utils.SourceAuthToken(passwd)
+	c := utils.LimitReadConn(utils.WithTimeout(utils.OpenNetConn(master, auth_type, passwd, tlsConfig),
+		ds.sourceTimeout(), ds.sourceTimeout()), ds.sourceLimiter)
 	log.Infof("dbSyncer[%v] psync connect '%v' with auth type[%v] OK!", ds.id, master, auth_type)
 
-	utils.SendPSyncListeningPort(c, conf.Options.HttpProfile)
-	log.Infof("dbSyncer[%v] psync send listening port[%v] OK!", ds.id, conf.Options.HttpProfile)
+	utils.SendPSyncListeningPort(c, ds.listeningPort())
+	log.Infof("dbSyncer[%v] psync send listening port[%v] OK!", ds.id, ds.listeningPort())
 
 	// reader buffer bind to client
 	br := bufio.NewReaderSize(c, utils.ReaderBufferSize)
@@ -290,39 +970,162 @@ func (ds *dbSyncer) sendPSyncCmd(master, auth_type, passwd string, tlsEnable boo
 	// send psync command and decode the result
 	runid, offset, wait := utils.SendPSyncFullsync(br, bw)
 	ds.targetOffset.Set(offset)
+	ds.applyOffset.Set(offset)
+	// the target is overwritten by the rdb, the checkpoint before is meaningless
+	ds.removeCheckpoint()
+	ds.runId.Store(runid)
 	log.Infof("dbSyncer[%v] psync runid = %s offset = %d, fullsync", ds.id, runid, offset)
+	ds.emit(EventSourceConnected, "runid = %s, offset = %d", runid, offset)
+
+	size := ds.waitPSyncRdb(wait)
+	nsize := size.Size
+
+	// write -> pipew -> piper -> read
+	piper, pipew := pipe.NewSize(utils.ReaderBufferSize)
+	var rdbw io.Writer = pipew
+	if ds.opts().SyncIncrOnly {
+		log.Infof("dbSyncer[%v] discard the rdb of size %d, only the increment is synced", ds.id, nsize)
+		rdbw = ioutil.Discard
+	}
+
+	ds.spawn(func() {
+		defer pipew.Close()
+		offset += ds.copyPSyncRdb(br, rdbw, pipew, size)
+
+		ds.pSyncIncr(c, br, bw, pipew, master, auth_type, passwd, tlsConfig, runid, offset)
+	})
+	return piper, nsize
+}
 
-	// get rdb file size
-	var nsize int64
-	for nsize == 0 {
+// get rdb file size
+func (ds *dbSyncer) waitPSyncRdb(wait <-chan utils.RdbSize) utils.RdbSize {
+	var size utils.RdbSize
+	for size.Size == 0 {
 		select {
-		case nsize = <-wait:
-			if nsize == 0 {
+		case size = <-wait:
+			size.CheckFatal()
+			if size.Size == 0 {
 				log.Infof("dbSyncer[%v] +", ds.id)
 			}
 		case <-time.After(time.Second):
 			log.Infof("dbSyncer[%v] -", ds.id)
 		}
 	}
+	return size
+}
 
-	// write -> pipew -> piper -> read
-	piper, pipew := pipe.NewSize(utils.ReaderBufferSize)
+/*
+ * copy the rdb from br to rdbw. In diskless mode, the increment read together with the end of
+ * the rdb is written into incrw and its size is returned.
+ */
+func (ds *dbSyncer) copyPSyncRdb(br *bufio.Reader, rdbw, incrw io.Writer, size utils.RdbSize) int64 {
+	// keep the rdb in the spool until it's validated by source.rdb_checksum
+	var spool *utils.RdbSpool
+	dst := rdbw
+	if ds.opts().SourceRdbChecksum {
+		var err error
+		if spool, err = utils.NewRdbSpool(); err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] create rdb spool failed", ds.id)
+		}
+		defer spool.Close()
+		dst = spool
+	}
+	flush := func() {
+		if spool == nil {
+			return
+		}
+		if err := spool.Verify(size.Size); err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] Event:RdbChecksumFail\tId:%s\tvalidate rdb failed", ds.id,
+				ds.opts().Id)
+		}
+		log.Infof("dbSyncer[%v] rdb checksum is validated", ds.id)
+		if _, err := spool.WriteTo(rdbw); err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] write rdb failed", ds.id)
+		}
+	}
 
-	go func() {
-		defer pipew.Close()
-		p := make([]byte, 8192)
-		// read rdb in for loop
-		for rdbsize := int(nsize); rdbsize != 0; {
-			// br -> pipew
-			rdbsize -= utils.Iocopy(br, pipew, p, rdbsize)
+	if size.EOFMark != nil {
+		// diskless, read until the eof mark. the data following the mark is increment
+		rdbSize, rest := utils.CopyRdbUntilEOFMark(br, dst, size.EOFMark, nil)
+		log.Infof("dbSyncer[%v] diskless rdb file size = %d", ds.id, rdbSize)
+		flush()
+		if len(rest) > 0 {
+			if _, err := incrw.Write(rest); err != nil {
+				log.PanicErrorf(err, "dbSyncer[%v] write increment failed", ds.id)
+			}
 		}
+		return int64(len(rest))
+	}
 
-		for {
+	// read rdb in for loop
+	p := make([]byte, 8192)
+	for rdbsize := int(size.Size); rdbsize != 0; {
+		// br -> rdbw
+		rdbsize -= utils.Iocopy(br, dst, p, rdbsize)
+	}
+	flush()
+	return 0
+}
+
+// try to continue from the given runid and offset directly without full sync, false is returned
+// if the source can't continue.
+func (ds *dbSyncer) sendPSyncContinueCmd(master, auth_type, passwd string, tlsConfig *tls.Config, runid string,
+	offset int64) (pipe.Reader, bool) {
+	passwd = utils.SourceAuthToken(passwd)
+	c := utils.LimitReadConn(utils.WithTimeout(utils.OpenNetConn(master, auth_type, passwd, tlsConfig),
+		ds.sourceTimeout(), ds.sourceTimeout()), ds.sourceLimiter)
+	log.Infof("dbSyncer[%v] psync connect '%v' with auth type[%v] OK!", ds.id, master, auth_type)
+
+	utils.SendPSyncListeningPort(c, ds.listeningPort())
+	log.Infof("dbSyncer[%v] psync send listening port[%v] OK!", ds.id, ds.listeningPort())
+
+	br := bufio.NewReaderSize(c, utils.ReaderBufferSize)
+	bw := bufio.NewWriterSize(c, utils.WriterBufferSize)
+
+	log.Infof("dbSyncer[%v] try to send 'psync' command, runid = %s offset = %d", ds.id, runid, offset)
+	ok, reply := utils.TryPSyncContinue(br, bw, runid, offset)
+	if !ok {
+		log.Errorf("dbSyncer[%v] Event:SkipFullFail\tId:%s\trunid = %s offset = %d\tReply:%s",
+			ds.id, ds.opts().Id, runid, offset, reply)
+		c.Close()
+		return nil, false
+	}
+	if newRunid := utils.PSyncContinueRunId(reply); newRunid != "" && newRunid != runid {
+		ds.switchRunId(runid, offset)
+		runid = newRunid
+	}
+	ds.targetOffset.Set(offset)
+	ds.applyOffset.Set(offset)
+	ds.runId.Store(runid)
+	log.Infof("dbSyncer[%v] psync runid = %s offset = %d, continue", ds.id, runid, offset)
+
+	piper, pipew := pipe.NewSize(utils.ReaderBufferSize)
+	ds.spawn(func() {
+		defer pipew.Close()
+		ds.pSyncIncr(c, br, bw, pipew, master, auth_type, passwd, tlsConfig, runid, offset)
+	})
+	return piper, true
+}
+
+// read the increment from source and reconnect with psync continue once the connection is broken.
+func (ds *dbSyncer) pSyncIncr(c net.Conn, br *bufio.Reader, bw *bufio.Writer, pipew io.Writer, master, auth_type,
+	passwd string, tlsConfig *tls.Config, runid string, offset int64) {
+	slot := ds.shardSlot(master)
+	for continued := true; ; {
+		if continued {
 			/*
 			 * read from br(source redis) and write into pipew.
 			 * Generally speaking, this function is forever run.
 			 */
+			stopWatch := ds.watchSentinel(c, master)
+			stopCluster := ds.watchClusterMaster(c, master, slot)
 			n, err := ds.pSyncPipeCopy(c, br, bw, offset, pipew)
+			close(stopWatch)
+			close(stopCluster)
+			if ds.stopping.Get() {
+				log.Infof("dbSyncer[%v] psync runid = %s, offset = %d, stopped", ds.id, runid, offset+n)
+				return
+			}
 			if err != nil {
 				log.PanicErrorf(err, "dbSyncer[%v] psync runid = %s, offset = %d, pipe is broken",
 					ds.id, runid, offset)
@@ -331,58 +1134,337 @@ func (ds *dbSyncer) sendPSyncCmd(master, auth_type, passwd string, tlsEnable boo
 
 			offset += n
 			ds.targetOffset.Set(offset)
+			if err := ds.checkReconnectLoop(); err != nil {
+				log.PanicErrorf(err, "dbSyncer[%v] Event:ReconnectLoop\tId:%s\toffset = %d", ds.id, ds.opts().Id,
+					offset)
+			}
+		}
 
-			// reopen 'c' every time
-			for {
-				// ds.SyncStat.SetStatus("reopen")
-				base.Status = "reopen"
-				time.Sleep(time.Second)
-				c = utils.OpenNetConnSoft(master, auth_type, passwd, tlsEnable)
-				if c != nil {
-					// log.PurePrintf("%s\n", NewLogItem("SourceConnReopenSuccess", "INFO", LogDetail{Info: strconv.FormatInt(offset, 10)}))
-					log.Infof("dbSyncer[%v] Event:SourceConnReopenSuccess\tId: %s\toffset = %d",
-						ds.id, conf.Options.Id, offset)
-					// ds.SyncStat.SetStatus("incr")
-					base.Status = "incr"
-					break
-				} else {
-					// log.PurePrintf("%s\n", NewLogItem("SourceConnReopenFail", "WARN", NewErrorLogDetail("", "")))
-					log.Errorf("dbSyncer[%v] Event:SourceConnReopenFail\tId: %s", ds.id, conf.Options.Id)
-				}
+		// reopen 'c' every time
+		for {
+			// ds.SyncStat.SetStatus("reopen")
+			base.SetStatus("reopen")
+			time.Sleep(time.Second)
+			if ds.stopping.Get() {
+				return
+			}
+			// fetch the token again in case it's expired
+			passwd = utils.SourceAuthToken(passwd)
+			master = ds.resolveSentinel(master)
+			master = ds.resolveClusterMaster(master, slot)
+			c = utils.OpenNetConnSoft(master, auth_type, passwd, tlsConfig)
+			if c != nil {
+				c = utils.LimitReadConn(utils.WithTimeout(c, ds.sourceTimeout(), ds.sourceTimeout()), ds.sourceLimiter)
+				// log.PurePrintf("%s\n", NewLogItem("SourceConnReopenSuccess", "INFO", LogDetail{Info: strconv.FormatInt(offset, 10)}))
+				log.Infof("dbSyncer[%v] Event:SourceConnReopenSuccess\tId: %s\toffset = %d",
+					ds.id, ds.opts().Id, offset)
+				ds.emit(EventSourceReconnect, "offset = %d", offset)
+				// ds.SyncStat.SetStatus("incr")
+				base.SetStatus("incr")
+				break
+			} else {
+				// log.PurePrintf("%s\n", NewLogItem("SourceConnReopenFail", "WARN", NewErrorLogDetail("", "")))
+				log.Errorf("dbSyncer[%v] Event:SourceConnReopenFail\tId: %s", ds.id, ds.opts().Id)
 			}
-			utils.AuthPassword(c, auth_type, passwd)
-			utils.SendPSyncListeningPort(c, conf.Options.HttpProfile)
-			br = bufio.NewReaderSize(c, utils.ReaderBufferSize)
-			bw = bufio.NewWriterSize(c, utils.WriterBufferSize)
-			utils.SendPSyncContinue(br, bw, runid, offset)
 		}
-	}()
-	return piper, nsize
+		utils.AuthPassword(c, auth_type, passwd)
+		utils.SendPSyncListeningPort(c, ds.listeningPort())
+		br = bufio.NewReaderSize(c, utils.ReaderBufferSize)
+		bw = bufio.NewWriterSize(c, utils.WriterBufferSize)
+		runid, offset, continued = ds.pSyncReconnect(c, br, bw, pipew, runid, offset)
+		ds.runId.Store(runid)
+	}
 }
 
-func (ds *dbSyncer) pSyncPipeCopy(c net.Conn, br *bufio.Reader, bw *bufio.Writer, offset int64, copyto io.Writer) (int64, error) {
-	var nread atomic2.Int64
-	go func() {
-		defer c.Close()
-		for range time.NewTicker(1 * time.Second).C {
-			select {
-			case <-ds.waitFull:
-				if err := utils.SendPSyncAck(bw, offset+nread.Get()); err != nil {
-					log.Errorf("dbSyncer[%v] send offset to source redis failed[%v]", ds.id, err)
-					return
-				}
-			default:
-				if err := utils.SendPSyncAck(bw, 0); err != nil {
+/*
+ * the target of the source in the job, all the nodes of the cluster target, the one pinned by
+ * shard.map to the source or the master of it, or else the one picked round-robin by the weight.
+ */
+func pickTarget(job *conf.Configuration, source string) []string {
+	if conf.Options.TargetType == conf.RedisTypeCluster {
+		return job.TargetAddressList
+	}
+	if target, ok := job.ShardMap[source]; ok {
+		return []string{target}
+	} else if target, ok = job.ShardMap[job.SourceReplicaOf[source]]; ok {
+		return []string{target}
+	}
+	pick := utils.PickTargetWeighted(job.TargetAddressList, job.TargetAddressOptions)
+	return []string{job.TargetAddressList[pick]}
+}
+
+// source.tls_enable unless tls is given in the address of the source, see conf.AddressOptions
+func (ds *dbSyncer) sourceTLSEnable() bool {
+	return utils.AddressTLS(ds.jobOptions().SourceAddressOptions, ds.source, ds.opts().SourceTLSEnable)
+}
+
+// the tls configuration of the source, nil if tls isn't enabled
+func (ds *dbSyncer) sourceTLS() *tls.Config {
+	return utils.SourceTLS(ds.sourceTLSEnable())
+}
+
+// the read and write timeout of the connections of the source, see source.timeout_ms
+func (ds *dbSyncer) sourceTimeout() time.Duration {
+	return time.Duration(ds.jobOptions().SourceTimeoutMs) * time.Millisecond
+}
+
+// the read and write timeout of the connections of the target, see target.timeout_ms
+func (ds *dbSyncer) targetTimeout() time.Duration {
+	return time.Duration(ds.jobOptions().TargetTimeoutMs) * time.Millisecond
+}
+
+// parallel unless it's given in the address of the source
+func (ds *dbSyncer) parallel() int {
+	if n := ds.jobOptions().SourceAddressOptions[ds.source].Parallel; n > 0 {
+		return n
+	}
+	return ds.opts().Parallel
+}
+
+// sender.count unless sender_count is given in the address of the source
+func (ds *dbSyncer) senderCount() uint {
+	if n := ds.jobOptions().SourceAddressOptions[ds.source].SenderCount; n > 0 {
+		return n
+	}
+	return ds.opts().SenderCount
+}
+
+// the tls configuration of the target, nil if tls isn't enabled. target.tls_enable unless tls is
+// given in the address of the target, the cluster target can't give it
+func (ds *dbSyncer) targetTLS() *tls.Config {
+	if len(ds.target) != 1 {
+		return utils.TargetTLS(ds.opts().TargetTLSEnable)
+	}
+	return utils.TargetTLS(utils.AddressTLS(ds.jobOptions().TargetAddressOptions, ds.target[0],
+		ds.opts().TargetTLSEnable))
+}
+
+// the address of the source now, it differs from the source given once the sentinel switches the master
+// or the shard of the source cluster fails over
+func (ds *dbSyncer) currentSource() string {
+	if master, _ := ds.master.Load().(string); master != "" {
+		return master
+	}
+	return ds.source
+}
+
+// the source got through the sentinel again if source.type = sentinel, master is kept on error
+func (ds *dbSyncer) resolveSentinel(master string) string {
+	if ds.opts().SourceType != conf.RedisTypeSentinel {
+		return master
+	}
+	address, _, err := utils.ResolveSentinelSource(ds.opts())
+	if err != nil {
+		log.Warnf("dbSyncer[%v] Event:SentinelResolveFail\tId:%s\tError:%v", ds.id, ds.opts().Id, err)
+		return master
+	}
+	if address != master {
+		log.Warnf("dbSyncer[%v] Event:SourceMasterSwitch\tId:%s\t%s -> %s", ds.id, ds.opts().Id, master, address)
+		ds.master.Store(address)
+	}
+	return address
+}
+
+// the master got through the sentinel again if target.type = sentinel, the target is kept on error
+func (ds *dbSyncer) resolveSentinelTarget(target []string) []string {
+	if ds.opts().TargetType != conf.RedisTypeSentinel {
+		return target
+	}
+	address, err := utils.ResolveSentinelTarget(ds.opts())
+	if err != nil {
+		log.Warnf("dbSyncer[%v] Event:SentinelResolveFail\tId:%s\tError:%v", ds.id, ds.opts().Id, err)
+		return target
+	}
+	if address != target[0] {
+		log.Warnf("dbSyncer[%v] Event:TargetMasterSwitch\tId:%s\t%s -> %s", ds.id, ds.opts().Id,
+			target[0], address)
+	}
+	return []string{address}
+}
+
+/*
+ * poll the master from the sentinel every second while reading from the master, the connection is
+ * closed once the master is switched so that the increment continues from the new one. It's needed
+ * since the old master may be down without closing the connection. The returned channel stops it.
+ */
+func (ds *dbSyncer) watchSentinel(c net.Conn, master string) chan struct{} {
+	stop := make(chan struct{})
+	if ds.opts().SourceType != conf.RedisTypeSentinel {
+		return stop
+	}
+	ds.spawn(func() {
+		ticker := time.NewTicker(sentinelWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			address, fromMaster, err := utils.ResolveSentinelSource(ds.opts())
+			if err != nil {
+				log.Debugf("dbSyncer[%v] resolve the source through the sentinel failed: %v", ds.id, err)
+				continue
+			}
+			if !fromMaster {
+				// a slave is picked randomly, it's only resolved again after reconnecting
+				return
+			}
+			if address != master {
+				log.Warnf("dbSyncer[%v] Event:SourceMasterSwitch\tId:%s\t%s -> %s, reconnect", ds.id,
+					ds.opts().Id, master, address)
+				c.Close()
+				return
+			}
+		}
+	})
+	return stop
+}
+
+/*
+ * record the reconnect of the source, the error is returned once it's reconnected more than
+ * source.reconnect_limit times within source.reconnect_window while the offset doesn't advance.
+ */
+func (ds *dbSyncer) checkReconnectLoop() error {
+	if ds.reconnect == nil {
+		return nil
+	}
+	metric.GetMetric(ds.id).AddReconnectCount(ds.id, 1)
+	if !ds.reconnect.Reconnect(ds.targetOffset.Get()) {
+		return nil
+	}
+	return fmt.Errorf("source is reconnected %d times in %ds without the offset advancing since %s",
+		ds.reconnect.Stalled(), ds.opts().SourceReconnectWindow,
+		ds.reconnect.LastProgress().Format(utils.GolangSecurityTime))
+}
+
+/*
+ * continue from the runid and offset on the reconnected source. If the source has failed over,
+ * the new master either continues with its new runid(psync2) or replies fullresync, the new rdb
+ * is restored into the target then. The runid and offset to continue the increment are returned.
+ *
+ * Like the replid2 of psync2, the runid before the last switch is kept along with the offset of
+ * the switch. If the source replies fullresync to the runid while the offset isn't beyond the
+ * switch, e.g., the new master is promoted from a replica of the old one which never follows the
+ * runid switched to, c is closed and false is returned to reconnect with the runid before.
+ */
+func (ds *dbSyncer) pSyncReconnect(c net.Conn, br *bufio.Reader, bw *bufio.Writer, incrw io.Writer, runid string,
+	offset int64) (string, int64, bool) {
+	ok, reply := utils.TryPSyncContinue(br, bw, runid, offset)
+	if ok {
+		if newRunid := utils.PSyncContinueRunId(reply); newRunid != "" && newRunid != runid {
+			log.Warnf("dbSyncer[%v] Event:SourceFailover\tId:%s\trunid = %s -> %s, continue from offset = %d",
+				ds.id, ds.opts().Id, runid, newRunid, offset)
+			ds.emit(EventSourceFailover, "runid = %s -> %s, continue from offset = %d", runid, newRunid, offset)
+			ds.switchRunId(runid, offset)
+			runid = newRunid
+		}
+		log.Infof("dbSyncer[%v] Event:IncSyncStart\tId:%s\t", ds.id, ds.opts().Id)
+		return runid, offset, true
+	}
+
+	newRunid, newOffset, wait, ok := utils.ParsePSyncFullsync(br, reply)
+	if !ok {
+		log.Panicf("dbSyncer[%v] invalid psync response = '%s', should be continue or fullresync", ds.id, reply)
+	}
+	if runid2, _ := ds.runId2.Load().(string); runid2 != "" && runid2 != runid && offset <= ds.runId2Offset.Get() {
+		log.Warnf("dbSyncer[%v] Event:SourcePSyncRunId2\tId:%s\trunid = %s offset = %d is rejected, "+
+			"try the runid before = %s", ds.id, ds.opts().Id, runid, offset, runid2)
+		// only tried once, the full sync comes if it's rejected again
+		ds.runId2.Store("")
+		c.Close()
+		return runid2, offset, false
+	}
+	log.Warnf("dbSyncer[%v] Event:SourceFailover\tId:%s\trunid = %s offset = %d -> runid = %s offset = %d, "+
+		"full sync again", ds.id, ds.opts().Id, runid, offset, newRunid, newOffset)
+	ds.emit(EventSourceFailover, "runid = %s offset = %d -> runid = %s offset = %d, full sync again", runid, offset,
+		newRunid, newOffset)
+
+	// the offsets of the old master are meaningless now
+	ds.targetOffset.Set(newOffset)
+	ds.applyOffset.Set(newOffset)
+	ds.checkpointOffset.Set(0)
+	ds.rbytes.Set(0)
+	ds.runId.Store("")
+	ds.runId2.Store("")
+	ds.removeCheckpoint()
+	for _, l := range ds.targetLanes() {
+		l.acked.Set(newOffset)
+	}
+
+	base.SetStatus("full")
+	size := ds.waitPSyncRdb(wait)
+	if ds.opts().SyncIncrOnly {
+		// the commands between the offsets are lost
+		log.Warnf("dbSyncer[%v] discard the rdb of size %d, only the increment is synced", ds.id, size.Size)
+		newOffset += ds.copyPSyncRdb(br, ioutil.Discard, incrw, size)
+		base.SetStatus("incr")
+		log.Infof("dbSyncer[%v] Event:IncSyncStart\tId:%s\t", ds.id, ds.opts().Id)
+		return newRunid, newOffset, true
+	}
+	rdbr, rdbw := pipe.NewSize(utils.ReaderBufferSize)
+	done := make(chan struct{})
+	ds.spawn(func() {
+		defer close(done)
+		ds.syncRDBFile(bufio.NewReaderSize(rdbr, utils.ReaderBufferSize), ds.target, ds.opts().TargetAuthType,
+			ds.targetPassword, size.Size, ds.targetTLS())
+	})
+	newOffset += ds.copyPSyncRdb(br, rdbw, incrw, size)
+	rdbw.Close()
+	<-done
+	ds.checkFailed()
+	base.SetStatus("incr")
+
+	log.Infof("dbSyncer[%v] Event:IncSyncStart\tId:%s\t", ds.id, ds.opts().Id)
+	return newRunid, newOffset, true
+}
+
+// keep the runid switched from and the offset of the switch, see pSyncReconnect
+func (ds *dbSyncer) switchRunId(runid string, offset int64) {
+	ds.runId2.Store(runid)
+	ds.runId2Offset.Set(offset)
+}
+
+func (ds *dbSyncer) pSyncPipeCopy(c net.Conn, br *bufio.Reader, bw *bufio.Writer, offset int64, copyto io.Writer) (int64, error) {
+	var nread atomic2.Int64
+	ds.spawn(func() {
+		defer c.Close()
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ds.ctx.Done():
+				return
+			case <-ds.failed:
+				return
+			case <-ticker.C:
+			}
+			if ds.stopping.Get() {
+				return
+			}
+			select {
+			case <-ds.waitFull:
+				// ack the offset parsed instead of read, which may be far behind
+				applied := ds.applyOffset.Get()
+				if err := utils.SendPSyncAck(bw, applied); err != nil {
+					log.Errorf("dbSyncer[%v] send offset to source redis failed[%v]", ds.id, err)
+					return
+				}
+				if ds.opts().SourceFakeSlaveOffset == false {
+					ds.sourceOffset.Set(applied)
+				}
+			default:
+				if err := utils.SendPSyncAck(bw, 0); err != nil {
 					log.Errorf("dbSyncer[%v] send offset to source redis failed[%v]", ds.id, err)
 					return
 				}
 			}
 		}
-		log.Errorf("dbSyncer[%v] heartbeat thread closed!", ds.id)
-	}()
+	})
 
 	var p = make([]byte, 8192)
 	for {
+		ds.waitInflight(offset + nread.Get())
 		n, err := br.Read(p)
 		if err != nil {
 			return nread.Get(), nil
@@ -394,57 +1476,240 @@ func (ds *dbSyncer) pSyncPipeCopy(c net.Conn, br *bufio.Reader, bw *bufio.Writer
 	}
 }
 
-func (ds *dbSyncer) syncRDBFile(reader *bufio.Reader, target []string, auth_type, passwd string, nsize int64, tlsEnable bool) {
-	pipe := utils.NewRDBLoader(reader, &ds.rbytes, base.RDBPipeSize)
+/*
+ * wait until the increment read but not parsed is under source.max_inflight_bytes. If nothing is
+ * parsed for a second, the decoder may be waiting for the rest of a big command, so it returns
+ * and one more read is allowed.
+ */
+func (ds *dbSyncer) waitInflight(readOffset int64) {
+	max := ds.opts().SourceMaxInflightBytes
+	if max <= 0 || readOffset-ds.applyOffset.Get() <= max {
+		return
+	}
+
+	ds.inflightThrottled.Incr()
+	log.Debugf("dbSyncer[%v] inflight bytes[%v] exceed %v, slow down reading source", ds.id,
+		readOffset-ds.applyOffset.Get(), max)
+	applied, since := ds.applyOffset.Get(), time.Now()
+	for readOffset-ds.applyOffset.Get() > max && !ds.stopping.Get() {
+		if a := ds.applyOffset.Get(); a != applied {
+			applied, since = a, time.Now()
+		} else if time.Since(since) >= time.Second {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (ds *dbSyncer) opts() *conf.Configuration {
+	if ds.options == nil {
+		return &conf.Options
+	}
+	return ds.options
+}
+
+func (ds *dbSyncer) jobOptions() *conf.Configuration {
+	if ds.job == nil {
+		return ds.opts()
+	}
+	return ds.job
+}
+
+// the filters of the job
+func (ds *dbSyncer) filter() filter.Filter {
+	return filter.New(ds.jobOptions())
+}
+
+// the command dropped by filter.dangerous_command is always logged since it may wipe the target
+func (ds *dbSyncer) blockCommand(scmd string, argv [][]byte, db int) {
+	strArgv := make([]string, len(argv))
+	for i, arg := range argv {
+		strArgv[i] = string(arg)
+	}
+	log.Warnf("dbSyncer[%v] Event:DangerousCommandBlocked\tId:%s\tCommand:%s %v\tDB:%v\tOffset:%v\t"+
+		"the command is dropped by filter.dangerous_command", ds.id, ds.opts().Id, scmd, strArgv, db,
+		ds.applyOffset.Get())
+	ds.emit(EventCommandBlocked, "command = %s %v, db = %d, offset = %d", scmd, strArgv, db, ds.applyOffset.Get())
+}
+
+// record the key dropped by the filters if filter.log_dropped is enabled
+func (ds *dbSyncer) auditDrop(reason string, db int, cmd string, key []byte) {
+	if ds.audit != nil {
+		ds.audit.Record(reason, db, cmd, key)
+	}
+}
+
+// record each key of the command dropped
+func (ds *dbSyncer) auditDropCommand(reason string, db int, scmd string, argv [][]byte) {
+	if ds.audit == nil {
+		return
+	}
+	keys, _ := filter.CommandKeys(scmd, argv)
+	if len(keys) == 0 {
+		ds.audit.Record(reason, db, scmd, nil)
+	}
+	for _, key := range keys {
+		ds.audit.Record(reason, db, scmd, key)
+	}
+}
+
+// drop the command which the proxy target doesn't support, it's warned once for each command
+func (ds *dbSyncer) dropProxyCommand(scmd string, db int, argv [][]byte) {
+	if ds.proxyDropped.Incr(scmd) {
+		log.Warnf("dbSyncer[%v] command[%v] isn't supported by the proxy target, it's dropped", ds.id, scmd)
+	}
+	ds.auditDropCommand(utils.DropReasonProxy, db, scmd, argv)
+	ds.nbypass.Incr()
+	metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+}
+
+// check the db on the first target by target.db_out_of_range
+func (ds *dbSyncer) newTargetDBChecker(target []string, auth_type, passwd string,
+	tlsConfig *tls.Config) *utils.TargetDBChecker {
+	return utils.NewTargetDBChecker(ds.opts(), func() redigo.Conn {
+		return utils.OpenRedisConn(target[:1], auth_type, utils.FetchAuthToken(utils.TargetAuthProvider, passwd),
+			false, tlsConfig)
+	})
+}
+
+// LastFullSync returns the stats of the last full sync finished, nil if there is none yet. The
+// stats are kept until the next full sync finishes.
+func (ds *dbSyncer) LastFullSync() *fullSyncStat {
+	s, _ := ds.lastFullSync.Load().(*fullSyncStat)
+	return s
+}
+
+func (ds *dbSyncer) syncRDBFile(reader *bufio.Reader, target []string, auth_type, passwd string, nsize int64,
+	tlsConfig *tls.Config) {
+	start := ds.Stat()
+	fullSync := &fullSyncStat{StartTime: time.Now()}
+	restoreShare := ds.restoreLimiter.Begin(ds.id)
+	pipe, version := utils.NewRDBLoader(reader, &ds.rbytes, base.RDBPipeSize, ds.recoverFatal)
+	bigKey := utils.BigKeyThreshold(ds.opts())
+	if ds.opts().SyncMode == conf.SyncModeVerify {
+		// nothing is restored
+	} else if rewrite, err := utils.CheckTargetRdbVersion(version, target, auth_type,
+		utils.FetchAuthToken(utils.TargetAuthProvider, passwd), tlsConfig, ds.opts()); err != nil {
+		log.PanicErrorf(err, "dbSyncer[%v] check rdb version failed", ds.id)
+	} else if rewrite {
+		bigKey = 1
+	}
+	if ds.opts().FilterMaxValueBytes > 0 {
+		pipe = utils.FilterRdbEntryBySize(pipe, ds.opts().FilterMaxValueBytes, base.RDBPipeSize,
+			func(e *rdb.BinEntry, size uint64) {
+				log.Warnf("dbSyncer[%v] skip key[%s] in db[%v] with value length[%v] bigger than filter.max_value_bytes[%v]",
+					ds.id, e.Key, e.DB, size, ds.opts().FilterMaxValueBytes)
+				ds.tooLarge.Incr()
+				ds.ignore.Incr()
+				ds.auditDrop(utils.DropReasonSize, int(e.DB), "", e.Key)
+				metric.GetMetric(ds.id).AddTooLargeCount(ds.id, 1)
+			})
+	}
+	if ds.opts().FullSyncResumable && ds.opts().SyncMode != conf.SyncModeVerify {
+		pipe = ds.skipRestored(pipe, target, auth_type, passwd, tlsConfig)
+	}
+	if ds.opts().RestoreDBGroupBuffer > 0 {
+		pipe = utils.GroupRdbEntryByDB(pipe, ds.opts().RestoreDBGroupBuffer, base.RDBPipeSize)
+	}
+	dbChecker := ds.newTargetDBChecker(target, auth_type, passwd, tlsConfig)
+	defer dbChecker.Close()
 	wait := make(chan struct{})
 	go func() {
 		defer close(wait)
 		var wg sync.WaitGroup
-		wg.Add(conf.Options.Parallel)
-		for i := 0; i < conf.Options.Parallel; i++ {
+		wg.Add(ds.parallel())
+		for i := 0; i < ds.parallel(); i++ {
 			go func() {
+				defer ds.recoverFatal()
 				defer wg.Done()
-				c := utils.OpenRedisConn(target, auth_type, passwd, conf.Options.TargetType == conf.RedisTypeCluster,
-					tlsEnable)
+				c := utils.LimitRedisConn(utils.ReauthTargetConn(utils.OpenRedisConn(target, auth_type,
+					utils.FetchAuthToken(utils.TargetAuthProvider, passwd),
+					ds.opts().TargetType == conf.RedisTypeCluster, tlsConfig), auth_type, passwd), ds.targetLimiter)
 				defer c.Close()
+				var rp *utils.RestorePipeline
+				if ds.opts().RestorePipelineCount > 1 && ds.opts().SyncMode != conf.SyncModeVerify {
+					rp = utils.NewRestorePipeline(c, int(ds.opts().RestorePipelineCount), bigKey)
+					defer func() {
+						rp.Flush()
+						ds.pipelineRetried.Add(rp.Retried)
+					}()
+				}
 				var lastdb uint32 = 0
 				for e := range pipe {
-					if filter.FilterDB(int(e.DB)) {
+					if ds.filter().FilterDB(int(e.DB)) {
 						// db filter
 						ds.ignore.Incr()
+						ds.auditDrop(utils.DropReasonDB, int(e.DB), "", e.Key)
+					} else if db, pass := utils.MapJobTargetDB(ds.jobOptions(), int(e.DB)); !pass {
+						// db isn't in the db map
+						ds.ignore.Incr()
+						ds.auditDrop(utils.DropReasonDB, int(e.DB), "", e.Key)
+					} else if db, pass = dbChecker.Map(db); !pass {
+						// db is out of range on the target
+						ds.ignore.Incr()
+						ds.auditDrop(utils.DropReasonDB, int(e.DB), "", e.Key)
 					} else {
 						ds.nentry.Incr()
 
 						log.Debugf("dbSyncer[%v] try restore key[%s] with value length[%v]", ds.id, e.Key, len(e.Value))
 
-						if conf.Options.TargetDB != -1 {
-							if conf.Options.TargetDB != int(lastdb) {
-								lastdb = uint32(conf.Options.TargetDB)
-								utils.SelectDB(c, uint32(conf.Options.TargetDB))
-							}
-						} else {
-							if e.DB != lastdb {
-								lastdb = e.DB
+						if uint32(db) != lastdb {
+							lastdb = uint32(db)
+							if rp != nil {
+								rp.Select(lastdb)
+							} else {
 								utils.SelectDB(c, lastdb)
 							}
 						}
 
-						if filter.FilterKey(string(e.Key)) == true {
+						if ds.filter().FilterKey(string(e.Key)) == true {
 							// 1. judge if not pass filter key
 							ds.ignore.Incr()
+							ds.auditDrop(utils.DropReasonKey, int(e.DB), "", e.Key)
+							continue
+						} else if ds.filter().FilterType(e.Type) == true {
+							// 2. judge if not pass filter type
+							ds.ignore.Incr()
+							ds.auditDrop(utils.DropReasonType, int(e.DB), "", e.Key)
+							continue
+						}
+						slot := int(utils.KeyToSlot(string(e.Key)))
+						if ds.filter().FilterSlot(slot) == true {
+							// 3. judge if not pass filter slot
+							ds.ignore.Incr()
+							ds.auditDrop(utils.DropReasonSlot, int(e.DB), "", e.Key)
+							continue
+						}
+
+						if restoreShare.Reached(e) {
+							// drain the pipe without writing
+							ds.ignore.Incr()
+							ds.auditDrop(utils.DropReasonLimit, int(e.DB), "", e.Key)
+							continue
+						}
+
+						if ds.opts().SyncMode == conf.SyncModeVerify {
+							ds.verifyRdbEntry(c, e)
+							continue
+						}
+						if !ds.resolveCollision(db, e) {
 							continue
-						} else {
-							slot := int(utils.KeyToSlot(string(e.Key)))
-							if filter.FilterSlot(slot) == true {
-								// 2. judge if not pass filter slot
-								ds.ignore.Incr()
-								continue
-							}
 						}
 
 						log.Debugf("dbSyncer[%v] start restoring key[%s] with value length[%v]", ds.id, e.Key, len(e.Value))
+						if e.NeedReadLen == 1 {
+							// count the split key once
+							ds.slotRestored[slot/utils.SlotRangeSize].Incr()
+						}
 
-						utils.RestoreRdbEntry(c, e)
+						if ds.qos != nil {
+							<-ds.qos
+						}
+						if rp != nil {
+							rp.Restore(e)
+							continue
+						}
+						utils.RestoreRdbEntry(c, e, bigKey)
 						log.Debugf("dbSyncer[%v] restore key[%s] ok", ds.id, e.Key)
 					}
 				}
@@ -464,144 +1729,252 @@ func (ds *dbSyncer) syncRDBFile(reader *bufio.Reader, target []string, auth_type
 		}
 		stat = ds.Stat()
 		var b bytes.Buffer
-		// fmt.Fprintf(&b, "dbSyncer[%v] total=%s - %12d [%3d%%]  entry=%-12d",
-		fmt.Fprintf(&b, "dbSyncer[%v] total = %s - %12s [%3d%%]  entry=%-12d",
-			ds.id, utils.GetMetric(nsize), utils.GetMetric(stat.rbytes), 100*stat.rbytes/nsize, stat.nentry)
+		if nsize > 0 {
+			// fmt.Fprintf(&b, "dbSyncer[%v] total=%s - %12d [%3d%%]  entry=%-12d",
+			fmt.Fprintf(&b, "dbSyncer[%v] total = %s - %12s [%3d%%]  entry=%-12d",
+				ds.id, utils.GetMetric(nsize), utils.GetMetric(stat.rbytes), 100*stat.rbytes/nsize, stat.nentry)
+		} else {
+			// total size is unknown in diskless mode
+			fmt.Fprintf(&b, "dbSyncer[%v] total = unknown - %12s  entry=%-12d",
+				ds.id, utils.GetMetric(stat.rbytes), stat.nentry)
+		}
 		if stat.ignore != 0 {
 			fmt.Fprintf(&b, "  ignore=%-12d", stat.ignore)
 		}
+		if n := ds.tooLarge.Get(); n != 0 {
+			fmt.Fprintf(&b, "  too_large=%d", n)
+		}
+		if n := ds.resumeSkipped.Get(); n != 0 {
+			fmt.Fprintf(&b, "  resumed=%d", n)
+		}
+		if n := ds.collisions.Get(); n != 0 {
+			fmt.Fprintf(&b, "  collision=%d", n)
+		}
+		if ds.opts().SyncMode == conf.SyncModeVerify {
+			fmt.Fprintf(&b, "  match=%d  mismatch=%d  missing=%d", ds.verified[utils.VerifyMatch].Get(),
+				ds.verified[utils.VerifyMismatch].Get(), ds.verified[utils.VerifyMissing].Get())
+		}
 		log.Info(b.String())
-		metric.GetMetric(ds.id).SetFullSyncProgress(ds.id, uint64(100*stat.rbytes/nsize))
+		if nsize > 0 {
+			metric.GetMetric(ds.id).SetFullSyncProgress(ds.id, uint64(100*stat.rbytes/nsize))
+		} else if done {
+			metric.GetMetric(ds.id).SetFullSyncProgress(ds.id, 100)
+		}
+	}
+	if ds.audit != nil {
+		log.Infof("dbSyncer[%v] Event:FilterDropSummary\tId:%s\t%s", ds.id, ds.opts().Id, ds.audit.Summary())
+	}
+	if n := ds.collisions.Get(); n != 0 {
+		log.Warnf("dbSyncer[%v] Event:MergeCollisionSummary\tId:%s\tCollisions:%d\tPolicy:%s", ds.id,
+			ds.opts().Id, n, ds.opts().TargetMergeCollision)
+	}
+	if n := ds.pipelineRetried.Get(); n != 0 {
+		log.Infof("dbSyncer[%v] %d entries failed in the restore pipeline are restored alone", ds.id, n)
 	}
+
+	fullSync.Duration = time.Since(fullSync.StartTime)
+	fullSync.Bytes = stat.rbytes - start.rbytes
+	fullSync.Entries = stat.nentry - start.nentry
+	ds.lastFullSync.Store(fullSync)
+	log.Infof("dbSyncer[%v] Event:FullSyncStat\tId:%s\tduration = %v, bytes = %d, entries = %d, throughput = %.2f MB/s",
+		ds.id, ds.opts().Id, fullSync.Duration, fullSync.Bytes, fullSync.Entries, fullSync.Throughput())
 	log.Infof("dbSyncer[%v] sync rdb done", ds.id)
 }
 
-func (ds *dbSyncer) syncCommand(reader *bufio.Reader, target []string, auth_type, passwd string, tlsEnable bool) {
-	readeTimeout := time.Duration(10) * time.Minute
-	writeTimeout := time.Duration(10) * time.Minute
-	isCluster := conf.Options.TargetType == conf.RedisTypeCluster
-	c := utils.OpenRedisConnWithTimeout(target, auth_type, passwd, readeTimeout, writeTimeout, isCluster, tlsEnable)
-	defer c.Close()
+// skip the entries restored by the full sync interrupted before, see fullsync.resumable
+func (ds *dbSyncer) skipRestored(pipe chan *rdb.BinEntry, target []string, auth_type, passwd string,
+	tlsConfig *tls.Config) chan *rdb.BinEntry {
+	keys := make(utils.TargetKeys)
+	for _, address := range target {
+		// each node of the cluster is scanned alone
+		c := utils.OpenRedisConn([]string{address}, auth_type, utils.FetchAuthToken(utils.TargetAuthProvider, passwd),
+			false, tlsConfig)
+		err := utils.ScanTargetKeys(c, keys)
+		c.Close()
+		if err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] scan the keys of target[%v] failed", ds.id, address)
+		}
+	}
+	log.Infof("dbSyncer[%v] Event:ResumeScan\tId:%s\t%d keys are found on the target", ds.id, ds.opts().Id,
+		keys.Len())
+	if keys.Len() == 0 {
+		return pipe
+	}
 
-	ds.sendBuf = make(chan cmdDetail, conf.Options.SenderCount)
-	ds.delayChannel = make(chan *delayNode, conf.Options.SenderDelayChannelSize)
-	var sendId, recvId, sendMarkId atomic2.Int64 // sendMarkId is also used as mark the sendId in sender routine
+	return utils.SkipRestoredRdbEntry(pipe, keys, ds.jobOptions(), func() redigo.Conn {
+		return utils.OpenRedisConn(target, auth_type, utils.FetchAuthToken(utils.TargetAuthProvider, passwd),
+			ds.opts().TargetType == conf.RedisTypeCluster, tlsConfig)
+	}, base.RDBPipeSize, ds.recoverFatal, func(e *rdb.BinEntry) {
+		log.Debugf("dbSyncer[%v] skip key[%s] in db[%v] restored before", ds.id, e.Key, e.DB)
+		ds.resumeSkipped.Incr()
+	})
+}
 
-	go func() {
-		if conf.Options.Psync == false {
-			log.Warnf("dbSyncer[%v] GetFakeSlaveOffset not enable when psync == false", ds.id)
+// compare the entry with the target in sync.mode = verify
+func (ds *dbSyncer) verifyRdbEntry(c redigo.Conn, e *rdb.BinEntry) {
+	ret := utils.VerifyRdbEntry(c, e)
+	if ret == utils.VerifySkip {
+		if e.NeedReadLen != 1 {
+			// only the first part of the split key is counted
 			return
 		}
-
-		srcConn := utils.OpenRedisConnWithTimeout([]string{ds.source}, conf.Options.SourceAuthType, ds.sourcePassword,
-			readeTimeout, writeTimeout, false, conf.Options.SourceTLSEnable)
-		ticker := time.NewTicker(10 * time.Second)
-		for range ticker.C {
-			offset, err := utils.GetFakeSlaveOffset(srcConn)
-			if err != nil {
-				// log.PurePrintf("%s\n", NewLogItem("GetFakeSlaveOffsetFail", "WARN", NewErrorLogDetail("", err.Error())))
-				log.Warnf("dbSyncer[%v] Event:GetFakeSlaveOffsetFail\tId:%s\tWarn:%s",
-					ds.id, conf.Options.Id, err.Error())
-
-				// Reconnect while network error happen
-				if err == io.EOF {
-					srcConn = utils.OpenRedisConnWithTimeout([]string{ds.source}, conf.Options.SourceAuthType,
-						ds.sourcePassword, readeTimeout, writeTimeout, false, conf.Options.SourceTLSEnable)
-				} else if _, ok := err.(net.Error); ok {
-					srcConn = utils.OpenRedisConnWithTimeout([]string{ds.source}, conf.Options.SourceAuthType,
-						ds.sourcePassword, readeTimeout, writeTimeout, false, conf.Options.SourceTLSEnable)
-				}
-			} else {
-				// ds.SyncStat.SetOffset(offset)
-				if ds.sourceOffset, err = strconv.ParseInt(offset, 10, 64); err != nil {
-					log.Errorf("dbSyncer[%v] Event:GetFakeSlaveOffsetFail\tId:%s\tError:%s",
-						ds.id, conf.Options.Id, err.Error())
-				}
-			}
-			// ds.SyncStat.SendBufCount = int64(len(sendBuf))
-			// ds.SyncStat.ProcessingCmdCount = int64(len(ds.delayChannel))
-			//log.Infof("%s", ds.SyncStat.Roll())
-			// ds.SyncStat.Roll()
-			// log.PurePrintf("%s\n", NewLogItem("Metric", "INFO", ds.SyncStat.Snapshot()))
+	} else if e.RealMemberCount != 0 {
+		var done bool
+		if ret, done = ds.mergeSplitVerify(e, ret); !done {
+			return
 		}
-	}()
-
-	go func() {
-		var node *delayNode
-		for {
-			reply, err := c.Receive()
-
-			recvId.Incr()
-			id := recvId.Get() // receive id
-
-			// print debug log of receive reply
-			log.Debugf("dbSyncer[%v] receive reply-id[%v]: [%v], error:[%v]", ds.id, id, reply, err)
-
-			if conf.Options.Metric == false {
-				continue
-			}
+	}
+	ds.verified[ret].Incr()
+	switch ret {
+	case utils.VerifyMismatch:
+		log.Warnf("dbSyncer[%v] verify key[%s] in db[%v]: mismatch", ds.id, e.Key, e.DB)
+	case utils.VerifyMissing:
+		log.Warnf("dbSyncer[%v] verify key[%s] in db[%v]: missing", ds.id, e.Key, e.DB)
+	case utils.VerifySkip:
+		log.Infof("dbSyncer[%v] verify key[%s] in db[%v]: skip the key split in loading", ds.id, e.Key, e.DB)
+	}
+}
 
-			if err == nil {
-				metric.GetMetric(ds.id).AddSuccessCmdCount(ds.id, 1)
-			} else {
-				metric.GetMetric(ds.id).AddFailCmdCount(ds.id, 1)
-				if utils.CheckHandleNetError(err) {
-					log.Panicf("dbSyncer[%v] Event:NetErrorWhileReceive\tId:%s\tError:%s",
-						ds.id, conf.Options.Id, err.Error())
-				} else {
-					log.Panicf("dbSyncer[%v] Event:ErrorReply\tId:%s\tCommand: [unknown]\tError: %s",
-						ds.id, conf.Options.Id, err.Error())
-				}
-			}
+// the result of the parts of a split hash compared so far
+type splitVerify struct {
+	remain uint32 // the fields not compared yet
+	ret    int
+}
 
-			if node == nil {
-				// non-blocking read from delay channel
-				select {
-				case node = <-ds.delayChannel:
-				default:
-					// it's ok, channel is empty
-				}
-			}
+// merge the result of the part into the key, the parts may be compared by the workers in any
+// order. done is true once all the fields of the key are compared, the key is counted then.
+func (ds *dbSyncer) mergeSplitVerify(e *rdb.BinEntry, ret int) (int, bool) {
+	ds.verifyMu.Lock()
+	defer ds.verifyMu.Unlock()
+	if ds.verifySplit == nil {
+		ds.verifySplit = make(map[string]*splitVerify)
+	}
+	id := fmt.Sprintf("%d_%s", e.DB, e.Key)
+	v, ok := ds.verifySplit[id]
+	if !ok {
+		v = &splitVerify{remain: e.TotMemberCount, ret: ret}
+		ds.verifySplit[id] = v
+	} else if v.ret != ret {
+		// e.g. some fields are missing
+		v.ret = utils.VerifyMismatch
+	}
+	if e.RealMemberCount >= v.remain {
+		delete(ds.verifySplit, id)
+		return v.ret, true
+	}
+	v.remain -= e.RealMemberCount
+	return v.ret, false
+}
 
-			if node != nil {
-				if node.id == id {
-					metric.GetMetric(ds.id).AddDelay(uint64(time.Now().Sub(node.t).Nanoseconds()) / 1000000) // ms
-					node = nil
-				} else if node.id < id {
-					log.Panicf("dbSyncer[%v] receive id invalid: node-id[%v] < receive-id[%v]",
-						ds.id, node.id, id)
-				}
-			}
+func (ds *dbSyncer) syncCommand(reader *bufio.Reader, target []string, auth_type, passwd string,
+	tlsConfig *tls.Config) {
+	readeTimeout := ds.targetTimeout()
+	writeTimeout := ds.targetTimeout()
+	passwd = utils.FetchAuthToken(utils.TargetAuthProvider, passwd)
+	lanes := make([]*targetLane, ds.opts().SenderTargetParallel)
+	budget := newByteBudget(ds.opts().SenderMaxBytes)
+	for i := range lanes {
+		lanes[i] = ds.openTargetLane(i, target, auth_type, passwd, tlsConfig, readeTimeout, writeTimeout)
+		lanes[i].budget = budget
+		if ds.opts().SenderSpillFile != "" {
+			lanes[i].spill = openSpillQueue(ds.opts(), fmt.Sprintf("%s.%d.%d", ds.opts().SenderSpillFile, ds.id, i))
 		}
-	}()
+		lanes[i].acked.Set(ds.applyOffset.Get())
+		defer lanes[i].close()
+	}
+	// read by the http api and the failure, so it's published once all the lanes are opened
+	ds.lanes.Store(lanes)
+	ds.waitChannel = make(chan *waitNode, 1024)
+	dbChecker := ds.newTargetDBChecker(target, auth_type, passwd, tlsConfig)
+	defer dbChecker.Close()
+	var sendMarkId atomic2.Int64 // sendMarkId is used as mark the command in the decoder routine
+
+	ds.startFakeSlaveOffset(ds.sourceTimeout(), ds.sourceTimeout())
+
+	for _, l := range lanes {
+		l := l
+		ds.spawn(func() {
+			ds.receiveReply(l)
+		})
+		if l.spill != nil {
+			ds.spawn(func() {
+				ds.feedLane(l)
+			})
+		}
+	}
 
-	go func() {
+	ds.spawn(func() {
 		var (
 			lastdb        int32 = 0
+			selectdb      int
+			sourcedb      int
 			bypass              = false
 			isselect            = false
 			scmd          string
 			argv, newArgv [][]byte
-			err           error
 			reject        bool
+			loopFilter    = filter.NewLoopFilter(ds.opts().SyncLoopTag)
+			held          *cmdDetail                  // the command behind the multi passed by the loop filter
+			unknownKeys   = make(map[string]struct{}) // commands warned by target.hash_tag_inject or rules
+			crossSlots    = make(map[string]struct{}) // commands warned since they can't be split by slot
 		)
 
 		decoder := redis.NewDecoder(reader)
 
-		log.Infof("dbSyncer[%v] FlushEvent:IncrSyncStart\tId:%s\t", ds.id, conf.Options.Id)
+		// record the commands sent to the target
+		var aof *utils.AofWriter
+		if ds.opts().IncrAofOutput != "" {
+			aof = utils.NewAofWriter(fmt.Sprintf("%s.%d", ds.opts().IncrAofOutput, ds.id),
+				int64(ds.opts().IncrAofMaxMB)*utils.MB)
+			defer aof.Close()
+		}
+		dispatcher := newLaneDispatcher(lanes)
+		send := func(item cmdDetail) {
+			if aof != nil {
+				aof.Write(item.Cmd, item.Args)
+			}
+			dispatcher.Send(item)
+		}
+
+		log.Infof("dbSyncer[%v] FlushEvent:IncrSyncStart\tId:%s\t", ds.id, ds.opts().Id)
 
 		for {
 			ignorecmd := false
 			isselect = false
-			resp := redis.MustDecodeOpt(decoder)
-
-			if scmd, argv, err = redis.ParseArgs(resp); err != nil {
-				log.PanicErrorf(err, "dbSyncer[%v] parse command arguments failed", ds.id)
+			if held != nil {
+				// the command behind the multi passed by the loop filter is judged already
+				scmd, argv, held = held.Cmd, held.Args, nil
 			} else {
+				if aof != nil && reader.Buffered() == 0 {
+					// flush before blocking on the source
+					aof.Flush()
+				}
+				resp, err := decoder.Decode()
+				if err != nil {
+					if ds.stopping.Get() {
+						// the senders quit once the buffers are drained
+						dispatcher.Close()
+						return
+					}
+					if cause := errors.Cause(err); ds.opts().Type == conf.TypeReplay &&
+						(cause == io.EOF || cause == io.ErrUnexpectedEOF) {
+						// the command cut at the end is dropped like aof-load-truncated of redis
+						log.Infof("dbSyncer[%v] Event:ReplayDone\tId:%s\tthe aof is replayed to the end, offset = %d",
+							ds.id, ds.opts().Id, ds.applyOffset.Get())
+						dispatcher.Close()
+						return
+					}
+					log.PanicErrorf(err, "dbSyncer[%v] decode redis resp failed", ds.id)
+				}
+
+				if scmd, argv, err = redis.ParseArgs(resp); err != nil {
+					log.PanicErrorf(err, "dbSyncer[%v] parse command arguments failed", ds.id)
+				}
+				ds.applyOffset.Add(commandLength(scmd, argv))
 				metric.GetMetric(ds.id).AddPullCmdCount(ds.id, 1)
 
 				// print debug log of send command
-				if conf.Options.LogLevel == utils.LogLevelDebug || conf.Options.LogLevel == utils.LogLevelAll {
+				if ds.opts().LogLevel == utils.LogLevelDebug || ds.opts().LogLevel == utils.LogLevelAll {
 					strArgv := make([]string, len(argv))
 					for i, ele := range argv {
 						strArgv[i] = *(*string)(unsafe.Pointer(&ele))
@@ -610,126 +1983,1095 @@ func (ds *dbSyncer) syncCommand(reader *bufio.Reader, target []string, auth_type
 					log.Debugf("dbSyncer[%v] send command[%v]: [%s %v]", ds.id, sendMarkId.Get(), scmd, strArgv)
 				}
 
-				if scmd != "ping" {
-					if strings.EqualFold(scmd, "select") {
-						if len(argv) != 1 {
-							log.Panicf("dbSyncer[%v] select command len(args) = %d", ds.id, len(argv))
-						}
-						s := string(argv[0])
-						n, err := strconv.Atoi(s)
-						if err != nil {
-							log.PanicErrorf(err, "dbSyncer[%v] parse db = %s failed", ds.id, s)
+				if skip, multi := loopFilter.Filter(scmd, argv); skip && loopFilter.Holding() {
+					// passed or skipped with the command behind it
+					continue
+				} else if skip {
+					// written by redis-shake from the other direction
+					ds.nbypass.Incr()
+					metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+					log.Debugf("dbSyncer[%v] skip command[%v] with loop tag", ds.id, scmd)
+					continue
+				} else if multi {
+					// the transaction isn't tagged, the multi held goes first
+					held = &cmdDetail{Cmd: scmd, Args: argv}
+					scmd, argv = "multi", nil
+				}
+			}
+
+			if scmd != "ping" {
+				if strings.EqualFold(scmd, "select") {
+					if len(argv) != 1 {
+						log.Panicf("dbSyncer[%v] select command len(args) = %d", ds.id, len(argv))
+					}
+					s := string(argv[0])
+					n, err := strconv.Atoi(s)
+					if err != nil {
+						log.PanicErrorf(err, "dbSyncer[%v] parse db = %s failed", ds.id, s)
+					}
+					sourcedb = n
+					bypass = ds.filter().FilterDB(n)
+					if !bypass {
+						// map the source db into the target db
+						var pass bool
+						selectdb, pass = utils.MapJobTargetDB(ds.jobOptions(), n)
+						if pass {
+							selectdb, pass = dbChecker.Map(selectdb)
 						}
-						bypass = filter.FilterDB(n)
-						isselect = true
-					} else if filter.FilterCommands(scmd) {
-						ignorecmd = true
+						bypass = !pass
 					}
-					if bypass || ignorecmd {
-						ds.nbypass.Incr()
-						// ds.SyncStat.BypassCmdCount.Incr()
-						metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
-						log.Debugf("dbSyncer[%v] ignore command[%v]", ds.id, scmd)
-						continue
+					isselect = true
+				} else if ds.filter().FilterCommands(scmd) || utils.SourceRdbCloud.VendorCommand(scmd) {
+					ignorecmd = true
+				} else if ds.filter().FilterDangerousCommand(scmd) {
+					ignorecmd = true
+					ds.blockCommand(scmd, argv, sourcedb)
+				}
+				if bypass || ignorecmd {
+					ds.nbypass.Incr()
+					// ds.SyncStat.BypassCmdCount.Incr()
+					metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+					log.Debugf("dbSyncer[%v] ignore command[%v]", ds.id, scmd)
+					if ignorecmd {
+						ds.auditDropCommand(utils.DropReasonCommand, sourcedb, scmd, argv)
+					} else if !isselect {
+						ds.auditDropCommand(utils.DropReasonDB, sourcedb, scmd, argv)
 					}
+					continue
 				}
+			}
 
-				newArgv, reject = filter.HandleFilterKeyWithCommand(scmd, argv)
-				if bypass || ignorecmd || reject {
+			newArgv, reject = ds.filter().HandleFilterKeyWithCommand(scmd, argv)
+			if bypass || ignorecmd || reject {
+				ds.auditDropCommand(utils.DropReasonKey, sourcedb, scmd, argv)
+				ds.nbypass.Incr()
+				metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+				log.Debugf("dbSyncer[%v] filter command[%v]", ds.id, scmd)
+				continue
+			}
+			if newArgv, reject = utils.FilterCommandSlot(ds.filter(), scmd, newArgv); reject {
+				ds.auditDropCommand(utils.DropReasonSlot, sourcedb, scmd, argv)
+				ds.nbypass.Incr()
+				metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+				log.Debugf("dbSyncer[%v] filter command[%v] by slot", ds.id, scmd)
+				continue
+			}
+			var kept bool
+			if scmd, newArgv, kept = ds.reconcileMigration(scmd, newArgv); !kept {
+				// all the keys migrated into another shard
+				ds.auditDropCommand(utils.DropReasonMigrate, sourcedb, scmd, argv)
+				ds.nbypass.Incr()
+				metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+				continue
+			}
+			if !isselect {
+				if newArgv, kept = ds.resolveCommandCollision(selectdb, scmd, newArgv); !kept {
+					// the keys are written by another shard merged into the target
+					ds.auditDropCommand(utils.DropReasonCollide, sourcedb, scmd, argv)
 					ds.nbypass.Incr()
 					metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
-					log.Debugf("dbSyncer[%v] filter command[%v]", ds.id, scmd)
 					continue
 				}
 			}
+			newArgv = utils.AdjustExpireCommand(scmd, newArgv)
+			if !isselect {
+				var known bool
+				if newArgv, known = utils.InjectCommandHashTag(scmd, newArgv); !known {
+					if _, ok := unknownKeys[scmd]; !ok && len(newArgv) != 0 {
+						unknownKeys[scmd] = struct{}{}
+						log.Warnf("dbSyncer[%v] the hash tag can't be injected since the keys of command[%v] "+
+							"are unknown, it's sent as it is", ds.id, scmd)
+					}
+				}
+			}
 
-			if isselect && conf.Options.TargetDB != -1 {
-				if conf.Options.TargetDB != int(lastdb) {
-					lastdb = int32(conf.Options.TargetDB)
+			if ds.opts().TargetType == conf.RedisTypeProxy {
+				if isselect {
+					// the proxy has db 0 only, see TargetDBChecker
+					ds.nbypass.Incr()
+					metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
+					continue
+				}
+				var supported bool
+				if scmd, supported = utils.ProxyCommand(scmd); !supported {
+					ds.dropProxyCommand(scmd, sourcedb, newArgv)
+					continue
+				}
+			}
+			if isselect && (ds.jobOptions().TargetDB != -1 || len(ds.jobOptions().TargetDBMap) != 0 ||
+				ds.opts().TargetDBOutOfRange == conf.DBOutOfRangeRemap) {
+				if selectdb != int(lastdb) {
+					lastdb = int32(selectdb)
 					//sendBuf <- cmdDetail{Cmd: scmd, Args: argv, Timestamp: time.Now()}
 					/* send select command. */
-					ds.sendBuf <- cmdDetail{Cmd: "SELECT", Args: [][]byte{[]byte(strconv.FormatInt(int64(lastdb), 10))}}
+					send(cmdDetail{Cmd: "SELECT", Args: [][]byte{[]byte(strconv.FormatInt(int64(lastdb), 10))},
+						Offset: ds.applyOffset.Get()})
 				} else {
 					ds.nbypass.Incr()
 					metric.GetMetric(ds.id).AddBypassCmdCount(ds.id, 1)
 				}
 				continue
 			}
-			ds.sendBuf <- cmdDetail{Cmd: scmd, Args: newArgv}
+			if ds.opts().TargetType == conf.RedisTypeCluster && !isselect {
+				// the cluster target replies CROSSSLOT to the keys in different slots
+				cmd, parts, ok := utils.SplitCommandBySlot(scmd, newArgv)
+				if !ok {
+					if _, warned := crossSlots[scmd]; !warned {
+						crossSlots[scmd] = struct{}{}
+						log.Warnf("dbSyncer[%v] the keys of command[%v] cross slots and it can't be split, "+
+							"the cluster target may reject it", ds.id, scmd)
+					}
+				} else if len(parts) > 1 {
+					ds.splitCommands.Incr()
+					for _, part := range parts {
+						send(cmdDetail{Cmd: cmd, Args: part, Offset: ds.applyOffset.Get()})
+					}
+					continue
+				}
+			}
+			send(cmdDetail{Cmd: scmd, Args: newArgv, Offset: ds.applyOffset.Get()})
 		}
-	}()
+	})
 
+	for _, l := range lanes {
+		l := l
+		ds.spawn(func() {
+			ds.sendCommand(l)
+		})
+	}
+	senderDone := make(chan struct{})
+	var lastCheckpoint time.Time
 	go func() {
-		var noFlushCount uint
-		var cachedSize uint64
+		defer close(senderDone)
+		for _, l := range lanes {
+			<-l.done
+		}
+	}()
 
-		for item := range ds.sendBuf {
-			length := len(item.Cmd)
-			data := make([]interface{}, len(item.Args))
-			for i := range item.Args {
-				data[i] = item.Args[i]
-				length += len(item.Args[i])
+	for lstat := ds.Stat(); ; {
+		select {
+		case <-senderDone:
+			if ds.opts().Type == conf.TypeReplay && !ds.stopping.Get() {
+				// the aof is replayed to the end, all the commands should be replied before quitting
+				for ds.unconfirmed() > 0 && ds.fatalError() == nil {
+					time.Sleep(time.Millisecond)
+				}
 			}
-			err := c.Send(item.Cmd, data...)
+			ds.drain(time.Duration(ds.opts().ShutdownDrainTimeoutMs) * time.Millisecond)
+			ds.writeCheckpoint()
+			if summary := ds.proxyDropped.Summary(); summary != "" {
+				log.Warnf("dbSyncer[%v] Event:ProxyDropSummary\tId:%s\t%s", ds.id, ds.opts().Id, summary)
+			}
+			log.Infof("dbSyncer[%v] sender quit", ds.id)
+			return
+		case <-time.After(time.Second):
+		}
+		if ds.opts().SyncCheckpointFile != "" &&
+			time.Since(lastCheckpoint) >= time.Duration(ds.opts().SyncCheckpointInterval)*time.Second {
+			ds.writeCheckpoint()
+			lastCheckpoint = time.Now()
+		}
+		nstat := ds.Stat()
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "dbSyncer[%v] sync: ", ds.id)
+		fmt.Fprintf(&b, " +forwardCommands=%-6d", nstat.forward-lstat.forward)
+		fmt.Fprintf(&b, " +filterCommands=%-6d", nstat.nbypass-lstat.nbypass)
+		fmt.Fprintf(&b, " +writeBytes=%d", nstat.wbytes-lstat.wbytes)
+		log.Info(b.String())
+		lstat = nstat
+	}
+}
+
+/*
+ * wait at most timeout for the replies of the commands sent after the senders quit. The checkpoint
+ * offset is moved to the last command parsed only if all the commands are replied, otherwise it's
+ * kept as the one confirmed before.
+ */
+func (ds *dbSyncer) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for ds.unconfirmed() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if unconfirmed := ds.unconfirmed(); unconfirmed != 0 {
+		log.Warnf("dbSyncer[%v] Event:DrainTimeout\tId:%s\tUnconfirmed:%d\tCheckpointOffset:%d",
+			ds.id, ds.opts().Id, unconfirmed, ds.checkpointOffset.Get())
+		return
+	}
+	if offset := ds.applyOffset.Get(); offset > ds.checkpointOffset.Get() {
+		ds.checkpointOffset.Set(offset)
+	}
+	log.Infof("dbSyncer[%v] Event:DrainDone\tId:%s\tCheckpointOffset:%d", ds.id, ds.opts().Id,
+		ds.checkpointOffset.Get())
+}
+
+func (ds *dbSyncer) setPaused(paused bool) {
+	if !ds.paused.CompareAndSwap(!paused, paused) {
+		return
+	}
+	if paused {
+		log.Infof("dbSyncer[%v] Event:Pause\tId:%s\tstop sending the increment", ds.id, ds.opts().Id)
+		ds.emit(EventPaused, "offset = %d", ds.applyOffset.Get())
+	} else {
+		log.Infof("dbSyncer[%v] Event:Resume\tId:%s\tcontinue sending the increment", ds.id, ds.opts().Id)
+		ds.emit(EventResumed, "offset = %d", ds.applyOffset.Get())
+	}
+}
+
+// the connections to the target in the increment sync, nil before it starts
+func (ds *dbSyncer) targetLanes() []*targetLane {
+	lanes, _ := ds.lanes.Load().([]*targetLane)
+	return lanes
+}
+
+// the commands queued or sent but not replied on all the lanes
+func (ds *dbSyncer) unconfirmed() int64 {
+	var n int64
+	for _, l := range ds.targetLanes() {
+		n += l.pending.Get()
+	}
+	return n
+}
+
+// the source offset whose commands are all replied by the target
+func (ds *dbSyncer) confirmedOffset() int64 {
+	offset := ds.checkpointOffset.Get()
+	var busy, idle int64 = -1, 0
+	for _, l := range ds.targetLanes() {
+		acked := l.acked.Get()
+		if l.pending.Get() == 0 {
+			if acked > idle {
+				idle = acked
+			}
+		} else if busy < 0 || acked < busy {
+			// the commands after it on the lane may not be replied
+			busy = acked
+		}
+	}
+	if busy >= 0 {
+		idle = busy
+	}
+	if idle > offset {
+		offset = idle
+	}
+	return offset
+}
+
+// the checkpoint of the confirmed offset is written into sync.checkpoint_file, see sendCheckpoint for sync.checkpoint_key
+func (ds *dbSyncer) writeCheckpoint() {
+	if ds.opts().SyncCheckpointFile == "" {
+		return
+	}
+	runid, _ := ds.runId.Load().(string)
+	if runid == "" {
+		// in the full sync
+		return
+	}
+	cp := &utils.Checkpoint{
+		Source: ds.currentSource(),
+		RunId:  runid,
+		Offset: ds.confirmedOffset(),
+		Time:   time.Now().Format(utils.GolangSecurityTime),
+	}
+	if err := utils.WriteCheckpoint(utils.CheckpointFileName(ds.opts().SyncCheckpointFile, ds.id), cp); err != nil {
+		log.Warnf("dbSyncer[%v] Event:CheckpointFail\tId:%s\tError:%v", ds.id, ds.opts().Id, err)
+	}
+}
+
+func (ds *dbSyncer) removeCheckpoint() {
+	if ds.opts().SyncCheckpointFile != "" {
+		if err := utils.RemoveCheckpoint(utils.CheckpointFileName(ds.opts().SyncCheckpointFile, ds.id)); err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] remove checkpoint failed", ds.id)
+		}
+	}
+	if ds.opts().SyncCheckpointKey != "" {
+		key := utils.CheckpointKeyName(ds.opts().SyncCheckpointKey, ds.id)
+		c := ds.openCheckpointConn()
+		defer c.Close()
+		if _, err := c.Do("del", key); err != nil {
+			log.PanicErrorf(err, "dbSyncer[%v] remove checkpoint key[%v] on target failed", ds.id, key)
+		}
+	}
+}
+
+// the connection to db 0 of the target where sync.checkpoint_key is
+func (ds *dbSyncer) openCheckpointConn() redigo.Conn {
+	return utils.OpenRedisConn(ds.target, ds.opts().TargetAuthType,
+		utils.FetchAuthToken(utils.TargetAuthProvider, ds.targetPassword),
+		ds.opts().TargetType == conf.RedisTypeCluster, ds.targetTLS())
+}
+
+// the checkpoint of the last run, nil if there is none or it isn't of this source
+func (ds *dbSyncer) loadCheckpoint() *utils.Checkpoint {
+	var cp *utils.Checkpoint
+	var err error
+	var from string // the file or the key
+	if ds.opts().SyncCheckpointFile != "" {
+		from = utils.CheckpointFileName(ds.opts().SyncCheckpointFile, ds.id)
+		cp, err = utils.ReadCheckpoint(from)
+	}
+	if cp == nil && err == nil && ds.opts().SyncCheckpointKey != "" {
+		// the file is missing, e.g., redis-shake is moved to another host
+		from = utils.CheckpointKeyName(ds.opts().SyncCheckpointKey, ds.id)
+		c := ds.openCheckpointConn()
+		cp, err = utils.ReadTargetCheckpoint(c, from)
+		c.Close()
+	}
+	if err != nil {
+		log.Warnf("dbSyncer[%v] ignore the checkpoint: %v", ds.id, err)
+		return nil
+	}
+	if cp == nil {
+		return nil
+	}
+	if cp.Source != ds.source {
+		log.Warnf("dbSyncer[%v] ignore the checkpoint[%v] of another source[%v]", ds.id, from, cp.Source)
+		return nil
+	}
+	log.Infof("dbSyncer[%v] load the checkpoint runid[%v] offset[%v] written at %v", ds.id, cp.RunId, cp.Offset,
+		cp.Time)
+	return cp
+}
+
+// receive the replies of the commands sent on the lane
+func (ds *dbSyncer) receiveReply(l *targetLane) {
+	var node *delayNode
+	var wnode *waitNode
+	var rnode *redirectNode
+	var anode *ackNode
+	var aid int64 // the reply id of auth
+	if l.redirector != nil {
+		defer l.redirector.Close()
+	}
+	defer func() {
+		if l.stallConn != nil {
+			l.stallConn.Close()
+		}
+	}()
+	c := l.c
+	for {
+		reply, err := c.Receive()
+		if err != nil && (ds.stopping.Get() || l.closed.Get()) {
+			// the connection is closed after the sender quits
+			return
+		}
+		if err != nil && l.breaker != nil && l.breaker.IsOpen() && l.recvId.Get() == l.sendId.Get() {
+			// closed by the sender to reconnect
+			c = <-l.reconnected
+			continue
+		}
+		if err != nil && l.broken != nil && utils.CheckHandleNetError(err) {
+			// the sender reopens the connection and sends the commands not replied again
+			log.Warnf("dbSyncer[%v] Event:NetErrorWhileReceive\tId:%s\tLane:%v\tError:%s", ds.id,
+				ds.opts().Id, l.id, err.Error())
+			l.broken <- struct{}{}
+			c = <-l.reconnected
+			continue
+		}
+		if err != nil && l.broken != nil && ds.opts().TargetType == conf.RedisTypeSentinel &&
+			utils.IsReadOnlyError(err) {
+			// the master is demoted by the sentinel, the commands not replied are sent to the one promoted
+			log.Warnf("dbSyncer[%v] Event:TargetReadOnly\tId:%s\tLane:%v\tError:%s, reconnect", ds.id,
+				ds.opts().Id, l.id, err.Error())
+			l.broken <- struct{}{}
+			c = <-l.reconnected
+			continue
+		}
+		if l.unreplied != nil {
+			l.unreplied.pop()
+		}
+
+		l.recvId.Incr()
+		id := l.recvId.Get() // receive id
+
+		// print debug log of receive reply
+		log.Debugf("dbSyncer[%v] lane[%v] receive reply-id[%v]: [%v], error:[%v]", ds.id, l.id, id, reply, err)
+
+		for {
+			if anode == nil {
+				select {
+				case anode = <-l.ackChannel:
+				default:
+				}
+			}
+			if anode == nil || anode.id > id {
+				break
+			}
+			l.acked.Set(anode.offset)
+			anode = nil
+		}
+
+		if wnode == nil {
+			// non-blocking read from wait channel
+			select {
+			case wnode = <-ds.waitChannel:
+			default:
+			}
+		}
+		if wnode != nil && wnode.id == id {
+			ds.handleWaitReply(wnode, reply, err)
+			wnode = nil
+			continue
+		}
+		if aid == 0 && l.authChannel != nil {
+			select {
+			case aid = <-l.authChannel:
+			default:
+			}
+		}
+		if aid != 0 && aid == id {
+			if err != nil {
+				log.Warnf("dbSyncer[%v] Event:ReauthFail\tId:%s\tLane:%v\tError:%v", ds.id, ds.opts().Id,
+					l.id, err)
+			}
+			aid = 0
+			continue
+		}
+		l.pending.Decr()
+
+		if l.redirectChannel != nil {
+			if rnode == nil {
+				// the node is pushed before flushing, so it's there once the reply comes
+				select {
+				case rnode = <-l.redirectChannel:
+				default:
+				}
+			}
+			if rnode != nil && rnode.id == id {
+				if err != nil && l.redirector != nil {
+					if r, rerr, handled := l.redirector.Redirect(err, rnode.cmd, rnode.args); handled {
+						log.Infof("dbSyncer[%v] Event:FollowRedirect\tId:%s\tCommand:%v\tRedirect:%v\tError:%v",
+							ds.id, ds.opts().Id, rnode.cmd, err, rerr)
+						reply, err = r, rerr
+					}
+				}
+				if l.openStall != nil && err == nil && strings.EqualFold(rnode.cmd, "select") && len(rnode.args) == 1 {
+					l.stallDB = rnode.args[0]
+				}
+				if l.openStall != nil && utils.IsStallError(err) {
+					log.Warnf("dbSyncer[%v] Event:TargetStalled\tId:%s\tCommand:%v\tError:%v, retry",
+						ds.id, ds.opts().Id, rnode.cmd, err)
+					reply, err = l.retryStalled(err, rnode.cmd, rnode.args)
+				}
+				rnode = nil
+			}
+		}
+		if err == nil && (ds.opts().SenderTransaction || ds.opts().SyncLoopTag != "") {
+			// the commands in the transaction of the batch or the loop tag are replied by exec
+			err = execError(reply)
+		}
+
+		if l.breaker != nil && !utils.CheckHandleNetError(err) {
 			if err != nil {
-				log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tError:%s\t",
-					ds.id, conf.Options.Id, err.Error())
+				log.Warnf("dbSyncer[%v] Event:ErrorReply\tId:%s\tCommand: [unknown]\tError: %s",
+					ds.id, ds.opts().Id, err.Error())
 			}
+			if l.breaker.Record(err == nil) {
+				log.Warnf("dbSyncer[%v] Event:CircuitBreakerOpen\tId:%s\tLane:%v\tTrips:%v",
+					ds.id, ds.opts().Id, l.id, l.breaker.Trips())
+			}
+		}
+
+		if ds.opts().Metric == false {
+			continue
+		}
+
+		if err == nil {
+			metric.GetMetric(ds.id).AddSuccessCmdCount(ds.id, 1)
+		} else {
+			metric.GetMetric(ds.id).AddFailCmdCount(ds.id, 1)
+			if utils.CheckHandleNetError(err) {
+				log.Panicf("dbSyncer[%v] Event:NetErrorWhileReceive\tId:%s\tError:%s",
+					ds.id, ds.opts().Id, err.Error())
+			} else if l.breaker == nil {
+				log.Panicf("dbSyncer[%v] Event:ErrorReply\tId:%s\tCommand: [unknown]\tError: %s",
+					ds.id, ds.opts().Id, err.Error())
+			}
+		}
+
+		if node == nil {
+			// non-blocking read from delay channel
+			select {
+			case node = <-l.delayChannel:
+			default:
+				// it's ok, channel is empty
+			}
+		}
+
+		if node != nil {
+			if node.id == id {
+				metric.GetMetric(ds.id).AddDelay(uint64(time.Now().Sub(node.t).Nanoseconds()) / 1000000) // ms
+				node = nil
+			} else if node.id < id {
+				log.Panicf("dbSyncer[%v] receive id invalid: node-id[%v] < receive-id[%v]",
+					ds.id, node.id, id)
+			}
+		}
+	}
+}
+
+// send the commands queued in the lane
+func (ds *dbSyncer) sendCommand(l *targetLane) {
+	defer close(l.done)
+	var noFlushCount uint
+	var cachedSize uint64
+	var lastOffset int64
+	var lastWait time.Time
+	var sinceWait uint // the commands sent since the last WAIT
+
+	for {
+		item, ok := ds.nextCommand(l)
+		if !ok {
+			break
+		}
+
+		// the transaction of sender.transaction can't be ended in the transaction of the source
+		holdable := !ds.opts().SenderTransaction || !l.inTx
+
+		// WAIT timeout with pause policy, stop sending until the replicas catch up
+		for holdable && ds.waitPaused.Get() && !ds.stopping.Get() {
+			if ds.waitPending.Get() == 0 {
+				ds.execBatch(l)
+				l.sendId.Incr()
+				ds.sendWait(l.c, l.sendId.Get(), lastOffset)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if holdable && ds.paused.Get() && noFlushCount > 0 {
+			// the commands sent are written before pausing
+			ds.execBatch(l)
+			ds.flushLane(l)
+			noFlushCount = 0
+			cachedSize = 0
+		}
+		for holdable && ds.paused.Get() && !ds.stopping.Get() {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if ds.qos != nil {
+			select {
+			case <-ds.qos:
+			default:
+				if holdable && noFlushCount > 0 {
+					// the commands sent are written before waiting for the token
+					ds.execBatch(l)
+					ds.flushLane(l)
+					noFlushCount = 0
+					cachedSize = 0
+				}
+				<-ds.qos
+			}
+		}
+
+		for l.stalled.Get() && !ds.stopping.Get() {
+			// sent once the command stalled is retried, see retryStalled
+			time.Sleep(time.Millisecond)
+		}
+
+		if l.breaker != nil && l.breaker.IsOpen() && !l.inTx && !l.batchTx {
+			ds.reconnectLane(l)
+		}
+		txCmd := false
+		switch {
+		case strings.EqualFold(item.Cmd, "select") && len(item.Args) == 1:
+			l.db = item.Args[0]
+		case strings.EqualFold(item.Cmd, "multi"):
+			l.inTx, txCmd = true, true
+		case strings.EqualFold(item.Cmd, "exec") || strings.EqualFold(item.Cmd, "discard"):
+			l.inTx, txCmd = false, true
+		}
+
+		if ds.opts().SenderTransaction && txCmd {
+			// the batch is already in a transaction which can't be nested, so multi and exec of the
+			// source are dropped and the transaction of the source isn't split by the batches
+			l.pending.Decr()
+		} else {
+			ds.beginBatch(l)
+			ds.sendItem(l, item)
 			noFlushCount += 1
+			sinceWait += 1
+		}
+		lastOffset = item.Offset
+
+		if (noFlushCount >= ds.senderCount() || cachedSize >= ds.opts().SenderSize ||
+				len(l.sendBuf) == 0 || waitCommandsDue(ds.opts(), sinceWait)) &&
+				(!ds.opts().SenderTransaction || !l.inTx) { // 5000 ds in a batch
+			if ds.opts().SyncCheckpointKey != "" && !l.inTx {
+				ds.sendCheckpoint(l, lastOffset)
+			}
+			ds.execBatch(l)
+			// push before flush so that the receiver can always find the node
+			select {
+			case l.ackChannel <- &ackNode{id: l.sendId.Get(), offset: lastOffset}:
+			default:
+			}
+			ds.flushLane(l)
+			noFlushCount = 0
+			cachedSize = 0
+
+			if waitCommandsDue(ds.opts(), sinceWait) || (ds.opts().TargetWaitReplicas > 0 &&
+				time.Since(lastWait) >= time.Duration(ds.opts().TargetWaitIntervalMs)*time.Millisecond) {
+				l.sendId.Incr()
+				ds.sendWait(l.c, l.sendId.Get(), lastOffset)
+				lastWait = time.Now()
+				sinceWait = 0
+			}
+		}
+	}
+}
+
+/*
+ * send one command of the source to the target. With sync.loop_tag the command is sent as "multi,
+ * publish ${loop_tag} ${id}, ${command}, exec" so that the loop filter of the other direction drops
+ * the transaction as a whole. The command in the transaction is tagged by the loop tag behind the
+ * multi instead.
+ */
+func (ds *dbSyncer) sendItem(l *targetLane, item cmdDetail) {
+	tagged := ds.opts().SyncLoopTag != "" && !l.inTx && !l.batchTx && !isTxCommand(item.Cmd) &&
+		!strings.EqualFold(item.Cmd, "select")
+	if tagged {
+		ds.sendTxCommand(l, "multi")
+		ds.sendLoopTag(l)
+	}
+
+	length := len(item.Cmd)
+	data := make([]interface{}, len(item.Args))
+	for i := range item.Args {
+		data[i] = item.Args[i]
+		length += len(item.Args[i])
+	}
+	err := l.c.Send(item.Cmd, data...)
+	if err != nil {
+		log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tError:%s\t",
+			ds.id, ds.opts().Id, err.Error())
+	}
+
+	ds.forward.Incr()
+	ds.wbytes.Add(int64(length))
+	metric.GetMetric(ds.id).AddPushCmdCount(ds.id, 1)
+	metric.GetMetric(ds.id).AddNetworkFlow(ds.id, uint64(length))
+	l.sendId.Incr()
+
+	if l.redirectChannel != nil {
+		l.redirectChannel <- &redirectNode{id: l.sendId.Get(), cmd: item.Cmd, args: item.Args}
+	}
+	if tagged {
+		ds.sendTxCommand(l, "exec")
+	} else if ds.opts().SyncLoopTag != "" && strings.EqualFold(item.Cmd, "multi") {
+		ds.sendLoopTag(l)
+	}
+
+	if ds.opts().Metric && ds.opts().DelaySampleRatio >= 0 {
+		// delay channel
+		ds.addDelayChan(l, l.sendId.Get())
+	}
+}
+
+// send multi ahead of the first command of the batch in sender.transaction
+func (ds *dbSyncer) beginBatch(l *targetLane) {
+	if !ds.opts().SenderTransaction || l.batchTx {
+		return
+	}
+	ds.sendTxCommand(l, "multi")
+	if ds.opts().SyncLoopTag != "" {
+		ds.sendLoopTag(l)
+	}
+	l.batchTx = true
+}
+
+// send exec behind the last command of the batch in sender.transaction, it's before the ack node
+// is pushed so that the offset is acked only once the batch is executed
+func (ds *dbSyncer) execBatch(l *targetLane) {
+	if !l.batchTx {
+		return
+	}
+	ds.sendTxCommand(l, "exec")
+	l.batchTx = false
+}
+
+func (ds *dbSyncer) sendTxCommand(l *targetLane, cmd string) {
+	if err := l.c.Send(cmd); err != nil {
+		log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tCommand:%s\tError:%s\t",
+			ds.id, ds.opts().Id, cmd, err.Error())
+	}
+	l.sendId.Incr()
+	l.pending.Incr()
+}
+
+// mark the transaction so that it won't be synced back
+func (ds *dbSyncer) sendLoopTag(l *targetLane) {
+	if err := l.c.Send("PUBLISH", ds.opts().SyncLoopTag, ds.opts().Id); err != nil {
+		log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tCommand:PUBLISH\tError:%s\t",
+			ds.id, ds.opts().Id, err.Error())
+	}
+	l.sendId.Incr()
+	l.pending.Incr()
+}
+
+func isTxCommand(cmd string) bool {
+	return strings.EqualFold(cmd, "multi") || strings.EqualFold(cmd, "exec") || strings.EqualFold(cmd, "discard")
+}
+
+// the first error in the replies of exec, nil if the reply isn't of exec
+func execError(reply interface{}) error {
+	replies, _ := reply.([]interface{})
+	for _, r := range replies {
+		if e, ok := r.(redigo.Error); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// the next command queued in the lane, the broken connection is reopened in the meantime
+func (ds *dbSyncer) nextCommand(l *targetLane) (cmdDetail, bool) {
+	for {
+		var reauth <-chan time.Time
+		if l.reauth != nil && !l.inTx && !l.batchTx {
+			// auth isn't allowed in the transaction
+			reauth = l.reauth.C
+		}
+		select {
+		case item, ok := <-l.sendBuf:
+			if ok {
+				l.pop(item)
+			}
+			return item, ok
+		case <-l.broken:
+			ds.replayLane(l)
+		case <-reauth:
+			ds.reauthLane(l)
+		}
+	}
+}
+
+// authenticate the connection of the lane again by the new token before the one authenticated expires
+func (ds *dbSyncer) reauthLane(l *targetLane) {
+	if err := l.c.Send(l.authType, utils.AuthArgs(l.authToken())...); err != nil {
+		log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tCommand:%s\tError:%s\t",
+			ds.id, ds.opts().Id, l.authType, err.Error())
+	}
+	l.sendId.Incr()
+	// push before flush so that the receiver can always find the id
+	l.authChannel <- l.sendId.Get()
+	ds.flushLane(l)
+}
+
+func (ds *dbSyncer) flushLane(l *targetLane) {
+	err := l.c.Flush()
+	if !utils.CheckHandleNetError(err) {
+		return
+	}
+	if l.broken == nil {
+		log.Panicf("dbSyncer[%v] Event:NetErrorWhileFlush\tId:%s\tError:%s\t",
+			ds.id, ds.opts().Id, err.Error())
+	}
+	log.Warnf("dbSyncer[%v] Event:NetErrorWhileFlush\tId:%s\tLane:%v\tError:%s\t", ds.id, ds.opts().Id,
+		l.id, err.Error())
+	// wake up the receiver, it tells the connection is broken once it stops receiving
+	l.c.Close()
+	<-l.broken
+	ds.replayLane(l)
+}
+
+/*
+ * reopen the broken connection of the lane and send the commands not replied again, the receiver
+ * waits for the new connection meanwhile. The backoff doubles after each failure, the sync fails
+ * after target.reconnect_retries times. The reply ids stay the same since the commands are sent
+ * in the same order, and the db selected before them is selected first without a reply id, so are
+ * multi and the commands queued after it if the connection is broken in the transaction.
+ */
+func (ds *dbSyncer) replayLane(l *targetLane) {
+	l.c.Close()
+	backoff := time.Duration(ds.opts().TargetReconnectBackoff) * time.Millisecond
+	for retry := uint(1); ; retry++ {
+		if retry > ds.opts().TargetReconnectRetries {
+			log.Panicf("dbSyncer[%v] Event:TargetReconnectFail\tId:%s\tLane:%v\tRetries:%v", ds.id,
+				ds.opts().Id, l.id, ds.opts().TargetReconnectRetries)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > targetReconnectMaxBackoff {
+			backoff = targetReconnectMaxBackoff
+		}
+
+		c := l.reopen()
+		if c == nil {
+			log.Warnf("dbSyncer[%v] Event:TargetReconnect\tId:%s\tLane:%v\tRetry:%v\tError:connect failed", ds.id,
+				ds.opts().Id, l.id, retry)
+			continue
+		}
+		cmds, db, tx := l.unreplied.all()
+		if err := replay(c, cmds, db, tx); err != nil {
+			log.Warnf("dbSyncer[%v] Event:TargetReconnect\tId:%s\tLane:%v\tRetry:%v\tError:%v", ds.id,
+				ds.opts().Id, l.id, retry, err)
+			c.Close()
+			continue
+		}
+
+		l.c = c
+		l.reconnected <- c
+		ds.targetReconnects.Incr()
+		log.Infof("dbSyncer[%v] Event:TargetReconnect\tId:%s\tLane:%v\tRetry:%v\tReplayed:%v", ds.id,
+			ds.opts().Id, l.id, retry, len(cmds))
+		return
+	}
+}
+
+// send the commands on the reopened connection, they're still in the queue so aren't recorded again
+func replay(c *recordConn, cmds []sentCommand, db interface{}, tx []sentCommand) error {
+	if db != nil {
+		if _, err := c.Conn.Do("select", db); err != nil {
+			return fmt.Errorf("select db[%s] failed: %v", db, err)
+		}
+	}
+	// the transaction is discarded by the broken connection, queue it again
+	for _, cmd := range tx {
+		if _, err := c.Conn.Do(cmd.cmd, cmd.args...); err != nil {
+			return fmt.Errorf("%v in the transaction failed: %v", cmd.cmd, err)
+		}
+	}
+	for _, cmd := range cmds {
+		if err := c.Conn.Send(cmd.cmd, cmd.args...); err != nil {
+			return fmt.Errorf("send %v failed: %v", cmd.cmd, err)
+		}
+	}
+	return c.Conn.Flush()
+}
+
+/*
+ * reopen the connection of the lane once the breaker trips: stop sending, wait for the replies of
+ * the commands sent, then hand the new connection to the receiver. The more trips in a row, the
+ * longer it waits before reconnecting.
+ */
+func (ds *dbSyncer) reconnectLane(l *targetLane) {
+	trips := l.breaker.Trips()
+	if trips > ds.opts().TargetErrorMaxTrips {
+		log.Panicf("dbSyncer[%v] Event:CircuitBreakerFail\tId:%s\tLane:%v\tTrips:%v",
+			ds.id, ds.opts().Id, l.id, trips)
+	}
+	if err := l.c.Flush(); utils.CheckHandleNetError(err) {
+		log.Panicf("dbSyncer[%v] Event:NetErrorWhileFlush\tId:%s\tError:%s\t",
+			ds.id, ds.opts().Id, err.Error())
+	}
+	for l.recvId.Get() < l.sendId.Get() {
+		// the receiver quits once the syncer fails
+		ds.checkFailed()
+		time.Sleep(time.Millisecond)
+	}
+
+	l.c.Close()
+	time.Sleep(time.Duration(trips) * time.Second)
+	l.c = l.open()
+	l.reconnected <- l.c
+	if l.db != nil {
+		if err := l.c.Send("select", l.db); err != nil {
+			log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tCommand:select\tError:%s\t",
+				ds.id, ds.opts().Id, err.Error())
+		}
+		l.sendId.Incr()
+		l.pending.Incr()
+	}
+	l.breaker.Close()
+	log.Infof("dbSyncer[%v] Event:CircuitBreakerClose\tId:%s\tLane:%v\tTrips:%v",
+		ds.id, ds.opts().Id, l.id, trips)
+}
+
+/*
+ * write the checkpoint into sync.checkpoint_key behind the commands of the batch. The commands
+ * before it on the same connection are executed once it's executed, so the offset of the batch is
+ * used directly with one lane on the standalone target, otherwise the confirmed offset is used.
+ */
+func (ds *dbSyncer) sendCheckpoint(l *targetLane, offset int64) {
+	runid, _ := ds.runId.Load().(string)
+	if runid == "" {
+		return
+	}
+	isCluster := ds.opts().TargetType == conf.RedisTypeCluster
+	if len(ds.targetLanes()) > 1 || isCluster {
+		offset = ds.confirmedOffset()
+	}
+	cp := &utils.Checkpoint{
+		Source: ds.currentSource(),
+		RunId:  runid,
+		Offset: offset,
+		Time:   time.Now().Format(utils.GolangSecurityTime),
+	}
+
+	type command struct {
+		cmd  string
+		args []interface{}
+	}
+	cmds := []command{{"hmset", cp.HMSetArgs(utils.CheckpointKeyName(ds.opts().SyncCheckpointKey, ds.id))}}
+	if !isCluster && l.db != nil && string(l.db) != "0" {
+		// the key is always in db 0
+		cmds = append([]command{{"select", []interface{}{0}}}, cmds...)
+		cmds = append(cmds, command{"select", []interface{}{l.db}})
+	}
+	for _, c := range cmds {
+		if err := l.c.Send(c.cmd, c.args...); err != nil {
+			log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tCommand:%s\tError:%s\t",
+				ds.id, ds.opts().Id, c.cmd, err.Error())
+		}
+		l.sendId.Incr()
+		l.pending.Incr()
+	}
+}
+
+// whether WAIT is sent for the commands sent since the last one, see target.wait_interval_commands
+func waitCommandsDue(options *conf.Configuration, sinceWait uint) bool {
+	return options.TargetWaitReplicas > 0 && options.TargetWaitIntervalCmds > 0 &&
+		sinceWait >= options.TargetWaitIntervalCmds
+}
+
+// send WAIT to the target, the reply is handled in the receiver routine
+func (ds *dbSyncer) sendWait(c redigo.Conn, id, offset int64) {
+	// push before flush so that the receiver can always find the node
+	ds.waitPending.Incr()
+	ds.waitChannel <- &waitNode{id: id, offset: offset}
+	if err := c.Send("WAIT", ds.opts().TargetWaitReplicas, ds.opts().TargetWaitTimeoutMs); err != nil {
+		log.Panicf("dbSyncer[%v] Event:SendToTargetFail\tId:%s\tCommand:WAIT\tError:%s\t",
+			ds.id, ds.opts().Id, err.Error())
+	}
+	if err := c.Flush(); utils.CheckHandleNetError(err) {
+		log.Panicf("dbSyncer[%v] Event:NetErrorWhileFlush\tId:%s\tError:%s\t",
+			ds.id, ds.opts().Id, err.Error())
+	}
+}
+
+// handle the reply of WAIT, return true if enough replicas acked
+func (ds *dbSyncer) handleWaitReply(node *waitNode, reply interface{}, err error) bool {
+	defer ds.waitPending.Decr()
+
+	replicas, err := redigo.Int64(reply, err)
+	if err != nil {
+		log.Panicf("dbSyncer[%v] Event:ErrorReply\tId:%s\tCommand:WAIT\tError:%s",
+			ds.id, ds.opts().Id, err.Error())
+	}
+
+	if replicas >= int64(ds.opts().TargetWaitReplicas) {
+		if node.offset > ds.checkpointOffset.Get() {
+			ds.checkpointOffset.Set(node.offset)
+		}
+		if ds.waitPaused.Get() {
+			log.Infof("dbSyncer[%v] Event:WaitResume\tId:%s\tReplicas:%d\tOffset:%d",
+				ds.id, ds.opts().Id, replicas, node.offset)
+			ds.waitPaused.Set(false)
+		}
+		return true
+	}
+
+	log.Warnf("dbSyncer[%v] Event:WaitTimeout\tId:%s\tReplicas:%d\tExpect:%d\tOffset:%d",
+		ds.id, ds.opts().Id, replicas, ds.opts().TargetWaitReplicas, node.offset)
+	if ds.opts().TargetWaitPolicy == conf.WaitPolicyPause {
+		ds.waitPaused.Set(true)
+	}
+	return false
+}
+
+// length of the command in RESP format, which is the same as it in the replication stream
+func commandLength(scmd string, argv [][]byte) int64 {
+	length := 1 + len(strconv.Itoa(len(argv)+1)) + 2
+	length += 1 + len(strconv.Itoa(len(scmd))) + 2 + len(scmd) + 2
+	for _, arg := range argv {
+		length += 1 + len(strconv.Itoa(len(arg))) + 2 + len(arg) + 2
+	}
+	return int64(length)
+}
 
-			ds.forward.Incr()
-			ds.wbytes.Add(int64(length))
-			metric.GetMetric(ds.id).AddPushCmdCount(ds.id, 1)
-			metric.GetMetric(ds.id).AddNetworkFlow(ds.id, uint64(length))
-			sendId.Incr()
+// start fetching the offset in the source redis in routine, return false if not started
+func (ds *dbSyncer) startFakeSlaveOffset(readeTimeout, writeTimeout time.Duration) bool {
+	if ds.opts().Psync == false {
+		log.Warnf("dbSyncer[%v] GetFakeSlaveOffset not enable when psync == false", ds.id)
+		return false
+	}
+	if ds.opts().SourceFakeSlaveOffset == false {
+		log.Infof("dbSyncer[%v] GetFakeSlaveOffset disabled, use the psync ack offset instead", ds.id)
+		return false
+	}
 
-			if conf.Options.Metric {
-				// delay channel
-				ds.addDelayChan(sendId.Get())
+	ds.spawn(func() {
+		srcConn := utils.ReauthSourceConn(utils.OpenRedisConnWithTimeout([]string{ds.currentSource()},
+			ds.opts().SourceAuthType, utils.SourceAuthToken(ds.sourcePassword),
+			readeTimeout, writeTimeout, false, ds.sourceTLS()), ds.opts().SourceAuthType, ds.sourcePassword)
+		defer func() {
+			srcConn.Close()
+		}()
+		ticker := time.NewTicker(time.Duration(ds.opts().SourceOffsetInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ds.ctx.Done():
+				return
+			case <-ds.failed:
+				return
+			case <-ticker.C:
+			}
+			if ds.stopping.Get() {
+				return
 			}
+			offset, err := utils.GetFakeSlaveOffset(srcConn, ds.listeningPort())
+			if err != nil {
+				// log.PurePrintf("%s\n", NewLogItem("GetFakeSlaveOffsetFail", "WARN", NewErrorLogDetail("", err.Error())))
+				log.Warnf("dbSyncer[%v] Event:GetFakeSlaveOffsetFail\tId:%s\tWarn:%s",
+					ds.id, ds.opts().Id, err.Error())
 
-			if noFlushCount >= conf.Options.SenderCount || cachedSize >= conf.Options.SenderSize ||
-					len(ds.sendBuf) == 0 { // 5000 ds in a batch
-				err := c.Flush()
-				noFlushCount = 0
-				cachedSize = 0
+				// Reconnect while network error happen, the source may be down or switched by the sentinel
 				if utils.CheckHandleNetError(err) {
-					log.Panicf("dbSyncer[%v] Event:NetErrorWhileFlush\tId:%s\tError:%s\t",
-						ds.id, conf.Options.Id, err.Error())
+					if c := utils.OpenRedisConnSoft([]string{ds.currentSource()}, ds.opts().SourceAuthType,
+						utils.SourceAuthToken(ds.sourcePassword), readeTimeout, writeTimeout,
+						false, ds.sourceTLS()); c != nil {
+						srcConn.Close()
+						srcConn = utils.ReauthSourceConn(c, ds.opts().SourceAuthType, ds.sourcePassword)
+					}
+				}
+			} else {
+				// ds.SyncStat.SetOffset(offset)
+				if val, err := strconv.ParseInt(offset, 10, 64); err != nil {
+					log.Errorf("dbSyncer[%v] Event:GetFakeSlaveOffsetFail\tId:%s\tError:%s",
+						ds.id, ds.opts().Id, err.Error())
+				} else {
+					ds.sourceOffset.Set(val)
 				}
 			}
+			// ds.SyncStat.SendBufCount = int64(len(sendBuf))
+			// ds.SyncStat.ProcessingCmdCount = int64(len(ds.delayChannel))
+			//log.Infof("%s", ds.SyncStat.Roll())
+			// ds.SyncStat.Roll()
+			// log.PurePrintf("%s\n", NewLogItem("Metric", "INFO", ds.SyncStat.Snapshot()))
 		}
-	}()
+	})
+	return true
+}
 
-	for lstat := ds.Stat(); ; {
-		time.Sleep(time.Second)
-		nstat := ds.Stat()
-		var b bytes.Buffer
-		fmt.Fprintf(&b, "dbSyncer[%v] sync: ", ds.id)
-		fmt.Fprintf(&b, " +forwardCommands=%-6d", nstat.forward-lstat.forward)
-		fmt.Fprintf(&b, " +filterCommands=%-6d", nstat.nbypass-lstat.nbypass)
-		fmt.Fprintf(&b, " +writeBytes=%d", nstat.wbytes-lstat.wbytes)
-		log.Info(b.String())
-		lstat = nstat
+// whether the command of the given id is sampled into the delay channel, see metric.delay_sample
+func (l *targetLane) sampleDelay(ratio int, id int64) bool {
+	switch {
+	case ratio < 0:
+		return false
+	case ratio > 0:
+		return id%int64(ratio) == 0
 	}
-}
 
-func (ds *dbSyncer) addDelayChan(id int64) {
-	// send
 	/*
+	 * adaptive:
 	 * available >=4096: 1:1 sampling
 	 * available >=1024: 1:10 sampling
 	 * available >=128: 1:100 sampling
 	 * else: 1:1000 sampling
 	 */
-	used := cap(ds.delayChannel) - len(ds.delayChannel)
-	if used >= 4096 ||
+	used := cap(l.delayChannel) - len(l.delayChannel)
+	return used >= 4096 ||
 		used >= 1024 && id%10 == 0 ||
 		used >= 128 && id%100 == 0 ||
-		id%1000 == 0 {
+		id%1000 == 0
+}
+
+func (ds *dbSyncer) addDelayChan(l *targetLane, id int64) {
+	// send
+	if l.sampleDelay(ds.opts().DelaySampleRatio, id) {
 		// non-blocking add
 		select {
-		case ds.delayChannel <- &delayNode{t: time.Now(), id: id}:
+		case l.delayChannel <- &delayNode{t: time.Now(), id: id}:
 		default:
 			// do nothing but print when channel is full
 			log.Warnf("dbSyncer[%v] delayChannel is full", ds.id)
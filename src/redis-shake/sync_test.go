@@ -0,0 +1,4851 @@
+// +build linux darwin windows
+// +build integration
+
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pkg/libs/atomic2"
+	"pkg/libs/log"
+	"pkg/rdb"
+	"pkg/redis"
+	"redis-shake/common"
+	"redis-shake/configure"
+	"redis-shake/metric"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fake target which replies the given replica count to every WAIT
+func startFakeWaitTarget(t *testing.T, replicas *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					if _, err := redis.Decode(br); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte(fmt.Sprintf(":%d\r\n", replicas.Get()))); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestWaitCheckpoint(t *testing.T) {
+	var replicas atomic2.Int64
+	l := startFakeWaitTarget(t, &replicas)
+	defer l.Close()
+
+	c, err := redigo.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err, "should be equal")
+	defer c.Close()
+
+	conf.Options.TargetWaitReplicas = 2
+	conf.Options.TargetWaitTimeoutMs = 10
+
+	ds := withRoutines(t, &dbSyncer{waitChannel: make(chan *waitNode, 16)})
+	receive := func() bool {
+		ds.sendWait(c, 1, 0)
+		node := <-ds.waitChannel
+		reply, err := c.Receive()
+		return ds.handleWaitReply(node, reply, err)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestWaitCheckpoint case %d.\n", nr)
+		nr++
+
+		// enough replicas, checkpoint moves forward
+		replicas.Set(2)
+		ds.sendWait(c, 1, 100)
+		node := <-ds.waitChannel
+		reply, err := c.Receive()
+		assert.Equal(t, true, ds.handleWaitReply(node, reply, err), "should be equal")
+		assert.Equal(t, int64(100), ds.checkpointOffset.Get(), "should be equal")
+		assert.Equal(t, int64(0), ds.waitPending.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestWaitCheckpoint case %d.\n", nr)
+		nr++
+
+		// timeout with warn policy, checkpoint stays
+		conf.Options.TargetWaitPolicy = conf.WaitPolicyWarn
+		replicas.Set(1)
+		ds.sendWait(c, 2, 200)
+		node := <-ds.waitChannel
+		reply, err := c.Receive()
+		assert.Equal(t, false, ds.handleWaitReply(node, reply, err), "should be equal")
+		assert.Equal(t, int64(100), ds.checkpointOffset.Get(), "should be equal")
+		assert.Equal(t, false, ds.waitPaused.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestWaitCheckpoint case %d.\n", nr)
+		nr++
+
+		// timeout with pause policy, resume once replicas catch up
+		conf.Options.TargetWaitPolicy = conf.WaitPolicyPause
+		replicas.Set(0)
+		assert.Equal(t, false, receive(), "should be equal")
+		assert.Equal(t, true, ds.waitPaused.Get(), "should be equal")
+
+		replicas.Set(3)
+		assert.Equal(t, true, receive(), "should be equal")
+		assert.Equal(t, false, ds.waitPaused.Get(), "should be equal")
+		assert.Equal(t, int64(100), ds.checkpointOffset.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestWaitCheckpoint case %d.\n", nr)
+		nr++
+
+		// "*3\r\n$3\r\nset\r\n$1\r\na\r\n$2\r\nbc\r\n"
+		assert.Equal(t, int64(28), commandLength("set", [][]byte{[]byte("a"), []byte("bc")}), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestWaitCheckpoint case %d.\n", nr)
+		nr++
+
+		// WAIT every n commands
+		conf.Options.TargetWaitIntervalCmds = 0
+		assert.Equal(t, false, waitCommandsDue(&conf.Options, 10000), "should be equal")
+		conf.Options.TargetWaitIntervalCmds = 100
+		assert.Equal(t, false, waitCommandsDue(&conf.Options, 99), "should be equal")
+		assert.Equal(t, true, waitCommandsDue(&conf.Options, 100), "should be equal")
+		conf.Options.TargetWaitReplicas = 0
+		assert.Equal(t, false, waitCommandsDue(&conf.Options, 100), "should be equal")
+		conf.Options.TargetWaitIntervalCmds = 0
+	}
+
+	conf.Options.TargetWaitReplicas = 0
+}
+
+// stop the syncer and wait for Start to return, so the options restored by the test aren't read by it
+func stopSyncer(s *Syncer) {
+	s.Stop()
+	<-s.done
+}
+
+// the routines started by the bare dbSyncer of the test are stopped and waited once the test ends
+func withRoutines(t *testing.T, ds *dbSyncer) *dbSyncer {
+	ctx, cancel := context.WithCancel(context.Background())
+	ds.ctx = ctx
+	t.Cleanup(func() {
+		ds.stopping.Set(true)
+		cancel()
+		ds.routines.Wait()
+	})
+	return ds
+}
+
+func TestStartFakeSlaveOffset(t *testing.T) {
+	var replicas atomic2.Int64
+	// keep the listener open, the offset goroutine connects to it asynchronously
+	l := startFakeWaitTarget(t, &replicas)
+
+	ds := withRoutines(t, &dbSyncer{source: l.Addr().String()})
+	conf.Options.SourceOffsetInterval = 10
+
+	var nr int
+	{
+		fmt.Printf("TestStartFakeSlaveOffset case %d.\n", nr)
+		nr++
+
+		conf.Options.Psync = true
+		conf.Options.SourceFakeSlaveOffset = false
+		assert.Equal(t, false, ds.startFakeSlaveOffset(time.Second, time.Second), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestStartFakeSlaveOffset case %d.\n", nr)
+		nr++
+
+		conf.Options.Psync = false
+		conf.Options.SourceFakeSlaveOffset = true
+		assert.Equal(t, false, ds.startFakeSlaveOffset(time.Second, time.Second), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestStartFakeSlaveOffset case %d.\n", nr)
+		nr++
+
+		conf.Options.Psync = true
+		conf.Options.SourceFakeSlaveOffset = true
+		assert.Equal(t, true, ds.startFakeSlaveOffset(time.Second, time.Second), "should be equal")
+	}
+}
+
+// fake master which replies the given response to psync and then sends the increment
+func startFakePSyncMaster(t *testing.T, psyncReply, incr string) net.Listener {
+	return startFakePSyncMasterInfo(t, psyncReply, incr, nil)
+}
+
+// the fake master which replies the offset stored in offset to info replication
+func startFakePSyncMasterInfo(t *testing.T, psyncReply, incr string, offset *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					switch {
+					case cmd == "psync":
+						conn.Write([]byte(psyncReply))
+						conn.Write([]byte(incr))
+					case cmd == "replconf" && string(args[0]) == "ack":
+						// no reply for ack
+					case cmd == "auth":
+						// no password is required
+						conn.Write([]byte("-ERR AUTH <password> called without any password configured\r\n"))
+					case cmd == "info" && offset != nil:
+						info := fmt.Sprintf("# Replication\r\nrole:master\r\nmaster_repl_offset:%d\r\n", offset.Get())
+						conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)))
+					default:
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestSkipFull(t *testing.T) {
+	conf.Options.Psync = true
+	conf.Options.SyncSkipFull = true
+	conf.Options.SyncSkipFullRunId = "0123456789"
+	conf.Options.SyncSkipFullOffset = 100
+
+	var nr int
+	{
+		fmt.Printf("TestSkipFull case %d.\n", nr)
+		nr++
+
+		// continue succeeds, the rdb phase is skipped
+		l := startFakePSyncMaster(t, "+CONTINUE\r\n", "*1\r\n$4\r\nping\r\n")
+		defer l.Close()
+
+		ds := withRoutines(t, &dbSyncer{source: l.Addr().String()})
+		input, nsize, full := ds.openSource()
+		assert.Equal(t, false, full, "should be equal")
+		assert.Equal(t, int64(0), nsize, "should be equal")
+		assert.Equal(t, int64(100), ds.targetOffset.Get(), "should be equal")
+
+		resp, err := redis.Decode(bufio.NewReader(input))
+		assert.Equal(t, nil, err, "should be equal")
+		cmd, args, err := redis.ParseArgs(resp)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "ping", cmd, "should be equal")
+		assert.Equal(t, 0, len(args), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSkipFull case %d.\n", nr)
+		nr++
+
+		// master can't continue
+		l := startFakePSyncMaster(t, "+FULLRESYNC 0123456789 200\r\n", "")
+		defer l.Close()
+
+		ds := withRoutines(t, &dbSyncer{source: l.Addr().String()})
+		_, ok := ds.sendPSyncContinueCmd(ds.source, "auth", "", nil, conf.Options.SyncSkipFullRunId,
+			conf.Options.SyncSkipFullOffset)
+		assert.Equal(t, false, ok, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSkipFull case %d.\n", nr)
+		nr++
+
+		// source.no_auth, AUTH isn't sent even if the password is given
+		l := startFakePSyncMaster(t, "+CONTINUE\r\n", "")
+		defer l.Close()
+
+		conf.Options.SourceNoAuth = true
+		ds := withRoutines(t, &dbSyncer{source: l.Addr().String()})
+		_, ok := ds.sendPSyncContinueCmd(ds.source, "auth", "pwd", nil, conf.Options.SyncSkipFullRunId,
+			conf.Options.SyncSkipFullOffset)
+		assert.Equal(t, true, ok, "should be equal")
+		conf.Options.SourceNoAuth = false
+	}
+
+	conf.Options.SyncSkipFull = false
+}
+
+func TestListeningPort(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.HttpProfile = 9320
+
+	// record the listening port reported by each connection
+	ports := make(chan string, 8)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					if cmd == "replconf" && string(args[0]) == "listening-port" {
+						ports <- string(args[1])
+					}
+					reply := "+OK\r\n"
+					if cmd == "psync" {
+						reply = "+FULLRESYNC 0123456789 200\r\n"
+					}
+					conn.Write([]byte(reply))
+				}
+			}(conn)
+		}
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestListeningPort case %d.\n", nr)
+		nr++
+
+		// http_profile plus the id by default
+		for id := 0; id < 3; id++ {
+			ds := withRoutines(t, &dbSyncer{id: id, source: l.Addr().String()})
+			ds.sendPSyncContinueCmd(ds.source, "auth", "", nil, "0123456789", 100)
+			assert.Equal(t, strconv.Itoa(9320+id), <-ports, "should be equal")
+		}
+	}
+
+	{
+		fmt.Printf("TestListeningPort case %d.\n", nr)
+		nr++
+
+		conf.Options.SourceReplicaPort = 7000
+		for id := 0; id < 3; id++ {
+			ds := withRoutines(t, &dbSyncer{id: id, source: l.Addr().String()})
+			ds.sendPSyncContinueCmd(ds.source, "auth", "", nil, "0123456789", 100)
+			assert.Equal(t, strconv.Itoa(7000+id), <-ports, "should be equal")
+		}
+	}
+}
+
+// fake target which replies OK to everything and counts the given command
+func startFakeTarget(t *testing.T, command string, count *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					if cmd, _, _ := redis.ParseArgs(resp); cmd == command {
+						count.Incr()
+					}
+					if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestRestoreLimit(t *testing.T) {
+	var restored atomic2.Int64
+	l := startFakeTarget(t, "restore", &restored)
+	defer l.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String("value")), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	conf.Options.Parallel = 3
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.LimitKeyCount = 4
+
+	fullSync := func(ds *dbSyncer) {
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{l.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestRestoreLimit case %d.\n", nr)
+		nr++
+
+		// the syncers run at the same time, the limit is on the total
+		limiter := utils.NewRestoreLimiter(&conf.Options)
+		var wg sync.WaitGroup
+		var ignored atomic2.Int64
+		for i := 0; i < 3; i++ {
+			ds := withRoutines(t, &dbSyncer{id: 100 + i, restoreLimiter: limiter})
+			metric.AddMetric(ds.id)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fullSync(ds)
+				ignored.Add(ds.ignore.Get())
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(4), restored.Get(), "should be equal")
+		assert.Equal(t, int64(26), ignored.Get(), "should be equal")
+		assert.Equal(t, true, limiter.Hit(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRestoreLimit case %d.\n", nr)
+		nr++
+
+		restored.Set(0)
+		limiter := utils.NewRestoreLimiter(&conf.Options)
+		ds1 := withRoutines(t, &dbSyncer{id: 110, restoreLimiter: limiter})
+		ds2 := withRoutines(t, &dbSyncer{id: 111, restoreLimiter: limiter})
+		metric.AddMetric(ds1.id)
+		metric.AddMetric(ds2.id)
+		fullSync(ds1)
+		fullSync(ds2)
+		assert.Equal(t, int64(4), restored.Get(), "should be equal")
+		assert.Equal(t, int64(6), ds1.ignore.Get(), "should be equal")
+		assert.Equal(t, int64(10), ds2.ignore.Get(), "should be equal")
+
+		// the keys of the last full sync of the syncer aren't counted again
+		fullSync(ds1)
+		assert.Equal(t, int64(8), restored.Get(), "should be equal")
+		assert.Equal(t, int64(12), ds1.ignore.Get(), "should be equal")
+		assert.Equal(t, true, ds2.restoreLimiter.Hit(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRestoreLimit case %d.\n", nr)
+		nr++
+
+		// no limit
+		restored.Set(0)
+		conf.Options.LimitKeyCount = 0
+		ds := withRoutines(t, &dbSyncer{id: 120, restoreLimiter: utils.NewRestoreLimiter(&conf.Options)})
+		metric.AddMetric(ds.id)
+		assert.Equal(t, true, ds.restoreLimiter == nil, "should be equal")
+		fullSync(ds)
+		assert.Equal(t, int64(10), restored.Get(), "should be equal")
+		assert.Equal(t, false, ds.restoreLimiter.Hit(), "should be equal")
+	}
+
+	conf.Options.LimitKeyCount = 0
+}
+
+func TestFilterMaxValueBytes(t *testing.T) {
+	var restored atomic2.Int64
+	l := startFakeTarget(t, "restore", &restored)
+	defer l.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 10; i++ {
+		value := "value"
+		if i%3 == 0 {
+			value = strings.Repeat("v", 2048)
+		}
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String(value)), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 2
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.FilterMaxValueBytes = 1024
+
+	var nr int
+	{
+		fmt.Printf("TestFilterMaxValueBytes case %d.\n", nr)
+		nr++
+
+		ds := withRoutines(t, &dbSyncer{id: 101})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{l.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+		// key0, key3, key6 and key9 are skipped
+		assert.Equal(t, int64(6), restored.Get(), "should be equal")
+		assert.Equal(t, int64(4), ds.tooLarge.Get(), "should be equal")
+		assert.Equal(t, int64(4), ds.ignore.Get(), "should be equal")
+		assert.Equal(t, uint64(4), metric.GetMetric(ds.id).GetTooLargeCount(), "should be equal")
+	}
+}
+
+// the same as startRecordTarget, but replies the version to info server
+func startVersionTarget(t *testing.T, version string) *recordTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	rt := &recordTarget{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					reply := "+OK\r\n"
+					if cmd == "info" {
+						info := fmt.Sprintf("# Server\r\nredis_version:%s\r\n", version)
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(info), info)
+					} else if cmd != "config" {
+						strs := []string{cmd}
+						for _, arg := range args {
+							strs = append(strs, string(arg))
+						}
+						rt.mu.Lock()
+						rt.all = append(rt.all, strings.Join(strs, " "))
+						rt.mu.Unlock()
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return rt
+}
+
+func TestVersionMismatch(t *testing.T) {
+	// rdb version 6 can't be loaded by redis 2.4
+	old := startVersionTarget(t, "2.4.0")
+	defer old.Close()
+	compatible := startVersionTarget(t, "5.0.7")
+	defer compatible.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("key"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	options := conf.Options
+	options.Parallel = 1
+	options.BigKeyThreshold = 50 * utils.MB
+	// the version given is used only if info fails
+	options.TargetVersion = "5.0.7"
+
+	var nr int
+	{
+		fmt.Printf("TestVersionMismatch case %d.\n", nr)
+		nr++
+
+		// abort by default before any key is written
+		opts := options
+		conf.FillDefaults(&opts)
+		assert.Equal(t, conf.VersionMismatchAbort, opts.TargetVersionMismatch, "should be equal")
+		ds := withRoutines(t, &dbSyncer{id: 4300, options: &opts})
+		metric.AddMetric(ds.id)
+		log.SetPanicRecoverable(true)
+		defer log.SetPanicRecoverable(false)
+		var fatal interface{}
+		func() {
+			defer func() {
+				fatal = recover()
+			}()
+			ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{old.Addr().String()}, "auth", "",
+				int64(b.Len()), nil)
+		}()
+		_, ok := fatal.(*log.Fatal)
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, 0, len(old.all), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestVersionMismatch case %d.\n", nr)
+		nr++
+
+		// rewrite by commands, the options of the syncer are left untouched
+		opts := options
+		opts.TargetVersionMismatch = conf.VersionMismatchRewrite
+		ds := withRoutines(t, &dbSyncer{id: 4301, options: &opts})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{old.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+		old.mu.Lock()
+		assert.Equal(t, []string{"set key value"}, old.all, "should be equal")
+		old.mu.Unlock()
+		assert.Equal(t, uint64(50*utils.MB), opts.BigKeyThreshold, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestVersionMismatch case %d.\n", nr)
+		nr++
+
+		// the compatible target is restored as usual
+		opts := options
+		opts.TargetVersionMismatch = conf.VersionMismatchAbort
+		ds := withRoutines(t, &dbSyncer{id: 4302, options: &opts})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{compatible.Addr().String()}, "auth",
+			"", int64(b.Len()), nil)
+		compatible.mu.Lock()
+		assert.Equal(t, 1, len(compatible.all), "should be equal")
+		assert.Equal(t, true, strings.HasPrefix(compatible.all[0], "restore key "), "should be equal")
+		compatible.mu.Unlock()
+	}
+}
+
+func TestFilterLogDropped(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 1
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.SenderTargetParallel = 1
+	conf.Options.SenderCount = 16
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+	conf.Options.TargetDB = -1
+	conf.Options.FilterDBBlacklist = []string{"1"}
+	conf.Options.FilterKeyBlacklist = []string{"skip"}
+	conf.Options.FilterTypeBlacklist = []string{"list"}
+	conf.Options.FilterLua = true
+	conf.Options.FilterMaxValueBytes = 1024
+
+	dir, err := ioutil.TempDir("", "log_dropped")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	readLines := func(name string) []string {
+		data, err := ioutil.ReadFile(name)
+		assert.Equal(t, nil, err, "should be equal")
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			// drop the time
+			lines = append(lines, strings.SplitN(line, " ", 3)[2])
+		}
+		return lines
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestFilterLogDropped case %d.\n", nr)
+		nr++
+
+		// the rdb entries
+		var restored atomic2.Int64
+		l := startFakeTarget(t, "restore", &restored)
+		defer l.Close()
+
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte("a"), 0, rdb.String("v")), "should be equal")
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte("skip1"), 0, rdb.String("v")), "should be equal")
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte("list"), 0, rdb.List{[]byte("v")}), "should be equal")
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte("large"), 0, rdb.String(strings.Repeat("v", 2048))),
+			"should be equal")
+		assert.Equal(t, nil, enc.EncodeObject(1, []byte("b"), 0, rdb.String("v")), "should be equal")
+		assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+		name := filepath.Join(dir, "rdb.log")
+		ds := withRoutines(t, &dbSyncer{id: 102, audit: utils.NewDropAudit("dbSyncer[102]", name, 0)})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{l.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+		ds.audit.Close()
+
+		assert.Equal(t, int64(1), restored.Get(), "should be equal")
+		assert.Equal(t, map[string]int64{"key": 1, "type": 1, "size": 1, "db": 1}, ds.audit.Counts(),
+			"should be equal")
+		assert.Equal(t, "db=1 key=1 size=1 type=1", ds.audit.Summary(), "should be equal")
+		// the size is checked in another goroutine ahead of the others
+		lines := readLines(name)
+		sort.Strings(lines)
+		assert.Equal(t, []string{
+			"dbSyncer[102] drop reason[db] db[1] key[b]",
+			"dbSyncer[102] drop reason[key] db[0] key[skip1]",
+			"dbSyncer[102] drop reason[size] db[0] key[large]",
+			"dbSyncer[102] drop reason[type] db[0] key[list]",
+		}, lines, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFilterLogDropped case %d.\n", nr)
+		nr++
+
+		// the increment
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+
+		encode := func(cmd string, args ...interface{}) []byte {
+			data, err := redis.EncodeToBytes(redis.NewCommand(cmd, args...))
+			assert.Equal(t, nil, err, "should be equal")
+			return data
+		}
+		var b bytes.Buffer
+		b.Write(encode("set", "a", "v"))
+		b.Write(encode("set", "skip1", "v"))
+		b.Write(encode("eval", "return 1", "1", "lua"))
+		b.Write(encode("select", "1"))
+		b.Write(encode("mset", "b", "v", "c", "v"))
+		b.Write(encode("select", "0"))
+		b.Write(encode("set", "d", "v"))
+
+		name := filepath.Join(dir, "incr.log")
+		ds := withRoutines(t, &dbSyncer{id: 103, audit: utils.NewDropAudit("dbSyncer[103]", name, 0)})
+		metric.AddMetric(ds.id)
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+		w.Write(b.Bytes())
+		for i := 0; i < 50 && target.count() < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+		ds.audit.Close()
+
+		target.mu.Lock()
+		assert.Equal(t, []string{"set a v", "select 0", "set d v"}, target.all, "should be equal")
+		target.mu.Unlock()
+		assert.Equal(t, map[string]int64{"key": 1, "command": 1, "db": 2}, ds.audit.Counts(), "should be equal")
+		assert.Equal(t, []string{
+			"dbSyncer[103] drop reason[key] db[0] command[set] key[skip1]",
+			"dbSyncer[103] drop reason[command] db[0] command[eval] key[]",
+			"dbSyncer[103] drop reason[db] db[1] command[mset] key[b]",
+			"dbSyncer[103] drop reason[db] db[1] command[mset] key[c]",
+		}, readLines(name), "should be equal")
+	}
+}
+
+func TestEmbeddedSyncer(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var written atomic2.Int64
+	target := startFakeTarget(t, "set", &written)
+	defer target.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String()),
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n")
+	defer source.Close()
+
+	options := DefaultSyncerOptions()
+	options.Parallel = 2
+	options.SourceFakeSlaveOffset = false
+	syncer := NewSyncer(SyncerConfig{
+		Id:      200,
+		Source:  source.Addr().String(),
+		Target:  []string{target.Addr().String()},
+		Options: &options,
+	})
+
+	var nr int
+	{
+		fmt.Printf("TestEmbeddedSyncer case %d.\n", nr)
+		nr++
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- syncer.Start(ctx)
+		}()
+
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.Equal(t, nil, err, "should be equal")
+		case <-time.After(5 * time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+	}
+
+	{
+		fmt.Printf("TestEmbeddedSyncer case %d.\n", nr)
+		nr++
+
+		// can't start twice
+		assert.NotEqual(t, nil, syncer.Start(context.Background()), "should be equal")
+		syncer.Stop()
+	}
+
+	{
+		fmt.Printf("TestEmbeddedSyncer case %d.\n", nr)
+		nr++
+
+		// each syncer keeps its own options, conf.Options isn't replaced
+		assert.Equal(t, old.Parallel, conf.Options.Parallel, "should be equal")
+		assert.Equal(t, 2, syncer.ds.opts().Parallel, "should be equal")
+		another := options
+		another.Parallel = 8
+		syncer2 := NewSyncer(SyncerConfig{
+			Id:      201,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &another,
+		})
+		another.Parallel = 16
+		assert.Equal(t, 8, syncer2.ds.opts().Parallel, "should be equal")
+		assert.Equal(t, 2, syncer.ds.opts().Parallel, "should be equal")
+
+		// the defaults are the ones of the configuration loader
+		defaults := DefaultSyncerOptions()
+		assert.Equal(t, uint(600000), defaults.TargetTimeoutMs, "should be equal")
+		assert.Equal(t, -1, defaults.TargetDB, "should be equal")
+		assert.Equal(t, true, defaults.Psync, "should be equal")
+	}
+}
+
+func TestDelaySample(t *testing.T) {
+	defer func() {
+		conf.Options.DelaySampleRatio = 0
+	}()
+
+	// count the sampled ids in [1, 10000]
+	count := func(l *targetLane) int {
+		n := 0
+		for id := int64(1); id <= 10000; id++ {
+			if l.sampleDelay(conf.Options.DelaySampleRatio, id) {
+				n++
+			}
+		}
+		return n
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestDelaySample case %d.\n", nr)
+		nr++
+
+		// adaptive, small channel: 1:1000
+		conf.Options.DelaySampleRatio = 0
+		l := &targetLane{delayChannel: make(chan *delayNode, 32)}
+		assert.Equal(t, 10, count(l), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDelaySample case %d.\n", nr)
+		nr++
+
+		// adaptive, big channel: 1:1, 1:10 once the available size drops
+		conf.Options.DelaySampleRatio = 0
+		l := &targetLane{delayChannel: make(chan *delayNode, 8192)}
+		assert.Equal(t, 10000, count(l), "should be equal")
+		for i := 0; i < 8192-2048; i++ {
+			l.delayChannel <- &delayNode{}
+		}
+		assert.Equal(t, 1000, count(l), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDelaySample case %d.\n", nr)
+		nr++
+
+		// all
+		conf.Options.DelaySampleRatio = 1
+		l := &targetLane{delayChannel: make(chan *delayNode, 32)}
+		assert.Equal(t, 10000, count(l), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDelaySample case %d.\n", nr)
+		nr++
+
+		// 1:N
+		conf.Options.DelaySampleRatio = 50
+		l := &targetLane{delayChannel: make(chan *delayNode, 32)}
+		assert.Equal(t, 200, count(l), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDelaySample case %d.\n", nr)
+		nr++
+
+		// off
+		conf.Options.DelaySampleRatio = -1
+		l := &targetLane{delayChannel: make(chan *delayNode, 8192)}
+		assert.Equal(t, 0, count(l), "should be equal")
+	}
+}
+
+func TestSourceFailover(t *testing.T) {
+	var restored atomic2.Int64
+	target := startFakeTarget(t, "restore", &restored)
+	defer target.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String("value")), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	conf.Options.Parallel = 2
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+
+	// reconnect to the master and continue from the old runid
+	reconnect := func(ds *dbSyncer, source net.Listener, incrw *bytes.Buffer) (string, int64, bool) {
+		c, err := net.Dial("tcp", source.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+		return ds.pSyncReconnect(c, bufio.NewReader(c), bufio.NewWriter(c), incrw, "0123456789", 100)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestSourceFailover case %d.\n", nr)
+		nr++
+
+		// psync2, continue with the new runid
+		source := startFakePSyncMaster(t, "+CONTINUE 9876543210\r\n", "")
+		defer source.Close()
+
+		ds := withRoutines(t, &dbSyncer{id: 300, target: []string{target.Addr().String()}})
+		var incr bytes.Buffer
+		runid, offset, continued := reconnect(ds, source, &incr)
+		assert.Equal(t, "9876543210", runid, "should be equal")
+		assert.Equal(t, int64(100), offset, "should be equal")
+		assert.Equal(t, true, continued, "should be equal")
+		assert.Equal(t, int64(0), restored.Get(), "should be equal")
+		// the runid before is kept
+		assert.Equal(t, "0123456789", ds.runId2.Load(), "should be equal")
+		assert.Equal(t, int64(100), ds.runId2Offset.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSourceFailover case %d.\n", nr)
+		nr++
+
+		// the new master can't continue, full sync again
+		source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 9876543210 500\r\n$%d\r\n%s", b.Len(),
+			b.String()), "")
+		defer source.Close()
+
+		ds := withRoutines(t, &dbSyncer{id: 301, target: []string{target.Addr().String()}})
+		ds.checkpointOffset.Set(100)
+		metric.AddMetric(ds.id)
+		var incr bytes.Buffer
+		runid, offset, continued := reconnect(ds, source, &incr)
+		assert.Equal(t, "9876543210", runid, "should be equal")
+		assert.Equal(t, int64(500), offset, "should be equal")
+		assert.Equal(t, true, continued, "should be equal")
+		assert.Equal(t, int64(500), ds.targetOffset.Get(), "should be equal")
+		assert.Equal(t, int64(0), ds.checkpointOffset.Get(), "should be equal")
+		assert.Equal(t, int64(2), restored.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSourceFailover case %d.\n", nr)
+		nr++
+
+		// diskless, the increment following the rdb isn't restored
+		mark := strings.Repeat("a", 40)
+		ping := "*1\r\n$4\r\nping\r\n"
+		source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 9876543210 500\r\n$EOF:%s\r\n%s%s%s",
+			mark, b.String(), mark, ping), "")
+		defer source.Close()
+
+		restored.Set(0)
+		ds := withRoutines(t, &dbSyncer{id: 302, target: []string{target.Addr().String()}})
+		metric.AddMetric(ds.id)
+		var incr bytes.Buffer
+		runid, offset, _ := reconnect(ds, source, &incr)
+		assert.Equal(t, "9876543210", runid, "should be equal")
+		assert.Equal(t, int64(500+len(ping)), offset, "should be equal")
+		assert.Equal(t, int64(2), restored.Get(), "should be equal")
+		assert.Equal(t, ping, incr.String(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSourceFailover case %d.\n", nr)
+		nr++
+
+		// the runid is rejected, retry the runid before since the offset isn't beyond the switch
+		source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 9876543210 500\r\n$%d\r\n%s", b.Len(),
+			b.String()), "")
+		defer source.Close()
+
+		restored.Set(0)
+		ds := withRoutines(t, &dbSyncer{id: 303, target: []string{target.Addr().String()}})
+		metric.AddMetric(ds.id)
+		ds.switchRunId("1111111111", 100)
+		var incr bytes.Buffer
+		runid, offset, continued := reconnect(ds, source, &incr)
+		assert.Equal(t, "1111111111", runid, "should be equal")
+		assert.Equal(t, int64(100), offset, "should be equal")
+		assert.Equal(t, false, continued, "should be equal")
+		assert.Equal(t, int64(0), restored.Get(), "should be equal")
+
+		// only once, full sync if it's rejected again
+		runid, offset, continued = reconnect(ds, source, &incr)
+		assert.Equal(t, "9876543210", runid, "should be equal")
+		assert.Equal(t, int64(500), offset, "should be equal")
+		assert.Equal(t, true, continued, "should be equal")
+		assert.Equal(t, int64(2), restored.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSourceFailover case %d.\n", nr)
+		nr++
+
+		// the offset is beyond the switch, the runid before can't continue
+		source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 9876543210 500\r\n$%d\r\n%s", b.Len(),
+			b.String()), "")
+		defer source.Close()
+
+		restored.Set(0)
+		ds := withRoutines(t, &dbSyncer{id: 304, target: []string{target.Addr().String()}})
+		metric.AddMetric(ds.id)
+		ds.switchRunId("1111111111", 50)
+		var incr bytes.Buffer
+		runid, offset, continued := reconnect(ds, source, &incr)
+		assert.Equal(t, "9876543210", runid, "should be equal")
+		assert.Equal(t, int64(500), offset, "should be equal")
+		assert.Equal(t, true, continued, "should be equal")
+		assert.Equal(t, int64(2), restored.Get(), "should be equal")
+		assert.Equal(t, "", ds.runId2.Load(), "should be equal")
+	}
+}
+
+// fake target which records the commands received on each connection, the first failConns
+// connections reply error to all the commands
+type recordTarget struct {
+	net.Listener
+	mu       sync.Mutex
+	commands [][]string // commands of each connection
+	all      []string   // commands of all the connections in the receiving order
+}
+
+func startRecordTarget(t *testing.T, failConns int) *recordTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	rt := &recordTarget{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rt.mu.Lock()
+			idx := len(rt.commands)
+			rt.commands = append(rt.commands, nil)
+			rt.mu.Unlock()
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					rt.mu.Lock()
+					rt.commands[idx] = append(rt.commands[idx], strings.Join(strs, " "))
+					rt.all = append(rt.all, strings.Join(strs, " "))
+					rt.mu.Unlock()
+					reply := "+OK\r\n"
+					if idx < failConns {
+						reply = "-ERR fake failure\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return rt
+}
+
+// the same as startRecordTarget, but the connection is closed without replying once the key comes
+// for the first time
+func startBreakingTarget(t *testing.T, key string) *recordTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	rt := &recordTarget{Listener: l}
+	var broken atomic2.Bool
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rt.mu.Lock()
+			idx := len(rt.commands)
+			rt.commands = append(rt.commands, nil)
+			rt.mu.Unlock()
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					rt.mu.Lock()
+					rt.commands[idx] = append(rt.commands[idx], strings.Join(strs, " "))
+					rt.all = append(rt.all, strings.Join(strs, " "))
+					rt.mu.Unlock()
+					if len(args) != 0 && string(args[0]) == key && broken.CompareAndSwap(false, true) {
+						return
+					}
+					if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return rt
+}
+
+func (rt *recordTarget) count() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	n := 0
+	for _, cmds := range rt.commands {
+		n += len(cmds)
+	}
+	return n
+}
+
+func TestTargetParallel(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SenderTargetParallel = 4
+	conf.Options.SenderCount = 16
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+
+	target := startRecordTarget(t, 0)
+	defer target.Close()
+
+	var nr int
+	{
+		fmt.Printf("TestTargetParallel case %d.\n", nr)
+		nr++
+
+		var b bytes.Buffer
+		encode := func(cmd string, args ...interface{}) {
+			data, err := redis.EncodeToBytes(redis.NewCommand(cmd, args...))
+			assert.Equal(t, nil, err, "should be equal")
+			b.Write(data)
+		}
+		for i := 0; i < 50; i++ {
+			for k := 0; k < 8; k++ {
+				encode("set", fmt.Sprintf("key%d", k), i)
+			}
+		}
+		// sent after all the commands before it are done
+		encode("flushall")
+		encode("set", "key0", "last")
+		total := 50*8 + 2
+
+		ds := withRoutines(t, &dbSyncer{id: 400})
+		metric.AddMetric(ds.id)
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+		w.Write(b.Bytes())
+		for i := 0; i < 50 && target.count() < total; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+
+		assert.Equal(t, total, target.count(), "should be equal")
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		assert.Equal(t, 4, len(target.commands), "should be equal")
+
+		// flushall waits for all the commands before it, and the following ones wait for it
+		assert.Equal(t, "flushall", target.all[total-2], "should be equal")
+		assert.Equal(t, "set key0 last", target.all[total-1], "should be equal")
+
+		// the commands of the same key are on the same connection in order
+		used := 0
+		for _, cmds := range target.commands {
+			if len(cmds) != 0 {
+				used++
+			}
+			next := make(map[string]int)
+			for _, cmd := range cmds {
+				args := strings.Split(cmd, " ")
+				if args[0] == "flushall" || args[2] == "last" {
+					continue
+				}
+				assert.Equal(t, strconv.Itoa(next[args[1]]), args[2], "should be equal")
+				next[args[1]]++
+			}
+			for key, n := range next {
+				assert.Equal(t, 50, n, key)
+			}
+		}
+		assert.Equal(t, true, used > 1, "should be equal")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SenderTargetParallel = 1
+	conf.Options.SenderCount = 16
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+	conf.Options.Metric = true
+	conf.Options.TargetDB = -1
+	conf.Options.TargetErrorRate = 50
+	conf.Options.TargetErrorWindow = 10
+	conf.Options.TargetErrorMaxTrips = 3
+
+	// the first connection fails all the commands
+	target := startRecordTarget(t, 1)
+	defer target.Close()
+
+	var nr int
+	{
+		fmt.Printf("TestCircuitBreaker case %d.\n", nr)
+		nr++
+
+		encode := func(cmd string, args ...interface{}) []byte {
+			data, err := redis.EncodeToBytes(redis.NewCommand(cmd, args...))
+			assert.Equal(t, nil, err, "should be equal")
+			return data
+		}
+
+		ds := withRoutines(t, &dbSyncer{id: 500})
+		metric.AddMetric(ds.id)
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+
+		w.Write(encode("select", "1"))
+		for i := 0; i < 30; i++ {
+			w.Write(encode("set", fmt.Sprintf("key%d", i), i))
+		}
+		for i := 0; i < 50 && ds.GetExtraInfo()["BreakerState"] != utils.BreakerOpen; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, utils.BreakerOpen, ds.GetExtraInfo()["BreakerState"], "should be equal")
+
+		// sent on the new connection after reconnecting
+		for i := 0; i < 10; i++ {
+			w.Write(encode("set", fmt.Sprintf("key%d", i), "again"))
+		}
+		for i := 0; i < 50 && target.count() < 31+11; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, utils.BreakerClosed, ds.GetExtraInfo()["BreakerState"], "should be equal")
+		assert.Equal(t, 1, ds.GetExtraInfo()["BreakerTrips"], "should be equal")
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		assert.Equal(t, 2, len(target.commands), "should be equal")
+		assert.Equal(t, 31, len(target.commands[0]), "should be equal")
+		assert.Equal(t, 11, len(target.commands[1]), "should be equal")
+		// the db is selected again on the new connection
+		assert.Equal(t, "select 1", target.commands[1][0], "should be equal")
+		assert.Equal(t, "set key9 again", target.commands[1][10], "should be equal")
+	}
+}
+
+// fake target which replies DUMP with the given payloads, TYPE/HLEN/HMGET with the given hashes and
+// counts the other commands except select
+func startFakeDumpTarget(t *testing.T, dumps map[string][]byte, hashes map[string]map[string]string,
+	writes *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					var reply []byte
+					switch {
+					case cmd == "dump" && len(args) == 1:
+						if p, ok := dumps[string(args[0])]; ok {
+							reply = []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(p), p))
+						} else {
+							reply = []byte("$-1\r\n")
+						}
+					case cmd == "type" && len(args) == 1:
+						if _, ok := hashes[string(args[0])]; ok {
+							reply = []byte("+hash\r\n")
+						} else if _, ok := dumps[string(args[0])]; ok {
+							reply = []byte("+string\r\n")
+						} else {
+							reply = []byte("+none\r\n")
+						}
+					case cmd == "hlen" && len(args) == 1:
+						reply = []byte(fmt.Sprintf(":%d\r\n", len(hashes[string(args[0])])))
+					case cmd == "hmget" && len(args) > 1:
+						reply = []byte(fmt.Sprintf("*%d\r\n", len(args)-1))
+						for _, field := range args[1:] {
+							if v, ok := hashes[string(args[0])][string(field)]; ok {
+								reply = append(reply, fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)...)
+							} else {
+								reply = append(reply, "$-1\r\n"...)
+							}
+						}
+					case cmd == "select":
+						reply = []byte("+OK\r\n")
+					default:
+						writes.Incr()
+						reply = []byte("+OK\r\n")
+					}
+					if _, err := conn.Write(reply); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestVerify(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 2
+	conf.Options.BigKeyThreshold = 32
+	conf.Options.TargetDB = -1
+	conf.Options.SyncMode = conf.SyncModeVerify
+
+	big := strings.Repeat("x", 64)
+	dump := func(value string) []byte {
+		p, err := rdb.EncodeDump(rdb.String(value))
+		assert.Equal(t, nil, err, "should be equal")
+		return p
+	}
+	same := dump("value")
+	// the target with another rdb version still matches
+	same[len(same)-10]++
+	dumps := map[string][]byte{
+		"same":    same,
+		"diff":    dump("other"),
+		"bigsame": dump(big),
+		"bigdiff": dump(big + "y"),
+	}
+	// the hash larger than 16MB is split into parts by the loader
+	var hash rdb.Hash
+	fields := make(map[string]string)
+	fieldValue := strings.Repeat("v", 1024)
+	for i := 0; i < 17000; i++ {
+		field := fmt.Sprintf("field%d", i)
+		hash = append(hash, &rdb.HashElement{Field: []byte(field), Value: []byte(fieldValue)})
+		fields[field] = fieldValue
+	}
+	// the last field in the last part differs
+	diffFields := make(map[string]string)
+	for field, value := range fields {
+		diffFields[field] = value
+	}
+	diffFields["field16999"] = "other"
+	hashes := map[string]map[string]string{
+		"hashsame": fields,
+		"hashdiff": diffFields,
+	}
+	var writes atomic2.Int64
+	l := startFakeDumpTarget(t, dumps, hashes, &writes)
+	defer l.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for key, value := range map[string]string{"same": "value", "diff": "value", "missing": "value",
+		"bigsame": big, "bigdiff": big} {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(key), 0, rdb.String(value)), "should be equal")
+	}
+	for _, key := range []string{"hashsame", "hashdiff", "hashmissing"} {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(key), 0, hash), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	var nr int
+	{
+		fmt.Printf("TestVerify case %d.\n", nr)
+		nr++
+
+		ds := withRoutines(t, &dbSyncer{id: 600})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{l.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+		info := ds.GetExtraInfo()
+		assert.Equal(t, int64(3), info["VerifyMatch"], "should be equal")
+		assert.Equal(t, int64(3), info["VerifyMismatch"], "should be equal")
+		assert.Equal(t, int64(2), info["VerifyMissing"], "should be equal")
+		assert.Equal(t, 0, len(ds.verifySplit), "should be equal")
+		assert.Equal(t, int64(0), info["VerifySkip"], "should be equal")
+		// nothing is written
+		assert.Equal(t, int64(0), writes.Get(), "should be equal")
+	}
+}
+
+func TestSyncerEvents(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var written atomic2.Int64
+	target := startFakeTarget(t, "set", &written)
+	defer target.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String()),
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n")
+	defer source.Close()
+
+	options := DefaultSyncerOptions()
+	options.Parallel = 2
+	options.SourceFakeSlaveOffset = false
+
+	var nr int
+	{
+		fmt.Printf("TestSyncerEvents case %d.\n", nr)
+		nr++
+
+		syncer := NewSyncer(SyncerConfig{
+			Id:      700,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- syncer.Start(ctx)
+		}()
+
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+
+		var types []EventType
+		for len(syncer.Events()) > 0 {
+			ev := <-syncer.Events()
+			assert.Equal(t, 700, ev.Syncer, "should be equal")
+			types = append(types, ev.Type)
+		}
+		assert.Equal(t, []EventType{EventSourceConnected, EventFullSyncStarted, EventFullSyncDone,
+			EventIncrSyncStarted, EventStopped}, types, "should be equal")
+		assert.Equal(t, int64(0), syncer.DroppedEvents(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSyncerEvents case %d.\n", nr)
+		nr++
+
+		// never block the sync if nobody takes the events
+		ds := withRoutines(t, &dbSyncer{id: 701, events: make(chan Event, 1)})
+		ds.emit(EventFullSyncStarted, "")
+		ds.emit(EventFullSyncDone, "entry = %d", 1)
+		assert.Equal(t, int64(1), ds.eventsDropped.Get(), "should be equal")
+		assert.Equal(t, EventFullSyncStarted, (<-ds.events).Type, "should be equal")
+	}
+}
+
+// writer which counts the bytes written
+type countWriter struct {
+	n atomic2.Int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func TestSourceMaxInflight(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SourceMaxInflightBytes = 64 * 1024
+	conf.Options.SourceFakeSlaveOffset = true
+
+	const total = 1024 * 1024
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	defer l.Close()
+	closeSource := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn) // acks
+		conn.Write(bytes.Repeat([]byte("x"), total))
+		<-closeSource
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err, "should be equal")
+
+	ds := withRoutines(t, &dbSyncer{id: 800, waitFull: make(chan struct{})})
+	close(ds.waitFull)
+	ds.applyOffset.Set(100)
+	var copied countWriter
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := ds.pSyncPipeCopy(c, bufio.NewReader(c), bufio.NewWriter(c), 100, &copied)
+		done <- n
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestSourceMaxInflight case %d.\n", nr)
+		nr++
+
+		// nothing is parsed, reading stops at the limit
+		time.Sleep(500 * time.Millisecond)
+		assert.Equal(t, true, copied.n.Get() >= conf.Options.SourceMaxInflightBytes, "should be equal")
+		assert.Equal(t, true, copied.n.Get() <= conf.Options.SourceMaxInflightBytes+8192, "should be equal")
+		assert.Equal(t, int64(1), ds.inflightThrottled.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSourceMaxInflight case %d.\n", nr)
+		nr++
+
+		// the consumer catches up
+		ds.applyOffset.Set(100 + total)
+		for i := 0; i < 50 && copied.n.Get() < total; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(total), copied.n.Get(), "should be equal")
+
+		ds.stopping.Set(true)
+		close(closeSource)
+		assert.Equal(t, int64(total), <-done, "should be equal")
+	}
+}
+
+func TestSlotRangeRestored(t *testing.T) {
+	var restored atomic2.Int64
+	l := startFakeTarget(t, "restore", &restored)
+	defer l.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	// slot of foo is 12182, bar is 5061, hello is 866
+	for _, key := range []string{"foo", "{foo}a", "bar", "hello", "skip:foo"} {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(key), 0, rdb.String("v")), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 2
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.FilterKeyBlacklist = []string{"skip:"}
+
+	var nr int
+	{
+		fmt.Printf("TestSlotRangeRestored case %d.\n", nr)
+		nr++
+
+		ds := withRoutines(t, &dbSyncer{id: 104})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{l.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+		assert.Equal(t, int64(4), restored.Get(), "should be equal")
+
+		// only shown when the target is cluster
+		_, ok := ds.GetExtraInfo()["SlotRangeRestored"]
+		assert.Equal(t, false, ok, "should be equal")
+
+		conf.Options.TargetType = conf.RedisTypeCluster
+		slots := ds.GetExtraInfo()["SlotRangeRestored"].(map[string]int64)
+		assert.Equal(t, utils.SlotRangeCount, len(slots), "should be equal")
+		assert.Equal(t, int64(2), slots["11264-12287"], "should be equal")
+		assert.Equal(t, int64(1), slots["4096-5119"], "should be equal")
+		assert.Equal(t, int64(1), slots["0-1023"], "should be equal")
+		assert.Equal(t, int64(0), slots["15360-16383"], "should be equal")
+	}
+}
+
+// fake target with the given number of dbs, which records the db and key of each write
+type dbRangeTarget struct {
+	net.Listener
+	mu     sync.Mutex
+	writes []string // "${db} ${command} ${key}"
+}
+
+func startFakeDBRangeTarget(t *testing.T, databases int) *dbRangeTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	rt := &dbRangeTarget{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				db := 0
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					reply := "+OK\r\n"
+					switch cmd {
+					case "select":
+						if n, _ := strconv.Atoi(string(args[0])); n >= databases {
+							reply = "-ERR DB index is out of range\r\n"
+						} else {
+							db = n
+						}
+					case "restore", "set":
+						rt.mu.Lock()
+						rt.writes = append(rt.writes, fmt.Sprintf("%d %s %s", db, cmd, args[0]))
+						rt.mu.Unlock()
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return rt
+}
+
+func (rt *dbRangeTarget) count() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return len(rt.writes)
+}
+
+func (rt *dbRangeTarget) sorted() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	ret := append([]string{}, rt.writes...)
+	sort.Strings(ret)
+	rt.writes = nil
+	return ret
+}
+
+func TestDBOutOfRange(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 2
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.TargetDB = -1
+	conf.Options.SenderTargetParallel = 1
+	conf.Options.SenderCount = 16
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+
+	// the target has db0 and db1 only
+	target := startFakeDBRangeTarget(t, 2)
+	defer target.Close()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for _, db := range []uint32{0, 1, 3} {
+		assert.Equal(t, nil, enc.EncodeObject(db, []byte(fmt.Sprintf("key%d", db)), 0, rdb.String("v")),
+			"should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	encode := func(cmd string, args ...interface{}) []byte {
+		data, err := redis.EncodeToBytes(redis.NewCommand(cmd, args...))
+		assert.Equal(t, nil, err, "should be equal")
+		return data
+	}
+	var incr bytes.Buffer
+	incr.Write(encode("set", "a", "v"))
+	incr.Write(encode("select", "3"))
+	incr.Write(encode("set", "b", "v"))
+	incr.Write(encode("select", "1"))
+	incr.Write(encode("set", "c", "v"))
+
+	run := func(id, writes int) {
+		ds := withRoutines(t, &dbSyncer{id: id})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{target.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+		w.Write(incr.Bytes())
+		for i := 0; i < 50 && target.count() < writes; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestDBOutOfRange case %d.\n", nr)
+		nr++
+
+		// skip drops the data of db3
+		conf.Options.TargetDBOutOfRange = conf.DBOutOfRangeSkip
+		run(105, 4)
+		assert.Equal(t, []string{"0 restore key0", "0 set a", "1 restore key1", "1 set c"}, target.sorted(),
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestDBOutOfRange case %d.\n", nr)
+		nr++
+
+		// remap writes the data of db3 into db0
+		conf.Options.TargetDBOutOfRange = conf.DBOutOfRangeRemap
+		run(106, 6)
+		assert.Equal(t, []string{"0 restore key0", "0 restore key3", "0 set a", "0 set b", "1 restore key1",
+			"1 set c"}, target.sorted(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDBOutOfRange case %d.\n", nr)
+		nr++
+
+		// error doesn't check the db and SELECT fails
+		conf.Options.TargetDBOutOfRange = conf.DBOutOfRangeError
+		dc := utils.NewTargetDBChecker(&conf.Options, func() redigo.Conn {
+			t.Error("shouldn't be opened")
+			return nil
+		})
+		db, pass := dc.Map(3)
+		assert.Equal(t, 3, db, "should be equal")
+		assert.Equal(t, true, pass, "should be equal")
+
+		c, err := redigo.Dial("tcp", target.Addr().String())
+		assert.Equal(t, nil, err, "should be equal")
+		defer c.Close()
+		_, err = c.Do("select", 3)
+		assert.Equal(t, true, utils.IsDBOutOfRangeError(err), "should be equal")
+	}
+}
+
+func TestSourceReconnectTimeout(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SourceTimeoutMs = 300
+
+	// the master continues the psync and then sends nothing, like the connection half-open
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	defer l.Close()
+	var psyncs atomic2.Int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					switch {
+					case cmd == "psync":
+						psyncs.Incr()
+						conn.Write([]byte("+CONTINUE\r\n"))
+					case cmd == "replconf" && string(args[0]) == "ack":
+					default:
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestSourceReconnectTimeout case %d.\n", nr)
+		nr++
+
+		// the connection reopened times out as well, so it's reopened again instead of hanging
+		ds := withRoutines(t, &dbSyncer{id: 1550})
+		metric.AddMetric(ds.id)
+		c, peer := net.Pipe()
+		peer.Close()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.pSyncIncr(c, bufio.NewReader(c), bufio.NewWriter(c), ioutil.Discard, l.Addr().String(), "auth", "",
+				nil, "0123456789", 100)
+		}()
+		for i := 0; i < 60 && psyncs.Get() < 2; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, true, psyncs.Get() >= 2, "should be equal")
+		ds.stopping.Set(true)
+		<-done
+	}
+}
+
+func TestReconnectLoop(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	conf.Options.SourceReconnectLimit = 3
+	conf.Options.SourceReconnectWindow = 60
+
+	var nr int
+	{
+		fmt.Printf("TestReconnectLoop case %d.\n", nr)
+		nr++
+
+		// the source is reconnected again and again at the same offset
+		ds := NewDbSyncer(1500, "", "", nil, "", 0, nil)
+		ds.targetOffset.Set(100)
+		var err error
+		var reconnects int
+		for err == nil && reconnects < 10 {
+			err = ds.checkReconnectLoop()
+			reconnects++
+		}
+		assert.NotEqual(t, nil, err, "should be equal")
+		assert.Equal(t, 5, reconnects, "should be equal")
+		assert.Equal(t, true, strings.Contains(err.Error(), "reconnected 4 times in 60s"), "should be equal")
+
+		info := ds.GetExtraInfo()
+		assert.Equal(t, int64(5), info["ReconnectCount"], "should be equal")
+		assert.Equal(t, uint64(5), metric.GetMetric(ds.id).GetReconnectCount(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestReconnectLoop case %d.\n", nr)
+		nr++
+
+		// the offset advances between the reconnects
+		ds := NewDbSyncer(1501, "", "", nil, "", 0, nil)
+		for i := 0; i < 10; i++ {
+			ds.targetOffset.Add(10)
+			assert.Equal(t, nil, ds.checkReconnectLoop(), "should be equal")
+		}
+		assert.Equal(t, int64(10), ds.GetExtraInfo()["ReconnectCount"], "should be equal")
+	}
+}
+
+func TestFullSyncStat(t *testing.T) {
+	var nr int
+	{
+		fmt.Printf("TestFullSyncStat case %d.\n", nr)
+		nr++
+
+		s := &fullSyncStat{Duration: 10 * time.Second, Bytes: 100 * utils.MB}
+		assert.Equal(t, float64(10), s.Throughput(), "should be equal")
+		s = &fullSyncStat{Duration: 500 * time.Millisecond, Bytes: 3 * utils.MB}
+		assert.Equal(t, float64(6), s.Throughput(), "should be equal")
+		s = &fullSyncStat{Bytes: 100}
+		assert.Equal(t, float64(0), s.Throughput(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFullSyncStat case %d.\n", nr)
+		nr++
+
+		var restored atomic2.Int64
+		l := startFakeTarget(t, "restore", &restored)
+		defer l.Close()
+
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+				rdb.String("value")), "should be equal")
+		}
+		assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+		old := conf.Options
+		defer func() {
+			conf.Options = old
+		}()
+		conf.Options.Parallel = 2
+		conf.Options.BigKeyThreshold = 50 * utils.MB
+
+		ds := withRoutines(t, &dbSyncer{id: 1600})
+		metric.AddMetric(ds.id)
+		assert.Equal(t, (*fullSyncStat)(nil), ds.LastFullSync(), "should be equal")
+		_, ok := ds.GetExtraInfo()["LastFullSync"]
+		assert.Equal(t, false, ok, "should be equal")
+
+		// the stats of the second full sync replace the first one instead of adding up
+		for i := 0; i < 2; i++ {
+			ds.rbytes.Set(0)
+			ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{l.Addr().String()}, "auth", "",
+				int64(b.Len()), nil)
+			s := ds.LastFullSync()
+			assert.Equal(t, int64(b.Len()), s.Bytes, "should be equal")
+			assert.Equal(t, int64(10), s.Entries, "should be equal")
+			assert.Equal(t, true, s.Duration > 0, "should be equal")
+			info := ds.GetExtraInfo()["LastFullSync"].(map[string]interface{})
+			assert.Equal(t, int64(10), info["Entries"], "should be equal")
+			assert.Equal(t, s.Throughput(), info["ThroughputMBps"], "should be equal")
+		}
+	}
+}
+
+func TestRdbChecksum(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SourceRdbChecksum = true
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("key"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	ping := "*1\r\n$4\r\nping\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestRdbChecksum case %d.\n", nr)
+		nr++
+
+		// the rdb is written after validated, followed by the increment
+		ds := withRoutines(t, &dbSyncer{id: 1700})
+		var out bytes.Buffer
+		br := bufio.NewReader(strings.NewReader(b.String() + ping))
+		assert.Equal(t, int64(0), ds.copyPSyncRdb(br, &out, &out, utils.RdbSize{Size: int64(b.Len())}),
+			"should be equal")
+		assert.Equal(t, b.String(), out.String(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestRdbChecksum case %d.\n", nr)
+		nr++
+
+		// diskless
+		mark := []byte(strings.Repeat("a", utils.RdbEOFMarkSize))
+		ds := withRoutines(t, &dbSyncer{id: 1701})
+		var rdbw, incrw bytes.Buffer
+		br := bufio.NewReader(strings.NewReader(b.String() + string(mark) + ping))
+		rest := ds.copyPSyncRdb(br, &rdbw, &incrw, utils.RdbSize{Size: utils.RdbSizeUnknown, EOFMark: mark})
+		assert.Equal(t, int64(len(ping)), rest, "should be equal")
+		assert.Equal(t, b.String(), rdbw.String(), "should be equal")
+		assert.Equal(t, ping, incrw.String(), "should be equal")
+	}
+}
+
+// target which replies the set of the keys prefixed by "slow" after delay
+func startSlowTarget(t *testing.T, delay time.Duration, written, slow *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					if cmd, args, _ := redis.ParseArgs(resp); cmd == "set" {
+						if strings.HasPrefix(string(args[0]), "slow") {
+							slow.Incr()
+							time.Sleep(delay)
+						}
+						written.Incr()
+					}
+					if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestDrain(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+
+	start := func(id int, source, target net.Listener, timeoutMs int) (*Syncer, chan error) {
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.ShutdownDrainTimeoutMs = timeoutMs
+		syncer := NewSyncer(SyncerConfig{
+			Id:      id,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- syncer.Start(context.Background())
+		}()
+		<-syncer.WaitFull()
+		return syncer, done
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestDrain case %d.\n", nr)
+		nr++
+
+		// all the commands are replied in time
+		var written, slow atomic2.Int64
+		target := startSlowTarget(t, 100*time.Millisecond, &written, &slow)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, set("a")+set("slow1"))
+		defer source.Close()
+
+		syncer, done := start(1800, source, target, 2000)
+		for i := 0; i < 50 && slow.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(0), syncer.Drain(2*time.Second), "should be equal")
+		select {
+		case err := <-done:
+			assert.Equal(t, nil, err, "should be equal")
+		case <-time.After(time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+		assert.Equal(t, int64(2), written.Get(), "should be equal")
+		// the offset of the last command is confirmed
+		assert.Equal(t, true, syncer.ds.applyOffset.Get() > 0, "should be equal")
+		assert.Equal(t, syncer.ds.applyOffset.Get(), syncer.ds.checkpointOffset.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDrain case %d.\n", nr)
+		nr++
+
+		// the target is too slow, exit once the drain times out
+		var written, slow atomic2.Int64
+		target := startSlowTarget(t, 3*time.Second, &written, &slow)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, set("a")+set("slow1")+set("slow2"))
+		defer source.Close()
+
+		syncer, done := start(1801, source, target, 300)
+		for i := 0; i < 50 && slow.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		begin := time.Now()
+		assert.Equal(t, int64(2), syncer.Drain(2*time.Second), "should be equal")
+		assert.Equal(t, true, time.Since(begin) < 2*time.Second, "should be equal")
+		select {
+		case err := <-done:
+			assert.Equal(t, nil, err, "should be equal")
+		case <-time.After(time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+		// the offset isn't confirmed without all the replies
+		assert.Equal(t, int64(0), syncer.ds.checkpointOffset.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDrain case %d.\n", nr)
+		nr++
+
+		// not started
+		syncer := NewSyncer(SyncerConfig{Id: 1802})
+		assert.Equal(t, int64(0), syncer.Drain(time.Second), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestDrain case %d.\n", nr)
+		nr++
+
+		// the shutdown of CmdSync on the signal, the syncers are stopped after the replies
+		var written, slow atomic2.Int64
+		target := startSlowTarget(t, 100*time.Millisecond, &written, &slow)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, set("slow1"))
+		defer source.Close()
+
+		syncer, _ := start(1803, source, target, 2000)
+		cmd := &CmdSync{dbSyncers: []*dbSyncer{syncer.ds, nil}, syncers: []*Syncer{syncer, nil}}
+		for i := 0; i < 50 && slow.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(0), cmd.Drain(2*time.Second), "should be equal")
+		select {
+		case <-syncer.done:
+		case <-time.After(time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+		assert.Equal(t, syncer.ds.applyOffset.Get(), syncer.ds.confirmedOffset(), "should be equal")
+	}
+}
+
+func TestPause(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	var written atomic2.Int64
+	target := startFakeTarget(t, "set", &written)
+	defer target.Close()
+	source := startFakePSyncMaster(t, full, set)
+	defer source.Close()
+
+	options := DefaultSyncerOptions()
+	options.Parallel = 2
+	options.SourceFakeSlaveOffset = false
+	syncer := NewSyncer(SyncerConfig{
+		Id:      2200,
+		Source:  source.Addr().String(),
+		Target:  []string{target.Addr().String()},
+		Options: &options,
+	})
+	cmd := &CmdSync{dbSyncers: []*dbSyncer{syncer.ds}, syncers: []*Syncer{syncer}}
+
+	var nr int
+	{
+		fmt.Printf("TestPause case %d.\n", nr)
+		nr++
+
+		// nothing is sent to the target once paused
+		ret := cmd.Pause().([]map[string]interface{})
+		assert.Equal(t, 1, len(ret), "should be equal")
+		assert.Equal(t, true, ret[0]["Paused"], "should be equal")
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.applyOffset.Get() == 100; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, int64(0), written.Get(), "should be equal")
+		assert.Equal(t, true, syncer.ds.GetExtraInfo()["Paused"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestPause case %d.\n", nr)
+		nr++
+
+		// the commands queued are sent after resuming
+		ret := cmd.Resume().([]map[string]interface{})
+		assert.Equal(t, false, ret[0]["Paused"], "should be equal")
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+	}
+}
+
+func TestTargetReconnect(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+	selectDB := "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestTargetReconnect case %d.\n", nr)
+		nr++
+
+		// the connection closed by the target is reopened, and the command not replied is sent again
+		target := startBreakingTarget(t, "broken")
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, selectDB+set("a")+set("broken"))
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.TargetReconnectRetries = 3
+		options.TargetReconnectBackoff = 10
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2300,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.targetReconnects.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), syncer.ds.targetReconnects.Get(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.unconfirmed(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		// the db replied before is selected first
+		last := target.commands[len(target.commands)-1]
+		assert.Equal(t, []string{"select 1", "set broken 1"}, last, "should be equal")
+		assert.Equal(t, []string{"select 1", "set a 1", "set broken 1"}, target.commands[len(target.commands)-2],
+			"should be equal")
+	}
+
+	{
+		fmt.Printf("TestTargetReconnect case %d.\n", nr)
+		nr++
+
+		// broken in the transaction of the source, the commands queued before are queued again
+		multi := "*1\r\n$5\r\nmulti\r\n"
+		exec := "*1\r\n$4\r\nexec\r\n"
+		target := startBreakingTarget(t, "broken")
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, selectDB+multi+set("a")+set("broken")+exec+set("b"))
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.TargetReconnectRetries = 3
+		options.TargetReconnectBackoff = 10
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2301,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.targetReconnects.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), syncer.ds.targetReconnects.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		last := target.commands[len(target.commands)-1]
+		assert.Equal(t, []string{"select 1", "multi", "set a 1", "set broken 1", "exec", "set b 1"}, last,
+			"should be equal")
+	}
+}
+
+func TestSenderTransaction(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+	multi := "*1\r\n$5\r\nmulti\r\n"
+	exec := "*1\r\n$4\r\nexec\r\n"
+	selectDB := "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestSenderTransaction case %d.\n", nr)
+		nr++
+
+		// each batch is in multi/exec, the transaction of the source is kept in one batch
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, set("a")+multi+set("b")+set("c")+exec+set("d"))
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SenderTransaction = true
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2500,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.forward.Get() < 4; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(4), syncer.ds.forward.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		// the commands of each batch joined by ";", multi and exec are never nested
+		var batches []string
+		var batch []string
+		for _, cmd := range target.commands[len(target.commands)-1] {
+			switch cmd {
+			case "multi":
+				assert.Equal(t, []string(nil), batch, "should be equal")
+				batch = []string{}
+			case "exec":
+				batches = append(batches, strings.Join(batch, ";"))
+				batch = nil
+			default:
+				batch = append(batch, cmd)
+			}
+		}
+		assert.Equal(t, []string(nil), batch, "should be equal")
+		assert.Equal(t, "set a 1;set b 1;set c 1;set d 1", strings.Join(batches, ";"), "should be equal")
+		for _, batch := range batches {
+			assert.Equal(t, strings.Contains(batch, "set b 1"), strings.Contains(batch, "set c 1"), "should be equal")
+		}
+	}
+
+	{
+		fmt.Printf("TestSenderTransaction case %d.\n", nr)
+		nr++
+
+		// the commands queued before the connection is broken are queued again
+		target := startBreakingTarget(t, "broken")
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, selectDB+set("a")+set("broken"))
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SenderTransaction = true
+		options.TargetReconnectRetries = 3
+		options.TargetReconnectBackoff = 10
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2501,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.targetReconnects.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), syncer.ds.targetReconnects.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		last := target.commands[len(target.commands)-1]
+		assert.Equal(t, []string{"multi", "select 1", "set a 1", "set broken 1", "exec"}, last, "should be equal")
+	}
+}
+
+func TestLoopTag(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	command := func(args ...string) string {
+		ret := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			ret += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return ret
+	}
+	tag := command("publish", "shake-loop", "other")
+
+	var nr int
+	{
+		fmt.Printf("TestLoopTag case %d.\n", nr)
+		nr++
+
+		// the tagged transaction is skipped, the command behind the loop tag alone and the
+		// transaction of the source are synced and tagged
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		incr := command("set", "a", "1") + command("multi") + tag + command("set", "b", "1") + command("exec") +
+			tag + command("set", "c", "1") + command("multi") + command("set", "d", "1") + command("exec")
+		source := startFakePSyncMaster(t, full, incr)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Id = "shake"
+		options.SourceFakeSlaveOffset = false
+		options.SyncLoopTag = "shake-loop"
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2550,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.forward.Get() < 5; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(5), syncer.ds.forward.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		var sent []string
+		for _, cmd := range target.commands[len(target.commands)-1] {
+			if !strings.HasPrefix(cmd, "ping") {
+				sent = append(sent, cmd)
+			}
+		}
+		assert.Equal(t, []string{
+			"multi", "publish shake-loop shake", "set a 1", "exec",
+			"multi", "publish shake-loop shake", "set c 1", "exec",
+			"multi", "publish shake-loop shake", "set d 1", "exec",
+		}, sent, "should be equal")
+	}
+}
+
+// the token expiring in a short time
+type shortTokenProvider struct{}
+
+func (p *shortTokenProvider) Token() (string, error) {
+	return "token", nil
+}
+
+func (p *shortTokenProvider) ReauthInterval() time.Duration {
+	return 200 * time.Millisecond
+}
+
+func TestTargetReauth(t *testing.T) {
+	old := conf.Options
+	oldProvider := utils.TargetAuthProvider
+	defer func() {
+		conf.Options = old
+		utils.TargetAuthProvider = oldProvider
+	}()
+	utils.TargetAuthProvider = new(shortTokenProvider)
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	incr := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestTargetReauth case %d.\n", nr)
+		nr++
+
+		// the idle lane is authenticated again by the new token, the reply isn't taken as of a command
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, incr)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.SourceFakeSlaveOffset = false
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2660,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		auths := func() int {
+			target.mu.Lock()
+			defer target.mu.Unlock()
+			var n int
+			for _, cmd := range target.commands[len(target.commands)-1] {
+				if cmd == "auth token" {
+					n++
+				}
+			}
+			return n
+		}
+		// once the lane is opened and at least twice again
+		for i := 0; i < 50 && auths() < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, true, auths() >= 3, "should be equal")
+		assert.Equal(t, int64(1), syncer.ds.forward.Get(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.unconfirmed(), "should be equal")
+		assert.Equal(t, nil, syncer.ds.fatalError(), "should be equal")
+	}
+}
+
+func TestIncrOnly(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String("value")), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	mark := strings.Repeat("a", 40)
+
+	// the rdb isn't restored and the increment following it is synced
+	run := func(id int, psyncReply string) {
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, psyncReply, set)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SyncIncrOnly = true
+		syncer := NewSyncer(SyncerConfig{
+			Id:      id,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.forward.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), syncer.ds.forward.Get(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.nentry.Get(), "should be equal")
+		assert.Equal(t, int64(100+len(set)), syncer.ds.applyOffset.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		for _, cmd := range target.all {
+			assert.Equal(t, false, strings.HasPrefix(cmd, "restore"), "should be equal")
+		}
+		assert.Equal(t, "set a 1", target.all[len(target.all)-1], "should be equal")
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestIncrOnly case %d.\n", nr)
+		nr++
+
+		run(2600, fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String()))
+	}
+
+	{
+		fmt.Printf("TestIncrOnly case %d.\n", nr)
+		nr++
+
+		// diskless
+		run(2601, fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$EOF:%s\r\n%s%s", mark, b.String(), mark))
+	}
+}
+
+func TestFullOnly(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String("value")), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestFullOnly case %d.\n", nr)
+		nr++
+
+		// the syncer stops once the rdb is restored, the increment isn't synced
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(),
+			b.String()), set)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SyncFullOnly = true
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2700,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		select {
+		case <-syncer.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the syncer isn't stopped after the full sync")
+		}
+		assert.Equal(t, int64(2), syncer.ds.nentry.Get(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.forward.Get(), "should be equal")
+		assert.Equal(t, true, syncer.ds.stopping.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		for _, cmd := range target.all {
+			assert.Equal(t, false, strings.HasPrefix(cmd, "set"), "should be equal")
+		}
+	}
+}
+
+func TestCutover(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestCutover case %d.\n", nr)
+		nr++
+
+		// drained and notified once the lag stays within the threshold
+		events := make(chan *utils.CutoverEvent, 1)
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			event := new(utils.CutoverEvent)
+			assert.Equal(t, nil, json.NewDecoder(r.Body).Decode(event), "should be equal")
+			events <- event
+		}))
+		defer webhook.Close()
+
+		var written atomic2.Int64
+		target := startFakeTarget(t, "set", &written)
+		defer target.Close()
+		var offset atomic2.Int64
+		offset.Set(100000)
+		source := startFakePSyncMasterInfo(t, full, set, &offset)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.CutoverEnable = true
+		options.CutoverLagThreshold = 10
+		options.CutoverStableSeconds = 1
+		options.CutoverWebhook = webhook.URL
+		options.ShutdownDrainTimeoutMs = 1000
+		// the cutover is driven by CmdSync with conf.Options
+		conf.Options = options
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2800,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		<-syncer.WaitFull()
+
+		cmd := &CmdSync{dbSyncers: []*dbSyncer{syncer.ds}, syncers: []*Syncer{syncer}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cmd.cutover()
+		}()
+
+		// the lag is too large
+		time.Sleep(2500 * time.Millisecond)
+		select {
+		case <-done:
+			t.Fatal("cutover with the lag over the threshold")
+		default:
+		}
+
+		offset.Set(int64(100 + len(set)))
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no cutover with the lag within the threshold")
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+		event := <-events
+		assert.Equal(t, utils.CutoverEventDone, event.Event, "should be equal")
+		assert.Equal(t, []utils.CutoverSyncer{{Syncer: 2800, Source: source.Addr().String(), RunId: "0123456789",
+			Offset: int64(100 + len(set))}}, event.Syncers, "should be equal")
+		select {
+		case <-syncer.done:
+		default:
+			t.Fatal("the syncer isn't stopped after the cutover")
+		}
+	}
+}
+
+// fake sentinel which replies the master address stored in master, the commands are rejected until
+// the password is given by AUTH if it isn't empty
+func startFakeSentinel(t *testing.T, master *atomic.Value, password string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					cmd, args, _ := redis.ParseArgs(resp)
+					if cmd == "auth" {
+						if authed = len(args) == 1 && string(args[0]) == password; !authed {
+							reply = "-WRONGPASS invalid username-password pair\r\n"
+						}
+					} else if !authed {
+						reply = "-NOAUTH Authentication required.\r\n"
+					} else if cmd == "sentinel" && len(args) == 2 &&
+						strings.EqualFold(string(args[0]), "get-master-addr-by-name") {
+						host, port, _ := net.SplitHostPort(master.Load().(string))
+						reply = fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestSentinelFailover(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestSentinelFailover case %d.\n", nr)
+		nr++
+
+		// the increment continues from the new master once the sentinel switches it
+		var written atomic2.Int64
+		target := startFakeTarget(t, "set", &written)
+		defer target.Close()
+		oldMaster := startFakePSyncMaster(t, full, set("a"))
+		defer oldMaster.Close()
+		newMaster := startFakePSyncMaster(t, "+CONTINUE 0123456789\r\n", set("b"))
+		defer newMaster.Close()
+		var master atomic.Value
+		master.Store(oldMaster.Addr().String())
+		sentinel := startFakeSentinel(t, &master, "")
+		defer sentinel.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SourceType = conf.RedisTypeSentinel
+		options.SourceAddress = "mymaster:master@" + sentinel.Addr().String()
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2400,
+			Source:  oldMaster.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+
+		master.Store(newMaster.Addr().String())
+		for i := 0; i < 100 && written.Get() != 2; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(2), written.Get(), "should be equal")
+		assert.Equal(t, newMaster.Addr().String(), syncer.ds.GetExtraInfo()["SourceAddress"], "should be equal")
+		// no full sync again
+		assert.Equal(t, "0123456789", syncer.ds.runId.Load(), "should be equal")
+	}
+}
+
+// fake master demoted by the sentinel which rejects the command by READONLY, and counts it
+func startReadOnlyTarget(t *testing.T, command string, count *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					reply := "+OK\r\n"
+					if cmd, _, _ := redis.ParseArgs(resp); cmd == command {
+						count.Incr()
+						reply = "-READONLY You can't write against a read only replica.\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestTargetSentinelFailover(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestTargetSentinelFailover case %d.\n", nr)
+		nr++
+
+		// the sentinel requires its own password
+		var master atomic.Value
+		master.Store("127.0.0.1:6379")
+		sentinel := startFakeSentinel(t, &master, "sentinel-pass")
+		defer sentinel.Close()
+
+		conf.Options.TargetSentinelPassword = "sentinel-pass"
+		conf.Options.TargetAddress = "mymaster@" + sentinel.Addr().String()
+		address, err := utils.ResolveSentinelTarget(&conf.Options)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, "127.0.0.1:6379", address, "should be equal")
+
+		conf.Options.TargetSentinelPassword = "wrong"
+		_, err = utils.ResolveSentinelTarget(&conf.Options)
+		assert.NotEqual(t, nil, err, "should be not equal")
+	}
+
+	{
+		fmt.Printf("TestTargetSentinelFailover case %d.\n", nr)
+		nr++
+
+		// the command rejected by the master demoted is sent again to the master promoted
+		var rejected, written atomic2.Int64
+		oldMaster := startReadOnlyTarget(t, "set", &rejected)
+		defer oldMaster.Close()
+		newMaster := startFakeTarget(t, "set", &written)
+		defer newMaster.Close()
+		var master atomic.Value
+		master.Store(newMaster.Addr().String())
+		sentinel := startFakeSentinel(t, &master, "sentinel-pass")
+		defer sentinel.Close()
+		source := startFakePSyncMaster(t, full, set)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.TargetType = conf.RedisTypeSentinel
+		options.TargetAddress = "mymaster@" + sentinel.Addr().String()
+		options.TargetSentinelPassword = "sentinel-pass"
+		options.TargetReconnectRetries = 3
+		options.TargetReconnectBackoff = 10
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2450,
+			Source:  source.Addr().String(),
+			Target:  []string{oldMaster.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), rejected.Get(), "should be equal")
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+		assert.Equal(t, int64(1), syncer.ds.targetReconnects.Get(), "should be equal")
+	}
+}
+
+/*
+ * the fake master of the shard of the cluster which replies the slots served by owner to cluster
+ * slots, and replies info stored in info to info replication if it isn't nil, e.g., of the replica.
+ * The connections accepted are counted in accepted if it isn't nil.
+ */
+func startFakeShardMaster(t *testing.T, psyncReply, incr string, owner, info *atomic.Value,
+	accepted *atomic2.Int64) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if accepted != nil {
+				accepted.Incr()
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, err := redis.ParseArgs(resp)
+					if err != nil {
+						return
+					}
+					switch {
+					case cmd == "psync":
+						conn.Write([]byte(psyncReply))
+						conn.Write([]byte(incr))
+					case cmd == "replconf" && string(args[0]) == "ack":
+					case cmd == "auth":
+						conn.Write([]byte("-ERR AUTH <password> called without any password configured\r\n"))
+					case cmd == "cluster" && strings.EqualFold(string(args[0]), "slots"):
+						host, port, _ := net.SplitHostPort(owner.Load().(string))
+						conn.Write([]byte(fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n",
+							len(host), host, port)))
+					case cmd == "info" && info != nil:
+						content := info.Load().(string)
+						conn.Write([]byte(fmt.Sprintf("$%d\r\n%s\r\n", len(content), content)))
+					default:
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestClusterFailover(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestClusterFailover case %d.\n", nr)
+		nr++
+
+		// the increment continues from the slave promoted once it serves the slots of the shard
+		var written atomic2.Int64
+		target := startFakeTarget(t, "set", &written)
+		defer target.Close()
+		var owner atomic.Value
+		oldMaster := startFakeShardMaster(t, full, set("a"), &owner, nil, nil)
+		defer oldMaster.Close()
+		newMaster := startFakeShardMaster(t, "+CONTINUE 0123456789\r\n", set("b"), &owner, nil, nil)
+		defer newMaster.Close()
+		owner.Store(oldMaster.Addr().String())
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SourceType = conf.RedisTypeCluster
+		options.SourceSlotMigration = conf.SlotMigrationIgnore
+		options.SourceAddressList = []string{oldMaster.Addr().String()}
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2912,
+			Source:  oldMaster.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+
+		owner.Store(newMaster.Addr().String())
+		for i := 0; i < 100 && written.Get() != 2; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(2), written.Get(), "should be equal")
+		assert.Equal(t, newMaster.Addr().String(), syncer.ds.GetExtraInfo()["SourceAddress"], "should be equal")
+		// no full sync again
+		assert.Equal(t, "0123456789", syncer.ds.runId.Load(), "should be equal")
+		// the next case changes the options read by the syncer
+		stopSyncer(syncer)
+	}
+
+	{
+		fmt.Printf("TestClusterFailover case %d.\n", nr)
+		nr++
+
+		// the slave serves no slot, it isn't followed
+		var owner atomic.Value
+		source := startFakeShardMaster(t, full, "", &owner, nil, nil)
+		defer source.Close()
+		owner.Store("127.0.0.1:1")
+		conf.Options.SourceType = conf.RedisTypeCluster
+		ds := withRoutines(t, &dbSyncer{id: 2913})
+		assert.Equal(t, -1, ds.shardSlot(source.Addr().String()), "should be equal")
+		owner.Store(source.Addr().String())
+		assert.Equal(t, 0, ds.shardSlot(source.Addr().String()), "should be equal")
+		conf.Options.SourceType = conf.RedisTypeStandalone
+		assert.Equal(t, -1, ds.shardSlot(source.Addr().String()), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestClusterFailover case %d.\n", nr)
+		nr++
+
+		// the connection to the node polled is kept across the polls
+		var owner atomic.Value
+		var accepted atomic2.Int64
+		source := startFakeShardMaster(t, full, "", &owner, nil, &accepted)
+		defer source.Close()
+		owner.Store(source.Addr().String())
+		conf.Options.SourceType = conf.RedisTypeCluster
+		conf.Options.SourceAddressList = []string{source.Addr().String()}
+		ds := withRoutines(t, &dbSyncer{id: 2913, source: source.Addr().String()})
+		c, peer := net.Pipe()
+		defer peer.Close()
+		stop := ds.watchClusterMaster(c, source.Addr().String(), 0)
+		time.Sleep(2500 * time.Millisecond)
+		close(stop)
+		ds.routines.Wait()
+		assert.Equal(t, int64(1), accepted.Get(), "should be equal")
+	}
+}
+
+func TestClusterReadReplica(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+	replication := func(status string, last int) string {
+		return fmt.Sprintf("# Replication\r\nrole:slave\r\nmaster_link_status:%s\r\nmaster_last_io_seconds_ago:%d\r\n",
+			status, last)
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestClusterReadReplica case %d.\n", nr)
+		nr++
+
+		// the replica is synced till its link to the master is down, then the increment continues from the master
+		var written atomic2.Int64
+		target := startFakeTarget(t, "set", &written)
+		defer target.Close()
+		var owner, info atomic.Value
+		info.Store(replication("up", 1))
+		replica := startFakeShardMaster(t, full, set("a"), &owner, &info, nil)
+		defer replica.Close()
+		master := startFakeShardMaster(t, "+CONTINUE 0123456789\r\n", set("b"), &owner, nil, nil)
+		defer master.Close()
+		owner.Store(master.Addr().String())
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SourceType = conf.RedisTypeCluster
+		options.SourceSlotMigration = conf.SlotMigrationIgnore
+		options.SourceClusterReadFrom = conf.ClusterReadFromReplica
+		options.SourceAddressList = []string{replica.Addr().String()}
+		options.SourceReplicaOf = map[string]string{replica.Addr().String(): master.Addr().String()}
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2915,
+			Source:  replica.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+		assert.Equal(t, replica.Addr().String(), syncer.ds.GetExtraInfo()["SourceAddress"], "should be equal")
+
+		info.Store(replication("down", 1))
+		for i := 0; i < 100 && written.Get() != 2; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(2), written.Get(), "should be equal")
+		assert.Equal(t, master.Addr().String(), syncer.ds.GetExtraInfo()["SourceAddress"], "should be equal")
+		assert.Equal(t, "0123456789", syncer.ds.runId.Load(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestClusterReadReplica case %d.\n", nr)
+		nr++
+
+		// the master is synced if the replica lags at the start
+		var owner, info atomic.Value
+		replica := startFakeShardMaster(t, full, "", &owner, &info, nil)
+		defer replica.Close()
+		conf.Options.SourceReplicaMaxLag = 30
+		conf.Options.SourceReplicaOf = map[string]string{replica.Addr().String(): "127.0.0.1:1"}
+		for _, c := range []struct {
+			info     string
+			expected string
+		}{
+			{replication("up", 10), replica.Addr().String()},
+			{replication("up", 31), "127.0.0.1:1"},
+			{replication("down", 1), "127.0.0.1:1"},
+			{"# Replication\r\nrole:master\r\n", "127.0.0.1:1"},
+		} {
+			info.Store(c.info)
+			ds := withRoutines(t, &dbSyncer{id: 2916, source: replica.Addr().String()})
+			ds.checkReplicaSource()
+			assert.Equal(t, c.expected, ds.currentSource(), "should be equal")
+		}
+
+		// not the replica picked
+		ds := withRoutines(t, &dbSyncer{id: 2916, source: "127.0.0.1:1"})
+		ds.checkReplicaSource()
+		assert.Equal(t, "127.0.0.1:1", ds.currentSource(), "should be equal")
+	}
+}
+
+func TestFullSyncResumable(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 2
+	conf.Options.BigKeyThreshold = 50 * utils.MB
+	conf.Options.Rewrite = true
+	conf.Options.TargetReplace = true
+	conf.Options.TargetDB = -1
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String(fmt.Sprintf("value%d", i))), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+
+	target := startFakeKVTarget(t)
+	defer target.Close()
+	syncRDB := func(id int) *dbSyncer {
+		ds := withRoutines(t, &dbSyncer{id: id})
+		metric.AddMetric(ds.id)
+		ds.syncRDBFile(bufio.NewReader(bytes.NewReader(b.Bytes())), []string{target.Addr().String()}, "auth", "",
+			int64(b.Len()), nil)
+		return ds
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestFullSyncResumable case %d.\n", nr)
+		nr++
+
+		// nothing on the target, all the keys are restored
+		conf.Options.FullSyncResumable = true
+		ds := syncRDB(1900)
+		assert.Equal(t, 10, target.restores, "should be equal")
+		assert.Equal(t, int64(0), ds.resumeSkipped.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFullSyncResumable case %d.\n", nr)
+		nr++
+
+		// interrupted after half of the keys are restored, and key4 is changed since then
+		target.mu.Lock()
+		for i := 5; i < 10; i++ {
+			delete(target.kv, fmt.Sprintf("key%d", i))
+		}
+		target.kv["key4"] = target.kv["key0"]
+		target.restores = 0
+		target.mu.Unlock()
+
+		ds := syncRDB(1901)
+		assert.Equal(t, 6, target.restores, "should be equal")
+		assert.Equal(t, int64(4), ds.resumeSkipped.Get(), "should be equal")
+		assert.Equal(t, 10, len(target.kv), "should be equal")
+		assert.Equal(t, int64(4), ds.GetExtraInfo()["ResumeSkipped"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestFullSyncResumable case %d.\n", nr)
+		nr++
+
+		// all the keys are restored again if disabled
+		conf.Options.FullSyncResumable = false
+		target.mu.Lock()
+		target.restores = 0
+		target.mu.Unlock()
+
+		syncRDB(1902)
+		assert.Equal(t, 10, target.restores, "should be equal")
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	setLen := commandLength("set", [][]byte{[]byte("a"), []byte("1")})
+
+	// run until the set is written, the checkpoint is written once stopped
+	run := func(id int, source net.Listener) *Syncer {
+		var written atomic2.Int64
+		target := startFakeTarget(t, "set", &written)
+		defer target.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SyncCheckpointFile = dir + "/checkpoint"
+		options.SyncCheckpointInterval = 60
+		syncer := NewSyncer(SyncerConfig{
+			Id:      id,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- syncer.Start(context.Background())
+		}()
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && written.Get() == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), written.Get(), "should be equal")
+		for i := 0; i < 50 && syncer.ds.confirmedOffset() != syncer.ds.applyOffset.Get(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		syncer.Stop()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+		return syncer
+	}
+	read := func(id int) *utils.Checkpoint {
+		cp, err := utils.ReadCheckpoint(utils.CheckpointFileName(dir+"/checkpoint", id))
+		assert.Equal(t, nil, err, "should be equal")
+		return cp
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestCheckpointResume case %d.\n", nr)
+		nr++
+
+		// the offset of the commands replied is persisted
+		source := startFakePSyncMaster(t, full, set)
+		defer source.Close()
+		syncer := run(2000, source)
+		assert.NotEqual(t, (*fullSyncStat)(nil), syncer.ds.LastFullSync(), "should be equal")
+		cp := read(2000)
+		assert.NotEqual(t, (*utils.Checkpoint)(nil), cp, "should be equal")
+		assert.Equal(t, "0123456789", cp.RunId, "should be equal")
+		assert.Equal(t, 100+setLen, cp.Offset, "should be equal")
+		assert.Equal(t, syncer.ds.source, cp.Source, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckpointResume case %d.\n", nr)
+		nr++
+
+		// continue from the checkpoint without the full sync
+		source := startFakePSyncMaster(t, "+CONTINUE\r\n", set)
+		defer source.Close()
+		file := utils.CheckpointFileName(dir+"/checkpoint", 2001)
+		assert.Equal(t, nil, utils.WriteCheckpoint(file, &utils.Checkpoint{Source: source.Addr().String(),
+			RunId: "0123456789", Offset: 500}), "should be equal")
+		syncer := run(2001, source)
+		assert.Equal(t, (*fullSyncStat)(nil), syncer.ds.LastFullSync(), "should be equal")
+		assert.Equal(t, 500+setLen, read(2001).Offset, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckpointResume case %d.\n", nr)
+		nr++
+
+		// the checkpoint of another source is ignored, and replaced after the full sync
+		file := utils.CheckpointFileName(dir+"/checkpoint", 2002)
+		assert.Equal(t, nil, utils.WriteCheckpoint(file, &utils.Checkpoint{Source: "127.0.0.1:1", RunId: "abc",
+			Offset: 500}), "should be equal")
+		source := startFakePSyncMaster(t, full, set)
+		defer source.Close()
+		syncer := run(2002, source)
+		assert.NotEqual(t, (*fullSyncStat)(nil), syncer.ds.LastFullSync(), "should be equal")
+		cp := read(2002)
+		assert.Equal(t, "0123456789", cp.RunId, "should be equal")
+		assert.Equal(t, 100+setLen, cp.Offset, "should be equal")
+	}
+}
+
+// fake target which keeps the hash keys written by hmset, set is counted
+type hashTarget struct {
+	net.Listener
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+	sets   int
+}
+
+func startFakeHashTarget(t *testing.T) *hashTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	ht := &hashTarget{Listener: l, hashes: make(map[string]map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					reply := "+OK\r\n"
+					ht.mu.Lock()
+					switch cmd {
+					case "set":
+						ht.sets++
+					case "hmset":
+						h, ok := ht.hashes[string(args[0])]
+						if !ok {
+							h = make(map[string]string)
+							ht.hashes[string(args[0])] = h
+						}
+						for i := 1; i+1 < len(args); i += 2 {
+							h[string(args[i])] = string(args[i+1])
+						}
+					case "hgetall":
+						h := ht.hashes[string(args[0])]
+						reply = fmt.Sprintf("*%d\r\n", 2*len(h))
+						for k, v := range h {
+							reply += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+						}
+					case "del":
+						delete(ht.hashes, string(args[0]))
+						reply = ":1\r\n"
+					}
+					ht.mu.Unlock()
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ht
+}
+
+func (ht *hashTarget) hash(key string) map[string]string {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	ret := make(map[string]string)
+	for k, v := range ht.hashes[key] {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (ht *hashTarget) setCount() int {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	return ht.sets
+}
+
+func TestCheckpointKey(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"
+	setLen := commandLength("set", [][]byte{[]byte("a"), []byte("1")})
+
+	// run until the checkpoint of the offset is written behind the set
+	run := func(id int, source net.Listener, target *hashTarget, offset int64) *Syncer {
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SyncCheckpointKey = "redis-shake-checkpoint"
+		syncer := NewSyncer(SyncerConfig{
+			Id:      id,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- syncer.Start(context.Background())
+		}()
+		<-syncer.WaitFull()
+		key := utils.CheckpointKeyName("redis-shake-checkpoint", id)
+		for i := 0; i < 50 && target.hash(key)["offset"] != strconv.FormatInt(offset, 10); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, 1, target.setCount(), "should be equal")
+		syncer.Stop()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("syncer isn't stopped")
+		}
+		return syncer
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestCheckpointKey case %d.\n", nr)
+		nr++
+
+		// the checkpoint is written into the target behind the commands
+		source := startFakePSyncMaster(t, full, set)
+		defer source.Close()
+		target := startFakeHashTarget(t)
+		defer target.Close()
+		syncer := run(2100, source, target, 100+setLen)
+		assert.NotEqual(t, (*fullSyncStat)(nil), syncer.ds.LastFullSync(), "should be equal")
+		h := target.hash(utils.CheckpointKeyName("redis-shake-checkpoint", 2100))
+		assert.Equal(t, "0123456789", h["runid"], "should be equal")
+		assert.Equal(t, strconv.FormatInt(100+setLen, 10), h["offset"], "should be equal")
+		assert.Equal(t, source.Addr().String(), h["source"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestCheckpointKey case %d.\n", nr)
+		nr++
+
+		// continue from the checkpoint on the target without the full sync, e.g., on another host
+		source := startFakePSyncMaster(t, "+CONTINUE\r\n", set)
+		defer source.Close()
+		target := startFakeHashTarget(t)
+		defer target.Close()
+		key := utils.CheckpointKeyName("redis-shake-checkpoint", 2101)
+		c := utils.OpenRedisConn([]string{target.Addr().String()}, "auth", "", false, nil)
+		cp := &utils.Checkpoint{Source: source.Addr().String(), RunId: "0123456789", Offset: 500}
+		_, err := c.Do("hmset", cp.HMSetArgs(key)...)
+		c.Close()
+		assert.Equal(t, nil, err, "should be equal")
+		syncer := run(2101, source, target, 500+setLen)
+		assert.Equal(t, (*fullSyncStat)(nil), syncer.ds.LastFullSync(), "should be equal")
+		assert.Equal(t, strconv.FormatInt(500+setLen, 10), target.hash(key)["offset"], "should be equal")
+	}
+}
+
+func TestAofSource(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	dir, err := ioutil.TempDir("", "aof")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, nil, enc.EncodeObject(0, []byte(fmt.Sprintf("key%d", i)), 0,
+			rdb.String("value")), "should be equal")
+	}
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	rdbFile, aofFile := dir+"/dump.rdb", dir+"/appendonly.aof"
+	assert.Equal(t, nil, ioutil.WriteFile(rdbFile, b.Bytes(), 0644), "should be equal")
+	assert.Equal(t, nil, ioutil.WriteFile(aofFile, []byte("*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"), 0644),
+		"should be equal")
+
+	var nr int
+	{
+		fmt.Printf("TestAofSource case %d.\n", nr)
+		nr++
+
+		// the rdb file is restored, then the commands appended into the aof are synced
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.Psync = false
+		options.SourceFakeSlaveOffset = false
+		options.SourceRdbFile = rdbFile
+		options.SourceAofFile = aofFile
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2900,
+			Source:  aofFile,
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		assert.Equal(t, int64(2), syncer.ds.nentry.Get(), "should be equal")
+
+		f, err := os.OpenFile(aofFile, os.O_WRONLY|os.O_APPEND, 0644)
+		assert.Equal(t, nil, err, "should be equal")
+		_, err = f.WriteString("*2\r\n$3\r\ndel\r\n$1\r\na\r\n")
+		assert.Equal(t, nil, err, "should be equal")
+		f.Close()
+		for i := 0; i < 50 && syncer.ds.forward.Get() < 2; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(2), syncer.ds.forward.Get(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		assert.Equal(t, []string{"set a 1", "del a"}, target.all[len(target.all)-2:], "should be equal")
+	}
+}
+
+func TestSyncJobs(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("a0"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("b0"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	psyncReply := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	incr := "*3\r\n$3\r\nset\r\n$2\r\na1\r\n$1\r\n1\r\n*3\r\n$3\r\nset\r\n$2\r\nb1\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestSyncJobs case %d.\n", nr)
+		nr++
+
+		// the jobs run together with their own filters and target db
+		conf.Options = DefaultSyncerOptions()
+		conf.Options.Parallel = 2
+		conf.Options.SourceFakeSlaveOffset = false
+		jobA, jobB := conf.Options, conf.Options
+		jobA.JobName, jobA.FilterKeyWhitelist = "a", []string{"a"}
+		jobB.JobName, jobB.FilterKeyWhitelist, jobB.TargetDB = "b", []string{"b"}, 2
+
+		var syncers []*Syncer
+		var targets []*recordTarget
+		for i, job := range []*conf.Configuration{&jobA, &jobB} {
+			target := startRecordTarget(t, 0)
+			defer target.Close()
+			source := startFakePSyncMaster(t, psyncReply, incr)
+			defer source.Close()
+			syncer := NewSyncer(SyncerConfig{
+				Id:     2901 + i,
+				Source: source.Addr().String(),
+				Target: []string{target.Addr().String()},
+				Job:    job,
+			})
+			go syncer.Start(context.Background())
+			defer stopSyncer(syncer)
+			syncers = append(syncers, syncer)
+			targets = append(targets, target)
+		}
+
+		expect := [][]string{{"a0", "set a1 1"}, {"b0", "set b1 1"}}
+		for i, syncer := range syncers {
+			<-syncer.WaitFull()
+			for j := 0; j < 50 && syncer.ds.forward.Get() == 0; j++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+			for j := 0; j < 50 && syncer.ds.unconfirmed() != 0; j++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.Equal(t, int64(1), syncer.ds.nentry.Get()-syncer.ds.ignore.Get(), "should be equal")
+			assert.Equal(t, syncer.ds.job.JobName, syncer.ds.GetExtraInfo()["Job"], "should be equal")
+
+			targets[i].mu.Lock()
+			var restored, set []string
+			for _, cmd := range targets[i].all {
+				if strings.HasPrefix(cmd, "restore ") {
+					restored = append(restored, strings.Fields(cmd)[1])
+				} else if strings.HasPrefix(cmd, "set ") {
+					set = append(set, cmd)
+				}
+			}
+			assert.Equal(t, []string{expect[i][0]}, restored, "should be equal")
+			assert.Equal(t, []string{expect[i][1]}, set, "should be equal")
+			if i == 1 {
+				assert.Contains(t, targets[i].all, "select 2", "should be equal")
+			}
+			targets[i].mu.Unlock()
+		}
+	}
+}
+
+func TestSenderMaxBytes(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestSenderMaxBytes case %d.\n", nr)
+		nr++
+
+		// blocks once it's full, the command larger than the budget goes alone
+		b := newByteBudget(10)
+		b.acquire(6)
+		acquired := make(chan struct{})
+		go func() {
+			b.acquire(6)
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			t.Fatal("acquired beyond the budget")
+		case <-time.After(100 * time.Millisecond):
+		}
+		b.release(6)
+		<-acquired
+		assert.Equal(t, int64(6), b.queued(), "should be equal")
+		b.release(6)
+		b.acquire(100)
+		assert.Equal(t, int64(100), b.queued(), "should be equal")
+
+		assert.Equal(t, true, newByteBudget(0) == nil, "should be equal")
+		assert.Equal(t, int64(0), newByteBudget(0).queued(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSenderMaxBytes case %d.\n", nr)
+		nr++
+
+		// all the commands are sent with a budget smaller than them
+		conf.Options.SenderTargetParallel = 2
+		conf.Options.SenderCount = 16
+		conf.Options.SenderDelayChannelSize = 32
+		conf.Options.SenderMaxBytes = 64
+		conf.Options.Psync = false
+
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+
+		var b bytes.Buffer
+		total := 200
+		for i := 0; i < total; i++ {
+			data, err := redis.EncodeToBytes(redis.NewCommand("set", fmt.Sprintf("key%d", i%8),
+				strings.Repeat("v", i%50)))
+			assert.Equal(t, nil, err, "should be equal")
+			b.Write(data)
+		}
+
+		ds := withRoutines(t, &dbSyncer{id: 2903})
+		metric.AddMetric(ds.id)
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+		w.Write(b.Bytes())
+		for i := 0; i < 50 && target.count() < total; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+
+		assert.Equal(t, total, target.count(), "should be equal")
+		assert.Equal(t, int64(0), ds.GetExtraInfo()["SenderBufBytes"], "should be equal")
+	}
+}
+
+func TestDangerousCommand(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.SenderTargetParallel = 1
+	conf.Options.SenderCount = 16
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+	conf.Options.FilterDangerousCommand = true
+	conf.Options.FilterDangerousAllow = []string{"swapdb"}
+
+	var nr int
+	{
+		fmt.Printf("TestDangerousCommand case %d.\n", nr)
+		nr++
+
+		// flushall and flushdb are dropped with an event, swapdb is allowed
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+
+		var b bytes.Buffer
+		for _, cmd := range [][]interface{}{{"set", "a", "1"}, {"flushall"}, {"flushdb"},
+			{"swapdb", "0", "1"}, {"set", "b", "1"}} {
+			data, err := redis.EncodeToBytes(redis.NewCommand(cmd[0].(string), cmd[1:]...))
+			assert.Equal(t, nil, err, "should be equal")
+			b.Write(data)
+		}
+
+		ds := withRoutines(t, &dbSyncer{id: 2904, events: make(chan Event, eventChanSize)})
+		metric.AddMetric(ds.id)
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+		w.Write(b.Bytes())
+		for i := 0; i < 50 && target.count() < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+
+		target.mu.Lock()
+		assert.Equal(t, []string{"set a 1", "swapdb 0 1", "set b 1"}, target.all, "should be equal")
+		target.mu.Unlock()
+		assert.Equal(t, int64(2), ds.nbypass.Get(), "should be equal")
+
+		var blocked []string
+		for len(ds.events) > 0 {
+			if ev := <-ds.events; ev.Type == EventCommandBlocked {
+				blocked = append(blocked, ev.Message)
+			}
+		}
+		assert.Equal(t, 2, len(blocked), "should be equal")
+		assert.Contains(t, blocked[0], "flushall", "should be equal")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	dir, err := ioutil.TempDir("", "replay")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("key0"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	// the rdb preamble followed by the commands, the last one is cut
+	aofFile := dir + "/appendonly.aof"
+	data := b.String() + "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$3\r\ndel\r\n$1\r\na\r\n*2\r\n$3\r\ndel"
+	assert.Equal(t, nil, ioutil.WriteFile(aofFile, []byte(data), 0644), "should be equal")
+
+	var nr int
+	{
+		fmt.Printf("TestReplay case %d.\n", nr)
+		nr++
+
+		// the syncer quits at the end of the aof once the commands are replied
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+
+		options := DefaultSyncerOptions()
+		options.Type = conf.TypeReplay
+		options.Parallel = 2
+		options.Psync = false
+		options.SourceFakeSlaveOffset = false
+		options.SourceAofFile = aofFile
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2905,
+			Source:  aofFile,
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		done := make(chan error)
+		go func() {
+			done <- syncer.Start(context.Background())
+		}()
+		select {
+		case err := <-done:
+			assert.Equal(t, nil, err, "should be equal")
+		case <-time.After(10 * time.Second):
+			syncer.Stop()
+			t.Fatal("the syncer doesn't quit at the end of the aof")
+		}
+		assert.Equal(t, int64(1), syncer.ds.nentry.Get(), "should be equal")
+		assert.Equal(t, int64(2), syncer.ds.forward.Get(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.unconfirmed(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		assert.Equal(t, []string{"set a 1", "del a"}, target.all[len(target.all)-2:], "should be equal")
+	}
+}
+
+func TestSyncerRestart(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	log.SetPanicRecoverable(true)
+	defer log.SetPanicRecoverable(false)
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeObject(0, []byte("key0"), 0, rdb.String("value")), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	psyncReply := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+
+	conf.Options = DefaultSyncerOptions()
+	conf.Options.Parallel = 2
+	conf.Options.SourceFakeSlaveOffset = false
+	conf.Options.SyncRestartRetries = 1
+	conf.Options.SyncRestartBackoff = 10
+
+	var nr int
+	{
+		fmt.Printf("TestSyncerRestart case %d.\n", nr)
+		nr++
+
+		// the fatal error in the routine of the syncer fails the syncer instead of exiting
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, psyncReply, "")
+		defer source.Close()
+		syncer := NewSyncer(SyncerConfig{
+			Id:     2906,
+			Source: source.Addr().String(),
+			Target: []string{target.Addr().String()},
+		})
+		done := make(chan error)
+		go func() {
+			done <- syncer.Start(context.Background())
+		}()
+		<-syncer.WaitFull()
+		go func() {
+			defer syncer.ds.recoverFatal()
+			log.Panicf("the target is broken")
+		}()
+
+		select {
+		case err := <-done:
+			f, ok := err.(*log.Fatal)
+			assert.Equal(t, true, ok, "should be equal")
+			assert.Contains(t, f.Error(), "the target is broken", "should be equal")
+		case <-time.After(10 * time.Second):
+			syncer.Stop()
+			t.Fatal("the syncer failed doesn't quit")
+		}
+		assert.Equal(t, true, syncer.ds.stopping.Get(), "should be equal")
+
+		var failed bool
+		for len(syncer.Events()) != 0 {
+			if e := <-syncer.Events(); e.Type == EventSyncerFailed {
+				failed = true
+			}
+		}
+		assert.Equal(t, true, failed, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSyncerRestart case %d.\n", nr)
+		nr++
+
+		// the syncer failed is replaced by a new one which does the full sync again
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, psyncReply, "")
+		defer source.Close()
+		cmd := &CmdSync{
+			dbSyncers: make([]*dbSyncer, 1),
+			syncers:   make([]*Syncer, 1),
+		}
+		nd := syncNode{id: 0, source: source.Addr().String(), target: []string{target.Addr().String()}}
+		full := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cmd.supervise(nd, full)
+		}()
+		<-full
+
+		cmd.mu.Lock()
+		first := cmd.syncers[0]
+		cmd.mu.Unlock()
+		first.ds.fail(&log.Fatal{Msg: "the source is broken"})
+
+		var second *Syncer
+		for i := 0; i < 100 && second == nil; i++ {
+			time.Sleep(50 * time.Millisecond)
+			cmd.mu.Lock()
+			if cmd.syncers[0] != first {
+				second = cmd.syncers[0]
+			}
+			cmd.mu.Unlock()
+		}
+		if second == nil {
+			t.Fatal("the syncer failed isn't restarted")
+		}
+		select {
+		case <-second.WaitFull():
+		case <-time.After(10 * time.Second):
+			t.Fatal("the syncer restarted doesn't do the full sync")
+		}
+		assert.Equal(t, int64(1), second.ds.nentry.Get(), "should be equal")
+
+		cmd.stopped.Set(true)
+		second.Stop()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the supervisor doesn't quit once the syncer is stopped")
+		}
+	}
+}
+
+func TestSenderSpill(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	dir, err := ioutil.TempDir("", "spill")
+	assert.Equal(t, nil, err, "should be equal")
+	defer os.RemoveAll(dir)
+
+	var nr int
+	{
+		fmt.Printf("TestSenderSpill case %d.\n", nr)
+		nr++
+
+		// the commands over sendBuf are spilled and queued again in order
+		conf.Options.SenderSpillMaxMB = 0
+		conf.Options.SenderSpillMaxAge = 0
+		ds := withRoutines(t, &dbSyncer{id: 2907})
+		l := &targetLane{sendBuf: make(chan cmdDetail, 2)}
+		l.spill = openSpillQueue(&conf.Options, filepath.Join(dir, "spill.2907.0"))
+		for i := 0; i < 10; i++ {
+			l.push(cmdDetail{Cmd: "set", Args: [][]byte{[]byte(strconv.Itoa(i)), []byte("1")}, Offset: int64(i)})
+		}
+		assert.Equal(t, 2, len(l.sendBuf), "should be equal")
+		assert.Equal(t, int64(8*len("set01")), l.spill.queued(), "should be equal")
+		assert.Equal(t, int64(10), l.pending.Get(), "should be equal")
+
+		go ds.feedLane(l)
+		l.spill.close()
+		var got []string
+		for item := range l.sendBuf {
+			got = append(got, fmt.Sprintf("%s %s %d", item.Cmd, item.Args[0], item.Offset))
+		}
+		assert.Equal(t, 10, len(got), "should be equal")
+		for i, s := range got {
+			assert.Equal(t, fmt.Sprintf("set %d %d", i, i), s, "should be equal")
+		}
+		assert.Equal(t, int64(0), l.spill.queued(), "should be equal")
+		fi, err := os.Stat(l.spill.name)
+		assert.Equal(t, nil, err, "should be equal")
+		assert.Equal(t, int64(0), fi.Size(), "should be equal")
+
+		l.spill.remove()
+		_, err = os.Stat(l.spill.name)
+		assert.Equal(t, true, os.IsNotExist(err), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSenderSpill case %d.\n", nr)
+		nr++
+
+		// the commands spilled for too long fail the syncer
+		log.SetPanicRecoverable(true)
+		defer log.SetPanicRecoverable(false)
+		conf.Options.SenderSpillMaxAge = 1
+		l := &targetLane{sendBuf: make(chan cmdDetail, 1)}
+		l.spill = openSpillQueue(&conf.Options, filepath.Join(dir, "spill.2907.1"))
+		defer l.spill.remove()
+		l.push(cmdDetail{Cmd: "ping"})
+		l.push(cmdDetail{Cmd: "ping"})
+		l.spill.since = time.Now().Add(-2 * time.Second)
+
+		var fatal interface{}
+		func() {
+			defer func() {
+				fatal = recover()
+			}()
+			l.push(cmdDetail{Cmd: "ping"})
+		}()
+		_, ok := fatal.(*log.Fatal)
+		assert.Equal(t, true, ok, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSenderSpill case %d.\n", nr)
+		nr++
+
+		// the commands spilled while reconnecting to the target are all sent in order
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+		assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+		full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+		var incr string
+		for _, key := range []string{"a", "broken", "b", "c", "d"} {
+			incr += fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+		}
+		target := startBreakingTarget(t, "broken")
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, incr)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.Parallel = 2
+		options.SourceFakeSlaveOffset = false
+		options.SenderCount = 1
+		options.SenderSpillFile = filepath.Join(dir, "spill")
+		options.TargetReconnectRetries = 3
+		options.TargetReconnectBackoff = 100
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2907,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && (syncer.ds.targetReconnects.Get() == 0 || syncer.ds.unconfirmed() != 0); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), syncer.ds.targetReconnects.Get(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.unconfirmed(), "should be equal")
+		assert.Equal(t, int64(0), syncer.ds.GetExtraInfo()["SenderSpillBytes"], "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		var all []string
+		for _, cmds := range target.commands {
+			all = append(all, cmds...)
+		}
+		assert.Equal(t, []string{"set broken 1", "set b 1", "set c 1", "set d 1"}, all[len(all)-4:],
+			"should be equal")
+	}
+}
+
+func TestSlotMigration(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var nr int
+	{
+		fmt.Printf("TestSlotMigration case %d.\n", nr)
+		nr++
+
+		// the DEL of the key restored by another shard is dropped once
+		migrations := newSlotMigrations()
+		importing := &dbSyncer{id: 2908, migrations: migrations}
+		migrating := &dbSyncer{id: 2909, migrations: migrations}
+
+		cmd, args, ok := importing.reconcileMigration("restore-asking",
+			[][]byte{[]byte("a"), []byte("0"), []byte("payload")})
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "restore", cmd, "should be equal")
+		assert.Equal(t, "a 0 payload REPLACE", string(bytes.Join(args, []byte(" "))), "should be equal")
+
+		_, args, ok = migrating.reconcileMigration("del", [][]byte{[]byte("b"), []byte("a"), []byte("c")})
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "b c", string(bytes.Join(args, []byte(" "))), "should be equal")
+		assert.Equal(t, int64(1), migrating.migrationDropped.Get(), "should be equal")
+
+		_, _, ok = migrating.reconcileMigration("del", [][]byte{[]byte("a")})
+		assert.Equal(t, true, ok, "should be equal")
+
+		// the key deleted by the importing shard itself
+		importing.reconcileMigration("restore-asking", [][]byte{[]byte("a"), []byte("0"), []byte("payload"),
+			[]byte("replace")})
+		_, _, ok = importing.reconcileMigration("unlink", [][]byte{[]byte("a")})
+		assert.Equal(t, true, ok, "should be equal")
+		_, _, ok = migrating.reconcileMigration("unlink", [][]byte{[]byte("a")})
+		assert.Equal(t, false, ok, "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSlotMigration case %d.\n", nr)
+		nr++
+
+		// the commands are kept as they are without the migrations
+		ds := withRoutines(t, &dbSyncer{id: 2908})
+		cmd, args, ok := ds.reconcileMigration("restore-asking", [][]byte{[]byte("a"), []byte("0"), []byte("payload")})
+		assert.Equal(t, true, ok, "should be equal")
+		assert.Equal(t, "restore-asking", cmd, "should be equal")
+		assert.Equal(t, 3, len(args), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestSlotMigration case %d.\n", nr)
+		nr++
+
+		// the DEL of MIGRATE in the stream of the migrating shard doesn't reach the target
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+		assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+		full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+		incr := "*2\r\n$3\r\ndel\r\n$1\r\na\r\n*2\r\n$3\r\ndel\r\n$1\r\nb\r\n*3\r\n$3\r\nset\r\n$1\r\nc\r\n$1\r\n1\r\n"
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, incr)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.SourceFakeSlaveOffset = false
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2908,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		syncer.ds.migrations = newSlotMigrations()
+		syncer.ds.migrations.restored(2909, "a")
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && syncer.ds.GetExtraInfo()["MigrationDropped"] != int64(1); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, int64(1), syncer.ds.GetExtraInfo()["MigrationDropped"], "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		assert.Equal(t, []string{"del b", "set c 1"}, target.all[len(target.all)-2:], "should be equal")
+	}
+}
+
+func TestMergeCollision(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	entry := func(key string) *rdb.BinEntry {
+		return &rdb.BinEntry{Key: []byte(key), Type: rdb.RdbTypeString, NeedReadLen: 1}
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestMergeCollision case %d.\n", nr)
+		nr++
+
+		// the key restored first is kept, the later one of another shard is skipped
+		conf.Options.TargetMergeCollision = conf.MergeCollisionSkip
+		owners := newKeyOwners()
+		first := &dbSyncer{id: 2910, owners: owners}
+		second := &dbSyncer{id: 2911, owners: owners}
+		assert.Equal(t, true, first.resolveCollision(0, entry("a")), "should be equal")
+		assert.Equal(t, true, first.resolveCollision(0, entry("a")), "should be equal")
+		assert.Equal(t, false, second.resolveCollision(0, entry("a")), "should be equal")
+		assert.Equal(t, true, second.resolveCollision(1, entry("a")), "should be equal")
+		assert.Equal(t, int64(0), first.collisions.Get(), "should be equal")
+		assert.Equal(t, int64(1), second.collisions.Get(), "should be equal")
+		assert.Equal(t, int64(1), second.GetExtraInfo()["MergeCollisions"], "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMergeCollision case %d.\n", nr)
+		nr++
+
+		// all the parts of the big key are renamed and counted once
+		conf.Options.TargetMergeCollision = conf.MergeCollisionRename
+		owners := newKeyOwners()
+		first := &dbSyncer{id: 2910, owners: owners}
+		second := &dbSyncer{id: 2911, owners: owners}
+		first.resolveCollision(0, entry("big"))
+		e := entry("big")
+		assert.Equal(t, true, second.resolveCollision(0, e), "should be equal")
+		assert.Equal(t, "big.shard2911", string(e.Key), "should be equal")
+		e = entry("big")
+		e.NeedReadLen = 0
+		assert.Equal(t, true, second.resolveCollision(0, e), "should be equal")
+		assert.Equal(t, "big.shard2911", string(e.Key), "should be equal")
+		assert.Equal(t, int64(1), second.collisions.Get(), "should be equal")
+
+		// the aux fields, e.g., the lua scripts, aren't keys
+		aux := &rdb.BinEntry{Key: []byte("lua"), Type: rdb.RdbFlagAUX}
+		assert.Equal(t, true, first.resolveCollision(0, aux), "should be equal")
+		assert.Equal(t, true, second.resolveCollision(0, aux), "should be equal")
+		assert.Equal(t, "lua", string(aux.Key), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMergeCollision case %d.\n", nr)
+		nr++
+
+		// the collision fails the syncer with abort
+		log.SetPanicRecoverable(true)
+		defer log.SetPanicRecoverable(false)
+		conf.Options.TargetMergeCollision = conf.MergeCollisionAbort
+		owners := newKeyOwners()
+		first := &dbSyncer{id: 2910, owners: owners}
+		second := &dbSyncer{id: 2911, owners: owners}
+		first.resolveCollision(0, entry("a"))
+
+		var fatal interface{}
+		func() {
+			defer func() {
+				fatal = recover()
+			}()
+			second.resolveCollision(0, entry("a"))
+		}()
+		_, ok := fatal.(*log.Fatal)
+		assert.Equal(t, true, ok, "should be equal")
+	}
+
+	conf.Options.SenderTargetParallel = 1
+	conf.Options.SenderCount = 16
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+	// the commands of the syncers in the increment, then the sets received by the target
+	incr := func(syncers []*dbSyncer, values ...string) []string {
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		for i, ds := range syncers {
+			data, err := redis.EncodeToBytes(redis.NewCommand("set", "k", values[i]))
+			assert.Equal(t, nil, err, "should be equal")
+			metric.AddMetric(ds.id)
+			r, w := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+			}()
+			w.Write(data)
+			for j := 0; j < 50 && ds.forward.Get()+ds.nbypass.Get() < 1; j++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+			ds.stopping.Set(true)
+			w.Close()
+			<-done
+		}
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		var sets []string
+		for _, cmd := range target.all {
+			if strings.HasPrefix(cmd, "set ") {
+				sets = append(sets, cmd)
+			}
+		}
+		return sets
+	}
+
+	{
+		fmt.Printf("TestMergeCollision case %d.\n", nr)
+		nr++
+
+		// the command of the shard losing the key in the full sync is skipped in the increment
+		conf.Options.TargetMergeCollision = conf.MergeCollisionSkip
+		owners := newKeyOwners()
+		first := withRoutines(t, &dbSyncer{id: 2912, owners: owners})
+		second := withRoutines(t, &dbSyncer{id: 2913, owners: owners})
+		first.resolveCollision(0, entry("k"))
+		assert.Equal(t, false, second.resolveCollision(0, entry("k")), "should be equal")
+		assert.Equal(t, []string{"set k v1"}, incr([]*dbSyncer{first, second}, "v1", "v2"), "should be equal")
+		assert.Equal(t, int64(1), second.nbypass.Get(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMergeCollision case %d.\n", nr)
+		nr++
+
+		// the key written by the later shard is renamed in the increment, the key written in the increment
+		// first is owned as well
+		conf.Options.TargetMergeCollision = conf.MergeCollisionRename
+		owners := newKeyOwners()
+		first := withRoutines(t, &dbSyncer{id: 2914, owners: owners})
+		second := withRoutines(t, &dbSyncer{id: 2915, owners: owners})
+		assert.Equal(t, []string{"set k v1", "set k.shard2915 v2"}, incr([]*dbSyncer{first, second}, "v1", "v2"),
+			"should be equal")
+
+		// the args aren't changed by rename
+		argv := [][]byte{[]byte("k"), []byte("v3")}
+		renamed, kept := second.resolveCommandCollision(0, "set", argv)
+		assert.Equal(t, true, kept, "should be equal")
+		assert.Equal(t, "k.shard2915", string(renamed[0]), "should be equal")
+		assert.Equal(t, "k", string(argv[0]), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestMergeCollision case %d.\n", nr)
+		nr++
+
+		// nothing is checked without the owners
+		ds := withRoutines(t, &dbSyncer{id: 2910})
+		assert.Equal(t, true, ds.resolveCollision(0, entry("a")), "should be equal")
+		assert.Equal(t, true, ds.resolveCollision(0, entry("a")), "should be equal")
+	}
+}
+
+func TestPickTarget(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+		utils.TargetRoundRobin = 0
+	}()
+	job := &conf.Configuration{
+		TargetAddressList: []string{"t0", "t1", "t2"},
+		ShardMap:          map[string]string{"s0": "t2", "s1": "t2"},
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestPickTarget case %d.\n", nr)
+		nr++
+
+		// the sources in shard.map are pinned, the others are picked round-robin
+		conf.Options.TargetType = conf.RedisTypeStandalone
+		utils.TargetRoundRobin = 0
+		assert.Equal(t, []string{"t2"}, pickTarget(job, "s0"), "should be equal")
+		assert.Equal(t, []string{"t2"}, pickTarget(job, "s1"), "should be equal")
+		assert.Equal(t, []string{"t0"}, pickTarget(job, "s2"), "should be equal")
+		assert.Equal(t, []string{"t1"}, pickTarget(job, "s3"), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestPickTarget case %d.\n", nr)
+		nr++
+
+		conf.Options.TargetType = conf.RedisTypeCluster
+		assert.Equal(t, job.TargetAddressList, pickTarget(job, "s0"), "should be equal")
+	}
+}
+
+func TestProxyTarget(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	resp := func(args ...string) string {
+		s := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			s += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return s
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestProxyTarget case %d.\n", nr)
+		nr++
+
+		// SELECT isn't sent, db 1 is skipped, the unsupported commands are dropped or translated
+		var b bytes.Buffer
+		enc := rdb.NewEncoder(&b)
+		assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+		assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+		full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+		incr := resp("select", "1") + resp("set", "x", "1") + resp("select", "0") + resp("multi") +
+			resp("set", "a", "1") + resp("exec") + resp("unlink", "b") + resp("flushall") + resp("set", "c", "1") +
+			resp("msetnx", "d", "1", "e", "2")
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, incr)
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.SourceFakeSlaveOffset = false
+		options.TargetType = conf.RedisTypeProxy
+		options.TargetDBOutOfRange = conf.DBOutOfRangeSkip
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2914,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		expected := map[string]int64{"multi": 1, "exec": 1, "flushall": 1}
+		for i := 0; i < 50 && len(syncer.ds.proxyDropped.Counts()) != len(expected); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.Equal(t, expected, syncer.ds.GetExtraInfo()["ProxyDropped"], "should be equal")
+		assert.Equal(t, "exec=1 flushall=1 multi=1", syncer.ds.proxyDropped.Summary(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		assert.Equal(t, []string{"set a 1", "del b", "set c 1", "mset d 1 e 2"}, target.all[len(target.all)-4:],
+			"should be equal")
+		for _, cmd := range target.all {
+			assert.Equal(t, false, strings.HasPrefix(cmd, "select"), "should be equal")
+			assert.NotEqual(t, "set x 1", cmd, "should be not equal")
+		}
+	}
+}
+
+// the same as startRecordTarget, but the command of the key is replied CLUSTERDOWN for the first
+// stalls times
+func startStallTarget(t *testing.T, key string, stalls int) *recordTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err, "should be equal")
+	rt := &recordTarget{Listener: l}
+	var stalled atomic2.Int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rt.mu.Lock()
+			idx := len(rt.commands)
+			rt.commands = append(rt.commands, nil)
+			rt.mu.Unlock()
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					resp, err := redis.Decode(br)
+					if err != nil {
+						return
+					}
+					cmd, args, _ := redis.ParseArgs(resp)
+					strs := []string{cmd}
+					for _, arg := range args {
+						strs = append(strs, string(arg))
+					}
+					rt.mu.Lock()
+					rt.commands[idx] = append(rt.commands[idx], strings.Join(strs, " "))
+					rt.all = append(rt.all, strings.Join(strs, " "))
+					rt.mu.Unlock()
+					reply := "+OK\r\n"
+					if len(args) != 0 && string(args[0]) == key && stalled.Incr() <= int64(stalls) {
+						reply = "-CLUSTERDOWN The cluster is down\r\n"
+					}
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return rt
+}
+
+func TestTargetStalled(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+
+	var b bytes.Buffer
+	enc := rdb.NewEncoder(&b)
+	assert.Equal(t, nil, enc.EncodeHeader(), "should be equal")
+	assert.Equal(t, nil, enc.EncodeFooter(), "should be equal")
+	full := fmt.Sprintf("+FULLRESYNC 0123456789 100\r\n$%d\r\n%s", b.Len(), b.String())
+	set := func(key string) string {
+		return fmt.Sprintf("*3\r\n$3\r\nset\r\n$%d\r\n%s\r\n$1\r\n1\r\n", len(key), key)
+	}
+	selectDB := "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n"
+
+	var nr int
+	{
+		fmt.Printf("TestTargetStalled case %d.\n", nr)
+		nr++
+
+		// the command replied CLUSTERDOWN is retried on another connection in the db selected, the
+		// command sent after it is applied before the retry
+		target := startStallTarget(t, "b", 3)
+		defer target.Close()
+		source := startFakePSyncMaster(t, full, selectDB+set("a")+set("b")+set("c"))
+		defer source.Close()
+
+		options := DefaultSyncerOptions()
+		options.SourceFakeSlaveOffset = false
+		options.TargetMaxStall = 5000
+		syncer := NewSyncer(SyncerConfig{
+			Id:      2917,
+			Source:  source.Addr().String(),
+			Target:  []string{target.Addr().String()},
+			Options: &options,
+		})
+		go syncer.Start(context.Background())
+		defer stopSyncer(syncer)
+		<-syncer.WaitFull()
+		for i := 0; i < 50 && target.count() < 8; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for i := 0; i < 50 && syncer.ds.unconfirmed() != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, int64(0), syncer.ds.unconfirmed(), "should be equal")
+
+		target.mu.Lock()
+		defer target.mu.Unlock()
+		last := target.commands[len(target.commands)-1]
+		assert.Equal(t, []string{"select 1", "set b 1", "set b 1", "set b 1"}, last, "should be equal")
+		assert.Equal(t, []string{"select 1", "set a 1", "set b 1", "set c 1"}, target.commands[len(target.commands)-2],
+			"should be equal")
+	}
+}
+
+func TestShardOptions(t *testing.T) {
+	old := conf.Options
+	defer func() {
+		conf.Options = old
+	}()
+	conf.Options.Parallel = 64
+	conf.Options.SenderCount = 16
+	conf.Options.SenderTargetParallel = 1
+	conf.Options.SenderDelayChannelSize = 32
+	conf.Options.Psync = false
+	conf.Options.SourceAddressOptions = map[string]conf.AddressOptions{
+		"10.1.1.1:6379": {Parallel: 8, SenderCount: 256},
+	}
+
+	var nr int
+	{
+		fmt.Printf("TestShardOptions case %d.\n", nr)
+		nr++
+
+		// given in the address of the source
+		ds := withRoutines(t, &dbSyncer{source: "10.1.1.1:6379"})
+		assert.Equal(t, 8, ds.parallel(), "should be equal")
+		assert.Equal(t, uint(256), ds.senderCount(), "should be equal")
+
+		ds = &dbSyncer{source: "10.1.1.2:6379"}
+		assert.Equal(t, 64, ds.parallel(), "should be equal")
+		assert.Equal(t, uint(16), ds.senderCount(), "should be equal")
+	}
+
+	{
+		fmt.Printf("TestShardOptions case %d.\n", nr)
+		nr++
+
+		// the commands are sent once the tokens are given
+		target := startRecordTarget(t, 0)
+		defer target.Close()
+
+		var b bytes.Buffer
+		for i := 0; i < 5; i++ {
+			data, err := redis.EncodeToBytes(redis.NewCommand("set", "key", i))
+			assert.Equal(t, nil, err, "should be equal")
+			b.Write(data)
+		}
+
+		ds := withRoutines(t, &dbSyncer{id: 2918, qos: make(chan struct{}, 5)})
+		metric.AddMetric(ds.id)
+		for i := 0; i < 3; i++ {
+			ds.qos <- struct{}{}
+		}
+		r, w := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ds.syncCommand(bufio.NewReader(r), []string{target.Addr().String()}, "auth", "", nil)
+		}()
+		w.Write(b.Bytes())
+		for i := 0; i < 50 && target.count() < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, 3, target.count(), "should be equal")
+
+		ds.qos <- struct{}{}
+		ds.qos <- struct{}{}
+		for i := 0; i < 50 && target.count() < 5; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ds.stopping.Set(true)
+		w.Close()
+		<-done
+		assert.Equal(t, 5, target.count(), "should be equal")
+	}
+}
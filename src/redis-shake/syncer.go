@@ -0,0 +1,168 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"pkg/libs/log"
+	"redis-shake/configure"
+	"redis-shake/metric"
+)
+
+// the configuration of one source -> target link used by the embedded Syncer
+type SyncerConfig struct {
+	Id             int
+	Source         string   // address of the source db, sentinel and cluster address aren't parsed here
+	SourcePassword string   // password of the source
+	Target         []string // address of the target, all the nodes if the target is cluster
+	TargetPassword string   // password of the target
+
+	/*
+	 * the options of the syncer, copied in NewSyncer so each Syncer keeps its own. nil means
+	 * conf.Options. DefaultSyncerOptions returns the defaults. The helpers shared with `restore`,
+	 * e.g., the dialer, the tls files and restoring the rdb entries, as well as the log and the
+	 * metric, still read conf.Options.
+	 */
+	Options *conf.Configuration
+
+	/*
+	 * the options of the job in sync.jobs, only the options which can be given in the job file are
+	 * read from it, e.g., the filters and target.db, see conf.IsJobOption. nil means conf.Options.
+	 */
+	Job *conf.Configuration
+}
+
+/*
+ * Syncer drives one dbSyncer so the sync can be embedded into other programs without the
+ * command line and the configuration file. CmdSync runs one Syncer for each source.
+ */
+type Syncer struct {
+	config SyncerConfig
+	ds     *dbSyncer
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	started bool
+	done    chan struct{} // closed once Start returns
+}
+
+// the default options used in `sync`, the same as the defaults filled by the configuration loader
+func DefaultSyncerOptions() conf.Configuration {
+	var options conf.Configuration
+	conf.Preset(&options)
+	conf.FillDefaults(&options)
+	return options
+}
+
+func NewSyncer(config SyncerConfig) *Syncer {
+	options := &conf.Options
+	if config.Options != nil {
+		copied := *config.Options
+		options = &copied
+	}
+	s := &Syncer{
+		config: config,
+		done:   make(chan struct{}),
+		ds: NewDbSyncer(config.Id, config.Source, config.SourcePassword, config.Target, config.TargetPassword,
+			options.HttpProfile+config.Id, options),
+	}
+	if config.Job != nil {
+		s.ds.job = config.Job
+		metric.GetMetric(config.Id).SetJob(config.Job.JobName)
+	}
+	return s
+}
+
+// Start runs the sync and blocks until it's stopped by the ctx or Stop. nil is returned once
+// stopped. Stopping in the rdb phase takes effect after the rdb is loaded. The *log.Fatal is
+// returned once the syncer fails if log.SetPanicRecoverable(true), otherwise the process exits.
+func (s *Syncer) Start(ctx context.Context) error {
+	if s.config.Source == "" || len(s.config.Target) == 0 {
+		return fmt.Errorf("source and target of syncer[%v] shouldn't be empty", s.config.Id)
+	}
+
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return fmt.Errorf("syncer[%v] is already started", s.config.Id)
+	}
+	s.started = true
+	defer close(s.done)
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.ds.ctx = ctx
+	s.mu.Unlock()
+
+	defer s.cancel()
+	registerFatalEvent(s.ds)
+	defer unregisterFatalEvent(s.ds)
+	log.Infof("syncer[%v] starts syncing data from %v to %v", s.config.Id, s.config.Source, s.config.Target)
+	err := s.ds.run()
+	log.Infof("syncer[%v] stopped", s.config.Id)
+	s.ds.emit(EventStopped, "")
+	return err
+}
+
+/*
+ * Drain stops the sync and waits at most timeout for the target to reply the commands sent, the
+ * number of the commands not replied is returned. The sync waits for the replies the same way
+ * by shutdown.drain_timeout_ms after being stopped, so Drain returns as soon as the sync quits.
+ */
+func (s *Syncer) Drain(timeout time.Duration) int64 {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return 0
+	}
+
+	s.Stop()
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		log.Warnf("syncer[%v] isn't stopped in %v", s.config.Id, timeout)
+	}
+	return s.ds.unconfirmed()
+}
+
+/*
+ * Pause stops sending the increment to the target until Resume, the source link is kept. The
+ * commands read from the source are queued until the sender buffer is full, then the source is
+ * no longer read and the data piles up in the output buffer of the source.
+ */
+func (s *Syncer) Pause() {
+	s.ds.setPaused(true)
+}
+
+// Resume sending the increment paused by Pause.
+func (s *Syncer) Resume() {
+	s.ds.setPaused(false)
+}
+
+// Stop the running Start, it's fine to call it more than once.
+func (s *Syncer) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// the channel is closed once the rdb phase is done
+func (s *Syncer) WaitFull() <-chan struct{} {
+	return s.ds.waitFull
+}
+
+/*
+ * the events of the sync, e.g., the full sync is done or the source is reconnected. The events
+ * are dropped instead of blocking the sync if they aren't taken in time, see DroppedEvents.
+ */
+func (s *Syncer) Events() <-chan Event {
+	return s.ds.events
+}
+
+// number of the events dropped because nobody takes them
+func (s *Syncer) DroppedEvents() int64 {
+	return s.ds.eventsDropped.Get()
+}